@@ -6,3 +6,16 @@ import "errors"
 // ErrUserAlreadyExists is returned when a user already exists in the system.
 var ErrUserAlreadyExists = errors.New("user already exists")
 var ErrUserNotFound = errors.New("user not found")
+
+// ErrInvalidCredentials is returned by a Provider that does not accept a user's credentials
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrAccountLocked is returned for a user locked out after too many wrong passwords
+var ErrAccountLocked = errors.New("account locked")
+
+// ErrPasswordExpired is returned for a right password that has to be changed before anything
+// else is allowed
+var ErrPasswordExpired = errors.New("password expired")
+
+// ErrKeyUnchanged is returned when a user store is rekeyed with the key it already has
+var ErrKeyUnchanged = errors.New("the new key is the same as the current one")
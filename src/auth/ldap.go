@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+LDAP provider.
+
+Authenticates a user by a simple bind (RFC 4511) to the directory as the user's DN, built from
+a template such as uid={username},ou=people,dc=example,dc=com with the user name escaped as an
+attribute value (RFC 4514). The directory checks the password, so nothing is stored here.
+Each login opens its own connection: ldaps:// connects with TLS, ldap:// in the clear, which
+sends passwords unencrypted and belongs on trusted networks only. An empty password is refused
+without asking the directory, since LDAP treats a bind without one as anonymous and lets it
+succeed.
+*/
+
+const (
+	defaultLDAPPort  = "389"
+	defaultLDAPSPort = "636"
+	ldapTimeout      = 10 * time.Second
+
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// LDAPProvider binds to an LDAP directory as the user
+type LDAPProvider struct {
+	address    string
+	serverName string // For the TLS handshake
+	useTLS     bool
+	userDN     string
+}
+
+func NewLDAPProvider(directoryURL, userDN string) (*LDAPProvider, error) {
+	u, err := url.Parse(directoryURL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid LDAP URL '%s'", directoryURL)
+	}
+	provider := &LDAPProvider{address: u.Host, serverName: u.Hostname(), useTLS: u.Scheme == "ldaps", userDN: userDN}
+	if u.Port() == "" {
+		port := defaultLDAPPort
+		if provider.useTLS {
+			port = defaultLDAPSPort
+		}
+		provider.address = net.JoinHostPort(u.Hostname(), port)
+	}
+	return provider, nil
+}
+
+func (p *LDAPProvider) Name() string { return ProviderLDAP }
+
+func (p *LDAPProvider) Authenticate(username, password string) (string, error) {
+	if username == "" || password == "" {
+		return "", ErrInvalidCredentials
+	}
+	dn := strings.ReplaceAll(p.userDN, "{username}", escapeDNValue(username))
+
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	var err error
+	if p.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.address, &tls.Config{ServerName: p.serverName, MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", p.address)
+	}
+	if err != nil {
+		return "", fmt.Errorf("LDAP server %s: %w", p.address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+
+	// Each bind has its own connection, so it is always message 1
+	const messageID = 1
+	bind := berElement(0x60, // BindRequest
+		berInteger(0x02, 3),       // version
+		berString(0x04, dn),       // name
+		berString(0x80, password)) // simple authentication
+	if _, err := conn.Write(berElement(0x30, berInteger(0x02, messageID), bind)); err != nil {
+		return "", fmt.Errorf("LDAP server %s: %w", p.address, err)
+	}
+
+	resultCode, diagnostic, err := readBindResponse(bufio.NewReader(conn), messageID)
+	if err != nil {
+		return "", fmt.Errorf("LDAP server %s: %w", p.address, err)
+	}
+	switch resultCode {
+	case ldapSuccess:
+		return username, nil
+	case ldapInvalidCredentials:
+		return "", ErrInvalidCredentials
+	}
+	return "", fmt.Errorf("LDAP server %s refused the bind with result %d: %s", p.address, resultCode, diagnostic)
+}
+
+// readBindResponse reads the LDAPMessage answering a bind, returning its result code and
+// diagnostic message
+func readBindResponse(reader *bufio.Reader, messageID int64) (int64, string, error) {
+	tag, message, err := readBERElement(reader)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != 0x30 {
+		return 0, "", fmt.Errorf("unexpected LDAP message tag 0x%02x", tag)
+	}
+	tag, value, message, err := nextBERElement(message)
+	if err != nil || tag != 0x02 {
+		return 0, "", fmt.Errorf("invalid LDAP message ID")
+	}
+	if id := berIntegerValue(value); id != messageID {
+		return 0, "", fmt.Errorf("LDAP answered message %d instead of %d", id, messageID)
+	}
+	tag, response, _, err := nextBERElement(message)
+	if err != nil || tag != 0x61 {
+		return 0, "", fmt.Errorf("expected an LDAP bind response")
+	}
+	tag, value, response, err = nextBERElement(response)
+	if err != nil || tag != 0x0a {
+		return 0, "", fmt.Errorf("invalid LDAP result code")
+	}
+	resultCode := berIntegerValue(value)
+	diagnostic := ""
+	if _, _, response, err = nextBERElement(response); err == nil { // matchedDN
+		if _, value, _, err = nextBERElement(response); err == nil {
+			diagnostic = string(value)
+		}
+	}
+	return resultCode, diagnostic, nil
+}
+
+// escapeDNValue escapes a user name for use as an attribute value in a DN
+func escapeDNValue(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == ',' || c == '+' || c == '"' || c == '\\' || c == '<' || c == '>' || c == ';' || c == '=':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c == 0 || (c == '#' && i == 0) || (c == ' ' && (i == 0 || i == len(value)-1)):
+			fmt.Fprintf(&escaped, "\\%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+// BER encoding, just enough for a bind
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var digits []byte
+	for ; n > 0; n >>= 8 {
+		digits = append([]byte{byte(n)}, digits...)
+	}
+	return append([]byte{0x80 | byte(len(digits))}, digits...)
+}
+
+func berElement(tag byte, children ...[]byte) []byte {
+	var content []byte
+	for _, child := range children {
+		content = append(content, child...)
+	}
+	return append(append([]byte{tag}, berLength(len(content))...), content...)
+}
+
+func berString(tag byte, value string) []byte {
+	return append(append([]byte{tag}, berLength(len(value))...), value...)
+}
+
+func berInteger(tag byte, value int64) []byte {
+	// Two's complement, in as few bytes as keep the sign
+	content := []byte{byte(value)}
+	for rest := value >> 8; !(rest == 0 && content[0]&0x80 == 0) && !(rest == -1 && content[0]&0x80 != 0); rest >>= 8 {
+		content = append([]byte{byte(rest)}, content...)
+	}
+	return berElement(tag, content)
+}
+
+func berIntegerValue(content []byte) int64 {
+	var value int64
+	if len(content) > 0 && content[0]&0x80 != 0 {
+		value = -1
+	}
+	for _, b := range content {
+		value = value<<8 | int64(b)
+	}
+	return value
+}
+
+// readBERElement reads one element from a stream
+func readBERElement(reader *bufio.Reader) (byte, []byte, error) {
+	tag, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		count := int(first & 0x7f)
+		if count == 0 || count > 4 {
+			return 0, nil, fmt.Errorf("unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > 1<<20 {
+		return 0, nil, fmt.Errorf("LDAP message of %d bytes is too large", length)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return 0, nil, err
+	}
+	return tag, content, nil
+}
+
+// nextBERElement splits the first element off a buffer
+func nextBERElement(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag, length, offset := data[0], int(data[1]), 2
+	if data[1]&0x80 != 0 {
+		count := int(data[1] & 0x7f)
+		if count == 0 || count > 4 || len(data) < 2+count {
+			return 0, nil, nil, fmt.Errorf("unsupported BER length")
+		}
+		length = 0
+		for _, b := range data[2 : 2+count] {
+			length = length<<8 | int(b)
+		}
+		offset += count
+	}
+	if length < 0 || len(data) < offset+length {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+OIDC provider.
+
+The client sends a JWT bearer token from an OpenID Connect provider as its password. The token
+is accepted when it is signed by one of the issuer's keys (RS256, RS384, RS512, ES256 or
+ES384), its iss claim is the configured issuer, its aud claim holds the configured audience,
+and it has not expired; exp and nbf are allowed a minute of clock skew. The client is known by
+the username claim, sub unless configured otherwise. A connection string that also names a
+user must name that one.
+
+Signing keys are fetched from the JWKS URL, or from the jwks_uri the issuer publishes at
+/.well-known/openid-configuration. They are kept for an hour, and fetched again early when a
+token names a key that is not known yet, at most once a minute, so rotated keys are picked up.
+*/
+
+const (
+	oidcTimeout        = 10 * time.Second
+	oidcClockSkew      = time.Minute
+	oidcKeysTTL        = time.Hour
+	oidcMinKeysRefresh = time.Minute
+)
+
+// OIDCProvider accepts JWT bearer tokens issued by an OpenID Connect provider
+type OIDCProvider struct {
+	issuer        string
+	audience      string
+	jwksURL       string // Discovered from the issuer when empty
+	usernameClaim string
+	client        *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // By key ID
+	fetchedAt time.Time
+}
+
+func NewOIDCProvider(issuer, audience, jwksURL, usernameClaim string) *OIDCProvider {
+	return &OIDCProvider{
+		issuer:        issuer,
+		audience:      audience,
+		jwksURL:       jwksURL,
+		usernameClaim: usernameClaim,
+		client:        &http.Client{Timeout: oidcTimeout},
+	}
+}
+
+func (p *OIDCProvider) Name() string { return ProviderOIDC }
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+func (p *OIDCProvider) Authenticate(username, password string) (string, error) {
+	parts := strings.Split(password, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidCredentials // Not a JWT; a password meant for another provider
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", ErrInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+
+	key, err := p.signingKey(header.KeyID)
+	if err != nil {
+		return "", err
+	}
+	if key == nil || !verifyJWTSignature(header.Algorithm, key, parts[0]+"."+parts[1], signature) {
+		return "", ErrInvalidCredentials
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", ErrInvalidCredentials
+	}
+	if !p.claimsValid(claims, time.Now()) {
+		return "", ErrInvalidCredentials
+	}
+	identity, _ := claims[p.usernameClaim].(string)
+	if identity == "" || (username != "" && username != identity) {
+		return "", ErrInvalidCredentials
+	}
+	return identity, nil
+}
+
+// claimsValid checks the issuer, audience and validity period of a token
+func (p *OIDCProvider) claimsValid(claims map[string]interface{}, now time.Time) bool {
+	if issuer, _ := claims["iss"].(string); issuer != p.issuer {
+		return false
+	}
+	audienceFound := false
+	switch audience := claims["aud"].(type) {
+	case string:
+		audienceFound = audience == p.audience
+	case []interface{}:
+		for _, entry := range audience {
+			if entry == p.audience {
+				audienceFound = true
+			}
+		}
+	}
+	if !audienceFound {
+		return false
+	}
+	expires, ok := claims["exp"].(float64)
+	if !ok || now.Add(-oidcClockSkew).After(time.Unix(int64(expires), 0)) {
+		return false
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(notBefore), 0)) {
+		return false
+	}
+	return true
+}
+
+// signingKey returns the issuer's key with an ID, fetching the keys when they are stale or the
+// ID is new; nil when the issuer has no such key
+func (p *OIDCProvider) signingKey(keyID string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, known := p.keys[keyID]
+	age := time.Since(p.fetchedAt)
+	if (known && age < oidcKeysTTL) || (!known && p.keys != nil && age < oidcMinKeysRefresh) {
+		return key, nil
+	}
+	keys, err := p.fetchKeys()
+	if err != nil {
+		if known {
+			return key, nil // The keys are stale, but still better than refusing everyone
+		}
+		return nil, err
+	}
+	p.keys, p.fetchedAt = keys, time.Now()
+	return p.keys[keyID], nil
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// fetchKeys downloads the issuer's signing keys, discovering where they are first if needed
+func (p *OIDCProvider) fetchKeys() (map[string]crypto.PublicKey, error) {
+	if p.jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := p.getJSON(strings.TrimSuffix(p.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("OIDC issuer %s publishes no jwks_uri", p.issuer)
+		}
+		p.jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURL, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	return keys, nil
+}
+
+func (p *OIDCProvider) getJSON(url string, value interface{}) error {
+	response, err := p.client.Get(url)
+	if err != nil {
+		return fmt.Errorf("OIDC: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("OIDC: %s answered %s", url, response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(value); err != nil {
+		return fmt.Errorf("OIDC: invalid JSON from %s: %w", url, err)
+	}
+	return nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("EC key is not on its curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.KeyType)
+}
+
+// verifyJWTSignature checks a token's signature with a key of the type its algorithm needs
+func verifyJWTSignature(algorithm string, key crypto.PublicKey, signed string, signature []byte) bool {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return false // Including none and the HMAC algorithms, which need no private key to forge
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(algorithm, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(algorithm, "ES") || len(signature) != 2*size || size != hash.Size() {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+Password policy.
+
+Applies to the users of the local user store. A new password must be long enough, mix enough
+kinds of characters (lower case, upper case, digits, anything else) and not contain the user
+name. MaxFailedLogins wrong passwords in a row lock the account for LockoutDuration; while it
+is locked even the right password is refused. A password older than MaxAge, or set by someone
+else for the user to replace (MustChangePassword), has expired: it still logs in, but the
+session may only change it (see the server's handling of ErrPasswordExpired).
+*/
+
+// PasswordPolicy is what the local user store requires of passwords and logins
+type PasswordPolicy struct {
+	MinLength       int
+	MinClasses      int           // Kinds of characters a password must mix, 1 to 4
+	MaxFailedLogins int           // Wrong passwords in a row before the account locks; 0 never locks
+	LockoutDuration time.Duration // How long a locked account stays locked
+	MaxAge          time.Duration // How long a password lasts; 0 forever
+}
+
+// Check reports why a new password does not meet the policy
+func (p PasswordPolicy) Check(username, password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.MinClasses {
+		return fmt.Errorf("password must mix at least %d of: lower case letters, upper case letters, digits, other characters", p.MinClasses)
+	}
+	if len(username) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return fmt.Errorf("password must not contain the user name")
+	}
+	return nil
+}
+
+// expired reports whether a user has to change their password before doing anything else
+func (p PasswordPolicy) expired(user *User, now time.Time) bool {
+	if user.MustChangePassword {
+		return true
+	}
+	changedAt := user.PasswordChangedAt
+	if changedAt.IsZero() {
+		changedAt = user.LastModifiedAt // Users stored before passwords expired
+	}
+	return p.MaxAge > 0 && now.Sub(changedAt) > p.MaxAge
+}
@@ -0,0 +1,30 @@
+package auth
+
+/*
+	Peer authentication.
+
+	A client connected over the server's Unix domain socket runs as an OS user the kernel
+	names (see server/socket.go). The peer provider lets it in as the SyndrDB user of the same
+	name without a password, so the CLI or a sidecar on the database host needs no secret.
+	Like LDAP and OIDC users, peer users need not exist in SyndrDB. It never accepts a client
+	connected over TCP.
+*/
+
+// PeerProvider accepts a Unix socket client as the user named after its OS user
+type PeerProvider struct{}
+
+func (PeerProvider) Name() string { return ProviderPeer }
+
+// Authenticate refuses every password; peers are checked by AuthenticatePeer
+func (PeerProvider) Authenticate(username, password string) (string, error) {
+	return "", ErrInvalidCredentials
+}
+
+// AuthenticatePeer accepts the user when it is the OS user at the other end of the socket,
+// which is empty for a connection that did not come over the socket
+func (PeerProvider) AuthenticatePeer(username, peerUser string) (string, error) {
+	if peerUser == "" || username != peerUser {
+		return "", ErrInvalidCredentials
+	}
+	return username, nil
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+/*
+Authentication providers.
+
+A provider checks the user name and password of a connection string and returns who the
+client is. The server asks its providers in the order they are configured and takes the first
+that accepts the credentials, so local users can sit in front of, or behind, corporate
+identity:
+
+	local  the server's own users
+	ldap   a simple bind to an LDAP directory as the user's DN (see ldap.go)
+	oidc   the password is a JWT bearer token issued by an OpenID Connect provider (see oidc.go)
+	peer   the OS user of a client on the server's Unix socket, without a password (see peer.go)
+
+LDAP, OIDC and peer users need not exist in SyndrDB; their passwords are never stored or synced.
+*/
+
+const (
+	ProviderLocal = "local"
+	ProviderLDAP  = "ldap"
+	ProviderOIDC  = "oidc"
+	ProviderPeer  = "peer"
+
+	DefaultUsernameClaim = "sub"
+)
+
+// Provider checks credentials against one source of identity
+type Provider interface {
+	Name() string
+	// Authenticate returns the name the client is known by, or ErrInvalidCredentials when the
+	// provider does not accept the credentials. Any other error means it could not tell.
+	Authenticate(username, password string) (string, error)
+}
+
+// ProviderConfig configures the providers a server authenticates with
+type ProviderConfig struct {
+	Providers string // Comma-separated, in the order they are asked
+
+	LDAPURL    string // ldap://host[:port] or ldaps://host[:port]
+	LDAPUserDN string // DN bound as; {username} is replaced by the escaped user name
+
+	OIDCIssuer        string // Must match the tokens' iss claim
+	OIDCAudience      string // Must be one of the tokens' aud claim
+	OIDCJWKSURL       string // Signing keys; discovered from the issuer when empty
+	OIDCUsernameClaim string // Claim holding the user name
+}
+
+// Names returns the configured providers in order
+func (c ProviderConfig) Names() []string {
+	var names []string
+	for _, name := range strings.Split(c.Providers, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Validate checks the configuration before the server starts
+func (c ProviderConfig) Validate() error {
+	names := c.Names()
+	if len(names) == 0 {
+		return fmt.Errorf("-authproviders must name at least one of local, ldap, oidc, peer")
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return fmt.Errorf("-authproviders lists %s twice", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case ProviderLocal:
+		case ProviderLDAP:
+			u, err := url.Parse(c.LDAPURL)
+			if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+				return fmt.Errorf("the ldap provider requires -ldapurl as ldap://host[:port] or ldaps://host[:port]")
+			}
+			if !strings.Contains(c.LDAPUserDN, "{username}") {
+				return fmt.Errorf("the ldap provider requires -ldapuserdn containing {username}, such as uid={username},ou=people,dc=example,dc=com")
+			}
+		case ProviderOIDC:
+			u, err := url.Parse(c.OIDCIssuer)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("the oidc provider requires -oidcissuer as an http(s) URL")
+			}
+			if c.OIDCAudience == "" {
+				return fmt.Errorf("the oidc provider requires -oidcaudience")
+			}
+			if c.OIDCJWKSURL != "" {
+				if u, err := url.Parse(c.OIDCJWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+					return fmt.Errorf("invalid -oidcjwksurl '%s'", c.OIDCJWKSURL)
+				}
+			}
+		case ProviderPeer:
+		default:
+			return fmt.Errorf("unknown authentication provider '%s' (must be local, ldap, oidc or peer)", name)
+		}
+	}
+	return nil
+}
+
+// NewProviders builds the configured providers in order; local checks the server's own users
+func NewProviders(config ProviderConfig, local Provider) ([]Provider, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	var providers []Provider
+	for _, name := range config.Names() {
+		switch name {
+		case ProviderLocal:
+			providers = append(providers, local)
+		case ProviderLDAP:
+			provider, err := NewLDAPProvider(config.LDAPURL, config.LDAPUserDN)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, provider)
+		case ProviderOIDC:
+			claim := config.OIDCUsernameClaim
+			if claim == "" {
+				claim = DefaultUsernameClaim
+			}
+			providers = append(providers, NewOIDCProvider(config.OIDCIssuer, config.OIDCAudience, config.OIDCJWKSURL, claim))
+		case ProviderPeer:
+			providers = append(providers, PeerProvider{})
+		}
+	}
+	return providers, nil
+}
@@ -28,12 +28,19 @@ type User struct {
 	PasswordHash   PasswordHash
 	CreatedAt      time.Time
 	LastModifiedAt time.Time
+
+	// Login state, see password_policy.go
+	PasswordChangedAt  time.Time
+	MustChangePassword bool      // The password was set for the user, who has to replace it
+	FailedLogins       int       // Wrong passwords in a row
+	LockedUntil        time.Time // Logins are refused until then
 }
 
 type NewUser struct {
-	UserID   string
-	Username string
-	Password string
+	UserID             string
+	Username           string
+	Password           string
+	MustChangePassword bool
 }
 
 // UserStore manages secure storage of user credentials
@@ -100,39 +107,21 @@ func (s *UserStore) AddUser(user NewUser) (*User, error) {
 		}
 	}
 
-	// Generate salt
-	salt := make([]byte, 16)
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	passwordHash, err := newPasswordHash(user.Password)
+	if err != nil {
+		return nil, err
 	}
 
-	// Hash the password using Argon2id
-	// Parameters recommended by OWASP:
-	// - Time: 1
-	// - Memory: 64 * 1024 (64 MB)
-	// - Threads: 4
-	// - Key length: 32 bytes
-	timeParam := uint32(1)
-	memory := uint32(64 * 1024)
-	threads := uint8(4)
-	keyLen := uint32(32)
-	hash := argon2.IDKey([]byte(user.Password), salt, timeParam, memory, threads, keyLen)
-
 	// Create stored user
+	now := time.Now()
 	storedUser := User{
-		UserID:   user.UserID,
-		Username: user.Username,
-		PasswordHash: PasswordHash{
-			Hash:    hash,
-			Salt:    salt,
-			Method:  "argon2id",
-			Time:    timeParam,
-			Memory:  memory,
-			Threads: threads,
-			KeyLen:  keyLen,
-		},
-		CreatedAt:      time.Now(),
-		LastModifiedAt: time.Now(),
+		UserID:             user.UserID,
+		Username:           user.Username,
+		PasswordHash:       passwordHash,
+		CreatedAt:          now,
+		LastModifiedAt:     now,
+		PasswordChangedAt:  now,
+		MustChangePassword: user.MustChangePassword,
 	}
 
 	s.users = append(s.users, storedUser)
@@ -149,30 +138,17 @@ func (s *UserStore) UpdateUser(updatedUser NewUser) error {
 
 	for i, existingUser := range s.users {
 		if existingUser.Username == updatedUser.Username {
-			// Generate salt
-			salt := make([]byte, 16)
-			if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-				return fmt.Errorf("failed to generate salt: %w", err)
+			passwordHash, err := newPasswordHash(updatedUser.Password)
+			if err != nil {
+				return err
 			}
 
-			// Hash the password using Argon2id
-			timeParam := uint32(1)
-			memory := uint32(64 * 1024)
-			threads := uint8(4)
-			keyLen := uint32(32)
-			hash := argon2.IDKey([]byte(updatedUser.Password), salt, timeParam, memory, threads, keyLen)
-
 			// Update the user
-			s.users[i].PasswordHash = PasswordHash{
-				Hash:    hash,
-				Salt:    salt,
-				Method:  "argon2id",
-				Time:    timeParam,
-				Memory:  memory,
-				Threads: threads,
-				KeyLen:  keyLen,
-			}
-			s.users[i].LastModifiedAt = time.Now()
+			now := time.Now()
+			s.users[i].PasswordHash = passwordHash
+			s.users[i].LastModifiedAt = now
+			s.users[i].PasswordChangedAt = now
+			s.users[i].MustChangePassword = updatedUser.MustChangePassword
 			s.dirty = true
 
 			// Save the changes
@@ -201,3 +177,132 @@ func (s *UserStore) RemoveUser(username string) error {
 
 	return errors.New("user not found")
 }
+
+// newPasswordHash hashes a password with Argon2id and a fresh salt
+func newPasswordHash(password string) (PasswordHash, error) {
+	// Generate salt
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return PasswordHash{}, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	// Parameters recommended by OWASP:
+	// - Time: 1
+	// - Memory: 64 * 1024 (64 MB)
+	// - Threads: 4
+	// - Key length: 32 bytes
+	timeParam := uint32(1)
+	memory := uint32(64 * 1024)
+	threads := uint8(4)
+	keyLen := uint32(32)
+	return PasswordHash{
+		Hash:    argon2.IDKey([]byte(password), salt, timeParam, memory, threads, keyLen),
+		Salt:    salt,
+		Method:  "argon2id",
+		Time:    timeParam,
+		Memory:  memory,
+		Threads: threads,
+		KeyLen:  keyLen,
+	}, nil
+}
+
+// matches reports whether a password is the one the hash was made from
+func (h PasswordHash) matches(password string) bool {
+	hash := argon2.IDKey([]byte(password), h.Salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return SlowEqual(hash, h.Hash)
+}
+
+// Authenticate checks a user's password under a policy, counting wrong passwords towards a
+// lockout. It returns ErrPasswordExpired when the password is right but has to be changed.
+func (s *UserStore) Authenticate(username, password string, policy PasswordPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.findUser(username)
+	if user == nil {
+		return ErrInvalidCredentials
+	}
+	if err := s.checkPassword(user, password, policy, time.Now()); err != nil {
+		return err
+	}
+	if policy.expired(user, time.Now()) {
+		return ErrPasswordExpired
+	}
+	return nil
+}
+
+// ChangePassword replaces a user's password after checking the current one, which counts
+// towards a lockout like a login
+func (s *UserStore) ChangePassword(username, currentPassword, newPassword string, policy PasswordPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.findUser(username)
+	if user == nil {
+		return ErrInvalidCredentials
+	}
+	if err := s.checkPassword(user, currentPassword, policy, time.Now()); err != nil {
+		return err
+	}
+	if newPassword == currentPassword {
+		return fmt.Errorf("the new password must differ from the current one")
+	}
+	if err := policy.Check(username, newPassword); err != nil {
+		return err
+	}
+
+	passwordHash, err := newPasswordHash(newPassword)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	user.PasswordHash = passwordHash
+	user.LastModifiedAt = now
+	user.PasswordChangedAt = now
+	user.MustChangePassword = false
+	s.dirty = true
+	return s.Save()
+}
+
+// checkPassword verifies a password, locking the account after too many wrong ones; the
+// caller holds s.mu
+func (s *UserStore) checkPassword(user *User, password string, policy PasswordPolicy, now time.Time) error {
+	if now.Before(user.LockedUntil) {
+		return fmt.Errorf("%w: account '%s' is locked until %s", ErrAccountLocked, user.Username, user.LockedUntil.Format(time.RFC3339))
+	}
+	if user.PasswordHash.matches(password) {
+		if user.FailedLogins > 0 {
+			user.FailedLogins = 0
+			s.dirty = true
+			if err := s.Save(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	user.FailedLogins++
+	locked := policy.MaxFailedLogins > 0 && user.FailedLogins >= policy.MaxFailedLogins
+	if locked {
+		user.FailedLogins = 0
+		user.LockedUntil = now.Add(policy.LockoutDuration)
+	}
+	s.dirty = true
+	if err := s.Save(); err != nil {
+		return err
+	}
+	if locked {
+		return fmt.Errorf("%w: account '%s' is locked until %s after %d failed logins", ErrAccountLocked, user.Username, user.LockedUntil.Format(time.RFC3339), policy.MaxFailedLogins)
+	}
+	return ErrInvalidCredentials
+}
+
+// findUser returns the stored user with a name; the caller holds s.mu
+func (s *UserStore) findUser(username string) *User {
+	for i := range s.users {
+		if s.users[i].Username == username {
+			return &s.users[i]
+		}
+	}
+	return nil
+}
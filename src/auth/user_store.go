@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,20 +21,8 @@ func NewUserStore(filePath string, encryptionKeyString string) (*UserStore, erro
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	// Convert encryption key string to bytes (32 bytes for AES-256)
-	encryptionKey := []byte(encryptionKeyString)
-	if len(encryptionKey) < 32 {
-		// Pad the key if it's too short
-		paddedKey := make([]byte, 32)
-		copy(paddedKey, encryptionKey)
-		encryptionKey = paddedKey
-	} else if len(encryptionKey) > 32 {
-		// Truncate if too long
-		encryptionKey = encryptionKey[:32]
-	}
-
 	store := &UserStore{
-		encryptionKey: encryptionKey,
+		encryptionKey: storeKey(encryptionKeyString),
 		filePath:      filePath,
 		users:         []User{},
 		dirty:         false,
@@ -49,6 +38,40 @@ func NewUserStore(filePath string, encryptionKeyString string) (*UserStore, erro
 	return store, nil
 }
 
+// storeKey turns an encryption key string into the 32 bytes AES-256 needs
+func storeKey(encryptionKeyString string) []byte {
+	encryptionKey := []byte(encryptionKeyString)
+	if len(encryptionKey) < 32 {
+		// Pad the key if it's too short
+		paddedKey := make([]byte, 32)
+		copy(paddedKey, encryptionKey)
+		encryptionKey = paddedKey
+	} else if len(encryptionKey) > 32 {
+		// Truncate if too long
+		encryptionKey = encryptionKey[:32]
+	}
+	return encryptionKey
+}
+
+// Rekey encrypts the store file with a new key from now on
+func (s *UserStore) Rekey(encryptionKeyString string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newKey := storeKey(encryptionKeyString)
+	if bytes.Equal(newKey, s.encryptionKey) {
+		return ErrKeyUnchanged
+	}
+	oldKey := s.encryptionKey
+	s.encryptionKey = newKey
+	s.dirty = true
+	if err := s.Save(); err != nil {
+		s.encryptionKey = oldKey
+		return err
+	}
+	return nil
+}
+
 // Save persists the user store to disk
 func (s *UserStore) Save() error {
 	if !s.dirty {
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"syndrdb/src/helpers"
@@ -15,6 +14,10 @@ const (
 	// Page size similar to PostgreSQL's default (8KB)
 	BTreePageSize = 8192
 
+	// FormatVersion is the layout of the index files written, recorded in their metadata.
+	// Files from before it was recorded are version 1.
+	FormatVersion = 1
+
 	// Page types
 	BTreeMetaPage  = 0
 	BTreeRootPage  = 1
@@ -69,17 +72,25 @@ func (bts *BTreeService) buildBTreeFromTuples(indexName string, tuples []IndexTu
 	// Initialize the B-tree structure
 	btree := &BTreeIndex{
 		Name:       indexName,
-		FileName:   filepath.Join(bts.dataDir, indexName+".idx"),
+		FileName:   bts.paths.BTreeIndexFile(indexName),
 		PageSize:   BTreePageSize,
 		IndexField: indexField,
 	}
 
-	// Create the file
-	file, err := os.Create(btree.FileName)
+	// Build into a file of its own, renamed over the index once synced, so a crash never
+	// leaves a half written index behind
+	tmpName := btree.FileName + ".tmp"
+	file, err := os.Create(tmpName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create index file: %w", err)
 	}
 	defer file.Close()
+	built := false
+	defer func() {
+		if !built {
+			os.Remove(tmpName)
+		}
+	}()
 
 	// Calculate how many tuples can fit in a leaf page
 	// This is an estimate that should be refined based on actual key sizes
@@ -96,12 +107,12 @@ func (bts *BTreeService) buildBTreeFromTuples(indexName string, tuples []IndexTu
 	}
 
 	// Step 2: Build internal nodes bottom-up
-	rootPageNum, height, err := bts.buildInternalNodes(leafPages, file)
+	innerPages, rootPageNum, height, err := bts.buildInternalNodes(leafPages)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build internal nodes: %w", err)
 	}
 
-	// Step 3: Create and write meta page
+	// Step 3: Create the meta page
 	metaPage := BTreePage{
 		PageType:   BTreeMetaPage,
 		PageNum:    0,
@@ -111,22 +122,39 @@ func (bts *BTreeService) buildBTreeFromTuples(indexName string, tuples []IndexTu
 				// The meta entry contains metadata about the tree
 				Key: []byte{0}, // Special key for metadata
 				Value: encodeMetadata(map[string]interface{}{
-					"rootPage":   rootPageNum,
-					"height":     height,
-					"totalPages": len(leafPages) + int(height),
-					"indexField": indexField.FieldName,
-					"isUnique":   indexField.IsUnique,
-					"collation":  indexField.Collation,
-					"created":    helpers.TimeNow(),
+					"rootPage":      rootPageNum,
+					"height":        height,
+					"totalPages":    len(leafPages) + int(height),
+					"indexField":    indexField.FieldName,
+					"isUnique":      indexField.IsUnique,
+					"collation":     indexField.Collation,
+					"created":       helpers.TimeNow(),
+					"formatVersion": FormatVersion,
 				}),
 			},
 		},
 	}
 
-	// Write meta page to file
-	if err := writePage(file, 0, metaPage); err != nil {
+	// Step 4: Write every page once, in page order: the meta page, the leaves, then the inner pages
+	writer := newPageWriter(file)
+	if err := writer.write(metaPage); err != nil {
 		return nil, fmt.Errorf("failed to write meta page: %w", err)
 	}
+	for _, pages := range [][]BTreePage{leafPages, innerPages} {
+		for _, page := range pages {
+			if err := writer.write(page); err != nil {
+				return nil, fmt.Errorf("failed to write page %d: %w", page.PageNum, err)
+			}
+		}
+	}
+	if err := writer.finish(); err != nil {
+		return nil, fmt.Errorf("failed to write index file: %w", err)
+	}
+	if err := os.Rename(tmpName, btree.FileName); err != nil {
+		return nil, fmt.Errorf("failed to replace index file: %w", err)
+	}
+	built = true
+	helpers.SyncDirectory(filepath.Dir(btree.FileName))
 
 	// Update B-tree structure with final info
 	btree.RootPage = rootPageNum
@@ -201,35 +229,23 @@ func (bts *BTreeService) createLeafPages(tuples []IndexTuple, entriesPerPage int
 	return leafPages, nil
 }
 
-// buildInternalNodes builds internal nodes of the B-tree bottom-up
-func (bts *BTreeService) buildInternalNodes(leafPages []BTreePage, file *os.File) (uint32, uint16, error) {
+// buildInternalNodes builds internal nodes of the B-tree bottom-up. It sets the parent of every
+// page and marks the root, and returns the inner pages in page order; nothing is written yet.
+func (bts *BTreeService) buildInternalNodes(leafPages []BTreePage) ([]BTreePage, uint32, uint16, error) {
 	if len(leafPages) == 0 {
-		return 0, 0, fmt.Errorf("no leaf pages to build tree from")
-	}
-
-	// Write all leaf pages to the file first
-	for _, page := range leafPages {
-		if err := writePage(file, page.PageNum, page); err != nil {
-			return 0, 0, fmt.Errorf("failed to write leaf page %d: %w", page.PageNum, err)
-		}
+		return nil, 0, 0, fmt.Errorf("no leaf pages to build tree from")
 	}
 
 	// If only one leaf page, it becomes the root
 	if len(leafPages) == 1 {
 		// This is both a leaf and the root
-		rootPage := leafPages[0]
-		rootPage.PageType = BTreeRootPage
-
-		// Update the page in the file
-		if err := writePage(file, rootPage.PageNum, rootPage); err != nil {
-			return 0, 0, fmt.Errorf("failed to write root page %d: %w", rootPage.PageNum, err)
-		}
-
-		return rootPage.PageNum, 1, nil // Height = 1 (just the root)
+		leafPages[0].PageType = BTreeRootPage
+		return nil, leafPages[0].PageNum, 1, nil // Height = 1 (just the root)
 	}
 
 	// Build internal nodes level by level, starting from one level above leaves
 	currentLevel := leafPages
+	var levels [][]BTreePage
 	nextPageNum := uint32(len(leafPages) + 1) // Next available page number
 	height := uint16(1)                       // Start with height 1 (leaf level)
 
@@ -265,68 +281,46 @@ func (bts *BTreeService) buildInternalNodes(leafPages []BTreePage, file *os.File
 
 			// Add entries to link to children
 			for j := i; j < end; j++ {
-				childPage := currentLevel[j]
-
 				// Set child's parent pointer
-				childPage.ParentPage = parentPage.PageNum
-				if err := writePage(file, childPage.PageNum, childPage); err != nil {
-					return 0, 0, fmt.Errorf("failed to update child page %d: %w", childPage.PageNum, err)
-				}
+				currentLevel[j].ParentPage = parentPage.PageNum
+				childPage := currentLevel[j]
 
-				// First child is special - we use its lowest key as separator
-				if j == i {
-					// For first child, we just store the page number
-					valueBuffer := new(bytes.Buffer)
-					binary.Write(valueBuffer, binary.LittleEndian, childPage.PageNum)
-
-					entry := BTreeEntry{
-						// Use the first key of the child page as separator key
-						Key:   childPage.Entries[0].Key,
-						Value: valueBuffer.Bytes(), // Page number as the value
-					}
-					parentPage.Entries = append(parentPage.Entries, entry)
-				} else {
-					// For subsequent children, store highest key from previous child as separator
+				// The first child is keyed by its lowest key, the others by the highest key
+				// of the child before them
+				separator := childPage.Entries[0].Key
+				if j > i {
 					prevChild := currentLevel[j-1]
-					highestKey := prevChild.Entries[len(prevChild.Entries)-1].Key
-
-					valueBuffer := new(bytes.Buffer)
-					binary.Write(valueBuffer, binary.LittleEndian, childPage.PageNum)
-
-					entry := BTreeEntry{
-						Key:   highestKey,
-						Value: valueBuffer.Bytes(),
-					}
-					parentPage.Entries = append(parentPage.Entries, entry)
+					separator = prevChild.Entries[len(prevChild.Entries)-1].Key
 				}
+
+				valueBuffer := new(bytes.Buffer)
+				binary.Write(valueBuffer, binary.LittleEndian, childPage.PageNum)
+				parentPage.Entries = append(parentPage.Entries, BTreeEntry{
+					Key:   separator,
+					Value: valueBuffer.Bytes(), // Page number as the value
+				})
 			}
 
 			// Calculate free space
 			parentPage.FreeSpace = uint16(BTreePageSize - estimatePageSize(parentPage))
 
-			// Write the parent page
-			if err := writePage(file, parentPage.PageNum, parentPage); err != nil {
-				return 0, 0, fmt.Errorf("failed to write internal page %d: %w", parentPage.PageNum, err)
-			}
-
 			nextLevel = append(nextLevel, parentPage)
 			nextPageNum++
 		}
 
 		// Move up to the next level
+		levels = append(levels, nextLevel)
 		currentLevel = nextLevel
 	}
 
 	// The last page is the root
-	rootPage := currentLevel[0]
-	rootPage.PageType = BTreeRootPage
+	currentLevel[0].PageType = BTreeRootPage
 
-	// Update the root page
-	if err := writePage(file, rootPage.PageNum, rootPage); err != nil {
-		return 0, 0, fmt.Errorf("failed to write root page %d: %w", rootPage.PageNum, err)
+	innerPages := make([]BTreePage, 0, nextPageNum-uint32(len(leafPages))-1)
+	for _, level := range levels {
+		innerPages = append(innerPages, level...)
 	}
-
-	return rootPage.PageNum, height, nil
+	return innerPages, currentLevel[0].PageNum, height, nil
 }
 
 // Helper functions
@@ -388,10 +382,9 @@ func estimatePageSize(page BTreePage) int {
 	return size
 }
 
-// writePage writes a page to the file at the specified position
-func writePage(file *os.File, pageNum uint32, page BTreePage) error {
-	// Serialize the page to bytes
-	pageBuffer := new(bytes.Buffer)
+// encodePage serializes a page, padded to the page size
+func encodePage(page BTreePage) (*bytes.Buffer, error) {
+	pageBuffer := bytes.NewBuffer(make([]byte, 0, BTreePageSize))
 
 	// Write page header
 	binary.Write(pageBuffer, binary.LittleEndian, uint32(page.PageType))
@@ -414,24 +407,14 @@ func writePage(file *os.File, pageNum uint32, page BTreePage) error {
 		pageBuffer.Write(entry.Value)
 	}
 
-	// Calculate page padding (fill to page size)
-	padding := int(BTreePageSize) - pageBuffer.Len()
-	if padding > 0 {
-		pageBuffer.Write(make([]byte, padding))
-	}
-
-	// Seek to the correct position in the file
-	pos := int64(pageNum) * int64(BTreePageSize)
-	if _, err := file.Seek(pos, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to page position: %w", err)
+	// Pages are written back to back, so one that overflows would shift every page after it
+	if pageBuffer.Len() > BTreePageSize {
+		return nil, fmt.Errorf("page %d holds %d bytes, more than the page size of %d", page.PageNum, pageBuffer.Len(), BTreePageSize)
 	}
 
-	// Write the page buffer to the file
-	if _, err := pageBuffer.WriteTo(file); err != nil {
-		return fmt.Errorf("failed to write page data: %w", err)
-	}
-
-	return nil
+	// Calculate page padding (fill to page size)
+	pageBuffer.Write(make([]byte, BTreePageSize-pageBuffer.Len()))
+	return pageBuffer, nil
 }
 
 // encodeMetadata serializes metadata for storage
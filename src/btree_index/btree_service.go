@@ -2,14 +2,15 @@ package btreeindex
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 
+	"syndrdb/src/helpers"
 	"syndrdb/src/models"
 	"time"
 
@@ -59,6 +60,7 @@ type IndexTuple struct {
 // BTreeService manages the creation and use of B-tree indexes
 type BTreeService struct {
 	dataDir       string
+	paths         *helpers.PathResolver
 	maxMemorySize int64
 	logger        *zap.SugaredLogger
 }
@@ -67,17 +69,18 @@ type BTreeService struct {
 func NewBTreeService(dataDir string, maxMemorySize int64, logger *zap.SugaredLogger) *BTreeService {
 	return &BTreeService{
 		dataDir:       dataDir,
+		paths:         helpers.NewPathResolver(dataDir),
 		maxMemorySize: maxMemorySize,
 		logger:        logger,
 	}
 }
 
-// CreateIndex creates a new B-tree index for the specified field across documents in a bundle
-func (bts *BTreeService) CreateIndex(bundle *models.Bundle, fieldName string, isUnique bool) (string, error) {
+// CreateIndex creates a new B-tree index for the specified field across documents in a bundle.
+// A canceled ctx stops the scan of the bundle.
+func (bts *BTreeService) CreateIndex(ctx context.Context, bundle *models.Bundle, fieldName string, isUnique bool) (string, error) {
 	// Generate a unique index name
 
-	indexName := fmt.Sprintf("%s_%s_idx", bundle.BundleID, fieldName)
-	indexName = strings.ReplaceAll(indexName, "-", "_") // Make safe for filenames
+	indexName := helpers.BTreeIndexName(bundle.BundleID, []string{fieldName})
 
 	bts.logger.Infof("Creating index %s on field %s", indexName, fieldName)
 
@@ -87,20 +90,16 @@ func (bts *BTreeService) CreateIndex(bundle *models.Bundle, fieldName string, is
 		IsUnique:  isUnique,
 	}
 
-	// Step 1: Scan the bundle and create index tuples
-	tuples, err := bts.scanBundleAndCreateTuples(bundle, indexField)
-	if err != nil {
-		return "", fmt.Errorf("failed to scan bundle: %w", err)
-	}
-
-	bts.logger.Infof("Created %d index tuples for index %s", len(tuples), indexName)
-
 	// For small indexes, we can just sort in memory
-	if len(tuples) < 100000 { // Arbitrary threshold
+	if len(bundle.Documents) < inMemorySortLimit {
+		tuples, err := bts.scanBundleAndCreateTuples(ctx, bundle, indexField)
+		if err != nil {
+			return "", fmt.Errorf("failed to scan bundle: %w", err)
+		}
+
+		bts.logger.Infof("Created %d index tuples for index %s", len(tuples), indexName)
 		bts.logger.Debugf("Using in-memory sort for small index")
-		sort.Slice(tuples, func(i, j int) bool {
-			return bytes.Compare(tuples[i].Key, tuples[j].Key) < 0
-		})
+		tuples = SortTuples(tuples)
 
 		// Build B-tree from sorted tuples
 		btreeIndex, err := bts.buildBTreeFromTuples(indexName, tuples, indexField)
@@ -115,7 +114,7 @@ func (bts *BTreeService) CreateIndex(bundle *models.Bundle, fieldName string, is
 		return indexName, nil
 	}
 
-	// For larger datasets, use tournament sort
+	// For larger datasets, use tournament sort, fed while the bundle is still being scanned
 	bts.logger.Debugf("Using external tournament sort for large index")
 	tempDir := filepath.Join(bts.dataDir, "tmp")
 
@@ -124,18 +123,15 @@ func (bts *BTreeService) CreateIndex(bundle *models.Bundle, fieldName string, is
 	})
 	defer sorter.Cleanup()
 
-	// Add tuples to sorter
-	for _, tuple := range tuples {
-		// Create a serialized form of document reference
-		var docRef []byte
-		var buf bytes.Buffer
-		binary.Write(&buf, binary.LittleEndian, tuple.TID)
-		docRef = buf.Bytes()
-
-		if err := sorter.Add(tuple.Key, tuple.DocID, docRef); err != nil {
-			return "", fmt.Errorf("failed to add tuple to sorter: %w", err)
-		}
+	tupleCount := 0
+	err := bts.scanBundleTuples(ctx, bundle, indexField, func(batch []IndexTuple) error {
+		tupleCount += len(batch)
+		return addToSorter(sorter, batch)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to scan bundle: %w", err)
 	}
+	bts.logger.Infof("Created %d index tuples for index %s", tupleCount, indexName)
 
 	// Perform the sort
 	// Build B-tree from tournament sorted results
@@ -182,7 +178,7 @@ func (bts *BTreeService) CreateIndex(bundle *models.Bundle, fieldName string, is
 // SearchIndex searches the B-tree index for documents matching a key
 func (bts *BTreeService) SearchIndex(indexName string, key interface{}, indexField IndexField) ([]string, error) {
 	// Open the index file
-	indexPath := filepath.Join(bts.dataDir, indexName+".idx")
+	indexPath := bts.paths.BTreeIndexFile(indexName)
 	btree, err := OpenBTreeFile(indexPath, 100) // Cache up to 100 pages TODO make this configurable
 	if err != nil {
 		return nil, fmt.Errorf("failed to open index file: %w", err)
@@ -213,7 +209,7 @@ func (bts *BTreeService) SearchIndex(indexName string, key interface{}, indexFie
 // SearchIndexRange searches the B-tree index for documents with keys in a range
 func (bts *BTreeService) SearchIndexRange(indexName string, startKey, endKey interface{}, indexField IndexField) ([]string, error) {
 	// Open the index file
-	indexPath := filepath.Join(bts.dataDir, indexName+".idx")
+	indexPath := bts.paths.BTreeIndexFile(indexName)
 	btree, err := OpenBTreeFile(indexPath, 100) // Cache up to 100 pages
 	if err != nil {
 		return nil, fmt.Errorf("failed to open index file: %w", err)
@@ -255,8 +251,7 @@ func (bts *BTreeService) SearchIndexRange(indexName string, startKey, endKey int
 func (bts *BTreeService) ListIndexes(bundleID string) ([]string, error) {
 	// Implement logic to find all indexes for a bundle
 	// This could scan the index directory for files matching the bundle pattern
-	indexPattern := fmt.Sprintf("%s_*_idx.idx", bundleID)
-	matches, err := filepath.Glob(filepath.Join(bts.dataDir, indexPattern))
+	matches, err := bts.paths.BTreeIndexFiles(bundleID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list indexes: %w", err)
 	}
@@ -264,7 +259,7 @@ func (bts *BTreeService) ListIndexes(bundleID string) ([]string, error) {
 	indexNames := make([]string, 0, len(matches))
 	for _, path := range matches {
 		// Extract index name from path
-		indexNames = append(indexNames, filepath.Base(path[:len(path)-4])) // Remove .idx extension
+		indexNames = append(indexNames, helpers.IndexNameFromFile(path))
 	}
 
 	return indexNames, nil
@@ -272,28 +267,37 @@ func (bts *BTreeService) ListIndexes(bundleID string) ([]string, error) {
 
 // DropIndex removes an index
 func (bts *BTreeService) DropIndex(indexName string) error {
-	indexPath := filepath.Join(bts.dataDir, indexName+".idx")
+	indexPath := bts.paths.BTreeIndexFile(indexName)
 	return os.Remove(indexPath)
 }
 
 // scanBundleAndCreateTuples scans a bundle and extracts index tuples for the specified field
-func (bts *BTreeService) scanBundleAndCreateTuples(bundle *models.Bundle, indexField IndexField) ([]IndexTuple, error) {
-	var tuples []IndexTuple
-	var tid uint64 = 1 // Start TIDs at 1
+func (bts *BTreeService) scanBundleAndCreateTuples(ctx context.Context, bundle *models.Bundle, indexField IndexField) ([]IndexTuple, error) {
+	tuples := make([]IndexTuple, 0, len(bundle.Documents))
+	err := bts.scanBundleTuples(ctx, bundle, indexField, func(batch []IndexTuple) error {
+		tuples = append(tuples, batch...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tuples, nil
+}
 
+// scanBundleTuples is scanBundleAndCreateTuples handing the tuples on in batches, see parallel_scan.go
+func (bts *BTreeService) scanBundleTuples(ctx context.Context, bundle *models.Bundle, indexField IndexField, consume func(batch []IndexTuple) error) error {
 	// Check if field definition exists
 	_, fieldExists := bundle.DocumentStructure.FieldDefinitions[indexField.FieldName]
 	if !fieldExists {
-		return nil, fmt.Errorf("field %s not defined in bundle structure", indexField.FieldName)
+		return fmt.Errorf("field %s not defined in bundle structure", indexField.FieldName)
 	}
 
-	// Scan each document in the bundle
-	for docID, doc := range bundle.Documents {
+	return bts.scanTuples(ctx, bundle, func(docID string, doc *models.Document) (IndexTuple, bool) {
 		// Get the field from the document
 		field, exists := doc.Fields[indexField.FieldName]
 		if !exists {
 			// Skip documents that don't have this field
-			continue
+			return IndexTuple{}, false
 		}
 
 		// Extract and encode the field value
@@ -301,23 +305,16 @@ func (bts *BTreeService) scanBundleAndCreateTuples(bundle *models.Bundle, indexF
 		if err != nil {
 			bts.logger.Warnf("INDEX Builder: Failed to encode field %s for document %s: %v",
 				indexField.FieldName, docID, err)
-			continue
+			return IndexTuple{}, false
 		}
 
-		// Create index tuple
-		tuple := IndexTuple{
+		return IndexTuple{
 			Key:       key,
 			DocID:     docID,
 			BundleID:  bundle.BundleID,
-			TID:       tid,
 			KeyString: keyString,
-		}
-
-		tuples = append(tuples, tuple)
-		tid++
-	}
-
-	return tuples, nil
+		}, true
+	}, consume)
 }
 
 // encodeFieldValue encodes a field value into a byte slice suitable for B-tree sorting
@@ -404,8 +401,9 @@ func appendStringWithPrefix(buffer *bytes.Buffer, s string) {
 
 // ---------------------------------------- Multicolumn Indexing ----------------------------------------
 // CreateMulticolumnIndex creates a B-tree index for multiple fields in a bundle
-// CreateMultiColumnIndex creates a B-tree index on multiple fields, similar to PostgreSQL's multi-column indexes
-func (bts *BTreeService) CreateMultiColumnIndex(bundle *models.Bundle, indexFields []IndexField, isUnique bool) (*BTreeIndex, error) {
+// CreateMultiColumnIndex creates a B-tree index on multiple fields, similar to PostgreSQL's multi-column indexes.
+// A canceled ctx stops the scan of the bundle.
+func (bts *BTreeService) CreateMultiColumnIndex(ctx context.Context, bundle *models.Bundle, indexFields []IndexField, isUnique bool) (*BTreeIndex, error) {
 	// Generate a unique index name with all field names
 	fieldNames := make([]string, 0, len(indexFields))
 	for _, field := range indexFields {
@@ -413,26 +411,20 @@ func (bts *BTreeService) CreateMultiColumnIndex(bundle *models.Bundle, indexFiel
 	}
 	fieldNamesStr := strings.Join(fieldNames, "_")
 
-	indexName := fmt.Sprintf("%s_%s_idx", bundle.BundleID, fieldNamesStr)
-	indexName = strings.ReplaceAll(indexName, "-", "_") // Make safe for filenames
+	indexName := helpers.BTreeIndexName(bundle.BundleID, fieldNames)
 
 	bts.logger.Infof("Creating multi-column index %s on fields %s", indexName, fieldNamesStr)
 
-	// Step 1: Scan the bundle and create composite index tuples
-	tuples, err := bts.scanBundleAndCreateMultiColumnTuples(bundle, indexFields, isUnique)
-	if err != nil {
-		return nil, fmt.Errorf("failed to scan bundle for multi-column index: %w", err)
-	}
-
-	bts.logger.Infof("Created %d index tuples for multi-column index %s", len(tuples), indexName)
-
 	// For small indexes, we can just sort in memory
-	if len(tuples) < 100000 { // Arbitrary threshold
-		// TODO Update this to be a faster sort algorithm
+	if len(bundle.Documents) < inMemorySortLimit {
+		tuples, err := bts.scanBundleAndCreateMultiColumnTuples(ctx, bundle, indexFields, isUnique)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan bundle for multi-column index: %w", err)
+		}
+
+		bts.logger.Infof("Created %d index tuples for multi-column index %s", len(tuples), indexName)
 		bts.logger.Debugf("Using in-memory sort for small index")
-		sort.Slice(tuples, func(i, j int) bool {
-			return bytes.Compare(tuples[i].Key, tuples[j].Key) < 0
-		})
+		tuples = SortTuples(tuples)
 
 		// Build B-tree from sorted tuples
 		btreeIndex, err := bts.buildBTreeFromTuples(indexName, tuples, indexFields[0]) // Use first field for metadata
@@ -446,7 +438,7 @@ func (bts *BTreeService) CreateMultiColumnIndex(bundle *models.Bundle, indexFiel
 		return btreeIndex, nil
 	}
 
-	// For larger datasets, use tournament sort
+	// For larger datasets, use tournament sort, fed while the bundle is still being scanned
 	bts.logger.Debugf("Using external tournament sort for large index")
 	tempDir := filepath.Join(bts.dataDir, "tmp")
 
@@ -455,18 +447,15 @@ func (bts *BTreeService) CreateMultiColumnIndex(bundle *models.Bundle, indexFiel
 	})
 	defer sorter.Cleanup()
 
-	// Add tuples to sorter
-	for _, tuple := range tuples {
-		// Create a serialized form of document reference
-		var docRef []byte
-		var buf bytes.Buffer
-		binary.Write(&buf, binary.LittleEndian, tuple.TID)
-		docRef = buf.Bytes()
-
-		if err := sorter.Add(tuple.Key, tuple.DocID, docRef); err != nil {
-			return nil, fmt.Errorf("failed to add tuple to sorter: %w", err)
-		}
+	tupleCount := 0
+	err := bts.scanBundleMultiColumnTuples(ctx, bundle, indexFields, isUnique, func(batch []IndexTuple) error {
+		tupleCount += len(batch)
+		return addToSorter(sorter, batch)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan bundle for multi-column index: %w", err)
 	}
+	bts.logger.Infof("Created %d index tuples for multi-column index %s", tupleCount, indexName)
 
 	// Perform the sort
 	iterator, err := sorter.Sort()
@@ -508,69 +497,71 @@ func (bts *BTreeService) CreateMultiColumnIndex(bundle *models.Bundle, indexFiel
 }
 
 // scanBundleAndCreateMultiColumnTuples scans a bundle and creates composite key tuples for multi-column indexes
-func (bts *BTreeService) scanBundleAndCreateMultiColumnTuples(bundle *models.Bundle, indexFields []IndexField, isUnique bool) ([]IndexTuple, error) {
-	var tuples []IndexTuple
-	var tid uint64 = 1 // Start TIDs at 1
+func (bts *BTreeService) scanBundleAndCreateMultiColumnTuples(ctx context.Context, bundle *models.Bundle, indexFields []IndexField, isUnique bool) ([]IndexTuple, error) {
+	tuples := make([]IndexTuple, 0, len(bundle.Documents))
+	err := bts.scanBundleMultiColumnTuples(ctx, bundle, indexFields, isUnique, func(batch []IndexTuple) error {
+		tuples = append(tuples, batch...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tuples, nil
+}
 
+// scanBundleMultiColumnTuples is scanBundleAndCreateMultiColumnTuples handing the tuples on in
+// batches, see parallel_scan.go
+func (bts *BTreeService) scanBundleMultiColumnTuples(ctx context.Context, bundle *models.Bundle, indexFields []IndexField, isUnique bool, consume func(batch []IndexTuple) error) error {
 	// Verify that all fields exist in the bundle structure
 	for _, indexField := range indexFields {
 		_, fieldExists := bundle.DocumentStructure.FieldDefinitions[indexField.FieldName]
 		if !fieldExists {
-			return nil, fmt.Errorf("field %s not defined in bundle structure", indexField.FieldName)
+			return fmt.Errorf("field %s not defined in bundle structure", indexField.FieldName)
 		}
 	}
 
-	// Track unique keys if necessary
-	uniqueKeys := make(map[string]struct{})
-
-	// Scan each document in the bundle
-	for docID, doc := range bundle.Documents {
+	encode := func(docID string, doc *models.Document) (IndexTuple, bool) {
 		// Check if this document has all needed fields
-		missingField := false
 		for _, indexField := range indexFields {
-			_, exists := doc.Fields[indexField.FieldName]
-			if !exists {
-				missingField = true
-				break
+			if _, exists := doc.Fields[indexField.FieldName]; !exists {
+				// Skip documents that don't have all required fields
+				return IndexTuple{}, false
 			}
 		}
 
-		if missingField {
-			// Skip documents that don't have all required fields
-			continue
-		}
-
 		// Create composite key from all fields
-		key, keyString, err := bts.encodeCompositeKey(&doc, indexFields)
+		key, keyString, err := bts.encodeCompositeKey(doc, indexFields)
 		if err != nil {
 			bts.logger.Warnf("INDEX Builder: Failed to encode composite key for document %s: %v",
 				docID, err)
-			continue
-		}
-
-		// Check uniqueness constraint if needed
-		if isUnique {
-			if _, exists := uniqueKeys[string(key)]; exists {
-				bts.logger.Warnf("INDEX Builder: Duplicate key found for document %s, skipping", docID)
-				continue
-			}
-			uniqueKeys[string(key)] = struct{}{}
+			return IndexTuple{}, false
 		}
 
-		// Create index tuple
-		tuple := IndexTuple{
+		return IndexTuple{
 			Key:       key,
 			DocID:     docID,
 			BundleID:  bundle.BundleID,
-			TID:       tid,
 			KeyString: keyString,
-		}
-
-		tuples = append(tuples, tuple)
-		tid++
+		}, true
+	}
+	if !isUnique {
+		return bts.scanTuples(ctx, bundle, encode, consume)
 	}
 
-	return tuples, nil
+	// Uniqueness is checked as batches arrive, on one goroutine
+	uniqueKeys := make(map[string]struct{})
+	return bts.scanTuples(ctx, bundle, encode, func(batch []IndexTuple) error {
+		kept := batch[:0]
+		for _, tuple := range batch {
+			if _, exists := uniqueKeys[string(tuple.Key)]; exists {
+				bts.logger.Warnf("INDEX Builder: Duplicate key found for document %s, skipping", tuple.DocID)
+				continue
+			}
+			uniqueKeys[string(tuple.Key)] = struct{}{}
+			kept = append(kept, tuple)
+		}
+		return consume(kept)
+	})
 }
 
 // encodeCompositeKey creates a single key from multiple field values for multi-column indexes
@@ -611,7 +602,7 @@ func (bts *BTreeService) encodeCompositeKey(doc *models.Document, indexFields []
 // SearchMultiColumnIndex searches the B-tree index using multiple field values
 func (bts *BTreeService) SearchMultiColumnIndex(indexName string, fieldValues []interface{}, indexFields []IndexField) ([]string, error) {
 	// Open the index file
-	indexPath := filepath.Join(bts.dataDir, indexName+".idx")
+	indexPath := bts.paths.BTreeIndexFile(indexName)
 	btree, err := OpenBTreeFile(indexPath, 100) // Cache up to 100 pages
 	if err != nil {
 		return nil, fmt.Errorf("failed to open index file: %w", err)
@@ -700,7 +691,7 @@ func (bts *BTreeService) SearchMultiColumnRange(
 	indexFields []IndexField,
 ) ([]string, error) {
 	// Open the index file
-	indexPath := filepath.Join(bts.dataDir, indexName+".idx")
+	indexPath := bts.paths.BTreeIndexFile(indexName)
 	btree, err := OpenBTreeFile(indexPath, 100) // Cache up to 100 pages
 	if err != nil {
 		return nil, fmt.Errorf("failed to open index file: %w", err)
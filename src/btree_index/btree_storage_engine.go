@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"syndrdb/src/protocol"
 )
 
 /*
@@ -119,6 +120,10 @@ func OpenBTreeFile(path string, cacheSize int) (*BTreeFile, error) {
 		file.Close()
 		return nil, fmt.Errorf("failed to decode metadata: %w", err)
 	}
+	if metadata.version > FormatVersion {
+		file.Close()
+		return nil, protocol.Errorf(protocol.ErrNewerFormat, "index has format version %d; this server reads versions 1 to %d", metadata.version, FormatVersion)
+	}
 
 	btree.metaPage = metaPage
 	btree.rootPageNum = metadata.rootPage
@@ -127,6 +132,43 @@ func OpenBTreeFile(path string, cacheSize int) (*BTreeFile, error) {
 	return btree, nil
 }
 
+// VerifyIndexFile checks that an index file's metadata decodes and its root page can be read.
+// It returns the field recorded in the metadata (the first field of a multi-column index).
+func VerifyIndexFile(path string) (string, error) {
+	btree, err := OpenBTreeFile(path, 1)
+	if err != nil {
+		return "", err
+	}
+	defer btree.Close()
+
+	metadata, err := decodeMetadata(btree.metaPage.Entries[0].Value)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	if metadata.totalPages > 0 && metadata.rootPage >= metadata.totalPages {
+		return "", fmt.Errorf("root page %d is past the last page %d", metadata.rootPage, metadata.totalPages-1)
+	}
+	if _, err := btree.readPage(metadata.rootPage); err != nil {
+		return "", fmt.Errorf("failed to read root page: %w", err)
+	}
+	return metadata.indexField, nil
+}
+
+// IndexFileVersion returns the format version of an index file
+func IndexFileVersion(path string) (int, error) {
+	btree, err := OpenBTreeFile(path, 1)
+	if err != nil {
+		return 0, err
+	}
+	defer btree.Close()
+
+	metadata, err := decodeMetadata(btree.metaPage.Entries[0].Value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	return metadata.version, nil
+}
+
 // Close closes the B-tree file
 func (bt *BTreeFile) Close() error {
 	bt.Lock()
@@ -604,11 +646,12 @@ type btreeMetadata struct {
 	isUnique   bool
 	collation  string
 	created    string
+	version    int
 }
 
 // decodeMetadata decodes metadata from bytes
 func decodeMetadata(data []byte) (btreeMetadata, error) {
-	result := btreeMetadata{}
+	result := btreeMetadata{version: 1}
 	buffer := bytes.NewReader(data)
 
 	// Read number of items
@@ -667,6 +710,8 @@ func decodeMetadata(data []byte) (btreeMetadata, error) {
 			result.collation = value
 		case "created":
 			result.created = value
+		case "formatVersion":
+			fmt.Sscanf(value, "%d", &result.version)
 		}
 	}
 
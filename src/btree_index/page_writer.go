@@ -0,0 +1,58 @@
+package btreeindex
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+/*
+	Buffered page writes for index builds.
+
+	A new index file is written front to back, every page once and in page order, so
+	instead of seeking and writing 8KB per page, pageWriter gathers pages in a buffer of
+	pageWriteBufferSize and writes it out in one call whenever it fills. The file is synced
+	once, in finish, after the last page: an index is only used once its build returned, so
+	there is no earlier point at which part of the file has to be on disk.
+*/
+
+// pageWriteBufferSize is how much of the index file is gathered before it is written out
+const pageWriteBufferSize = 1 << 20
+
+// pageWriter writes the pages of a new index file in page order
+type pageWriter struct {
+	file   *os.File
+	buffer *bufio.Writer
+	next   uint32 // Page number the next page must have
+}
+
+func newPageWriter(file *os.File) *pageWriter {
+	return &pageWriter{file: file, buffer: bufio.NewWriterSize(file, pageWriteBufferSize)}
+}
+
+// write appends a page to the file; pages must come in page order with none left out
+func (w *pageWriter) write(page BTreePage) error {
+	if page.PageNum != w.next {
+		return fmt.Errorf("page %d written out of order, expected page %d", page.PageNum, w.next)
+	}
+	pageBuffer, err := encodePage(page)
+	if err != nil {
+		return err
+	}
+	if _, err := pageBuffer.WriteTo(w.buffer); err != nil {
+		return fmt.Errorf("failed to write page data: %w", err)
+	}
+	w.next++
+	return nil
+}
+
+// finish writes out what is buffered and syncs the file
+func (w *pageWriter) finish() error {
+	if err := w.buffer.Flush(); err != nil {
+		return fmt.Errorf("failed to write page data: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync index file: %w", err)
+	}
+	return nil
+}
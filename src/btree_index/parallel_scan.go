@@ -0,0 +1,149 @@
+package btreeindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"syndrdb/src/models"
+	"syndrdb/src/workers"
+)
+
+/*
+	Parallel bundle scans for index builds.
+
+	Building an index starts by reading every document of the bundle and encoding its key.
+	The document IDs are split into chunks of scanChunkSize, which goroutines encode side by
+	side, each chunk on a worker of the index_build pool (see workers/pool.go), so builds
+	running at once share its workers. Each chunk's tuples are handed on as one batch, on the
+	goroutine that started the scan, as soon as they are ready: small indexes collect them for
+	an in-memory sort, large ones add them to the tournament sorter, which flushes its sorted
+	runs while later chunks are still being encoded. TIDs are numbered in the order batches
+	arrive; map iteration made that order arbitrary before too.
+*/
+
+// scanChunkSize is how many documents one goroutine encodes at a time
+const scanChunkSize = 4096
+
+// inMemorySortLimit is the document count from which an index build sorts externally
+const inMemorySortLimit = 100000
+
+// tupleEncoder turns a document into its index tuple; ok is false for a document left out
+type tupleEncoder func(docID string, doc *models.Document) (tuple IndexTuple, ok bool)
+
+// scanWorkers is how many goroutines encode the keys of a bundle with this many documents
+func scanWorkers(documents int) int {
+	chunks := (documents + scanChunkSize - 1) / scanChunkSize
+	return max(1, min(workers.IndexBuild.Size(), chunks))
+}
+
+// scanTuples encodes the documents of a bundle on several goroutines and hands their tuples
+// to consume in batches. An error from consume, or ctx being canceled, stops the scan and is
+// returned.
+func (bts *BTreeService) scanTuples(ctx context.Context, bundle *models.Bundle, encode tupleEncoder, consume func(batch []IndexTuple) error) error {
+	docIDs := make([]string, 0, len(bundle.Documents))
+	for docID := range bundle.Documents {
+		docIDs = append(docIDs, docID)
+	}
+	scanners := scanWorkers(len(docIDs))
+
+	chunks := make(chan []string)
+	batches := make(chan []IndexTuple, scanners)
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(done) }) }
+
+	go func() {
+		defer close(chunks)
+		for start := 0; start < len(docIDs); start += scanChunkSize {
+			select {
+			case chunks <- docIDs[start:min(start+scanChunkSize, len(docIDs))]:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var failure error
+	var failureMu sync.Mutex
+	var wg sync.WaitGroup
+	for range scanners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				// A key that cannot be encoded fails the build instead of leaving it short
+				if recovered := recover(); recovered != nil {
+					bts.logger.Errorw("Recovered from a panic", "task", "encoding index keys of bundle "+bundle.Name, "panic", recovered, "stack", string(debug.Stack()))
+					failureMu.Lock()
+					failure = fmt.Errorf("internal error encoding index keys: %v", recovered)
+					failureMu.Unlock()
+					stop()
+				}
+			}()
+			for chunk := range chunks {
+				batch := encodeChunk(bundle, chunk, encode)
+				select {
+				case batches <- batch:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(batches)
+	}()
+
+	var err error
+	var tid uint64 = 1 // Start TIDs at 1
+	for batch := range batches {
+		if err != nil {
+			continue
+		}
+		for i := range batch {
+			batch[i].TID = tid
+			tid++
+		}
+		if err = ctx.Err(); err == nil {
+			err = consume(batch)
+		}
+		if err != nil {
+			stop()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return failure
+}
+
+// encodeChunk encodes the tuples of a chunk of documents on a worker of the index_build pool
+func encodeChunk(bundle *models.Bundle, chunk []string, encode tupleEncoder) []IndexTuple {
+	release := workers.IndexBuild.Acquire()
+	defer release()
+
+	batch := make([]IndexTuple, 0, len(chunk))
+	for _, docID := range chunk {
+		doc := bundle.Documents[docID]
+		if tuple, ok := encode(docID, &doc); ok {
+			batch = append(batch, tuple)
+		}
+	}
+	return batch
+}
+
+// addToSorter hands a batch of tuples to the tournament sorter, with the TID as extra data
+func addToSorter(sorter *TournamentSorter, batch []IndexTuple) error {
+	for _, tuple := range batch {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, tuple.TID)
+		if err := sorter.Add(tuple.Key, tuple.DocID, buf.Bytes()); err != nil {
+			return fmt.Errorf("failed to add tuple to sorter: %w", err)
+		}
+	}
+	return nil
+}
@@ -33,10 +33,10 @@ func ExampleUsage() {
 	// Use the iterator to build the B-tree index
 	count := 0
 	for {
-		// kv, ok := iter.Next()
-		// if !ok {
-		// 	break
-		// }
+		_, ok := iter.Next()
+		if !ok {
+			break
+		}
 
 		// Here you would add the entry to your B-tree
 		// btree.Insert(kv.Key, kv.DocID, kv.ExtraData)
@@ -0,0 +1,48 @@
+package btreeindex
+
+import (
+	"bytes"
+	"slices"
+)
+
+/*
+	In-memory sort of index tuples.
+
+	Index builds below inMemorySortLimit documents sort their tuples by encoded key in
+	memory. Rather than have sort.Slice swap whole tuples through reflection, the sort runs
+	pdqsort (slices.SortFunc) over small entries holding each tuple's already encoded key and
+	its position, then places the tuples once in their sorted order. Keys are compared with
+	bytes.Compare as before; tuples with equal keys come in no set order. syndrbench -micro
+	measures it against the sort.Slice it replaced.
+*/
+
+// tupleSortEntry is a tuple's place in the sort: its key and where the tuple is
+type tupleSortEntry struct {
+	key   []byte
+	index int
+}
+
+// SortTuples returns the tuples ordered by key
+func SortTuples(tuples []IndexTuple) []IndexTuple {
+	entries := make([]tupleSortEntry, len(tuples))
+	for i := range tuples {
+		entries[i] = tupleSortEntry{key: tuples[i].Key, index: i}
+	}
+
+	slices.SortFunc(entries, func(a, b tupleSortEntry) int {
+		return bytes.Compare(a.key, b.key)
+	})
+
+	sorted := make([]IndexTuple, len(tuples))
+	for i, entry := range entries {
+		sorted[i] = tuples[entry.index]
+	}
+	return sorted
+}
+
+// EncodeKey encodes a string or integer field value as an index key, for tuples built outside
+// an index such as syndrbench's
+func EncodeKey(value interface{}) ([]byte, error) {
+	key, _, err := (&BTreeService{}).encodeFieldValue(value, IndexField{})
+	return key, err
+}
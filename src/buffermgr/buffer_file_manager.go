@@ -1,6 +1,7 @@
 package buffermgr
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,15 +10,15 @@ import (
 	"go.uber.org/zap"
 )
 
-// FileManager handles files on disk
+// FileManager handles files on disk. Its fileIDs are those of the buffer pool's file
+// registry, which reads and writes the pages.
 type FileManager struct {
-	mu            sync.Mutex
-	openFiles     map[uint32]*os.File
-	dataDir       string
-	bufferPool    *BufferPool
-	fileIDCounter uint32
-	fileIDMap     map[string]uint32 // Maps filenames to fileIDs
-	logger        *zap.SugaredLogger
+	mu         sync.Mutex
+	openFiles  map[uint32]*os.File
+	dataDir    string
+	bufferPool *BufferPool
+	fileIDMap  map[string]uint32 // Maps filenames to fileIDs
+	logger     *zap.SugaredLogger
 }
 
 // NewFileManager creates a new file manager
@@ -29,12 +30,11 @@ func NewFileManager(dataDir string, bufferPool *BufferPool, logger *zap.SugaredL
 	}
 
 	return &FileManager{
-		openFiles:     make(map[uint32]*os.File),
-		dataDir:       dataDir,
-		bufferPool:    bufferPool,
-		fileIDCounter: 1, // Start from 1, 0 is reserved
-		fileIDMap:     make(map[string]uint32),
-		logger:        logger,
+		openFiles:  make(map[uint32]*os.File),
+		dataDir:    dataDir,
+		bufferPool: bufferPool,
+		fileIDMap:  make(map[string]uint32),
+		logger:     logger,
 	}, nil
 }
 
@@ -43,17 +43,21 @@ func (fm *FileManager) GetFileID(filename string) (uint32, error) {
 	fm.mu.Lock()
 	defer fm.mu.Unlock()
 
+	return fm.fileIDLocked(filename)
+}
+
+// fileIDLocked returns the fileID the buffer pool's registry gives a filename
+func (fm *FileManager) fileIDLocked(filename string) (uint32, error) {
 	// Check if we already have a fileID for this filename
 	fileID, exists := fm.fileIDMap[filename]
 	if exists {
 		return fileID, nil
 	}
 
-	// Assign a new fileID
-	fileID = fm.fileIDCounter
-	fm.fileIDCounter++
-
-	// Add to the map
+	fileID, err := fm.bufferPool.RegisterFile(filename)
+	if err != nil {
+		return 0, err
+	}
 	fm.fileIDMap[filename] = fileID
 
 	return fileID, nil
@@ -70,11 +74,9 @@ func (fm *FileManager) OpenFile(filename string) (uint32, error) {
 	defer fm.mu.Unlock()
 
 	// Get or create a fileID
-	fileID, exists := fm.fileIDMap[filename]
-	if !exists {
-		fileID = fm.fileIDCounter
-		fm.fileIDCounter++
-		fm.fileIDMap[filename] = fileID
+	fileID, err := fm.fileIDLocked(filename)
+	if err != nil {
+		return 0, err
 	}
 
 	// Check if file is already open
@@ -96,7 +98,7 @@ func (fm *FileManager) OpenFile(filename string) (uint32, error) {
 }
 
 // ReadPage reads a page through the buffer manager
-func (fm *FileManager) ReadPage(fileID uint32, blockNum uint32) (*DBPageBuffer, error) {
+func (fm *FileManager) ReadPage(ctx context.Context, fileID uint32, blockNum uint32) (*DBPageBuffer, error) {
 	// Get the file handle
 	fm.mu.Lock()
 	_, exists := fm.openFiles[fileID]
@@ -107,7 +109,30 @@ func (fm *FileManager) ReadPage(fileID uint32, blockNum uint32) (*DBPageBuffer,
 	}
 
 	// Get the page through the buffer pool
-	return fm.bufferPool.GetPage(fileID, blockNum)
+	return fm.bufferPool.GetPage(ctx, fileID, blockNum)
+}
+
+// NewPage returns a zeroed page through the buffer manager, for a page written whole
+func (fm *FileManager) NewPage(fileID uint32, blockNum uint32) (*DBPageBuffer, error) {
+	fm.mu.Lock()
+	_, exists := fm.openFiles[fileID]
+	fm.mu.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("no open file with ID %d", fileID)
+	}
+
+	return fm.bufferPool.NewPage(fileID, blockNum)
+}
+
+// FlushFile writes the dirty pages of a file to disk
+func (fm *FileManager) FlushFile(fileID uint32) error {
+	return fm.bufferPool.FlushFile(fileID)
+}
+
+// PageSize returns the size of the pages the buffer manager reads and writes
+func (fm *FileManager) PageSize() int {
+	return fm.bufferPool.pageSize
 }
 
 // ReleasePage decrements the reference count for a buffer
@@ -120,6 +145,20 @@ func (fm *FileManager) WritePage(buffer *DBPageBuffer) {
 	fm.bufferPool.MarkBufferDirty(buffer)
 }
 
+// WritePageLSN marks a page as dirty with a change logged at lsn; it is not written before
+// the WAL is durable up to lsn
+func (fm *FileManager) WritePageLSN(buffer *DBPageBuffer, lsn uint64) {
+	fm.bufferPool.MarkBufferDirtyLSN(buffer, lsn)
+}
+
+// SyncAll writes the dirty pages of every file and syncs the files
+func (fm *FileManager) SyncAll() error {
+	if err := fm.bufferPool.FlushAllDirty(); err != nil {
+		return fmt.Errorf("could not flush dirty buffers: %w", err)
+	}
+	return fm.bufferPool.SyncFiles()
+}
+
 // Close closes all open files
 func (fm *FileManager) Close() error {
 	fm.mu.Lock()
@@ -1,9 +1,12 @@
 package buffermgr
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"syndrdb/src/protocol"
+	"syndrdb/src/workers"
 	"time"
 
 	"go.uber.org/zap"
@@ -50,11 +53,20 @@ type DBPageBuffer struct {
 	// For dirty buffer management
 	IsDirty      bool
 	LastModified time.Time
+	LSN          uint64 // Of the last WAL record that changed the page; 0 for changes not logged
 
 	// For clock sweep algorithm
 	Referenced bool
 }
 
+// WAL is the write-ahead log the pool's pages are changed behind. A page is not written to
+// its file before the log is durable up to the LSN of the last record that changed it, so a
+// crash never leaves a change on disk that the log cannot redo or explain.
+type WAL interface {
+	FlushedLSN() uint64     // The log is durable up to this LSN
+	Flush(lsn uint64) error // Makes the log durable up to at least lsn
+}
+
 // BufferDescriptor holds metadata about a buffer
 type BufferDescriptor struct {
 	ID         int       // Buffer ID
@@ -86,9 +98,17 @@ type BufferPool struct {
 	writeCount   uint64 // Track total writes
 	syncInterval int    // How often to sync (every N writes)
 
+	// Moving average of how long a page write (including any sync) takes; a slow disk shows up here
+	latencyMu    sync.Mutex
+	writeLatency time.Duration
+
 	// File management
 	fileRegistry *FileRegistry
 
+	// Pages are written behind it, see WAL; nil when their changes are not logged
+	wal        WAL
+	walFlushes uint64 // Page writes that had to flush the log first
+
 	logger *zap.SugaredLogger
 }
 
@@ -133,19 +153,46 @@ func NewBufferPool(bufferCount int, pageSize int, fileRegistry *FileRegistry, lo
 	return pool
 }
 
-// GetPage retrieves a page from the buffer pool, reading from disk if necessary
-func (bp *BufferPool) GetPage(fileID uint32, blockNum uint32) (*DBPageBuffer, error) {
-	tag := BufferTag{
-		FileID:      fileID,
-		BlockNumber: blockNum,
+// SetWAL makes the pool write pages only behind wal
+func (bp *BufferPool) SetWAL(wal WAL) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.wal = wal
+}
+
+// RegisterFile registers a file, by its path in the data directory, with the pool's file
+// registry and returns the fileID its pages are tagged with
+func (bp *BufferPool) RegisterFile(filePath string) (uint32, error) {
+	return bp.fileRegistry.RegisterFile(filePath)
+}
+
+// GetPage retrieves a page from the buffer pool, reading from disk if necessary. A canceled
+// ctx fails it before it reads anything, so a scan stops between one page and the next.
+func (bp *BufferPool) GetPage(ctx context.Context, fileID uint32, blockNum uint32) (*DBPageBuffer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	return bp.pinPage(BufferTag{FileID: fileID, BlockNumber: blockNum}, true)
+}
+
+// NewPage returns a zeroed buffer for a page about to be written whole, such as one past the
+// end of its file, without reading it from disk
+func (bp *BufferPool) NewPage(fileID uint32, blockNum uint32) (*DBPageBuffer, error) {
+	return bp.pinPage(BufferTag{FileID: fileID, BlockNumber: blockNum}, false)
+}
 
+// pinPage returns the buffer holding a page, pinned, reading the page from disk when it is not
+// in the pool and read is set; otherwise the buffer is zeroed
+func (bp *BufferPool) pinPage(tag BufferTag, read bool) (*DBPageBuffer, error) {
 	// First, try to find the page in the buffer pool
 	buffer, found := bp.lookupBuffer(tag)
 	if found {
 		bp.hits++
 		buffer.Referenced = true
 		buffer.UsageCount++
+		if !read {
+			clear(buffer.Data)
+		}
 		return buffer, nil
 	}
 
@@ -183,7 +230,11 @@ func (bp *BufferPool) GetPage(fileID uint32, blockNum uint32) (*DBPageBuffer, er
 	bp.hashTable[tag] = bufferID
 
 	// Read the page from disk
-	err = bp.readPageFromDisk(fileID, blockNum, buffer)
+	if read {
+		err = bp.readPageFromDisk(tag.FileID, tag.BlockNumber, buffer)
+	} else {
+		clear(buffer.Data)
+	}
 	if err != nil {
 		// Revert the hash table changes on failure
 		delete(bp.hashTable, tag)
@@ -199,6 +250,7 @@ func (bp *BufferPool) GetPage(fileID uint32, blockNum uint32) (*DBPageBuffer, er
 	buffer.UsageCount = 1
 	buffer.Referenced = true
 	buffer.IsDirty = false
+	buffer.LSN = 0
 
 	// Update descriptor
 	bp.descriptors[bufferID].Tag = tag
@@ -273,7 +325,7 @@ func (bp *BufferPool) findFreeBuffer() (int, error) {
 
 		// If we've gone through all buffers and found none to evict
 		if bp.clockHand == startHand {
-			return 0, errors.New("all buffers are in use, cannot evict any")
+			return 0, protocol.Errorf(protocol.ErrBufferPoolFull, "all buffers are in use, cannot evict any")
 		}
 
 		return bufferID, nil
@@ -282,6 +334,9 @@ func (bp *BufferPool) findFreeBuffer() (int, error) {
 
 // writeBufferToDisk writes a dirty buffer back to its file
 func (bp *BufferPool) writeBufferToDisk(buffer *DBPageBuffer) error {
+	started := time.Now()
+	defer func() { bp.recordWriteLatency(time.Since(started)) }()
+
 	bp.logger.Debugf("Writing buffer %d (file %d, block %d) to disk",
 		buffer.ID, buffer.Tag.FileID, buffer.Tag.BlockNumber)
 
@@ -293,6 +348,15 @@ func (bp *BufferPool) writeBufferToDisk(buffer *DBPageBuffer) error {
 	}
 	// We don't need to close the file as it's managed by the registry
 
+	// The records that changed the page go to disk before it does
+	if bp.wal != nil && buffer.LSN > bp.wal.FlushedLSN() {
+		if err := bp.wal.Flush(buffer.LSN); err != nil {
+			return fmt.Errorf("failed to flush the WAL to LSN %d before block %d: %w",
+				buffer.LSN, buffer.Tag.BlockNumber, err)
+		}
+		atomic.AddUint64(&bp.walFlushes, 1)
+	}
+
 	// Acquire a write lock on the file
 	file.Lock()
 	defer file.Unlock()
@@ -320,8 +384,8 @@ func (bp *BufferPool) writeBufferToDisk(buffer *DBPageBuffer) error {
 	buffer.IsDirty = false
 	buffer.LastModified = time.Now()
 
-	// Update write statistics
-	bp.writeCount++
+	// Update write statistics; buffers are flushed in parallel
+	writes := atomic.AddUint64(&bp.writeCount, 1)
 
 	// Sync based on policy
 	if bp.fileRegistry.ShouldSyncWrites() {
@@ -329,7 +393,7 @@ func (bp *BufferPool) writeBufferToDisk(buffer *DBPageBuffer) error {
 		if err := file.Sync(); err != nil {
 			return fmt.Errorf("failed to sync file: %w", err)
 		}
-	} else if bp.syncInterval > 0 && bp.writeCount%uint64(bp.syncInterval) == 0 {
+	} else if bp.syncInterval > 0 && writes%uint64(bp.syncInterval) == 0 {
 		// Sync every N writes
 		if err := file.Sync(); err != nil {
 			bp.logger.Warnf("Failed to perform interval sync on fileID %d: %v",
@@ -341,6 +405,18 @@ func (bp *BufferPool) writeBufferToDisk(buffer *DBPageBuffer) error {
 	return nil
 }
 
+// recordWriteLatency folds one page write into the moving average, weighting it by 1/8
+func (bp *BufferPool) recordWriteLatency(elapsed time.Duration) {
+	bp.latencyMu.Lock()
+	defer bp.latencyMu.Unlock()
+
+	if bp.writeLatency == 0 {
+		bp.writeLatency = elapsed
+		return
+	}
+	bp.writeLatency += (elapsed - bp.writeLatency) / 8
+}
+
 // readPageFromDisk reads a page from disk into a buffer
 func (bp *BufferPool) readPageFromDisk(fileID uint32, blockNum uint32, buffer *DBPageBuffer) error {
 	// Get the file handle from the file registry
@@ -400,23 +476,98 @@ func (bp *BufferPool) MarkBufferDirty(buffer *DBPageBuffer) {
 	buffer.LastModified = time.Now()
 }
 
+// MarkBufferDirtyLSN marks a buffer as dirty with a change logged at lsn, which the WAL is
+// flushed to before the buffer is written
+func (bp *BufferPool) MarkBufferDirtyLSN(buffer *DBPageBuffer, lsn uint64) {
+	buffer.Mu.Lock()
+	defer buffer.Mu.Unlock()
+
+	buffer.IsDirty = true
+	buffer.LastModified = time.Now()
+	buffer.LSN = max(buffer.LSN, lsn)
+}
+
+// SyncFiles syncs the files the pool has written pages to
+func (bp *BufferPool) SyncFiles() error {
+	return bp.fileRegistry.SyncAllFiles()
+}
+
+// FlushFile writes the dirty buffers of one file to disk
+func (bp *BufferPool) FlushFile(fileID uint32) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for _, buffer := range bp.buffers {
+		if buffer.State != BufferStateInvalid && buffer.IsDirty && buffer.Tag.FileID == fileID {
+			if err := bp.writeBufferToDisk(buffer); err != nil {
+				return fmt.Errorf("error flushing buffer %d: %w", buffer.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
 // FlushAllDirty writes all dirty buffers to disk
 func (bp *BufferPool) FlushAllDirty() error {
 	bp.mu.Lock()
 	defer bp.mu.Unlock()
+	return bp.flushAllDirtyLocked()
+}
+
+// TryFlushAllDirty flushes like FlushAllDirty unless the pool is busy, as it stays when a
+// panic interrupted one of its operations; it reports whether it flushed
+func (bp *BufferPool) TryFlushAllDirty() (bool, error) {
+	if !bp.mu.TryLock() {
+		return false, nil
+	}
+	defer bp.mu.Unlock()
+	return true, bp.flushAllDirtyLocked()
+}
 
+// flushAllDirtyLocked writes the dirty buffers on the workers of the background_writer pool
+// (see workers/pool.go) and returns the first error; the rest are still written
+func (bp *BufferPool) flushAllDirtyLocked() error {
+	var dirty []*DBPageBuffer
 	for i := 0; i < bp.maxBuffers; i++ {
 		buffer := bp.buffers[i]
-
 		if buffer.State != BufferStateInvalid && buffer.IsDirty {
-			err := bp.writeBufferToDisk(buffer)
-			if err != nil {
-				return fmt.Errorf("error flushing buffer %d: %w", i, err)
-			}
+			dirty = append(dirty, buffer)
 		}
 	}
-
-	return nil
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	writers := min(workers.BackgroundWriter.Size(), len(dirty))
+	pending := make(chan *DBPageBuffer, len(dirty))
+	for _, buffer := range dirty {
+		pending <- buffer
+	}
+	close(pending)
+
+	var firstErr error
+	var errMu sync.Mutex
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for buffer := range pending {
+				release := workers.BackgroundWriter.Acquire()
+				err := bp.writeBufferToDisk(buffer)
+				release()
+				if err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("error flushing buffer %d: %w", buffer.ID, err)
+					}
+					errMu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
 }
 
 // Stats returns statistics about the buffer pool
@@ -428,6 +579,8 @@ type BufferStats struct {
 	Misses       uint64
 	HitRatio     float64
 	Evictions    uint64
+	DirtyRatio   float64       // DirtyBuffers / TotalBuffers
+	WriteLatency time.Duration // Moving average of a page write to disk
 }
 
 // GetStats returns statistics about the buffer pool
@@ -453,6 +606,13 @@ func (bp *BufferPool) GetStats() BufferStats {
 		}
 	}
 
+	if stats.TotalBuffers > 0 {
+		stats.DirtyRatio = float64(stats.DirtyBuffers) / float64(stats.TotalBuffers)
+	}
+	bp.latencyMu.Lock()
+	stats.WriteLatency = bp.writeLatency
+	bp.latencyMu.Unlock()
+
 	totalRequests := stats.Hits + stats.Misses
 	if totalRequests > 0 {
 		stats.HitRatio = float64(stats.Hits) / float64(totalRequests)
@@ -461,6 +621,80 @@ func (bp *BufferPool) GetStats() BufferStats {
 	return stats
 }
 
+// BufferInternals is the buffer pool's state in more detail than BufferStats, for diagnostics
+type BufferInternals struct {
+	BufferStats
+	PageSize      int
+	ClockHand     int            // Next buffer the clock sweep looks at
+	PinnedBuffers int            // Buffers someone is reading or writing right now
+	WriteCount    uint64         // Pages written since the pool was created
+	WALFlushes    uint64         // Page writes that had to flush the WAL first
+	SyncInterval  int            // Pages written between syncs
+	PagesByFile   map[uint32]int // Cached pages per file ID
+}
+
+// GetInternals returns the buffer pool's state for diagnostics
+func (bp *BufferPool) GetInternals() BufferInternals {
+	internals := BufferInternals{BufferStats: bp.GetStats(), PagesByFile: make(map[uint32]int)}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	internals.PageSize = bp.pageSize
+	internals.ClockHand = bp.clockHand
+	internals.WriteCount = atomic.LoadUint64(&bp.writeCount)
+	internals.WALFlushes = atomic.LoadUint64(&bp.walFlushes)
+	internals.SyncInterval = bp.syncInterval
+	for _, buffer := range bp.buffers {
+		if buffer.State == BufferStateInvalid {
+			continue
+		}
+		internals.PagesByFile[buffer.Tag.FileID]++
+		if buffer.RefCount > 0 {
+			internals.PinnedBuffers++
+		}
+	}
+	return internals
+}
+
+// BufferSnapshot is one buffer of a Snapshot
+type BufferSnapshot struct {
+	Buffer     int
+	FileID     uint32
+	File       string // As the file was registered
+	Block      uint32
+	Dirty      bool
+	RefCount   int    // Pins on the buffer right now
+	UsageCount int    // Times the page was asked for since it was read
+	Referenced bool   // The clock sweep passes over it once more before evicting it
+	LSN        uint64 `json:",omitempty"`
+}
+
+// Snapshot returns the pages the pool holds, by buffer, for diagnosing how it caches them
+func (bp *BufferPool) Snapshot() []BufferSnapshot {
+	names := bp.fileRegistry.FileNames()
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	snapshot := make([]BufferSnapshot, 0)
+	for _, buffer := range bp.buffers {
+		if buffer.State == BufferStateInvalid {
+			continue
+		}
+		snapshot = append(snapshot, BufferSnapshot{
+			Buffer:     buffer.ID,
+			FileID:     buffer.Tag.FileID,
+			File:       names[buffer.Tag.FileID],
+			Block:      buffer.Tag.BlockNumber,
+			Dirty:      buffer.IsDirty,
+			RefCount:   buffer.RefCount,
+			UsageCount: buffer.UsageCount,
+			Referenced: buffer.Referenced,
+			LSN:        buffer.LSN,
+		})
+	}
+	return snapshot
+}
+
 // ClearBuffer invalidates a buffer and releases its memory
 func (bp *BufferPool) ClearBuffer(bufferID int) error {
 	bp.mu.Lock()
@@ -569,7 +803,7 @@ func (bp *BufferPool) ShutDown() error {
 	// Log final statistics
 	stats := bp.GetStats()
 	bp.logger.Infof("Buffer pool stats at shutdown: hits=%d, misses=%d, ratio=%.2f, evictions=%d, writes=%d",
-		stats.Hits, stats.Misses, stats.HitRatio, stats.Evictions, bp.writeCount)
+		stats.Hits, stats.Misses, stats.HitRatio, stats.Evictions, atomic.LoadUint64(&bp.writeCount))
 
 	// Flush all dirty buffers
 	if err := bp.FlushAllDirty(); err != nil {
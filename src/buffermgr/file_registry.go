@@ -177,6 +177,18 @@ func (fr *FileRegistry) RegisterFile(filePath string) (uint32, error) {
 	return fileID, nil
 }
 
+// FileNames returns the path each registered fileID was registered under
+func (fr *FileRegistry) FileNames() map[uint32]string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	names := make(map[uint32]string, len(fr.fileIDMap))
+	for filePath, fileID := range fr.fileIDMap {
+		names[fileID] = filePath
+	}
+	return names
+}
+
 // CloseFile decrements the reference count for a file and closes it if no longer in use
 func (fr *FileRegistry) CloseFile(fileID uint32) error {
 	fr.mu.Lock()
@@ -218,6 +230,21 @@ func (fr *FileRegistry) CloseAllFiles() error {
 	return lastErr
 }
 
+// SyncAllFiles syncs all open files
+func (fr *FileRegistry) SyncAllFiles() error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	var lastErr error
+	for fileID, file := range fr.files {
+		if err := file.Sync(); err != nil {
+			lastErr = fmt.Errorf("failed to sync file %d: %w", fileID, err)
+			fr.logger.Errorf("Failed to sync file %d: %v", fileID, err)
+		}
+	}
+	return lastErr
+}
+
 // ShouldSyncWrites returns whether writes should be synced according to policy
 func (fr *FileRegistry) ShouldSyncWrites() bool {
 	return fr.syncPolicy == SyncAlways
@@ -0,0 +1,154 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+/*
+Change encodings.
+
+json: one object per change,
+
+	{"sequence": 7, "time": "2026-01-02T15:04:05.123Z", "op": "UPDATE", "database": "shop",
+	 "bundle": "Orders", "document_id": "...", "transaction": 3,
+	 "before": {"Status": "new"}, "after": {"Status": "paid"}}
+
+with "transaction" left out outside transactions and "before" or "after" null when the
+document did not exist.
+
+avro: the Avro single-object encoding of a record of AvroSchema, that is the bytes C3 01,
+the schema's 8-byte CRC-64-AVRO fingerprint (little-endian), then the record in Avro's
+binary encoding. Avro has no type for SyndrDB's free-form field values, so "before" and
+"after" map each field name to its value encoded as JSON.
+*/
+
+// AvroSchema is the schema of changes published with -cdcformat avro
+const AvroSchema = `{"type":"record","name":"DocumentChange","namespace":"syndrdb","fields":[` +
+	`{"name":"sequence","type":"long"},` +
+	`{"name":"time","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"op","type":{"type":"enum","name":"Operation","symbols":["INSERT","UPDATE","DELETE"]}},` +
+	`{"name":"database","type":"string"},` +
+	`{"name":"bundle","type":"string"},` +
+	`{"name":"document_id","type":"string"},` +
+	`{"name":"transaction","type":"long"},` +
+	`{"name":"before","type":["null",{"type":"map","values":"string"}]},` +
+	`{"name":"after","type":["null",{"type":"map","values":"string"}]}]}`
+
+// avroCanonicalSchema is AvroSchema in Avro's parsing canonical form, which the fingerprint
+// is taken over
+const avroCanonicalSchema = `{"name":"syndrdb.DocumentChange","type":"record","fields":[` +
+	`{"name":"sequence","type":"long"},` +
+	`{"name":"time","type":"long"},` +
+	`{"name":"op","type":{"name":"syndrdb.Operation","type":"enum","symbols":["INSERT","UPDATE","DELETE"]}},` +
+	`{"name":"database","type":"string"},` +
+	`{"name":"bundle","type":"string"},` +
+	`{"name":"document_id","type":"string"},` +
+	`{"name":"transaction","type":"long"},` +
+	`{"name":"before","type":["null",{"type":"map","values":"string"}]},` +
+	`{"name":"after","type":["null",{"type":"map","values":"string"}]}]}`
+
+// AvroFingerprint is the CRC-64-AVRO fingerprint of AvroSchema, as found in each message
+var AvroFingerprint = avroFingerprint(avroCanonicalSchema)
+
+type jsonChange struct {
+	Sequence    uint64                 `json:"sequence"`
+	Time        string                 `json:"time"`
+	Operation   string                 `json:"op"`
+	Database    string                 `json:"database"`
+	Bundle      string                 `json:"bundle"`
+	DocumentID  string                 `json:"document_id"`
+	Transaction uint64                 `json:"transaction,omitempty"`
+	Before      map[string]interface{} `json:"before"`
+	After       map[string]interface{} `json:"after"`
+}
+
+func encodeJSON(change Change) ([]byte, error) {
+	return json.Marshal(jsonChange{
+		Sequence:    change.Sequence,
+		Time:        change.Time.UTC().Format(time.RFC3339Nano),
+		Operation:   change.Operation,
+		Database:    change.Database,
+		Bundle:      change.Bundle,
+		DocumentID:  change.DocumentID,
+		Transaction: change.Transaction,
+		Before:      change.Before,
+		After:       change.After,
+	})
+}
+
+var avroOperations = map[string]int64{OpInsert: 0, OpUpdate: 1, OpDelete: 2}
+
+func encodeAvro(change Change) ([]byte, error) {
+	buf := []byte{0xC3, 0x01}
+	buf = binary.LittleEndian.AppendUint64(buf, AvroFingerprint)
+
+	buf = binary.AppendVarint(buf, int64(change.Sequence))
+	buf = binary.AppendVarint(buf, change.Time.UnixMilli())
+	buf = binary.AppendVarint(buf, avroOperations[change.Operation])
+	buf = appendAvroString(buf, change.Database)
+	buf = appendAvroString(buf, change.Bundle)
+	buf = appendAvroString(buf, change.DocumentID)
+	buf = binary.AppendVarint(buf, int64(change.Transaction))
+
+	var err error
+	for _, fields := range []map[string]interface{}{change.Before, change.After} {
+		if buf, err = appendAvroFields(buf, fields); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// appendAvroFields encodes document fields as the union of null and a map of JSON values
+func appendAvroFields(buf []byte, fields map[string]interface{}) ([]byte, error) {
+	if fields == nil {
+		return binary.AppendVarint(buf, 0), nil
+	}
+	buf = binary.AppendVarint(buf, 1)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		// One block holding every entry
+		buf = binary.AppendVarint(buf, int64(len(names)))
+		for _, name := range names {
+			value, err := json.Marshal(fields[name])
+			if err != nil {
+				return nil, err
+			}
+			buf = appendAvroString(buf, name)
+			buf = appendAvroString(buf, string(value))
+		}
+	}
+	return binary.AppendVarint(buf, 0), nil
+}
+
+func appendAvroString(buf []byte, s string) []byte {
+	buf = binary.AppendVarint(buf, int64(len(s)))
+	return append(buf, s...)
+}
+
+// avroFingerprint computes the CRC-64-AVRO (Rabin) fingerprint of a canonical schema
+func avroFingerprint(schema string) uint64 {
+	const empty = 0xc15d213aa4d7a795
+	var table [256]uint64
+	for i := range table {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (empty & -(fp & 1))
+		}
+		table[i] = fp
+	}
+
+	fp := uint64(empty)
+	for i := 0; i < len(schema); i++ {
+		fp = (fp >> 8) ^ table[byte(fp)^schema[i]]
+	}
+	return fp
+}
@@ -0,0 +1,477 @@
+package cdc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+/*
+Kafka sink.
+
+A minimal producer speaking the Kafka protocol over plain TCP: Metadata (v1) finds the
+partitions of a topic and the brokers leading them, and Produce (v3, acks=all) sends record
+batches in message format v2, uncompressed; brokers from 0.11 on understand both. A change
+goes to partition fnv-1a(document ID) mod the topic's partition count. Brokers create a
+missing topic on first use when auto.create.topics.enable is set; otherwise create the
+topics beforehand. SASL and TLS are not supported.
+*/
+
+const (
+	defaultKafkaPort = "9092"
+	kafkaClientID    = "syndrdb-cdc"
+
+	kafkaProduceKey  = 0
+	kafkaMetadataKey = 3
+)
+
+// Kafka error codes the sink tells apart
+const (
+	kafkaNoError         = 0
+	kafkaCorruptMessage  = 2
+	kafkaMessageTooLarge = 10
+	kafkaInvalidTopic    = 17
+	kafkaInvalidRecord   = 87
+)
+
+var kafkaErrorNames = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	17: "INVALID_TOPIC_EXCEPTION",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	87: "INVALID_RECORD",
+}
+
+func kafkaError(code int16) string {
+	if name, known := kafkaErrorNames[code]; known {
+		return name
+	}
+	return fmt.Sprintf("error code %d", code)
+}
+
+// kafkaRejects reports whether an error code means the broker will never take the messages
+func kafkaRejects(code int16) bool {
+	switch code {
+	case kafkaCorruptMessage, kafkaMessageTooLarge, kafkaInvalidTopic, kafkaInvalidRecord:
+		return true
+	}
+	return false
+}
+
+type kafkaPartition struct {
+	id     int32
+	leader int32 // Node ID; -1 while the partition has none
+}
+
+type kafkaConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type kafkaSink struct {
+	bootstrap   []string
+	brokers     map[int32]string            // Node ID -> address, from the last metadata
+	topics      map[string][]kafkaPartition // From the last metadata
+	conns       map[string]*kafkaConn       // By address
+	correlation int32
+}
+
+func newKafkaSink(bootstrap []string) *kafkaSink {
+	addresses := make([]string, 0, len(bootstrap))
+	for _, address := range bootstrap {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, defaultKafkaPort)
+		}
+		addresses = append(addresses, address)
+	}
+	return &kafkaSink{
+		bootstrap: addresses,
+		brokers:   make(map[int32]string),
+		topics:    make(map[string][]kafkaPartition),
+		conns:     make(map[string]*kafkaConn),
+	}
+}
+
+func (k *kafkaSink) Publish(messages []Message) error {
+	var rejected []Message
+	var missing []string
+	for _, message := range messages {
+		if _, known := k.topics[message.Topic]; !known && !containsString(missing, message.Topic) {
+			missing = append(missing, message.Topic)
+		}
+	}
+	if len(missing) > 0 {
+		invalid, err := k.refreshMetadata(missing)
+		if err != nil {
+			return err
+		}
+		if len(invalid) > 0 {
+			kept := messages[:0:0]
+			for _, message := range messages {
+				if invalid[message.Topic] {
+					rejected = append(rejected, message)
+				} else {
+					kept = append(kept, message)
+				}
+			}
+			messages = kept
+		}
+	}
+
+	// Leader -> topic -> partition -> messages, in order
+	batches := make(map[int32]map[string]map[int32][]Message)
+	for _, message := range messages {
+		partitions := k.topics[message.Topic]
+		hash := fnv.New32a()
+		hash.Write(message.Key)
+		partition := partitions[hash.Sum32()%uint32(len(partitions))]
+		if partition.leader < 0 {
+			k.forgetMetadata()
+			return fmt.Errorf("partition %d of topic '%s' has no leader", partition.id, message.Topic)
+		}
+		if batches[partition.leader] == nil {
+			batches[partition.leader] = make(map[string]map[int32][]Message)
+		}
+		if batches[partition.leader][message.Topic] == nil {
+			batches[partition.leader][message.Topic] = make(map[int32][]Message)
+		}
+		batches[partition.leader][message.Topic][partition.id] = append(batches[partition.leader][message.Topic][partition.id], message)
+	}
+
+	for leader, topics := range batches {
+		address, known := k.brokers[leader]
+		if !known {
+			k.forgetMetadata()
+			return fmt.Errorf("Kafka broker %d is not in the cluster metadata", leader)
+		}
+		refused, err := k.produce(address, topics)
+		if err != nil {
+			return err
+		}
+		rejected = append(rejected, refused...)
+	}
+	if len(rejected) > 0 {
+		return &RejectedError{Messages: rejected, Reason: "refused by the Kafka broker"}
+	}
+	return nil
+}
+
+// produce sends messages to the broker leading their partitions, returning those it refused
+// for good
+func (k *kafkaSink) produce(address string, topics map[string]map[int32][]Message) ([]Message, error) {
+	now := time.Now()
+	request := &kafkaWriter{}
+	request.int16(-1) // No transactional ID
+	request.int16(-1) // acks=all
+	request.int32(int32(sinkTimeout / time.Millisecond))
+	request.int32(int32(len(topics)))
+	for topic, partitions := range topics {
+		request.string(topic)
+		request.int32(int32(len(partitions)))
+		for partition, messages := range partitions {
+			request.int32(partition)
+			request.bytes(kafkaRecordBatch(messages, now))
+		}
+	}
+
+	response, err := k.request(address, kafkaProduceKey, 3, request.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var rejected []Message
+	var failed error
+	for topicCount := response.int32(); topicCount > 0 && response.err == nil; topicCount-- {
+		topic := response.string()
+		for partitionCount := response.int32(); partitionCount > 0 && response.err == nil; partitionCount-- {
+			partition := response.int32()
+			code := response.int16()
+			response.int64() // Base offset
+			response.int64() // Log append time
+			switch {
+			case code == kafkaNoError:
+			case kafkaRejects(code):
+				rejected = append(rejected, topics[topic][partition]...)
+			case failed == nil:
+				failed = fmt.Errorf("Kafka broker %s refused partition %d of topic '%s': %s", address, partition, topic, kafkaError(code))
+			}
+		}
+	}
+	if response.err != nil {
+		k.closeConn(address)
+		return nil, fmt.Errorf("invalid produce response from Kafka broker %s: %w", address, response.err)
+	}
+	if failed != nil {
+		// Leaders move; look them up again before retrying
+		k.forgetMetadata()
+		return nil, failed
+	}
+	return rejected, nil
+}
+
+// refreshMetadata looks up the partitions of topics, returning those the brokers call invalid
+func (k *kafkaSink) refreshMetadata(topics []string) (map[string]bool, error) {
+	request := &kafkaWriter{}
+	request.int32(int32(len(topics)))
+	for _, topic := range topics {
+		request.string(topic)
+	}
+
+	addresses := append([]string(nil), k.bootstrap...)
+	for _, address := range k.brokers {
+		if !containsString(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	var response *kafkaReader
+	var err error
+	for _, address := range addresses {
+		if response, err = k.request(address, kafkaMetadataKey, 1, request.buf); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	brokers := make(map[int32]string)
+	for count := response.int32(); count > 0 && response.err == nil; count-- {
+		nodeID := response.int32()
+		host := response.string()
+		port := response.int32()
+		response.string() // Rack
+		brokers[nodeID] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	response.int32() // Controller
+
+	invalid := make(map[string]bool)
+	found := make(map[string][]kafkaPartition)
+	var failed error
+	for count := response.int32(); count > 0 && response.err == nil; count-- {
+		code := response.int16()
+		topic := response.string()
+		response.int8() // Internal
+		var partitions []kafkaPartition
+		for partitionCount := response.int32(); partitionCount > 0 && response.err == nil; partitionCount-- {
+			response.int16() // Partition error; a partition without a leader shows in its leader
+			partition := kafkaPartition{id: response.int32(), leader: response.int32()}
+			for replicas := response.int32(); replicas > 0 && response.err == nil; replicas-- {
+				response.int32()
+			}
+			for isr := response.int32(); isr > 0 && response.err == nil; isr-- {
+				response.int32()
+			}
+			partitions = append(partitions, partition)
+		}
+		switch {
+		case code == kafkaNoError && len(partitions) > 0:
+			sort.Slice(partitions, func(i, j int) bool { return partitions[i].id < partitions[j].id })
+			found[topic] = partitions
+		case kafkaRejects(code):
+			invalid[topic] = true
+		case failed == nil:
+			failed = fmt.Errorf("Kafka topic '%s' is not available: %s", topic, kafkaError(code))
+		}
+	}
+	if response.err != nil {
+		return nil, fmt.Errorf("invalid metadata response: %w", response.err)
+	}
+	k.brokers = brokers
+	for topic, partitions := range found {
+		k.topics[topic] = partitions
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	for _, topic := range topics {
+		if _, known := k.topics[topic]; !known && !invalid[topic] {
+			return nil, fmt.Errorf("Kafka topic '%s' is not available", topic)
+		}
+	}
+	return invalid, nil
+}
+
+func (k *kafkaSink) forgetMetadata() {
+	k.topics = make(map[string][]kafkaPartition)
+}
+
+// request sends one request to a broker and returns the body of its response
+func (k *kafkaSink) request(address string, apiKey, version int16, body []byte) (*kafkaReader, error) {
+	c, err := k.connection(address)
+	if err != nil {
+		return nil, err
+	}
+	c.conn.SetDeadline(time.Now().Add(sinkTimeout))
+
+	k.correlation++
+	header := &kafkaWriter{}
+	header.int32(0) // Size, filled in below
+	header.int16(apiKey)
+	header.int16(version)
+	header.int32(k.correlation)
+	header.string(kafkaClientID)
+	frame := append(header.buf, body...)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	if _, err := c.conn.Write(frame); err != nil {
+		k.closeConn(address)
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		k.closeConn(address)
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		k.closeConn(address)
+		return nil, err
+	}
+
+	reader := &kafkaReader{buf: response}
+	if correlation := reader.int32(); correlation != k.correlation {
+		k.closeConn(address)
+		return nil, fmt.Errorf("Kafka broker %s answered request %d with %d", address, k.correlation, correlation)
+	}
+	return reader, nil
+}
+
+func (k *kafkaSink) connection(address string) (*kafkaConn, error) {
+	if c, open := k.conns[address]; open {
+		return c, nil
+	}
+	conn, err := net.DialTimeout("tcp", address, sinkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &kafkaConn{conn: conn, reader: bufio.NewReader(conn)}
+	k.conns[address] = c
+	return c, nil
+}
+
+func (k *kafkaSink) closeConn(address string) {
+	if c, open := k.conns[address]; open {
+		c.conn.Close()
+		delete(k.conns, address)
+	}
+}
+
+func (k *kafkaSink) Close() error {
+	for address := range k.conns {
+		k.closeConn(address)
+	}
+	k.forgetMetadata()
+	return nil
+}
+
+// kafkaRecordBatch encodes messages as one record batch (message format v2)
+func kafkaRecordBatch(messages []Message, now time.Time) []byte {
+	var records []byte
+	for i, message := range messages {
+		record := []byte{0}                            // Attributes
+		record = binary.AppendVarint(record, 0)        // Timestamp delta
+		record = binary.AppendVarint(record, int64(i)) // Offset delta
+		record = binary.AppendVarint(record, int64(len(message.Key)))
+		record = append(record, message.Key...)
+		record = binary.AppendVarint(record, int64(len(message.Value)))
+		record = append(record, message.Value...)
+		record = binary.AppendVarint(record, 0) // Headers
+		records = binary.AppendVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+
+	// Everything from the attributes on is covered by the CRC
+	checked := &kafkaWriter{}
+	checked.int16(0) // Attributes: no compression, create time
+	checked.int32(int32(len(messages) - 1))
+	checked.int64(now.UnixMilli()) // First timestamp
+	checked.int64(now.UnixMilli()) // Max timestamp
+	checked.int64(-1)              // Producer ID
+	checked.int16(-1)              // Producer epoch
+	checked.int32(-1)              // Base sequence
+	checked.int32(int32(len(messages)))
+	checked.buf = append(checked.buf, records...)
+
+	batch := &kafkaWriter{}
+	batch.int64(0)                                   // Base offset
+	batch.int32(int32(4 + 1 + 4 + len(checked.buf))) // Length of what follows
+	batch.int32(-1)                                  // Partition leader epoch
+	batch.int8(2)                                    // Magic
+	batch.int32(int32(crc32.Checksum(checked.buf, crc32.MakeTable(crc32.Castagnoli))))
+	batch.buf = append(batch.buf, checked.buf...)
+	return batch.buf
+}
+
+// kafkaWriter encodes the big-endian primitives of the Kafka protocol
+type kafkaWriter struct {
+	buf []byte
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.buf = append(w.buf, byte(v)) }
+func (w *kafkaWriter) int16(v int16) { w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v)) }
+func (w *kafkaWriter) int32(v int32) { w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v)) }
+func (w *kafkaWriter) int64(v int64) { w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v)) }
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// kafkaReader decodes a response; after the first short read every value is zero and err is set
+type kafkaReader struct {
+	buf []byte
+	err error
+}
+
+var errKafkaShort = errors.New("response ends early")
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || len(r.buf) < n {
+		r.err = errKafkaShort
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+// string reads a string or nullable string; null reads as ""
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
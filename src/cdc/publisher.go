@@ -0,0 +1,367 @@
+package cdc
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syndrdb/src/helpers"
+	"syndrdb/src/workers"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+Change data capture.
+
+With -cdcsink set, every document write that succeeds is published to Kafka or NATS, one
+message per document it inserted, updated or deleted, carrying the document as it was
+before the write and as it is after it. Writes made by a transaction are published when it
+commits, tagged with its ID. Changes to aggregate groups are published like any other.
+
+Changes go through an in-memory queue to a delivery loop, so they reach the sink in the
+order they were made. With -cdcworkers above one, changes are spread over that many loops,
+each with its own queue and connection to the sink, by topic and document ID: the changes
+to one document still arrive in order, but those to different documents may not. When the
+sink cannot be reached a loop keeps its changes and retries every second; if the queues
+fill meanwhile, further changes are dropped and counted. Delivery is at least once while the server runs: a batch that failed part way is
+sent again whole. Changes still queued when the server stops are not kept.
+
+The topic (a subject, for NATS) comes from -cdctopic, where {database} and {bundle} are
+replaced by the names the change was made in. Kafka messages are keyed by document ID, so
+the changes to one document stay in order on one partition.
+*/
+
+const (
+	OpInsert = "INSERT"
+	OpUpdate = "UPDATE"
+	OpDelete = "DELETE"
+
+	FormatJSON = "json"
+	FormatAvro = "avro"
+
+	// DefaultTopic publishes every bundle to a topic of its own
+	DefaultTopic = "syndrdb.{database}.{bundle}"
+
+	publishQueueSize     = 64 * 1024
+	publishBatchSize     = 500
+	publishRetryInterval = time.Second
+	sinkTimeout          = 10 * time.Second
+)
+
+// Change is one document inserted, updated or deleted
+type Change struct {
+	Sequence    uint64 // Set by the publisher, in the order changes are published
+	Time        time.Time
+	Operation   string
+	Database    string
+	Bundle      string
+	DocumentID  string
+	Transaction uint64                 // The transaction that wrote the document; 0 outside transactions
+	Before      map[string]interface{} // Field values before the write; nil for an insert
+	After       map[string]interface{} // Field values after the write; nil for a delete
+}
+
+// Message is an encoded change addressed to a topic
+type Message struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// Sink delivers messages to a message broker. Publish returns once the broker has them, in
+// order, or fails; a sink reconnects on the next Publish after a failure. Messages the broker
+// refuses for good, such as ones over its size limit, are left out and reported with a
+// RejectedError once the others are delivered.
+type Sink interface {
+	Publish(messages []Message) error
+	Close() error
+}
+
+// RejectedError reports messages a broker will never accept
+type RejectedError struct {
+	Messages []Message
+	Reason   string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%d change(s) rejected: %s", len(e.Messages), e.Reason)
+}
+
+// Config says where changes are published and how they are encoded
+type Config struct {
+	Sink    string // kafka://host:port[,host:port...] or nats://[user:password@]host:port
+	Topic   string // Topic or subject, with {database} and {bundle} placeholders
+	Format  string // json or avro
+	Workers int    // Delivery loops; 0 means one
+}
+
+// Validate checks a configuration without connecting to the sink
+func (c Config) Validate() error {
+	if _, err := parseSinkURL(c.Sink); err != nil {
+		return err
+	}
+	if c.Format != FormatJSON && c.Format != FormatAvro {
+		return fmt.Errorf("invalid CDC format '%s' (must be '%s' or '%s')", c.Format, FormatJSON, FormatAvro)
+	}
+	if strings.TrimSpace(c.Topic) == "" {
+		return fmt.Errorf("the CDC topic cannot be empty")
+	}
+	return nil
+}
+
+func parseSinkURL(sink string) (*url.URL, error) {
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CDC sink '%s': %w", sink, err)
+	}
+	if u.Scheme != "kafka" && u.Scheme != "nats" {
+		return nil, fmt.Errorf("invalid CDC sink '%s' (must be kafka://host:port or nats://host:port)", sink)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid CDC sink '%s': no broker address", sink)
+	}
+	return u, nil
+}
+
+// PublisherStats are the counters SHOW METRICS reports for the CDC sink
+type PublisherStats struct {
+	Sink            string
+	Format          string
+	Workers         int    // Delivery loops
+	Published       uint64 // Changes the sink accepted
+	Queued          int    // Changes waiting to be sent
+	Dropped         uint64 // Changes lost because the queue was full or the broker refused them
+	Failures        uint64 // Sends that failed and were retried
+	LastError       string
+	LastPublishedAt string
+	LagSeconds      float64 // Age of the oldest change waiting
+}
+
+// Publisher encodes changes and sends them to a sink in the background
+type Publisher struct {
+	mu       sync.Mutex
+	sequence uint64
+	lanes    []*deliveryLane
+	queued   int // Changes waiting in every lane
+	stats    PublisherStats
+	topic    string
+	encode   func(Change) ([]byte, error)
+	logger   *zap.SugaredLogger
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// deliveryLane is one delivery loop's queue and connection to the sink
+type deliveryLane struct {
+	queue  []Message
+	times  []time.Time // When each queued change was made
+	sink   Sink
+	wakeCh chan struct{}
+}
+
+// NewPublisher sets up publishing to the sink of a configuration; it connects when the
+// first changes are sent
+func NewPublisher(config Config, logger *zap.SugaredLogger) (*Publisher, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	u, _ := parseSinkURL(config.Sink)
+
+	workers := max(1, config.Workers)
+	lanes := make([]*deliveryLane, workers)
+	for i := range lanes {
+		lane := &deliveryLane{wakeCh: make(chan struct{}, 1)}
+		switch u.Scheme {
+		case "kafka":
+			lane.sink = newKafkaSink(strings.Split(u.Host, ","))
+		case "nats":
+			lane.sink = newNATSSink(u)
+		}
+		lanes[i] = lane
+	}
+	encode := encodeJSON
+	if config.Format == FormatAvro {
+		encode = encodeAvro
+	}
+
+	return &Publisher{
+		topic:  config.Topic,
+		encode: encode,
+		lanes:  lanes,
+		logger: logger,
+		stopCh: make(chan struct{}),
+		stats:  PublisherStats{Sink: u.Redacted(), Format: config.Format, Workers: workers},
+	}, nil
+}
+
+// Start runs the delivery loops
+func (p *Publisher) Start() {
+	for _, lane := range p.lanes {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			helpers.Supervise(p.logger, "change data capture delivery", func() { p.deliver(lane) })
+		}()
+	}
+}
+
+// Stop halts delivery after one last attempt to send what is queued
+func (p *Publisher) Stop() {
+	close(p.stopCh)
+	p.wg.Wait()
+	for _, lane := range p.lanes {
+		p.flush(lane)
+	}
+
+	p.mu.Lock()
+	if p.queued > 0 {
+		p.logger.Warnf("CDC: %d change(s) were not published before shutdown", p.queued)
+	}
+	p.mu.Unlock()
+	for _, lane := range p.lanes {
+		lane.sink.Close()
+	}
+}
+
+// laneFor picks the lane of a document's changes, so they stay in order
+func (p *Publisher) laneFor(topic, documentID string) *deliveryLane {
+	if len(p.lanes) == 1 {
+		return p.lanes[0]
+	}
+	hasher := fnv.New32a()
+	hasher.Write([]byte(topic))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(documentID))
+	return p.lanes[hasher.Sum32()%uint32(len(p.lanes))]
+}
+
+// Publish queues a change for the sink
+func (p *Publisher) Publish(change Change) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sequence++
+	change.Sequence = p.sequence
+	if change.Time.IsZero() {
+		change.Time = time.Now()
+	}
+	if p.queued >= publishQueueSize {
+		if p.stats.Dropped == 0 {
+			p.logger.Errorf("CDC queue is full; dropping changes until %s catches up", p.stats.Sink)
+		}
+		p.stats.Dropped++
+		return
+	}
+	value, err := p.encode(change)
+	if err != nil {
+		p.logger.Errorf("CDC: cannot encode change to document '%s' of bundle '%s': %v", change.DocumentID, change.Bundle, err)
+		p.stats.Dropped++
+		return
+	}
+	topic := topicName(p.topic, change.Database, change.Bundle)
+	lane := p.laneFor(topic, change.DocumentID)
+	lane.queue = append(lane.queue, Message{
+		Topic: topic,
+		Key:   []byte(change.DocumentID),
+		Value: value,
+	})
+	lane.times = append(lane.times, change.Time)
+	p.queued++
+
+	select {
+	case lane.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the publisher's counters
+func (p *Publisher) Stats() PublisherStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Queued = p.queued
+	for _, lane := range p.lanes {
+		if len(lane.times) > 0 {
+			stats.LagSeconds = max(stats.LagSeconds, time.Since(lane.times[0]).Seconds())
+		}
+	}
+	return stats
+}
+
+// deliver sends a lane's changes as they come, retrying while the sink is down
+func (p *Publisher) deliver(lane *deliveryLane) {
+	ticker := time.NewTicker(publishRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-lane.wakeCh:
+		case <-ticker.C:
+		}
+		for p.flush(lane) {
+		}
+	}
+}
+
+// flush sends one batch from the head of a lane's queue, reporting whether more can be sent now
+func (p *Publisher) flush(lane *deliveryLane) bool {
+	p.mu.Lock()
+	batch := lane.queue
+	if len(batch) > publishBatchSize {
+		batch = batch[:publishBatchSize]
+	}
+	p.mu.Unlock()
+	if len(batch) == 0 {
+		return false
+	}
+
+	release := workers.CDCDispatcher.Acquire()
+	err := lane.sink.Publish(batch)
+	release()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	refused := 0
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		p.logger.Errorf("CDC: %s refused %d change(s) for good: %s", p.stats.Sink, len(rejected.Messages), rejected.Reason)
+		refused = len(rejected.Messages)
+		p.stats.Dropped += uint64(refused)
+		err = nil
+	}
+	if err != nil {
+		if p.stats.LastError == "" || p.stats.Failures%60 == 0 {
+			p.logger.Warnf("CDC: cannot publish to %s, retrying: %v", p.stats.Sink, err)
+		}
+		p.stats.Failures++
+		p.stats.LastError = err.Error()
+		lane.sink.Close()
+		return false
+	}
+	// Only the lane's own loop removes from its queue, so the batch is still at its head
+	lane.queue = lane.queue[len(batch):]
+	lane.times = lane.times[len(batch):]
+	p.queued -= len(batch)
+	p.stats.Published += uint64(len(batch) - refused)
+	p.stats.LastPublishedAt = time.Now().Format(time.RFC3339Nano)
+	p.stats.LastError = ""
+	return len(lane.queue) > 0
+}
+
+var unsafeTopicChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// topicName fills in a topic template. Names are reduced to characters both Kafka topics and
+// NATS subject tokens accept.
+func topicName(template, database, bundle string) string {
+	return strings.NewReplacer(
+		"{database}", unsafeTopicChars.ReplaceAllString(database, "_"),
+		"{bundle}", unsafeTopicChars.ReplaceAllString(bundle, "_"),
+	).Replace(template)
+}
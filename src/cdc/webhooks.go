@@ -0,0 +1,270 @@
+package cdc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"syndrdb/src/helpers"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+Webhooks.
+
+A webhook POSTs the changes to one bundle's documents to a URL, one request per change, with
+the change as the JSON object described in format.go. Each webhook has its own queue and
+delivers in order. A 2xx answer delivers the change. Network errors, 408, 429 and 5xx answers
+are retried up to the webhook's MaxRetries times, waiting Backoff before the first retry and
+twice as long before each next one, up to maxWebhookBackoff; after that the change is counted
+as failed and the next one is sent. Any other answer means the endpoint will not take the
+change, and it is failed at once. A webhook whose queue is full drops further changes.
+Changes still queued when the server stops are lost.
+
+Each request carries the headers
+
+	X-SyndrDB-Webhook:   the webhook's name
+	X-SyndrDB-Event:     INSERT, UPDATE or DELETE
+	X-SyndrDB-Delivery:  the change's sequence number, the same on every retry
+	X-SyndrDB-Timestamp: Unix seconds when the request was sent
+
+and, for a webhook with a secret,
+
+	X-SyndrDB-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>" keyed by the secret>
+
+so the receiver can check that the request came from this server and is recent.
+*/
+
+const (
+	webhookQueueSize  = 10000
+	webhookTimeout    = 10 * time.Second
+	maxWebhookBackoff = 10 * time.Minute
+)
+
+// Webhook is where and how one webhook delivers
+type Webhook struct {
+	Name       string
+	URL        string
+	Secret     string
+	MaxRetries int
+	Backoff    time.Duration
+}
+
+// WebhookStats are the delivery counters of one webhook
+type WebhookStats struct {
+	Queued          int
+	Delivered       uint64
+	Failed          uint64 // Given up on
+	Dropped         uint64 // Left out because the queue was full
+	Retries         uint64
+	LastStatus      int // HTTP status of the last answer; 0 when there was none
+	LastError       string
+	LastDeliveredAt string
+}
+
+// webhookQueue holds the changes waiting for one webhook
+type webhookQueue struct {
+	hook    Webhook
+	queue   []Change
+	running bool          // A goroutine is delivering
+	stopCh  chan struct{} // Closed when the webhook is removed
+	stats   WebhookStats
+}
+
+// WebhookDispatcher delivers changes to webhooks in the background
+type WebhookDispatcher struct {
+	mu       sync.Mutex
+	sequence uint64
+	queues   map[string]*webhookQueue // By key, see Deliver
+	client   *http.Client
+	logger   *zap.SugaredLogger
+}
+
+func NewWebhookDispatcher(logger *zap.SugaredLogger) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		queues: make(map[string]*webhookQueue),
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+	}
+}
+
+// Deliver queues a change for a webhook, identified by a key unique among all webhooks
+func (d *WebhookDispatcher) Deliver(key string, hook Webhook, change Change) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	q, exists := d.queues[key]
+	if !exists {
+		q = &webhookQueue{stopCh: make(chan struct{})}
+		d.queues[key] = q
+	}
+	q.hook = hook
+	d.sequence++
+	change.Sequence = d.sequence
+	if len(q.queue) >= webhookQueueSize {
+		if q.stats.Dropped == 0 {
+			d.logger.Errorf("Webhook '%s' is not keeping up; dropping changes", hook.Name)
+		}
+		q.stats.Dropped++
+		return
+	}
+	q.queue = append(q.queue, change)
+	if !q.running {
+		q.running = true
+		go helpers.Supervise(d.logger, "webhook '"+hook.Name+"' delivery", func() { d.run(q) })
+	}
+}
+
+// Forget drops a removed webhook and everything queued for it
+func (d *WebhookDispatcher) Forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if q, exists := d.queues[key]; exists {
+		close(q.stopCh)
+		q.queue = nil
+		delete(d.queues, key)
+	}
+}
+
+// Stats returns the counters of a webhook; zero for one that has not fired yet
+func (d *WebhookDispatcher) Stats(key string) WebhookStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q, exists := d.queues[key]
+	if !exists {
+		return WebhookStats{}
+	}
+	stats := q.stats
+	stats.Queued = len(q.queue)
+	return stats
+}
+
+// run delivers a webhook's queue in order until it is empty
+func (d *WebhookDispatcher) run(q *webhookQueue) {
+	for {
+		d.mu.Lock()
+		if len(q.queue) == 0 {
+			q.running = false
+			d.mu.Unlock()
+			return
+		}
+		change, hook := q.queue[0], q.hook
+		d.mu.Unlock()
+
+		delivered := d.deliverWithRetries(q, hook, change)
+
+		d.mu.Lock()
+		select {
+		case <-q.stopCh:
+			d.mu.Unlock()
+			return
+		default:
+		}
+		q.queue = q.queue[1:]
+		if delivered {
+			q.stats.Delivered++
+			q.stats.LastDeliveredAt = time.Now().Format(time.RFC3339Nano)
+		} else {
+			q.stats.Failed++
+			d.logger.Warnf("Webhook '%s' gave up on change %d to document '%s' of bundle '%s': %s",
+				hook.Name, change.Sequence, change.DocumentID, change.Bundle, q.stats.LastError)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// deliverWithRetries sends one change, retrying with exponential backoff
+func (d *WebhookDispatcher) deliverWithRetries(q *webhookQueue, hook Webhook, change Change) bool {
+	body, err := encodeJSON(change)
+	if err != nil {
+		d.recordAttempt(q, 0, err)
+		return false
+	}
+
+	backoff := hook.Backoff
+	for attempt := 0; ; attempt++ {
+		status, retry, err := d.post(hook, change, body)
+		d.recordAttempt(q, status, err)
+		if err == nil {
+			return true
+		}
+		if !retry || attempt >= hook.MaxRetries {
+			return false
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-q.stopCh:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > maxWebhookBackoff {
+			backoff = maxWebhookBackoff
+		}
+		d.mu.Lock()
+		q.stats.Retries++
+		d.mu.Unlock()
+	}
+}
+
+// post makes one delivery attempt, reporting the answer's status and whether a failure is
+// worth retrying
+func (d *WebhookDispatcher) post(hook Webhook, change Change, body []byte) (int, bool, error) {
+	request, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "SyndrDB-Webhook")
+	request.Header.Set("X-SyndrDB-Webhook", hook.Name)
+	request.Header.Set("X-SyndrDB-Event", change.Operation)
+	request.Header.Set("X-SyndrDB-Delivery", strconv.FormatUint(change.Sequence, 10))
+	request.Header.Set("X-SyndrDB-Timestamp", timestamp)
+	if hook.Secret != "" {
+		request.Header.Set("X-SyndrDB-Signature", "sha256="+WebhookSignature(hook.Secret, timestamp, body))
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, true, err
+	}
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return response.StatusCode, false, nil
+	case response.StatusCode == http.StatusRequestTimeout, response.StatusCode == http.StatusTooManyRequests,
+		response.StatusCode >= 500:
+		return response.StatusCode, true, fmt.Errorf("%s answered %s", hook.URL, response.Status)
+	}
+	return response.StatusCode, false, fmt.Errorf("%s refused the change: %s", hook.URL, response.Status)
+}
+
+func (d *WebhookDispatcher) recordAttempt(q *webhookQueue, status int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q.stats.LastStatus = status
+	if err != nil {
+		q.stats.LastError = err.Error()
+	} else {
+		q.stats.LastError = ""
+	}
+}
+
+// WebhookSignature is the hex HMAC-SHA256 a webhook request is signed with
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
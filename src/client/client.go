@@ -0,0 +1,460 @@
+// Package client is a Go driver for SyndrDB.
+//
+// A client is given one or more seed hosts. It discovers the rest of the cluster
+// with SHOW CLUSTER STATUS, sends writes to the primary and spreads reads according
+// to its read preference, retrying on another node when one fails.
+package client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"syndrdb/src/protocol"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReadPreference decides which nodes serve reads
+type ReadPreference string
+
+const (
+	// ReadPrimary sends every read to the primary
+	ReadPrimary ReadPreference = "primary"
+	// ReadReplica prefers non-primary nodes, falling back to the primary
+	ReadReplica ReadPreference = "replica"
+	// ReadNearest uses the node with the lowest measured round trip
+	ReadNearest ReadPreference = "nearest"
+)
+
+const (
+	DefaultTimeout           = 10 * time.Second
+	DefaultMaxRetries        = 3
+	DefaultRefreshInterval   = 30 * time.Second
+	DefaultHeartbeatInterval = 30 * time.Second
+	retryBackoff             = 200 * time.Millisecond
+	maxRetryBackoff          = 5 * time.Second
+	noticeBuffer             = 64 // Notices kept for a caller slow to read Notices; later ones are dropped
+)
+
+// ParseReadPreference converts a setting such as "replica" into a ReadPreference
+func ParseReadPreference(value string) (ReadPreference, error) {
+	switch ReadPreference(strings.ToLower(strings.TrimSpace(value))) {
+	case ReadPrimary, "":
+		return ReadPrimary, nil
+	case ReadReplica:
+		return ReadReplica, nil
+	case ReadNearest:
+		return ReadNearest, nil
+	}
+	return "", fmt.Errorf("invalid read preference '%s' (must be primary, replica or nearest)", value)
+}
+
+// Options configure a Client
+type Options struct {
+	Seeds          []string // host:port of one or more nodes, or unix:<path> of a local server's socket
+	Database       string
+	Username       string
+	Password       string
+	ReadPreference ReadPreference
+	MaxRetries     int           // Extra attempts on other nodes after a connection failure
+	Timeout        time.Duration // Per command
+	// How often the topology is re-read; failures also trigger a refresh
+	RefreshInterval time.Duration
+	AppName         string // Shown in SHOW PROCESSLIST on the server
+	// How responses are encoded: json (the default), or msgpack for smaller payloads that
+	// are quicker to decode; results are JSON either way
+	Format    string
+	TLSConfig *tls.Config // Connect over TLS when set
+	// Connections idle this long are checked with PING and dropped when the node does not
+	// answer; negative turns heartbeats off
+	HeartbeatInterval time.Duration
+}
+
+// Notice is an event a node pushed without being asked, such as a shutdown or a new primary
+type Notice struct {
+	Node    string // Address of the node that sent it
+	Event   string // maintenance, shutdown, role_change or slow_query
+	Message string
+	Time    time.Time
+	Details map[string]interface{}
+}
+
+// Response is the decoded result of a command
+type Response struct {
+	ResultCount int
+	Result      json.RawMessage
+	Node        string   // Address of the node that answered
+	Notices     []string // Server notices, such as maintenance starting or ending
+	NextKey     string   // Continuation token for AFTER KEY when LIMIT filled the page
+	// The bundle a SELECT DOCUMENTS or SELECT DISTINCT read and its declared fields, in name
+	// order; empty for other commands
+	Bundle string
+	Fields []Field
+}
+
+// Field is a field a bundle declares
+type Field struct {
+	Name     string
+	Type     string // As declared, such as STRING or INT
+	Required bool
+	Unique   bool
+}
+
+// Decode unmarshals the result into v
+func (r *Response) Decode(v interface{}) error {
+	if len(r.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Result, v)
+}
+
+// ServerError is an error returned by the server itself; retrying elsewhere will not help
+type ServerError struct {
+	Code       protocol.ErrorCode // What went wrong, for branching on; see protocol/errors.go
+	Message    string
+	Syntax     *SyntaxDetails // Set when the command failed to parse
+	RetryAfter time.Duration  // Set when the error is retryable; the command may be sent again after this long
+}
+
+// SyntaxDetails locates a parse error in the command that was sent
+type SyntaxDetails struct {
+	Position   int      `json:"position"` // Character offset into the command
+	Near       string   `json:"near"`     // The offending text; empty at the end of the command
+	Expected   []string `json:"expected"`
+	Suggestion string   `json:"suggestion"` // A keyword the offending text may be a typo of
+	Snippet    string   `json:"snippet"`    // The command line with the error underlined
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// Retryable reports whether sending the same command again after RetryAfter may succeed
+func (e *ServerError) Retryable() bool {
+	if e.Code == "" {
+		// Servers from before error codes only sent a delay with throttled writes
+		return e.RetryAfter > 0
+	}
+	return protocol.Retryable(e.Code)
+}
+
+// Client routes commands across a SyndrDB deployment. It is safe for concurrent use.
+type Client struct {
+	options Options
+
+	mu          sync.Mutex
+	topology    *topology
+	connections map[string]*connection
+	sessions    map[string]string // Session token per node, kept across reconnects
+	refreshedAt time.Time
+
+	notices   chan Notice
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Connect discovers the topology from the seeds and returns a ready client
+func Connect(options Options) (*Client, error) {
+	if len(options.Seeds) == 0 {
+		return nil, fmt.Errorf("at least one seed host is required")
+	}
+	if options.Database == "" {
+		return nil, fmt.Errorf("a database name is required")
+	}
+	preference, err := ParseReadPreference(string(options.ReadPreference))
+	if err != nil {
+		return nil, err
+	}
+	options.ReadPreference = preference
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.MaxRetries <= 0 {
+		options.MaxRetries = DefaultMaxRetries
+	}
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = DefaultRefreshInterval
+	}
+	if options.HeartbeatInterval == 0 {
+		options.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	c := &Client{
+		options:     options,
+		connections: make(map[string]*connection),
+		sessions:    make(map[string]string),
+		notices:     make(chan Notice, noticeBuffer),
+		done:        make(chan struct{}),
+	}
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+	if options.HeartbeatInterval > 0 {
+		go c.heartbeat()
+	}
+	return c, nil
+}
+
+// Notices returns the events nodes push, such as an impending shutdown, a change of primary
+// or a slow command on one of the client's own connections. Notices that arrive while the
+// channel is full are dropped.
+func (c *Client) Notices() <-chan Notice {
+	return c.notices
+}
+
+// notify passes a notice on without waiting for the caller to read it
+func (c *Client) notify(notice Notice) {
+	select {
+	case c.notices <- notice:
+	default:
+	}
+}
+
+// heartbeat sends PING over connections left idle, dropping those whose node does not
+// answer so the next command reconnects instead of failing
+func (c *Client) heartbeat() {
+	ticker := time.NewTicker(c.options.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		idle := make(map[string]*connection)
+		for address, conn := range c.connections {
+			if conn.idleFor() >= c.options.HeartbeatInterval {
+				idle[address] = conn
+			}
+		}
+		c.mu.Unlock()
+
+		for address, conn := range idle {
+			if _, err := conn.execute("PING", c.options.Timeout); err != nil {
+				c.mu.Lock()
+				if c.connections[address] == conn {
+					conn.close()
+					delete(c.connections, address)
+				}
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+// Execute runs a command on the node chosen by its type: writes go to the primary,
+// SELECT/SHOW follow the read preference. Connection failures are retried on other nodes;
+// writes are tagged with a request ID so a retry on the same node is not applied twice.
+// Retryable server errors, such as a throttled write or a cluster without a leader, are
+// retried on the same terms after the delay the server asked for, with jitter so clients
+// turned away together do not all come back at once; other server errors are returned as is.
+//
+// Values can be passed as params and written in the command as $1, $2, ...; the server
+// binds them as literals, so strings from users need no quoting or escaping:
+//
+//	client.Execute(`SELECT DOCUMENTS FROM "Authors" WHERE "Name" == $1`, name)
+func (c *Client) Execute(command string, params ...interface{}) (*Response, error) {
+	read := isReadCommand(command)
+	if !read {
+		// Every attempt carries the same ID, so a node that already applied the write
+		// answers a retry with the original result instead of applying it again
+		command = fmt.Sprintf("REQUEST \"%s\" %s", uuid.New().String(), command)
+	}
+	if len(params) > 0 {
+		message, err := protocol.MarshalCommand(command, params)
+		if err != nil {
+			return nil, err
+		}
+		command = string(message)
+	}
+	tried := make(map[string]bool)
+	var lastErr error
+	refused := false
+
+	for attempt := 0; attempt <= c.options.MaxRetries; attempt++ {
+		if attempt > 0 && !refused {
+			time.Sleep(retryBackoff * time.Duration(attempt))
+			// A node failed: the primary may have moved
+			if err := c.Refresh(); err != nil {
+				lastErr = err
+			}
+		} else if c.topologyStale() {
+			c.Refresh()
+		}
+
+		address, err := c.pick(read, tried)
+		if err != nil {
+			if lastErr == nil {
+				lastErr = err
+			}
+			// Every node has been tried once; start over on the refreshed topology
+			tried = make(map[string]bool)
+			continue
+		}
+
+		response, err := c.executeOn(address, command)
+		if err == nil {
+			return response, nil
+		}
+		if serverErr, isServerError := err.(*ServerError); isServerError {
+			if !serverErr.Retryable() || attempt == c.options.MaxRetries {
+				return nil, err
+			}
+			// The node cannot serve the command right now; wait about as long as it asked before sending it again
+			time.Sleep(retryDelay(serverErr, attempt))
+			lastErr = err
+			refused = true
+			continue
+		}
+		refused = false
+
+		tried[address] = true
+		lastErr = fmt.Errorf("node %s: %w", address, err)
+	}
+
+	return nil, fmt.Errorf("command failed after %d attempt(s): %w", c.options.MaxRetries+1, lastErr)
+}
+
+// retryDelay is how long to wait before retrying after a retryable error: the delay the
+// server asked for, or a backoff doubling with each attempt when it gave none, spread by up
+// to half again at random
+func retryDelay(err *ServerError, attempt int) time.Duration {
+	delay := err.RetryAfter
+	if delay <= 0 {
+		delay = retryBackoff << uint(attempt)
+		if delay <= 0 || delay > maxRetryBackoff {
+			delay = maxRetryBackoff
+		}
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// Refresh re-reads the cluster topology from the first node that answers
+func (c *Client) Refresh() error {
+	c.mu.Lock()
+	candidates := append([]string(nil), c.options.Seeds...)
+	if c.topology != nil {
+		candidates = append(c.topology.addresses(), candidates...)
+	}
+	c.mu.Unlock()
+
+	var lastErr error
+	seen := make(map[string]bool)
+	for _, address := range candidates {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		discovered, err := c.discover(address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if c.options.ReadPreference == ReadNearest {
+			c.measureLatency(discovered)
+		}
+
+		c.mu.Lock()
+		c.topology = discovered
+		c.refreshedAt = time.Now()
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("no seed host reachable: %w", lastErr)
+}
+
+// Close drops every open connection
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for address, conn := range c.connections {
+		conn.close()
+		delete(c.connections, address)
+	}
+	return nil
+}
+
+func (c *Client) topologyStale() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.refreshedAt) > c.options.RefreshInterval
+}
+
+// executeOn runs a command over the cached connection to a node, reconnecting once if it went stale
+func (c *Client) executeOn(address, command string) (*Response, error) {
+	conn, err := c.connectionTo(address)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := conn.execute(command, c.options.Timeout)
+	if err != nil {
+		if _, isServerError := err.(*ServerError); !isServerError {
+			c.dropConnection(address)
+		}
+		return nil, err
+	}
+	response.Node = address
+	return response, nil
+}
+
+func (c *Client) connectionTo(address string) (*connection, error) {
+	c.mu.Lock()
+	conn, exists := c.connections[address]
+	c.mu.Unlock()
+	if exists {
+		return conn, nil
+	}
+
+	c.mu.Lock()
+	session := c.sessions[address]
+	c.mu.Unlock()
+
+	conn, err := dial(address, c.options, session, c.notify)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, exists := c.connections[address]; exists {
+		conn.close()
+		return existing, nil
+	}
+	c.connections[address] = conn
+	if conn.session != "" {
+		c.sessions[address] = conn.session
+	}
+	return conn, nil
+}
+
+func (c *Client) dropConnection(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, exists := c.connections[address]; exists {
+		conn.close()
+		delete(c.connections, address)
+	}
+}
+
+// isReadCommand reports whether a command can be served by any node
+func isReadCommand(command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "SHOW", "EXPLAIN":
+		return true
+	}
+	return false
+}
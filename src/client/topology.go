@@ -0,0 +1,129 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// member is one node as seen by the client
+type member struct {
+	ID      string
+	Address string
+	Latency time.Duration // Only measured for ReadNearest
+}
+
+// topology is the client's view of the deployment
+type topology struct {
+	primary string // Address of the node taking writes
+	members []member
+}
+
+// clusterStatus is the part of SHOW CLUSTER STATUS the client needs
+type clusterStatus struct {
+	NodeID  string
+	Primary string
+	Nodes   []member
+}
+
+// discover asks one node for the cluster layout. A standalone server answers
+// without cluster information and is treated as a single primary.
+func (c *Client) discover(address string) (*topology, error) {
+	response, err := c.executeOn(address, "SHOW CLUSTER STATUS")
+	if err != nil {
+		if _, isServerError := err.(*ServerError); !isServerError {
+			return nil, err
+		}
+	}
+
+	status := &clusterStatus{}
+	if response != nil && len(response.Result) > 0 {
+		json.Unmarshal(response.Result, status)
+	}
+	if len(status.Nodes) == 0 {
+		return &topology{
+			primary: address,
+			members: []member{{ID: address, Address: address}},
+		}, nil
+	}
+
+	discovered := &topology{members: status.Nodes}
+	for _, node := range status.Nodes {
+		if node.ID == status.Primary {
+			discovered.primary = node.Address
+		}
+	}
+	return discovered, nil
+}
+
+// measureLatency times a connection round trip to every member
+func (c *Client) measureLatency(t *topology) {
+	for i := range t.members {
+		start := time.Now()
+		if _, err := c.executeOn(t.members[i].Address, "SHOW CLUSTER STATUS"); err != nil {
+			if _, isServerError := err.(*ServerError); !isServerError {
+				t.members[i].Latency = time.Duration(1<<63 - 1)
+				continue
+			}
+		}
+		t.members[i].Latency = time.Since(start)
+	}
+}
+
+// pick chooses the node for a command, skipping nodes that already failed it
+func (c *Client) pick(read bool, tried map[string]bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.topology
+	if t == nil {
+		return "", fmt.Errorf("cluster topology is unknown")
+	}
+
+	if !read || c.options.ReadPreference == ReadPrimary {
+		if t.primary == "" {
+			return "", fmt.Errorf("no primary is currently known")
+		}
+		if tried[t.primary] {
+			return "", fmt.Errorf("primary %s is unavailable", t.primary)
+		}
+		return t.primary, nil
+	}
+
+	var candidates []member
+	for _, m := range t.members {
+		if !tried[m.Address] {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no reachable node left to serve the read")
+	}
+
+	switch c.options.ReadPreference {
+	case ReadNearest:
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Latency < candidates[j].Latency })
+		return candidates[0].Address, nil
+	default:
+		// ReadReplica: spread reads over replicas, using the primary only when none is left
+		var replicas []member
+		for _, m := range candidates {
+			if m.Address != t.primary {
+				replicas = append(replicas, m)
+			}
+		}
+		if len(replicas) == 0 {
+			return candidates[0].Address, nil
+		}
+		return replicas[time.Now().UnixNano()%int64(len(replicas))].Address, nil
+	}
+}
+
+func (t *topology) addresses() []string {
+	addresses := make([]string, 0, len(t.members))
+	for _, m := range t.members {
+		addresses = append(addresses, m.Address)
+	}
+	return addresses
+}
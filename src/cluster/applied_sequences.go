@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syndrdb/src/helpers"
+)
+
+// AppliedSequencesFileName records, in the hints directory of a replica, the last change it
+// applied from each node
+const AppliedSequencesFileName = "applied.json"
+
+// AppliedSequences is the last replicated change a replica applied from each node. A primary
+// sends a change again when its reply was lost, and the replica skips it by its sequence
+// instead of applying it twice.
+type AppliedSequences struct {
+	mu   sync.Mutex
+	path string
+	last map[string]uint64 // By origin node
+}
+
+// OpenAppliedSequences loads the sequences a replica recorded before a restart
+func OpenAppliedSequences(dataDir string) (*AppliedSequences, error) {
+	dir := filepath.Join(dataDir, HintsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create hints directory: %w", err)
+	}
+
+	a := &AppliedSequences{path: filepath.Join(dir, AppliedSequencesFileName), last: make(map[string]uint64)}
+	data, err := os.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied sequences: %w", err)
+	}
+	if err := json.Unmarshal(data, &a.last); err != nil {
+		return nil, fmt.Errorf("invalid applied sequences in %s: %w", a.path, err)
+	}
+	return a, nil
+}
+
+// Applied reports whether the change numbered sequence from origin was applied already
+func (a *AppliedSequences) Applied(origin string, sequence uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return sequence <= a.last[origin]
+}
+
+// Last returns the sequence of the last change applied from origin
+func (a *AppliedSequences) Last(origin string) uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last[origin]
+}
+
+// Record notes that the change numbered sequence from origin was applied, replacing the file
+// through a temp file and rename
+func (a *AppliedSequences) Record(origin string, sequence uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if sequence <= a.last[origin] {
+		return nil
+	}
+	previous := a.last[origin]
+	a.last[origin] = sequence
+
+	data, err := json.Marshal(a.last)
+	if err == nil {
+		err = a.write(data)
+	}
+	if err != nil {
+		a.last[origin] = previous
+		return err
+	}
+	return nil
+}
+
+func (a *AppliedSequences) write(data []byte) error {
+	tempPath := a.path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to write applied sequences: %w", err)
+	}
+	if _, err := helpers.Write(file, data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write applied sequences: %w", err)
+	}
+	if err := helpers.Sync(file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync applied sequences: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write applied sequences: %w", err)
+	}
+	if err := helpers.Rename(tempPath, a.path); err != nil {
+		return fmt.Errorf("failed to replace applied sequences: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HintsDirName is the directory in the data directory holding one hint file per replica
+const HintsDirName = "hints"
+
+// ErrHintLogFull is returned when buffering another change would exceed the hint log limit
+var ErrHintLogFull = fmt.Errorf("hint log is full")
+
+// HintLog is a bounded, append-only file of changes a replica has not received yet.
+// Changes are stored one JSON object per line in the order they happened.
+type HintLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	entries  int
+	bytes    int64
+	oldest   time.Time // Time of the first buffered change
+}
+
+// OpenHintLog opens (or creates) the hint file for a replica, counting any backlog left from a previous run
+func OpenHintLog(dataDir, replicaID string, maxBytes int64) (*HintLog, error) {
+	dir := filepath.Join(dataDir, HintsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create hints directory: %w", err)
+	}
+
+	h := &HintLog{
+		path:     filepath.Join(dir, replicaID+".hints"),
+		maxBytes: maxBytes,
+	}
+
+	changes, err := h.readAll()
+	if err != nil {
+		return nil, err
+	}
+	h.entries = len(changes)
+	if len(changes) > 0 {
+		h.oldest = changes[0].Time
+	}
+	if info, err := os.Stat(h.path); err == nil {
+		h.bytes = info.Size()
+	}
+	return h, nil
+}
+
+// Append buffers a change, failing with ErrHintLogFull once the size limit is reached
+func (h *HintLog) Append(change Change) error {
+	line, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("failed to encode hint: %w", err)
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.maxBytes > 0 && h.bytes+int64(len(line)) > h.maxBytes {
+		return ErrHintLogFull
+	}
+
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open hint log: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to write hint: %w", err)
+	}
+	if h.entries == 0 {
+		h.oldest = change.Time
+	}
+	h.entries++
+	h.bytes += int64(len(line))
+	return nil
+}
+
+// Pending returns every buffered change in order
+func (h *HintLog) Pending() ([]Change, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.readAll()
+}
+
+// Remove drops the first n changes once they have been delivered
+func (h *HintLog) Remove(n int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changes, err := h.readAll()
+	if err != nil {
+		return err
+	}
+	if n > len(changes) {
+		n = len(changes)
+	}
+	return h.rewrite(changes[n:])
+}
+
+// Clear drops the whole backlog
+func (h *HintLog) Clear() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rewrite(nil)
+}
+
+// Size returns the number of buffered changes and their size on disk
+func (h *HintLog) Size() (int, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.entries, h.bytes
+}
+
+// Oldest returns when the first buffered change was made; zero when nothing is buffered
+func (h *HintLog) Oldest() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.oldest
+}
+
+func (h *HintLog) readAll() ([]Change, error) {
+	file, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hint log: %w", err)
+	}
+	defer file.Close()
+
+	var changes []Change
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			// A torn final line from a crash mid-append; everything before it is intact
+			break
+		}
+		changes = append(changes, change)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hint log: %w", err)
+	}
+	return changes, nil
+}
+
+// rewrite replaces the hint file with the given changes through a temp file and rename
+func (h *HintLog) rewrite(changes []Change) error {
+	tempPath := h.path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite hint log: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	var size int64
+	for _, change := range changes {
+		line, err := json.Marshal(change)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to encode hint: %w", err)
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+		size += int64(len(line)) + 1
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to rewrite hint log: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to rewrite hint log: %w", err)
+	}
+	if err := os.Rename(tempPath, h.path); err != nil {
+		return fmt.Errorf("failed to replace hint log: %w", err)
+	}
+
+	h.entries = len(changes)
+	h.bytes = size
+	h.oldest = time.Time{}
+	if len(changes) > 0 {
+		h.oldest = changes[0].Time
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package cluster
+
+import "syndrdb/src/engine"
+
+// IsMetadataCommand reports whether a command changes the cluster-wide catalog rather than
+// documents; a command that does not parse changes nothing. See IsMetadataStatement.
+func IsMetadataCommand(command string) bool {
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return false
+	}
+	return IsMetadataStatement(statement)
+}
+
+// IsMetadataStatement reports whether a statement changes the cluster-wide catalog: databases
+// and their settings, bundles other than temporary ones, snapshots and clones, indexes,
+// aggregates, webhooks, APPLY SCHEMA, and the bundle files ADOPT ORPHANED FILE and DELETE
+// ORPHANED FILES list or remove.
+func IsMetadataStatement(statement engine.Statement) bool {
+	switch cmd := statement.(type) {
+	case *engine.BundleCommand:
+		return !cmd.Temporary
+	case *engine.DatabaseCommand, *engine.BundleCopyCommand, *engine.CreateIndexCommand,
+		*engine.CreateAggregateCommand, *engine.CreateWebhookCommand, *engine.DeleteWebhookCommand,
+		*engine.ApplySchemaCommand, *engine.AdoptOrphanedFileCommand, *engine.DeleteOrphanedFilesCommand:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+// DefaultNodeTimeout bounds how long a routed query waits on a single node
+const DefaultNodeTimeout = 10 * time.Second
+
+// NodeClient runs a command on another node and returns the documents it produced
+type NodeClient interface {
+	Query(node Node, database string, command string) ([]*models.Document, error)
+}
+
+// TCPNodeClient talks to peers over the regular client protocol.
+// Each query opens its own connection so a slow node never blocks another.
+type TCPNodeClient struct {
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+// NewTCPNodeClient creates a node client using the cluster credentials
+func NewTCPNodeClient(username, password string, timeout time.Duration) *TCPNodeClient {
+	if timeout <= 0 {
+		timeout = DefaultNodeTimeout
+	}
+	return &TCPNodeClient{
+		Username: username,
+		Password: password,
+		Timeout:  timeout,
+	}
+}
+
+// nodeResponse covers both the success and error shapes the server writes
+type nodeResponse struct {
+	Status      string             `json:"status"`
+	Code        protocol.ErrorCode `json:"code"`
+	Message     string             `json:"message"`
+	ResultCount int
+	Result      json.RawMessage // Decoded by the caller; writes return strings, SELECTs documents
+}
+
+// NodeError is a command a node received and refused, as opposed to one that never reached it
+// or whose answer was lost
+type NodeError struct {
+	Code    protocol.ErrorCode
+	Message string
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("node returned an error: %s", e.Message)
+}
+
+// Query runs a SELECT on a node and returns the documents it produced
+func (c *TCPNodeClient) Query(node Node, database string, command string) ([]*models.Document, error) {
+	response, err := c.roundTrip(node, database, command)
+	if err != nil {
+		return nil, err
+	}
+
+	var documents []*models.Document
+	if len(response.Result) > 0 {
+		if err := json.Unmarshal(response.Result, &documents); err != nil {
+			return nil, fmt.Errorf("unexpected query result: %w", err)
+		}
+	}
+	return documents, nil
+}
+
+// Execute runs a write command on a node, only reporting whether it succeeded
+func (c *TCPNodeClient) Execute(node Node, database string, command string) error {
+	_, err := c.roundTrip(node, database, command)
+	return err
+}
+
+// roundTrip connects to a node, selects the database and runs one command over protocol v2 frames
+func (c *TCPNodeClient) roundTrip(node Node, database string, command string) (*nodeResponse, error) {
+	conn, err := net.DialTimeout("tcp", node.Address, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	reader := bufio.NewReader(conn)
+
+	// Welcome banner
+	if _, err := reader.ReadString('\n'); err != nil {
+		return nil, fmt.Errorf("failed to read welcome message: %w", err)
+	}
+
+	connStr := url.URL{
+		Scheme:   "syndrdb",
+		User:     url.UserPassword(c.Username, c.Password),
+		Host:     node.Address,
+		Path:     "/" + database,
+		RawQuery: "protocol=2&appname=syndrdb-node",
+	}
+	if _, err := conn.Write([]byte(connStr.String() + "\n")); err != nil {
+		return nil, fmt.Errorf("failed to send connection string: %w", err)
+	}
+	if _, err := readNodeResponse(reader, false); err != nil {
+		var nodeErr *NodeError
+		if errors.As(err, &nodeErr) {
+			// Not the command's fault; the node would not let us in
+			return nil, fmt.Errorf("node refused the connection: %s", nodeErr.Message)
+		}
+		return nil, err
+	}
+
+	if err := protocol.WriteFrame(conn, []byte(command)); err != nil {
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	return readNodeResponse(reader, true)
+}
+
+// readNodeResponse reads one response line (or frame, once v2 is negotiated) and turns a server error into a Go error
+func readNodeResponse(reader *bufio.Reader, framed bool) (*nodeResponse, error) {
+	var line string
+	if framed {
+		payload, err := protocol.ReadFrame(reader, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		line = string(payload)
+	} else {
+		var err error
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+	}
+
+	response := &nodeResponse{}
+	line = strings.TrimSpace(line)
+	if line == "" || line == "null" {
+		return response, nil
+	}
+	if err := json.Unmarshal([]byte(line), response); err != nil {
+		return nil, fmt.Errorf("unexpected response: %s", line)
+	}
+	if response.Status == "error" {
+		return nil, &NodeError{Code: response.Code, Message: response.Message}
+	}
+	return response, nil
+}
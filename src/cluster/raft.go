@@ -0,0 +1,807 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+Metadata consensus.
+
+DDL (databases, bundles, indexes, users) must look the same on every node, so in
+cluster mode those commands are not executed directly. They are appended to a
+replicated log using the Raft protocol (leader election + log replication) and
+every node applies committed entries to its catalog in log order.
+
+Only the leader appends to the log. Followers forward DDL to the leader and wait
+for the result. Membership is the static node list from the topology file.
+
+The catalog files are the snapshot: once every node has stored an entry and this node has
+applied it, the entry can be compacted out of its log (see raft_storage.go). A node that
+loses its data directory cannot be caught up from the log after that; restore it from a
+copy of another node's.
+
+An entry that fails to apply the same way on every node, because the command is wrong or
+the catalog refuses it, is skipped everywhere. One that fails for a reason of this node
+alone, such as a disk error, stops the node applying: it retries the entry until it
+succeeds and reports the error as ApplyError in SHOW CLUSTER STATUS meanwhile, so it never
+goes on with a catalog the others do not have.
+*/
+
+const (
+	RaftFollower  = "FOLLOWER"
+	RaftCandidate = "CANDIDATE"
+	RaftLeader    = "LEADER"
+
+	raftHeartbeatInterval = 100 * time.Millisecond
+	raftElectionTimeout   = 500 * time.Millisecond // randomised up to 2x
+	raftProposeTimeout    = 5 * time.Second
+	raftMaxEntriesPerSend = 128
+	raftCompactEntries    = 1024 // Applied entries stored on every node that trigger a compaction
+	raftApplyRetry        = 5 * time.Second
+)
+
+// LogEntry is one replicated metadata command
+type LogEntry struct {
+	Index    uint64
+	Term     uint64
+	Database string // Database the command runs against (empty for server-level commands)
+	Command  string // Empty for the no-op a new leader appends
+}
+
+// ApplyFunc applies a committed entry to the local catalog
+type ApplyFunc func(entry LogEntry) (interface{}, error)
+
+// RequestVoteRequest is sent by candidates to gather votes
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// RequestVoteResponse answers a vote request
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesRequest replicates entries and doubles as the leader heartbeat
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []LogEntry
+	LeaderCommit uint64
+	CompactIndex uint64 // Entries up to here are stored on every node and may be compacted once applied
+}
+
+// AppendEntriesResponse answers an append; ConflictIndex lets the leader back up quickly
+type AppendEntriesResponse struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+}
+
+// ForwardRequest carries a DDL command from a follower to the leader
+type ForwardRequest struct {
+	Database string
+	Command  string
+}
+
+// ForwardResponse carries the leader's apply result back to the follower
+type ForwardResponse struct {
+	Result interface{}
+	Error  string
+}
+
+// proposal is a client waiting on its entry to commit and apply
+type proposal struct {
+	result interface{}
+	err    error
+	done   chan struct{}
+}
+
+// RaftNode runs the consensus protocol for this server
+type RaftNode struct {
+	mu sync.Mutex
+
+	id        string
+	peers     []string // IDs of the other nodes
+	transport RaftTransport
+	storage   *RaftStorage
+	apply     ApplyFunc
+	logger    *zap.SugaredLogger
+
+	// Persistent state
+	currentTerm uint64
+	votedFor    string
+	log         []LogEntry // log[0] is a sentinel for the last compacted entry, index 0 before any
+	lastApplied uint64
+
+	// Volatile state
+	state        string
+	leaderID     string
+	commitIndex  uint64
+	compactIndex uint64 // What the leader last said every node has stored, on a follower
+	nextIndex    map[string]uint64
+	matchIndex   map[string]uint64
+	lastContact  time.Time
+	timeout      time.Duration
+	proposals    map[uint64]*proposal
+	applyError   string          // Why the node stopped applying, until the entry applies
+	compacted    map[string]bool // Peers told they need compacted entries, so it is logged once
+
+	applyCh chan struct{}
+	stopCh  chan struct{}
+	stopped bool
+
+	onRoleChange RoleChangeFunc // Set by OnRoleChange
+}
+
+// RoleChangeFunc is told the node's new role, LEADER or FOLLOWER, and the leader it follows
+type RoleChangeFunc func(node, role, leader string)
+
+// OnRoleChange has f called, on a goroutine of its own, whenever this node becomes the leader,
+// steps down, or learns of a new leader
+func (r *RaftNode) OnRoleChange(f RoleChangeFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onRoleChange = f
+}
+
+// roleChanged tells the role change handler. Caller holds r.mu.
+func (r *RaftNode) roleChanged() {
+	if r.onRoleChange != nil {
+		go r.onRoleChange(r.id, r.state, r.leaderID)
+	}
+}
+
+// NewRaftNode restores persisted state and creates a node that starts as a follower
+func NewRaftNode(id string, peers []string, transport RaftTransport, storage *RaftStorage, apply ApplyFunc, logger *zap.SugaredLogger) (*RaftNode, error) {
+	state, entries, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RaftNode{
+		id:          id,
+		peers:       peers,
+		transport:   transport,
+		storage:     storage,
+		apply:       apply,
+		logger:      logger,
+		currentTerm: state.CurrentTerm,
+		votedFor:    state.VotedFor,
+		log:         append([]LogEntry{{Index: state.SnapshotIndex, Term: state.SnapshotTerm}}, entries...),
+		lastApplied: state.LastApplied,
+		state:       RaftFollower,
+		proposals:   make(map[uint64]*proposal),
+		compacted:   make(map[string]bool),
+		applyCh:     make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+	// Entries up to lastApplied were committed before the restart
+	r.commitIndex = r.lastApplied
+	r.resetElectionTimer()
+	return r, nil
+}
+
+// Start runs the election/heartbeat loop and the apply loop
+func (r *RaftNode) Start() {
+	r.mu.Lock()
+	r.logger.Infof("Raft node '%s' started at term %d with %d log entries", r.id, r.currentTerm, r.lastIndex())
+	r.mu.Unlock()
+
+	go helpers.Supervise(r.logger, "raft election and heartbeat loop", r.run)
+	go helpers.Supervise(r.logger, "raft apply loop", r.applyLoop)
+}
+
+// Stop halts the background loops
+func (r *RaftNode) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.stopCh)
+		r.failProposals(fmt.Errorf("raft node stopped"))
+		if err := r.storage.Close(); err != nil {
+			r.logger.Errorf("Failed to close the raft log: %v", err)
+		}
+	}
+}
+
+// Status reports this node's view of the cluster for SHOW-style commands and logs
+func (r *RaftNode) Status() map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return map[string]interface{}{
+		"NodeID":        r.id,
+		"State":         r.state,
+		"Term":          r.currentTerm,
+		"Leader":        r.leaderID,
+		"LastIndex":     r.lastIndex(),
+		"CommitIndex":   r.commitIndex,
+		"LastApplied":   r.lastApplied,
+		"SnapshotIndex": r.snapshotIndex(),
+		"ApplyError":    r.applyError,
+	}
+}
+
+// Submit runs a metadata command through the replicated log and returns its local apply result.
+// On a follower the command is forwarded to the current leader.
+func (r *RaftNode) Submit(database, command string) (interface{}, error) {
+	r.mu.Lock()
+	if r.state != RaftLeader {
+		leaderID := r.leaderID
+		r.mu.Unlock()
+		if leaderID == "" {
+			return nil, protocol.Errorf(protocol.ErrLeaderUnavailable, "no cluster leader is currently elected; retry the command shortly")
+		}
+		response, err := r.transport.Forward(leaderID, &ForwardRequest{Database: database, Command: command})
+		if err != nil {
+			return nil, protocol.Errorf(protocol.ErrLeaderUnavailable, "failed to forward command to leader '%s': %w", leaderID, err)
+		}
+		if response.Error != "" {
+			return nil, fmt.Errorf("%s", response.Error)
+		}
+		return response.Result, nil
+	}
+
+	entry := LogEntry{
+		Index:    r.lastIndex() + 1,
+		Term:     r.currentTerm,
+		Database: database,
+		Command:  command,
+	}
+	if err := r.storage.Append([]LogEntry{entry}); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	r.log = append(r.log, entry)
+	p := &proposal{done: make(chan struct{})}
+	r.proposals[entry.Index] = p
+	r.maybeAdvanceCommit()
+	r.mu.Unlock()
+
+	r.broadcastAppendEntries()
+
+	select {
+	case <-p.done:
+		return p.result, p.err
+	case <-time.After(raftProposeTimeout):
+		r.mu.Lock()
+		delete(r.proposals, entry.Index)
+		r.mu.Unlock()
+		return nil, protocol.Errorf(protocol.ErrCommitUncertain, "timed out waiting for a majority of nodes to accept the command; it may still be applied")
+	}
+}
+
+// HandleRequestVote processes a vote request from a candidate
+func (r *RaftNode) HandleRequestVote(req *RequestVoteRequest) *RequestVoteResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Term > r.currentTerm {
+		r.becomeFollower(req.Term, "")
+	}
+
+	response := &RequestVoteResponse{Term: r.currentTerm}
+	if req.Term < r.currentTerm {
+		return response
+	}
+
+	// Only vote for candidates whose log is at least as up to date as ours
+	upToDate := req.LastLogTerm > r.lastTerm() ||
+		(req.LastLogTerm == r.lastTerm() && req.LastLogIndex >= r.lastIndex())
+
+	if (r.votedFor == "" || r.votedFor == req.CandidateID) && upToDate {
+		r.votedFor = req.CandidateID
+		if err := r.saveState(); err != nil {
+			r.votedFor = ""
+			return response
+		}
+		r.resetElectionTimer()
+		response.VoteGranted = true
+	}
+	return response
+}
+
+// HandleAppendEntries processes replication/heartbeats from the leader
+func (r *RaftNode) HandleAppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	response := &AppendEntriesResponse{Term: r.currentTerm}
+	if req.Term < r.currentTerm {
+		return response
+	}
+
+	if req.Term > r.currentTerm || r.state != RaftFollower {
+		r.becomeFollower(req.Term, req.LeaderID)
+	}
+	if r.leaderID != req.LeaderID {
+		// A follower that voted in this term learns who won
+		r.leaderID = req.LeaderID
+		r.roleChanged()
+	}
+	r.resetElectionTimer()
+	response.Term = r.currentTerm
+
+	// Our log must contain the entry the new ones follow
+	if req.PrevLogIndex > r.lastIndex() {
+		response.ConflictIndex = r.lastIndex() + 1
+		return response
+	}
+	// Compacted entries were committed, so they match the leader's
+	base := r.snapshotIndex()
+	if req.PrevLogIndex > base && r.termAt(req.PrevLogIndex) != req.PrevLogTerm {
+		// Back up to the first entry of the conflicting term
+		conflictTerm := r.termAt(req.PrevLogIndex)
+		index := req.PrevLogIndex
+		for index > base+1 && r.termAt(index-1) == conflictTerm {
+			index--
+		}
+		response.ConflictIndex = index
+		return response
+	}
+
+	for i, entry := range req.Entries {
+		if entry.Index <= base {
+			continue
+		}
+		if entry.Index <= r.lastIndex() {
+			if r.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			// Conflict: drop this entry and everything after it
+			if err := r.storage.TruncateFrom(entry.Index); err != nil {
+				r.logger.Errorf("Failed to truncate the raft log at entry %d: %v", entry.Index, err)
+				return response
+			}
+			r.log = r.log[:entry.Index-base]
+		}
+		if err := r.storage.Append(req.Entries[i:]); err != nil {
+			r.logger.Errorf("Failed to append to the raft log: %v", err)
+			return response
+		}
+		r.log = append(r.log, req.Entries[i:]...)
+		break
+	}
+
+	// A delayed request may cover less of the log than is already committed; commitIndex never goes back
+	matched := req.PrevLogIndex + uint64(len(req.Entries))
+	if next := min(req.LeaderCommit, matched); next > r.commitIndex {
+		r.commitIndex = next
+		r.signalApply()
+	}
+	if compact := min(req.CompactIndex, matched); compact > r.compactIndex {
+		r.compactIndex = compact
+	}
+
+	response.Success = true
+	return response
+}
+
+// HandleForward runs a follower's DDL through the log when this node is the leader
+func (r *RaftNode) HandleForward(req *ForwardRequest) *ForwardResponse {
+	r.mu.Lock()
+	isLeader := r.state == RaftLeader
+	r.mu.Unlock()
+	if !isLeader {
+		return &ForwardResponse{Error: "node is no longer the cluster leader; retry the command"}
+	}
+
+	result, err := r.Submit(req.Database, req.Command)
+	if err != nil {
+		return &ForwardResponse{Error: err.Error()}
+	}
+	return &ForwardResponse{Result: result}
+}
+
+func (r *RaftNode) run() {
+	ticker := time.NewTicker(raftHeartbeatInterval / 2)
+	defer ticker.Stop()
+
+	lastHeartbeat := time.Time{}
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		state := r.state
+		electionDue := state != RaftLeader && time.Since(r.lastContact) > r.timeout
+		r.mu.Unlock()
+
+		switch {
+		case state == RaftLeader && time.Since(lastHeartbeat) >= raftHeartbeatInterval:
+			r.broadcastAppendEntries()
+			lastHeartbeat = time.Now()
+		case electionDue:
+			r.startElection()
+		}
+	}
+}
+
+// startElection becomes a candidate and asks every peer for a vote
+func (r *RaftNode) startElection() {
+	r.mu.Lock()
+	r.state = RaftCandidate
+	r.currentTerm++
+	r.votedFor = r.id
+	r.leaderID = ""
+	r.resetElectionTimer()
+	if err := r.saveState(); err != nil {
+		r.mu.Unlock()
+		return
+	}
+	req := &RequestVoteRequest{
+		Term:         r.currentTerm,
+		CandidateID:  r.id,
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.lastTerm(),
+	}
+	r.logger.Infof("Raft node '%s' starting election for term %d", r.id, req.Term)
+	r.mu.Unlock()
+
+	votes := 1
+	if votes >= r.quorum() {
+		r.mu.Lock()
+		r.becomeLeader()
+		r.mu.Unlock()
+		return
+	}
+
+	for _, peer := range r.peers {
+		go func(peer string) {
+			defer helpers.RecoverPanic(r.logger, "raft vote request to "+peer)
+			response, err := r.transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if response.Term > r.currentTerm {
+				r.becomeFollower(response.Term, "")
+				return
+			}
+			if r.state != RaftCandidate || r.currentTerm != req.Term || !response.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= r.quorum() {
+				r.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// broadcastAppendEntries sends each peer the entries it is missing (or a heartbeat)
+func (r *RaftNode) broadcastAppendEntries() {
+	r.mu.Lock()
+	if r.state != RaftLeader {
+		r.mu.Unlock()
+		return
+	}
+	term := r.currentTerm
+	r.mu.Unlock()
+
+	for _, peer := range r.peers {
+		go r.replicateTo(peer, term)
+	}
+}
+
+func (r *RaftNode) replicateTo(peer string, term uint64) {
+	defer helpers.RecoverPanic(r.logger, "raft replication to "+peer)
+	r.mu.Lock()
+	if r.state != RaftLeader || r.currentTerm != term {
+		r.mu.Unlock()
+		return
+	}
+	base := r.snapshotIndex()
+	next := r.nextIndex[peer]
+	if next <= base {
+		// Every node stored the compacted entries, so a peer without them lost its log
+		if !r.compacted[peer] {
+			r.compacted[peer] = true
+			r.logger.Errorf("Raft peer '%s' needs entries up to %d, which are compacted; restore its data directory from another node", peer, base)
+		}
+		next = base + 1
+	}
+	end := min(r.lastIndex()+1, next+raftMaxEntriesPerSend)
+	entries := append([]LogEntry(nil), r.log[next-base:end-base]...)
+	req := &AppendEntriesRequest{
+		Term:         term,
+		LeaderID:     r.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.termAt(next - 1),
+		Entries:      entries,
+		LeaderCommit: r.commitIndex,
+		CompactIndex: r.storedEverywhere(),
+	}
+	r.mu.Unlock()
+
+	response, err := r.transport.AppendEntries(peer, req)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if response.Term > r.currentTerm {
+		r.becomeFollower(response.Term, "")
+		return
+	}
+	if r.state != RaftLeader || r.currentTerm != term {
+		return
+	}
+
+	if response.Success {
+		match := req.PrevLogIndex + uint64(len(entries))
+		if match > r.matchIndex[peer] {
+			r.matchIndex[peer] = match
+		}
+		r.nextIndex[peer] = match + 1
+		r.maybeAdvanceCommit()
+		return
+	}
+
+	if response.ConflictIndex > 0 {
+		r.nextIndex[peer] = response.ConflictIndex
+	} else if r.nextIndex[peer] > 1 {
+		r.nextIndex[peer]--
+	}
+}
+
+// maybeAdvanceCommit commits the highest current-term entry stored on a majority. Caller holds r.mu.
+func (r *RaftNode) maybeAdvanceCommit() {
+	for index := r.lastIndex(); index > r.commitIndex; index-- {
+		if r.termAt(index) != r.currentTerm {
+			break
+		}
+		replicas := 1
+		for _, peer := range r.peers {
+			if r.matchIndex[peer] >= index {
+				replicas++
+			}
+		}
+		if replicas >= r.quorum() {
+			r.commitIndex = index
+			r.signalApply()
+			return
+		}
+	}
+}
+
+// applyLoop applies committed entries in order and wakes any waiting proposer
+func (r *RaftNode) applyLoop() {
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-r.applyCh:
+		}
+
+		for {
+			r.mu.Lock()
+			if r.lastApplied >= r.commitIndex {
+				r.mu.Unlock()
+				break
+			}
+			entry := r.entryAt(r.lastApplied + 1)
+			r.mu.Unlock()
+
+			var result interface{}
+			var err error
+			if entry.Command != "" {
+				result, err = r.apply(entry)
+				if err != nil && localApplyFailure(err) {
+					r.mu.Lock()
+					r.applyError = fmt.Sprintf("entry %d: %v", entry.Index, err)
+					r.mu.Unlock()
+					r.logger.Errorf("Raft node '%s' stopped applying at entry %d (%s), retrying every %s: %v",
+						r.id, entry.Index, entry.Command, raftApplyRetry, err)
+					select {
+					case <-r.stopCh:
+						return
+					case <-time.After(raftApplyRetry):
+					}
+					continue
+				}
+				if err != nil {
+					// Every node sees the same error for the same entry, so keep going
+					r.logger.Warnf("Raft entry %d (%s) failed to apply: %v", entry.Index, entry.Command, err)
+				}
+			}
+
+			r.mu.Lock()
+			if r.applyError != "" {
+				r.logger.Infof("Raft node '%s' applied entry %d and goes on applying", r.id, entry.Index)
+				r.applyError = ""
+			}
+			r.lastApplied = entry.Index
+			if persistErr := r.saveState(); persistErr != nil {
+				r.logger.Errorf("Failed to persist raft state after applying entry %d: %v", entry.Index, persistErr)
+			}
+			if p, exists := r.proposals[entry.Index]; exists {
+				p.result, p.err = result, err
+				close(p.done)
+				delete(r.proposals, entry.Index)
+			}
+			r.maybeCompact()
+			r.mu.Unlock()
+		}
+	}
+}
+
+// localApplyFailure reports whether an entry failed to apply for a reason of this node alone:
+// a file it could not read or write, a panic, or an error of the SDB-5xxx group, which the
+// server may get past later. Anything else fails the same way on every node.
+func localApplyFailure(err error) bool {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	var syscallErr *os.SyscallError
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) || errors.As(err, &syscallErr) {
+		return true
+	}
+	code := protocol.CodeOf(err)
+	return code == protocol.ErrInternal || strings.HasPrefix(string(code), "SDB-5")
+}
+
+// maybeCompact drops the applied entries every node has stored from the log once there are
+// raftCompactEntries of them. Caller holds r.mu.
+func (r *RaftNode) maybeCompact() {
+	through := min(r.lastApplied, r.storedEverywhere())
+	base := r.snapshotIndex()
+	if r.stopped || through < base+raftCompactEntries {
+		return
+	}
+
+	snapshot := r.entryAt(through)
+	remaining := append([]LogEntry{{Index: snapshot.Index, Term: snapshot.Term}}, r.log[through-base+1:]...)
+	state := r.persistentState()
+	state.SnapshotIndex, state.SnapshotTerm = snapshot.Index, snapshot.Term
+	if err := r.storage.Compact(state, remaining[1:]); err != nil {
+		r.logger.Errorf("Failed to compact the raft log through entry %d: %v", through, err)
+		return
+	}
+	r.log = remaining
+	r.logger.Infof("Raft log compacted through entry %d", through)
+}
+
+// storedEverywhere returns the last entry every node has stored: on the leader from what its
+// peers acknowledged, on a follower from what the leader said. Caller holds r.mu.
+func (r *RaftNode) storedEverywhere() uint64 {
+	if r.state != RaftLeader {
+		return r.compactIndex
+	}
+	stored := r.lastIndex()
+	for _, peer := range r.peers {
+		stored = min(stored, r.matchIndex[peer])
+	}
+	return stored
+}
+
+// becomeFollower steps down. Caller holds r.mu.
+func (r *RaftNode) becomeFollower(term uint64, leaderID string) {
+	wasLeader := r.state == RaftLeader
+	newLeader := leaderID != "" && leaderID != r.leaderID
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+		if err := r.saveState(); err != nil {
+			r.logger.Errorf("Failed to persist raft state: %v", err)
+		}
+	}
+	r.state = RaftFollower
+	r.leaderID = leaderID
+	r.resetElectionTimer()
+	if wasLeader {
+		r.logger.Infof("Raft node '%s' stepped down at term %d", r.id, r.currentTerm)
+		r.failProposals(protocol.Errorf(protocol.ErrCommitUncertain, "leadership lost before the command committed; it may still be applied"))
+	}
+	if wasLeader || newLeader {
+		r.roleChanged()
+	}
+}
+
+// becomeLeader takes over and appends a no-op so earlier-term entries can commit. Caller holds r.mu.
+func (r *RaftNode) becomeLeader() {
+	r.state = RaftLeader
+	r.leaderID = r.id
+	r.roleChanged()
+	r.nextIndex = make(map[string]uint64, len(r.peers))
+	r.matchIndex = make(map[string]uint64, len(r.peers))
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+	}
+
+	noop := LogEntry{Index: r.lastIndex() + 1, Term: r.currentTerm}
+	if err := r.storage.Append([]LogEntry{noop}); err != nil {
+		r.logger.Errorf("Failed to persist raft state: %v", err)
+	} else {
+		r.log = append(r.log, noop)
+	}
+	r.maybeAdvanceCommit()
+	r.logger.Infof("Raft node '%s' is now the leader for term %d", r.id, r.currentTerm)
+	go r.broadcastAppendEntries()
+}
+
+// failProposals releases every waiting proposer with an error. Caller holds r.mu.
+func (r *RaftNode) failProposals(err error) {
+	for index, p := range r.proposals {
+		p.err = err
+		close(p.done)
+		delete(r.proposals, index)
+	}
+}
+
+func (r *RaftNode) signalApply() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *RaftNode) resetElectionTimer() {
+	r.lastContact = time.Now()
+	r.timeout = raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout)))
+}
+
+func (r *RaftNode) quorum() int {
+	return (len(r.peers)+1)/2 + 1
+}
+
+// snapshotIndex is the last entry compacted out of the log. Caller holds r.mu.
+func (r *RaftNode) snapshotIndex() uint64 {
+	return r.log[0].Index
+}
+
+func (r *RaftNode) lastIndex() uint64 {
+	return r.log[0].Index + uint64(len(r.log)-1)
+}
+
+func (r *RaftNode) lastTerm() uint64 {
+	return r.log[len(r.log)-1].Term
+}
+
+// entryAt returns an entry after the snapshot, or the sentinel standing for it. Caller holds r.mu.
+func (r *RaftNode) entryAt(index uint64) LogEntry {
+	return r.log[index-r.log[0].Index]
+}
+
+func (r *RaftNode) termAt(index uint64) uint64 {
+	return r.entryAt(index).Term
+}
+
+// persistentState is the persistent state besides the log. Caller holds r.mu.
+func (r *RaftNode) persistentState() *RaftState {
+	return &RaftState{
+		CurrentTerm:   r.currentTerm,
+		VotedFor:      r.votedFor,
+		LastApplied:   r.lastApplied,
+		SnapshotIndex: r.log[0].Index,
+		SnapshotTerm:  r.log[0].Term,
+	}
+}
+
+// saveState writes term, vote and how far the log is applied to disk; entries are written as
+// they are appended. Caller holds r.mu.
+func (r *RaftNode) saveState() error {
+	return r.storage.Save(r.persistentState())
+}
@@ -0,0 +1,310 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+Raft storage.
+
+A node keeps its raft state in two files of the data directory. raft_state.json holds the
+term, the vote, how far the log is applied and where it starts; it is small and replaced
+whole, through a temp file and rename, whenever one of them changes. raft_log.jsonl holds
+the log, one JSON entry per line. New entries are appended and synced; entries a new leader
+overrides are cut off the end. An append a crash interrupted leaves a torn last line, which
+is dropped at the next start: it was never acknowledged.
+
+Compaction drops the entries every node has stored and this node has applied (see
+RaftNode.maybeCompact). Their effect lives on in the catalog files, which are the snapshot.
+The state file is written first, saying where the log now starts, and the log file is then
+rewritten with the entries after it. A crash between the two leaves entries the state file
+says are compacted; they are skipped at load.
+*/
+
+const (
+	// RaftStateFileName is the file in the data directory holding this node's raft state
+	RaftStateFileName = "raft_state.json"
+
+	// RaftLogFileName is the file in the data directory holding this node's raft log
+	RaftLogFileName = "raft_log.jsonl"
+)
+
+// RaftState is what raft must remember across restarts besides the log
+type RaftState struct {
+	CurrentTerm   uint64
+	VotedFor      string
+	LastApplied   uint64 // Entries up to here are already reflected in the catalog files
+	SnapshotIndex uint64 // The last entry compacted away; the log starts after it
+	SnapshotTerm  uint64
+
+	// Log is only set in state files written before the log had a file of its own. Load
+	// moves it there.
+	Log []LogEntry `json:",omitempty"`
+}
+
+// RaftStorage persists raft state and the raft log in the data directory
+type RaftStorage struct {
+	mu        sync.Mutex
+	statePath string
+	logPath   string
+
+	logFile    *os.File // Open once loaded
+	firstIndex uint64   // Of the first entry in the log file
+	offsets    []int64  // Where each entry of the log file starts, from firstIndex
+	size       int64
+}
+
+// NewRaftStorage creates storage for the raft state in the data directory
+func NewRaftStorage(dataDir string) *RaftStorage {
+	return &RaftStorage{
+		statePath: filepath.Join(dataDir, RaftStateFileName),
+		logPath:   filepath.Join(dataDir, RaftLogFileName),
+	}
+}
+
+// Load reads the saved state and the log entries after its snapshot, returning an empty
+// state on first start
+func (s *RaftStorage) Load() (*RaftState, []LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := &RaftState{}
+	data, err := os.ReadFile(s.statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to read raft state: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse raft state: %w", err)
+		}
+	}
+
+	if len(state.Log) > 0 {
+		if _, err := os.Stat(s.logPath); os.IsNotExist(err) {
+			if err := s.writeLogFile(state.Log); err != nil {
+				return nil, nil, err
+			}
+		}
+		state.Log = nil
+		if err := s.saveLocked(state); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	entries, err := s.openLog()
+	if err != nil {
+		return nil, nil, err
+	}
+	for len(entries) > 0 && entries[0].Index <= state.SnapshotIndex {
+		entries = entries[1:]
+	}
+	if len(entries) > 0 && entries[0].Index != state.SnapshotIndex+1 {
+		return nil, nil, fmt.Errorf("raft log starts at entry %d, but entries up to %d are all it compacted", entries[0].Index, state.SnapshotIndex)
+	}
+	return state, entries, nil
+}
+
+// openLog reads the log file, drops a torn last line and keeps the file open for appends
+func (s *RaftStorage) openLog() ([]LogEntry, error) {
+	file, err := os.OpenFile(s.logPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+
+	var entries []LogEntry
+	s.offsets = nil
+	s.firstIndex = 0
+	offset := int64(0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read raft log: %w", err)
+		}
+		var entry LogEntry
+		if json.Unmarshal(line, &entry) != nil {
+			break
+		}
+		if len(entries) > 0 && entry.Index != entries[len(entries)-1].Index+1 {
+			file.Close()
+			return nil, fmt.Errorf("raft log skips from entry %d to %d", entries[len(entries)-1].Index, entry.Index)
+		}
+		if len(entries) == 0 {
+			s.firstIndex = entry.Index
+		}
+		entries = append(entries, entry)
+		s.offsets = append(s.offsets, offset)
+		offset += int64(len(line))
+	}
+
+	// Whatever follows the last whole entry is an append a crash interrupted
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to trim raft log: %w", err)
+	}
+	s.logFile = file
+	s.size = offset
+	return entries, nil
+}
+
+// Save writes the state through a temp file and rename so a crash never leaves a torn file
+func (s *RaftStorage) Save(state *RaftState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked(state)
+}
+
+func (s *RaftStorage) saveLocked(state *RaftState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode raft state: %w", err)
+	}
+	if err := writeFileSynced(s.statePath, data); err != nil {
+		return fmt.Errorf("failed to write raft state: %w", err)
+	}
+	return nil
+}
+
+// Append adds entries to the end of the log and syncs them
+func (s *RaftStorage) Append(entries []LogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logFile == nil {
+		return errors.New("raft log is not open")
+	}
+
+	var buf bytes.Buffer
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		offsets = append(offsets, s.size+int64(buf.Len()))
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode raft entry %d: %w", entry.Index, err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if _, err := s.logFile.WriteAt(buf.Bytes(), s.size); err != nil {
+		s.logFile.Truncate(s.size)
+		return fmt.Errorf("failed to append to raft log: %w", err)
+	}
+	if err := s.logFile.Sync(); err != nil {
+		s.logFile.Truncate(s.size)
+		return fmt.Errorf("failed to sync raft log: %w", err)
+	}
+	if len(s.offsets) == 0 && len(entries) > 0 {
+		s.firstIndex = entries[0].Index
+	}
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(buf.Len())
+	return nil
+}
+
+// TruncateFrom cuts the entry at index and every later one off the log
+func (s *RaftStorage) TruncateFrom(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logFile == nil {
+		return errors.New("raft log is not open")
+	}
+	if len(s.offsets) == 0 || index >= s.firstIndex+uint64(len(s.offsets)) {
+		return nil
+	}
+	if index < s.firstIndex {
+		index = s.firstIndex
+	}
+
+	offset := s.offsets[index-s.firstIndex]
+	if err := s.logFile.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate raft log: %w", err)
+	}
+	if err := s.logFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync raft log: %w", err)
+	}
+	s.offsets = s.offsets[:index-s.firstIndex]
+	s.size = offset
+	return nil
+}
+
+// Compact saves the state, whose snapshot says where the log now starts, and rewrites the
+// log file with the entries after it
+func (s *RaftStorage) Compact(state *RaftState, remaining []LogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.saveLocked(state); err != nil {
+		return err
+	}
+	if s.logFile != nil {
+		s.logFile.Close()
+		s.logFile = nil
+	}
+	if err := s.writeLogFile(remaining); err != nil {
+		return err
+	}
+	_, err := s.openLog()
+	return err
+}
+
+// writeLogFile replaces the log file with entries, through a temp file and rename
+func (s *RaftStorage) writeLogFile(entries []LogEntry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode raft entry %d: %w", entry.Index, err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileSynced(s.logPath, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write raft log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the log file
+func (s *RaftStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logFile == nil {
+		return nil
+	}
+	err := s.logFile.Close()
+	s.logFile = nil
+	return err
+}
+
+// writeFileSynced replaces a file through a synced temp file and rename
+func writeFileSynced(path string, data []byte) error {
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
@@ -0,0 +1,299 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// memTransport delivers raft messages between nodes of one process
+type memTransport struct {
+	mu    sync.Mutex
+	nodes map[string]*RaftNode
+}
+
+func (t *memTransport) node(peer string) (*RaftNode, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.nodes[peer] == nil {
+		return nil, errors.New("node is down")
+	}
+	return t.nodes[peer], nil
+}
+
+func (t *memTransport) RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	node, err := t.node(peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleRequestVote(req), nil
+}
+
+func (t *memTransport) AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	node, err := t.node(peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleAppendEntries(req), nil
+}
+
+func (t *memTransport) Forward(peer string, req *ForwardRequest) (*ForwardResponse, error) {
+	node, err := t.node(peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleForward(req), nil
+}
+
+// newTestNode creates a node, not started, whose log holds entries and whose term is term
+func newTestNode(t *testing.T, dir string, term uint64, entries []LogEntry) *RaftNode {
+	t.Helper()
+	storage := NewRaftStorage(dir)
+	if _, _, err := storage.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Append(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Save(&RaftState{CurrentTerm: term}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	node, err := NewRaftNode("follower", []string{"leader", "other"}, &memTransport{}, NewRaftStorage(dir), nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// entryTerms lists the terms of entries, for comparing logs
+func entryTerms(entries []LogEntry) []uint64 {
+	terms := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		terms = append(terms, entry.Term)
+	}
+	return terms
+}
+
+// termEntries creates entries 1 to n with the given terms
+func termEntries(terms ...uint64) []LogEntry {
+	entries := make([]LogEntry, 0, len(terms))
+	for i, term := range terms {
+		entries = append(entries, LogEntry{Index: uint64(i + 1), Term: term, Command: fmt.Sprintf("c%d", i+1)})
+	}
+	return entries
+}
+
+func TestAppendEntriesLogMatching(t *testing.T) {
+	tests := []struct {
+		name          string
+		log           []uint64 // Terms of the follower's entries
+		request       AppendEntriesRequest
+		success       bool
+		conflictIndex uint64
+		want          []uint64 // Terms of the follower's entries afterwards
+	}{
+		{
+			name:    "appends after a matching entry",
+			log:     []uint64{1, 1, 2},
+			request: AppendEntriesRequest{Term: 3, PrevLogIndex: 3, PrevLogTerm: 2, Entries: []LogEntry{{Index: 4, Term: 3}}},
+			success: true,
+			want:    []uint64{1, 1, 2, 3},
+		},
+		{
+			name:          "rejects a gap",
+			log:           []uint64{1, 1},
+			request:       AppendEntriesRequest{Term: 3, PrevLogIndex: 4, PrevLogTerm: 2, Entries: []LogEntry{{Index: 5, Term: 3}}},
+			conflictIndex: 3,
+			want:          []uint64{1, 1},
+		},
+		{
+			name:          "backs up to the first entry of the conflicting term",
+			log:           []uint64{1, 2, 2, 2},
+			request:       AppendEntriesRequest{Term: 3, PrevLogIndex: 4, PrevLogTerm: 3, Entries: []LogEntry{{Index: 5, Term: 3}}},
+			conflictIndex: 2,
+			want:          []uint64{1, 2, 2, 2},
+		},
+		{
+			name:    "replaces entries from the first conflict on",
+			log:     []uint64{1, 2, 2, 2},
+			request: AppendEntriesRequest{Term: 3, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []LogEntry{{Index: 2, Term: 2}, {Index: 3, Term: 3}}},
+			success: true,
+			want:    []uint64{1, 2, 3},
+		},
+		{
+			name:    "keeps entries a stale request repeats",
+			log:     []uint64{1, 1, 2},
+			request: AppendEntriesRequest{Term: 2, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []LogEntry{{Index: 2, Term: 1}}},
+			success: true,
+			want:    []uint64{1, 1, 2},
+		},
+		{
+			name:    "rejects an older term",
+			log:     []uint64{1, 3},
+			request: AppendEntriesRequest{Term: 2, PrevLogIndex: 2, PrevLogTerm: 3, Entries: []LogEntry{{Index: 3, Term: 2}}},
+			want:    []uint64{1, 3},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			node := newTestNode(t, dir, test.log[len(test.log)-1], termEntries(test.log...))
+			test.request.LeaderID = "leader"
+
+			response := node.HandleAppendEntries(&test.request)
+			if response.Success != test.success || response.ConflictIndex != test.conflictIndex {
+				t.Errorf("response = %+v, want success %v and conflict index %d", response, test.success, test.conflictIndex)
+			}
+			node.mu.Lock()
+			got := entryTerms(node.log[1:])
+			node.mu.Unlock()
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("log terms = %v, want %v", got, test.want)
+			}
+
+			// What is on disk is what the node holds
+			node.Stop()
+			_, stored, err := NewRaftStorage(dir).Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entryTerms(stored), test.want) {
+				t.Errorf("stored log terms = %v, want %v", entryTerms(stored), test.want)
+			}
+		})
+	}
+}
+
+func TestAppendEntriesCommitIndex(t *testing.T) {
+	node := newTestNode(t, t.TempDir(), 1, termEntries(1, 1, 1, 1))
+	defer node.Stop()
+
+	steps := []struct {
+		name    string
+		request AppendEntriesRequest
+		want    uint64
+	}{
+		// Only entries known to match the leader's are committed
+		{"limited to the matched entries", AppendEntriesRequest{Term: 1, PrevLogIndex: 2, PrevLogTerm: 1, LeaderCommit: 4}, 2},
+		{"follows the leader", AppendEntriesRequest{Term: 1, PrevLogIndex: 4, PrevLogTerm: 1, LeaderCommit: 3}, 3},
+		{"never goes back", AppendEntriesRequest{Term: 1, PrevLogIndex: 1, PrevLogTerm: 1, LeaderCommit: 1}, 3},
+		{"not on a rejected request", AppendEntriesRequest{Term: 1, PrevLogIndex: 6, PrevLogTerm: 1, LeaderCommit: 6}, 3},
+	}
+	for _, step := range steps {
+		step.request.LeaderID = "leader"
+		node.HandleAppendEntries(&step.request)
+		if got := node.Status()["CommitIndex"]; got != step.want {
+			t.Errorf("%s: commit index = %v, want %d", step.name, got, step.want)
+		}
+	}
+}
+
+func TestMaybeAdvanceCommitNeedsCurrentTermEntry(t *testing.T) {
+	node := newTestNode(t, t.TempDir(), 2, termEntries(1, 1, 2))
+	defer node.Stop()
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.state = RaftLeader
+	node.currentTerm = 2
+	node.nextIndex = map[string]uint64{"leader": 4, "other": 4}
+
+	// An entry of an earlier term is not committed by being stored on a majority...
+	node.matchIndex = map[string]uint64{"leader": 2, "other": 0}
+	node.maybeAdvanceCommit()
+	if node.commitIndex != 0 {
+		t.Errorf("commit index = %d with an earlier-term entry on a majority, want 0", node.commitIndex)
+	}
+
+	// ...only together with an entry of the current term after it
+	node.matchIndex["leader"] = 3
+	node.maybeAdvanceCommit()
+	if node.commitIndex != 3 {
+		t.Errorf("commit index = %d with a current-term entry on a majority, want 3", node.commitIndex)
+	}
+}
+
+func TestClusterAppliesTheSameLog(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	transport := &memTransport{nodes: make(map[string]*RaftNode)}
+	var mu sync.Mutex
+	applied := make(map[string][]string)
+
+	for _, id := range ids {
+		var peers []string
+		for _, peer := range ids {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+		id := id
+		node, err := NewRaftNode(id, peers, transport, NewRaftStorage(t.TempDir()), func(entry LogEntry) (interface{}, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if entry.Command != "" {
+				applied[id] = append(applied[id], entry.Command)
+			}
+			return entry.Command, nil
+		}, zap.NewNop().Sugar())
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport.nodes[id] = node
+	}
+	for _, id := range ids {
+		transport.nodes[id].Start()
+		defer transport.nodes[id].Stop()
+	}
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		command := fmt.Sprintf("c%d", i)
+		// Followers forward to the leader; retry while none is elected
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			result, err := transport.nodes[ids[i%len(ids)]].Submit("", command)
+			if err == nil {
+				if result != command {
+					t.Fatalf("Submit(%q) = %v", command, result)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Submit(%q) failed: %v", command, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		want = append(want, command)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := true
+		for _, id := range ids {
+			done = done && len(applied[id]) >= len(want)
+		}
+		snapshot := make(map[string][]string, len(ids))
+		for _, id := range ids {
+			snapshot[id] = append([]string(nil), applied[id]...)
+		}
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			for _, id := range ids {
+				if !reflect.DeepEqual(snapshot[id], want) {
+					t.Errorf("node %s applied %v, want %v", id, snapshot[id], want)
+				}
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,149 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"syndrdb/src/helpers"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// raftRPCTimeout bounds a single raft RPC. Forwarded commands wait for a commit, so they get longer.
+const raftRPCTimeout = 300 * time.Millisecond
+
+// RaftTransport carries raft RPCs between nodes
+type RaftTransport interface {
+	RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	Forward(peer string, req *ForwardRequest) (*ForwardResponse, error)
+}
+
+// raftMessage is the envelope for every raft RPC; exactly one request field is set
+type raftMessage struct {
+	RequestVote   *RequestVoteRequest   `json:",omitempty"`
+	AppendEntries *AppendEntriesRequest `json:",omitempty"`
+	Forward       *ForwardRequest       `json:",omitempty"`
+}
+
+// TCPRaftTransport sends one JSON request per connection to each node's raft address
+type TCPRaftTransport struct {
+	topology *Topology
+	listener net.Listener
+	logger   *zap.SugaredLogger
+	wg       sync.WaitGroup
+}
+
+// NewTCPRaftTransport creates a transport that resolves peers through the topology
+func NewTCPRaftTransport(topology *Topology, logger *zap.SugaredLogger) *TCPRaftTransport {
+	return &TCPRaftTransport{
+		topology: topology,
+		logger:   logger,
+	}
+}
+
+// Listen serves raft RPCs for the given node on its raft address
+func (t *TCPRaftTransport) Listen(node *RaftNode) error {
+	local, exists := t.topology.Node(t.topology.LocalNodeID)
+	if !exists || local.RaftAddress == "" {
+		return fmt.Errorf("local node '%s' has no RaftAddress", t.topology.LocalNodeID)
+	}
+
+	listener, err := net.Listen("tcp", local.RaftAddress)
+	if err != nil {
+		return fmt.Errorf("error starting raft listener on %s: %w", local.RaftAddress, err)
+	}
+	t.listener = listener
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // Listener closed
+			}
+			go t.serve(conn, node)
+		}
+	}()
+	return nil
+}
+
+// Close stops accepting raft RPCs
+func (t *TCPRaftTransport) Close() error {
+	if t.listener == nil {
+		return nil
+	}
+	err := t.listener.Close()
+	t.wg.Wait()
+	return err
+}
+
+func (t *TCPRaftTransport) serve(conn net.Conn, node *RaftNode) {
+	defer helpers.RecoverPanic(t.logger, "raft message from "+conn.RemoteAddr().String())
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(raftRPCTimeout))
+
+	message := &raftMessage{}
+	if err := json.NewDecoder(conn).Decode(message); err != nil {
+		t.logger.Debugf("Invalid raft message from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var response interface{}
+	switch {
+	case message.RequestVote != nil:
+		response = node.HandleRequestVote(message.RequestVote)
+	case message.AppendEntries != nil:
+		response = node.HandleAppendEntries(message.AppendEntries)
+	case message.Forward != nil:
+		response = node.HandleForward(message.Forward)
+	default:
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(raftRPCTimeout))
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		t.logger.Debugf("Failed to answer raft message from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// RequestVote asks a peer for its vote
+func (t *TCPRaftTransport) RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	response := &RequestVoteResponse{}
+	return response, t.call(peer, &raftMessage{RequestVote: req}, response, raftRPCTimeout)
+}
+
+// AppendEntries replicates log entries to a peer
+func (t *TCPRaftTransport) AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	response := &AppendEntriesResponse{}
+	return response, t.call(peer, &raftMessage{AppendEntries: req}, response, raftRPCTimeout)
+}
+
+// Forward hands a DDL command to the leader and waits for it to be applied
+func (t *TCPRaftTransport) Forward(peer string, req *ForwardRequest) (*ForwardResponse, error) {
+	response := &ForwardResponse{}
+	return response, t.call(peer, &raftMessage{Forward: req}, response, raftProposeTimeout+time.Second)
+}
+
+func (t *TCPRaftTransport) call(peer string, message *raftMessage, response interface{}, timeout time.Duration) error {
+	node, exists := t.topology.Node(peer)
+	if !exists || node.RaftAddress == "" {
+		return fmt.Errorf("node '%s' has no RaftAddress", peer)
+	}
+
+	conn, err := net.DialTimeout("tcp", node.RaftAddress, raftRPCTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(message); err != nil {
+		return err
+	}
+	return json.NewDecoder(conn).Decode(response)
+}
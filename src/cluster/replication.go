@@ -0,0 +1,607 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+Write replication with hinted handoff.
+
+Every document write (and DDL, when raft is not handling it) that succeeds
+locally is shipped to each replica listed in the topology, in order.
+
+While a replica is reachable, changes go through a small in-memory queue. When
+a send fails, the replica switches to handoff: the failed change and everything
+after it are appended to a bounded hint file on disk (hints/<node>.hints) and
+replayed in order once the replica answers again. If the hint file reaches its
+size limit the backlog is dropped and the replica is marked as needing a full
+resync, since replaying a partial stream would leave it inconsistent.
+
+Each change is sent as a replicated command (see ReplicatedCommandPrefix) telling the
+replica when the change was made here and how much is still waiting behind it, which is
+what the replica reports as its lag.
+
+Delivery is at least once: a change whose reply was lost is sent again. Changes are numbered
+in the order they are shipped, and the numbers survive a restart (hints/sequence holds the
+highest one handed out), so a replica skips a change it has already applied (see
+AppliedSequences). A replicated ADD DOCUMENT names the ID its document got here, and an ADD
+DOCUMENTS ... FROM SELECT or MERGE the seed of the IDs of the documents it added. A committed
+transaction is one change (see TransactionCommandPrefix), which the replica commits whole.
+
+A change the replica received and refused (a NodeError outside the 4xxx and 5xxx groups) would
+be refused again, so it is skipped and counted as Rejected instead of holding up the changes
+behind it; the replica has diverged from this node and the error is logged.
+*/
+
+const (
+	ReplicaLive           = "LIVE"
+	ReplicaHandoff        = "HANDOFF"
+	ReplicaResyncRequired = "RESYNC_REQUIRED"
+
+	// DefaultMaxHintBytes bounds the on-disk backlog kept for one replica
+	DefaultMaxHintBytes = 64 * 1024 * 1024
+
+	replicaQueueSize     = 1024
+	replicaRetryInterval = time.Second
+
+	// SequenceFileName holds the highest change number handed out, in the hints directory
+	SequenceFileName = "sequence"
+	sequenceReserve  = 4096 // Change numbers handed out per write of the sequence file
+)
+
+// Change is one write shipped to replicas
+type Change struct {
+	Sequence uint64
+	Database string
+	Command  string
+	Time     time.Time
+}
+
+// ReplicatedCommandPrefix marks a change shipped from a primary. The replica applies the
+// command unless it has applied that sequence from that node already, and keeps the rest for
+// SHOW REPLICA STATUS:
+//
+//	REPLICATED <origin node> <sequence> <unix-ms written> <changes waiting> <bytes waiting> <command>
+const ReplicatedCommandPrefix = "REPLICATED"
+
+// ReplicatedChange is a change as a replica receives it
+type ReplicatedChange struct {
+	Origin         string // The node that made the change
+	Sequence       uint64
+	Time           time.Time // When the primary made the change
+	PendingChanges int       // Changes for this replica queued behind it when it was sent
+	PendingBytes   int64
+	Command        string
+}
+
+// FormatReplicatedCommand wraps a change made on the origin node for sending to a replica
+func FormatReplicatedCommand(origin string, change Change, pendingChanges int, pendingBytes int64) string {
+	return fmt.Sprintf("%s %s %d %d %d %d %s", ReplicatedCommandPrefix, origin, change.Sequence, change.Time.UnixMilli(),
+		pendingChanges, pendingBytes, change.Command)
+}
+
+// ParseReplicatedCommand splits a replicated command into its header and the command to apply
+func ParseReplicatedCommand(command string) (*ReplicatedChange, error) {
+	fields := strings.SplitN(strings.TrimSpace(command), " ", 7)
+	if len(fields) < 7 || !strings.EqualFold(fields[0], ReplicatedCommandPrefix) {
+		return nil, fmt.Errorf("invalid replicated command. Expected: %s <ORIGIN> <SEQUENCE> <TIME> <PENDING> <PENDING_BYTES> <COMMAND>", ReplicatedCommandPrefix)
+	}
+
+	change := &ReplicatedChange{Origin: fields[1], Command: fields[6]}
+	var millis int64
+	if _, err := fmt.Sscanf(strings.Join(fields[2:6], " "), "%d %d %d %d",
+		&change.Sequence, &millis, &change.PendingChanges, &change.PendingBytes); err != nil {
+		return nil, fmt.Errorf("invalid replicated command header: %w", err)
+	}
+	change.Time = time.UnixMilli(millis)
+	return change, nil
+}
+
+// TransactionCommandPrefix marks a change carrying a committed transaction. The replica
+// commits its statements in one transaction, at the isolation level it had here:
+//
+//	TRANSACTION {"Isolation":"SNAPSHOT","Commands":["ADD DOCUMENT ...", ...]}
+const TransactionCommandPrefix = "TRANSACTION"
+
+// ReplicatedTransaction is a committed transaction shipped as one change
+type ReplicatedTransaction struct {
+	Isolation string
+	Commands  []string // The statements as sent, in order
+}
+
+// FormatTransactionCommand encodes a committed transaction as the command of one change
+func FormatTransactionCommand(tx ReplicatedTransaction) string {
+	// Strings only, so it cannot fail; JSON keeps the statements on one line
+	encoded, _ := json.Marshal(tx)
+	return TransactionCommandPrefix + " " + string(encoded)
+}
+
+// IsTransactionCommand reports whether the command of a change carries a transaction
+func IsTransactionCommand(command string) bool {
+	fields := strings.Fields(command)
+	return len(fields) > 0 && strings.EqualFold(fields[0], TransactionCommandPrefix)
+}
+
+// ParseTransactionCommand decodes the transaction a change carries
+func ParseTransactionCommand(command string) (*ReplicatedTransaction, error) {
+	fields := strings.SplitN(strings.TrimSpace(command), " ", 2)
+	if len(fields) < 2 || !strings.EqualFold(fields[0], TransactionCommandPrefix) {
+		return nil, fmt.Errorf("invalid replicated transaction. Expected: %s <JSON>", TransactionCommandPrefix)
+	}
+	tx := &ReplicatedTransaction{}
+	if err := json.Unmarshal([]byte(fields[1]), tx); err != nil {
+		return nil, fmt.Errorf("invalid replicated transaction: %w", err)
+	}
+	if len(tx.Commands) == 0 {
+		return nil, fmt.Errorf("invalid replicated transaction: it has no statements")
+	}
+	return tx, nil
+}
+
+// ChangeSender delivers a change to a replica
+type ChangeSender interface {
+	Execute(node Node, database string, command string) error
+}
+
+// ReplicaStats are the handoff metrics for one replica
+type ReplicaStats struct {
+	Replica        string
+	State          string
+	QueuedChanges  int   // In memory, waiting to be sent
+	BacklogChanges int   // Buffered on disk while the replica was unreachable
+	BacklogBytes   int64 // Size of the on-disk backlog
+	MaxBacklog     int64
+	Delivered      uint64
+	Replayed       uint64 // Delivered from the on-disk backlog
+	Dropped        uint64 // Lost because the backlog overflowed
+	Filtered       uint64 // Left out by the replica's replication filter
+	Rejected       uint64 // Refused by the replica and skipped
+	LastError      string
+
+	// How far the replica is behind: changes not delivered yet, their size, and the age of the oldest
+	LagChanges int
+	LagBytes   int64
+	LagSeconds float64
+}
+
+// replicaStream ships changes to a single replica
+type replicaStream struct {
+	mu     sync.Mutex
+	node   Node
+	filter *ReplicationFilter // nil ships every change
+	hints  *HintLog
+	state  string
+	queue  []Change
+	stats  ReplicaStats
+	wakeCh chan struct{}
+}
+
+// Replicator fans local writes out to every replica
+type Replicator struct {
+	mu           sync.Mutex
+	origin       string // This node
+	sequence     uint64
+	reserved     uint64 // The sequence file allows numbers up to this one
+	sequencePath string
+	streams      []*replicaStream
+	sender       ChangeSender
+	logger       *zap.SugaredLogger
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
+}
+
+// NewReplicator opens the hint logs for every replica in the topology. Replica filters compare
+// names by identifiers.
+func NewReplicator(topology *Topology, sender ChangeSender, dataDir string, maxHintBytes int64, identifiers helpers.Identifiers, logger *zap.SugaredLogger) (*Replicator, error) {
+	if maxHintBytes <= 0 {
+		maxHintBytes = DefaultMaxHintBytes
+	}
+
+	r := &Replicator{
+		origin:       topology.LocalNodeID,
+		sequencePath: filepath.Join(dataDir, HintsDirName, SequenceFileName),
+		sender:       sender,
+		logger:       logger,
+		stopCh:       make(chan struct{}),
+	}
+	if err := r.loadSequence(); err != nil {
+		return nil, err
+	}
+
+	for _, replicaID := range topology.Replicas {
+		node, _ := topology.Node(replicaID)
+		hints, err := OpenHintLog(dataDir, replicaID, maxHintBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		filter := topology.ReplicaFilters[replicaID]
+		if filter != nil {
+			scoped := *filter
+			scoped.identifiers = identifiers
+			filter = &scoped
+		}
+		stream := &replicaStream{
+			node:   node,
+			filter: filter,
+			hints:  hints,
+			state:  ReplicaLive,
+			wakeCh: make(chan struct{}, 1),
+			stats:  ReplicaStats{Replica: replicaID, MaxBacklog: maxHintBytes},
+		}
+		// A backlog left over from before a restart has to be replayed first
+		if entries, _ := hints.Size(); entries > 0 {
+			stream.state = ReplicaHandoff
+			logger.Infof("Replica '%s' has %d buffered change(s) from a previous run", replicaID, entries)
+			if pending, err := hints.Pending(); err == nil && len(pending) > 0 {
+				r.sequence = max(r.sequence, pending[len(pending)-1].Sequence)
+			}
+		}
+		r.streams = append(r.streams, stream)
+	}
+	r.reserved = r.sequence
+	return r, nil
+}
+
+// loadSequence continues the change numbers after the highest one a previous run handed out
+func (r *Replicator) loadSequence() error {
+	data, err := os.ReadFile(r.sequencePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read replication sequence: %w", err)
+	}
+	if r.sequence, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+		return fmt.Errorf("invalid replication sequence in %s: %w", r.sequencePath, err)
+	}
+	return nil
+}
+
+// reserveSequenceLocked records that numbers up to another sequenceReserve may be handed out,
+// before the first of them is. Caller holds r.mu.
+func (r *Replicator) reserveSequenceLocked() error {
+	reserved := r.sequence + sequenceReserve
+	tempPath := r.sequencePath + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to write replication sequence: %w", err)
+	}
+	if _, err := helpers.Write(file, []byte(strconv.FormatUint(reserved, 10)+"\n")); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write replication sequence: %w", err)
+	}
+	if err := helpers.Sync(file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync replication sequence: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write replication sequence: %w", err)
+	}
+	if err := helpers.Rename(tempPath, r.sequencePath); err != nil {
+		return fmt.Errorf("failed to replace replication sequence: %w", err)
+	}
+	r.reserved = reserved
+	return nil
+}
+
+// Start runs one delivery loop per replica
+func (r *Replicator) Start() {
+	for _, stream := range r.streams {
+		r.wg.Add(1)
+		go func(stream *replicaStream) {
+			defer r.wg.Done()
+			helpers.Supervise(r.logger, "replication to "+stream.node.ID, func() { r.deliver(stream) })
+		}(stream)
+	}
+}
+
+// Stop halts delivery. Anything still queued in memory is moved to the hint log so it survives a restart.
+func (r *Replicator) Stop() {
+	close(r.stopCh)
+	r.wg.Wait()
+
+	for _, stream := range r.streams {
+		stream.mu.Lock()
+		if stream.state == ReplicaLive && len(stream.queue) > 0 {
+			r.spillLocked(stream, stream.queue)
+		}
+		stream.queue = nil
+		stream.mu.Unlock()
+	}
+}
+
+// Replicate queues a locally applied write for every replica
+func (r *Replicator) Replicate(database, command string) {
+	// Held until every stream has the change, so the streams get the changes in sequence order
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sequence >= r.reserved {
+		if err := r.reserveSequenceLocked(); err != nil {
+			// The change is still shipped; after a restart replicas may skip changes numbered past the file
+			r.logger.Errorf("Failed to reserve replication sequence numbers: %v", err)
+		}
+	}
+	r.sequence++
+	change := Change{Sequence: r.sequence, Database: database, Command: command, Time: time.Now()}
+
+	transaction := IsTransactionCommand(command)
+	targetKnown := false
+	targetDatabase, targetBundle := "", ""
+	for _, stream := range r.streams {
+		shipped := change
+		allowed := true
+		switch {
+		case stream.filter == nil:
+		case transaction:
+			shipped.Command, allowed = stream.filter.filterTransaction(database, command)
+		default:
+			if !targetKnown {
+				var ok bool
+				if targetDatabase, targetBundle, ok = changeTarget(database, command); !ok {
+					targetDatabase, targetBundle = database, ""
+				}
+				targetKnown = true
+			}
+			allowed = stream.filter.allows(targetDatabase, targetBundle)
+		}
+
+		stream.mu.Lock()
+		if !allowed {
+			stream.stats.Filtered++
+			stream.mu.Unlock()
+			continue
+		}
+		switch stream.state {
+		case ReplicaResyncRequired:
+			stream.stats.Dropped++
+		case ReplicaHandoff:
+			r.spillLocked(stream, []Change{shipped})
+		default:
+			if len(stream.queue) < replicaQueueSize {
+				stream.queue = append(stream.queue, shipped)
+			} else {
+				// The replica is not keeping up; buffer on disk instead of growing memory
+				r.enterHandoffLocked(stream, fmt.Errorf("replication queue full"))
+				r.spillLocked(stream, append(stream.queue, shipped))
+				stream.queue = nil
+			}
+		}
+		stream.mu.Unlock()
+
+		select {
+		case stream.wakeCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stats returns the handoff metrics for every replica
+func (r *Replicator) Stats() []ReplicaStats {
+	stats := make([]ReplicaStats, 0, len(r.streams))
+	for _, stream := range r.streams {
+		stream.mu.Lock()
+		s := stream.stats
+		s.State = stream.state
+		s.QueuedChanges = len(stream.queue)
+		s.BacklogChanges, s.BacklogBytes = stream.hints.Size()
+
+		s.LagChanges = s.QueuedChanges + s.BacklogChanges
+		s.LagBytes = s.BacklogBytes
+		for _, change := range stream.queue {
+			s.LagBytes += int64(len(change.Command))
+		}
+		oldest := stream.hints.Oldest()
+		if oldest.IsZero() && len(stream.queue) > 0 {
+			oldest = stream.queue[0].Time
+		}
+		if !oldest.IsZero() {
+			s.LagSeconds = time.Since(oldest).Seconds()
+		}
+		stream.mu.Unlock()
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// deliver sends queued changes to one replica and replays its backlog when it comes back
+func (r *Replicator) deliver(stream *replicaStream) {
+	ticker := time.NewTicker(replicaRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-stream.wakeCh:
+		case <-ticker.C:
+		}
+
+		stream.mu.Lock()
+		state := stream.state
+		stream.mu.Unlock()
+
+		switch state {
+		case ReplicaHandoff:
+			r.replayBacklog(stream)
+		case ReplicaLive:
+			r.drainQueue(stream)
+		}
+	}
+}
+
+// drainQueue sends in-memory changes until the queue is empty or a send fails
+func (r *Replicator) drainQueue(stream *replicaStream) {
+	for {
+		stream.mu.Lock()
+		if stream.state != ReplicaLive || len(stream.queue) == 0 {
+			stream.mu.Unlock()
+			return
+		}
+		change := stream.queue[0]
+		var waitingBytes int64
+		for _, waiting := range stream.queue[1:] {
+			waitingBytes += int64(len(waiting.Command))
+		}
+		command := FormatReplicatedCommand(r.origin, change, len(stream.queue)-1, waitingBytes)
+		stream.mu.Unlock()
+
+		err := r.sender.Execute(stream.node, change.Database, command)
+
+		stream.mu.Lock()
+		if err != nil && refused(err) {
+			r.rejectLocked(stream, change, err)
+			stream.queue = stream.queue[1:]
+			stream.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			// Keep the failed change and everything after it, in order, on disk
+			r.enterHandoffLocked(stream, err)
+			r.spillLocked(stream, stream.queue)
+			stream.queue = nil
+			stream.mu.Unlock()
+			return
+		}
+		stream.queue = stream.queue[1:]
+		stream.stats.Delivered++
+		stream.mu.Unlock()
+	}
+}
+
+// replayBacklog sends the on-disk backlog in order and goes live again once it is empty
+func (r *Replicator) replayBacklog(stream *replicaStream) {
+	pending, err := stream.hints.Pending()
+	if err != nil {
+		r.logger.Errorf("Failed to read hint log for replica '%s': %v", stream.node.ID, err)
+		return
+	}
+
+	var waitingBytes int64
+	for _, change := range pending {
+		waitingBytes += int64(len(change.Command))
+	}
+
+	sent := 0
+	var sendErr error
+	var rejected []Change
+	var rejectedErrs []error
+	for i, change := range pending {
+		waitingBytes -= int64(len(change.Command))
+		command := FormatReplicatedCommand(r.origin, change, len(pending)-i-1, waitingBytes)
+		if sendErr = r.sender.Execute(stream.node, change.Database, command); sendErr != nil {
+			if !refused(sendErr) {
+				break
+			}
+			rejected = append(rejected, change)
+			rejectedErrs = append(rejectedErrs, sendErr)
+			sendErr = nil
+		}
+		sent++
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	// Appends happen under stream.mu, so anything added during the replay stays after what was sent
+	if sent > 0 {
+		if err := stream.hints.Remove(sent); err != nil {
+			r.logger.Errorf("Failed to trim hint log for replica '%s': %v", stream.node.ID, err)
+			return
+		}
+		for i, change := range rejected {
+			r.rejectLocked(stream, change, rejectedErrs[i])
+		}
+		stream.stats.Delivered += uint64(sent - len(rejected))
+		stream.stats.Replayed += uint64(sent - len(rejected))
+	}
+	if sendErr != nil {
+		stream.stats.LastError = sendErr.Error()
+		return
+	}
+
+	if entries, _ := stream.hints.Size(); entries == 0 && stream.state == ReplicaHandoff {
+		stream.state = ReplicaLive
+		r.logger.Infof("Replica '%s' caught up after replaying %d change(s)", stream.node.ID, stream.stats.Replayed)
+	}
+}
+
+// refused reports whether a replica received a change and refused it for good. Errors of the
+// 4xxx and 5xxx groups (permissions, a busy or read-only replica) may clear, so the change is
+// kept for later like one that never arrived.
+func refused(err error) bool {
+	var nodeErr *NodeError
+	if !errors.As(err, &nodeErr) {
+		return false
+	}
+	return !strings.HasPrefix(string(nodeErr.Code), "SDB-4") && !strings.HasPrefix(string(nodeErr.Code), "SDB-5")
+}
+
+// rejectLocked skips a change the replica refused. Caller holds stream.mu.
+func (r *Replicator) rejectLocked(stream *replicaStream, change Change, cause error) {
+	stream.stats.Rejected++
+	stream.stats.LastError = cause.Error()
+	r.logger.Errorf("Replica '%s' refused change %d to database '%s'; skipping it, the replica no longer matches this node: %v",
+		stream.node.ID, change.Sequence, change.Database, cause)
+}
+
+// enterHandoffLocked switches a replica to on-disk buffering. Caller holds stream.mu.
+func (r *Replicator) enterHandoffLocked(stream *replicaStream, cause error) {
+	if stream.state == ReplicaLive {
+		r.logger.Warnf("Replica '%s' unreachable, buffering changes: %v", stream.node.ID, cause)
+	}
+	stream.state = ReplicaHandoff
+	stream.stats.LastError = cause.Error()
+}
+
+// spillLocked appends changes to the hint log, giving up on the replica if the log overflows. Caller holds stream.mu.
+func (r *Replicator) spillLocked(stream *replicaStream, changes []Change) {
+	for i, change := range changes {
+		err := stream.hints.Append(change)
+		if err == nil {
+			continue
+		}
+
+		stream.stats.Dropped += uint64(len(changes) - i)
+		if err == ErrHintLogFull {
+			entries, _ := stream.hints.Size()
+			stream.stats.Dropped += uint64(entries)
+			stream.hints.Clear()
+			stream.state = ReplicaResyncRequired
+			stream.stats.LastError = "hint log exceeded its size limit; the replica needs a full resync"
+			r.logger.Errorf("Replica '%s' backlog exceeded %d bytes; dropping it, the replica needs a full resync", stream.node.ID, stream.stats.MaxBacklog)
+		} else {
+			stream.stats.LastError = err.Error()
+			r.logger.Errorf("Failed to buffer change for replica '%s': %v", stream.node.ID, err)
+		}
+		return
+	}
+}
+
+// IsReplicatedCommand reports whether a successful command must be shipped to replicas.
+// DDL is left out when raft already replicates it.
+func IsReplicatedCommand(command string, consensusEnabled bool) bool {
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return false
+	}
+
+	switch statement.(type) {
+	case *engine.DocumentCommand, *engine.InsertSelectCommand, *engine.DocumentUpdateCommand,
+		*engine.DocumentDeleteCommand, *engine.MergeCommand, *engine.EraseSubjectCommand:
+		return true
+	}
+	return !consensusEnabled && IsMetadataStatement(statement)
+}
@@ -0,0 +1,142 @@
+package cluster
+
+import (
+	"strings"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+)
+
+/*
+Replication filters.
+
+A primary can ship a replica only the writes it needs, for example a reporting replica
+that carries a few bundles. Filters are set per replica in the primary's topology:
+
+  "ReplicaFilters": {
+    "node3": { "Databases": [ "shop" ], "Bundles": [ "Orders", "OrderLines" ] }
+  }
+
+A change is shipped when the database it writes is listed, or Databases is empty, and the
+bundle it writes is listed, or Bundles is empty. DDL on a database itself is filtered by
+the database only. SNAPSHOT and CLONE BUNDLE are filtered by the bundle and database they
+create, CREATE AGGREGATE by its source bundle, webhooks by the bundle they watch, and ADOPT
+ORPHANED FILE by the database it adopts the file into. A change whose bundle cannot be told is
+filtered by its database only. A transaction is shipped with the statements the filter
+passes, and left out when it passes none. Changes left out are counted as Filtered in the
+replica's stats.
+*/
+
+// ReplicationFilter selects the changes shipped to one replica
+type ReplicationFilter struct {
+	Databases []string
+	Bundles   []string
+
+	identifiers helpers.Identifiers // How names are compared; set by NewReplicator
+}
+
+// allows reports whether a change to a bundle of a database passes the filter; an empty
+// bundle stands for the database itself
+func (f *ReplicationFilter) allows(database, bundle string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Databases) > 0 && !f.contains(f.Databases, database) {
+		return false
+	}
+	return bundle == "" || len(f.Bundles) == 0 || f.contains(f.Bundles, bundle)
+}
+
+// changeTarget returns the database and bundle a replicated command writes; ok is false when
+// the command does not say
+func changeTarget(database, command string) (string, string, bool) {
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return "", "", false
+	}
+
+	switch cmd := statement.(type) {
+	case *engine.DocumentCommand:
+		return database, cmd.BundleName, true
+	case *engine.InsertSelectCommand:
+		return database, cmd.BundleName, true
+	case *engine.MergeCommand:
+		return database, cmd.Target, true
+	case *engine.EraseSubjectCommand:
+		// Erases documents of several bundles
+		return database, "", true
+	case *engine.DocumentUpdateCommand:
+		return database, cmd.BundleName, true
+	case *engine.DocumentDeleteCommand:
+		return database, cmd.BundleName, true
+	case *engine.BundleCommand:
+		return database, cmd.BundleName, true
+	case *engine.CreateIndexCommand:
+		return database, cmd.BundleName, true
+	case *engine.CreateAggregateCommand:
+		return database, cmd.SourceBundle, true
+	case *engine.CreateWebhookCommand:
+		return database, cmd.BundleName, true
+	case *engine.DeleteWebhookCommand:
+		return database, cmd.BundleName, true
+	case *engine.DatabaseCommand:
+		return cmd.DatabaseName, "", true
+	case *engine.AdoptOrphanedFileCommand:
+		return cmd.DatabaseName, "", true
+	case *engine.BundleCopyCommand:
+		target := cmd.TargetBundle
+		if target == "" {
+			target = cmd.SourceBundle
+		}
+		if cmd.TargetDatabase != "" {
+			database = cmd.TargetDatabase
+		}
+		return database, target, true
+	}
+	return "", "", false
+}
+
+func containsFold(names []string, name string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether a database or bundle name is in a list, compared as the server's
+// -identifiercase says
+func (f *ReplicationFilter) contains(names []string, name string) bool {
+	for _, candidate := range names {
+		if f.identifiers.Same(candidate, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTransaction returns the command of a transaction change keeping only the statements
+// the filter passes; ok is false when it passes none of them
+func (f *ReplicationFilter) filterTransaction(database, command string) (string, bool) {
+	tx, err := ParseTransactionCommand(command)
+	if err != nil {
+		return command, f.allows(database, "")
+	}
+	var kept []string
+	for _, statement := range tx.Commands {
+		targetDatabase, targetBundle, ok := changeTarget(database, statement)
+		if !ok {
+			targetDatabase, targetBundle = database, ""
+		}
+		if f.allows(targetDatabase, targetBundle) {
+			kept = append(kept, statement)
+		}
+	}
+	switch len(kept) {
+	case 0:
+		return "", false
+	case len(tx.Commands):
+		return command, true
+	}
+	return FormatTransactionCommand(ReplicatedTransaction{Isolation: tx.Isolation, Commands: kept}), true
+}
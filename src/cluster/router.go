@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syndrdb/src/engine"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+
+	"go.uber.org/zap"
+)
+
+// RoutedCommandPrefix marks a SELECT that another node has already routed.
+// The receiving node runs it against the listed partitions only and never routes it again:
+//
+//	ROUTED PARTITIONS 0,2 SELECT DOCUMENTS FROM "Orders" WHERE ...
+const RoutedCommandPrefix = "ROUTED PARTITIONS"
+
+// LocalQuery runs a SELECT against the given partitions on this node
+type LocalQuery func(partitions []int) ([]*models.Document, error)
+
+// QueryRouter fans SELECTs on partitioned bundles out to the nodes owning each partition
+type QueryRouter struct {
+	topology *Topology
+	client   NodeClient
+	logger   *zap.SugaredLogger
+}
+
+// NewQueryRouter creates a router for the given topology
+func NewQueryRouter(topology *Topology, client NodeClient, logger *zap.SugaredLogger) *QueryRouter {
+	return &QueryRouter{
+		topology: topology,
+		client:   client,
+		logger:   logger,
+	}
+}
+
+// ShouldRoute reports whether a SELECT on the bundle needs to involve other nodes
+func (r *QueryRouter) ShouldRoute(bundle *models.Bundle) bool {
+	return r != nil && bundle.Partitioning != nil && r.topology.HasRemotePartitions(bundle.Name)
+}
+
+// nodeResult is what one node contributed to a routed query
+type nodeResult struct {
+	nodeID     string
+	partitions []int
+	documents  []*models.Document
+	err        error
+}
+
+// RouteSelect runs a SELECT DOCUMENTS across every node owning a partition the WHERE clause can match.
+// ORDER BY and LIMIT are pushed down to each node and applied again to the merged result;
+// SAMPLE is pushed down with its seed.
+// If any node fails the whole query fails, naming each failed node and the partitions it owns,
+// rather than silently returning a partial result.
+func (r *QueryRouter) RouteSelect(databaseName string, bundle *models.Bundle, whereClause string, sample *engine.SampleClause, modifiers *engine.SelectModifiers, local LocalQuery) ([]*models.Document, error) {
+	var whereGroup *engine.WhereGroup
+	if strings.TrimSpace(whereClause) != "" {
+		group, err := engine.ParseWhereClause(whereClause)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing WHERE clause: %v", err)
+		}
+		whereGroup = group
+	}
+
+	partitions := engine.PrunePartitions(bundle.Partitioning, whereGroup)
+	owners := r.topology.GroupByOwner(bundle.Name, partitions)
+
+	results := make(chan nodeResult, len(owners))
+	var wg sync.WaitGroup
+	for nodeID, nodePartitions := range owners {
+		wg.Add(1)
+		go func(nodeID string, nodePartitions []int) {
+			defer wg.Done()
+			result := nodeResult{nodeID: nodeID, partitions: nodePartitions}
+			defer func() {
+				// A panic fails this node's part of the query rather than the server
+				if recovered := recover(); recovered != nil {
+					r.logger.Errorw("Recovered from a panic", "task", "routed query on node "+nodeID, "panic", recovered, "stack", string(debug.Stack()))
+					result.documents, result.err = nil, fmt.Errorf("internal error: %v", recovered)
+					results <- result
+				}
+			}()
+			if nodeID == r.topology.LocalNodeID {
+				result.documents, result.err = local(nodePartitions)
+			} else {
+				result.documents, result.err = r.queryRemote(nodeID, nodePartitions, databaseName, bundle.Name, whereClause, sample, modifiers)
+			}
+			results <- result
+		}(nodeID, nodePartitions)
+	}
+	wg.Wait()
+	close(results)
+
+	var merged []*models.Document
+	var failures []nodeResult
+	for result := range results {
+		if result.err != nil {
+			failures = append(failures, result)
+			continue
+		}
+		merged = append(merged, result.documents...)
+	}
+
+	if len(failures) > 0 {
+		return nil, partialFailureError(bundle.Name, len(owners), failures)
+	}
+
+	r.logger.Debugf("Routed SELECT on bundle '%s' across %d node(s), %d document(s) before merge", bundle.Name, len(owners), len(merged))
+
+	if modifiers == nil {
+		// Still return a stable order so results do not depend on which node answered first
+		modifiers = &engine.SelectModifiers{}
+	}
+	return engine.ApplySelectModifiers(merged, modifiers), nil
+}
+
+// queryRemote sends the routed form of the SELECT to a peer
+func (r *QueryRouter) queryRemote(nodeID string, partitions []int, databaseName, bundleName, whereClause string, sample *engine.SampleClause, modifiers *engine.SelectModifiers) ([]*models.Document, error) {
+	node, exists := r.topology.Node(nodeID)
+	if !exists {
+		return nil, fmt.Errorf("node is not in the cluster topology")
+	}
+	command := BuildRoutedCommand(partitions, bundleName, whereClause, sample, modifiers)
+	return r.client.Query(node, databaseName, command)
+}
+
+// BuildRoutedCommand renders the SELECT a peer runs for its share of the partitions
+func BuildRoutedCommand(partitions []int, bundleName, whereClause string, sample *engine.SampleClause, modifiers *engine.SelectModifiers) string {
+	partitionList := make([]string, len(partitions))
+	for i, partition := range partitions {
+		partitionList[i] = fmt.Sprintf("%d", partition)
+	}
+
+	command := fmt.Sprintf("%s %s SELECT DOCUMENTS FROM \"%s\"", RoutedCommandPrefix, strings.Join(partitionList, ","), bundleName)
+	if sample != nil {
+		command += " " + sample.String()
+	}
+	if strings.TrimSpace(whereClause) != "" {
+		command += " WHERE " + whereClause
+	}
+	if clause := modifiers.String(); clause != "" {
+		command += " " + clause
+	}
+	return command
+}
+
+// ParseRoutedCommand splits a routed command into its partitions and the SELECT to run
+func ParseRoutedCommand(command string) ([]int, string, error) {
+	fields := strings.Fields(command)
+	if len(fields) < 4 || !strings.EqualFold(fields[0], "ROUTED") || !strings.EqualFold(fields[1], "PARTITIONS") {
+		return nil, "", fmt.Errorf("invalid routed command. Expected: %s <P1,P2,...> SELECT ...", RoutedCommandPrefix)
+	}
+
+	var partitions []int
+	for _, raw := range strings.Split(fields[2], ",") {
+		var partition int
+		if _, err := fmt.Sscanf(raw, "%d", &partition); err != nil || partition < 0 {
+			return nil, "", fmt.Errorf("invalid partition number '%s'", raw)
+		}
+		partitions = append(partitions, partition)
+	}
+
+	return partitions, strings.Join(fields[3:], " "), nil
+}
+
+// partialFailureError describes which nodes and partitions could not be read
+func partialFailureError(bundleName string, nodeCount int, failures []nodeResult) error {
+	sort.Slice(failures, func(i, j int) bool { return failures[i].nodeID < failures[j].nodeID })
+
+	details := make([]string, len(failures))
+	for i, failure := range failures {
+		details[i] = fmt.Sprintf("node '%s' (partitions %v): %v", failure.nodeID, failure.partitions, failure.err)
+	}
+	return protocol.Errorf(protocol.ErrNodeUnavailable, "query on bundle '%s' failed on %d of %d node(s): %s",
+		bundleName, len(failures), nodeCount, strings.Join(details, "; "))
+}
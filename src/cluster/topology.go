@@ -0,0 +1,188 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+/*
+The cluster topology tells a node which peers exist and which of them own each
+partition of a partitioned bundle. It is loaded from a JSON file at startup:
+
+{
+  "Username": "cluster",
+  "Password": "secret",
+  "Nodes": [
+    { "ID": "node1", "Address": "10.0.0.1:1776", "RaftAddress": "10.0.0.1:1777" },
+    { "ID": "node2", "Address": "10.0.0.2:1776", "RaftAddress": "10.0.0.2:1777" }
+  ],
+  "Partitions": {
+    "Orders": { "0": "node1", "1": "node2", "2": "node2" }
+  },
+  "Replicas": [ "node2" ]
+}
+
+Partitions that are not listed are owned by the local node. When the nodes have a
+RaftAddress, DDL is replicated between them through the raft log (see raft.go).
+Replicas lists the nodes that receive this node's writes (see replication.go), and
+ReplicaFilters can narrow what each of them gets (see replication_filter.go). On
+a replica, "ReplicaOf": "node1" names the node it receives them from and makes it a
+read-only hot standby: it answers reads and refuses writes from clients.
+*/
+
+// Node is a single SyndrDB server taking part in the cluster
+type Node struct {
+	ID          string
+	Address     string // host:port of the node's client listener
+	RaftAddress string // host:port for consensus traffic; empty disables metadata consensus
+}
+
+// Topology describes the nodes in the cluster and which node owns each bundle partition
+type Topology struct {
+	LocalNodeID string
+	Username    string // Credentials used for node-to-node connections
+	Password    string
+	Nodes       []Node
+	Partitions  map[string]map[int]string // bundle name -> partition -> node ID
+	Replicas    []string                  // Nodes this node ships its document writes to
+	ReplicaOf   string                    // The primary whose writes this node receives; empty unless it is a hot standby
+
+	ReplicaFilters map[string]*ReplicationFilter // Replica ID -> the changes it receives, see replication_filter.go
+}
+
+// LoadTopology reads and validates a cluster topology file
+func LoadTopology(path string, localNodeID string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster config: %w", err)
+	}
+
+	topology := &Topology{}
+	if err := json.Unmarshal(data, topology); err != nil {
+		return nil, fmt.Errorf("failed to parse cluster config: %w", err)
+	}
+
+	if localNodeID != "" {
+		topology.LocalNodeID = localNodeID
+	}
+	if topology.LocalNodeID == "" {
+		return nil, fmt.Errorf("cluster config does not identify the local node (use -nodeid)")
+	}
+
+	if err := topology.Validate(); err != nil {
+		return nil, err
+	}
+	return topology, nil
+}
+
+// Validate checks that every partition owner is a known node
+func (t *Topology) Validate() error {
+	known := make(map[string]bool, len(t.Nodes))
+	for _, node := range t.Nodes {
+		if node.ID == "" || node.Address == "" {
+			return fmt.Errorf("cluster nodes need both an ID and an Address")
+		}
+		if (node.RaftAddress == "") != (t.Nodes[0].RaftAddress == "") {
+			return fmt.Errorf("either every cluster node or none must have a RaftAddress")
+		}
+		if known[node.ID] {
+			return fmt.Errorf("duplicate cluster node '%s'", node.ID)
+		}
+		known[node.ID] = true
+	}
+
+	if !known[t.LocalNodeID] {
+		return fmt.Errorf("local node '%s' is not listed in the cluster nodes", t.LocalNodeID)
+	}
+
+	for _, replica := range t.Replicas {
+		if !known[replica] || replica == t.LocalNodeID {
+			return fmt.Errorf("replica '%s' must be another node in the cluster", replica)
+		}
+	}
+
+	for replica := range t.ReplicaFilters {
+		if !containsFold(t.Replicas, replica) {
+			return fmt.Errorf("replication filter for '%s', which is not listed in Replicas", replica)
+		}
+	}
+
+	if t.ReplicaOf != "" {
+		if !known[t.ReplicaOf] || t.ReplicaOf == t.LocalNodeID {
+			return fmt.Errorf("ReplicaOf '%s' must be another node in the cluster", t.ReplicaOf)
+		}
+		if len(t.Replicas) > 0 {
+			return fmt.Errorf("a hot standby (ReplicaOf) cannot ship writes to replicas of its own")
+		}
+	}
+
+	for bundleName, owners := range t.Partitions {
+		for partition, nodeID := range owners {
+			if !known[nodeID] {
+				return fmt.Errorf("partition %d of bundle '%s' is assigned to unknown node '%s'", partition, bundleName, nodeID)
+			}
+		}
+	}
+	return nil
+}
+
+// Node returns a node by ID
+func (t *Topology) Node(nodeID string) (Node, bool) {
+	for _, node := range t.Nodes {
+		if node.ID == nodeID {
+			return node, true
+		}
+	}
+	return Node{}, false
+}
+
+// ConsensusEnabled reports whether DDL is replicated through raft
+func (t *Topology) ConsensusEnabled() bool {
+	return len(t.Nodes) > 0 && t.Nodes[0].RaftAddress != ""
+}
+
+// PeerIDs returns the IDs of every node except the local one
+func (t *Topology) PeerIDs() []string {
+	var peers []string
+	for _, node := range t.Nodes {
+		if node.ID != t.LocalNodeID {
+			peers = append(peers, node.ID)
+		}
+	}
+	return peers
+}
+
+// OwnerOf returns the node that owns a partition of a bundle
+func (t *Topology) OwnerOf(bundleName string, partition int) string {
+	if owners, exists := t.Partitions[bundleName]; exists {
+		if nodeID, exists := owners[partition]; exists {
+			return nodeID
+		}
+	}
+	return t.LocalNodeID
+}
+
+// GroupByOwner maps each owning node to the sorted partitions it holds
+func (t *Topology) GroupByOwner(bundleName string, partitions []int) map[string][]int {
+	groups := make(map[string][]int)
+	for _, partition := range partitions {
+		owner := t.OwnerOf(bundleName, partition)
+		groups[owner] = append(groups[owner], partition)
+	}
+	for _, group := range groups {
+		sort.Ints(group)
+	}
+	return groups
+}
+
+// HasRemotePartitions reports whether any partition of the bundle lives on another node
+func (t *Topology) HasRemotePartitions(bundleName string) bool {
+	for _, nodeID := range t.Partitions[bundleName] {
+		if nodeID != t.LocalNodeID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,459 @@
+// Command syndrbench measures SyndrDB's performance, so changes can be compared release to
+// release.
+//
+// By default it is a load generator: workers send a mix of reads and writes to a server
+// through the Go client and it reports throughput and latency percentiles per kind of
+// operation. With -micro it instead runs benchmarks of core paths in process (filtering,
+// index lookups and the buffer pool), with no server. Either way -out saves the report as
+// JSON, and -baseline compares the run with a saved report, exiting with status 1 when it
+// is slower by more than -tolerance.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syndrdb/src/client"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+// benchBundle is the bundle the load generator creates, fills and drops
+const benchBundle = "syndrbench"
+
+// config is what a run was asked to do, kept in its report
+type config struct {
+	Seeds       []string      `json:",omitempty"`
+	Database    string        `json:",omitempty"`
+	Concurrency int           `json:",omitempty"`
+	Duration    time.Duration `json:",omitempty"`
+	Operations  int           `json:",omitempty"` // Total operations, instead of Duration
+	ReadRatio   float64       // Share of operations that are reads
+	UpdateRatio float64       // Share of writes that update a document instead of adding one
+	DocSize     int           // Bytes of payload per document
+	Documents   int           // Documents loaded before the run
+	Index       bool          // Whether reads are served by a hash index
+	Format      string        `json:",omitempty"`
+	Micro       bool          `json:",omitempty"`
+}
+
+// opStats summarizes the operations of one kind. Latencies are in milliseconds.
+type opStats struct {
+	Count      int
+	Errors     int
+	Throughput float64 // Operations per second
+	P50        float64
+	P90        float64
+	P99        float64
+	P999       float64
+	Max        float64
+}
+
+// microResult is the outcome of one in-process benchmark
+type microResult struct {
+	Name        string
+	NsPerOp     float64
+	AllocsPerOp int64
+	BytesPerOp  int64
+}
+
+// report is the outcome of a run, as written by -out and read by -baseline
+type report struct {
+	Version    int
+	Config     config
+	Started    time.Time
+	Elapsed    float64             `json:",omitempty"` // Seconds
+	Operations map[string]*opStats `json:",omitempty"` // By kind: read, insert and update
+	Micro      []microResult       `json:",omitempty"`
+}
+
+const reportVersion = 1
+
+func main() {
+	var cfg config
+	var seeds, user, password, out, baseline string
+	var seed int64
+	var tolerance float64
+	var keep bool
+
+	flag.StringVar(&seeds, "seeds", "127.0.0.1:1776", "Comma separated host:port of the server or cluster nodes")
+	flag.StringVar(&cfg.Database, "database", "syndrbench", "Database to run in; created when it does not exist")
+	flag.StringVar(&user, "user", "root", "User to connect as")
+	flag.StringVar(&password, "password", "", "Password of -user")
+	flag.StringVar(&cfg.Format, "format", "json", "Response format: json or msgpack")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 8, "Workers sending operations at once, each over connections of its own")
+	flag.DurationVar(&cfg.Duration, "duration", 30*time.Second, "How long to send operations")
+	flag.IntVar(&cfg.Operations, "ops", 0, "Stop after this many operations instead of after -duration (0 uses -duration)")
+	flag.Float64Var(&cfg.ReadRatio, "readratio", 0.8, "Share of operations that are reads, from 0 to 1")
+	flag.Float64Var(&cfg.UpdateRatio, "updateratio", 0.5, "Share of writes that update a document instead of adding one, from 0 to 1")
+	flag.IntVar(&cfg.DocSize, "docsize", 256, "Bytes of payload in each document")
+	flag.IntVar(&cfg.Documents, "documents", 10000, "Documents loaded before the run, and in the bundles of -micro")
+	flag.BoolVar(&cfg.Index, "index", true, "Serve reads by key with a hash index instead of a full scan")
+	flag.BoolVar(&keep, "keep", false, "Keep the benchmark bundle after the run")
+	flag.Int64Var(&seed, "seed", 0, "Seed of the keys and payloads chosen (0 picks one from the clock)")
+	flag.BoolVar(&cfg.Micro, "micro", false, "Run the in-process benchmarks of core paths instead of the load generator")
+	flag.StringVar(&out, "out", "", "File to write the report to as JSON")
+	flag.StringVar(&baseline, "baseline", "", "Report of an earlier run to compare with; exits with status 1 on a regression")
+	flag.Float64Var(&tolerance, "tolerance", 0.10, "Slowdown against -baseline allowed before it counts as a regression, as a fraction")
+	flag.Parse()
+
+	switch {
+	case cfg.Concurrency < 1:
+		log.Fatalf("-concurrency must be at least 1")
+	case cfg.ReadRatio < 0 || cfg.ReadRatio > 1:
+		log.Fatalf("-readratio must be between 0 and 1")
+	case cfg.UpdateRatio < 0 || cfg.UpdateRatio > 1:
+		log.Fatalf("-updateratio must be between 0 and 1")
+	case cfg.DocSize < 0 || cfg.Documents < 0 || cfg.Operations < 0:
+		log.Fatalf("-docsize, -documents and -ops must not be negative")
+	case cfg.Documents == 0 && (cfg.Micro || cfg.ReadRatio > 0 || cfg.UpdateRatio > 0):
+		log.Fatalf("-documents must be at least 1 to have documents to read and update")
+	case tolerance < 0:
+		log.Fatalf("-tolerance must not be negative")
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	if cfg.Operations > 0 {
+		cfg.Duration = 0
+	}
+	result := &report{Version: reportVersion, Config: cfg, Started: time.Now().UTC()}
+	if cfg.Micro {
+		result.Config = config{Documents: cfg.Documents, DocSize: cfg.DocSize, Micro: true}
+		result.Micro = runMicro(cfg.Documents, cfg.DocSize, seed)
+	} else {
+		for _, s := range strings.Split(seeds, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				cfg.Seeds = append(cfg.Seeds, s)
+			}
+		}
+		result.Config.Seeds = cfg.Seeds
+		options := client.Options{Seeds: cfg.Seeds, Username: user, Password: password, Format: cfg.Format, AppName: "syndrbench"}
+		if err := runLoad(result, options, seed, keep); err != nil {
+			log.Fatalf("syndrbench: %v", err)
+		}
+	}
+	result.print()
+
+	if out != "" {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err == nil {
+			err = os.WriteFile(out, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			log.Fatalf("syndrbench: failed to write %s: %v", out, err)
+		}
+	}
+	if baseline != "" {
+		regressions, err := compareWithBaseline(result, baseline, tolerance)
+		if err != nil {
+			log.Fatalf("syndrbench: %v", err)
+		}
+		for _, regression := range regressions {
+			fmt.Printf("REGRESSION %s\n", regression)
+		}
+		if len(regressions) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("No regressions against %s (tolerance %.0f%%)\n", baseline, tolerance*100)
+	}
+}
+
+// runLoad sets up the bundle, runs the workers and fills in the report's operations
+func runLoad(result *report, options client.Options, seed int64, keep bool) error {
+	cfg := result.Config
+
+	// The server only accepts connection strings naming databases it had when it started, so
+	// every client connects to "default" and switches to the benchmark's database with USE
+	options.Database = "default"
+	connect := func() (*client.Client, error) {
+		c, err := client.Connect(options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect: %w", err)
+		}
+		if _, err := c.Execute(fmt.Sprintf(`USE "%s";`, cfg.Database)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to use database %s: %w", cfg.Database, err)
+		}
+		return c, nil
+	}
+
+	admin, err := client.Connect(options)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer admin.Close()
+	if _, err := admin.Execute(fmt.Sprintf(`CREATE DATABASE "%s";`, cfg.Database)); err != nil {
+		var serverErr *client.ServerError
+		if !errors.As(err, &serverErr) || serverErr.Code != protocol.ErrAlreadyExists {
+			return fmt.Errorf("failed to create database %s: %w", cfg.Database, err)
+		}
+	}
+	if _, err := admin.Execute(fmt.Sprintf(`USE "%s";`, cfg.Database)); err != nil {
+		return fmt.Errorf("failed to use database %s: %w", cfg.Database, err)
+	}
+
+	// A bundle left behind by an earlier run with -keep is replaced
+	admin.Execute(fmt.Sprintf(`DELETE BUNDLE "%s";`, benchBundle))
+	if _, err := admin.Execute(fmt.Sprintf(`CREATE BUNDLE "%s" WITH FIELDS ({"Key", "STRING", true, false, ""}, {"Counter", "INT", false, false, 0}, {"Payload", "STRING", false, false, ""});`, benchBundle)); err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	if !keep {
+		defer admin.Execute(fmt.Sprintf(`DELETE BUNDLE "%s";`, benchBundle))
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	payload := randomPayload(rng, cfg.DocSize)
+	log.Printf("syndrbench: loading %d documents of %d bytes", cfg.Documents, cfg.DocSize)
+	for i := 0; i < cfg.Documents; i++ {
+		if _, err := admin.Execute(fmt.Sprintf(`ADD DOCUMENT TO BUNDLE "%s" WITH ({"Key" = $1}, {"Counter" = $2}, {"Payload" = $3});`, benchBundle), benchKey(i), i, payload); err != nil {
+			return fmt.Errorf("failed to load document %d: %w", i, err)
+		}
+	}
+	if cfg.Index {
+		if _, err := admin.Execute(fmt.Sprintf(`CREATE H-INDEX "syndrbench_key" ON BUNDLE "%s" WITH FIELDS ({"Key", false});`, benchBundle)); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+
+	workers := make([]*worker, cfg.Concurrency)
+	for i := range workers {
+		c, err := connect()
+		if err != nil {
+			return fmt.Errorf("worker %d: %w", i, err)
+		}
+		defer c.Close()
+		workers[i] = &worker{client: c, cfg: cfg, rng: rand.New(rand.NewSource(seed + int64(i) + 1)), latencies: make(map[string][]time.Duration)}
+		workers[i].payload = randomPayload(workers[i].rng, cfg.DocSize)
+	}
+
+	log.Printf("syndrbench: running %d workers", cfg.Concurrency)
+	run := &loadRun{nextKey: int64(cfg.Documents)}
+	if cfg.Operations > 0 {
+		run.budget = int64(cfg.Operations)
+	} else {
+		run.deadline = time.Now().Add(cfg.Duration)
+	}
+	started := time.Now()
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(run)
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	result.Elapsed = elapsed.Seconds()
+	result.Operations = make(map[string]*opStats)
+	for _, kind := range []string{"read", "insert", "update"} {
+		var latencies []time.Duration
+		failed := 0
+		for _, w := range workers {
+			latencies = append(latencies, w.latencies[kind]...)
+			failed += w.errors[kind]
+		}
+		if len(latencies) == 0 && failed == 0 {
+			continue
+		}
+		result.Operations[kind] = summarize(latencies, failed, elapsed)
+	}
+	for _, w := range workers {
+		if w.firstErr != nil {
+			log.Printf("syndrbench: first error of a worker: %v", w.firstErr)
+			break
+		}
+	}
+	return nil
+}
+
+// loadRun is what the workers share while they run
+type loadRun struct {
+	deadline time.Time // Zero when the run is bounded by operations instead
+	budget   int64     // Operations still to send
+	nextKey  int64     // Key number of the next document added
+}
+
+// next reports whether a worker should send another operation
+func (r *loadRun) next() bool {
+	if r.deadline.IsZero() {
+		return atomic.AddInt64(&r.budget, -1) >= 0
+	}
+	return time.Now().Before(r.deadline)
+}
+
+// worker sends operations over a client of its own and records how long each took
+type worker struct {
+	client    *client.Client
+	cfg       config
+	rng       *rand.Rand
+	payload   string
+	latencies map[string][]time.Duration // Of successful operations, by kind
+	errors    map[string]int
+	firstErr  error
+}
+
+func (w *worker) run(r *loadRun) {
+	w.errors = make(map[string]int)
+	selectCommand := fmt.Sprintf(`SELECT DOCUMENTS FROM "%s" WHERE "Key" == $1;`, benchBundle)
+	insertCommand := fmt.Sprintf(`ADD DOCUMENT TO BUNDLE "%s" WITH ({"Key" = $1}, {"Counter" = $2}, {"Payload" = $3});`, benchBundle)
+	updateCommand := fmt.Sprintf(`UPDATE DOCUMENTS IN BUNDLE "%s" ("Counter" = $1) WHERE "Key" == $2;`, benchBundle)
+
+	for r.next() {
+		var kind string
+		var err error
+		started := time.Now()
+		switch {
+		case w.rng.Float64() < w.cfg.ReadRatio:
+			kind = "read"
+			_, err = w.client.Execute(selectCommand, benchKey(w.rng.Intn(w.cfg.Documents)))
+		case w.rng.Float64() < w.cfg.UpdateRatio:
+			kind = "update"
+			_, err = w.client.Execute(updateCommand, w.rng.Intn(1<<30), benchKey(w.rng.Intn(w.cfg.Documents)))
+		default:
+			kind = "insert"
+			key := atomic.AddInt64(&r.nextKey, 1) - 1
+			_, err = w.client.Execute(insertCommand, benchKey(int(key)), key, w.payload)
+		}
+		elapsed := time.Since(started)
+		if err != nil {
+			w.errors[kind]++
+			if w.firstErr == nil {
+				w.firstErr = err
+			}
+			continue
+		}
+		w.latencies[kind] = append(w.latencies[kind], elapsed)
+	}
+}
+
+// benchKey is the key of the i'th document; reads and updates pick among the loaded ones
+func benchKey(i int) string {
+	return fmt.Sprintf("key-%08d", i)
+}
+
+// randomPayload returns size random letters, so payloads do not compress to nothing
+func randomPayload(rng *rand.Rand, size int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = letters[rng.Intn(len(letters))]
+	}
+	return string(payload)
+}
+
+// summarize works out the throughput and latency percentiles of one kind of operation
+func summarize(latencies []time.Duration, failed int, elapsed time.Duration) *opStats {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) float64 {
+		if len(latencies) == 0 {
+			return 0
+		}
+		index := int(p*float64(len(latencies))+0.5) - 1
+		index = max(0, min(index, len(latencies)-1))
+		return milliseconds(latencies[index])
+	}
+	stats := &opStats{
+		Count:  len(latencies),
+		Errors: failed,
+		P50:    percentile(0.50),
+		P90:    percentile(0.90),
+		P99:    percentile(0.99),
+		P999:   percentile(0.999),
+	}
+	if len(latencies) > 0 {
+		stats.Max = milliseconds(latencies[len(latencies)-1])
+	}
+	if elapsed > 0 {
+		stats.Throughput = float64(len(latencies)) / elapsed.Seconds()
+	}
+	return stats
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// print writes the report as a table
+func (r *report) print() {
+	if len(r.Micro) > 0 {
+		fmt.Printf("%-32s %14s %12s %12s\n", "benchmark", "ns/op", "allocs/op", "B/op")
+		for _, m := range r.Micro {
+			fmt.Printf("%-32s %14.0f %12d %12d\n", m.Name, m.NsPerOp, m.AllocsPerOp, m.BytesPerOp)
+		}
+		return
+	}
+	fmt.Printf("%d workers for %.1fs, %.0f%% reads, %d byte documents\n", r.Config.Concurrency, r.Elapsed, r.Config.ReadRatio*100, r.Config.DocSize)
+	fmt.Printf("%-8s %10s %8s %12s %9s %9s %9s %9s %9s\n", "op", "count", "errors", "ops/s", "p50 ms", "p90 ms", "p99 ms", "p99.9 ms", "max ms")
+	for _, kind := range []string{"read", "insert", "update"} {
+		s, exists := r.Operations[kind]
+		if !exists {
+			continue
+		}
+		fmt.Printf("%-8s %10d %8d %12.1f %9.2f %9.2f %9.2f %9.2f %9.2f\n", kind, s.Count, s.Errors, s.Throughput, s.P50, s.P90, s.P99, s.P999, s.Max)
+	}
+}
+
+// compareWithBaseline returns the ways the report is slower than the one saved in path:
+// throughput lower, p99 latency or ns/op higher, by more than tolerance. Operations and
+// benchmarks missing from either report are skipped.
+func compareWithBaseline(r *report, path string, tolerance float64) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %w", err)
+	}
+	var base report
+	if err := json.Unmarshal(data, &base); err != nil {
+		return nil, fmt.Errorf("failed to parse baseline %s: %w", path, err)
+	}
+	if base.Config.Micro != r.Config.Micro {
+		return nil, fmt.Errorf("baseline %s is not a report of the same mode (-micro)", path)
+	}
+	// Runs against other hosts are compared on purpose, to compare machines
+	baseConfig, config := base.Config, r.Config
+	baseConfig.Seeds, config.Seeds = nil, nil
+	if !reflect.DeepEqual(baseConfig, config) {
+		log.Printf("syndrbench: baseline %s ran with other settings; the results may not be comparable", path)
+	}
+
+	var regressions []string
+	slower := func(what string, was, now float64, higherIsWorse bool) {
+		if was <= 0 {
+			return
+		}
+		change := (now - was) / was
+		if !higherIsWorse {
+			change = -change
+		}
+		if change > tolerance {
+			regressions = append(regressions, fmt.Sprintf("%s: %.2f, was %.2f (%+.0f%%)", what, now, was, (now-was)/was*100))
+		}
+	}
+	for kind, now := range r.Operations {
+		if was, exists := base.Operations[kind]; exists {
+			slower(kind+" ops/s", was.Throughput, now.Throughput, false)
+			slower(kind+" p99 ms", was.P99, now.P99, true)
+		}
+	}
+	for _, now := range r.Micro {
+		for _, was := range base.Micro {
+			if was.Name == now.Name {
+				slower(now.Name+" ns/op", was.NsPerOp, now.NsPerOp, true)
+			}
+		}
+	}
+	sort.Strings(regressions)
+	return regressions, nil
+}
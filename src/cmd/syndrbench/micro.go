@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	btreeindex "syndrdb/src/btree_index"
+	"syndrdb/src/buffermgr"
+	"syndrdb/src/engine"
+	hashindex "syndrdb/src/hash_index"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+	"syndrdb/src/server"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Micro-benchmarks.
+
+	-micro runs the core paths below in process with testing.Benchmark, so they need no server
+	and no _test.go files, and reports ns/op and allocations for each:
+	  - filter/full-scan: a range WHERE over a bundle without indexes
+	  - filter/hash-lookup: an equality WHERE the planner serves from a hash index
+	  - filter/btree-range: the range WHERE served from a B-tree index
+	  - hashindex/search: a key looked up in a hash index file on disk
+	  - bufferpool/hit: a page read from a buffer pool that holds the whole file
+	  - bufferpool/miss: a page read from a pool an eighth the size of the file, evicting
+	  - pagedbundle/load-overflow: a bundle read back from the paged layout, its documents
+	    three pages each and so split across overflow pages (see engine/paged_bundle.go)
+	  - btreesort/<keys>: the tuples of an index build sorted by key as builds sort them
+	    (btree_index/tuple_sort.go), for integer, surname-like and zero-padded string keys
+	  - btreesort/<keys>-sort-slice: the same tuples sorted with the sort.Slice builds used
+	    before, to compare with
+	  - bson/encode: the bundle without indexes encoded as its file is, into a new slice
+	  - bson/encode-pooled: the same encoding into a pooled scratch buffer, as bundle files
+	    are written now (helpers/buffer_pool.go)
+	  - frame/write-marshal: a response of microResponseDocuments documents marshalled and
+	    written as a protocol v2 frame, as framed responses were written before
+	  - frame/write-pooled: the same response written by the server's framed write, which
+	    encodes it into a pooled scratch buffer
+	The bundles hold -documents documents with -docsize bytes of payload each.
+*/
+
+// microBenchmark is a named core path
+type microBenchmark struct {
+	name string
+	run  func(b *testing.B)
+}
+
+// microRangeWidth is how many documents the range benchmarks select
+const microRangeWidth = 100
+
+// pagedDocuments is the most documents the pagedbundle benchmarks write
+const pagedDocuments = 256
+
+// microResponseDocuments is how many documents the frame benchmarks' response holds
+const microResponseDocuments = 100
+
+// sortTuples is how many tuples the btreesort benchmarks sort, a build just under the
+// B-tree index's in-memory sort limit
+const sortTuples = 90000
+
+// microPlanCacheSize is the plans the filter benchmarks cache, the server's default
+const microPlanCacheSize = 256
+
+// microWhereClauses is how many distinct clauses the filter benchmarks cycle through, built
+// ahead so formatting them is not measured
+const microWhereClauses = 1024
+
+// runMicro sets up the benchmarks' data in a temporary directory and runs them
+func runMicro(documents, docSize int, seed int64) []microResult {
+	dir, err := os.MkdirTemp("", "syndrbench-")
+	if err != nil {
+		log.Fatalf("syndrbench: failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	logger := zap.NewNop().Sugar()
+	rng := rand.New(rand.NewSource(seed))
+
+	plain := microBundle("plain", documents, randomPayload(rng, docSize))
+	indexed := microBundle("indexed", documents, randomPayload(rng, docSize))
+	indexed.Indexes["by_key"] = models.IndexReference{IndexName: "by_key", IndexType: "hash", Fields: []models.FieldDefinition{{Name: "Key", Type: "STRING"}}}
+	indexed.Indexes["by_counter"] = models.IndexReference{IndexName: "by_counter", IndexType: "btree", Fields: []models.FieldDefinition{{Name: "Counter", Type: "INT"}}}
+	caches := engine.NewQueryCaches(microPlanCacheSize)
+	engine.AttachQueryCaches(plain, caches)
+	engine.AttachQueryCaches(indexed, caches)
+
+	keyClauses := make([]string, microWhereClauses)
+	rangeClauses := make([]string, microWhereClauses)
+	keys := make([]string, microWhereClauses)
+	for i := range keyClauses {
+		keys[i] = benchKey(rng.Intn(documents))
+		keyClauses[i] = fmt.Sprintf(`"Key" == "%s"`, keys[i])
+		low := rng.Intn(documents)
+		rangeClauses[i] = fmt.Sprintf(`"Counter" > %d AND "Counter" < %d`, low-1, low+microRangeWidth)
+	}
+	filter := func(bundle *models.Bundle, clauses []string) func(b *testing.B) {
+		return func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := engine.FilterDocuments(bundle, clauses[i%len(clauses)], logger); err != nil {
+					microFailed(err)
+				}
+			}
+		}
+	}
+
+	hashService := hashindex.NewHashService(dir, 0, 0, logger)
+	keyField := hashindex.IndexField{FieldName: "Key"}
+	hashIndexName, err := hashService.CreateHashIndex(context.Background(), plain, keyField)
+	if err != nil {
+		log.Fatalf("syndrbench: failed to build hash index: %v", err)
+	}
+
+	benchmarks := []microBenchmark{
+		{"filter/full-scan", filter(plain, rangeClauses)},
+		{"filter/hash-lookup", filter(indexed, keyClauses)},
+		{"filter/btree-range", filter(indexed, rangeClauses)},
+		{"hashindex/search", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := hashService.SearchHashIndex(hashIndexName, keys[i%len(keys)], keyField); err != nil {
+					microFailed(err)
+				}
+			}
+		}},
+		{"bufferpool/hit", benchmarkBufferPool(filepath.Join(dir, "pool-hit"), 1024, 1024, seed, logger)},
+		{"bufferpool/miss", benchmarkBufferPool(filepath.Join(dir, "pool-miss"), 1024, 128, seed, logger)},
+		{"pagedbundle/load-overflow", benchmarkPagedBundle(filepath.Join(dir, "paged"), min(documents, pagedDocuments), rng, logger)},
+		{"pagedbundle/update-in-place", benchmarkPagedUpdate(filepath.Join(dir, "paged-update"), min(documents, pagedDocuments), rng, logger)},
+	}
+	benchmarks = append(benchmarks, encodingBenchmarks(plain)...)
+	for _, shape := range []string{"int", "surname", "padded"} {
+		tuples := sortKeyTuples(shape, sortTuples, rng)
+		benchmarks = append(benchmarks,
+			microBenchmark{"btreesort/" + shape, benchmarkTupleSort(tuples, false)},
+			microBenchmark{"btreesort/" + shape + "-sort-slice", benchmarkTupleSort(tuples, true)})
+	}
+
+	var results []microResult
+	for _, benchmark := range benchmarks {
+		log.Printf("syndrbench: running %s", benchmark.name)
+		result := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			benchmark.run(b)
+		})
+		results = append(results, microResult{
+			Name:        benchmark.name,
+			NsPerOp:     float64(result.T.Nanoseconds()) / float64(result.N),
+			AllocsPerOp: result.AllocsPerOp(),
+			BytesPerOp:  result.AllocedBytesPerOp(),
+		})
+	}
+	return results
+}
+
+// microFailed stops the run. testing.B can only fail benchmarks run by go test.
+func microFailed(err error) {
+	log.Fatalf("syndrbench: benchmark failed: %v", err)
+}
+
+// microBundle returns an in-memory bundle of documents with the load generator's fields
+func microBundle(name string, documents int, payload string) *models.Bundle {
+	bundle := &models.Bundle{
+		BundleID:  "syndrbench-" + name,
+		Name:      name,
+		Documents: make(map[string]models.Document, documents),
+		Indexes:   make(map[string]models.IndexReference),
+		Database:  &models.Database{DatabaseID: "syndrbench-" + name, Name: "syndrbench"},
+		DocumentStructure: models.DocumentStructure{FieldDefinitions: map[string]models.FieldDefinition{
+			"Key":     {Name: "Key", Type: "STRING"},
+			"Counter": {Name: "Counter", Type: "INT"},
+			"Payload": {Name: "Payload", Type: "STRING"},
+		}},
+	}
+	created := time.Unix(0, 0)
+	for i := 0; i < documents; i++ {
+		docID := fmt.Sprintf("doc-%08d", i)
+		bundle.Documents[docID] = models.Document{DocumentID: docID, CreatedAt: created, UpdatedAt: created, Fields: map[string]models.Field{
+			"Key":     {Name: "Key", Value: benchKey(i)},
+			"Counter": {Name: "Counter", Value: i},
+			"Payload": {Name: "Payload", Value: payload},
+		}}
+	}
+	return bundle
+}
+
+// encodingBenchmarks compare encoding a bundle file and writing a framed response with and
+// without the pooled scratch buffers
+func encodingBenchmarks(bundle *models.Bundle) []microBenchmark {
+	bundleMap := engine.BundleToMap(bundle)
+	response := make([]models.Document, 0, microResponseDocuments)
+	for _, document := range bundle.Documents {
+		if len(response) == microResponseDocuments {
+			break
+		}
+		response = append(response, document)
+	}
+	connection := bufio.NewWriter(io.Discard)
+
+	return []microBenchmark{
+		{"bson/encode", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := helpers.EncodeBSON(bundleMap); err != nil {
+					microFailed(err)
+				}
+			}
+		}},
+		{"bson/encode-pooled", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				buffer := helpers.GetBuffer()
+				if err := helpers.EncodeBSONTo(buffer, bundleMap); err != nil {
+					microFailed(err)
+				}
+				helpers.PutBuffer(buffer)
+			}
+		}},
+		{"frame/write-marshal", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				payload, err := json.Marshal(response)
+				if err == nil {
+					err = protocol.WriteFrame(connection, payload)
+				}
+				if err == nil {
+					err = connection.Flush()
+				}
+				if err != nil {
+					microFailed(err)
+				}
+			}
+		}},
+		{"frame/write-pooled", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := server.WriteFramedJSON(connection, protocol.FormatJSON, response); err != nil {
+					microFailed(err)
+				}
+			}
+		}},
+	}
+}
+
+// sortKeyTuples returns count index tuples in random order with keys of the given shape:
+// distinct integers, surname-like strings that repeat and share prefixes, or distinct
+// zero-padded strings
+func sortKeyTuples(shape string, count int, rng *rand.Rand) []btreeindex.IndexTuple {
+	syllables := []string{"An", "Ber", "Car", "Dal", "El", "Fitz", "Gar", "Har", "Mc", "Ro", "son", "ton", "ley", "well", "ham", "ing"}
+	tuples := make([]btreeindex.IndexTuple, count)
+	for i, n := range rng.Perm(count) {
+		var value interface{}
+		switch shape {
+		case "int":
+			value = n
+		case "surname":
+			value = syllables[rng.Intn(10)] + syllables[10+rng.Intn(6)] + syllables[10+rng.Intn(6)]
+		default:
+			value = benchKey(n)
+		}
+		key, err := btreeindex.EncodeKey(value)
+		if err != nil {
+			log.Fatalf("syndrbench: failed to encode index key: %v", err)
+		}
+		docID := fmt.Sprintf("doc-%08d", n)
+		tuples[i] = btreeindex.IndexTuple{Key: key, DocID: docID, BundleID: "syndrbench-sort", TID: uint64(n), KeyString: fmt.Sprint(value)}
+	}
+	return tuples
+}
+
+// benchmarkTupleSort sorts the tuples by key with the index build's sort, or with sort.Slice
+// over a copy made outside the timer, since sort.Slice sorts in place
+func benchmarkTupleSort(tuples []btreeindex.IndexTuple, sortSlice bool) func(b *testing.B) {
+	return func(b *testing.B) {
+		work := make([]btreeindex.IndexTuple, len(tuples))
+		for i := 0; i < b.N; i++ {
+			if !sortSlice {
+				btreeindex.SortTuples(tuples)
+				continue
+			}
+			b.StopTimer()
+			copy(work, tuples)
+			b.StartTimer()
+			sort.Slice(work, func(i, j int) bool {
+				return bytes.Compare(work[i].Key, work[j].Key) < 0
+			})
+		}
+	}
+}
+
+// benchmarkBufferPool reads random pages of a file of filePages pages through a pool of
+// poolPages buffers, releasing each
+func benchmarkBufferPool(dir string, filePages, poolPages int, seed int64, logger *zap.SugaredLogger) func(b *testing.B) {
+	return func(b *testing.B) {
+		registry, err := buffermgr.NewFileRegistry(dir, buffermgr.SyncNever, logger)
+		if err != nil {
+			microFailed(err)
+		}
+		defer registry.CloseAllFiles()
+		if err := os.WriteFile(filepath.Join(dir, "pages.dat"), make([]byte, filePages*buffermgr.DefaultPageSize), 0644); err != nil {
+			microFailed(err)
+		}
+		fileID, err := registry.RegisterFile("pages.dat")
+		if err != nil {
+			microFailed(err)
+		}
+		pool := buffermgr.NewBufferPool(poolPages, buffermgr.DefaultPageSize, registry, logger)
+		rng := rand.New(rand.NewSource(seed))
+		ctx := context.Background()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			buffer, err := pool.GetPage(ctx, fileID, uint32(rng.Intn(filePages)))
+			if err != nil {
+				microFailed(err)
+			}
+			pool.ReleaseBuffer(buffer)
+		}
+	}
+}
+
+// benchmarkPagedBundle writes a bundle of documents three pages large in the paged layout and
+// reads it back, checking the first read returns every document as written
+func benchmarkPagedBundle(dir string, documents int, rng *rand.Rand, logger *zap.SugaredLogger) func(b *testing.B) {
+	return func(b *testing.B) {
+		registry, err := buffermgr.NewFileRegistry(dir, buffermgr.SyncNever, logger)
+		if err != nil {
+			microFailed(err)
+		}
+		defer registry.CloseAllFiles()
+		pool := buffermgr.NewBufferPool(256, buffermgr.DefaultPageSize, registry, logger)
+		pageWAL, err := engine.OpenPageWAL(dir, logger)
+		if err != nil {
+			microFailed(err)
+		}
+		defer pageWAL.Close()
+		store, err := engine.NewBundleStore(dir, pool, pageWAL, engine.NewFileSyncer(models.DurabilityOff, 0, logger), false, logger)
+		if err != nil {
+			microFailed(err)
+		}
+		bundle := microBundle("paged", documents, randomPayload(rng, 3*buffermgr.DefaultPageSize))
+		if err := store.WritePagedBundle(bundle, 0); err != nil {
+			microFailed(err)
+		}
+		ctx := context.Background()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			loaded, err := store.LoadBundle(ctx, bundle.Name)
+			if err != nil {
+				microFailed(err)
+			}
+			if i > 0 {
+				continue
+			}
+			if len(loaded.Documents) != len(bundle.Documents) {
+				microFailed(fmt.Errorf("paged bundle read back %d of %d documents", len(loaded.Documents), len(bundle.Documents)))
+			}
+			for documentID, document := range bundle.Documents {
+				if loaded.Documents[documentID].Fields["Payload"].Value != document.Fields["Payload"].Value {
+					microFailed(fmt.Errorf("paged bundle read back document %s changed", documentID))
+				}
+			}
+		}
+	}
+}
+
+// benchmarkPagedUpdate updates random documents of a bundle in the paged layout in place,
+// each to a payload of a random size so tuples shrink and grow, then checks the bundle
+// reads back with every document as last written
+func benchmarkPagedUpdate(dir string, documents int, rng *rand.Rand, logger *zap.SugaredLogger) func(b *testing.B) {
+	return func(b *testing.B) {
+		registry, err := buffermgr.NewFileRegistry(dir, buffermgr.SyncNever, logger)
+		if err != nil {
+			microFailed(err)
+		}
+		defer registry.CloseAllFiles()
+		pool := buffermgr.NewBufferPool(256, buffermgr.DefaultPageSize, registry, logger)
+		pageWAL, err := engine.OpenPageWAL(dir, logger)
+		if err != nil {
+			microFailed(err)
+		}
+		defer pageWAL.Close()
+		store, err := engine.NewBundleStore(dir, pool, pageWAL, engine.NewFileSyncer(models.DurabilityOff, 0, logger), false, logger)
+		if err != nil {
+			microFailed(err)
+		}
+		bundle := microBundle("paged", documents, randomPayload(rng, 500))
+		if err := store.WritePagedBundle(bundle, 0); err != nil {
+			microFailed(err)
+		}
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			document := bundle.Documents[fmt.Sprintf("doc-%08d", rng.Intn(documents))]
+			document.Fields = maps.Clone(document.Fields)
+			document.Fields["Payload"] = models.Field{Name: "Payload", Value: randomPayload(rng, 100+rng.Intn(2000))}
+			if err := store.UpdatePagedDocument(bundle.Name, document, 0); err != nil {
+				microFailed(err)
+			}
+			bundle.Documents[document.DocumentID] = document
+		}
+
+		b.StopTimer()
+		loaded, err := store.LoadBundle(context.Background(), bundle.Name)
+		if err != nil {
+			microFailed(err)
+		}
+		for documentID, document := range bundle.Documents {
+			if loaded.Documents[documentID].Fields["Payload"].Value != document.Fields["Payload"].Value {
+				microFailed(fmt.Errorf("paged bundle read back document %s changed", documentID))
+			}
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Command syndrsoak is a soak test. Workers keep adding, updating, deleting and reading back
+// documents of one bundle at once, for as long as it runs, while the invariants the engine
+// must keep are checked; the first one broken stops it with a report of the divergence.
+//
+// Each worker owns the documents it adds and keeps a model of them, so it knows what every
+// read of its own documents must return even while the others write. Every -checkinterval
+// the workers are paused and the whole bundle is checked against the models:
+//   - counts: the bundle holds exactly the documents the workers added and did not delete
+//   - data: every document holds the values its last acknowledged write gave it
+//   - unique constraints: no two documents share a value of the unique Key field
+//   - indexes: lookups served by the hash indexes on Key and Group and the B-tree index on
+//     Counter return the same documents as a scan
+//   - aggregates: the per-group counts and sums of an aggregate over the bundle match the
+//     documents
+//
+// By default it runs the engine in process on a data directory of its own (see
+// src/embedded); with -seeds it runs against a server or cluster instead.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syndrdb/src/client"
+	"syndrdb/src/embedded"
+	"syscall"
+	"time"
+)
+
+const (
+	soakBundle    = "syndrsoak"
+	soakAggregate = "syndrsoak_groups"
+	maxCounter    = 1000000
+	seedDocuments = 20  // Documents each worker adds before the indexes are created
+	rangeChecks   = 8   // Counter ranges checked against a scan at each check
+	keyChecks     = 100 // Keys looked up at each check, besides the workers' own reads
+)
+
+// soakLog is the run's own output; the in-process engine logs elsewhere
+var soakLog = log.New(os.Stderr, "soak: ", log.LstdFlags)
+
+// session runs commands with a database selected, returning their results as JSON
+type session interface {
+	execute(command string, params ...interface{}) (json.RawMessage, error)
+	close()
+}
+
+type embeddedSession struct {
+	session *embedded.Session
+}
+
+func (s *embeddedSession) execute(command string, params ...interface{}) (json.RawMessage, error) {
+	result, err := s.session.Execute(command, params...)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result.Result)
+}
+
+func (s *embeddedSession) close() {
+	s.session.Close()
+}
+
+type clientSession struct {
+	client *client.Client
+}
+
+func (s *clientSession) execute(command string, params ...interface{}) (json.RawMessage, error) {
+	response, err := s.client.Execute(command, params...)
+	if err != nil {
+		return nil, err
+	}
+	return response.Result, nil
+}
+
+func (s *clientSession) close() {
+	s.client.Close()
+}
+
+// storedDocument is a document as SELECT DOCUMENTS returns it
+type storedDocument struct {
+	DocumentID string
+	Fields     map[string]struct{ Value interface{} }
+}
+
+// modelDocument is what a worker expects one of its documents to hold
+type modelDocument struct {
+	Group   int
+	Counter int
+}
+
+// soak is the state of a run
+type soak struct {
+	groups     int
+	perWorker  int
+	pause      sync.RWMutex // Workers hold it to write; checks take it to see the bundle at rest
+	stop       chan struct{}
+	stopOnce   sync.Once
+	operations atomic.Int64
+	divergence atomic.Pointer[string]
+	workers    []*worker
+}
+
+// diverged records the first broken invariant and stops the run
+func (s *soak) diverged(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if s.divergence.CompareAndSwap(nil, &message) {
+		soakLog.Printf("DIVERGENCE %s", message)
+	}
+	s.halt()
+}
+
+func (s *soak) halt() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func (s *soak) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func main() {
+	var seeds, user, password, database, dataDir string
+	var workers, groups, perWorker int
+	var duration, checkInterval time.Duration
+	var seed int64
+
+	flag.StringVar(&seeds, "seeds", "", "Comma separated host:port of a server or cluster to soak; empty runs the engine in process")
+	flag.StringVar(&dataDir, "datadir", "", "Data directory of the in-process engine; empty uses a temporary one, removed unless the run fails")
+	flag.StringVar(&user, "user", "root", "User to connect to -seeds as")
+	flag.StringVar(&password, "password", "", "Password of -user")
+	flag.StringVar(&database, "database", "syndrsoak", "Database to run in; created when it does not exist")
+	flag.IntVar(&workers, "workers", 8, "Workers writing at once")
+	flag.IntVar(&perWorker, "documents", 500, "Most documents each worker keeps at a time")
+	flag.IntVar(&groups, "groups", 16, "Distinct values of the Group field")
+	flag.DurationVar(&duration, "duration", 10*time.Minute, "How long to run (0 runs until interrupted)")
+	flag.DurationVar(&checkInterval, "checkinterval", 10*time.Second, "How often the workers are paused to check the whole bundle")
+	flag.Int64Var(&seed, "seed", 0, "Seed of the operations chosen (0 picks one from the clock)")
+	flag.Parse()
+
+	switch {
+	case workers < 1:
+		soakLog.Fatalf("-workers must be at least 1")
+	case perWorker < seedDocuments:
+		soakLog.Fatalf("-documents must be at least %d", seedDocuments)
+	case groups < 1:
+		soakLog.Fatalf("-groups must be at least 1")
+	case duration < 0 || checkInterval <= 0:
+		soakLog.Fatalf("-duration must not be negative and -checkinterval must be positive")
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	soakLog.Printf("seed %d", seed)
+
+	// Every session is opened the same way, whichever the engine runs in
+	var open func() (session, error)
+	var shutdown func(failed bool)
+	if seeds == "" {
+		// The engine's log goes to a file next to its data, keeping the run's own output readable
+		workDir, err := os.MkdirTemp("", "syndrsoak-")
+		if err != nil {
+			soakLog.Fatalf("failed to create working directory: %v", err)
+		}
+		temporary := dataDir == ""
+		if temporary {
+			dataDir = filepath.Join(workDir, "data")
+		}
+		engineLog, err := os.Create(filepath.Join(workDir, "engine.log"))
+		if err != nil {
+			soakLog.Fatalf("failed to create engine log: %v", err)
+		}
+		os.Stderr = engineLog
+		log.SetOutput(engineLog)
+
+		db, err := embedded.Open(dataDir)
+		if err != nil {
+			soakLog.Fatalf("failed to open %s: %v", dataDir, err)
+		}
+		open = func() (session, error) {
+			s, err := db.Session()
+			if err != nil {
+				return nil, err
+			}
+			return &embeddedSession{session: s}, nil
+		}
+		shutdown = func(failed bool) {
+			if err := db.Close(); err != nil {
+				soakLog.Printf("failed to close %s: %v", dataDir, err)
+			}
+			engineLog.Close()
+			if failed {
+				soakLog.Printf("data is in %s and the engine's log in %s", dataDir, engineLog.Name())
+				return
+			}
+			if !temporary {
+				soakLog.Printf("data is in %s", dataDir)
+			}
+			os.RemoveAll(workDir)
+		}
+	} else {
+		// The server only accepts connection strings naming databases it had when it
+		// started, so sessions connect to "default" and switch with USE
+		options := client.Options{Seeds: splitSeeds(seeds), Database: "default", Username: user, Password: password, AppName: "syndrsoak"}
+		open = func() (session, error) {
+			c, err := client.Connect(options)
+			if err != nil {
+				return nil, err
+			}
+			return &clientSession{client: c}, nil
+		}
+		shutdown = func(bool) {}
+	}
+
+	s := &soak{groups: groups, perWorker: perWorker, stop: make(chan struct{})}
+	checker, err := s.setUp(open, database, workers, seed)
+	if err != nil {
+		shutdown(true)
+		soakLog.Fatalf("setup failed: %v", err)
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupts:
+			soakLog.Printf("interrupted")
+			s.halt()
+		case <-s.stop:
+		}
+	}()
+	if duration > 0 {
+		timer := time.AfterFunc(duration, s.halt)
+		defer timer.Stop()
+	}
+
+	soakLog.Printf("%d workers running", workers)
+	started := time.Now()
+	var wg sync.WaitGroup
+	for _, w := range s.workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(s)
+		}(w)
+	}
+
+	// Checks pause the workers; a last one runs once they have stopped, unless one of them
+	// found a divergence already
+	rng := rand.New(rand.NewSource(seed))
+	ticker := time.NewTicker(checkInterval)
+	checks := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+		}
+		finished := s.stopped()
+		if finished {
+			wg.Wait()
+		}
+		if s.divergence.Load() == nil {
+			s.pause.Lock()
+			documents := s.check(checker, rng)
+			s.pause.Unlock()
+			checks++
+			if s.divergence.Load() == nil {
+				elapsed := time.Since(started)
+				operations := s.operations.Load()
+				soakLog.Printf("check %d passed after %s: %d documents, %d operations (%.0f/s)",
+					checks, elapsed.Round(time.Second), documents, operations, float64(operations)/elapsed.Seconds())
+			}
+		}
+		if finished || s.stopped() {
+			break
+		}
+	}
+	ticker.Stop()
+	wg.Wait()
+
+	failed := s.divergence.Load() != nil
+	if !failed {
+		s.tearDown(checker)
+	}
+	for _, w := range s.workers {
+		w.session.close()
+	}
+	checker.close()
+	shutdown(failed)
+	if failed {
+		os.Exit(1)
+	}
+	soakLog.Printf("passed %d checks", checks)
+}
+
+// splitSeeds splits the -seeds list
+func splitSeeds(list string) []string {
+	var seeds []string
+	for _, seed := range strings.Split(list, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"syndrdb/src/client"
+	"syndrdb/src/protocol"
+)
+
+// worker writes the documents it owns and reads them back
+type worker struct {
+	id        int
+	session   session
+	rng       *rand.Rand
+	documents map[string]modelDocument // The model: what each live document must hold
+	keys      []string                 // Keys of documents, for picking one at random
+	positions map[string]int           // Position of each key in keys
+	deleted   []string                 // Keys deleted lately, which must stay gone
+	added     int
+}
+
+// errorCode returns the code of an error from either kind of session
+func errorCode(err error) protocol.ErrorCode {
+	var serverErr *client.ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.Code
+	}
+	return protocol.CodeOf(err)
+}
+
+// setUp creates the bundle, its indexes and its aggregate, and the workers with a few
+// documents each, since a B-tree index cannot be built over an empty bundle. It returns the
+// session checks run on.
+func (s *soak) setUp(open func() (session, error), database string, workers int, seed int64) (session, error) {
+	use := func() (session, error) {
+		ses, err := open()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := ses.execute(fmt.Sprintf(`USE "%s";`, database)); err != nil {
+			ses.close()
+			return nil, fmt.Errorf("failed to use database %s: %w", database, err)
+		}
+		return ses, nil
+	}
+
+	admin, err := open()
+	if err != nil {
+		return nil, err
+	}
+	_, err = admin.execute(fmt.Sprintf(`CREATE DATABASE "%s";`, database))
+	admin.close()
+	if err != nil && errorCode(err) != protocol.ErrAlreadyExists {
+		return nil, fmt.Errorf("failed to create database %s: %w", database, err)
+	}
+
+	checker, err := use()
+	if err != nil {
+		return nil, err
+	}
+	// Bundles a failed run left behind are replaced, the aggregate first since it holds up its source
+	checker.execute(fmt.Sprintf(`DELETE BUNDLE "%s";`, soakAggregate))
+	checker.execute(fmt.Sprintf(`DELETE BUNDLE "%s";`, soakBundle))
+	if _, err := checker.execute(fmt.Sprintf(`CREATE BUNDLE "%s" WITH FIELDS ({"Key", "string", true, true, ""}, {"Group", "int", true, false, 0}, {"Counter", "int", true, false, 0});`, soakBundle)); err != nil {
+		checker.close()
+		return nil, fmt.Errorf("failed to create bundle: %w", err)
+	}
+
+	for i := 0; i < workers; i++ {
+		ses, err := use()
+		if err != nil {
+			checker.close()
+			return nil, err
+		}
+		w := &worker{
+			id:        i,
+			session:   ses,
+			rng:       rand.New(rand.NewSource(seed + int64(i) + 1)),
+			documents: make(map[string]modelDocument),
+			positions: make(map[string]int),
+		}
+		s.workers = append(s.workers, w)
+		for j := 0; j < seedDocuments; j++ {
+			w.add(s)
+		}
+	}
+	if message := s.divergence.Load(); message != nil {
+		checker.close()
+		return nil, errors.New(*message)
+	}
+
+	for _, command := range []string{
+		fmt.Sprintf(`CREATE H-INDEX "syndrsoak_key" ON BUNDLE "%s" WITH FIELDS ({"Key", true});`, soakBundle),
+		fmt.Sprintf(`CREATE H-INDEX "syndrsoak_group" ON BUNDLE "%s" WITH FIELDS ({"Group", false});`, soakBundle),
+		fmt.Sprintf(`CREATE B-INDEX "syndrsoak_counter" ON BUNDLE "%s" WITH FIELDS ({"Counter", false});`, soakBundle),
+		fmt.Sprintf(`CREATE AGGREGATE "%s" ON BUNDLE "%s" GROUP BY "Group" COMPUTE COUNT, SUM("Counter");`, soakAggregate, soakBundle),
+	} {
+		if _, err := checker.execute(command); err != nil {
+			checker.close()
+			return nil, fmt.Errorf("failed to run %s: %w", command, err)
+		}
+	}
+	return checker, nil
+}
+
+// tearDown drops what setUp created
+func (s *soak) tearDown(checker session) {
+	for _, bundle := range []string{soakAggregate, soakBundle} {
+		if _, err := checker.execute(fmt.Sprintf(`DELETE BUNDLE "%s";`, bundle)); err != nil {
+			soakLog.Printf("failed to delete bundle %s: %v", bundle, err)
+		}
+	}
+}
+
+// run sends operations until the run stops
+func (w *worker) run(s *soak) {
+	for !s.stopped() {
+		s.pause.RLock()
+		w.step(s)
+		s.pause.RUnlock()
+		s.operations.Add(1)
+	}
+}
+
+// step sends one operation, chosen at random
+func (w *worker) step(s *soak) {
+	switch roll := w.rng.Intn(100); {
+	case len(w.keys) == 0 || (roll < 30 && len(w.keys) < s.perWorker):
+		w.add(s)
+	case roll < 55:
+		w.update(s)
+	case roll < 70:
+		w.remove(s)
+	case roll < 90 || len(w.deleted) == 0:
+		w.readBack(s, w.keys[w.rng.Intn(len(w.keys))])
+	default:
+		w.readBack(s, w.deleted[w.rng.Intn(len(w.deleted))])
+	}
+}
+
+func (w *worker) add(s *soak) {
+	key := fmt.Sprintf("w%02d-%08d", w.id, w.added)
+	document := modelDocument{Group: w.rng.Intn(s.groups), Counter: w.rng.Intn(maxCounter)}
+	if _, err := w.session.execute(fmt.Sprintf(`ADD DOCUMENT TO BUNDLE "%s" WITH ({"Key" = $1}, {"Group" = $2}, {"Counter" = $3});`, soakBundle), key, document.Group, document.Counter); err != nil {
+		s.diverged("worker %d failed to add %s: %v", w.id, key, err)
+		return
+	}
+	w.added++
+	w.documents[key] = document
+	w.positions[key] = len(w.keys)
+	w.keys = append(w.keys, key)
+}
+
+func (w *worker) update(s *soak) {
+	key := w.keys[w.rng.Intn(len(w.keys))]
+	document := modelDocument{Group: w.rng.Intn(s.groups), Counter: w.rng.Intn(maxCounter)}
+	if _, err := w.session.execute(fmt.Sprintf(`UPDATE DOCUMENTS IN BUNDLE "%s" ("Group" = $1, "Counter" = $2) WHERE "Key" == $3;`, soakBundle), document.Group, document.Counter, key); err != nil {
+		s.diverged("worker %d failed to update %s: %v", w.id, key, err)
+		return
+	}
+	w.documents[key] = document
+}
+
+func (w *worker) remove(s *soak) {
+	key := w.keys[w.rng.Intn(len(w.keys))]
+	if _, err := w.session.execute(fmt.Sprintf(`DELETE DOCUMENTS FROM BUNDLE "%s" WHERE "Key" == $1;`, soakBundle), key); err != nil {
+		s.diverged("worker %d failed to delete %s: %v", w.id, key, err)
+		return
+	}
+	delete(w.documents, key)
+	last := w.keys[len(w.keys)-1]
+	w.keys[w.positions[key]] = last
+	w.positions[last] = w.positions[key]
+	w.keys = w.keys[:len(w.keys)-1]
+	delete(w.positions, key)
+
+	w.deleted = append(w.deleted, key)
+	if len(w.deleted) > 100 {
+		w.deleted = w.deleted[1:]
+	}
+}
+
+// readBack looks up one of the worker's keys, which no other worker writes, and checks it
+// against the model
+func (w *worker) readBack(s *soak, key string) {
+	documents, err := selectDocuments(w.session, `"Key" == $1`, key)
+	if err != nil {
+		s.diverged("worker %d failed to read %s: %v", w.id, key, err)
+		return
+	}
+	expected, live := w.documents[key]
+	switch {
+	case !live && len(documents) > 0:
+		s.diverged("worker %d reads %s back after deleting it: %s", w.id, key, describe(documents[0]))
+	case live && len(documents) != 1:
+		s.diverged("worker %d reads %d documents with key %s, not 1", w.id, len(documents), key)
+	case live:
+		if mismatch := expected.mismatch(documents[0]); mismatch != "" {
+			s.diverged("worker %d reads %s back with %s", w.id, key, mismatch)
+		}
+	}
+}
+
+// mismatch describes how a stored document differs from the model, or is empty when it does not
+func (m modelDocument) mismatch(document storedDocument) string {
+	group, _ := intValue(document.Fields["Group"].Value)
+	counter, _ := intValue(document.Fields["Counter"].Value)
+	if group != m.Group || counter != m.Counter {
+		return fmt.Sprintf("Group %v and Counter %v, but the last write set %d and %d",
+			document.Fields["Group"].Value, document.Fields["Counter"].Value, m.Group, m.Counter)
+	}
+	return ""
+}
+
+// check compares the whole bundle with the workers' models, while they are paused, and
+// returns how many documents it holds
+func (s *soak) check(checker session, rng *rand.Rand) int {
+	documents, err := selectDocuments(checker, "")
+	if err != nil {
+		s.diverged("failed to scan the bundle: %v", err)
+		return 0
+	}
+
+	// Unique constraints and data
+	byKey := make(map[string]storedDocument, len(documents))
+	for _, document := range documents {
+		key, _ := document.Fields["Key"].Value.(string)
+		if other, exists := byKey[key]; exists {
+			s.diverged("unique field Key holds %q in documents %s and %s", key, other.DocumentID, document.DocumentID)
+			return len(documents)
+		}
+		byKey[key] = document
+	}
+	expected := 0
+	for _, w := range s.workers {
+		expected += len(w.documents)
+		for key, model := range w.documents {
+			document, exists := byKey[key]
+			if !exists {
+				s.diverged("document %s of worker %d is missing", key, w.id)
+				return len(documents)
+			}
+			if mismatch := model.mismatch(document); mismatch != "" {
+				s.diverged("document %s of worker %d has %s", key, w.id, mismatch)
+				return len(documents)
+			}
+		}
+	}
+	for key, document := range byKey {
+		owned := false
+		for _, w := range s.workers {
+			if _, exists := w.documents[key]; exists {
+				owned = true
+			}
+		}
+		if !owned {
+			s.diverged("bundle holds %s, which no worker added or which was deleted", describe(document))
+			return len(documents)
+		}
+	}
+	// Counts
+	if len(documents) != expected {
+		s.diverged("bundle holds %d documents, but the workers keep %d", len(documents), expected)
+		return len(documents)
+	}
+
+	// Indexes: each lookup must find what the scan holds
+	scanned := func(matches func(group, counter int) bool) []string {
+		var keys []string
+		for key, document := range byKey {
+			group, _ := intValue(document.Fields["Group"].Value)
+			counter, _ := intValue(document.Fields["Counter"].Value)
+			if matches(group, counter) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	lookup := func(what, where string, params []interface{}, want []string) bool {
+		found, err := selectDocuments(checker, where, params...)
+		if err != nil {
+			s.diverged("lookup %s failed: %v", what, err)
+			return false
+		}
+		var got []string
+		for _, document := range found {
+			key, _ := document.Fields["Key"].Value.(string)
+			got = append(got, key)
+		}
+		if difference := compareKeys(got, want); difference != "" {
+			s.diverged("lookup %s differs from a scan: %s", what, difference)
+			return false
+		}
+		return true
+	}
+	for group := 0; group < s.groups; group++ {
+		want := scanned(func(g, _ int) bool { return g == group })
+		if !lookup(fmt.Sprintf(`"Group" == %d`, group), `"Group" == $1`, []interface{}{group}, want) {
+			return len(documents)
+		}
+	}
+	for i := 0; i < rangeChecks; i++ {
+		low := rng.Intn(maxCounter)
+		high := low + maxCounter/100
+		want := scanned(func(_, c int) bool { return c > low && c < high })
+		if !lookup(fmt.Sprintf(`"Counter" > %d AND "Counter" < %d`, low, high), `"Counter" > $1 AND "Counter" < $2`, []interface{}{low, high}, want) {
+			return len(documents)
+		}
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i := 0; i < keyChecks && len(keys) > 0; i++ {
+		key := keys[rng.Intn(len(keys))]
+		if !lookup(fmt.Sprintf(`"Key" == %q`, key), `"Key" == $1`, []interface{}{key}, []string{key}) {
+			return len(documents)
+		}
+	}
+
+	// Aggregates
+	type groupTotals struct{ count, sum int }
+	totals := make(map[int]groupTotals)
+	for _, document := range byKey {
+		group, _ := intValue(document.Fields["Group"].Value)
+		counter, _ := intValue(document.Fields["Counter"].Value)
+		totals[group] = groupTotals{totals[group].count + 1, totals[group].sum + counter}
+	}
+	aggregate, err := selectDocumentsFrom(checker, soakAggregate, "")
+	if err != nil {
+		s.diverged("failed to read the aggregate: %v", err)
+		return len(documents)
+	}
+	seen := make(map[int]bool)
+	for _, document := range aggregate {
+		group, _ := intValue(document.Fields["Group"].Value)
+		count, _ := intValue(document.Fields["count"].Value)
+		sum, _ := intValue(document.Fields["sum_Counter"].Value)
+		seen[group] = true
+		if want := totals[group]; count != want.count || sum != want.sum {
+			s.diverged("aggregate holds count %d and sum %d for group %d, but its documents add up to %d and %d", count, sum, group, want.count, want.sum)
+			return len(documents)
+		}
+	}
+	for group, want := range totals {
+		if !seen[group] {
+			s.diverged("aggregate has no group %d, which holds %d documents", group, want.count)
+			return len(documents)
+		}
+	}
+	return len(documents)
+}
+
+// selectDocuments runs SELECT DOCUMENTS on the bundle, with a WHERE clause unless it is empty
+func selectDocuments(ses session, where string, params ...interface{}) ([]storedDocument, error) {
+	return selectDocumentsFrom(ses, soakBundle, where, params...)
+}
+
+func selectDocumentsFrom(ses session, bundle, where string, params ...interface{}) ([]storedDocument, error) {
+	command := fmt.Sprintf(`SELECT DOCUMENTS FROM "%s"`, bundle)
+	if where != "" {
+		command += " WHERE " + where
+	}
+	result, err := ses.execute(command+";", params...)
+	if err != nil {
+		return nil, err
+	}
+	var byID map[string]storedDocument
+	if len(result) > 0 {
+		if err := json.Unmarshal(result, &byID); err != nil {
+			return nil, fmt.Errorf("unexpected result: %w", err)
+		}
+	}
+	documents := make([]storedDocument, 0, len(byID))
+	for _, document := range byID {
+		documents = append(documents, document)
+	}
+	return documents, nil
+}
+
+// compareKeys describes the keys got lacks or has beyond want, or is empty when it has the same
+func compareKeys(got, want []string) string {
+	counts := make(map[string]int)
+	for _, key := range want {
+		counts[key]++
+	}
+	for _, key := range got {
+		counts[key]--
+	}
+	var missing, extra []string
+	for key, count := range counts {
+		switch {
+		case count > 0:
+			missing = append(missing, key)
+		case count < 0:
+			extra = append(extra, key)
+		}
+	}
+	if len(missing) == 0 && len(extra) == 0 {
+		return ""
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return fmt.Sprintf("%d document(s) missing %s, %d extra %s", len(missing), firstKeys(missing), len(extra), firstKeys(extra))
+}
+
+// firstKeys lists a few keys
+func firstKeys(keys []string) string {
+	if len(keys) > 5 {
+		return "[" + strings.Join(keys[:5], " ") + " ...]"
+	}
+	return "[" + strings.Join(keys, " ") + "]"
+}
+
+// describe shows a stored document in a divergence report
+func describe(document storedDocument) string {
+	return fmt.Sprintf("%s (Key %v, Group %v, Counter %v)", document.DocumentID,
+		document.Fields["Key"].Value, document.Fields["Group"].Value, document.Fields["Counter"].Value)
+}
+
+// intValue converts a number decoded from JSON to an int
+func intValue(value interface{}) (int, bool) {
+	number, ok := value.(float64)
+	if !ok || number != float64(int(number)) {
+		return 0, false
+	}
+	return int(number), true
+}
@@ -0,0 +1,249 @@
+package directors
+
+import (
+	"fmt"
+	"strings"
+	"syndrdb/src/engine"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+)
+
+/*
+	Aggregate maintenance.
+
+	CREATE AGGREGATE makes an ordinary bundle of per-group counts and sums, fills it from the
+	source bundle and lists it in the source's bundle file (see engine/aggregates.go). Document
+	writes on the source collect how they change each group and apply the changes to the
+	aggregate bundles once the statement is done, rewriting each aggregate file once per
+	statement rather than once per document.
+
+	The source write is not undone when an aggregate cannot be written; the error says so and
+	REFRESH AGGREGATE brings the aggregate back in line. Creating an aggregate and deleting one,
+	which drops it from its source, are catalog changes (engine/catalog_wal.go); a bundle with
+	aggregates cannot be deleted before them.
+*/
+
+// aggregateChanges collects how one statement's writes change the aggregates of a bundle,
+// by aggregate bundle and then group document ID
+type aggregateChanges map[string]map[string]*engine.AggregateDelta
+
+// record notes a source document entering (sign 1) or leaving (sign -1) the aggregates
+func (c aggregateChanges) record(source *models.Bundle, doc *models.Document, sign int) {
+	for _, def := range source.Aggregates {
+		deltas, exists := c[def.Bundle]
+		if !exists {
+			deltas = make(map[string]*engine.AggregateDelta)
+			c[def.Bundle] = deltas
+		}
+		engine.AddAggregateDelta(deltas, def, doc, sign)
+	}
+}
+
+// CreateAggregate creates an aggregate bundle over a source bundle, fills it from the source's
+// documents and registers it with the source
+func (s *BundleService) CreateAggregate(databaseService *DatabaseService, db *models.Database, command engine.CreateAggregateCommand) (*models.Bundle, error) {
+	source, err := s.GetBundleByName(db, command.SourceBundle)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", command.SourceBundle)
+	}
+	if source.AggregateOf != "" {
+		return nil, fmt.Errorf("bundle '%s' is an aggregate; aggregates cannot be built on aggregates", source.Name)
+	}
+
+	groupField, exists := source.DocumentStructure.FieldDefinitions[command.GroupBy]
+	if !exists {
+		return nil, fmt.Errorf("bundle '%s' has no field '%s'", source.Name, command.GroupBy)
+	}
+	fields := []models.FieldDefinition{
+		{Name: command.GroupBy, Type: groupField.Type},
+		{Name: engine.AggregateCountField, Type: "int", IsRequired: true},
+	}
+	for _, field := range command.SumFields {
+		sumField, exists := source.DocumentStructure.FieldDefinitions[field]
+		if !exists {
+			return nil, fmt.Errorf("bundle '%s' has no field '%s'", source.Name, field)
+		}
+		if sumField.Type != "int" && sumField.Type != "float" {
+			return nil, fmt.Errorf("field '%s' of bundle '%s' is %s; only int and float fields can be summed", field, source.Name, sumField.Type)
+		}
+		fields = append(fields, models.FieldDefinition{Name: engine.AggregateSumField(field), Type: sumField.Type})
+	}
+	for _, field := range fields[1:] {
+		if field.Name == command.GroupBy {
+			return nil, fmt.Errorf("cannot group by '%s'; the aggregate has a field of that name", command.GroupBy)
+		}
+	}
+
+	if _, err := s.GetBundleByName(db, command.AggregateName); err == nil {
+		return nil, protocol.Errorf(protocol.ErrAlreadyExists, "bundle '%s' already exists", command.AggregateName)
+	}
+	if command.AggregateName, err = s.newBundleName(command.AggregateName); err != nil {
+		return nil, err
+	}
+	aggregate := s.factory.NewBundle(command.AggregateName, "")
+	aggregate.Database = db
+	aggregate.AggregateOf = source.Name
+	for _, field := range fields {
+		aggregate.DocumentStructure.FieldDefinitions[field.Name] = field
+	}
+
+	def := models.AggregateDefinition{Bundle: command.AggregateName, GroupBy: command.GroupBy, SumFields: command.SumFields}
+	engine.ComputeAggregate(aggregate, source, def)
+
+	// The aggregate, the source listing it and the database listing the aggregate are written together
+	source.Aggregates = append(source.Aggregates, def)
+	description := fmt.Sprintf("create aggregate %s over %s in %s", aggregate.Name, source.Name, db.Name)
+	if err := s.commitNewBundles(databaseService, db, description, []*models.Bundle{aggregate}, source); err != nil {
+		if catalogChangeFailed(err) {
+			source.Aggregates = source.Aggregates[:len(source.Aggregates)-1]
+		}
+		return nil, fmt.Errorf("error creating aggregate '%s': %w", aggregate.Name, err)
+	}
+
+	s.forgetBundleStats(aggregate.Name)
+	s.logger.Infof("Created aggregate '%s' over bundle '%s' with %d groups", aggregate.Name, source.Name, len(aggregate.Documents))
+	return aggregate, nil
+}
+
+// RefreshAggregate rebuilds an aggregate bundle from every document of its source
+func (s *BundleService) RefreshAggregate(db *models.Database, name string) (*models.Bundle, error) {
+	aggregate, err := s.GetBundleByName(db, name)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", name)
+	}
+	if aggregate.AggregateOf == "" {
+		return nil, fmt.Errorf("bundle '%s' is not an aggregate", name)
+	}
+	source, def, err := s.aggregateSource(db, aggregate)
+	if err != nil {
+		return nil, err
+	}
+	defer s.writeLocks.lock(source.Name, aggregate.Name)()
+
+	rebuilt := *aggregate
+	engine.ComputeAggregate(&rebuilt, source, def)
+	changed := make([]string, 0, len(aggregate.Documents)+len(rebuilt.Documents))
+	for groupID := range aggregate.Documents {
+		changed = append(changed, groupID)
+	}
+	for groupID := range rebuilt.Documents {
+		if _, exists := aggregate.Documents[groupID]; !exists {
+			changed = append(changed, groupID)
+		}
+	}
+	capture := s.captureWrite(aggregate, changed...)
+	defer s.maintainIndexes(s.captureIndexWrite(aggregate, changed...))
+	s.versions.write(map[*models.Bundle][]string{aggregate: changed}, func() {
+		aggregate.Documents = rebuilt.Documents
+	})
+	engine.InvalidateIndexLookups(aggregate)
+	if err := s.store.UpdateBundleFile(db, aggregate); err != nil {
+		return nil, fmt.Errorf("error writing aggregate '%s': %w", name, err)
+	}
+	s.publishWrite(capture, 0)
+	s.forgetBundleStats(aggregate.Name)
+	return aggregate, nil
+}
+
+// checkWritable refuses document writes to an aggregate bundle
+func checkWritable(bundle *models.Bundle) error {
+	if bundle.AggregateOf != "" {
+		return fmt.Errorf("bundle '%s' is an aggregate of '%s'; it changes with that bundle and cannot be written directly",
+			bundle.Name, bundle.AggregateOf)
+	}
+	return nil
+}
+
+// applyAggregateChanges writes the changes a statement made to the aggregates of its bundle
+func (s *BundleService) applyAggregateChanges(source *models.Bundle, changes aggregateChanges) error {
+	var failed []string
+	for _, def := range source.Aggregates {
+		deltas := changes[def.Bundle]
+		if len(deltas) == 0 {
+			continue
+		}
+		if err := s.applyAggregateDeltas(source, def, deltas); err != nil {
+			s.logger.Errorf("Error maintaining aggregate '%s' of bundle '%s': %v", def.Bundle, source.Name, err)
+			failed = append(failed, def.Bundle)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("documents of bundle '%s' were written but aggregate(s) %s could not be updated; run REFRESH AGGREGATE",
+			source.Name, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (s *BundleService) applyAggregateDeltas(source *models.Bundle, def models.AggregateDefinition, deltas map[string]*engine.AggregateDelta) error {
+	aggregate, err := s.GetBundleByName(source.Database, def.Bundle)
+	if err != nil {
+		return err
+	}
+
+	groupIDs := make([]string, 0, len(deltas))
+	for groupID := range deltas {
+		groupIDs = append(groupIDs, groupID)
+	}
+	capture := s.captureWrite(aggregate, groupIDs...)
+	defer s.maintainIndexes(s.captureIndexWrite(aggregate, groupIDs...))
+	s.versions.writeDocuments(aggregate, groupIDs...)
+
+	var sizeBefore int64
+	for groupID := range deltas {
+		if doc, exists := aggregate.Documents[groupID]; exists {
+			sizeBefore += documentSize(&doc)
+		}
+	}
+	documents := engine.ApplyAggregateDeltas(aggregate, def, deltas)
+	engine.InvalidateIndexLookups(aggregate)
+
+	var sizeAfter int64
+	for groupID := range deltas {
+		if doc, exists := aggregate.Documents[groupID]; exists {
+			sizeAfter += documentSize(&doc)
+		}
+	}
+	if err := s.store.UpdateBundleFile(source.Database, aggregate); err != nil {
+		return err
+	}
+	s.recordBundleWrite(aggregate, len(deltas), documents, sizeAfter-sizeBefore)
+	s.publishWrite(capture, 0)
+	return nil
+}
+
+// aggregateSource returns the source bundle of an aggregate and the aggregate's definition
+func (s *BundleService) aggregateSource(db *models.Database, aggregate *models.Bundle) (*models.Bundle, models.AggregateDefinition, error) {
+	source, err := s.GetBundleByName(db, aggregate.AggregateOf)
+	if err != nil {
+		return nil, models.AggregateDefinition{}, protocol.Errorf(protocol.ErrBundleNotFound, "source bundle '%s' of aggregate '%s' not found", aggregate.AggregateOf, aggregate.Name)
+	}
+	for _, def := range source.Aggregates {
+		if def.Bundle == aggregate.Name {
+			return source, def, nil
+		}
+	}
+	return nil, models.AggregateDefinition{}, fmt.Errorf("bundle '%s' does not list aggregate '%s'", source.Name, aggregate.Name)
+}
+
+// unregisterAggregate drops an aggregate bundle that is being deleted from its source's list in
+// memory, returning the source to write and its previous list; nil when no source lists it
+func (s *BundleService) unregisterAggregate(db *models.Database, aggregate *models.Bundle) (*models.Bundle, []models.AggregateDefinition) {
+	source, err := s.GetBundleByName(db, aggregate.AggregateOf)
+	if err != nil {
+		// Nothing maintains the aggregate any more
+		return nil, nil
+	}
+
+	previous := source.Aggregates
+	kept := make([]models.AggregateDefinition, 0, len(previous))
+	for _, def := range previous {
+		if def.Bundle != aggregate.Name {
+			kept = append(kept, def)
+		}
+	}
+	if len(kept) == len(previous) {
+		return nil, nil
+	}
+	source.Aggregates = kept
+	return source, previous
+}
@@ -0,0 +1,121 @@
+package directors
+
+import (
+	"math/rand"
+	"sort"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"syndrdb/src/workers"
+	"time"
+)
+
+/*
+	Automatic ANALYZE.
+
+	Writes count the documents they insert, update or delete in each bundle since it was last
+	analyzed, or since startup (ChangesSinceAnalyze in SHOW BUNDLE STATS). Every
+	AutoAnalyzeInterval, give or take a fifth at random so the scans do not line up with other
+	periodic work, a background worker analyzes each loaded bundle whose changes reached
+
+		AutoAnalyzeThreshold + AutoAnalyzeScale * its document count
+
+	over the default sample, as ANALYZE BUNDLE would, so the planner's estimates follow the
+	data without anyone running it. Bundles with the most changes for their size go first.
+
+	The worker stays out of the way of clients: it analyzes one bundle at a time on a worker of
+	the query pool, with the lowest share, stops the round as soon as SELECTs wait for a
+	worker, and skips rounds while the server refuses writes (read-only, maintenance or a hot
+	standby). Bundles marked suspect after a panic are left alone until CHECK DATABASE.
+*/
+
+// autoAnalyzeClass is the class the worker takes query workers as, see workers/pool.go
+const autoAnalyzeClass = "auto_analyze"
+
+// StartAutoAnalyze starts the background worker when AutoAnalyzeInterval is set; it skips
+// rounds while paused reports true
+func (s *BundleService) StartAutoAnalyze(paused func() bool) {
+	if s.settings.AutoAnalyzeInterval <= 0 {
+		return
+	}
+	go helpers.Supervise(s.logger, "automatic analyze", func() { s.autoAnalyzeEvery(s.settings.AutoAnalyzeInterval, paused) })
+}
+
+// autoAnalyzeEvery analyzes the bundles that changed enough every interval, with jitter, for
+// as long as the server runs
+func (s *BundleService) autoAnalyzeEvery(interval time.Duration, paused func() bool) {
+	for {
+		jitter := time.Duration(rand.Int63n(int64(interval)/5*2+1)) - interval/5
+		time.Sleep(interval + jitter)
+		if paused() {
+			continue
+		}
+		for _, bundle := range s.autoAnalyzeCandidates() {
+			if paused() || workers.Query.Stats().Waiting > 0 {
+				break
+			}
+			s.autoAnalyze(bundle)
+		}
+	}
+}
+
+// autoAnalyze analyzes one bundle on a worker of the query pool
+func (s *BundleService) autoAnalyze(bundle *models.Bundle) {
+	if s.bundles[bundle.Name] != bundle || s.checkNotSuspect(bundle.Name) != nil {
+		// Deleted or replaced since the round started, or waiting for CHECK DATABASE
+		return
+	}
+	release := workers.Query.AcquireShare(autoAnalyzeClass, 1)
+	defer release()
+
+	s.statsMu.Lock()
+	stats, _ := s.bundleStats(bundle)
+	changes := stats.ChangesSinceAnalyze
+	s.statsMu.Unlock()
+
+	if err := s.AnalyzeBundle(bundle, engine.DefaultAnalyzeSample); err != nil {
+		s.logger.Warnf("Automatic ANALYZE of bundle '%s' failed: %v", bundle.Name, err)
+		return
+	}
+	s.statsMu.Lock()
+	stats.AutoAnalyzed++
+	s.statsMu.Unlock()
+	s.logger.Infof("Analyzed bundle '%s' automatically after %d changed document(s)", bundle.Name, changes)
+}
+
+// autoAnalyzeCandidates returns the loaded bundles whose changes reached the threshold, the
+// most changed for their size first
+func (s *BundleService) autoAnalyzeCandidates() []*models.Bundle {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	type candidate struct {
+		bundle *models.Bundle
+		ratio  float64
+	}
+	var candidates []candidate
+	for _, bundle := range s.bundles {
+		stats, exists := s.stats[bundle.Name]
+		if !exists || stats.ChangesSinceAnalyze == 0 {
+			// Neither read nor written since startup, or unchanged
+			continue
+		}
+		threshold := float64(s.settings.AutoAnalyzeThreshold) + s.settings.AutoAnalyzeScale*float64(stats.DocumentCount)
+		if float64(stats.ChangesSinceAnalyze) < threshold {
+			continue
+		}
+		candidates = append(candidates, candidate{bundle: bundle, ratio: float64(stats.ChangesSinceAnalyze) / float64(max(1, stats.DocumentCount))})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].ratio != candidates[j].ratio {
+			return candidates[i].ratio > candidates[j].ratio
+		}
+		return candidates[i].bundle.Name < candidates[j].bundle.Name
+	})
+
+	bundles := make([]*models.Bundle, len(candidates))
+	for i, candidate := range candidates {
+		bundles[i] = candidate.bundle
+	}
+	return bundles
+}
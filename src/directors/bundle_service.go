@@ -1,13 +1,20 @@
 package directors
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	btreeindex "syndrdb/src/btree_index"
+	"syndrdb/src/cdc"
 	"syndrdb/src/engine"
 	hashindex "syndrdb/src/hash_index"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
 
 	//hashindex "syndrdb/src/hash_index"
+	"sync"
 	"syndrdb/src/models"
 	"syndrdb/src/settings"
 	"time"
@@ -20,8 +27,32 @@ type BundleService struct {
 	factory         engine.BundleFactory
 	documentFactory engine.DocumentFactory
 	settings        *settings.Arguments
+	paths           *helpers.PathResolver
+	identifiers     helpers.Identifiers // How bundle names are compared, see helpers/identifiers.go
 	bundles         map[string]*models.Bundle
 	logger          *zap.SugaredLogger
+
+	statsMu sync.Mutex
+	stats   map[string]*BundleStats // Bundle name -> statistics, see bundle_stats.go
+
+	commitMu   sync.Mutex       // Held while a transaction commits, see transactions.go
+	writeLocks bundleWriteLocks // Held while documents of a bundle are written, see bundle_write_locks.go
+	versions   *versionStore    // Document versions for snapshot transactions, see snapshots.go
+	locks      *lockManager     // Document locks of transactions, see locks.go
+
+	suspectMu sync.Mutex
+	suspect   map[string]SuspectBundle // Bundles a panic interrupted a write to, see suspect_bundles.go
+
+	changes  *cdc.Publisher         // Publishes document writes when CDC is on, see change_capture.go
+	webhooks *cdc.WebhookDispatcher // Delivers document writes to webhooks, see webhooks.go
+
+	indexUsageMu    sync.Mutex
+	indexUsageSaved uint64 // Version of the index usage last written, see index_usage.go
+
+	erasure *ErasureSubjects // What ERASE SUBJECT erases, see erasure.go
+
+	hashIndexes *hashindex.HashService // Hash index files, kept open and maintained on writes, see index_maintenance.go
+	queryCaches *engine.QueryCaches    // Plans and postings of the bundles held here, see engine/query_caches.go
 }
 
 func NewBundleService(store engine.BundleStore, factory engine.BundleFactory,
@@ -33,30 +64,97 @@ func NewBundleService(store engine.BundleStore, factory engine.BundleFactory,
 		factory:         factory,
 		documentFactory: docFactory,
 		settings:        settings,
+		paths:           helpers.NewPathResolver(settings.DataDir),
+		identifiers:     helpers.NewIdentifiers(settings.IdentifierCase),
 		logger:          logger,
 		bundles:         make(map[string]*models.Bundle),
+		stats:           make(map[string]*BundleStats),
+		versions:        newVersionStore(settings.VersionRetention),
+		locks:           newLockManager(),
+		suspect:         make(map[string]SuspectBundle),
+		webhooks:        cdc.NewWebhookDispatcher(logger),
+		hashIndexes:     hashindex.NewHashService(settings.DataDir, sortMemory(settings), uint32(settings.HashFillFactor), logger),
+		queryCaches:     engine.NewQueryCaches(settings.PlanCacheSize),
+	}
+	if settings.DeadlockCheckInterval > 0 {
+		go helpers.Supervise(logger, "deadlock detection", func() { service.locks.run(settings.DeadlockCheckInterval, logger) })
 	}
 
 	// Load existing databases
-	bundles, err := store.LoadAllBundleDataFiles(settings.DataDir)
+	bundles, err := store.LoadAllBundleDataFiles(context.Background(), settings.DataDir)
 	if err != nil {
 		log.Printf("Warning: Error loading databases: %v", err)
 	} else {
 		service.bundles = bundles
+		for _, bundle := range bundles {
+			service.attach(bundle)
+		}
 		log.Printf("Database service loaded %d databases", len(service.bundles))
 	}
 
+	if err := service.loadIndexUsage(); err != nil {
+		logger.Warnf("Index usage starts from nothing: %v", err)
+	}
+	if settings.IndexUsageInterval > 0 {
+		go helpers.Supervise(logger, "index usage", func() { service.saveIndexUsageEvery(settings.IndexUsageInterval) })
+	}
+
 	return service
 }
 
 func (s *BundleService) AddBundle(databaseService *DatabaseService, db *models.Database, bundleCommand engine.BundleCommand) error {
-	args := settings.GetSettings()
-	// Check if the bundle already exists
-	if _, err := s.GetBundleByName(db, bundleCommand.BundleName); err == nil {
-		return fmt.Errorf("bundle '%s' already exists", bundleCommand.BundleName)
+	// Check if the bundle already exists, under this name or one differing only in case
+	if existing, err := s.GetBundleByName(db, bundleCommand.BundleName); err == nil {
+		return protocol.Errorf(protocol.ErrAlreadyExists, "bundle '%s' already exists", existing.Name)
 	}
+	name, err := s.newBundleName(bundleCommand.BundleName)
+	if err != nil {
+		return err
+	}
+	bundleCommand.BundleName = name
+	bundle := s.newBundle(db, bundleCommand)
+
+	// The bundle file and the database file listing it are written together
+	if err := s.commitNewBundles(databaseService, db, fmt.Sprintf("create bundle %s in %s", bundle.Name, db.Name), []*models.Bundle{bundle}); err != nil {
+		return fmt.Errorf("error creating bundle file: %w", err)
+	}
+	return nil
+}
+
+// NewTempBundle makes the temporary bundle of a CREATE TEMP BUNDLE, see temp_bundles.go. It is
+// not listed in the database nor written anywhere.
+func (s *BundleService) NewTempBundle(db *models.Database, bundleCommand engine.BundleCommand) (*models.Bundle, error) {
+	name, err := s.newBundleName(bundleCommand.BundleName)
+	if err != nil {
+		return nil, err
+	}
+	bundleCommand.BundleName = name
+	bundleCommand.Partitioning = nil
+	bundle := s.newBundle(db, bundleCommand)
+	bundle.Temporary = true
+	engine.AttachQueryCaches(bundle, s.queryCaches)
+	return bundle, nil
+}
 
-	// Create a new bundle
+// attach lets lookups on a bundle held here read its index files and use the service's caches
+func (s *BundleService) attach(bundle *models.Bundle) {
+	engine.AttachIndexFiles(bundle, s.hashIndexes)
+	engine.AttachQueryCaches(bundle, s.queryCaches)
+}
+
+// Identifiers returns how the service compares database and bundle names
+func (s *BundleService) Identifiers() helpers.Identifiers {
+	return s.identifiers
+}
+
+// QueryCaches returns the plan and postings caches of the bundles held here
+func (s *BundleService) QueryCaches() *engine.QueryCaches {
+	return s.queryCaches
+}
+
+// newBundle makes the bundle a CREATE BUNDLE describes
+func (s *BundleService) newBundle(db *models.Database, bundleCommand engine.BundleCommand) *models.Bundle {
+	args := s.settings
 	bundle := s.factory.NewBundle(bundleCommand.BundleName, "")
 	bundle.Database = db
 
@@ -74,38 +172,130 @@ func (s *BundleService) AddBundle(databaseService *DatabaseService, db *models.D
 		}
 	}
 
-	// Add the bundle to the database
-	db.Bundles[bundle.Name] = *bundle
+	if bundleCommand.Limits != nil {
+		bundle.Limits = *bundleCommand.Limits
+	}
+	bundle.Limits = engine.InheritLimits(bundle.Limits, db.Defaults.Limits)
 
-	//This needs to be added to a bundle file
-	err := s.store.CreateBundleFile(db, bundle)
-	if err != nil {
-		return fmt.Errorf("error creating bundle file: %w", err)
+	if bundleCommand.Partitioning != nil {
+		bundle.Partitioning = bundleCommand.Partitioning
+		if args.Debug {
+			s.logger.Infof("Bundle '%s' is partitioned by %s on '%s' into %d partitions",
+				bundleCommand.BundleName, bundle.Partitioning.Strategy, bundle.Partitioning.Field, bundle.Partitioning.PartitionCount)
+		}
 	}
-	//logger.Infof("Decoded bundle data from file %v", bundle)
-	// and then the bundle file name needs to be added to the database file
-	db.BundleFiles = append(db.BundleFiles, fmt.Sprintf("%s.bnd", bundle.Name))
+	return bundle
+}
 
-	// Write the updated database file
-	err = databaseService.store.UpdateDatabaseDataFile(db)
-	if err != nil {
-		return fmt.Errorf("error updating database file: %w", err)
+// commitNewBundles lists new bundles in a database and writes their files together with the
+// database file and the files of any changed bundles, as one catalog change
+func (s *BundleService) commitNewBundles(databaseService *DatabaseService, db *models.Database, description string,
+	created []*models.Bundle, changed ...*models.Bundle) error {
+	if db.Bundles == nil {
+		db.Bundles = make(map[string]models.Bundle)
+	}
+	for _, bundle := range created {
+		db.Bundles[bundle.Name] = *bundle
+		db.BundleFiles = append(db.BundleFiles, helpers.BundleFileName(bundle.Name))
 	}
 
-	if err != nil {
-		return fmt.Errorf("failed to add bundle to database: %w", err)
+	tx := databaseService.BeginCatalogChange(description)
+	err := s.stageBundleFiles(tx, append(created, changed...)...)
+	if err == nil {
+		err = databaseService.stageDatabaseFile(tx, db)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if catalogChangeFailed(err) {
+		for _, bundle := range created {
+			delete(db.Bundles, bundle.Name)
+		}
+		db.BundleFiles = db.BundleFiles[:len(db.BundleFiles)-len(created)]
+		return err
 	}
 
-	s.bundles[bundleCommand.BundleName] = bundle
+	for _, bundle := range created {
+		s.attach(bundle)
+		s.bundles[bundle.Name] = bundle
+	}
+	return err
+}
+
+// stageBundleFiles adds writing the files of bundles to a catalog change
+func (s *BundleService) stageBundleFiles(tx *engine.CatalogTx, bundles ...*models.Bundle) error {
+	for _, bundle := range bundles {
+		files, err := s.store.EncodeBundleFiles(bundle)
+		if err != nil {
+			return err
+		}
+		for fileName, data := range files {
+			tx.WriteFile(fileName, data)
+		}
+	}
 	return nil
 }
 
+// catalogChangeFailed reports whether a catalog change did not happen, so the in-memory changes
+// made for it must be undone. A change that was logged but not applied yet still happens.
+func catalogChangeFailed(err error) bool {
+	return err != nil && !errors.Is(err, engine.ErrCatalogChangePending)
+}
+
+// resolveBundleName returns the name a bundle was created under, given a name that matches it
+// as -identifiercase says, or the name itself when no bundle matches
+func (s *BundleService) resolveBundleName(database *models.Database, name string) string {
+	if s.identifiers.CaseSensitive {
+		return name
+	}
+	if _, exists := s.bundles[name]; exists {
+		return name
+	}
+	for stored := range s.bundles {
+		if s.identifiers.Same(stored, name) {
+			return stored
+		}
+	}
+	if database != nil {
+		for stored := range database.Bundles {
+			if s.identifiers.Same(stored, name) {
+				return stored
+			}
+		}
+	}
+	// A bundle not loaded yet is found by its file
+	entries, err := s.paths.ReadDataDir()
+	if err != nil {
+		return name
+	}
+	for _, entry := range entries {
+		fileName := entry.Path
+		if !strings.HasSuffix(fileName, helpers.BundleFileExt) {
+			continue
+		}
+		if _, _, partition := helpers.ParsePartitionFileName(fileName); partition {
+			continue
+		}
+		if stored := helpers.BundleNameFromFile(fileName); s.identifiers.Same(stored, name) {
+			return stored
+		}
+	}
+	return name
+}
+
 func (s *BundleService) GetBundleByName(database *models.Database, name string) (*models.Bundle, error) {
-	args := settings.GetSettings()
+	return s.GetBundleByNameContext(context.Background(), database, name)
+}
+
+// GetBundleByNameContext is GetBundleByName loading a bundle that is not in memory yet with
+// ctx, which stops the load when canceled
+func (s *BundleService) GetBundleByNameContext(ctx context.Context, database *models.Database, name string) (*models.Bundle, error) {
+	args := s.settings
+	name = s.resolveBundleName(database, name)
 	fileExists := s.store.BundleFileExists(name)
 	//First, check to see if the bundle file exists in the store
 	if !fileExists {
-		return nil, fmt.Errorf("bundle file '%s' does not exist on disk", name)
+		return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle file '%s' does not exist on disk", name)
 	}
 
 	bundle, exists := s.bundles[name]
@@ -116,7 +306,7 @@ func (s *BundleService) GetBundleByName(database *models.Database, name string)
 				s.logger.Infof("Bundle '%s' not found in memory, loading from store", name)
 			}
 
-			bundle, err := s.store.LoadBundleDataFile(database, s.settings.DataDir, fmt.Sprintf("%s.bnd", name))
+			bundle, err := s.store.LoadBundleDataFile(ctx, database, helpers.BundleFileName(name))
 			if err != nil {
 				return nil, fmt.Errorf("failed to load bundle '%s': %w", name, err)
 			}
@@ -125,10 +315,11 @@ func (s *BundleService) GetBundleByName(database *models.Database, name string)
 				s.logger.Infof("Loaded bundle '%s' from store", name)
 			}
 
+			s.attach(bundle)
 			s.bundles[name] = bundle
 			return bundle, nil
 		} else {
-			return nil, fmt.Errorf("bundle file exists in memory but not on disk. '%s'.bnd not found", name)
+			return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle file exists in memory but not on disk. '%s' not found", helpers.BundleFileName(name))
 		}
 
 	}
@@ -140,28 +331,95 @@ func (s *BundleService) GetAllBundles() map[string]*models.Bundle {
 	return s.bundles
 }
 
-func (s *BundleService) RemoveBundle(db *models.Database, name string) error {
+// RemoveBundle deletes a bundle's file and drops it from its database's bundle list as one
+// catalog change. Partition and index files are left behind as orphaned files.
+func (s *BundleService) RemoveBundle(databaseService *DatabaseService, db *models.Database, name string) error {
+	name = s.resolveBundleName(db, name)
 	// Check if the bundle exists
 	bundle, exists := s.bundles[name]
 	if !exists {
-		return fmt.Errorf("bundle '%s' not found", name)
+		return protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", name)
+	}
+	if len(bundle.Aggregates) > 0 {
+		names := make([]string, 0, len(bundle.Aggregates))
+		for _, def := range bundle.Aggregates {
+			names = append(names, def.Bundle)
+		}
+		return protocol.Errorf(protocol.ErrBundleHasAggregate, "bundle '%s' has aggregate(s) %s; delete them first", name, strings.Join(names, ", "))
 	}
 
-	// Remove the bundle from the store
-	err := s.store.RemoveBundleFile(db, bundle.Name)
-	if err != nil {
-		return fmt.Errorf("failed to remove bundle from store: %w", err)
+	tx := databaseService.BeginCatalogChange(fmt.Sprintf("delete bundle %s from %s", name, db.Name))
+	tx.RemoveFile(helpers.BundleFileName(name))
+
+	// An aggregate is dropped from its source in the same change
+	var source *models.Bundle
+	var sourceAggregates []models.AggregateDefinition
+	if bundle.AggregateOf != "" {
+		source, sourceAggregates = s.unregisterAggregate(db, bundle)
+	}
+
+	bundleFiles := db.BundleFiles
+	listed, wasListed := db.Bundles[name]
+	db.BundleFiles = make([]string, 0, len(bundleFiles))
+	for _, fileName := range bundleFiles {
+		if fileName != helpers.BundleFileName(name) {
+			db.BundleFiles = append(db.BundleFiles, fileName)
+		}
+	}
+	delete(db.Bundles, name)
+
+	var err error
+	if source != nil {
+		err = s.stageBundleFiles(tx, source)
+	}
+	if err == nil {
+		err = databaseService.stageDatabaseFile(tx, db)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if catalogChangeFailed(err) {
+		db.BundleFiles = bundleFiles
+		if wasListed {
+			db.Bundles[name] = listed
+		}
+		if source != nil {
+			source.Aggregates = sourceAggregates
+		}
+		return fmt.Errorf("failed to remove bundle: %w", err)
 	}
 
 	delete(s.bundles, name)
-	return nil
+	s.forgetBundleStats(name)
+	s.forgetWebhooks(bundle)
+	engine.InvalidateIndexLookups(bundle)
+	engine.ForgetBundleIndexUsage(bundle)
+	engine.ForgetQueryShapes(bundle)
+	engine.InvalidatePlans(bundle)
+	return err
 }
 
 func (s *BundleService) UpdateBundle(db *models.Database, bundleCommand engine.BundleCommand) error {
 	// Check if the bundle exists
 	bundle, err := s.GetBundleByName(db, bundleCommand.BundleName)
 	if err != nil {
-		return fmt.Errorf("bundle '%s' not found", bundleCommand.BundleName)
+		return protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", bundleCommand.BundleName)
+	}
+
+	if len(bundleCommand.Changes) > 0 {
+		if err := checkWritable(bundle); err != nil {
+			return err
+		}
+		definitions, err := changedFieldDefinitions(bundle, bundleCommand.Changes)
+		if err != nil {
+			return err
+		}
+		bundle.DocumentStructure.FieldDefinitions = definitions
+		// Cached plans were made for the old definitions
+		engine.InvalidatePlans(bundle)
+	}
+	if bundleCommand.Limits != nil {
+		bundle.Limits = *bundleCommand.Limits
 	}
 
 	// Update the bundle in the store
@@ -173,8 +431,138 @@ func (s *BundleService) UpdateBundle(db *models.Database, bundleCommand engine.B
 	return nil
 }
 
-func (s *BundleService) AddIndexToBundle(database *models.Database, bundle *models.Bundle, indexCommand *engine.CreateIndexCommand) error {
-	args := settings.GetSettings()
+// changedFieldDefinitions returns a bundle's field definitions with UPDATE BUNDLE's field
+// changes made, in order, or the first change that cannot be. Only the definitions change:
+// the documents already stored keep their values, under the names they were written with.
+func changedFieldDefinitions(bundle *models.Bundle, changes []engine.FieldChange) (map[string]models.FieldDefinition, error) {
+	definitions := make(map[string]models.FieldDefinition, len(bundle.DocumentStructure.FieldDefinitions)+len(changes))
+	for name, definition := range bundle.DocumentStructure.FieldDefinitions {
+		definitions[name] = definition
+	}
+
+	// The fields that partition the bundle or group and sum its aggregates must stay
+	inUse := func(name string) string {
+		if bundle.Partitioning != nil && bundle.Partitioning.Field == name {
+			return "partitions the bundle"
+		}
+		for _, aggregate := range bundle.Aggregates {
+			if aggregate.GroupBy == name {
+				return fmt.Sprintf("groups aggregate '%s'", aggregate.Bundle)
+			}
+			for _, sumField := range aggregate.SumFields {
+				if sumField == name {
+					return fmt.Sprintf("is summed by aggregate '%s'", aggregate.Bundle)
+				}
+			}
+		}
+		return ""
+	}
+
+	for _, change := range changes {
+		switch change.ChangeType {
+		case "ADD":
+			if _, exists := definitions[change.NewField.Name]; exists {
+				return nil, protocol.Errorf(protocol.ErrAlreadyExists, "field '%s' already exists in bundle '%s'", change.NewField.Name, bundle.Name)
+			}
+			definitions[change.NewField.Name] = change.NewField
+		case "CHANGE", "REMOVE":
+			if _, exists := definitions[change.OldFieldName]; !exists {
+				return nil, fmt.Errorf("field '%s' is not defined in bundle '%s'", change.OldFieldName, bundle.Name)
+			}
+			if change.ChangeType == "CHANGE" && change.NewField.Name == change.OldFieldName {
+				definitions[change.OldFieldName] = change.NewField
+				continue
+			}
+			if use := inUse(change.OldFieldName); use != "" {
+				return nil, fmt.Errorf("field '%s' %s and cannot be renamed or removed", change.OldFieldName, use)
+			}
+			if change.ChangeType == "CHANGE" {
+				if _, exists := definitions[change.NewField.Name]; exists {
+					return nil, protocol.Errorf(protocol.ErrAlreadyExists, "field '%s' already exists in bundle '%s'", change.NewField.Name, bundle.Name)
+				}
+				definitions[change.NewField.Name] = change.NewField
+			}
+			delete(definitions, change.OldFieldName)
+		}
+	}
+	return definitions, nil
+}
+
+// CopyBundle makes a physical copy of a bundle, schema and documents, under a new name.
+// The copy gets its own BundleID and file; indexes are not copied and must be rebuilt.
+func (s *BundleService) CopyBundle(databaseService *DatabaseService, sourceDB *models.Database, targetDB *models.Database, copyCommand engine.BundleCopyCommand) (*models.Bundle, error) {
+	args := s.settings
+
+	source, err := s.GetBundleByName(sourceDB, copyCommand.SourceBundle)
+	if err != nil {
+		return nil, fmt.Errorf("source bundle '%s' not found: %w", copyCommand.SourceBundle, err)
+	}
+
+	if copyCommand.TargetBundle, err = s.newBundleName(copyCommand.TargetBundle); err != nil {
+		return nil, err
+	}
+
+	// Bundle files share one data directory, so the name must be free everywhere
+	if target := s.resolveBundleName(targetDB, copyCommand.TargetBundle); s.store.BundleFileExists(target) {
+		return nil, protocol.Errorf(protocol.ErrAlreadyExists, "bundle '%s' already exists", target)
+	}
+
+	clone := s.factory.NewBundle(copyCommand.TargetBundle, "")
+	clone.Database = targetDB
+	if source.Partitioning != nil {
+		partitioning := *source.Partitioning
+		partitioning.Boundaries = append([]interface{}(nil), source.Partitioning.Boundaries...)
+		clone.Partitioning = &partitioning
+	}
+
+	for name, fieldDef := range source.DocumentStructure.FieldDefinitions {
+		clone.DocumentStructure.FieldDefinitions[name] = fieldDef
+	}
+	for name, relationship := range source.Relationships {
+		clone.Relationships[name] = relationship
+	}
+	for name, constraint := range source.Constraints {
+		clone.Constraints[name] = constraint
+	}
+	for docID, doc := range source.Documents {
+		fields := make(map[string]models.Field, len(doc.Fields))
+		for fieldName, field := range doc.Fields {
+			fields[fieldName] = field
+		}
+		clone.Documents[docID] = models.Document{
+			DocumentID: doc.DocumentID,
+			Fields:     fields,
+			CreatedAt:  doc.CreatedAt,
+			UpdatedAt:  doc.UpdatedAt,
+		}
+	}
+
+	// The copy's files and the target database's file are written together
+	description := fmt.Sprintf("%s bundle %s in %s as %s in %s",
+		strings.ToLower(copyCommand.CommandType), source.Name, sourceDB.Name, clone.Name, targetDB.Name)
+	if err := s.commitNewBundles(databaseService, targetDB, description, []*models.Bundle{clone}); err != nil {
+		return nil, fmt.Errorf("error creating bundle file: %w", err)
+	}
+
+	if args.Debug {
+		s.logger.Infof("Copied bundle '%s' (%d documents) to '%s' in database '%s'",
+			source.Name, len(clone.Documents), clone.Name, targetDB.Name)
+	}
+
+	return clone, nil
+}
+
+// sortMemory is the memory an index build sorts its keys in
+func sortMemory(args *settings.Arguments) int64 {
+	if args.SortMemory > 0 {
+		return args.SortMemory
+	}
+	return settings.DefaultSortMemory
+}
+
+// AddIndexToBundle builds an index of a bundle and records it. A canceled ctx stops the build.
+func (s *BundleService) AddIndexToBundle(ctx context.Context, database *models.Database, bundle *models.Bundle, indexCommand *engine.CreateIndexCommand) error {
+	args := s.settings
 	// Check if the bundle exists
 	if bundle == nil {
 		s.logger.Errorf("Bundle is nil, cannot add index")
@@ -183,16 +571,30 @@ func (s *BundleService) AddIndexToBundle(database *models.Database, bundle *mode
 
 	bundle, err := s.GetBundleByName(database, bundle.Name)
 	if err != nil {
-		return fmt.Errorf("bundle '%s' not found", indexCommand.BundleName)
+		return protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", indexCommand.BundleName)
+	}
+	// Writes wait for the build, which reads every document and replaces the index file
+	defer s.lockBundleWrites(bundle)()
+	// An index recreated under an old name must not reuse the old postings or usage
+	engine.InvalidateIndexLookups(bundle)
+	engine.ForgetIndexUsage(bundle, indexCommand.IndexName)
+	// Plans cached before the index exists would never use it
+	defer engine.InvalidatePlans(bundle)
+
+	if bundle.Indexes == nil {
+		bundle.Indexes = make(map[string]models.IndexReference)
 	}
 
+	// Expression fields are written to the index files as computed fields of a copy of the bundle
+	source, sourceFields := engine.IndexSource(bundle, indexCommand.Fields)
+
 	// Create the index based on the command type
 
 	switch indexCommand.IndexType {
 	case "btree":
 
 		// Create index services
-		btreeService := btreeindex.NewBTreeService(args.DataDir, 100*1024*1024, s.logger)
+		btreeService := btreeindex.NewBTreeService(args.DataDir, sortMemory(args), s.logger)
 
 		// Register services for this bundle
 		engine.RegisterBTreeService(bundle.BundleID, btreeService)
@@ -202,8 +604,8 @@ func (s *BundleService) AddIndexToBundle(database *models.Database, bundle *mode
 
 		//Determine if the index has more than one field
 		if len(indexCommand.Fields) > 1 {
-			indexFields := make([]btreeindex.IndexField, 0, len(indexCommand.Fields))
-			for _, field := range indexCommand.Fields {
+			indexFields := make([]btreeindex.IndexField, 0, len(sourceFields))
+			for _, field := range sourceFields {
 				b := btreeindex.IndexField{
 					FieldName: field.Name,
 					IsUnique:  field.IsUnique,
@@ -211,7 +613,7 @@ func (s *BundleService) AddIndexToBundle(database *models.Database, bundle *mode
 				}
 				indexFields = append(indexFields, b)
 			}
-			index, err := btreeService.CreateMultiColumnIndex(bundle, indexFields, true)
+			index, err := btreeService.CreateMultiColumnIndex(ctx, source, indexFields, true)
 			if err != nil {
 				s.logger.Errorf("Failed to create multi-column index: %v", err)
 				return err
@@ -226,7 +628,7 @@ func (s *BundleService) AddIndexToBundle(database *models.Database, bundle *mode
 				IndexInstance: index,
 			}
 		} else {
-			index, err := btreeService.CreateIndex(bundle, "myField", true)
+			index, err := btreeService.CreateIndex(ctx, source, sourceFields[0].Name, sourceFields[0].IsUnique)
 			if err != nil {
 				s.logger.Errorf("Failed to create index: %v", err)
 				return err
@@ -249,17 +651,17 @@ func (s *BundleService) AddIndexToBundle(database *models.Database, bundle *mode
 			return fmt.Errorf("failed to update bundle file after creating index: %w", err)
 		}
 	case "hash":
-		hIndexService := hashindex.NewHashService(args.DataDir, 100*1024*1024, s.logger)
+		hIndexService := s.hashIndexes
 
 		engine.RegisterHashService(bundle.BundleID, hIndexService)
 
 		b := hashindex.IndexField{
-			FieldName: indexCommand.Fields[0].Name,
-			IsUnique:  indexCommand.Fields[0].IsUnique,
+			FieldName: sourceFields[0].Name,
+			IsUnique:  sourceFields[0].IsUnique,
 			Collation: "",
 		}
 
-		index, err := hIndexService.CreateHashIndex(bundle, b)
+		index, err := hIndexService.CreateHashIndex(ctx, source, b)
 		if err != nil {
 			s.logger.Errorf("Failed to create index: %v", err)
 			return err
@@ -294,43 +696,145 @@ func (s *BundleService) AddDocumentToBundle(database *models.Database, bundle *m
 		return fmt.Errorf("bundle '%s' is nil, cannot add document ", docCommand.BundleName)
 	}
 
-	bundle, err := s.GetBundleByName(database, docCommand.BundleName)
-	//exists := s.bundles[docCommand.BundleName]
-	if err != nil {
-		return fmt.Errorf("bundle '%s' not found", docCommand.BundleName)
+	if !bundle.Temporary {
+		var err error
+		bundle, err = s.GetBundleByName(database, docCommand.BundleName)
+		//exists := s.bundles[docCommand.BundleName]
+		if err != nil {
+			return protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", docCommand.BundleName)
+		}
+	}
+	if err := checkWritable(bundle); err != nil {
+		return err
 	}
+	if err := s.checkNotSuspect(bundle.Name); err != nil {
+		return err
+	}
+	defer s.lockBundleWrites(bundle)()
 
 	// Add the document to the bundle
 	newDocument := s.documentFactory.NewDocument(*docCommand)
-
-	s.bundles[docCommand.BundleName].Documents[newDocument.DocumentID] = *newDocument
-	err = s.store.AddDocumentToBundleFile(bundle, newDocument)
-	if err != nil {
-		return fmt.Errorf("failed to add document to bundle: %w", err)
+	if _, exists := bundle.Documents[newDocument.DocumentID]; exists {
+		return protocol.Errorf(protocol.ErrAlreadyExists, "document '%s' already exists in bundle '%s'", newDocument.DocumentID, bundle.Name)
+	}
+	if err := s.checkDocumentLimits(bundle, newDocument); err != nil {
+		return err
 	}
 
+	capture := s.captureWrite(bundle, newDocument.DocumentID)
+	indexCapture := s.captureIndexWrite(bundle, newDocument.DocumentID)
+	s.versions.writeDocuments(bundle, newDocument.DocumentID)
+	bundle.Documents[newDocument.DocumentID] = *newDocument
+	engine.InvalidateIndexLookups(bundle)
+	if !bundle.Temporary {
+		if err := s.store.AddDocumentToBundleFile(bundle, newDocument); err != nil {
+			s.maintainIndexes(indexCapture)
+			return fmt.Errorf("failed to add document to bundle: %w", err)
+		}
+	}
+	s.maintainIndexes(indexCapture)
+	s.recordBundleWrite(bundle, 1, 1, documentSize(newDocument))
+	s.publishWrite(capture, 0)
+
+	if len(bundle.Aggregates) > 0 {
+		changes := make(aggregateChanges)
+		changes.record(bundle, newDocument, 1)
+		return s.applyAggregateChanges(bundle, changes)
+	}
 	return nil
 }
 
-func (s *BundleService) UpdateDocumentInBundle(bundle *models.Bundle, docCommand *engine.DocumentUpdateCommand) error {
-	args := settings.GetSettings()
+// AddDocumentsToBundle adds the documents of many ADD DOCUMENT commands to a bundle at once:
+// all of them or, when one is refused, none. The bundle's files are written once, the way a
+// transaction's COMMIT writes them.
+func (s *BundleService) AddDocumentsToBundle(databaseService *DatabaseService, bundle *models.Bundle, commands []*engine.DocumentCommand) (int, error) {
+	if err := checkWritable(bundle); err != nil {
+		return 0, err
+	}
+	if err := s.checkNotSuspect(bundle.Name); err != nil {
+		return 0, err
+	}
+	if len(commands) == 0 {
+		return 0, nil
+	}
+
+	if bundle.Temporary {
+		docs := make([]*models.Document, 0, len(commands))
+		for _, command := range commands {
+			doc := s.documentFactory.NewDocument(*command)
+			if err := s.checkDocumentLimits(bundle, doc); err != nil {
+				return 0, err
+			}
+			docs = append(docs, doc)
+		}
+		for _, doc := range docs {
+			bundle.Documents[doc.DocumentID] = *doc
+		}
+		engine.InvalidateIndexLookups(bundle)
+		return len(docs), nil
+	}
+
+	tx := s.BeginTransaction(bundle.Database, engine.IsolationReadCommitted)
+	for _, command := range commands {
+		tx.statements = append(tx.statements, command)
+	}
+	return s.CommitTransaction(databaseService, tx)
+}
+
+func (s *BundleService) UpdateDocumentInBundle(bundle *models.Bundle, docCommand *engine.DocumentUpdateCommand) (err error) {
+	args := s.settings
 	// Check if the bundle exists
 	if bundle == nil {
 		s.logger.Errorf("Bundle is nil, cannot update document")
 		return fmt.Errorf("bundle '%s' is nil, cannot update document", docCommand.BundleName)
 	}
+	if err := checkWritable(bundle); err != nil {
+		return err
+	}
+	if err := s.checkNotSuspect(bundle.Name); err != nil {
+		return err
+	}
+	defer s.lockBundleWrites(bundle)()
 
 	// Get the existing document
 	filteredDocs, err := s.GetDocumentsByFilter(bundle, docCommand.WhereClause)
 	if err != nil {
 		return fmt.Errorf("failed to filter documents: %w", err)
 	}
+	for _, doc := range filteredDocs {
+		if err := s.checkDocumentLimits(bundle, withUpdates(doc, docCommand.Fields)); err != nil {
+			return err
+		}
+	}
+	capture := s.captureWrite(bundle, documentIDs(filteredDocs)...)
+	defer s.maintainIndexes(s.captureIndexWrite(bundle, documentIDs(filteredDocs)...))
+	s.versions.writeDocuments(bundle, documentIDs(filteredDocs)...)
+	// Fields are changed in place, so the postings are stale even if a write below fails
+	defer engine.InvalidateIndexLookups(bundle)
+
+	updated, sizeChange := 0, int64(0)
+	defer func() { s.recordBundleWrite(bundle, updated, 0, sizeChange) }()
+
+	// Applied for the documents written even when a later one fails
+	changes := make(aggregateChanges)
+	defer func() {
+		if aggregateErr := s.applyAggregateChanges(bundle, changes); err == nil {
+			err = aggregateErr
+		}
+	}()
+	defer s.publishWrite(capture, 0)
 
 	if args.Debug {
 		s.logger.Infof("Deleting %d documents from bundle '%s' with filter '%s'", len(filteredDocs), docCommand.BundleName, docCommand.WhereClause)
 	}
 
 	for _, doc := range filteredDocs {
+		sizeChange -= documentSize(doc)
+		before := models.Document{DocumentID: doc.DocumentID, Fields: make(map[string]models.Field, len(doc.Fields))}
+		for name, field := range doc.Fields {
+			before.Fields[name] = field
+		}
+
 		// Update the document fields
 		// loop through the fields in the command and update the document
 		for _, kv := range docCommand.Fields {
@@ -340,31 +844,45 @@ func (s *BundleService) UpdateDocumentInBundle(bundle *models.Bundle, docCommand
 			foundField.Value = kv.Value
 			doc.Fields[kv.Key] = foundField
 		}
+		sizeChange += documentSize(doc)
 
 		// Save the updated document back to the bundle
-		err = s.store.UpdateDocumentInBundleFile(bundle, doc)
-		if err != nil {
-			return fmt.Errorf("failed to update document in bundle: %w", err)
+		if !bundle.Temporary {
+			err = s.store.UpdateDocumentInBundleFile(bundle, doc)
+			if err != nil {
+				return fmt.Errorf("failed to update document in bundle: %w", err)
+			}
 		}
 
 		bundle.Documents[doc.DocumentID] = *doc
+		updated++
+		changes.record(bundle, &before, -1)
+		changes.record(bundle, doc, 1)
 	}
 
 	return nil
 }
 
-func (s *BundleService) DeleteDocumentFromBundle(bundle *models.Bundle, docCommand *engine.DocumentDeleteCommand) error {
-	args := settings.GetSettings()
+func (s *BundleService) DeleteDocumentFromBundle(bundle *models.Bundle, docCommand *engine.DocumentDeleteCommand) (err error) {
+	args := s.settings
 
 	// Check if the bundle exists
 	if bundle == nil {
 		s.logger.Errorf("Bundle is nil, cannot delete document")
 		return fmt.Errorf("bundle '%s' is nil, cannot delete document", docCommand.BundleName)
 	}
+	if err := checkWritable(bundle); err != nil {
+		return err
+	}
+	if err := s.checkNotSuspect(bundle.Name); err != nil {
+		return err
+	}
+
+	defer s.lockBundleWrites(bundle)()
 
 	// bundle, err := s.GetBundleByName(docCommand.BundleName)
 	// if err != nil {
-	// 	return fmt.Errorf("bundle '%s' not found", docCommand.BundleName)
+	// 	return protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", docCommand.BundleName)
 	// }
 
 	filteredDocs, err := s.GetDocumentsByFilter(bundle, docCommand.WhereClause)
@@ -376,14 +894,35 @@ func (s *BundleService) DeleteDocumentFromBundle(bundle *models.Bundle, docComma
 		s.logger.Infof("Deleting %d documents from bundle '%s' with filter '%s'", len(filteredDocs), docCommand.BundleName, docCommand.WhereClause)
 	}
 
+	capture := s.captureWrite(bundle, documentIDs(filteredDocs)...)
+	defer s.maintainIndexes(s.captureIndexWrite(bundle, documentIDs(filteredDocs)...))
+	s.versions.writeDocuments(bundle, documentIDs(filteredDocs)...)
+	defer engine.InvalidateIndexLookups(bundle)
+
+	removed, removedSize := 0, int64(0)
+	defer func() { s.recordBundleWrite(bundle, removed, -removed, -removedSize) }()
+
+	changes := make(aggregateChanges)
+	defer func() {
+		if aggregateErr := s.applyAggregateChanges(bundle, changes); err == nil {
+			err = aggregateErr
+		}
+	}()
+	defer s.publishWrite(capture, 0)
+
 	for _, doc := range filteredDocs {
 		// Remove the document from the bundle
-		err = s.store.DeleteDocumentFromBundleFile(bundle, doc.DocumentID)
-		if err != nil {
-			return fmt.Errorf("failed to remove document from bundle: %w", err)
+		if !bundle.Temporary {
+			err = s.store.DeleteDocumentFromBundleFile(bundle, doc.DocumentID)
+			if err != nil {
+				return fmt.Errorf("failed to remove document from bundle: %w", err)
+			}
 		}
 
-		delete(s.bundles[docCommand.BundleName].Documents, doc.DocumentID)
+		delete(bundle.Documents, doc.DocumentID)
+		removed++
+		removedSize += documentSize(doc)
+		changes.record(bundle, doc, -1)
 	}
 	return nil
 }
@@ -404,3 +943,12 @@ func (s *BundleService) GetDocumentsByFilter(bundle *models.Bundle, whereParts s
 
 	return filteredDocs, nil
 }
+
+// documentIDs returns the IDs of documents
+func documentIDs(documents []*models.Document) []string {
+	ids := make([]string, 0, len(documents))
+	for _, doc := range documents {
+		ids = append(ids, doc.DocumentID)
+	}
+	return ids
+}
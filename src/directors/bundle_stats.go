@@ -0,0 +1,212 @@
+package directors
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"syndrdb/src/engine"
+	"syndrdb/src/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+	Bundle statistics.
+
+	The document count, encoded document size and last modification of every bundle are kept
+	up to date by the document writes, so SHOW BUNDLE STATS "<name>" and SHOW METRICS answer
+	without scanning the bundle. A bundle's counters start from its documents and data files
+	the first time it is read or written after startup. Reads (SELECT DOCUMENTS) and writes
+	(ADD DOCUMENT, UPDATE DOCUMENTS and DELETE DOCUMENTS) are counted since startup, and the
+	documents the writes changed since the bundle was last analyzed, or since startup, for
+	automatic ANALYZE (see auto_analyze.go).
+
+	The per-field statistics of ANALYZE BUNDLE are gathered in engine/field_statistics.go and
+	kept in the bundle file; they are only served from here.
+*/
+
+// BundleStats are the statistics kept for one bundle
+type BundleStats struct {
+	Bundle        string
+	DocumentCount int
+	TotalBytes    int64 // Encoded size of the documents
+	LastModified  time.Time
+	Reads         uint64
+	Writes        uint64
+
+	ChangesSinceAnalyze uint64     // Documents inserted, updated or deleted since the last ANALYZE, or since startup
+	LastAnalyzed        *time.Time // nil when the bundle was never analyzed
+	AutoAnalyzed        uint64     // Times automatic ANALYZE ran on it since startup
+}
+
+// BundleStats returns the statistics of a bundle
+func (s *BundleService) BundleStats(bundle *models.Bundle) BundleStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	stats, _ := s.bundleStats(bundle)
+	return withLastAnalyzed(*stats, bundle)
+}
+
+// AllBundleStats returns the statistics of every loaded bundle, ordered by name
+func (s *BundleService) AllBundleStats() []BundleStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	all := make([]BundleStats, 0, len(s.bundles))
+	for _, bundle := range s.bundles {
+		stats, _ := s.bundleStats(bundle)
+		all = append(all, withLastAnalyzed(*stats, bundle))
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Bundle < all[j].Bundle })
+	return all
+}
+
+// RecordBundleRead counts a query against a bundle
+func (s *BundleService) RecordBundleRead(bundle *models.Bundle) {
+	if bundle.Temporary {
+		return
+	}
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	stats, _ := s.bundleStats(bundle)
+	stats.Reads++
+}
+
+// recordBundleWrite counts a write that changed the given number of documents and the bundle's
+// document count and size by the given amounts. It is called once the bundle's documents
+// have been changed.
+func (s *BundleService) recordBundleWrite(bundle *models.Bundle, changed, documents int, bytes int64) {
+	if bundle.Temporary {
+		return
+	}
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	stats, started := s.bundleStats(bundle)
+	if !started {
+		// Counters started just now already reflect the change
+		stats.DocumentCount += documents
+		stats.TotalBytes += bytes
+	}
+	stats.LastModified = time.Now()
+	stats.Writes++
+	stats.ChangesSinceAnalyze += uint64(max(0, changed))
+}
+
+// withLastAnalyzed fills in when the bundle's field statistics were gathered
+func withLastAnalyzed(stats BundleStats, bundle *models.Bundle) BundleStats {
+	for _, field := range bundle.FieldStatistics {
+		if analyzedAt := field.AnalyzedAt; stats.LastAnalyzed == nil || analyzedAt.After(*stats.LastAnalyzed) {
+			stats.LastAnalyzed = &analyzedAt
+		}
+	}
+	return stats
+}
+
+// forgetBundleStats drops the statistics of a removed bundle
+func (s *BundleService) forgetBundleStats(name string) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	delete(s.stats, name)
+}
+
+// bundleStats returns a bundle's counters, starting them from its documents the first time;
+// started reports whether that happened in this call. Called with statsMu held.
+func (s *BundleService) bundleStats(bundle *models.Bundle) (stats *BundleStats, started bool) {
+	if stats, exists := s.stats[bundle.Name]; exists {
+		return stats, false
+	}
+
+	stats = &BundleStats{
+		Bundle:        bundle.Name,
+		DocumentCount: len(bundle.Documents),
+		LastModified:  s.bundleFilesModified(bundle),
+	}
+	for _, doc := range bundle.Documents {
+		stats.TotalBytes += documentSize(&doc)
+	}
+	s.stats[bundle.Name] = stats
+	return stats, true
+}
+
+// bundleFilesModified is when any of a bundle's data files was last written
+func (s *BundleService) bundleFilesModified(bundle *models.Bundle) time.Time {
+	paths := []string{s.paths.BundleFile(bundle.Name)}
+	if bundle.Partitioning != nil {
+		for i := 0; i < bundle.Partitioning.PartitionCount; i++ {
+			paths = append(paths, s.paths.PartitionFile(bundle.Name, i))
+		}
+	}
+
+	var latest time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// documentSize is the encoded size of a document as the bundle files store it
+func documentSize(doc *models.Document) int64 {
+	encoded, err := bson.Marshal(map[string]interface{}{
+		"Fields":    doc.Fields,
+		"CreatedAt": doc.CreatedAt,
+		"UpdatedAt": doc.UpdatedAt,
+	})
+	if err != nil {
+		return 0
+	}
+	return int64(len(encoded))
+}
+
+// FieldStats are the statistics ANALYZE gathered for one field
+type FieldStats struct {
+	Field string
+	models.FieldStatistics
+}
+
+// AnalyzeBundle gathers field statistics over a sample of a bundle's documents and stores
+// them in the bundle file
+func (s *BundleService) AnalyzeBundle(bundle *models.Bundle, sampleSize int) error {
+	// Changes made while the sample is taken may not be in it, so they still count
+	s.statsMu.Lock()
+	stats, _ := s.bundleStats(bundle)
+	changes := stats.ChangesSinceAnalyze
+	s.statsMu.Unlock()
+
+	previous := bundle.FieldStatistics
+	bundle.FieldStatistics = engine.AnalyzeBundle(bundle, sampleSize)
+	if err := s.store.UpdateBundleFile(bundle.Database, bundle); err != nil {
+		bundle.FieldStatistics = previous
+		return fmt.Errorf("failed to store field statistics of bundle '%s': %w", bundle.Name, err)
+	}
+	engine.InvalidatePlans(bundle)
+
+	s.statsMu.Lock()
+	stats.ChangesSinceAnalyze -= min(changes, stats.ChangesSinceAnalyze)
+	s.statsMu.Unlock()
+	return nil
+}
+
+// FieldStatistics returns the statistics of one field of a bundle, or of every field ordered
+// by name when field is empty
+func (s *BundleService) FieldStatistics(bundle *models.Bundle, field string) ([]FieldStats, error) {
+	if bundle.FieldStatistics == nil {
+		return nil, fmt.Errorf("bundle '%s' has not been analyzed; run ANALYZE BUNDLE \"%s\"", bundle.Name, bundle.Name)
+	}
+	if field != "" {
+		stats, exists := bundle.FieldStatistics[field]
+		if !exists {
+			return nil, fmt.Errorf("no statistics for field '%s' of bundle '%s'", field, bundle.Name)
+		}
+		return []FieldStats{{Field: field, FieldStatistics: stats}}, nil
+	}
+
+	all := make([]FieldStats, 0, len(bundle.FieldStatistics))
+	for name, stats := range bundle.FieldStatistics {
+		all = append(all, FieldStats{Field: name, FieldStatistics: stats})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Field < all[j].Field })
+	return all, nil
+}
@@ -0,0 +1,128 @@
+package directors
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"syndrdb/src/engine"
+	"syndrdb/src/models"
+)
+
+/*
+	Bundle write locks.
+
+	Every write to the documents of a bundle holds the bundle's write lock: ADD DOCUMENT, UPDATE
+	DOCUMENTS and DELETE DOCUMENTS outside transactions, REFRESH AGGREGATE, and the COMMIT of a
+	transaction from before it prepares until its documents are in the bundles. A write also
+	holds the locks of the bundle's aggregates, which change with it. The locks a write needs
+	are taken together, in name order, so two writers never wait for each other in a cycle.
+	Reads and temporary bundles, which only their connection sees, take no lock.
+
+	A transaction's bundles are worked out from its statements before it prepares. Should it
+	reach one that was not among them, the commit lets go of its locks and prepares again with
+	that bundle locked as well.
+*/
+
+// bundleWriteLocks hands out a lock per bundle name; the zero value is ready to use
+type bundleWriteLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock takes the write locks of the named bundles and returns the function letting go of them
+func (l *bundleWriteLocks) lock(names ...string) func() {
+	names = slices.Clone(names)
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	held := make([]*sync.Mutex, 0, len(names))
+	for _, name := range names {
+		lock, exists := l.locks[name]
+		if !exists {
+			lock = &sync.Mutex{}
+			l.locks[name] = lock
+		}
+		held = append(held, lock)
+	}
+	l.mu.Unlock()
+
+	for _, lock := range held {
+		lock.Lock()
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+		}
+	}
+}
+
+// lockBundleWrites takes the write locks of a bundle and its aggregates
+func (s *BundleService) lockBundleWrites(bundle *models.Bundle) func() {
+	if bundle.Temporary {
+		return func() {}
+	}
+	return s.writeLocks.lock(s.withAggregates(bundle.Database, bundle.Name)...)
+}
+
+// withAggregates resolves bundle names and adds the aggregates of the bundles to them
+func (s *BundleService) withAggregates(db *models.Database, names ...string) []string {
+	resolved := make([]string, 0, len(names))
+	for _, name := range names {
+		name = s.resolveBundleName(db, name)
+		resolved = append(resolved, name)
+		if bundle, exists := s.bundles[name]; exists {
+			for _, def := range bundle.Aggregates {
+				resolved = append(resolved, s.resolveBundleName(db, def.Bundle))
+			}
+		}
+	}
+	return resolved
+}
+
+// transactionBundles returns the bundles the statements of a transaction write, with their
+// aggregates
+func (s *BundleService) transactionBundles(tx *Transaction) []string {
+	var names []string
+	for _, statement := range tx.statements {
+		switch cmd := statement.(type) {
+		case *engine.DocumentCommand:
+			names = append(names, cmd.BundleName)
+		case *engine.DocumentUpdateCommand:
+			names = append(names, cmd.BundleName)
+		case *engine.DocumentDeleteCommand:
+			names = append(names, cmd.BundleName)
+		case *engine.MergeCommand:
+			names = append(names, cmd.Target)
+		case *engine.EraseSubjectCommand:
+			if subject, err := s.erasureSubject(tx.Database, cmd.Subject); err == nil {
+				names = append(names, subject.Bundle)
+				for _, link := range subject.Related {
+					names = append(names, link.Bundle)
+				}
+			}
+		}
+	}
+	return s.withAggregates(tx.Database, names...)
+}
+
+// unlockedBundleError stops a prepare that reached a bundle the commit did not lock
+type unlockedBundleError struct {
+	name string
+}
+
+func (e *unlockedBundleError) Error() string {
+	return "bundle '" + e.name + "' is written without its write lock"
+}
+
+// unlockedBundle returns the bundle a prepare stopped at for want of its lock, or ""
+func unlockedBundle(err error) string {
+	var unlocked *unlockedBundleError
+	if errors.As(err, &unlocked) {
+		return unlocked.name
+	}
+	return ""
+}
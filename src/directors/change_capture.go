@@ -0,0 +1,107 @@
+package directors
+
+import (
+	"reflect"
+	"syndrdb/src/cdc"
+	"syndrdb/src/models"
+	"time"
+)
+
+/*
+	Change data capture.
+
+	With a CDC publisher set (see cdc/publisher.go), every document write takes a copy of the
+	documents it is about to change, and once it is done publishes one change per document:
+	an insert for a document that did not exist, a delete for one that no longer does and an
+	update for one whose fields differ. A write that fails part way publishes what it did
+	write. Transactions publish when they commit, and the aggregate groups a write moves are
+	published after its documents. The same changes fire the bundle's webhooks (see
+	webhooks.go), with or without a publisher.
+*/
+
+// SetChangePublisher publishes every document write from now on; nil turns publishing off
+func (s *BundleService) SetChangePublisher(publisher *cdc.Publisher) {
+	s.changes = publisher
+}
+
+// capturedWrite holds the documents a write is about to change, as they are before it
+type capturedWrite struct {
+	bundle *models.Bundle
+	docIDs []string
+	before map[string]*models.Document
+}
+
+// captureWrite copies documents of a bundle before a write changes them; nil when changes are
+// neither published nor watched by a webhook, and for temporary bundles
+func (s *BundleService) captureWrite(bundle *models.Bundle, docIDs ...string) *capturedWrite {
+	if bundle.Temporary || s.changes == nil && len(bundle.Webhooks) == 0 {
+		return nil
+	}
+	capture := &capturedWrite{
+		bundle: bundle,
+		docIDs: append([]string(nil), docIDs...),
+		before: make(map[string]*models.Document, len(docIDs)),
+	}
+	for _, docID := range docIDs {
+		if doc, exists := bundle.Documents[docID]; exists {
+			capture.before[docID] = copyDocument(doc)
+		}
+	}
+	return capture
+}
+
+// publishWrite publishes what a write did to the documents it captured, and fires the webhooks
+// it matches; transaction is 0 outside transactions
+func (s *BundleService) publishWrite(capture *capturedWrite, transaction uint64) {
+	if capture == nil {
+		return
+	}
+	database := ""
+	if capture.bundle.Database != nil {
+		database = capture.bundle.Database.Name
+	}
+
+	for _, docID := range capture.docIDs {
+		change := cdc.Change{
+			Database:    database,
+			Bundle:      capture.bundle.Name,
+			DocumentID:  docID,
+			Transaction: transaction,
+		}
+		before, after := capture.before[docID], (*models.Document)(nil)
+		if before != nil {
+			change.Before = fieldValues(before)
+		}
+		if doc, exists := capture.bundle.Documents[docID]; exists {
+			after = &doc
+			change.After = fieldValues(after)
+		}
+
+		switch {
+		case change.Before == nil && change.After == nil:
+			continue
+		case change.Before == nil:
+			change.Operation = cdc.OpInsert
+		case change.After == nil:
+			change.Operation = cdc.OpDelete
+		case reflect.DeepEqual(change.Before, change.After):
+			continue
+		default:
+			change.Operation = cdc.OpUpdate
+		}
+		change.Time = time.Now()
+		if s.changes != nil {
+			s.changes.Publish(change)
+		}
+		s.notifyWebhooks(capture.bundle, change, before, after)
+	}
+}
+
+// fieldValues returns a document's values by field name
+func fieldValues(doc *models.Document) map[string]interface{} {
+	values := make(map[string]interface{}, len(doc.Fields))
+	for name, field := range doc.Fields {
+		values[name] = field.Value
+	}
+	return values
+}
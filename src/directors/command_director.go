@@ -3,338 +3,702 @@ package directors
 import (
 	"fmt"
 	"strings"
+	"syndrdb/src/cluster"
 	"syndrdb/src/engine"
 	"syndrdb/src/models"
+	"syndrdb/src/protocol"
 
 	"go.uber.org/zap"
 )
 
 func CommandDirector(database *models.Database, serviceManager ServiceManager, command string, logger *zap.SugaredLogger) (interface{}, error) {
 	command = strings.TrimSpace(command)
-	command = strings.TrimSuffix(command, ";") // Remove trailing semicolon if present
-	commandParts := strings.Split(command, " ")
-	result := ""
 
-	if strings.HasPrefix(strings.ToLower(command), "select") {
-		// Parse SELECT command
-		//dbCommand, err := engine.ParseSelectCommand(command)
-		switch strings.ToLower(commandParts[1]) {
-		case "databases":
-			if len(commandParts) < 3 {
-				return nil, fmt.Errorf("SELECT DATABASES requires the spec 'FROM Default'")
-			}
-			if strings.EqualFold(commandParts[3], "DEFAULT") {
-				databases := serviceManager.DatabaseService.ListDatabases()
-
-				if len(databases) == 0 {
-					//fmt.Print("No databases found.\n")
-					databases = make([]*models.Database, 0)
-				}
-
-				cmdResponse := &engine.CommandResponse{
-					ResultCount: len(databases),
-					Result:      databases,
-				}
-				return &cmdResponse, nil
-			}
+	// A SELECT another cluster node already routed here, restricted to the partitions this node owns
+	if strings.HasPrefix(strings.ToUpper(command), cluster.RoutedCommandPrefix) {
+		partitions, selectCommand, err := cluster.ParseRoutedCommand(command)
+		if err != nil {
+			return nil, err
+		}
+		statement, err := engine.ParseStatement(selectCommand)
+		if err != nil {
+			return nil, err
+		}
+		selectStatement, ok := statement.(*engine.SelectDocumentsCommand)
+		if !ok {
+			return nil, fmt.Errorf("only SELECT DOCUMENTS can be routed between nodes")
+		}
+		return selectDocuments(database, serviceManager, selectStatement, partitions, logger)
+	}
 
-		case "documents":
+	statement, err := serviceManager.parse(command)
+	if err != nil {
+		return nil, protocol.WithCode(protocol.ErrParse, err)
+	}
+	return executeStatement(database, serviceManager, statement, logger)
+}
 
-			if len(commandParts) < 4 || !strings.EqualFold(commandParts[2], "FROM") {
-				return nil, fmt.Errorf("SELECT DOCUMENTS requires the spec 'FROM <Bundle_name>'")
-			}
+// executeStatement runs a parsed SyndrQL statement against the current database
+func executeStatement(database *models.Database, serviceManager ServiceManager, statement engine.Statement, logger *zap.SugaredLogger) (interface{}, error) {
+	result := ""
+	if err := checkTempBundleStatement(database, serviceManager, statement); err != nil {
+		return nil, err
+	}
 
-			bundleName := strings.Trim(commandParts[3], "\"'")
+	switch cmd := statement.(type) {
+	case *engine.SelectDatabasesCommand:
+		databases := serviceManager.DatabaseService.ListDatabases()
+		if len(databases) == 0 {
+			databases = make([]*models.Database, 0)
+		}
+		cmdResponse := &engine.CommandResponse{
+			ResultCount: len(databases),
+			Result:      databases,
+		}
+		return &cmdResponse, nil
 
-			bundleName = strings.ReplaceAll(bundleName, "\"", "")
-			bundleName = strings.ReplaceAll(bundleName, "'", "")
-			bundleName = strings.ReplaceAll(bundleName, "”", "") // A very odd type of quote that can appear in text
+	case *engine.SelectDocumentsCommand:
+		return selectDocuments(database, serviceManager, cmd, nil, logger)
 
-			// Get the bundle by name
-			bundle, err := serviceManager.BundleService.GetBundleByName(database, bundleName)
-			if err != nil {
-				return nil, fmt.Errorf("error retrieving bundle '%s': %v", bundleName, err)
-			}
+	case *engine.SelectDistinctCommand:
+		return selectDistinct(database, serviceManager, cmd, logger)
 
-			var documents map[string]*models.Document
-			if len(commandParts) > 4 && strings.EqualFold(commandParts[4], "WHERE") {
-				//logger.Infof("Filtering documents in bundle '%s' with WHERE clause: %s", bundleName, strings.Join(commandParts[5:], " "))
-				whereClause := strings.Join(commandParts[5:], " ")
-				filteredDocs, err := engine.FilterDocuments(bundle, whereClause, logger)
-				if err != nil {
-					return nil, fmt.Errorf("error filtering documents: %v", err)
-				}
-
-				// if len(filteredDocs) > 0 {
-				// 	prettyJSON, err := json.MarshalIndent(filteredDocs, "", "  ")
-				// 	if err != nil {
-				// 		logger.Warnf("Failed to convert documents to JSON: %v", err)
-				// 	} else {
-				// 		logger.Infof("Found %d documents: \n%s", len(filteredDocs), string(prettyJSON))
-				// 	}
-				// } else {
-				// 	logger.Infof("No documents found matching the filter")
-				// }
-
-				documents = make(map[string]*models.Document)
-				for _, v := range filteredDocs {
-					docCopy := v
-					documents[docCopy.DocumentID] = v
-				}
-			} else {
-				// Get documents from the bundle
-				documents = make(map[string]*models.Document)
-				for k, v := range bundle.Documents {
-					docCopy := v
-					documents[k] = &docCopy
-				}
-			}
+	case *engine.SelectApproximateCommand:
+		return selectApproximate(database, serviceManager, cmd, logger)
 
-			// if len(documents) == 0 {
-			// 	result = fmt.Sprintf("No documents found in bundle '%s'.", bundleName)
-			// } else {
-			// 	result = fmt.Sprintf("Found %d documents in bundle '%s'.", len(documents), bundleName)
-			// }
-			// logger.Infof(result)
+	case *engine.ExplainCommand:
+		return explainSelect(database, serviceManager, cmd.Select)
 
-			cmdResponse := &engine.CommandResponse{
-				ResultCount: len(documents),
-				Result:      documents,
-			}
-			return cmdResponse, nil
+	case *engine.UseDatabaseCommand:
+		// The selected database belongs to the client's connection
+		return nil, fmt.Errorf("USE can only be sent by a client connection")
+
+	case *engine.CheckDatabaseCommand:
+		db, err := serviceManager.DatabaseService.GetDatabaseByName(cmd.DatabaseName)
+		if err != nil {
+			return nil, err
 		}
-		return nil, nil
-	}
+		report := serviceManager.BundleService.CheckDatabase(serviceManager.Context(), serviceManager.DatabaseService, db, cmd.Repair)
+		logger.Infof("CHECK DATABASE %s", report.Summary())
+		return &engine.CommandResponse{
+			ResultCount: len(report.Problems),
+			Result:      report,
+		}, nil
+
+	case *engine.ShowOrphanedFilesCommand:
+		orphans, err := serviceManager.BundleService.FindOrphanedFiles(serviceManager.DatabaseService)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.CommandResponse{
+			ResultCount: len(orphans),
+			Result:      orphans,
+		}, nil
+
+	case *engine.ShowDocumentHistoryCommand:
+		bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), database, cmd.BundleName)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving bundle '%s': %w", cmd.BundleName, err)
+		}
+		versions, err := serviceManager.BundleService.DocumentHistory(bundle, cmd.DocumentID)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.CommandResponse{
+			ResultCount: len(versions),
+			Result:      versions,
+		}, nil
+
+	case *engine.ShowNamespacesCommand:
+		if database == nil {
+			return nil, fmt.Errorf("SHOW NAMESPACES requires a database to be selected")
+		}
+		namespaces := serviceManager.BundleService.Namespaces(database)
+		return &engine.CommandResponse{
+			ResultCount: len(namespaces),
+			Result:      namespaces,
+		}, nil
+
+	case *engine.ShowBundleStatsCommand:
+		bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), database, cmd.BundleName)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving bundle '%s': %w", cmd.BundleName, err)
+		}
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      serviceManager.BundleService.BundleStats(bundle),
+		}, nil
+
+	case *engine.AnalyzeBundleCommand:
+		bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), database, cmd.BundleName)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving bundle '%s': %w", cmd.BundleName, err)
+		}
+		if err := serviceManager.BundleService.AnalyzeBundle(bundle, cmd.SampleSize); err != nil {
+			return nil, err
+		}
+		sampled := len(bundle.Documents)
+		if sampled > cmd.SampleSize {
+			sampled = cmd.SampleSize
+		}
+		result = fmt.Sprintf("Analyzed %d field(s) of bundle '%s' over %d of %d document(s).",
+			len(bundle.FieldStatistics), bundle.Name, sampled, len(bundle.Documents))
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      result,
+		}, nil
+
+	case *engine.AdviseIndexesCommand:
+		bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), database, cmd.BundleName)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving bundle '%s': %w", cmd.BundleName, err)
+		}
+		advice := engine.AdviseIndexes(bundle)
+		return &engine.CommandResponse{
+			ResultCount: len(advice),
+			Result:      advice,
+		}, nil
+
+	case *engine.CreateAggregateCommand:
+		database, err := serviceManager.DatabaseService.GetDatabaseByName(database.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving database '%s': %w", database.Name, err)
+		}
+		aggregate, err := serviceManager.BundleService.CreateAggregate(serviceManager.DatabaseService, database, *cmd)
+		if err != nil {
+			return nil, fmt.Errorf("error creating aggregate: %w", err)
+		}
+		result = fmt.Sprintf("Aggregate '%s' created over bundle '%s' with %d group(s).", aggregate.Name, cmd.SourceBundle, len(aggregate.Documents))
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      result,
+		}, nil
+
+	case *engine.RefreshAggregateCommand:
+		aggregate, err := serviceManager.BundleService.RefreshAggregate(database, cmd.AggregateName)
+		if err != nil {
+			return nil, err
+		}
+		result = fmt.Sprintf("Aggregate '%s' refreshed from bundle '%s' with %d group(s).", aggregate.Name, aggregate.AggregateOf, len(aggregate.Documents))
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      result,
+		}, nil
+
+	case *engine.ShowIndexStatsCommand:
+		if database == nil {
+			return nil, fmt.Errorf("SHOW INDEX STATS requires a database to be selected")
+		}
+		indexes, err := serviceManager.BundleService.IndexStats(database, cmd.BundleName)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.CommandResponse{
+			ResultCount: len(indexes),
+			Result:      indexes,
+		}, nil
 
-	if strings.HasPrefix(strings.ToLower(command), "create") {
+	case *engine.ExportSchemaCommand:
+		return exportSchema(database, serviceManager, cmd)
 
-		switch strings.ToLower(commandParts[1]) {
-		case "database":
-			dbCommand, err := engine.ParseCreateDatabaseCommand(command, logger)
-			if err != nil {
-				return nil, err
-			}
+	case *engine.ApplySchemaCommand:
+		return applySchema(database, serviceManager, cmd, logger)
 
+	case *engine.CreateWebhookCommand:
+		if _, err := serviceManager.BundleService.CreateWebhook(database, *cmd); err != nil {
+			return nil, fmt.Errorf("error creating webhook: %w", err)
+		}
+		result = fmt.Sprintf("Webhook '%s' created on bundle '%s'.", cmd.WebhookName, cmd.BundleName)
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      result,
+		}, nil
+
+	case *engine.DeleteWebhookCommand:
+		if err := serviceManager.BundleService.DeleteWebhook(database, cmd.BundleName, cmd.WebhookName); err != nil {
+			return nil, fmt.Errorf("error deleting webhook: %w", err)
+		}
+		result = fmt.Sprintf("Webhook '%s' deleted from bundle '%s'.", cmd.WebhookName, cmd.BundleName)
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      result,
+		}, nil
+
+	case *engine.ShowWebhooksCommand:
+		if database == nil && cmd.BundleName == "" {
+			return nil, fmt.Errorf("SHOW WEBHOOKS without a bundle requires a database to be selected")
+		}
+		webhooks, err := serviceManager.BundleService.Webhooks(database, cmd.BundleName)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.CommandResponse{
+			ResultCount: len(webhooks),
+			Result:      webhooks,
+		}, nil
+
+	case *engine.ShowIndexUsageCommand:
+		if database == nil {
+			return nil, fmt.Errorf("SHOW INDEX USAGE requires a database to be selected")
+		}
+		indexes, err := serviceManager.BundleService.IndexUsage(database, cmd.BundleName)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.CommandResponse{
+			ResultCount: len(indexes),
+			Result:      indexes,
+		}, nil
+
+	case *engine.ShowFieldStatsCommand:
+		bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), database, cmd.BundleName)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving bundle '%s': %w", cmd.BundleName, err)
+		}
+		stats, err := serviceManager.BundleService.FieldStatistics(bundle, cmd.FieldName)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.CommandResponse{
+			ResultCount: len(stats),
+			Result:      stats,
+		}, nil
+
+	case *engine.DeleteOrphanedFilesCommand:
+		deleted, err := serviceManager.BundleService.DeleteOrphanedFiles(serviceManager.DatabaseService, cmd.FileNames)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.CommandResponse{
+			ResultCount: len(deleted),
+			Result:      fmt.Sprintf("Deleted %d orphaned file(s).", len(deleted)),
+		}, nil
+
+	case *engine.AdoptOrphanedFileCommand:
+		db, err := serviceManager.DatabaseService.GetDatabaseByName(cmd.DatabaseName)
+		if err != nil {
+			return nil, err
+		}
+		bundle, err := serviceManager.BundleService.AdoptOrphanedFile(serviceManager.DatabaseService, db, cmd.FileName)
+		if err != nil {
+			return nil, err
+		}
+		result = fmt.Sprintf("Bundle '%s' adopted into database '%s' with %d documents.", bundle.Name, db.Name, len(bundle.Documents))
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      result,
+		}, nil
+
+	case *engine.DatabaseCommand:
+		switch cmd.CommandType {
+		case "CREATE":
 			// Check if the database already exists
-			existingDB, err := serviceManager.DatabaseService.GetDatabaseByName(dbCommand.DatabaseName)
+			existingDB, err := serviceManager.DatabaseService.GetDatabaseByName(cmd.DatabaseName)
 			if err == nil {
-				return nil, fmt.Errorf("database '%s' already exists", existingDB.Name)
+				return nil, protocol.Errorf(protocol.ErrAlreadyExists, "database '%s' already exists", existingDB.Name)
 			}
 
 			//Validate the database name with a regex
-			if !engine.IsValidDatabaseName(dbCommand.DatabaseName) {
-				return nil, fmt.Errorf("invalid database name: %s. Database names must start with a letter, can be alphanumeric, with underscores and hyphens", dbCommand.DatabaseName)
+			if !engine.IsValidDatabaseName(cmd.DatabaseName) {
+				return nil, fmt.Errorf("invalid database name: %s. Database names must start with a letter, can be alphanumeric, with underscores and hyphens", cmd.DatabaseName)
 			}
 			// Execute the database command
-			err = serviceManager.DatabaseService.AddDatabase(*dbCommand)
-			if err != nil {
-				return nil, fmt.Errorf("error creating database: %v", err)
+			if err := serviceManager.DatabaseService.AddDatabase(*cmd); err != nil {
+				return nil, fmt.Errorf("error creating database: %w", err)
 			}
-			result = fmt.Sprintf("Database '%s' created successfully.", dbCommand.DatabaseName)
-			cmdResponse := &engine.CommandResponse{
+			result = fmt.Sprintf("Database '%s' created successfully.", cmd.DatabaseName)
+			return &engine.CommandResponse{
 				ResultCount: 1,
 				Result:      result,
+			}, nil
+		case "UPDATE":
+			if err := serviceManager.DatabaseService.UpdateDatabase(*cmd); err != nil {
+				return nil, fmt.Errorf("error updating database '%s': %w", cmd.DatabaseName, err)
 			}
-			return cmdResponse, nil
-		case "bundle":
-			bundleCmd, err := engine.ParseCreateBundleCommand(command, logger)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing bundle command: %v", err)
+			result = fmt.Sprintf("Database '%s' updated.", cmd.DatabaseName)
+			return &engine.CommandResponse{
+				ResultCount: 1,
+				Result:      result,
+			}, nil
+		case "DELETE":
+			if db, err := serviceManager.DatabaseService.GetDatabaseByName(cmd.DatabaseName); err == nil {
+				serviceManager.BundleService.QueryCaches().ForgetDatabasePlans(db)
 			}
+			serviceManager.DatabaseService.DeleteDatabase(cmd.DatabaseName)
+		}
+		return &result, nil
 
+	case *engine.BundleCommand:
+		switch cmd.CommandType {
+		case "CREATE":
+			if cmd.Temporary {
+				return createTempBundle(database, serviceManager, cmd)
+			}
 			//Check if the bundle already exists
-			existingBundle, err := serviceManager.BundleService.GetBundleByName(database, bundleCmd.BundleName)
+			existingBundle, err := serviceManager.bundleByName(database, cmd.BundleName)
 			if err == nil {
-				return nil, fmt.Errorf("bundle '%s' already exists", existingBundle.Name)
+				return nil, protocol.Errorf(protocol.ErrAlreadyExists, "bundle '%s' already exists", existingBundle.Name)
 			}
 
 			// Get database object by name
 			database, err := serviceManager.DatabaseService.GetDatabaseByName(database.Name)
 			if err != nil {
-				return nil, fmt.Errorf("error retrieving database '%s': %v", database.Name, err)
+				return nil, fmt.Errorf("error retrieving database '%s': %w", database.Name, err)
 			}
 
 			// Add the bundle to the database
-			err = serviceManager.BundleService.AddBundle(serviceManager.DatabaseService, database, *bundleCmd)
-			if err != nil {
-				return nil, fmt.Errorf("error creating bundle: %v", err)
+			if err := serviceManager.BundleService.AddBundle(serviceManager.DatabaseService, database, *cmd); err != nil {
+				return nil, fmt.Errorf("error creating bundle: %w", err)
 			}
 
-			// Return the response
-			result = fmt.Sprintf("Bundle '%s' created successfully in database '%s'.", bundleCmd.BundleName, database.Name)
-			cmdResponse := &engine.CommandResponse{
+			result = fmt.Sprintf("Bundle '%s' created successfully in database '%s'.", cmd.BundleName, database.Name)
+			return &engine.CommandResponse{
 				ResultCount: 1,
 				Result:      result,
+			}, nil
+		case "UPDATE":
+			if err := serviceManager.BundleService.UpdateBundle(database, *cmd); err != nil {
+				return nil, fmt.Errorf("error updating bundle '%s': %w", cmd.BundleName, err)
 			}
-			return cmdResponse, nil
-		case "b-index":
-			btreeIndexCommand, err := engine.ParseCreateBTreeIndexCommand(command, logger)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing B-Tree index command: %v", err)
-			}
-			logger.Infof("Parsed B-Tree index command: %+v", btreeIndexCommand)
-
-			// Get the bundle by name
-			bundle, err := serviceManager.BundleService.GetBundleByName(database, btreeIndexCommand.BundleName)
-			if err == nil {
-				return nil, fmt.Errorf("bundle '%s' cannot be found", bundle.Name)
+		case "DELETE":
+			if bundle := serviceManager.TempBundles.Get(database, cmd.BundleName); bundle != nil {
+				serviceManager.TempBundles.remove(bundle)
+				break
 			}
-
-			// TODO Validate the index name
-			err = serviceManager.BundleService.AddIndexToBundle(database, bundle, btreeIndexCommand)
-			if err != nil {
-				return nil, fmt.Errorf("error adding B-Tree index to bundle '%s': %v", btreeIndexCommand.BundleName, err)
+			if err := serviceManager.BundleService.RemoveBundle(serviceManager.DatabaseService, database, cmd.BundleName); err != nil {
+				return nil, fmt.Errorf("error deleting bundle '%s': %w", cmd.BundleName, err)
 			}
-		case "h-index":
-			hashIndexCommand, err := engine.ParseCreateHashIndexCommand(command, logger)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing hash index command: %v", err)
-			}
-			logger.Infof("Parsed Hash index command: %+v", hashIndexCommand)
+		}
+		return &result, nil
 
-			// Get the bundle by name
-			bundle, err := serviceManager.BundleService.GetBundleByName(database, hashIndexCommand.BundleName)
-			if err == nil {
-				return nil, fmt.Errorf("bundle '%s' cannot be found", bundle.Name)
-			}
+	case *engine.CreateIndexCommand:
+		logger.Infof("Parsed %s index command: %+v", cmd.IndexType, cmd)
 
-			err = serviceManager.BundleService.AddIndexToBundle(database, bundle, hashIndexCommand)
-			if err != nil {
-				return nil, fmt.Errorf("error adding hash index to bundle '%s': %v", hashIndexCommand.BundleName, err)
-			}
-		case "user":
-			// ParseCreateRelationshipCommand(command)
-		default:
+		// Get the bundle by name
+		bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), database, cmd.BundleName)
+		if err != nil {
+			return nil, fmt.Errorf("bundle '%s' cannot be found", cmd.BundleName)
+		}
 
-			return &result, fmt.Errorf("unknown command format: %s", command)
+		// TODO Validate the index name
+		if err := serviceManager.BundleService.AddIndexToBundle(serviceManager.Context(), database, bundle, cmd); err != nil {
+			return nil, fmt.Errorf("error adding %s index to bundle '%s': %w", cmd.IndexType, cmd.BundleName, err)
 		}
 		return &result, nil
-	}
-
-	// Parse Add Document command
-	if strings.HasPrefix(strings.ToLower(command), "add") {
-		switch strings.ToLower(commandParts[1]) {
-		case "document":
-			if len(commandParts) < 4 {
-				return nil, fmt.Errorf("ADD DOCUMENT requires the spec 'TO <bundle_name>'")
-			}
 
-			// Parse the document command
-			docCommand, err := engine.ParseAddDocumentCommand(command, logger)
+	case *engine.BundleCopyCommand:
+		if cmd.CommandType == "SNAPSHOT" {
+			clone, err := serviceManager.BundleService.CopyBundle(serviceManager.DatabaseService, database, database, *cmd)
 			if err != nil {
-				return nil, fmt.Errorf("error parsing add document command: %v", err)
+				return nil, fmt.Errorf("error creating snapshot of bundle '%s': %w", cmd.SourceBundle, err)
 			}
 
-			bundleName := docCommand.BundleName
-			// Get the bundle by name
-			bundle, err := serviceManager.BundleService.GetBundleByName(database, docCommand.BundleName)
-			if err != nil {
-				return nil, fmt.Errorf("error retrieving bundle '%s': %v", bundleName, err)
-			}
-			// Add the document to the bundle
-			err = serviceManager.BundleService.AddDocumentToBundle(database, bundle, docCommand)
-			if err != nil {
-				return nil, fmt.Errorf("error adding document to bundle '%s': %v", bundleName, err)
-			}
-			result = fmt.Sprintf("Document added successfully to bundle '%s'.", bundleName)
-			cmdResponse := &engine.CommandResponse{
+			result = fmt.Sprintf("Snapshot '%s' of bundle '%s' created with %d documents.", clone.Name, cmd.SourceBundle, len(clone.Documents))
+			return &engine.CommandResponse{
 				ResultCount: 1,
 				Result:      result,
-			}
-			return cmdResponse, nil
+			}, nil
+		}
+
+		targetDB, err := serviceManager.DatabaseService.GetDatabaseByName(cmd.TargetDatabase)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving database '%s': %w", cmd.TargetDatabase, err)
+		}
+
+		clone, err := serviceManager.BundleService.CopyBundle(serviceManager.DatabaseService, database, targetDB, *cmd)
+		if err != nil {
+			return nil, fmt.Errorf("error cloning bundle '%s': %w", cmd.SourceBundle, err)
 		}
+
+		result = fmt.Sprintf("Bundle '%s' cloned to '%s' in database '%s' with %d documents.", cmd.SourceBundle, clone.Name, targetDB.Name, len(clone.Documents))
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      result,
+		}, nil
+
+	case *engine.BeginTransactionCommand, *engine.CommitCommand, *engine.RollbackCommand:
+		// Transactions belong to a connection; the server runs these
+		return nil, fmt.Errorf("%s is only available on a client connection", engine.StatementName(statement))
+
+	case *engine.DocumentCommand:
+		// Get the bundle by name
+		bundle, err := serviceManager.bundleByName(database, cmd.BundleName)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving bundle '%s': %w", cmd.BundleName, err)
+		}
+		// Add the document to the bundle
+		if err := serviceManager.BundleService.AddDocumentToBundle(database, bundle, cmd); err != nil {
+			return nil, fmt.Errorf("error adding document to bundle '%s': %w", cmd.BundleName, err)
+		}
+		result = fmt.Sprintf("Document added successfully to bundle '%s'.", cmd.BundleName)
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      result,
+		}, nil
+
+	case *engine.InsertSelectCommand:
+		return insertSelect(database, serviceManager, cmd, logger)
+
+	case *engine.MergeCommand:
+		return merge(database, serviceManager, cmd)
+
+	case *engine.EraseSubjectCommand:
+		return eraseSubject(database, serviceManager, cmd)
+
+	case *engine.DocumentUpdateCommand:
+		// Get the bundle by name
+		bundle, err := serviceManager.bundleByName(database, cmd.BundleName)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving bundle '%s': %w", cmd.BundleName, err)
+		}
+		err = serviceManager.BundleService.UpdateDocumentInBundle(bundle, cmd)
+		return &result, err
+
+	case *engine.DocumentDeleteCommand:
+		// Get the bundle by name
+		bundle, err := serviceManager.bundleByName(database, cmd.BundleName)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving bundle '%s': %w", cmd.BundleName, err)
+		}
+		err = serviceManager.BundleService.DeleteDocumentFromBundle(bundle, cmd)
+		return &result, err
 	}
 
-	// Parse UPDATE  command
-	if strings.HasPrefix(strings.ToLower(command), "update") {
-		switch strings.ToLower(commandParts[1]) {
-		case "database":
-			dbCommand, err := engine.ParseUpdateDatabaseCommand(command)
-			if err != nil {
-				return &result, err
-			}
-			// Execute the database command
-			serviceManager.DatabaseService.UpdateDatabase(*dbCommand)
-		case "bundle":
-			engine.ParseUpdateBundleCommand(command)
-		case "documents":
-
-			/*
-				UPDATE DOCUMENTS IN BUNDLE "BUNDLE_NAME"
-				(<FIELDNAME> = <VALUE>, <FIELDNAME> = <VALUE>, ... )
-			*/
-			if len(commandParts) < 5 || !strings.EqualFold(commandParts[2], "IN") {
-				return nil, fmt.Errorf("UPDATE DOCUMENTS requires the spec 'IN <Bundle_name>'")
-			}
-			bundleName := strings.Trim(commandParts[4], "\"'")
-			bundleName = strings.ReplaceAll(bundleName, "\"", "")
-			bundleName = strings.ReplaceAll(bundleName, "'", "")
-			bundleName = strings.ReplaceAll(bundleName, "”", "") // A very odd type of quote that can appear in text
-			// Get the bundle by name
-			bundle, err := serviceManager.BundleService.GetBundleByName(database, bundleName)
-			if err != nil {
-				return nil, fmt.Errorf("error retrieving bundle '%s': %v", bundleName, err)
-			}
-			// Parse the document command
-			docCommand, err := engine.ParseUpdateDocumentCommand(command, logger)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing update document command: %v", err)
-			}
+	return &result, nil
+}
+
+// explainSelect returns the access paths considered for a SELECT DOCUMENTS and the one the planner picks
+func explainSelect(database *models.Database, serviceManager ServiceManager, command *engine.SelectDocumentsCommand) (interface{}, error) {
+	bundle, err := serviceManager.bundleByName(database, command.BundleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving bundle '%s': %w", command.BundleName, err)
+	}
+
+	plan := engine.PlanQuery(bundle, command.Where)
+	plan.Where = command.WhereClause
+	return &engine.CommandResponse{
+		ResultCount: len(plan.Candidates),
+		Result:      plan,
+	}, nil
+}
 
-			// Delete the document from the bundle
-			err = serviceManager.BundleService.UpdateDocumentInBundle(bundle, docCommand)
-		case "user":
-			// ParseCreateRelationshipCommand(command)
-		default:
-			return &result, fmt.Errorf("unknown command format: %s", command)
+// selectDocuments runs SELECT DOCUMENTS FROM <bundle> [SAMPLE ...] [WHERE ...] [ORDER BY <field> [ASC|DESC]] [LIMIT n].
+// A non-nil partition list means the command was routed here by another node: only those
+// partitions are read and the command is never routed again.
+func selectDocuments(database *models.Database, serviceManager ServiceManager, command *engine.SelectDocumentsCommand, partitions []int, logger *zap.SugaredLogger) (interface{}, error) {
+	// Get the bundle by name
+	bundle, err := serviceManager.bundleByName(database, command.BundleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving bundle '%s': %w", command.BundleName, err)
+	}
+	serviceManager.BundleService.RecordBundleRead(bundle)
+	if command.AsOf != nil {
+		return selectAsOf(database, serviceManager, bundle, command, logger)
+	}
+	return selectFromBundle(database, serviceManager, bundle, command, partitions, logger)
+}
+
+// selectAsOf runs a SELECT DOCUMENTS ... AS OF against the bundle as it was at that time. The
+// versions are this node's, so a bundle spread over the cluster cannot be read this way.
+func selectAsOf(database *models.Database, serviceManager ServiceManager, bundle *models.Bundle, command *engine.SelectDocumentsCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	if serviceManager.QueryRouter.ShouldRoute(bundle) {
+		return nil, fmt.Errorf("AS OF cannot read bundle '%s'; it is spread over the cluster and versions are kept per node", bundle.Name)
+	}
+	view, err := serviceManager.BundleService.AsOf(bundle, *command.AsOf)
+	if err != nil {
+		return nil, err
+	}
+	if view != bundle {
+		defer engine.InvalidateIndexLookups(view)
+	}
+	return selectFromBundle(database, serviceManager, view, command, nil, logger)
+}
+
+// TransactionSelect runs a SELECT DOCUMENTS inside a transaction, against the documents its
+// isolation level lets it see
+func TransactionSelect(tx *Transaction, serviceManager ServiceManager, command *engine.SelectDocumentsCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), tx.Database, command.BundleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving bundle '%s': %w", command.BundleName, err)
+	}
+	serviceManager.BundleService.RecordBundleRead(bundle)
+	if command.AsOf != nil {
+		return selectAsOf(tx.Database, serviceManager, bundle, command, logger)
+	}
+
+	view := serviceManager.BundleService.TransactionView(tx, bundle)
+	if view != bundle {
+		defer engine.InvalidateIndexLookups(view)
+	}
+	return selectFromBundle(tx.Database, serviceManager, view, command, nil, logger)
+}
+
+// selectDistinct runs SELECT DISTINCT <field> FROM <bundle> [WHERE ...]
+func selectDistinct(database *models.Database, serviceManager ServiceManager, command *engine.SelectDistinctCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	bundle, err := serviceManager.bundleByName(database, command.BundleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving bundle '%s': %w", command.BundleName, err)
+	}
+	serviceManager.BundleService.RecordBundleRead(bundle)
+	return distinctFromBundle(database, serviceManager, bundle, command, logger)
+}
+
+// TransactionSelectDistinct runs a SELECT DISTINCT inside a transaction, against the documents
+// its isolation level lets it see
+func TransactionSelectDistinct(tx *Transaction, serviceManager ServiceManager, command *engine.SelectDistinctCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), tx.Database, command.BundleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving bundle '%s': %w", command.BundleName, err)
+	}
+	serviceManager.BundleService.RecordBundleRead(bundle)
+
+	view := serviceManager.BundleService.TransactionView(tx, bundle)
+	if view != bundle {
+		defer engine.InvalidateIndexLookups(view)
+	}
+	return distinctFromBundle(tx.Database, serviceManager, view, command, logger)
+}
+
+// distinctFromBundle collects the distinct values of a field. A bundle spread over the cluster
+// is filtered on every node and the values of what they return are collected here.
+func distinctFromBundle(database *models.Database, serviceManager ServiceManager, bundle *models.Bundle, command *engine.SelectDistinctCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	var values []interface{}
+	if serviceManager.QueryRouter.ShouldRoute(bundle) {
+		if database == nil {
+			return nil, fmt.Errorf("routed queries require a database to be selected")
+		}
+		documents, err := serviceManager.QueryRouter.RouteSelect(database.Name, bundle, command.WhereClause, nil, nil, func(localPartitions []int) ([]*models.Document, error) {
+			return engine.FilterDocumentsInPartitions(bundle, command.WhereClause, localPartitions, logger)
+		})
+		if err != nil {
+			return nil, err
+		}
+		values = engine.DistinctFieldValues(documents, command.Field)
+	} else {
+		var err error
+		if values, err = engine.DistinctValues(bundle, command.Field, command.Where, command.WhereClause, logger); err != nil {
+			return nil, fmt.Errorf("error filtering documents: %w", err)
 		}
-		return &result, nil
 	}
+	return &engine.CommandResponse{
+		ResultCount: len(values),
+		Result:      values,
+		Metadata:    engine.FieldMetadataOf(bundle, command.Field),
+	}, nil
+}
 
-	// Parse DELETE  command
-	if strings.HasPrefix(strings.ToLower(command), "delete") {
+// selectApproximate runs a SELECT of approximate aggregates such as TOPK and PERCENTILE
+func selectApproximate(database *models.Database, serviceManager ServiceManager, command *engine.SelectApproximateCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	bundle, err := serviceManager.bundleByName(database, command.BundleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving bundle '%s': %w", command.BundleName, err)
+	}
+	serviceManager.BundleService.RecordBundleRead(bundle)
+	return approximateFromBundle(database, serviceManager, bundle, command, logger)
+}
 
-		switch strings.ToLower(commandParts[1]) {
-		case "database":
-			dbCommand, err := engine.ParseDeleteDatabaseCommand(command)
-			if err != nil {
-				return &result, err
-			}
-			// Execute the database command
-			serviceManager.DatabaseService.DeleteDatabase(dbCommand.DatabaseName)
-		case "bundle":
-			engine.ParseDeleteBundleCommand(command)
-		case "documents":
-			//DELETE DOCUMENTS FROM BUNDLE "BUNDLE_NAME"
-			//WHERE <FIELDNAME> = <VALUE>
-			if len(commandParts) < 5 || !strings.EqualFold(commandParts[2], "FROM") {
-				return nil, fmt.Errorf("DELETE DOCUMENTS requires the spec 'FROM <Bundle_name>'")
-			}
-			bundleName := strings.Trim(commandParts[4], "\"'")
-			bundleName = strings.ReplaceAll(bundleName, "\"", "")
-			bundleName = strings.ReplaceAll(bundleName, "'", "")
-			bundleName = strings.ReplaceAll(bundleName, "”", "") // A very odd type of quote that can appear in text
-			// Get the bundle by name
-
-			// Parse the document command
-			docCommand, err := engine.ParseDeleteDocumentCommand(command, logger)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing delete document command: %v", err)
-			}
-			bundle, err := serviceManager.BundleService.GetBundleByName(database, bundleName)
-			if err != nil {
-				return nil, fmt.Errorf("error retrieving bundle '%s': %v", bundleName, err)
-			}
+// TransactionSelectApproximate runs a SELECT of approximate aggregates inside a transaction,
+// against the documents its isolation level lets it see
+func TransactionSelectApproximate(tx *Transaction, serviceManager ServiceManager, command *engine.SelectApproximateCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), tx.Database, command.BundleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving bundle '%s': %w", command.BundleName, err)
+	}
+	serviceManager.BundleService.RecordBundleRead(bundle)
 
-			// Delete the document from the bundle
-			err = serviceManager.BundleService.DeleteDocumentFromBundle(bundle, docCommand)
-		case "user":
-			// ParseCreateRelationshipCommand(command)
-		default:
-			return &result, fmt.Errorf("unknown command format: %s", command)
+	view := serviceManager.BundleService.TransactionView(tx, bundle)
+	if view != bundle {
+		defer engine.InvalidateIndexLookups(view)
+	}
+	return approximateFromBundle(tx.Database, serviceManager, view, command, logger)
+}
+
+// approximateFromBundle streams the matching documents through the sketches of the query's
+// functions. A bundle spread over the cluster is filtered on every node and what they return
+// is fed to the sketches here.
+func approximateFromBundle(database *models.Database, serviceManager ServiceManager, bundle *models.Bundle, command *engine.SelectApproximateCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	aggregator := engine.NewApproximateAggregator(command.Functions)
+	if serviceManager.QueryRouter.ShouldRoute(bundle) {
+		if database == nil {
+			return nil, fmt.Errorf("routed queries require a database to be selected")
 		}
-		return &result, nil
+		if command.Sample != nil && command.Sample.Rows > 0 {
+			return nil, fmt.Errorf("SAMPLE ROWS cannot read bundle '%s'; it is spread over the cluster, use SAMPLE n PERCENT", bundle.Name)
+		}
+		documents, err := serviceManager.QueryRouter.RouteSelect(database.Name, bundle, command.WhereClause, command.Sample, nil, func(localPartitions []int) ([]*models.Document, error) {
+			return engine.FilterSampledDocuments(bundle, command.WhereClause, localPartitions, command.Sample, logger)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range documents {
+			aggregator.Add(doc)
+		}
+	} else if err := engine.ScanDocuments(bundle, command.WhereClause, nil, command.Sample, logger, aggregator.Add); err != nil {
+		return nil, fmt.Errorf("error filtering documents: %w", err)
 	}
 
-	return &result, nil
+	results := aggregator.Results()
+	return &engine.CommandResponse{
+		ResultCount: len(results),
+		Result:      results,
+	}, nil
+}
+
+// selectFromBundle filters a bundle's documents, routing to other nodes when the bundle is spread
+// over the cluster
+func selectFromBundle(database *models.Database, serviceManager ServiceManager, bundle *models.Bundle, command *engine.SelectDocumentsCommand, partitions []int, logger *zap.SugaredLogger) (interface{}, error) {
+	whereClause, sample, modifiers := command.WhereClause, command.Sample, command.Modifiers
+
+	if partitions == nil && serviceManager.QueryRouter.ShouldRoute(bundle) {
+		if database == nil {
+			return nil, fmt.Errorf("routed queries require a database to be selected")
+		}
+		if sample != nil && sample.Rows > 0 {
+			return nil, fmt.Errorf("SAMPLE ROWS cannot read bundle '%s'; it is spread over the cluster, use SAMPLE n PERCENT", bundle.Name)
+		}
+		documents, err := serviceManager.QueryRouter.RouteSelect(database.Name, bundle, whereClause, sample, modifiers, func(localPartitions []int) ([]*models.Document, error) {
+			return engine.FilterSampledDocuments(bundle, whereClause, localPartitions, sample, logger)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &engine.CommandResponse{
+			ResultCount: len(documents),
+			Result:      documents,
+			NextKey:     modifiers.NextKey(documents),
+			Metadata:    engine.BundleMetadata(bundle),
+		}, nil
+	}
+
+	// Ordered results (and routed partial results) are returned as a list
+	if modifiers != nil || partitions != nil {
+		documents, err := engine.SelectOrderedDocuments(bundle, whereClause, partitions, sample, modifiers, logger)
+		if err != nil {
+			return nil, fmt.Errorf("error filtering documents: %w", err)
+		}
+		return &engine.CommandResponse{
+			ResultCount: len(documents),
+			Result:      documents,
+			NextKey:     modifiers.NextKey(documents),
+			Metadata:    engine.BundleMetadata(bundle),
+		}, nil
+	}
+
+	filteredDocs, err := engine.FilterSampledDocuments(bundle, whereClause, partitions, sample, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error filtering documents: %w", err)
+	}
+
+	documents := make(map[string]*models.Document)
+	for _, v := range filteredDocs {
+		documents[v.DocumentID] = v
+	}
+
+	cmdResponse := &engine.CommandResponse{
+		ResultCount: len(documents),
+		Result:      documents,
+		Metadata:    engine.BundleMetadata(bundle),
+	}
+	return cmdResponse, nil
 }
@@ -0,0 +1,362 @@
+package directors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	btreeindex "syndrdb/src/btree_index"
+	"syndrdb/src/engine"
+	hashindex "syndrdb/src/hash_index"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+)
+
+/*
+	Consistency check (CHECK DATABASE, and -fsck at startup).
+
+	For one database it verifies that
+	  - every bundle file listed in the database file exists, once,
+	  - every bundle file (and partition file) decodes and names the bundle it is listed as,
+	  - every index file belonging to a bundle opens and indexes a field the bundle defines,
+	  - every index the bundle knows about has its file,
+	  - every hash index has an entry for each document holding a value for its field.
+	With repair, references to missing bundle files are dropped from the database file and
+	missing, unreadable or out of date indexes are rebuilt from the bundle's documents. Hash indexes marked
+	invalid, by a crash during their build or one their log could not recover from, count as
+	unreadable; the server also rebuilds them at startup (RebuildInvalidIndexes). A bundle file that
+	does not decode is never touched; it has to be restored from a backup. A suspect bundle
+	(see suspect_bundles.go) that passes is writable again.
+*/
+
+// CheckProblem is one inconsistency found by a consistency check
+type CheckProblem struct {
+	Object   string // The file or catalog entry at fault
+	Problem  string
+	Repaired bool
+	Action   string // What the repair did, or why it could not; empty when no repair was asked for
+}
+
+// CheckReport is the outcome of checking one database
+type CheckReport struct {
+	Database       string
+	BundlesChecked int
+	IndexesChecked int
+	Problems       []CheckProblem
+	Repaired       int
+	Unresolved     int
+}
+
+func (r *CheckReport) add(problem CheckProblem) {
+	r.Problems = append(r.Problems, problem)
+	if problem.Repaired {
+		r.Repaired++
+	} else {
+		r.Unresolved++
+	}
+}
+
+// Summary is a one-line account of the check, for logs
+func (r *CheckReport) Summary() string {
+	return fmt.Sprintf("database '%s': %d bundle(s) and %d index(es) checked, %d problem(s) found, %d repaired, %d unresolved",
+		r.Database, r.BundlesChecked, r.IndexesChecked, len(r.Problems), r.Repaired, r.Unresolved)
+}
+
+// CheckDatabase verifies a database's bundle and index files, repairing what it can when asked
+func (s *BundleService) CheckDatabase(ctx context.Context, databaseService *DatabaseService, db *models.Database, repair bool) *CheckReport {
+	report := &CheckReport{Database: db.Name}
+
+	// Problems whose repair is dropping the reference; they only count as repaired once the
+	// database file has been rewritten
+	var dropped []CheckProblem
+	kept := make([]string, 0, len(db.BundleFiles))
+	seen := make(map[string]bool)
+
+	for _, fileName := range db.BundleFiles {
+		if seen[fileName] {
+			dropped = append(dropped, CheckProblem{Object: fileName, Problem: "bundle file is listed more than once"})
+			continue
+		}
+		seen[fileName] = true
+
+		if _, err := os.Stat(s.paths.Path(fileName)); err != nil {
+			dropped = append(dropped, CheckProblem{Object: fileName, Problem: fmt.Sprintf("database file lists a bundle file that cannot be found: %v", err)})
+			continue
+		}
+		kept = append(kept, fileName)
+
+		loaded, err := s.store.LoadBundleDataFile(ctx, db, fileName)
+		if err != nil {
+			report.add(CheckProblem{
+				Object:  fileName,
+				Problem: fmt.Sprintf("bundle file does not decode: %v", err),
+				Action:  repairAction(repair, "bundle files are never rewritten by a repair; restore it from a backup"),
+			})
+			continue
+		}
+		report.BundlesChecked++
+
+		if expected := helpers.BundleNameFromFile(fileName); loaded.Name != expected {
+			report.add(CheckProblem{
+				Object:  fileName,
+				Problem: fmt.Sprintf("bundle file holds bundle '%s', not '%s'", loaded.Name, expected),
+				Action:  repairAction(repair, "rename the file or the bundle by hand"),
+			})
+			continue
+		}
+
+		// The cached bundle knows the indexes created since startup
+		bundle := loaded
+		if cached, exists := s.bundles[loaded.Name]; exists {
+			bundle = cached
+		}
+		unresolved := report.Unresolved
+		s.checkIndexes(ctx, report, db, bundle, repair)
+		if report.Unresolved == unresolved {
+			s.clearSuspect(bundle.Name)
+		}
+	}
+
+	if len(dropped) == 0 {
+		return report
+	}
+	if !repair {
+		for _, problem := range dropped {
+			report.add(problem)
+		}
+		return report
+	}
+
+	previous := db.BundleFiles
+	db.BundleFiles = kept
+	err := databaseService.store.UpdateDatabaseDataFile(db)
+	if err != nil {
+		db.BundleFiles = previous
+	}
+	for _, problem := range dropped {
+		if err != nil {
+			problem.Action = fmt.Sprintf("could not rewrite the database file: %v", err)
+		} else {
+			problem.Repaired = true
+			problem.Action = "reference removed from the database file"
+		}
+		report.add(problem)
+	}
+	return report
+}
+
+// checkIndexes verifies the index files of one bundle against its schema and known indexes
+func (s *BundleService) checkIndexes(ctx context.Context, report *CheckReport, db *models.Database, bundle *models.Bundle, repair bool) {
+	prefix := helpers.IndexNamePrefix(bundle.BundleID)
+
+	onDisk := make(map[string]string) // File name -> index type
+	btreeFiles, _ := s.paths.BTreeIndexFiles(bundle.BundleID)
+	hashFiles, _ := s.paths.HashIndexFiles(bundle.BundleID)
+	for _, path := range btreeFiles {
+		onDisk[filepath.Base(path)] = "btree"
+	}
+	for _, path := range hashFiles {
+		onDisk[filepath.Base(path)] = "hash"
+	}
+
+	known := make(map[string]models.IndexReference) // File name -> reference
+	for _, ref := range bundle.Indexes {
+		known[indexFileName(bundle, ref)] = ref
+	}
+
+	fileNames := make([]string, 0, len(onDisk))
+	for fileName := range onDisk {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		indexType := onDisk[fileName]
+		report.IndexesChecked++
+
+		var field string
+		var err error
+		if indexType == "btree" {
+			field, err = btreeindex.VerifyIndexFile(s.paths.Path(fileName))
+		} else {
+			// A write under way marks the hash indexes it maintains, see index_maintenance.go
+			unlock := s.lockBundleWrites(bundle)
+			field, err = hashindex.VerifyHashIndexFile(s.paths.Path(fileName))
+			unlock()
+		}
+
+		if err != nil {
+			problem := CheckProblem{Object: fileName, Problem: fmt.Sprintf("index file is unreadable: %v", err)}
+			if repair {
+				ref, ok := known[fileName]
+				if !ok {
+					ref, ok = guessIndexReference(bundle, fileName, indexType, prefix)
+				}
+				if ok {
+					problem.Repaired, problem.Action = s.rebuildIndex(ctx, db, bundle, ref)
+				} else {
+					problem.Action = "cannot tell which fields it covered; drop it and create the index again"
+				}
+			}
+			report.add(problem)
+			continue
+		}
+
+		if _, defined := bundle.DocumentStructure.FieldDefinitions[field]; !defined && !indexesExpression(known[fileName], field) {
+			report.add(CheckProblem{
+				Object:  fileName,
+				Problem: fmt.Sprintf("index is on field '%s', which bundle '%s' does not define", field, bundle.Name),
+				Action:  repairAction(repair, "drop the index or add the field back"),
+			})
+		}
+		if ref, ok := known[fileName]; ok && indexType == "hash" && len(ref.Fields) > 0 {
+			s.checkHashEntries(ctx, report, db, bundle, fileName, ref, repair)
+		}
+	}
+
+	for fileName, ref := range known {
+		if _, exists := onDisk[fileName]; exists {
+			continue
+		}
+		report.IndexesChecked++
+		problem := CheckProblem{Object: fileName, Problem: fmt.Sprintf("index '%s' on bundle '%s' has no index file", ref.IndexName, bundle.Name)}
+		if repair {
+			problem.Repaired, problem.Action = s.rebuildIndex(ctx, db, bundle, ref)
+		}
+		report.add(problem)
+	}
+}
+
+// checkHashEntries compares the entries of a hash index with the documents of its bundle holding
+// a value for its field. They differ when writes the index took were lost with the machine, see
+// index_maintenance.go.
+func (s *BundleService) checkHashEntries(ctx context.Context, report *CheckReport, db *models.Database, bundle *models.Bundle,
+	fileName string, ref models.IndexReference, repair bool) {
+	unlock := s.lockBundleWrites(bundle)
+	stats, err := s.hashIndexes.HashIndexStats(strings.TrimSuffix(fileName, helpers.HashIndexFileExt))
+	holding := 0
+	for _, doc := range bundle.Documents {
+		if _, ok := engine.IndexedValue(&doc, ref.Fields[0]); ok {
+			holding++
+		}
+	}
+	unlock()
+	if err != nil || stats.Entries == uint64(holding) {
+		return
+	}
+
+	problem := CheckProblem{
+		Object:  fileName,
+		Problem: fmt.Sprintf("index is out of date: it has %d entries for %d documents holding its field", stats.Entries, holding),
+	}
+	if repair {
+		problem.Repaired, problem.Action = s.rebuildIndex(ctx, db, bundle, ref)
+	}
+	report.add(problem)
+}
+
+// RebuildInvalidIndexes rebuilds the hash indexes marked invalid (see hashindex.ErrIndexInvalid)
+// whose field can be told from their file name, returning how many it rebuilt. The others are
+// left for CHECK DATABASE to report.
+func (s *BundleService) RebuildInvalidIndexes(databaseService *DatabaseService) int {
+	// Only the meta pages are read unless an index is invalid
+	paths, _ := filepath.Glob(s.paths.Path("*_hidx" + helpers.HashIndexFileExt))
+	invalid := make(map[string]bool)
+	for _, path := range paths {
+		if _, err := hashindex.VerifyHashIndexFile(path); errors.Is(err, hashindex.ErrIndexInvalid) {
+			invalid[filepath.Base(path)] = true
+		}
+	}
+	if len(invalid) == 0 {
+		return 0
+	}
+
+	rebuilt := 0
+	for _, db := range databaseService.ListDatabases() {
+		for _, bundleFile := range db.BundleFiles {
+			bundle, err := s.GetBundleByName(db, helpers.BundleNameFromFile(bundleFile))
+			if err != nil {
+				continue
+			}
+			prefix := helpers.IndexNamePrefix(bundle.BundleID)
+			for fileName := range invalid {
+				if !strings.HasPrefix(fileName, prefix) {
+					continue
+				}
+				delete(invalid, fileName)
+				ref, ok := guessIndexReference(bundle, fileName, "hash", prefix)
+				if !ok {
+					s.logger.Warnf("Hash index %s is invalid and its field cannot be told; run CHECK DATABASE on '%s'", fileName, db.Name)
+					continue
+				}
+				if repaired, action := s.rebuildIndex(context.Background(), db, bundle, ref); repaired {
+					s.logger.Infof("Rebuilt invalid hash index %s of bundle '%s'", fileName, bundle.Name)
+					rebuilt++
+				} else {
+					s.logger.Errorf("Hash index %s of bundle '%s' is invalid: %s", fileName, bundle.Name, action)
+				}
+			}
+		}
+	}
+	return rebuilt
+}
+
+// rebuildIndex recreates an index from the bundle's documents
+func (s *BundleService) rebuildIndex(ctx context.Context, db *models.Database, bundle *models.Bundle, ref models.IndexReference) (bool, string) {
+	err := s.AddIndexToBundle(ctx, db, bundle, &engine.CreateIndexCommand{
+		IndexType:  ref.IndexType,
+		IndexName:  ref.IndexName,
+		BundleName: bundle.Name,
+		Fields:     ref.Fields,
+	})
+	if err != nil {
+		return false, fmt.Sprintf("rebuild failed: %v", err)
+	}
+	return true, "index rebuilt"
+}
+
+// indexFileName is the file the index services write an index to
+func indexFileName(bundle *models.Bundle, ref models.IndexReference) string {
+	fieldNames := make([]string, 0, len(ref.Fields))
+	for _, field := range ref.Fields {
+		fieldNames = append(fieldNames, engine.IndexFieldKey(field))
+	}
+	if ref.IndexType == "hash" {
+		return helpers.HashIndexName(bundle.BundleID, strings.Join(fieldNames, "_")) + helpers.HashIndexFileExt
+	}
+	return helpers.BTreeIndexName(bundle.BundleID, fieldNames) + helpers.BTreeIndexFileExt
+}
+
+// indexesExpression reports whether a field named in an index file is one of the index's
+// expressions, which the bundle does not define
+func indexesExpression(ref models.IndexReference, fieldName string) bool {
+	for _, field := range ref.Fields {
+		if field.Expression != "" && engine.IndexFieldKey(field) == fieldName {
+			return true
+		}
+	}
+	return false
+}
+
+// guessIndexReference recovers the field of a single-field index from its file name
+func guessIndexReference(bundle *models.Bundle, fileName, indexType, prefix string) (models.IndexReference, bool) {
+	name := helpers.IndexNameFromFile(fileName)
+	field := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), "_idx"), "_hidx")
+
+	definition, defined := bundle.DocumentStructure.FieldDefinitions[field]
+	if !defined {
+		return models.IndexReference{}, false
+	}
+	definition.Name = field // Definitions read back from a bundle file leave it to the map key
+	return models.IndexReference{IndexName: name, IndexType: indexType, Fields: []models.FieldDefinition{definition}}, true
+}
+
+func repairAction(repair bool, action string) string {
+	if !repair {
+		return ""
+	}
+	return action
+}
@@ -1,11 +1,13 @@
 package directors
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"strings"
 	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
 	"syndrdb/src/models"
+	"syndrdb/src/protocol"
 
 	"syndrdb/src/settings"
 
@@ -30,27 +32,33 @@ import (
 
 // DatabaseService manages operations on databases
 type DatabaseService struct {
-	store     engine.DatabaseStore
-	factory   engine.DatabaseFactory
-	settings  *settings.Arguments
-	databases map[string]*models.Database
-	logger    *zap.SugaredLogger
+	store       engine.DatabaseStore
+	factory     engine.DatabaseFactory
+	settings    *settings.Arguments
+	identifiers helpers.Identifiers // How database names are compared, see helpers/identifiers.go
+	databases   map[string]*models.Database
+	catalog     *engine.CatalogWAL // Commits changes that write database and bundle files together
+	logger      *zap.SugaredLogger
 }
 
-// NewDatabaseService creates a new DatabaseService
+// NewDatabaseService creates a new DatabaseService. The catalog log must have been opened,
+// finishing any interrupted change, before the databases are loaded here.
 func NewDatabaseService(store engine.DatabaseStore, factory engine.DatabaseFactory,
+	catalog *engine.CatalogWAL,
 	settings *settings.Arguments,
 	logger *zap.SugaredLogger) *DatabaseService {
 	service := &DatabaseService{
-		store:     store,
-		factory:   factory,
-		settings:  settings,
-		logger:    logger,
-		databases: make(map[string]*models.Database),
+		store:       store,
+		factory:     factory,
+		settings:    settings,
+		identifiers: helpers.NewIdentifiers(settings.IdentifierCase),
+		catalog:     catalog,
+		logger:      logger,
+		databases:   make(map[string]*models.Database),
 	}
 
 	// Load existing databases
-	databases, err := store.LoadAllDatabaseDataFiles(settings.DataDir)
+	databases, err := store.LoadAllDatabaseDataFiles(context.Background(), settings.DataDir)
 	if err != nil {
 		log.Printf("Warning: Error loading databases: %v", err)
 	} else {
@@ -65,11 +73,15 @@ func (s *DatabaseService) AddDatabase(databaseCommand engine.DatabaseCommand) er
 
 	// Check if the database already exists
 	if _, err := s.GetDatabaseByName(databaseCommand.DatabaseName); err == nil {
-		return fmt.Errorf("database '%s' already exists", databaseCommand.DatabaseName)
+		return protocol.Errorf(protocol.ErrAlreadyExists, "database '%s' already exists", databaseCommand.DatabaseName)
 	}
 
 	db := s.factory.NewDatabase(databaseCommand.DatabaseName, "")
 	db.DataDirectory = s.settings.DataDir
+	if databaseCommand.DefaultLimits != nil {
+		db.Defaults.Limits = *databaseCommand.DefaultLimits
+	}
+	db.Durability = databaseCommand.Durability
 
 	// Add to in-memory map
 	s.databases[db.DatabaseID] = db
@@ -82,12 +94,21 @@ func (s *DatabaseService) UpdateDatabase(databaseCommand engine.DatabaseCommand)
 	// Check if database exists
 	db, err := s.GetDatabaseByName(databaseCommand.DatabaseName)
 	if db == nil {
-		return fmt.Errorf("database '%s' not found", databaseCommand.DatabaseName)
+		return protocol.Errorf(protocol.ErrDatabaseNotFound, "database '%s' not found", databaseCommand.DatabaseName)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to get database: %w", err)
 	}
 
+	// Bundles already created keep the defaults they were created with
+	if databaseCommand.DefaultLimits != nil {
+		db.Defaults.Limits = *databaseCommand.DefaultLimits
+	}
+	// Takes effect from the next write to each bundle file
+	if databaseCommand.Durability != "" {
+		db.Durability = databaseCommand.Durability
+	}
+
 	// Update in-memory database
 	s.databases[db.DatabaseID] = db
 
@@ -101,15 +122,15 @@ func (s *DatabaseService) UpdateDatabase(databaseCommand engine.DatabaseCommand)
 	return nil
 }
 
-func GetDatabase(databases *map[string]*models.Database, databaseName string) (*models.Database, error) {
+func GetDatabase(databases *map[string]*models.Database, databaseName string, identifiers helpers.Identifiers) (*models.Database, error) {
 	// Check if the database exists in the system.
 	for dbName, db := range *databases {
-		if strings.EqualFold(dbName, databaseName) {
+		if identifiers.Same(dbName, databaseName) {
 			return db, nil
 		}
 	}
 
-	return nil, fmt.Errorf("database '%s' not found", databaseName)
+	return nil, protocol.Errorf(protocol.ErrDatabaseNotFound, "database '%s' not found", databaseName)
 }
 
 // DeleteDatabase removes a database from the server
@@ -133,18 +154,17 @@ func (s *DatabaseService) GetDatabaseByID(id string) (*models.Database, error) {
 	if db, exists := s.databases[id]; exists {
 		return db, nil
 	}
-	return nil, fmt.Errorf("database with ID %s not found", id)
+	return nil, protocol.Errorf(protocol.ErrDatabaseNotFound, "database with ID %s not found", id)
 }
 
-// GetDatabaseByName retrieves a database by name (case insensitive)
+// GetDatabaseByName retrieves a database by name, compared as -identifiercase says
 func (s *DatabaseService) GetDatabaseByName(name string) (*models.Database, error) {
-	nameLower := strings.ToLower(name)
 	for _, db := range s.databases {
-		if strings.ToLower(db.Name) == nameLower {
+		if s.identifiers.Same(db.Name, name) {
 			return db, nil
 		}
 	}
-	return nil, fmt.Errorf("database '%s' not found", name)
+	return nil, protocol.Errorf(protocol.ErrDatabaseNotFound, "database '%s' not found", name)
 }
 
 // ListDatabases returns all databases
@@ -164,21 +184,40 @@ func (s *DatabaseService) AddBundleToDatabase(dbName string, bundle models.Bundl
 	}
 
 	db.Bundles[bundle.Name] = bundle
-
-	//This needs to be added to a bundle file
-	err = bundleStore.CreateBundleFile(db, &bundle)
+	db.BundleFiles = append(db.BundleFiles, helpers.BundleFileName(bundle.Name))
+
+	// The bundle file and the database file listing it are written together
+	tx := s.BeginCatalogChange(fmt.Sprintf("create bundle %s in %s", bundle.Name, db.Name))
+	files, err := bundleStore.EncodeBundleFiles(&bundle)
+	if err == nil {
+		for fileName, data := range files {
+			tx.WriteFile(fileName, data)
+		}
+		err = s.stageDatabaseFile(tx, db)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
+		delete(db.Bundles, bundle.Name)
+		db.BundleFiles = db.BundleFiles[:len(db.BundleFiles)-1]
 		return fmt.Errorf("error creating bundle file: %w", err)
 	}
-	//logger.Infof("Decoded bundle data from file %v", bundle)
-	// and then the bundle file name needs to be added to the database file
-	db.BundleFiles = append(db.BundleFiles, fmt.Sprintf("%s.bnd", bundle.Name))
+	return nil
+}
 
-	// Write the updated database file
-	err = s.store.UpdateDatabaseDataFile(db)
+// BeginCatalogChange starts a catalog change; the files staged in it are written together
+// when it commits
+func (s *DatabaseService) BeginCatalogChange(description string) *engine.CatalogTx {
+	return s.catalog.Begin(description)
+}
+
+// stageDatabaseFile adds writing a database's file to a catalog change
+func (s *DatabaseService) stageDatabaseFile(tx *engine.CatalogTx, db *models.Database) error {
+	data, err := s.store.EncodeDatabaseFile(db)
 	if err != nil {
-		return fmt.Errorf("error updating database file: %w", err)
+		return err
 	}
-
-	return err
+	tx.WriteFile(helpers.DatabaseFileName(db.Name), data)
+	return nil
 }
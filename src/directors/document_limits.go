@@ -0,0 +1,142 @@
+package directors
+
+import (
+	"fmt"
+	"syndrdb/src/engine"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	Document limits.
+
+	Every document written is checked against its bundle's limits before anything is changed,
+	in memory or on disk: its encoded size, its field count, counting the fields of nested
+	objects, and how deeply objects and arrays nest in it. A limit the bundle leaves at zero
+	falls back to the server's (-maxdocumentbytes, -maxdocumentfields, -maxdocumentdepth),
+	and a server limit of zero is no limit. An update is checked as the documents would be
+	after it, so it fails as a whole before any of them is written.
+*/
+
+// DocumentLimitError refuses a document that is over one of its bundle's limits
+type DocumentLimitError struct {
+	Bundle     string
+	DocumentID string
+	Limit      string // BYTES, FIELDS or DEPTH, as in the LIMITS clause
+	Value      int64
+	Max        int64
+}
+
+func (e *DocumentLimitError) Error() string {
+	var what string
+	switch e.Limit {
+	case "BYTES":
+		what = fmt.Sprintf("is %d bytes", e.Value)
+	case "FIELDS":
+		what = fmt.Sprintf("has %d fields", e.Value)
+	default:
+		what = fmt.Sprintf("nests %d levels deep", e.Value)
+	}
+	return fmt.Sprintf("document '%s' %s; bundle '%s' allows at most %d (limit %s)", e.DocumentID, what, e.Bundle, e.Max, e.Limit)
+}
+
+func (e *DocumentLimitError) ErrorCode() protocol.ErrorCode { return protocol.ErrDocumentLimit }
+
+// documentLimits returns the limits a bundle's documents are held to
+func (s *BundleService) documentLimits(bundle *models.Bundle) models.DocumentLimits {
+	args := s.settings
+	limits := bundle.Limits
+	if limits.MaxBytes == 0 {
+		limits.MaxBytes = args.MaxDocumentBytes
+	}
+	if limits.MaxFields == 0 {
+		limits.MaxFields = args.MaxDocumentFields
+	}
+	if limits.MaxDepth == 0 {
+		limits.MaxDepth = args.MaxDocumentDepth
+	}
+	return limits
+}
+
+// checkDocumentLimits refuses a document that is over one of its bundle's limits
+func (s *BundleService) checkDocumentLimits(bundle *models.Bundle, doc *models.Document) error {
+	limits := s.documentLimits(bundle)
+	refuse := func(limit string, value, max int64) error {
+		return &DocumentLimitError{Bundle: bundle.Name, DocumentID: doc.DocumentID, Limit: limit, Value: value, Max: max}
+	}
+
+	if limits.MaxFields > 0 || limits.MaxDepth > 0 {
+		fields, depth := len(doc.Fields), 1
+		for _, field := range doc.Fields {
+			nestedFields, nestedDepth := valueShape(field.Value)
+			fields += nestedFields
+			depth = max(depth, 1+nestedDepth)
+		}
+		if limits.MaxFields > 0 && fields > limits.MaxFields {
+			return refuse("FIELDS", int64(fields), int64(limits.MaxFields))
+		}
+		if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+			return refuse("DEPTH", int64(depth), int64(limits.MaxDepth))
+		}
+	}
+	if limits.MaxBytes > 0 {
+		if size := documentSize(doc); size > limits.MaxBytes {
+			return refuse("BYTES", size, limits.MaxBytes)
+		}
+	}
+	return nil
+}
+
+// valueShape counts the fields of the objects nested in a value and how deeply objects and
+// arrays nest in it; a plain value has neither
+func valueShape(value interface{}) (fields int, depth int) {
+	var children []interface{}
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		fields = len(typed)
+		for _, child := range typed {
+			children = append(children, child)
+		}
+	case primitive.M:
+		fields = len(typed)
+		for _, child := range typed {
+			children = append(children, child)
+		}
+	case primitive.D:
+		fields = len(typed)
+		for _, element := range typed {
+			children = append(children, element.Value)
+		}
+	case []interface{}:
+		children = typed
+	case primitive.A:
+		children = typed
+	default:
+		return 0, 0
+	}
+
+	for _, child := range children {
+		childFields, childDepth := valueShape(child)
+		fields += childFields
+		depth = max(depth, childDepth)
+	}
+	return fields, depth + 1
+}
+
+// withUpdates returns a copy of a document with an update's field values applied
+func withUpdates(doc *models.Document, updates []engine.KeyValue) *models.Document {
+	updated := *doc
+	updated.Fields = make(map[string]models.Field, len(doc.Fields)+len(updates))
+	for name, field := range doc.Fields {
+		updated.Fields[name] = field
+	}
+	for _, kv := range updates {
+		field := updated.Fields[kv.Key]
+		field.Name = kv.Key
+		field.Value = kv.Value
+		updated.Fields[kv.Key] = field
+	}
+	return &updated
+}
@@ -0,0 +1,428 @@
+package directors
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"time"
+)
+
+/*
+	Subject erasure.
+
+	ERASE SUBJECT [<name>] WHERE ... [SHRED] carries out a GDPR-style erasure request. The
+	subjects, such as customers, are configured at startup in the JSON file -erasuresubjects
+	names:
+
+	{
+	  "Subjects": [
+	    {
+	      "Name": "customer",
+	      "Database": "shop",
+	      "Bundle": "Customers",
+	      "Key": "CustomerID",
+	      "Personal": ["Name", "Email"],
+	      "Related": [
+	        { "Bundle": "Orders", "Field": "CustomerID", "Personal": ["ShippingAddress"] },
+	        { "Bundle": "Tickets", "Field": "Customer" }
+	      ]
+	    }
+	  ]
+	}
+
+	The WHERE condition finds the subjects' documents in the subject's Bundle; their Key
+	values then find the documents of each Related bundle whose Field holds one of them. A
+	document of the subject's bundle without the key is erased on its own. Every document
+	found is
+	  - deleted, or
+	  - with SHRED, crypto-shredded: its Personal fields, or all its fields when the bundle
+	    lists none, are encrypted with AES-256-GCM under a key generated for its subject and
+	    never stored, so the documents stay for counts and totals but the personal values
+	    cannot be read back. Shredded values read as "shredded:" and base64.
+	The whole erasure is written the way a transaction's COMMIT writes (see transactions.go):
+	every document or none. The contents the erased documents had are dropped from the
+	versions kept for snapshots, AS OF and SHOW DOCUMENT HISTORY.
+
+	Each erasure returns a report, which is also appended as a line of JSON to erasures.log
+	in the data directory: who erased what and when, and for each subject the SHA-256 of its
+	key (so the report itself holds no personal data, while whoever asked for the erasure can
+	check it) and, with SHRED, the ID of the key its documents were shredded with. Changes
+	already published to change data capture or webhooks, copies made with SNAPSHOT or CLONE
+	BUNDLE and backups are outside its reach.
+*/
+
+// shreddedPrefix starts the value of a crypto-shredded field
+const shreddedPrefix = "shredded:"
+
+// ErasureSubjects are the subjects ERASE SUBJECT can erase, see LoadErasureSubjects
+type ErasureSubjects struct {
+	Subjects []ErasureSubject
+}
+
+// ErasureSubject is one kind of subject of a database and the bundles holding its documents
+type ErasureSubject struct {
+	Name     string
+	Database string
+	Bundle   string
+	Key      string   // Field of Bundle identifying the subject
+	Personal []string // Fields SHRED encrypts; every field when empty
+	Related  []ErasureLink
+}
+
+// ErasureLink is a bundle whose documents belong to the subject whose key Field holds
+type ErasureLink struct {
+	Bundle   string
+	Field    string
+	Personal []string
+}
+
+// ErasureReport is the record of one ERASE SUBJECT
+type ErasureReport struct {
+	ErasureID string
+	At        time.Time
+	User      string
+	Database  string
+	Subject   string
+	Condition string
+	Mode      string // DELETE or SHRED
+	Subjects  []ErasedSubject
+	Bundles   []ErasedBundle
+	Documents int
+
+	AuditLogError string `json:",omitempty"` // Set when the report could not be appended to erasures.log
+}
+
+// ErasedSubject is one subject an erasure found
+type ErasedSubject struct {
+	SubjectHash string // Hex SHA-256 of the key value, or of the DocumentID without one
+	KeyID       string `json:",omitempty"` // SHRED only: the first 8 bytes of the SHA-256 of the discarded key
+}
+
+// ErasedBundle lists the documents an erasure erased in one bundle
+type ErasedBundle struct {
+	Bundle    string
+	Documents []string
+}
+
+// LoadErasureSubjects reads the subjects from path; an empty path configures none
+func LoadErasureSubjects(path string, identifiers helpers.Identifiers) (*ErasureSubjects, error) {
+	subjects := &ErasureSubjects{}
+	if path == "" {
+		return subjects, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read erasure subjects: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(subjects); err != nil {
+		return nil, fmt.Errorf("failed to parse erasure subjects: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, subject := range subjects.Subjects {
+		if subject.Name == "" || subject.Database == "" || subject.Bundle == "" || subject.Key == "" {
+			return nil, fmt.Errorf("every erasure subject needs a Name, Database, Bundle and Key")
+		}
+		key := identifiers.Key(subject.Database) + "/" + identifiers.Key(subject.Name)
+		if seen[key] {
+			return nil, fmt.Errorf("erasure subject '%s' of database '%s' is listed twice", subject.Name, subject.Database)
+		}
+		seen[key] = true
+		for _, link := range subject.Related {
+			if link.Bundle == "" || link.Field == "" {
+				return nil, fmt.Errorf("erasure subject '%s': every related bundle needs a Bundle and a Field", subject.Name)
+			}
+		}
+	}
+	return subjects, nil
+}
+
+// SetErasureSubjects sets the subjects ERASE SUBJECT can erase
+func (s *BundleService) SetErasureSubjects(subjects *ErasureSubjects) {
+	s.erasure = subjects
+}
+
+// erasureSubject returns the subject of a database an ERASE SUBJECT names
+func (s *BundleService) erasureSubject(db *models.Database, name string) (*ErasureSubject, error) {
+	var found []*ErasureSubject
+	if s.erasure != nil {
+		for i, subject := range s.erasure.Subjects {
+			if s.identifiers.Same(subject.Database, db.Name) && (name == "" || s.identifiers.Same(subject.Name, name)) {
+				found = append(found, &s.erasure.Subjects[i])
+			}
+		}
+	}
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case name != "":
+		return nil, fmt.Errorf("no erasure subject '%s' is configured for database '%s'; see -erasuresubjects", name, db.Name)
+	case len(found) == 0:
+		return nil, fmt.Errorf("no erasure subject is configured for database '%s'; see -erasuresubjects", db.Name)
+	}
+	return nil, fmt.Errorf("database '%s' has %d erasure subjects; name one, as in ERASE SUBJECT \"%s\" WHERE ...", db.Name, len(found), found[0].Name)
+}
+
+// EraseSubject runs an ERASE SUBJECT outside any transaction and records its report
+func (s *BundleService) EraseSubject(databaseService *DatabaseService, db *models.Database, command *engine.EraseSubjectCommand, user string) (*ErasureReport, error) {
+	if _, err := s.erasureSubject(db, command.Subject); err != nil {
+		return nil, err
+	}
+	tx := s.BeginTransaction(db, engine.IsolationReadCommitted)
+	tx.statements = append(tx.statements, command)
+	w, _, err := s.commitTransaction(databaseService, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := w.erasure
+	report.ErasureID = helpers.GenerateUUID()
+	report.At = time.Now().UTC()
+	report.User = user
+	if err := s.logErasure(report); err != nil {
+		s.logger.Errorf("Erasure %s was carried out but not recorded in %s: %v", report.ErasureID, helpers.ErasureLogFileName, err)
+		report.AuditLogError = err.Error()
+	}
+	s.logger.Infof("Erasure %s of %d subject(s) '%s' in database '%s' erased %d document(s)",
+		report.ErasureID, len(report.Subjects), report.Subject, report.Database, report.Documents)
+	return report, nil
+}
+
+// logErasure appends a report to erasures.log
+func (s *BundleService) logErasure(report *ErasureReport) error {
+	line, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.paths.Path(helpers.ErasureLogFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// erasedSubject is a subject an erasure found, with its key for SHRED
+type erasedSubject struct {
+	report ErasedSubject
+	aead   cipher.AEAD // nil without SHRED
+}
+
+// applyErase runs an ERASE SUBJECT against the working copies
+func (w *transactionWrites) applyErase(cmd *engine.EraseSubjectCommand) (int, error) {
+	subject, err := w.service.erasureSubject(w.db, cmd.Subject)
+	if err != nil {
+		return 0, err
+	}
+	root, err := w.writable(subject.Bundle)
+	if err != nil {
+		return 0, err
+	}
+	found, err := engine.FilterDocuments(root, cmd.WhereClause, w.service.logger)
+	if err != nil {
+		return 0, fmt.Errorf("failed to filter documents: %w", err)
+	}
+
+	report := &ErasureReport{Database: w.db.Name, Subject: subject.Name, Condition: cmd.WhereClause, Mode: "DELETE"}
+	if cmd.Shred {
+		report.Mode = "SHRED"
+	}
+	var subjects []*erasedSubject
+	byKey := make(map[string]*erasedSubject)
+	newSubject := func(identity interface{}) (*erasedSubject, error) {
+		sum := sha256.Sum256([]byte(fmt.Sprint(identity)))
+		erased := &erasedSubject{report: ErasedSubject{SubjectHash: hex.EncodeToString(sum[:])}}
+		if cmd.Shred {
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return nil, fmt.Errorf("failed to generate a subject key: %w", err)
+			}
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			if erased.aead, err = cipher.NewGCM(block); err != nil {
+				return nil, err
+			}
+			keySum := sha256.Sum256(key)
+			erased.report.KeyID = hex.EncodeToString(keySum[:8])
+			clear(key)
+		}
+		subjects = append(subjects, erased)
+		return erased, nil
+	}
+
+	// The subjects' documents of their own bundle, then those of the related bundles
+	targets := make(map[*models.Bundle]map[string]*erasedSubject)
+	targets[root] = make(map[string]*erasedSubject)
+	for _, doc := range found {
+		field, exists := doc.Fields[subject.Key]
+		if !exists || field.Value == nil {
+			erased, err := newSubject(doc.DocumentID)
+			if err != nil {
+				return 0, err
+			}
+			targets[root][doc.DocumentID] = erased
+			continue
+		}
+		key := engine.ValueKey(field.Value)
+		erased := byKey[key]
+		if erased == nil {
+			if erased, err = newSubject(field.Value); err != nil {
+				return 0, err
+			}
+			byKey[key] = erased
+		}
+		targets[root][doc.DocumentID] = erased
+	}
+	personal := map[*models.Bundle][]string{root: subject.Personal}
+	bundles := []*models.Bundle{root}
+	for _, link := range subject.Related {
+		related, err := w.writable(link.Bundle)
+		if err != nil {
+			return 0, fmt.Errorf("related bundle '%s' of erasure subject '%s': %w", link.Bundle, subject.Name, err)
+		}
+		if targets[related] == nil {
+			targets[related] = make(map[string]*erasedSubject)
+			bundles = append(bundles, related)
+		}
+		personal[related] = append(personal[related], link.Personal...)
+		for docID, doc := range related.Documents {
+			if field, exists := doc.Fields[link.Field]; exists && field.Value != nil {
+				if erased := byKey[engine.ValueKey(field.Value)]; erased != nil {
+					targets[related][docID] = erased
+				}
+			}
+		}
+	}
+
+	erasedCount := 0
+	for _, bundle := range bundles {
+		docIDs := make([]string, 0, len(targets[bundle]))
+		for docID := range targets[bundle] {
+			docIDs = append(docIDs, docID)
+		}
+		if len(docIDs) == 0 {
+			continue
+		}
+		sort.Strings(docIDs)
+		if w.erased[bundle.Name] == nil {
+			w.erased[bundle.Name] = make(map[string]*models.Document)
+		}
+		for _, docID := range docIDs {
+			before := bundle.Documents[docID]
+			if !cmd.Shred {
+				delete(bundle.Documents, docID)
+				w.documents[bundle.Name]--
+				w.bytes[bundle.Name] -= documentSize(&before)
+				w.changes[bundle.Name].record(bundle, &before, -1)
+				w.erased[bundle.Name][docID] = nil
+			} else {
+				doc, err := shredDocument(&before, personal[bundle], targets[bundle][docID].aead)
+				if err != nil {
+					return 0, err
+				}
+				doc.UpdatedAt = time.Now()
+				bundle.Documents[docID] = *doc
+				w.bytes[bundle.Name] += documentSize(doc) - documentSize(&before)
+				w.changes[bundle.Name].record(bundle, &before, -1)
+				w.changes[bundle.Name].record(bundle, doc, 1)
+				w.erased[bundle.Name][docID] = doc
+			}
+			w.touched[bundle.Name][docID] = true
+		}
+		engine.InvalidateIndexLookups(bundle)
+		report.Bundles = append(report.Bundles, ErasedBundle{Bundle: bundle.Name, Documents: docIDs})
+		erasedCount += len(docIDs)
+	}
+	for _, erased := range subjects {
+		report.Subjects = append(report.Subjects, erased.report)
+	}
+	report.Documents = erasedCount
+	w.erasure = report
+	return erasedCount, nil
+}
+
+// shredDocument returns a copy of a document with its personal fields, or all of them when
+// none are named, encrypted under a subject's key
+func shredDocument(doc *models.Document, personal []string, aead cipher.AEAD) (*models.Document, error) {
+	names := personal
+	if len(names) == 0 {
+		names = make([]string, 0, len(doc.Fields))
+		for name := range doc.Fields {
+			names = append(names, name)
+		}
+	}
+	var updates []engine.KeyValue
+	for _, name := range names {
+		field, exists := doc.Fields[name]
+		if !exists || field.Value == nil {
+			continue
+		}
+		plain, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to shred field '%s': %w", name, err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("failed to shred field '%s': %w", name, err)
+		}
+		sealed := aead.Seal(nonce, nonce, plain, nil)
+		updates = append(updates, engine.KeyValue{Key: name, Value: shreddedPrefix + base64.StdEncoding.EncodeToString(sealed)})
+	}
+	return withUpdates(doc, updates), nil
+}
+
+// forget replaces the contents kept of erased documents, by bundle and ID, with what the
+// erasure left: nothing for a deleted document, the shredded one otherwise
+func (v *versionStore) forget(erased map[string]map[string]*models.Document) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for i := range v.undo {
+		record := &v.undo[i]
+		after, exists := erased[record.bundle][record.docID]
+		if !exists || record.before == nil {
+			continue
+		}
+		if after == nil {
+			record.before = nil
+		} else {
+			record.before = copyDocument(*after)
+		}
+	}
+}
+
+// eraseSubject runs ERASE SUBJECT
+func eraseSubject(database *models.Database, serviceManager ServiceManager, command *engine.EraseSubjectCommand) (interface{}, error) {
+	if database == nil {
+		return nil, fmt.Errorf("ERASE SUBJECT requires a database to be selected")
+	}
+	report, err := serviceManager.BundleService.EraseSubject(serviceManager.DatabaseService, database, command, serviceManager.User)
+	if err != nil {
+		return nil, fmt.Errorf("error erasing subject: %w", err)
+	}
+	return &engine.CommandResponse{
+		ResultCount: report.Documents,
+		Result:      report,
+	}, nil
+}
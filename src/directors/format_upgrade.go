@@ -0,0 +1,99 @@
+package directors
+
+import (
+	"fmt"
+	"strings"
+	btreeindex "syndrdb/src/btree_index"
+	"syndrdb/src/engine"
+	hashindex "syndrdb/src/hash_index"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Data directory upgrades.
+
+	At startup, before any database is loaded, a data directory older than
+	engine.DataFormatVersion (or without format.json) has its files brought forward:
+	  - bundle and partition files in an older format are rewritten in the current one, each
+	    under a temporary name renamed into place,
+	  - hash index files in an older format cannot be converted, since their keys were encoded
+	    differently; hashindex.UpgradeHashIndexFile marks them invalid and they are rebuilt
+	    once the databases are loaded (RebuildInvalidIndexes),
+	  - btree index files only have their version checked, since every version is still read.
+	format.json is written last. An upgrade cut short is run again at the next start, and files
+	already converted are left alone.
+
+	The upgrade never guesses. It refuses to go on, and the server to start, when format.json
+	or any file is newer than this server reads, or when a file's format cannot be told because
+	it does not decode. Such a file has to be restored from a backup or moved out of the data
+	directory first. Legacy bundle files are not read and are left for ADOPT.
+*/
+
+// UpgradeDataDirectory brings the files of a data directory to the current formats, unless
+// format.json says they already are
+func UpgradeDataDirectory(dataDir string, logger *zap.SugaredLogger) error {
+	paths := helpers.NewPathResolver(dataDir)
+	format, recorded, err := engine.ReadDataFormat(paths)
+	if err != nil {
+		return err
+	}
+	if recorded && format.Version > engine.DataFormatVersion {
+		return protocol.Errorf(protocol.ErrNewerFormat, "data directory has format version %d, written by a newer server; this server reads versions 1 to %d",
+			format.Version, engine.DataFormatVersion)
+	}
+	if recorded && format.Version == engine.DataFormatVersion {
+		return nil
+	}
+
+	entries, err := paths.ReadDataDir()
+	if err != nil {
+		return fmt.Errorf("error reading data directory %s: %w", dataDir, err)
+	}
+	converted := 0
+	for _, entry := range entries {
+		name := entry.Path
+		path := paths.Path(name)
+
+		var version, current int
+		switch {
+		case strings.HasSuffix(name, helpers.BundleFileExt):
+			version, err = engine.UpgradeBundleFile(path)
+			current = engine.BundleFormatVersion
+		case strings.HasSuffix(name, helpers.HashIndexFileExt):
+			version, err = hashindex.UpgradeHashIndexFile(path)
+			current = hashindex.FormatVersion
+			if err == nil && version < current {
+				logger.Warnf("%s is in hash index format version %d, which cannot be converted; it will be rebuilt", name, version)
+				continue
+			}
+		case strings.HasSuffix(name, helpers.BTreeIndexFileExt):
+			version, err = btreeindex.IndexFileVersion(path)
+			current = version
+		default:
+			continue
+		}
+		if err != nil && !strings.HasSuffix(name, helpers.BundleFileExt) && protocol.CodeOf(err) != protocol.ErrNewerFormat {
+			// An index can be rebuilt from its bundle; CHECK DATABASE will find it
+			logger.Warnf("Index file %s could not be read to upgrade it: %v", name, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot upgrade %s: %w; restore it or move it out of the data directory", name, err)
+		}
+		if version < current {
+			logger.Infof("Upgraded %s from format version %d to %d", name, version, current)
+			converted++
+		}
+	}
+
+	if err := engine.WriteDataFormat(paths); err != nil {
+		return fmt.Errorf("error recording the data directory's format: %w", err)
+	}
+	if converted > 0 {
+		logger.Infof("Upgraded the data directory to format version %d: %d file(s) converted", engine.DataFormatVersion, converted)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package directors
+
+import (
+	"errors"
+	"syndrdb/src/engine"
+	hashindex "syndrdb/src/hash_index"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+)
+
+/*
+	Hash index maintenance.
+
+	The hash index files of a bundle change with its documents. Before a write changes any
+	document, captureIndexWrite reads the value each hash index holds for the documents it is
+	about to write and marks the indexes invalid in their files, durably. Once the documents are
+	written, maintainIndexes removes the entries of the values that changed, adds the new ones
+	and clears the mark, in one commit to each index's log (see hash_index/hash_wal.go). A write
+	that fails part way maintains what it did write; one that wrote nothing just clears the mark.
+
+	A crash between the two leaves the index marked, and it is rebuilt from its bundle at
+	startup. That holds whenever the bundle's files survive as the write left them: after a
+	server crash in every durability mode, and after a machine crash at ALWAYS. At INTERVAL or
+	OFF a machine crash can lose document writes the index took; CHECK DATABASE finds an index
+	whose entries no longer match its bundle and a repair rebuilds it.
+
+	An index that cannot take a write is left invalid. Lookups then read the postings built from
+	the documents until it is rebuilt, at startup or by a repair. B-tree index files are built by
+	CREATE INDEX and are not maintained.
+*/
+
+// CloseIndexes closes the hash indexes held open for lookups and writes
+func (s *BundleService) CloseIndexes() error {
+	return s.hashIndexes.Close()
+}
+
+// indexCapture holds what the hash indexes of a bundle hold for the documents of a write
+type indexCapture struct {
+	bundle  *models.Bundle
+	docIDs  []string
+	indexes []capturedIndex
+}
+
+// capturedIndex is one hash index of a captured write
+type capturedIndex struct {
+	name   string // Of the index file
+	field  models.FieldDefinition
+	before map[string]interface{} // DocID -> value, for the documents that had one
+}
+
+// captureIndexWrite marks the hash indexes of a bundle before a write changes the documents and
+// keeps their values; nil for temporary bundles and bundles without hash indexes
+func (s *BundleService) captureIndexWrite(bundle *models.Bundle, docIDs ...string) *indexCapture {
+	if bundle.Temporary {
+		return nil
+	}
+	var capture *indexCapture
+	for _, index := range bundle.Indexes {
+		if index.IndexType != "hash" || len(index.Fields) == 0 {
+			continue
+		}
+		field := index.Fields[0]
+		name := helpers.HashIndexName(bundle.BundleID, engine.IndexFieldKey(field))
+		if err := s.hashIndexes.MarkHashIndexChanging(name); err != nil {
+			// An invalid index is rebuilt rather than maintained
+			if !errors.Is(err, hashindex.ErrIndexInvalid) {
+				s.logger.Errorf("Hash index %s of bundle '%s' is left invalid: %v", name, bundle.Name, err)
+			}
+			continue
+		}
+
+		captured := capturedIndex{name: name, field: field, before: make(map[string]interface{}, len(docIDs))}
+		for _, docID := range docIDs {
+			if doc, exists := bundle.Documents[docID]; exists {
+				if value, ok := engine.IndexedValue(&doc, field); ok {
+					captured.before[docID] = value
+				}
+			}
+		}
+		if capture == nil {
+			capture = &indexCapture{bundle: bundle, docIDs: append([]string(nil), docIDs...)}
+		}
+		capture.indexes = append(capture.indexes, captured)
+	}
+	return capture
+}
+
+// maintainIndexes writes to the captured hash indexes the values the write changed and clears
+// their marks. An index that fails is left invalid, the write stands.
+func (s *BundleService) maintainIndexes(capture *indexCapture) {
+	if capture == nil {
+		return
+	}
+	for _, index := range capture.indexes {
+		var removed, added []hashindex.IndexEntry
+		for _, docID := range capture.docIDs {
+			before, had := index.before[docID]
+			var after interface{}
+			has := false
+			if doc, exists := capture.bundle.Documents[docID]; exists {
+				after, has = engine.IndexedValue(&doc, index.field)
+			}
+			if had && has && engine.ValueKey(before) == engine.ValueKey(after) {
+				continue
+			}
+			if had {
+				removed = append(removed, hashindex.IndexEntry{DocID: docID, Value: before})
+			}
+			if has {
+				added = append(added, hashindex.IndexEntry{DocID: docID, Value: after})
+			}
+		}
+
+		indexField := hashindex.IndexField{FieldName: engine.IndexFieldKey(index.field), IsUnique: index.field.IsUnique}
+		if err := s.hashIndexes.UpdateHashIndex(index.name, indexField, removed, added); err != nil {
+			s.logger.Errorf("Hash index %s of bundle '%s' is left invalid: %v", index.name, capture.bundle.Name, err)
+		}
+	}
+}
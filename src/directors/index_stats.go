@@ -0,0 +1,81 @@
+package directors
+
+import (
+	"sort"
+	"syndrdb/src/engine"
+	hashindex "syndrdb/src/hash_index"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+)
+
+/*
+	Index statistics report.
+
+	SHOW INDEX STATS lists the indexes of the current database, or of one bundle, with the
+	statistics the query planner costs them by: entries, distinct keys per field prefix and
+	height. A hash index also reports its file: buckets, fill factor and load, splits, and how
+	many overflow pages are chained behind its buckets. Long chains mean lookups read several
+	pages for one bucket; a lower -hashfillfactor splits buckets sooner and keeps them short.
+*/
+
+// IndexStatsInfo is one index in SHOW INDEX STATS
+type IndexStatsInfo struct {
+	Bundle     string
+	Index      string
+	Type       string
+	Fields     []string
+	Statistics *engine.IndexStatistics
+	Hash       *hashindex.HashIndexStats `json:",omitempty"` // For a hash index whose file could be read
+	HashError  string                    `json:",omitempty"` // Why it could not
+}
+
+// IndexStats describes the indexes of a bundle, or of every bundle of the database
+func (s *BundleService) IndexStats(db *models.Database, bundleName string) ([]IndexStatsInfo, error) {
+	var names []string
+	if bundleName != "" {
+		names = []string{bundleName}
+	} else {
+		for _, fileName := range db.BundleFiles {
+			names = append(names, helpers.BundleNameFromFile(fileName))
+		}
+	}
+
+	indexes := make([]IndexStatsInfo, 0)
+	for _, name := range names {
+		bundle, err := s.GetBundleByName(db, name)
+		if err != nil {
+			if bundleName != "" {
+				return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", bundleName)
+			}
+			continue
+		}
+		for _, index := range bundle.Indexes {
+			info := IndexStatsInfo{
+				Bundle:     bundle.Name,
+				Index:      index.IndexName,
+				Type:       index.IndexType,
+				Statistics: engine.CollectIndexStatistics(bundle, index),
+			}
+			for _, field := range index.Fields {
+				info.Fields = append(info.Fields, field.Name)
+			}
+			if index.IndexType == "hash" && len(index.Fields) > 0 {
+				stats, err := s.hashIndexes.HashIndexStats(helpers.HashIndexName(bundle.BundleID, engine.IndexFieldKey(index.Fields[0])))
+				if err != nil {
+					info.HashError = err.Error()
+				} else {
+					info.Hash = &stats
+				}
+			}
+			indexes = append(indexes, info)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		if indexes[i].Bundle != indexes[j].Bundle {
+			return indexes[i].Bundle < indexes[j].Bundle
+		}
+		return indexes[i].Index < indexes[j].Index
+	})
+	return indexes, nil
+}
@@ -0,0 +1,145 @@
+package directors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	Index usage report.
+
+	The engine counts the queries each index serves (see engine/index_usage.go). The counts
+	are written to index_usage.json in the data directory every IndexUsageInterval and when
+	the server stops, and read back when it starts, so they cover more than one run; a crash
+	loses at most one interval of them. SHOW INDEX USAGE lists the indexes of the current
+	database, or of one bundle, least used first: an index that never served a query still
+	costs every write to its bundle.
+*/
+
+const indexUsageFile = "index_usage.json"
+
+// IndexUsageInfo is one index in SHOW INDEX USAGE
+type IndexUsageInfo struct {
+	Bundle   string
+	Index    string
+	Type     string
+	Fields   []string
+	Created  time.Time
+	Lookups  uint64     // Queries the index served
+	LastUsed *time.Time // nil when it never served one
+	Unused   bool
+}
+
+// IndexUsage lists the indexes of a bundle, or of every bundle of the database, least used first
+func (s *BundleService) IndexUsage(db *models.Database, bundleName string) ([]IndexUsageInfo, error) {
+	var names []string
+	if bundleName != "" {
+		names = []string{bundleName}
+	} else {
+		for _, fileName := range db.BundleFiles {
+			names = append(names, helpers.BundleNameFromFile(fileName))
+		}
+	}
+
+	indexes := make([]IndexUsageInfo, 0)
+	for _, name := range names {
+		bundle, err := s.GetBundleByName(db, name)
+		if err != nil {
+			if bundleName != "" {
+				return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", bundleName)
+			}
+			continue
+		}
+		for _, index := range bundle.Indexes {
+			usage := engine.IndexUsageOf(bundle, index.IndexName)
+			info := IndexUsageInfo{
+				Bundle:  bundle.Name,
+				Index:   index.IndexName,
+				Type:    index.IndexType,
+				Created: index.CreateTime,
+				Lookups: usage.Lookups,
+				Unused:  usage.Lookups == 0,
+			}
+			for _, field := range index.Fields {
+				info.Fields = append(info.Fields, field.Name)
+			}
+			if !usage.LastUsed.IsZero() {
+				lastUsed := usage.LastUsed
+				info.LastUsed = &lastUsed
+			}
+			indexes = append(indexes, info)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		if indexes[i].Lookups != indexes[j].Lookups {
+			return indexes[i].Lookups < indexes[j].Lookups
+		}
+		if indexes[i].Bundle != indexes[j].Bundle {
+			return indexes[i].Bundle < indexes[j].Bundle
+		}
+		return indexes[i].Index < indexes[j].Index
+	})
+	return indexes, nil
+}
+
+// loadIndexUsage reads back the index usage saved by an earlier run
+func (s *BundleService) loadIndexUsage() error {
+	data, err := os.ReadFile(s.paths.Path(indexUsageFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read index usage: %w", err)
+	}
+	var saved map[string]engine.IndexUsage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to decode index usage: %w", err)
+	}
+	engine.RestoreIndexUsage(saved)
+	_, s.indexUsageSaved = engine.IndexUsageSnapshot()
+	return nil
+}
+
+// SaveIndexUsage writes the index usage to the data directory if it changed since it was
+// last written
+func (s *BundleService) SaveIndexUsage() error {
+	s.indexUsageMu.Lock()
+	defer s.indexUsageMu.Unlock()
+	usage, version := engine.IndexUsageSnapshot()
+	if version == s.indexUsageSaved {
+		return nil
+	}
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return fmt.Errorf("failed to encode index usage: %w", err)
+	}
+	path := s.paths.Path(indexUsageFile)
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write index usage: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to replace index usage: %w", err)
+	}
+	s.indexUsageSaved = version
+	return nil
+}
+
+// saveIndexUsageEvery writes the index usage every interval, for as long as the server runs
+func (s *BundleService) saveIndexUsageEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.SaveIndexUsage(); err != nil {
+			s.logger.Warnf("Could not save index usage: %v", err)
+		}
+	}
+}
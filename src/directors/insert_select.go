@@ -0,0 +1,107 @@
+package directors
+
+import (
+	"fmt"
+	"sort"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+
+	"go.uber.org/zap"
+)
+
+// insertSelect runs ADD DOCUMENTS TO <bundle> [MAP (...)] FROM SELECT DOCUMENTS .... The SELECT
+// runs as it would on its own, routed over the cluster when its bundle is spread, and every
+// document it returns is added to the target as a new document: a copy of its fields, or the
+// fields MAP computes from it. A mapped expression with no value for a document leaves that
+// field out. Either every document is added or, when one is refused, none is. With IDS, a new
+// document's ID derives from the seed and the ID of the document it was made from, so a
+// replica running the same command gives it the same ID.
+func insertSelect(database *models.Database, serviceManager ServiceManager, command *engine.InsertSelectCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	if err := checkTempBundleStatement(database, serviceManager, command.Select); err != nil {
+		return nil, err
+	}
+	target, err := serviceManager.bundleByName(database, command.BundleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving bundle '%s': %w", command.BundleName, err)
+	}
+
+	selected, err := selectDocuments(database, serviceManager, command.Select, nil, logger)
+	if err != nil {
+		return nil, err
+	}
+	sources := selectedDocuments(selected)
+	commands := make([]*engine.DocumentCommand, 0, len(sources))
+	made := make(map[string]int) // Documents made so far from each source ID
+	for _, source := range sources {
+		add := &engine.DocumentCommand{
+			CommandType: "ADD",
+			BundleName:  target.Name,
+			Fields:      mappedFields(source, command.Mapping),
+		}
+		if command.IDSeed != "" {
+			made[source.DocumentID]++
+			add.DocumentID = helpers.DerivedUUID(command.IDSeed, fmt.Sprintf("%s#%d", source.DocumentID, made[source.DocumentID]))
+		}
+		commands = append(commands, add)
+	}
+
+	added, err := serviceManager.BundleService.AddDocumentsToBundle(serviceManager.DatabaseService, target, commands)
+	if err != nil {
+		return nil, fmt.Errorf("error adding documents to bundle '%s': %w", target.Name, err)
+	}
+	return &engine.CommandResponse{
+		ResultCount: added,
+		Result:      fmt.Sprintf("%d document(s) added to bundle '%s' from bundle '%s'.", added, target.Name, command.Select.BundleName),
+	}, nil
+}
+
+// selectedDocuments returns the documents of a SELECT DOCUMENTS result, in the order of the
+// result when it has one and by creation otherwise
+func selectedDocuments(result interface{}) []*models.Document {
+	response, ok := result.(*engine.CommandResponse)
+	if !ok || response == nil {
+		return nil
+	}
+	switch documents := response.Result.(type) {
+	case []*models.Document:
+		return documents
+	case map[string]*models.Document:
+		ordered := make([]*models.Document, 0, len(documents))
+		for _, doc := range documents {
+			ordered = append(ordered, doc)
+		}
+		sort.Slice(ordered, func(i, j int) bool {
+			if !ordered[i].CreatedAt.Equal(ordered[j].CreatedAt) {
+				return ordered[i].CreatedAt.Before(ordered[j].CreatedAt)
+			}
+			return ordered[i].DocumentID < ordered[j].DocumentID
+		})
+		return ordered
+	}
+	return nil
+}
+
+// mappedFields returns the fields of the document made from a selected one
+func mappedFields(source *models.Document, mapping []engine.FieldMapping) []engine.KeyValue {
+	if mapping == nil {
+		names := make([]string, 0, len(source.Fields))
+		for name := range source.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]engine.KeyValue, 0, len(names))
+		for _, name := range names {
+			fields = append(fields, engine.KeyValue{Key: name, Value: source.Fields[name].Value})
+		}
+		return fields
+	}
+
+	fields := make([]engine.KeyValue, 0, len(mapping))
+	for _, mapped := range mapping {
+		if value, ok := mapped.Value.Evaluate(source); ok {
+			fields = append(fields, engine.KeyValue{Key: mapped.Field, Value: value})
+		}
+	}
+	return fields
+}
@@ -0,0 +1,229 @@
+package directors
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syndrdb/src/protocol"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Document locks and deadlock detection.
+
+	A transaction queuing UPDATE DOCUMENTS or DELETE DOCUMENTS takes an exclusive lock on every
+	document the statement matches, as the transaction sees them, and keeps the locks until it
+	commits or rolls back. A document another transaction holds makes the statement wait.
+	Writes outside transactions do not take document locks; they wait for a committing
+	transaction through the bundle write locks instead, see bundle_write_locks.go.
+
+	Two transactions can each wait for a document the other holds. Every DeadlockCheckInterval
+	the detector builds the waits-for graph (an edge from each waiting transaction to the one
+	holding the document it wants) and breaks every cycle by failing the wait of the youngest
+	transaction in it, the one that began last, with a DeadlockError. The server then rolls
+	that transaction back, which lets the others go on.
+*/
+
+// documentLock identifies a locked document
+type documentLock struct {
+	bundle string
+	docID  string
+}
+
+// DeadlockError aborts the transaction chosen to break a deadlock
+type DeadlockError struct {
+	Victim     uint64   // The transaction rolled back
+	Cycle      []uint64 // The transactions that waited for each other, starting with the victim
+	Bundle     string   // The document the victim waited for
+	DocumentID string
+}
+
+func (e *DeadlockError) Error() string {
+	cycle := make([]string, 0, len(e.Cycle))
+	for _, txID := range e.Cycle {
+		cycle = append(cycle, fmt.Sprint(txID))
+	}
+	return fmt.Sprintf("deadlock: transaction %d was rolled back while waiting for document '%s' of bundle '%s' (waits-for cycle %s)",
+		e.Victim, e.DocumentID, e.Bundle, strings.Join(cycle, " -> "))
+}
+
+func (e *DeadlockError) ErrorCode() protocol.ErrorCode { return protocol.ErrDeadlock }
+
+// lockWait is a transaction waiting for a document
+type lockWait struct {
+	lock    documentLock
+	granted chan error // nil once the lock is the transaction's, a DeadlockError if it was chosen as victim
+}
+
+// lockManager hands out document locks to transactions
+type lockManager struct {
+	mu        sync.Mutex
+	holders   map[documentLock]uint64 // Document -> transaction holding it
+	held      map[uint64][]documentLock
+	waiting   map[uint64]*lockWait // Transaction -> what it waits for
+	deadlocks uint64
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		holders: make(map[documentLock]uint64),
+		held:    make(map[uint64][]documentLock),
+		waiting: make(map[uint64]*lockWait),
+	}
+}
+
+// acquire locks documents for a transaction, waiting for those other transactions hold. Locks
+// are taken in a fixed order; the ones taken before a deadlock error are kept until release.
+func (m *lockManager) acquire(txID uint64, locks []documentLock) error {
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].bundle < locks[j].bundle || (locks[i].bundle == locks[j].bundle && locks[i].docID < locks[j].docID)
+	})
+	for _, lock := range locks {
+		m.mu.Lock()
+		holder, locked := m.holders[lock]
+		if !locked {
+			m.holders[lock] = txID
+			m.held[txID] = append(m.held[txID], lock)
+		}
+		if !locked || holder == txID {
+			m.mu.Unlock()
+			continue
+		}
+		wait := &lockWait{lock: lock, granted: make(chan error, 1)}
+		m.waiting[txID] = wait
+		m.mu.Unlock()
+
+		if err := <-wait.granted; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release gives up every lock of a transaction, handing each to the oldest transaction waiting
+// for it
+func (m *lockManager) release(txID uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if wait, waiting := m.waiting[txID]; waiting {
+		delete(m.waiting, txID)
+		wait.granted <- fmt.Errorf("transaction %d ended while waiting for a lock", txID)
+	}
+	for _, lock := range m.held[txID] {
+		delete(m.holders, lock)
+		next := uint64(0)
+		for waiter, wait := range m.waiting {
+			if wait.lock == lock && (next == 0 || waiter < next) {
+				next = waiter
+			}
+		}
+		if next != 0 {
+			wait := m.waiting[next]
+			delete(m.waiting, next)
+			m.holders[lock] = next
+			m.held[next] = append(m.held[next], lock)
+			wait.granted <- nil
+		}
+	}
+	delete(m.held, txID)
+}
+
+// detect breaks every deadlock among waiting transactions, returning the victims' errors
+func (m *lockManager) detect() []*DeadlockError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var victims []*DeadlockError
+	done := make(map[uint64]bool) // Walked already, in a cycle or not
+	waiters := make([]uint64, 0, len(m.waiting))
+	for txID := range m.waiting {
+		waiters = append(waiters, txID)
+	}
+	sort.Slice(waiters, func(i, j int) bool { return waiters[i] < waiters[j] })
+
+	for _, start := range waiters {
+		// Each waiting transaction waits for exactly one other, so a walk finds at most one cycle
+		var path []uint64
+		onPath := make(map[uint64]int)
+		txID := start
+		for !done[txID] {
+			wait, waiting := m.waiting[txID]
+			if !waiting {
+				break
+			}
+			onPath[txID] = len(path)
+			path = append(path, txID)
+			done[txID] = true
+			txID = m.holders[wait.lock]
+			if at, seen := onPath[txID]; seen {
+				victims = append(victims, m.abort(path[at:]))
+				break
+			}
+		}
+	}
+	return victims
+}
+
+// abort fails the wait of the youngest transaction of a cycle. Called with mu held.
+func (m *lockManager) abort(cycle []uint64) *DeadlockError {
+	youngest := 0
+	for i, txID := range cycle {
+		if txID > cycle[youngest] {
+			youngest = i
+		}
+	}
+	victim := cycle[youngest]
+	wait := m.waiting[victim]
+	delete(m.waiting, victim)
+	m.deadlocks++
+
+	err := &DeadlockError{
+		Victim:     victim,
+		Cycle:      append(append([]uint64(nil), cycle[youngest:]...), cycle[:youngest]...),
+		Bundle:     wait.lock.bundle,
+		DocumentID: wait.lock.docID,
+	}
+	wait.granted <- err
+	return err
+}
+
+// run checks for deadlocks every interval, for as long as the server runs
+func (m *lockManager) run(interval time.Duration, logger *zap.SugaredLogger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, err := range m.detect() {
+			logger.Warnf("Broke a deadlock: %v", err)
+		}
+	}
+}
+
+// LockStats are the counters SHOW METRICS reports for document locks
+type LockStats struct {
+	LocksHeld    int
+	Waiting      int
+	Deadlocks    uint64 // Transactions rolled back to break a deadlock since the server started
+	Transactions int    // Transactions holding or waiting for locks
+}
+
+func (m *lockManager) stats() LockStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	transactions := make(map[uint64]bool, len(m.held)+len(m.waiting))
+	for txID := range m.held {
+		transactions[txID] = true
+	}
+	for txID := range m.waiting {
+		transactions[txID] = true
+	}
+	return LockStats{
+		LocksHeld:    len(m.holders),
+		Waiting:      len(m.waiting),
+		Deadlocks:    m.deadlocks,
+		Transactions: len(transactions),
+	}
+}
@@ -0,0 +1,204 @@
+package directors
+
+import (
+	"fmt"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"time"
+)
+
+/*
+	MERGE.
+
+	MERGE INTO "Target" USING "Source" [WHERE ...] ON ("Key" [= "SourceKey"]) reconciles one
+	bundle with another on the server, the way a nightly sync job would:
+
+	  WHEN MATCHED [THEN] UPDATE [SET (field = expression, ...)]
+	      updates the target document whose key equals the source document's: with every
+	      field of the source document, or with the fields SET computes from it
+	  WHEN NOT MATCHED [THEN] INSERT [MAP (field = expression, ...)]
+	      adds a source document no target document matches: a copy of its fields, or the
+	      fields MAP computes from it. The new document always gets the key, and with IDS an
+	      ID derived from the seed and the key, so a replica gives it the same ID.
+
+	Either clause may be left out, so a MERGE can only update or only insert. Expressions
+	are evaluated against the source document, and one with no value leaves its field alone.
+	Keys compare the way WHERE equality compares them, so 7 matches "7". Source documents
+	without the key are skipped, and two source documents with the same key fail the MERGE,
+	since either could win. When several target documents share a key they are all updated.
+	Matched documents the update would not change are left alone and counted as unchanged.
+
+	The whole MERGE is written the way a transaction's COMMIT writes (see transactions.go):
+	every document or, when one is refused, none. Inside a transaction it is one more write
+	of the transaction. Temporary bundles cannot take part.
+*/
+
+// MergeResult counts what a MERGE did with the source documents
+type MergeResult struct {
+	Inserted  int
+	Updated   int // Target documents updated
+	Unchanged int // Target documents matched that the update left as they were
+	Skipped   int // Source documents without the key
+}
+
+// Merge runs a MERGE outside any transaction
+func (s *BundleService) Merge(databaseService *DatabaseService, db *models.Database, command *engine.MergeCommand) (MergeResult, error) {
+	tx := s.BeginTransaction(db, engine.IsolationReadCommitted)
+	tx.statements = append(tx.statements, command)
+	w, _, err := s.commitTransaction(databaseService, tx)
+	if err != nil {
+		return MergeResult{}, err
+	}
+	return w.merged, nil
+}
+
+// source returns a bundle a statement of the transaction reads: its working copy when the
+// transaction writes it, else the bundle itself
+func (w *transactionWrites) source(name string) (*models.Bundle, error) {
+	if working, exists := w.bundles[w.service.resolveBundleName(w.db, name)]; exists {
+		return working, nil
+	}
+	bundle, err := w.service.GetBundleByName(w.db, name)
+	if err != nil {
+		return nil, fmt.Errorf("bundle '%s' not found", name)
+	}
+	return bundle, nil
+}
+
+// applyMerge runs a MERGE against the working copies
+func (w *transactionWrites) applyMerge(cmd *engine.MergeCommand) (int, error) {
+	target, err := w.writable(cmd.Target)
+	if err != nil {
+		return 0, err
+	}
+	source, err := w.source(cmd.Source)
+	if err != nil {
+		return 0, err
+	}
+	sources, err := engine.FilterDocuments(source, cmd.WhereClause, w.service.logger)
+	if err != nil {
+		return 0, fmt.Errorf("failed to filter documents: %w", err)
+	}
+
+	matches := make(map[string][]string)
+	for docID, doc := range target.Documents {
+		if field, exists := doc.Fields[cmd.TargetKey]; exists && field.Value != nil {
+			key := engine.ValueKey(field.Value)
+			matches[key] = append(matches[key], docID)
+		}
+	}
+
+	var result MergeResult
+	seen := make(map[string]bool, len(sources))
+	for _, sourceDoc := range sources {
+		field, exists := sourceDoc.Fields[cmd.SourceKey]
+		if !exists || field.Value == nil {
+			result.Skipped++
+			continue
+		}
+		key := engine.ValueKey(field.Value)
+		if seen[key] {
+			return 0, fmt.Errorf("more than one document of bundle '%s' has %s %v", source.Name, cmd.SourceKey, field.Value)
+		}
+		seen[key] = true
+
+		docIDs := matches[key]
+		if len(docIDs) == 0 {
+			if !cmd.NotMatchedInsert {
+				continue
+			}
+			fields := withKey(mappedFields(sourceDoc, cmd.Insert), cmd.TargetKey, field.Value)
+			add := engine.DocumentCommand{CommandType: "ADD", BundleName: target.Name, Fields: fields}
+			if cmd.IDSeed != "" {
+				add.DocumentID = helpers.DerivedUUID(cmd.IDSeed, key)
+			}
+			doc := w.service.documentFactory.NewDocument(add)
+			if err := w.service.checkDocumentLimits(target, doc); err != nil {
+				return 0, err
+			}
+			target.Documents[doc.DocumentID] = *doc
+			w.touched[target.Name][doc.DocumentID] = true
+			w.documents[target.Name]++
+			w.bytes[target.Name] += documentSize(doc)
+			w.changes[target.Name].record(target, doc, 1)
+			result.Inserted++
+			continue
+		}
+
+		if !cmd.MatchedUpdate {
+			continue
+		}
+		updates := mappedFields(sourceDoc, cmd.Update)
+		for _, docID := range docIDs {
+			before := target.Documents[docID]
+			if !changesDocument(&before, updates) {
+				result.Unchanged++
+				continue
+			}
+			doc := withUpdates(&before, updates)
+			if err := w.service.checkDocumentLimits(target, doc); err != nil {
+				return 0, err
+			}
+			doc.UpdatedAt = time.Now()
+			target.Documents[docID] = *doc
+			w.touched[target.Name][docID] = true
+			w.bytes[target.Name] += documentSize(doc) - documentSize(&before)
+			w.changes[target.Name].record(target, &before, -1)
+			w.changes[target.Name].record(target, doc, 1)
+			result.Updated++
+		}
+	}
+	engine.InvalidateIndexLookups(target)
+
+	w.merged.Inserted += result.Inserted
+	w.merged.Updated += result.Updated
+	w.merged.Unchanged += result.Unchanged
+	w.merged.Skipped += result.Skipped
+	return result.Inserted + result.Updated, nil
+}
+
+// withKey sets the key field of a document MERGE inserts
+func withKey(fields []engine.KeyValue, key string, value interface{}) []engine.KeyValue {
+	for i := range fields {
+		if fields[i].Key == key {
+			fields[i].Value = value
+			return fields
+		}
+	}
+	return append(fields, engine.KeyValue{Key: key, Value: value})
+}
+
+// changesDocument reports whether updates would change any field of a document
+func changesDocument(doc *models.Document, updates []engine.KeyValue) bool {
+	for _, kv := range updates {
+		field, exists := doc.Fields[kv.Key]
+		if !exists || engine.ValueKey(field.Value) != engine.ValueKey(kv.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// merge runs MERGE INTO <bundle> USING <bundle> ...
+func merge(database *models.Database, serviceManager ServiceManager, command *engine.MergeCommand) (interface{}, error) {
+	if database == nil {
+		return nil, fmt.Errorf("MERGE requires a database to be selected")
+	}
+	if serviceManager.TempBundles.Get(database, command.Source) != nil {
+		return nil, fmt.Errorf("MERGE is not available for temporary bundle '%s'", command.Source)
+	}
+	result, err := serviceManager.BundleService.Merge(serviceManager.DatabaseService, database, command)
+	if err != nil {
+		return nil, fmt.Errorf("error merging bundle '%s' into bundle '%s': %w", command.Source, command.Target, err)
+	}
+	return &engine.CommandResponse{
+		ResultCount: result.Inserted + result.Updated,
+		Result: map[string]interface{}{
+			"Inserted":  result.Inserted,
+			"Updated":   result.Updated,
+			"Unchanged": result.Unchanged,
+			"Skipped":   result.Skipped,
+		},
+	}, nil
+}
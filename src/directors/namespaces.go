@@ -0,0 +1,55 @@
+package directors
+
+import (
+	"fmt"
+	"sort"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+)
+
+// NamespaceInfo is a namespace of a database and the bundles in it, for SHOW NAMESPACES
+type NamespaceInfo struct {
+	Namespace string
+	Bundles   []string // Names within the namespace
+}
+
+// Namespaces lists the namespaces a database's bundles are in, by name
+func (s *BundleService) Namespaces(db *models.Database) []NamespaceInfo {
+	bundles := make(map[string][]string)
+	for _, fileName := range db.BundleFiles {
+		namespace, bundle := helpers.SplitBundleName(helpers.BundleNameFromFile(fileName))
+		if namespace != "" {
+			bundles[namespace] = append(bundles[namespace], bundle)
+		}
+	}
+	namespaces := make([]NamespaceInfo, 0, len(bundles))
+	for namespace, names := range bundles {
+		sort.Strings(names)
+		namespaces = append(namespaces, NamespaceInfo{Namespace: namespace, Bundles: names})
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Namespace < namespaces[j].Namespace })
+	return namespaces
+}
+
+// newBundleName checks the name of a bundle about to be created. A namespace that already
+// exists in another case is spelled the way it was created, so its bundles share a directory.
+func (s *BundleService) newBundleName(name string) (string, error) {
+	if !engine.IsValidBundleName(name) {
+		return "", fmt.Errorf("invalid bundle name: %s. Bundle names must start with a letter, can be alphanumeric, with underscores and hyphens, and may be qualified with a namespace named the same way, as namespace.bundle", name)
+	}
+	namespace, bundle := helpers.SplitBundleName(name)
+	if namespace == "" || s.identifiers.CaseSensitive {
+		return name, nil
+	}
+	existing, err := s.paths.Namespaces()
+	if err != nil {
+		return name, nil
+	}
+	for _, candidate := range existing {
+		if s.identifiers.Same(candidate, namespace) {
+			return helpers.QualifiedBundleName(candidate, bundle), nil
+		}
+	}
+	return name, nil
+}
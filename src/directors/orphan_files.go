@@ -0,0 +1,236 @@
+package directors
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"time"
+)
+
+/*
+	Orphaned files.
+
+	Dropping a bundle removes its bundle file but leaves its partition and index files behind,
+	and bundle files written by older code under the .bun extension are never read. A data file
+	is orphaned when no database lists it:
+	  - a .bnd file that is in no database's BundleFiles,
+	  - a .bun file (bundles are always listed as .bnd),
+	  - a <bundle>.p<n>.bnd partition file whose bundle is not listed or has fewer partitions,
+	  - a .idx or .hidx index file whose name does not start with a listed bundle's ID.
+	Database (.db) files and anything with another extension are never reported.
+*/
+
+// OrphanedFile is a data file no database refers to
+type OrphanedFile struct {
+	Name      string
+	Kind      string // "bundle", "legacy bundle", "partition", "btree index" or "hash index"
+	Size      int64
+	Modified  time.Time
+	Adoptable bool // Bundle files can be listed in a database again with ADOPT ORPHANED FILE
+}
+
+// FindOrphanedFiles lists the data files in the data directory that no database refers to.
+// It fails rather than guess when a listed bundle file cannot be read, since the partition
+// and index files that bundle owns could not be told apart from orphans.
+func (s *BundleService) FindOrphanedFiles(databaseService *DatabaseService) ([]OrphanedFile, error) {
+	listed := make(map[string]bool)    // Bundle file names listed by a database
+	partitions := make(map[string]int) // Bundle name -> partition count
+	bundleIDs := make([]string, 0)     // Index file name prefixes of listed bundles
+
+	for _, db := range databaseService.ListDatabases() {
+		for _, fileName := range db.BundleFiles {
+			if listed[fileName] {
+				continue
+			}
+			listed[fileName] = true
+
+			if _, err := os.Stat(s.paths.Path(fileName)); err != nil {
+				// A dangling reference; CHECK DATABASE REPAIR removes it
+				continue
+			}
+			bundle, err := s.listedBundle(db, fileName)
+			if err != nil {
+				return nil, fmt.Errorf("cannot tell which files '%s' in database '%s' owns: %w; run CHECK DATABASE \"%s\" first",
+					fileName, db.Name, err, db.Name)
+			}
+			if bundle.Partitioning != nil {
+				partitions[bundle.Name] = bundle.Partitioning.PartitionCount
+			}
+			bundleIDs = append(bundleIDs, helpers.IndexNamePrefix(bundle.BundleID))
+		}
+	}
+
+	entries, err := s.paths.ReadDataDir()
+	if err != nil {
+		return nil, fmt.Errorf("error reading data directory %s: %w", s.paths.DataDir(), err)
+	}
+
+	orphans := make([]OrphanedFile, 0)
+	for _, entry := range entries {
+		name := entry.Path
+		if listed[name] {
+			continue
+		}
+
+		var kind string
+		bundleName, partition, isPartition := helpers.ParsePartitionFileName(name)
+		switch {
+		case strings.HasSuffix(name, helpers.LegacyBundleFileExt):
+			kind = "legacy bundle"
+		case isPartition:
+			if count, exists := partitions[bundleName]; exists && partition < count {
+				continue
+			}
+			kind = "partition"
+		case strings.HasSuffix(name, helpers.BundleFileExt):
+			kind = "bundle"
+		case strings.HasSuffix(name, helpers.BTreeIndexFileExt), strings.HasSuffix(name, helpers.HashIndexFileExt):
+			if hasAnyPrefix(name, bundleIDs) {
+				continue
+			}
+			kind = "btree index"
+			if strings.HasSuffix(name, helpers.HashIndexFileExt) {
+				kind = "hash index"
+			}
+		default:
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		orphans = append(orphans, OrphanedFile{
+			Name:      name,
+			Kind:      kind,
+			Size:      info.Size(),
+			Modified:  info.ModTime(),
+			Adoptable: kind == "bundle" || kind == "legacy bundle",
+		})
+	}
+
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Name < orphans[j].Name })
+	return orphans, nil
+}
+
+// DeleteOrphanedFiles removes the named orphaned files, or all of them when no names are given.
+// Nothing is removed if any named file is not an orphan.
+func (s *BundleService) DeleteOrphanedFiles(databaseService *DatabaseService, fileNames []string) ([]string, error) {
+	orphans, err := s.FindOrphanedFiles(databaseService)
+	if err != nil {
+		return nil, err
+	}
+
+	toDelete := make([]string, 0, len(orphans))
+	if len(fileNames) == 0 {
+		for _, orphan := range orphans {
+			toDelete = append(toDelete, orphan.Name)
+		}
+	} else {
+		orphaned := make(map[string]bool, len(orphans))
+		for _, orphan := range orphans {
+			orphaned[orphan.Name] = true
+		}
+		for _, fileName := range fileNames {
+			if !orphaned[fileName] {
+				return nil, fmt.Errorf("'%s' is not an orphaned file", fileName)
+			}
+			toDelete = append(toDelete, fileName)
+		}
+	}
+
+	deleted := make([]string, 0, len(toDelete))
+	for _, fileName := range toDelete {
+		if err := os.Remove(s.paths.Path(fileName)); err != nil {
+			return deleted, fmt.Errorf("error removing orphaned file %s: %w", fileName, err)
+		}
+		if dir := filepath.Dir(fileName); dir != "." {
+			os.Remove(s.paths.Path(dir)) // The namespace directory too, once empty
+		}
+		deleted = append(deleted, fileName)
+		s.logger.Infof("Removed orphaned file %s", fileName)
+	}
+	return deleted, nil
+}
+
+// AdoptOrphanedFile lists an orphaned bundle file in a database again. A .bun file is renamed
+// to .bnd first. The file must decode and hold the bundle its name says.
+func (s *BundleService) AdoptOrphanedFile(databaseService *DatabaseService, db *models.Database, fileName string) (*models.Bundle, error) {
+	orphans, err := s.FindOrphanedFiles(databaseService)
+	if err != nil {
+		return nil, err
+	}
+	var orphan *OrphanedFile
+	for i := range orphans {
+		if orphans[i].Name == fileName {
+			orphan = &orphans[i]
+		}
+	}
+	if orphan == nil {
+		return nil, fmt.Errorf("'%s' is not an orphaned file", fileName)
+	}
+	if !orphan.Adoptable {
+		return nil, fmt.Errorf("'%s' is a %s file; only bundle files can be adopted", fileName, orphan.Kind)
+	}
+
+	bundleName := helpers.BundleNameFromFile(fileName)
+	bundle, err := s.store.LoadBundleDataFile(context.Background(), db, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot adopt '%s': %w", fileName, err)
+	}
+	if bundle.Name != bundleName {
+		return nil, fmt.Errorf("cannot adopt '%s': it holds bundle '%s'", fileName, bundle.Name)
+	}
+
+	// Renaming a .bun file and listing it in the database are one catalog change
+	tx := databaseService.BeginCatalogChange(fmt.Sprintf("adopt %s into %s", fileName, db.Name))
+	bundleFile := helpers.BundleFileName(bundleName)
+	if fileName != bundleFile {
+		if _, err := os.Stat(s.paths.Path(bundleFile)); err == nil {
+			return nil, fmt.Errorf("cannot adopt '%s': '%s' already exists", fileName, bundleFile)
+		}
+		tx.RenameFile(fileName, bundleFile)
+	}
+
+	if db.Bundles == nil {
+		db.Bundles = make(map[string]models.Bundle)
+	}
+	db.Bundles[bundle.Name] = *bundle
+	db.BundleFiles = append(db.BundleFiles, bundleFile)
+	err = databaseService.stageDatabaseFile(tx, db)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if catalogChangeFailed(err) {
+		delete(db.Bundles, bundle.Name)
+		db.BundleFiles = db.BundleFiles[:len(db.BundleFiles)-1]
+		return nil, fmt.Errorf("error adopting '%s': %w", fileName, err)
+	}
+
+	s.attach(bundle)
+	s.bundles[bundle.Name] = bundle
+	s.logger.Infof("Adopted orphaned file %s into database '%s'", fileName, db.Name)
+	return bundle, err
+}
+
+// listedBundle returns a listed bundle, from memory when it is loaded
+func (s *BundleService) listedBundle(db *models.Database, fileName string) (*models.Bundle, error) {
+	if bundle, exists := s.bundles[helpers.BundleNameFromFile(fileName)]; exists {
+		return bundle, nil
+	}
+	return s.store.LoadBundleDataFile(context.Background(), db, fileName)
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package directors
+
+import (
+	"fmt"
+	"sort"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+
+	"go.uber.org/zap"
+)
+
+// exportSchema runs EXPORT SCHEMA [BUNDLE <bundle>] [AS JSON|YAML], see engine/schema_files.go
+func exportSchema(database *models.Database, serviceManager ServiceManager, command *engine.ExportSchemaCommand) (interface{}, error) {
+	if database == nil {
+		return nil, fmt.Errorf("EXPORT SCHEMA requires a database to be selected")
+	}
+	var names []string
+	if command.BundleName != "" {
+		names = []string{command.BundleName}
+	} else {
+		for _, fileName := range database.BundleFiles {
+			names = append(names, helpers.BundleNameFromFile(fileName))
+		}
+		sort.Strings(names)
+	}
+
+	bundles := make([]*models.Bundle, 0, len(names))
+	for _, name := range names {
+		bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), database, name)
+		if err != nil {
+			if command.BundleName != "" {
+				return nil, fmt.Errorf("error retrieving bundle '%s': %w", command.BundleName, err)
+			}
+			continue
+		}
+		bundles = append(bundles, bundle)
+	}
+
+	schema := engine.ExportSchema(bundles)
+	if !command.YAML {
+		return &engine.CommandResponse{
+			ResultCount: len(schema.Bundles),
+			Result:      schema,
+		}, nil
+	}
+	text, err := engine.EncodeSchemaYAML(schema)
+	if err != nil {
+		return nil, fmt.Errorf("error writing the schema as YAML: %w", err)
+	}
+	return &engine.CommandResponse{
+		ResultCount: len(schema.Bundles),
+		Result:      text,
+	}, nil
+}
+
+// applySchema runs APPLY SCHEMA: it plans the statements that bring the database to the
+// schema and, unless PREVIEW is given, runs them in order, stopping at the first that fails
+func applySchema(database *models.Database, serviceManager ServiceManager, command *engine.ApplySchemaCommand, logger *zap.SugaredLogger) (interface{}, error) {
+	if database == nil {
+		return nil, fmt.Errorf("APPLY SCHEMA requires a database to be selected")
+	}
+	schema, err := engine.DecodeSchema(command.Schema)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := engine.PlanSchema(schema, func(name string) *models.Bundle {
+		bundle, err := serviceManager.BundleService.GetBundleByNameContext(serviceManager.Context(), database, name)
+		if err != nil {
+			return nil
+		}
+		return bundle
+	}, serviceManager.BundleService.Identifiers(), database.Defaults, command.Prune)
+	if err != nil {
+		return nil, fmt.Errorf("schema cannot be applied: %w", err)
+	}
+
+	plan.Preview = command.Preview
+	if !command.Preview {
+		for _, step := range plan.Steps {
+			if _, err := executeStatement(database, serviceManager, step.Command, logger); err != nil {
+				return nil, fmt.Errorf("schema partly applied, %d of %d step(s) ran before %s failed: %w", plan.Applied, len(plan.Steps), step.Statement, err)
+			}
+			plan.Applied++
+		}
+		if plan.Applied > 0 {
+			logger.Infof("APPLY SCHEMA ran %d step(s) on database %s", plan.Applied, database.Name)
+		}
+	}
+	return &engine.CommandResponse{
+		ResultCount: len(plan.Steps),
+		Result:      plan,
+	}, nil
+}
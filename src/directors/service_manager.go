@@ -1,7 +1,10 @@
 package directors
 
 import (
+	"context"
 	"sync"
+	"syndrdb/src/cluster"
+	"syndrdb/src/engine"
 
 	"go.uber.org/zap"
 )
@@ -10,17 +13,55 @@ type ServiceManager struct {
 	// Add fields for managing services
 	DatabaseService *DatabaseService
 	BundleService   *BundleService
+	Statements      *engine.StatementCache // nil parses every command
+	QueryRouter     *cluster.QueryRouter   // Only set in cluster mode
+	TempBundles     *TempBundles           // The client connection's, set on its copy; see temp_bundles.go
+	User            string                 // The client connection's user, set on its copy
+	Ctx             context.Context        // The running command's, set on its copy; canceled when its client disconnects
 	logger          *zap.SugaredLogger
 }
 
+// Context returns the running command's context, which stops long reads and index builds when
+// it is canceled, or context.Background when none was set
+func (sm ServiceManager) Context() context.Context {
+	if sm.Ctx == nil {
+		return context.Background()
+	}
+	return sm.Ctx
+}
+
+// parse parses a command through the server's statement cache
+func (sm ServiceManager) parse(command string) (engine.Statement, error) {
+	return sm.Statements.Parse(command)
+}
+
+// NewServiceManager returns the services of one server. Each server carries its own and
+// passes it down to the directors, so servers in one process do not share their catalogs.
+func NewServiceManager(dbService *DatabaseService, bundleService *BundleService, logger *zap.SugaredLogger) *ServiceManager {
+	return &ServiceManager{
+		DatabaseService: dbService,
+		BundleService:   bundleService,
+		logger:          logger,
+	}
+}
+
+/*
+	Compatibility shim.
+
+	The directors used to find their services through a process-wide singleton. Code outside
+	the server that still calls GetServiceManager gets the services of the first server
+	started, which registers them with SetServiceManager. The shim goes once nothing calls it.
+*/
+
 // Private instance and mutex for thread safety
 var (
 	instance *ServiceManager
-	once     sync.Once
 	mu       sync.RWMutex
 )
 
-// GetServiceManager returns the singleton instance of ServiceManager
+// GetServiceManager returns the services of the first server started.
+//
+// Deprecated: use the ServiceManager the server carries, see server.Server.Services.
 func GetServiceManager() *ServiceManager {
 	mu.RLock()
 	defer mu.RUnlock()
@@ -33,25 +74,40 @@ func GetServiceManager() *ServiceManager {
 	return instance
 }
 
-// InitServiceManager initializes the ServiceManager singleton with services
-func InitServiceManager(dbService *DatabaseService, bundleService *BundleService, logger *zap.SugaredLogger) *ServiceManager {
-	// Use sync.Once to ensure this only happens one time
-	once.Do(func() {
-		mu.Lock()
-		defer mu.Unlock()
-
-		instance = &ServiceManager{
-			DatabaseService: dbService,
-			BundleService:   bundleService,
-			logger:          logger,
+// SetServiceManager makes services what GetServiceManager returns, unless a server's
+// services were set already
+//
+// Deprecated: only for GetServiceManager.
+func SetServiceManager(services *ServiceManager) {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance == nil {
+		instance = services
+		if services.logger != nil {
+			services.logger.Info("ServiceManager singleton initialized")
 		}
+	}
+}
 
-		if logger != nil {
-			logger.Info("ServiceManager singleton initialized")
-		}
-	})
+// InitServiceManager makes a ServiceManager of the services given and sets it, as
+// NewServiceManager and SetServiceManager do
+//
+// Deprecated: use NewServiceManager.
+func InitServiceManager(dbService *DatabaseService, bundleService *BundleService, logger *zap.SugaredLogger) *ServiceManager {
+	SetServiceManager(NewServiceManager(dbService, bundleService, logger))
+	return GetServiceManager()
+}
 
-	return instance
+// SetQueryRouter enables routing of SELECTs on partitioned bundles to other cluster nodes, on
+// the services GetServiceManager returns
+//
+// Deprecated: set the QueryRouter of the server's ServiceManager.
+func SetQueryRouter(router *cluster.QueryRouter) {
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		instance.QueryRouter = router
+	}
 }
 
 // ResetServiceManager is useful for testing - it resets the singleton
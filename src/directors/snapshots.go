@@ -0,0 +1,181 @@
+package directors
+
+import (
+	"sync"
+	"syndrdb/src/models"
+	"time"
+)
+
+/*
+	Document versions for snapshot transactions.
+
+	Every in-memory document write is a new version of the server's data. While a transaction
+	with SNAPSHOT isolation is open, each write first hands the versionStore the current
+	contents of the documents it is about to change (nothing for a document it creates). A
+	snapshot read of a bundle takes the bundle's documents as they are now and puts back,
+	newest first, every document written after the transaction's version, so it sees the
+	bundle as it was at BEGIN. Versions no open snapshot needs are dropped, and with no
+	snapshot open nothing is kept at all, unless -versionretention keeps every version for a
+	while for AS OF queries; see time_travel.go.
+
+	The same records tell COMMIT whether a document the transaction writes was changed by
+	someone else after it began; see CommitTransaction.
+*/
+
+// documentVersion is the contents a document had before the write that made a version
+type documentVersion struct {
+	version uint64
+	at      time.Time // When the write that made the version happened
+	bundle  string
+	docID   string
+	before  *models.Document // nil when the write created the document
+}
+
+// versionStore keeps the document versions open snapshots still need
+type versionStore struct {
+	mu        sync.Mutex
+	version   uint64            // Of the last write
+	undo      []documentVersion // Oldest first
+	snapshots map[uint64]uint64 // Transaction ID -> version its reads see
+
+	retention time.Duration // How long every version is kept for AS OF; 0 keeps none past the snapshots
+	since     time.Time     // When the versions kept for AS OF start
+}
+
+func newVersionStore(retention time.Duration) *versionStore {
+	return &versionStore{snapshots: make(map[uint64]uint64), retention: retention, since: time.Now()}
+}
+
+// begin opens a snapshot of the data as of the last write
+func (v *versionStore) begin(txID uint64) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.snapshots[txID] = v.version
+	return v.version
+}
+
+// end closes a snapshot, dropping the versions only it needed
+func (v *versionStore) end(txID uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, open := v.snapshots[txID]; !open {
+		return
+	}
+	delete(v.snapshots, txID)
+	v.prune()
+}
+
+// prune drops the versions neither an open snapshot nor the retention window needs
+func (v *versionStore) prune() {
+	oldest := v.version
+	for _, version := range v.snapshots {
+		if version < oldest {
+			oldest = version
+		}
+	}
+	cutoff := time.Now().Add(-v.retention)
+	dropped := 0
+	for dropped < len(v.undo) && v.undo[dropped].version <= oldest && (v.retention <= 0 || v.undo[dropped].at.Before(cutoff)) {
+		dropped++
+	}
+	if dropped == len(v.undo) {
+		v.undo = nil
+		return
+	}
+	clear(v.undo[:dropped])
+	v.undo = v.undo[dropped:]
+}
+
+// write makes a new version out of changes to documents of bundles, given by ID. It saves their
+// current contents for open snapshots and then runs apply, if any, before another snapshot can
+// begin, so a change made by apply is seen whole or not at all.
+func (v *versionStore) write(changes map[*models.Bundle][]string, apply func()) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.version++
+	if len(v.snapshots) > 0 || v.retention > 0 {
+		now := time.Now()
+		for bundle, docIDs := range changes {
+			for _, docID := range docIDs {
+				record := documentVersion{version: v.version, at: now, bundle: bundle.Name, docID: docID}
+				if doc, exists := bundle.Documents[docID]; exists {
+					record.before = copyDocument(doc)
+				}
+				v.undo = append(v.undo, record)
+			}
+		}
+		if v.retention > 0 {
+			v.prune()
+		}
+	}
+	if apply != nil {
+		apply()
+	}
+}
+
+// writeDocuments makes a new version out of changes to documents of one bundle
+func (v *versionStore) writeDocuments(bundle *models.Bundle, docIDs ...string) {
+	if bundle.Temporary {
+		// Versions are kept by bundle name, which a temporary bundle may share
+		return
+	}
+	v.write(map[*models.Bundle][]string{bundle: docIDs}, nil)
+}
+
+// snapshotOf returns a bundle as a snapshot taken at a version sees it; the bundle itself when
+// no document of it was written since
+func (v *versionStore) snapshotOf(bundle *models.Bundle, version uint64) *models.Bundle {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.viewAt(bundle, version)
+}
+
+// viewAt is snapshotOf for callers holding the lock
+func (v *versionStore) viewAt(bundle *models.Bundle, version uint64) *models.Bundle {
+	var newer []documentVersion
+	for _, record := range v.undo {
+		if record.version > version && record.bundle == bundle.Name {
+			newer = append(newer, record)
+		}
+	}
+	if len(newer) == 0 {
+		return bundle
+	}
+
+	view := *bundle
+	view.Documents = make(map[string]models.Document, len(bundle.Documents))
+	for docID, doc := range bundle.Documents {
+		view.Documents[docID] = doc
+	}
+	for i := len(newer) - 1; i >= 0; i-- {
+		if newer[i].before == nil {
+			delete(view.Documents, newer[i].docID)
+		} else {
+			view.Documents[newer[i].docID] = *newer[i].before
+		}
+	}
+	return &view
+}
+
+// changedSince returns a document of the given ones, by bundle, that was written after a version
+func (v *versionStore) changedSince(documents map[string]map[string]bool, version uint64) (bundle, docID string, changed bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, record := range v.undo {
+		if record.version > version && documents[record.bundle][record.docID] {
+			return record.bundle, record.docID, true
+		}
+	}
+	return "", "", false
+}
+
+// copyDocument copies a document with its own fields map
+func copyDocument(doc models.Document) *models.Document {
+	fields := make(map[string]models.Field, len(doc.Fields))
+	for name, field := range doc.Fields {
+		fields[name] = field
+	}
+	doc.Fields = fields
+	return &doc
+}
@@ -0,0 +1,68 @@
+package directors
+
+import (
+	"sort"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	Suspect bundles.
+
+	A command that panicked part way through may have left its bundle half changed, in memory,
+	on disk, or both. The server then marks the bundle suspect: its cached copy is dropped, so
+	the next command reloads it from its file, and writes to it are refused until CHECK
+	DATABASE finds its files sound again. Reads carry on. SHOW METRICS lists suspect bundles.
+	The marks are kept in memory only; a restart reloads every bundle from disk anyway.
+*/
+
+// SuspectBundle is a bundle whose last write was interrupted by a panic
+type SuspectBundle struct {
+	Bundle   string
+	Reason   string
+	MarkedAt time.Time
+}
+
+// MarkSuspect refuses writes to a bundle until a consistency check clears it
+func (s *BundleService) MarkSuspect(bundleName, reason string) {
+	s.suspectMu.Lock()
+	s.suspect[s.identifiers.Key(bundleName)] = SuspectBundle{Bundle: bundleName, Reason: reason, MarkedAt: time.Now()}
+	s.suspectMu.Unlock()
+
+	delete(s.bundles, s.resolveBundleName(nil, bundleName))
+	s.logger.Warnw("Bundle marked suspect; writes are refused until CHECK DATABASE passes", "bundle", bundleName, "reason", reason)
+}
+
+// SuspectBundles lists the bundles marked suspect, by name
+func (s *BundleService) SuspectBundles() []SuspectBundle {
+	s.suspectMu.Lock()
+	defer s.suspectMu.Unlock()
+	suspects := make([]SuspectBundle, 0, len(s.suspect))
+	for _, suspect := range s.suspect {
+		suspects = append(suspects, suspect)
+	}
+	sort.Slice(suspects, func(i, j int) bool { return suspects[i].Bundle < suspects[j].Bundle })
+	return suspects
+}
+
+// checkNotSuspect refuses writes to a suspect bundle
+func (s *BundleService) checkNotSuspect(bundleName string) error {
+	s.suspectMu.Lock()
+	defer s.suspectMu.Unlock()
+	if suspect, marked := s.suspect[s.identifiers.Key(bundleName)]; marked {
+		return protocol.Errorf(protocol.ErrBundleSuspect, "bundle '%s' is suspect since %s (%s); run CHECK DATABASE before writing to it again",
+			bundleName, suspect.MarkedAt.Format(time.RFC3339), suspect.Reason)
+	}
+	return nil
+}
+
+// clearSuspect lifts the mark once a consistency check found the bundle sound
+func (s *BundleService) clearSuspect(bundleName string) {
+	s.suspectMu.Lock()
+	_, marked := s.suspect[s.identifiers.Key(bundleName)]
+	delete(s.suspect, s.identifiers.Key(bundleName))
+	s.suspectMu.Unlock()
+	if marked {
+		s.logger.Infow("Suspect bundle passed its consistency check; writes are allowed again", "bundle", bundleName)
+	}
+}
@@ -0,0 +1,156 @@
+package directors
+
+import (
+	"fmt"
+	"sync"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+)
+
+/*
+	Temporary bundles.
+
+	CREATE TEMP BUNDLE "scratch" WITH FIELDS (...) makes a bundle only the connection that
+	created it sees, for the intermediate steps of a transformation. It lives in memory: it is
+	not listed in the database, written to the data directory, replicated, published to change
+	data capture, versioned for AS OF or counted in SHOW BUNDLE STATS. It is dropped when the
+	connection closes, or earlier with DELETE BUNDLE. While it exists its name hides a bundle of
+	the database with the same name from that connection.
+
+	SELECT DOCUMENTS, SELECT DISTINCT, approximate aggregates and EXPLAIN read it, and ADD
+	DOCUMENT, ADD DOCUMENTS, UPDATE DOCUMENTS and DELETE DOCUMENTS write it. Other statements,
+	such as CREATE INDEX, ANALYZE BUNDLE or SNAPSHOT BUNDLE, refuse it. Statements inside a
+	transaction only see the bundles of the database, and a resumed session starts without the
+	temporary bundles of the connection it replaces.
+*/
+
+// TempBundles are the temporary bundles of one connection
+type TempBundles struct {
+	mu          sync.Mutex
+	bundles     map[string]*models.Bundle // By key
+	identifiers helpers.Identifiers
+}
+
+// NewTempBundles holds the temporary bundles of a connection, their names compared by identifiers
+func NewTempBundles(identifiers helpers.Identifiers) *TempBundles {
+	return &TempBundles{bundles: make(map[string]*models.Bundle), identifiers: identifiers}
+}
+
+// key keys a temporary bundle by its database and its name as -identifiercase compares it
+func (t *TempBundles) key(database *models.Database, name string) string {
+	return t.identifiers.Key(database.Name) + "/" + t.identifiers.Key(name)
+}
+
+// Get returns the connection's temporary bundle of that name in the database, or nil
+func (t *TempBundles) Get(database *models.Database, name string) *models.Bundle {
+	if t == nil || database == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bundles[t.key(database, name)]
+}
+
+// Len returns how many temporary bundles the connection has
+func (t *TempBundles) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.bundles)
+}
+
+func (t *TempBundles) add(bundle *models.Bundle) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := t.key(bundle.Database, bundle.Name)
+	if existing := t.bundles[key]; existing != nil {
+		return protocol.Errorf(protocol.ErrAlreadyExists, "temporary bundle '%s' already exists", existing.Name)
+	}
+	t.bundles[key] = bundle
+	return nil
+}
+
+func (t *TempBundles) remove(bundle *models.Bundle) {
+	t.mu.Lock()
+	delete(t.bundles, t.key(bundle.Database, bundle.Name))
+	t.mu.Unlock()
+	forgetTempBundle(bundle)
+}
+
+// Drop drops every temporary bundle of the connection, when it closes
+func (t *TempBundles) Drop() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	bundles := t.bundles
+	t.bundles = make(map[string]*models.Bundle)
+	t.mu.Unlock()
+	for _, bundle := range bundles {
+		forgetTempBundle(bundle)
+	}
+	return len(bundles)
+}
+
+// forgetTempBundle drops what queries cached about a temporary bundle
+func forgetTempBundle(bundle *models.Bundle) {
+	engine.InvalidateIndexLookups(bundle)
+	engine.ForgetQueryShapes(bundle)
+	engine.InvalidatePlans(bundle)
+}
+
+// bundleByName returns the bundle a statement names: the connection's temporary bundle of
+// that name, else the database's
+func (sm ServiceManager) bundleByName(database *models.Database, name string) (*models.Bundle, error) {
+	if bundle := sm.TempBundles.Get(database, name); bundle != nil {
+		return bundle, nil
+	}
+	return sm.BundleService.GetBundleByNameContext(sm.Context(), database, name)
+}
+
+// checkTempBundleStatement refuses a statement that names a temporary bundle it cannot run on
+func checkTempBundleStatement(database *models.Database, serviceManager ServiceManager, statement engine.Statement) error {
+	name := engine.StatementBundle(statement)
+	if name == "" || serviceManager.TempBundles.Get(database, name) == nil {
+		return nil
+	}
+	switch cmd := statement.(type) {
+	case *engine.SelectDocumentsCommand:
+		if cmd.AsOf == nil {
+			return nil
+		}
+	case *engine.SelectDistinctCommand, *engine.SelectApproximateCommand, *engine.ExplainCommand,
+		*engine.DocumentCommand, *engine.InsertSelectCommand, *engine.DocumentUpdateCommand, *engine.DocumentDeleteCommand:
+		return nil
+	case *engine.BundleCommand:
+		if cmd.CommandType != "UPDATE" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not available for temporary bundle '%s'", engine.StatementName(statement), name)
+}
+
+// createTempBundle runs CREATE TEMP BUNDLE
+func createTempBundle(database *models.Database, serviceManager ServiceManager, command *engine.BundleCommand) (interface{}, error) {
+	if serviceManager.TempBundles == nil {
+		return nil, fmt.Errorf("temporary bundles belong to a client connection")
+	}
+	if database == nil {
+		return nil, fmt.Errorf("CREATE TEMP BUNDLE requires a database to be selected")
+	}
+	bundle, err := serviceManager.BundleService.NewTempBundle(database, *command)
+	if err != nil {
+		return nil, fmt.Errorf("error creating bundle: %w", err)
+	}
+	if err := serviceManager.TempBundles.add(bundle); err != nil {
+		return nil, err
+	}
+	return &engine.CommandResponse{
+		ResultCount: 1,
+		Result:      fmt.Sprintf("Temporary bundle '%s' created; it is dropped when this connection closes.", bundle.Name),
+	}, nil
+}
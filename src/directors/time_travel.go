@@ -0,0 +1,110 @@
+package directors
+
+import (
+	"fmt"
+	"syndrdb/src/models"
+	"time"
+)
+
+/*
+	Time travel.
+
+	With -versionretention set, the versionStore (snapshots.go) keeps the contents every
+	document had before each write for that long, whether or not a snapshot is open. SELECT
+	DOCUMENTS FROM "X" AS OF '<RFC 3339 time>' then reads a bundle as it was at that time, by
+	putting back the documents written since, and SHOW DOCUMENT HISTORY lists the writes to a
+	document within the window. History covers document writes since the server started, so
+	the window begins at the later of the start and the retention period ago. Versions are kept
+	in memory only and are not shared with other nodes; a bundle's schema, indexes and
+	existence are always current.
+*/
+
+// DocumentVersion is one write to a document, for SHOW DOCUMENT HISTORY
+type DocumentVersion struct {
+	WrittenAt time.Time
+	Change    string           // created, updated or deleted
+	Document  *models.Document // Contents after the write; nil when it deleted the document
+}
+
+// horizon is the earliest time history is complete from
+func (v *versionStore) horizon() time.Time {
+	if cutoff := time.Now().Add(-v.retention); cutoff.After(v.since) {
+		return cutoff
+	}
+	return v.since
+}
+
+// asOf returns a bundle as it was at a time within the retention window
+func (v *versionStore) asOf(bundle *models.Bundle, at time.Time) (*models.Bundle, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.retention <= 0 {
+		return nil, fmt.Errorf("AS OF needs document versions; start the server with -versionretention")
+	}
+	if horizon := v.horizon(); at.Before(horizon) {
+		return nil, fmt.Errorf("AS OF %s is before the oldest version kept, %s", at.Format(time.RFC3339), horizon.Format(time.RFC3339))
+	}
+	version := v.version
+	for _, record := range v.undo {
+		if record.at.After(at) {
+			version = record.version - 1
+			break
+		}
+	}
+	return v.viewAt(bundle, version), nil
+}
+
+// history returns the versions kept of one document, oldest first
+func (v *versionStore) history(bundleName, docID string) ([]documentVersion, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.retention <= 0 {
+		return nil, fmt.Errorf("document history needs document versions; start the server with -versionretention")
+	}
+	var records []documentVersion
+	for _, record := range v.undo {
+		if record.bundle == bundleName && record.docID == docID {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// AsOf returns a bundle as it was at a time, for SELECT DOCUMENTS ... AS OF
+func (s *BundleService) AsOf(bundle *models.Bundle, at time.Time) (*models.Bundle, error) {
+	return s.versions.asOf(bundle, at)
+}
+
+// DocumentHistory lists the writes to a document within the retention window, newest first
+func (s *BundleService) DocumentHistory(bundle *models.Bundle, docID string) ([]DocumentVersion, error) {
+	records, err := s.versions.history(bundle.Name, docID)
+	if err != nil {
+		return nil, err
+	}
+
+	var current *models.Document
+	if doc, exists := bundle.Documents[docID]; exists {
+		current = copyDocument(doc)
+	}
+	if len(records) == 0 && current == nil {
+		return nil, fmt.Errorf("bundle '%s' has no document '%s' and none was written since %s",
+			bundle.Name, docID, s.versions.horizon().Format(time.RFC3339))
+	}
+
+	// Each record holds the contents before its write; the next one, or the document as it is
+	// now, holds the contents after
+	versions := make([]DocumentVersion, 0, len(records))
+	after := current
+	for i := len(records) - 1; i >= 0; i-- {
+		version := DocumentVersion{WrittenAt: records[i].at, Change: "updated", Document: after}
+		switch {
+		case records[i].before == nil:
+			version.Change = "created"
+		case after == nil:
+			version.Change = "deleted"
+		}
+		versions = append(versions, version)
+		after = records[i].before
+	}
+	return versions, nil
+}
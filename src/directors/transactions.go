@@ -0,0 +1,481 @@
+package directors
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"syndrdb/src/engine"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	Transactions.
+
+	BEGIN [TRANSACTION] starts collecting the document writes (ADD DOCUMENT, UPDATE DOCUMENTS,
+	DELETE DOCUMENTS, MERGE) a connection sends until COMMIT or ROLLBACK. They may touch any number of
+	bundles of the connection's database; nothing is written before COMMIT, which runs in two
+	phases:
+
+	  prepare  the writes are applied in order to private copies of the bundles they touch and
+	           of the aggregates of those bundles. The first write that fails aborts the
+	           transaction and nothing changes.
+	  commit   the files of every touched bundle are written as one catalog change (see
+	           engine/catalog_wal.go), so after a crash either all of them reflect the
+	           transaction or none do. The documents it wrote are then copied into the bundles.
+
+	Transactions commit one at a time. A commit holds the write locks of the bundles it writes
+	(see bundle_write_locks.go) through both phases, so writes outside any transaction to
+	those bundles wait for it rather than land in between and be lost. The server discards a
+	connection's open transaction when the connection ends.
+
+	Isolation levels (BEGIN TRANSACTION ISOLATION LEVEL ...):
+
+	  SNAPSHOT        the default. Reads see the database as it was at BEGIN (see
+	                  snapshots.go). COMMIT fails, writing nothing, when a document the
+	                  transaction updates or deletes was written by anyone else since BEGIN.
+	  READ COMMITTED  every read sees what is committed when it runs, and COMMIT applies the
+	                  writes to whatever is committed then.
+
+	Neither level shows a transaction its own queued writes.
+*/
+
+var lastTransactionID uint64
+
+// Transaction is the document writes a connection has collected since BEGIN
+type Transaction struct {
+	ID        uint64
+	Database  *models.Database
+	Isolation string // engine.IsolationSnapshot or engine.IsolationReadCommitted
+	StartedAt time.Time
+
+	snapshot   uint64 // Version SNAPSHOT reads see
+	statements []engine.Statement
+	commands   []string // The statements as sent, for replication after COMMIT
+}
+
+// BeginTransaction starts a transaction in a database
+func (s *BundleService) BeginTransaction(db *models.Database, isolation string) *Transaction {
+	tx := &Transaction{
+		ID:        atomic.AddUint64(&lastTransactionID, 1),
+		Database:  db,
+		Isolation: isolation,
+		StartedAt: time.Now(),
+	}
+	if isolation == engine.IsolationSnapshot {
+		tx.snapshot = s.versions.begin(tx.ID)
+	}
+	return tx
+}
+
+// EndTransaction lets go of a transaction that is rolled back; COMMIT ends it by itself
+func (s *BundleService) EndTransaction(tx *Transaction) {
+	s.locks.release(tx.ID)
+	s.versions.end(tx.ID)
+}
+
+// LockStats reports the document locks of transactions
+func (s *BundleService) LockStats() LockStats {
+	return s.locks.stats()
+}
+
+// TransactionView returns a bundle as the reads of a transaction see it
+func (s *BundleService) TransactionView(tx *Transaction, bundle *models.Bundle) *models.Bundle {
+	if tx.Isolation != engine.IsolationSnapshot {
+		return bundle
+	}
+	return s.versions.snapshotOf(bundle, tx.snapshot)
+}
+
+// Commands returns the statements of the transaction as they were sent
+func (t *Transaction) Commands() []string {
+	return t.commands
+}
+
+// Len returns the number of statements collected
+func (t *Transaction) Len() int {
+	return len(t.statements)
+}
+
+// AddToTransaction collects a document write for the next COMMIT, refusing statements that are
+// not document writes and writes to bundles that cannot take them
+func (s *BundleService) AddToTransaction(tx *Transaction, statement engine.Statement, command string) error {
+	var bundleName, whereClause string
+	switch cmd := statement.(type) {
+	case *engine.DocumentCommand:
+		bundleName = cmd.BundleName
+	case *engine.DocumentUpdateCommand:
+		bundleName, whereClause = cmd.BundleName, cmd.WhereClause
+	case *engine.DocumentDeleteCommand:
+		bundleName, whereClause = cmd.BundleName, cmd.WhereClause
+	case *engine.MergeCommand:
+		bundleName = cmd.Target
+	default:
+		return fmt.Errorf("%s cannot run inside a transaction; only document writes can, COMMIT or ROLLBACK first",
+			engine.StatementName(statement))
+	}
+
+	bundle, err := s.GetBundleByName(tx.Database, bundleName)
+	if err != nil {
+		return protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", bundleName)
+	}
+	if err := checkWritable(bundle); err != nil {
+		return err
+	}
+	if err := s.checkNotSuspect(bundle.Name); err != nil {
+		return err
+	}
+
+	// Updates and deletes lock the documents they match, see locks.go
+	if whereClause != "" {
+		view := s.TransactionView(tx, bundle)
+		docs, err := engine.FilterDocuments(view, whereClause, s.logger)
+		if view != bundle {
+			engine.InvalidateIndexLookups(view)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to filter documents: %w", err)
+		}
+		locks := make([]documentLock, 0, len(docs))
+		for _, doc := range docs {
+			locks = append(locks, documentLock{bundle: bundle.Name, docID: doc.DocumentID})
+		}
+		if err := s.locks.acquire(tx.ID, locks); err != nil {
+			return err
+		}
+	}
+
+	tx.statements = append(tx.statements, statement)
+	tx.commands = append(tx.commands, command)
+	return nil
+}
+
+// transactionWrites is the prepare phase's private copy of the bundles a transaction touches
+type transactionWrites struct {
+	service   *BundleService
+	db        *models.Database
+	locked    map[string]bool            // Bundles whose write locks the commit holds
+	bundles   map[string]*models.Bundle  // Bundle name -> working copy
+	documents map[string]int             // Change in document count, by bundle
+	touched   map[string]map[string]bool // IDs of the documents written, by bundle
+	bytes     map[string]int64           // Change in size, by bundle
+	changes   map[string]aggregateChanges
+	merged    MergeResult                            // What the MERGEs of the transaction did, see merge.go
+	erasure   *ErasureReport                         // What an ERASE SUBJECT did, see erasure.go
+	erased    map[string]map[string]*models.Document // Documents erased, by bundle: nil when deleted, else shredded
+}
+
+// bundle returns the working copy of a bundle, copying it on first use
+func (w *transactionWrites) bundle(name string) (*models.Bundle, error) {
+	name = w.service.resolveBundleName(w.db, name)
+	if working, exists := w.bundles[name]; exists {
+		return working, nil
+	}
+	if !w.locked[name] {
+		return nil, &unlockedBundleError{name: name}
+	}
+	bundle, err := w.service.GetBundleByName(w.db, name)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", name)
+	}
+	working := copyBundle(bundle)
+	w.bundles[name] = working
+	w.touched[name] = make(map[string]bool)
+	return working, nil
+}
+
+// copyBundle copies a bundle and its documents deeply enough that writes to the copy leave the
+// original alone
+func copyBundle(bundle *models.Bundle) *models.Bundle {
+	working := *bundle
+	working.Documents = make(map[string]models.Document, len(bundle.Documents))
+	for docID, doc := range bundle.Documents {
+		working.Documents[docID] = *copyDocument(doc)
+	}
+	return &working
+}
+
+// CommitTransaction writes every statement of a transaction or none of them, returning the
+// number of documents written
+func (s *BundleService) CommitTransaction(databaseService *DatabaseService, tx *Transaction) (int, error) {
+	_, written, err := s.commitTransaction(databaseService, tx)
+	return written, err
+}
+
+func (s *BundleService) commitTransaction(databaseService *DatabaseService, tx *Transaction) (*transactionWrites, int, error) {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+	defer s.EndTransaction(tx)
+
+	names := s.transactionBundles(tx)
+	for {
+		unlock := s.writeLocks.lock(names...)
+		w, written, err := s.commitLocked(databaseService, tx, names)
+		unlock()
+		if missing := unlockedBundle(err); missing != "" {
+			names = append(names, s.withAggregates(tx.Database, missing)...)
+			continue
+		}
+		return w, written, err
+	}
+}
+
+// commitLocked prepares and commits a transaction holding the write locks of the named bundles
+func (s *BundleService) commitLocked(databaseService *DatabaseService, tx *Transaction, names []string) (*transactionWrites, int, error) {
+	w := &transactionWrites{
+		service:   s,
+		db:        tx.Database,
+		locked:    make(map[string]bool, len(names)),
+		bundles:   make(map[string]*models.Bundle),
+		documents: make(map[string]int),
+		touched:   make(map[string]map[string]bool),
+		bytes:     make(map[string]int64),
+		changes:   make(map[string]aggregateChanges),
+		erased:    make(map[string]map[string]*models.Document),
+	}
+	for _, name := range names {
+		w.locked[name] = true
+	}
+	// Postings built while filtering the copies are not wanted afterwards
+	defer func() {
+		for _, working := range w.bundles {
+			engine.InvalidateIndexLookups(working)
+		}
+	}()
+
+	// Prepare
+	written := 0
+	for i, statement := range tx.statements {
+		n, err := w.apply(statement)
+		if err != nil {
+			return nil, 0, fmt.Errorf("statement %d of transaction %d failed, nothing was written: %w", i+1, tx.ID, err)
+		}
+		written += n
+	}
+	if err := w.applyAggregates(); err != nil {
+		return nil, 0, fmt.Errorf("transaction %d failed, nothing was written: %w", tx.ID, err)
+	}
+
+	if tx.Isolation == engine.IsolationSnapshot {
+		if err := w.checkConflicts(tx); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	touched := make([]string, 0, len(w.bundles))
+	for name := range w.bundles {
+		touched = append(touched, name)
+	}
+	sort.Strings(touched)
+	staged := make([]*models.Bundle, 0, len(touched))
+	for _, name := range touched {
+		staged = append(staged, w.bundles[name])
+	}
+
+	// Commit. The hash indexes are marked before the files change, see index_maintenance.go.
+	for _, working := range staged {
+		docIDs := make([]string, 0, len(w.touched[working.Name]))
+		for docID := range w.touched[working.Name] {
+			docIDs = append(docIDs, docID)
+		}
+		defer s.maintainIndexes(s.captureIndexWrite(s.bundles[working.Name], docIDs...))
+	}
+	catalogTx := databaseService.BeginCatalogChange(fmt.Sprintf("transaction %d in %s", tx.ID, tx.Database.Name))
+	err := s.stageBundleFiles(catalogTx, staged...)
+	if err == nil {
+		err = catalogTx.Commit()
+	}
+	if catalogChangeFailed(err) {
+		return nil, 0, fmt.Errorf("transaction %d failed, nothing was written: %w", tx.ID, err)
+	}
+
+	changes := make(map[*models.Bundle][]string, len(staged))
+	var captures []*capturedWrite
+	for _, working := range staged {
+		bundle := s.bundles[working.Name]
+		for docID := range w.touched[working.Name] {
+			changes[bundle] = append(changes[bundle], docID)
+		}
+		if capture := s.captureWrite(bundle, changes[bundle]...); capture != nil {
+			sort.Strings(capture.docIDs)
+			captures = append(captures, capture)
+		}
+	}
+	s.versions.write(changes, func() {
+		for _, working := range staged {
+			bundle := s.bundles[working.Name]
+			for docID := range w.touched[working.Name] {
+				if doc, exists := working.Documents[docID]; exists {
+					bundle.Documents[docID] = doc
+				} else {
+					delete(bundle.Documents, docID)
+				}
+			}
+		}
+	})
+	if len(w.erased) > 0 {
+		// Erased documents leave no earlier contents behind, see erasure.go
+		s.versions.forget(w.erased)
+	}
+	// Documents first, then the aggregate groups they moved
+	sort.SliceStable(captures, func(i, j int) bool {
+		return captures[i].bundle.AggregateOf == "" && captures[j].bundle.AggregateOf != ""
+	})
+	for _, capture := range captures {
+		s.publishWrite(capture, tx.ID)
+	}
+	for _, working := range staged {
+		bundle := s.bundles[working.Name]
+		engine.InvalidateIndexLookups(bundle)
+		s.recordBundleWrite(bundle, len(w.touched[working.Name]), w.documents[working.Name], w.bytes[working.Name])
+	}
+	if err != nil {
+		// Logged, so the transaction has happened; its files are written later
+		s.logger.Warnf("Transaction %d committed but its files are not written yet: %v", tx.ID, err)
+	}
+	return w, written, nil
+}
+
+// apply runs one statement of a transaction against the working copies
+func (w *transactionWrites) apply(statement engine.Statement) (int, error) {
+	switch cmd := statement.(type) {
+	case *engine.DocumentCommand:
+		bundle, err := w.writable(cmd.BundleName)
+		if err != nil {
+			return 0, err
+		}
+		doc := w.service.documentFactory.NewDocument(*cmd)
+		if _, exists := bundle.Documents[doc.DocumentID]; exists {
+			return 0, protocol.Errorf(protocol.ErrAlreadyExists, "document '%s' already exists in bundle '%s'", doc.DocumentID, bundle.Name)
+		}
+		if err := w.service.checkDocumentLimits(bundle, doc); err != nil {
+			return 0, err
+		}
+		bundle.Documents[doc.DocumentID] = *doc
+		engine.InvalidateIndexLookups(bundle)
+		w.touched[bundle.Name][doc.DocumentID] = true
+		w.documents[bundle.Name]++
+		w.bytes[bundle.Name] += documentSize(doc)
+		w.changes[bundle.Name].record(bundle, doc, 1)
+		return 1, nil
+
+	case *engine.DocumentUpdateCommand:
+		bundle, err := w.writable(cmd.BundleName)
+		if err != nil {
+			return 0, err
+		}
+		docs, err := engine.FilterDocuments(bundle, cmd.WhereClause, w.service.logger)
+		if err != nil {
+			return 0, fmt.Errorf("failed to filter documents: %w", err)
+		}
+		for _, doc := range docs {
+			before := *doc
+			doc = withUpdates(&before, cmd.Fields)
+			if err := w.service.checkDocumentLimits(bundle, doc); err != nil {
+				return 0, err
+			}
+			doc.UpdatedAt = time.Now()
+			bundle.Documents[doc.DocumentID] = *doc
+			w.touched[bundle.Name][doc.DocumentID] = true
+			w.bytes[bundle.Name] += documentSize(doc) - documentSize(&before)
+			w.changes[bundle.Name].record(bundle, &before, -1)
+			w.changes[bundle.Name].record(bundle, doc, 1)
+		}
+		engine.InvalidateIndexLookups(bundle)
+		return len(docs), nil
+
+	case *engine.DocumentDeleteCommand:
+		bundle, err := w.writable(cmd.BundleName)
+		if err != nil {
+			return 0, err
+		}
+		docs, err := engine.FilterDocuments(bundle, cmd.WhereClause, w.service.logger)
+		if err != nil {
+			return 0, fmt.Errorf("failed to filter documents: %w", err)
+		}
+		for _, doc := range docs {
+			delete(bundle.Documents, doc.DocumentID)
+			w.touched[bundle.Name][doc.DocumentID] = true
+			w.documents[bundle.Name]--
+			w.bytes[bundle.Name] -= documentSize(doc)
+			w.changes[bundle.Name].record(bundle, doc, -1)
+		}
+		engine.InvalidateIndexLookups(bundle)
+		return len(docs), nil
+
+	case *engine.MergeCommand:
+		return w.applyMerge(cmd)
+
+	case *engine.EraseSubjectCommand:
+		return w.applyErase(cmd)
+	}
+	return 0, fmt.Errorf("%s cannot run inside a transaction", engine.StatementName(statement))
+}
+
+// writable returns the working copy of a bundle documents can be written to
+func (w *transactionWrites) writable(name string) (*models.Bundle, error) {
+	bundle, err := w.bundle(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWritable(bundle); err != nil {
+		return nil, err
+	}
+	if err := w.service.checkNotSuspect(bundle.Name); err != nil {
+		return nil, err
+	}
+	if _, exists := w.changes[bundle.Name]; !exists {
+		w.changes[bundle.Name] = make(aggregateChanges)
+	}
+	return bundle, nil
+}
+
+// applyAggregates applies the collected aggregate changes to working copies of the aggregates
+func (w *transactionWrites) applyAggregates() error {
+	for sourceName, changes := range w.changes {
+		source := w.bundles[sourceName]
+		for _, def := range source.Aggregates {
+			deltas := changes[def.Bundle]
+			if len(deltas) == 0 {
+				continue
+			}
+			aggregate, err := w.bundle(def.Bundle)
+			if err != nil {
+				return fmt.Errorf("aggregate '%s' of bundle '%s': %w", def.Bundle, sourceName, err)
+			}
+			for groupID := range deltas {
+				if doc, exists := aggregate.Documents[groupID]; exists {
+					w.bytes[def.Bundle] -= documentSize(&doc)
+				}
+			}
+			for groupID := range deltas {
+				w.touched[def.Bundle][groupID] = true
+			}
+			w.documents[def.Bundle] += engine.ApplyAggregateDeltas(aggregate, def, deltas)
+			for groupID := range deltas {
+				if doc, exists := aggregate.Documents[groupID]; exists {
+					w.bytes[def.Bundle] += documentSize(&doc)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkConflicts fails a SNAPSHOT transaction that writes a document someone else wrote after it
+// began. Aggregate groups are left out: the transaction's changes to them are added to whatever
+// they hold at COMMIT.
+func (w *transactionWrites) checkConflicts(tx *Transaction) error {
+	written := make(map[string]map[string]bool, len(w.touched))
+	for name, docIDs := range w.touched {
+		if w.bundles[name].AggregateOf == "" {
+			written[name] = docIDs
+		}
+	}
+	if bundle, docID, changed := w.service.versions.changedSince(written, tx.snapshot); changed {
+		return fmt.Errorf("transaction %d failed, nothing was written: document '%s' of bundle '%s' was changed after the transaction began",
+			tx.ID, docID, bundle)
+	}
+	return nil
+}
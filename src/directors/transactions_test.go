@@ -0,0 +1,77 @@
+package directors_test
+
+import (
+	"fmt"
+	"sync"
+	"syndrdb/src/engine"
+	"syndrdb/src/syndrtest"
+	"testing"
+)
+
+// TestCommitKeepsConcurrentWrites commits transactions while documents are added to the same
+// bundle outside any transaction; every document of both must be there afterwards
+func TestCommitKeepsConcurrentWrites(t *testing.T) {
+	h, err := syndrtest.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.MustExecute(t, `CREATE DATABASE "shop";`)
+	h.MustExecute(t, `USE "shop";`)
+	h.MustExecute(t, `CREATE BUNDLE "Orders" WITH FIELDS ({"N", "INT", false, false, 0});`)
+	bundles := h.Services.BundleService
+	bundle, err := bundles.GetBundleByName(h.Database, "Orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writes = 200
+	for _, isolation := range []string{engine.IsolationSnapshot, engine.IsolationReadCommitted} {
+		before := len(bundle.Documents)
+		var wg sync.WaitGroup
+		failures := make(chan error, 2)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				command := fmt.Sprintf(`ADD DOCUMENT TO BUNDLE "Orders" WITH ({"N" = %d});`, i)
+				statement, err := engine.ParseStatement(command)
+				if err != nil {
+					failures <- err
+					return
+				}
+				tx := bundles.BeginTransaction(h.Database, isolation)
+				if err := bundles.AddToTransaction(tx, statement, command); err != nil {
+					failures <- err
+					return
+				}
+				if _, err := bundles.CommitTransaction(h.Services.DatabaseService, tx); err != nil {
+					failures <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				statement, err := engine.ParseStatement(fmt.Sprintf(`ADD DOCUMENT TO BUNDLE "Orders" WITH ({"N" = %d});`, -i))
+				if err != nil {
+					failures <- err
+					return
+				}
+				if err := bundles.AddDocumentToBundle(h.Database, bundle, statement.(*engine.DocumentCommand)); err != nil {
+					failures <- err
+					return
+				}
+			}
+		}()
+		wg.Wait()
+		close(failures)
+		for err := range failures {
+			t.Fatalf("%s: %v", isolation, err)
+		}
+
+		if got, want := len(bundle.Documents)-before, 2*writes; got != want {
+			t.Errorf("%s: %d documents were added, want %d", isolation, got, want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package directors
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"syndrdb/src/cdc"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+)
+
+/*
+	Webhooks.
+
+	CREATE WEBHOOK lists a webhook in its bundle's file, so it survives restarts. Every change
+	to a document of the bundle (see change_capture.go) is checked against the bundle's
+	webhooks: the webhook must name the change's event, or none, and its WHERE clause must
+	match the document as the write left it or, for deletes, as it was. An update matches when
+	either side does, so a webhook also hears of documents leaving its filter. Matching changes
+	are handed to the dispatcher (cdc/webhooks.go), which delivers them in the background.
+
+	Webhooks belong to the node they are created on: their DDL is not replicated, and a hot
+	standby refuses it like any write.
+*/
+
+// WebhookInfo describes a webhook for SHOW WEBHOOKS; the secret itself is never shown
+type WebhookInfo struct {
+	Bundle     string
+	Name       string
+	URL        string
+	Events     []string
+	Where      string
+	Signed     bool
+	MaxRetries int
+	Backoff    string
+	Stats      cdc.WebhookStats
+}
+
+// CreateWebhook adds a webhook to a bundle
+func (s *BundleService) CreateWebhook(db *models.Database, command engine.CreateWebhookCommand) (*models.Bundle, error) {
+	bundle, err := s.GetBundleByName(db, command.BundleName)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", command.BundleName)
+	}
+	for _, existing := range bundle.Webhooks {
+		if existing.Name == command.WebhookName {
+			return nil, fmt.Errorf("bundle '%s' already has a webhook named '%s'", bundle.Name, command.WebhookName)
+		}
+	}
+	target, err := url.Parse(command.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL '%s' (must be an http:// or https:// URL)", command.URL)
+	}
+
+	webhooks := bundle.Webhooks
+	bundle.Webhooks = append(append([]models.WebhookDefinition(nil), webhooks...), models.WebhookDefinition{
+		Name:        command.WebhookName,
+		URL:         command.URL,
+		Events:      command.Events,
+		WhereClause: command.WhereClause,
+		Secret:      command.Secret,
+		MaxRetries:  command.MaxRetries,
+		Backoff:     command.Backoff,
+	})
+	if err := s.store.UpdateBundleFile(db, bundle); err != nil {
+		bundle.Webhooks = webhooks
+		return nil, fmt.Errorf("error writing bundle '%s': %w", bundle.Name, err)
+	}
+	return bundle, nil
+}
+
+// DeleteWebhook removes a webhook from a bundle, dropping the changes still queued for it
+func (s *BundleService) DeleteWebhook(db *models.Database, bundleName, name string) error {
+	bundle, err := s.GetBundleByName(db, bundleName)
+	if err != nil {
+		return protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", bundleName)
+	}
+	webhooks := bundle.Webhooks
+	kept := make([]models.WebhookDefinition, 0, len(webhooks))
+	for _, def := range webhooks {
+		if def.Name != name {
+			kept = append(kept, def)
+		}
+	}
+	if len(kept) == len(webhooks) {
+		return fmt.Errorf("bundle '%s' has no webhook named '%s'", bundle.Name, name)
+	}
+
+	bundle.Webhooks = kept
+	if err := s.store.UpdateBundleFile(db, bundle); err != nil {
+		bundle.Webhooks = webhooks
+		return fmt.Errorf("error writing bundle '%s': %w", bundle.Name, err)
+	}
+	s.webhooks.Forget(webhookKey(bundle, name))
+	return nil
+}
+
+// Webhooks lists the webhooks of a bundle, or of every bundle of a database when bundleName
+// is empty
+func (s *BundleService) Webhooks(db *models.Database, bundleName string) ([]WebhookInfo, error) {
+	var names []string
+	if bundleName != "" {
+		names = []string{bundleName}
+	} else {
+		for _, fileName := range db.BundleFiles {
+			names = append(names, helpers.BundleNameFromFile(fileName))
+		}
+		sort.Strings(names)
+	}
+
+	webhooks := make([]WebhookInfo, 0)
+	for _, name := range names {
+		bundle, err := s.GetBundleByName(db, name)
+		if err != nil {
+			if bundleName != "" {
+				return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle '%s' not found", bundleName)
+			}
+			continue
+		}
+		for _, def := range bundle.Webhooks {
+			webhooks = append(webhooks, WebhookInfo{
+				Bundle:     bundle.Name,
+				Name:       def.Name,
+				URL:        def.URL,
+				Events:     def.Events,
+				Where:      def.WhereClause,
+				Signed:     def.Secret != "",
+				MaxRetries: def.MaxRetries,
+				Backoff:    def.Backoff.String(),
+				Stats:      s.webhooks.Stats(webhookKey(bundle, def.Name)),
+			})
+		}
+	}
+	return webhooks, nil
+}
+
+// notifyWebhooks hands a change to every webhook of its bundle that it matches
+func (s *BundleService) notifyWebhooks(bundle *models.Bundle, change cdc.Change, before, after *models.Document) {
+	for _, def := range bundle.Webhooks {
+		if !webhookWants(def, change.Operation) {
+			continue
+		}
+		if def.WhereClause != "" {
+			where, err := engine.ParseWhereClause(def.WhereClause)
+			if err != nil {
+				s.logger.Errorf("Webhook '%s' of bundle '%s' has an invalid WHERE clause: %v", def.Name, bundle.Name, err)
+				continue
+			}
+			matches := (before != nil && engine.EvaluateWhereClause(before, where, s.logger)) ||
+				(after != nil && engine.EvaluateWhereClause(after, where, s.logger))
+			if !matches {
+				continue
+			}
+		}
+		s.webhooks.Deliver(webhookKey(bundle, def.Name), cdc.Webhook{
+			Name:       def.Name,
+			URL:        def.URL,
+			Secret:     def.Secret,
+			MaxRetries: def.MaxRetries,
+			Backoff:    def.Backoff,
+		}, change)
+	}
+}
+
+// forgetWebhooks drops the queues of a deleted bundle's webhooks
+func (s *BundleService) forgetWebhooks(bundle *models.Bundle) {
+	for _, def := range bundle.Webhooks {
+		s.webhooks.Forget(webhookKey(bundle, def.Name))
+	}
+}
+
+func webhookWants(def models.WebhookDefinition, operation string) bool {
+	if len(def.Events) == 0 {
+		return true
+	}
+	for _, event := range def.Events {
+		if event == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookKey identifies a webhook to the dispatcher
+func webhookKey(bundle *models.Bundle, name string) string {
+	database := ""
+	if bundle.Database != nil {
+		database = bundle.Database.Name
+	}
+	return database + "/" + bundle.Name + "/" + name
+}
@@ -0,0 +1,224 @@
+package embedded
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syndrdb/src/engine"
+	"syndrdb/src/server"
+	"syndrdb/src/settings"
+)
+
+/*
+	Embedded mode.
+
+	A Go program can run SyndrDB in its own process instead of connecting to a server, the way
+	SQLite or Bolt are used. Open loads a data directory and SyndrQL commands run on it
+	directly, with no listener, connection string or JSON in between:
+
+	    db, err := embedded.Open("./data")
+	    ...
+	    defer db.Close()
+	    result, err := db.Execute(`SELECT DOCUMENTS FROM "Orders" WHERE "Total" > $1`, 100)
+
+	Commands take the path a client's do on the server (see server/local.go), and results hold
+	the engine's own values; Decode turns them into the caller's types through JSON, as the
+	Go client's responses do. DB.Execute runs every command on one shared session, so a USE
+	stays in effect for later commands; a Session has a current database and transaction of
+	its own, as a client's connection does.
+
+	There is no authentication: commands run as the admin user. Each DB runs a server of its
+	own, with its own services, so a process can open several data directories at once; Open
+	fails for a directory that is open already. Cluster mode needs the server.
+*/
+
+var (
+	openMu   sync.Mutex
+	openDirs = make(map[string]bool) // Absolute paths of the data directories open
+)
+
+// DB is an open data directory. It is safe for concurrent use.
+type DB struct {
+	server *server.Server
+	admin  string
+	dir    string // Absolute path of the data directory
+
+	mu       sync.Mutex
+	closed   bool
+	sessions map[*Session]struct{} // Open ones, rolled back by Close
+	nextID   atomic.Int64
+
+	shared   *Session   // Runs DB.Execute
+	sharedMu sync.Mutex // Lets one command at a time use shared
+}
+
+// Open opens a data directory, creating it when it does not exist, with the default settings
+func Open(dir string) (*DB, error) {
+	// A copy, as every DB keeps the settings it was opened with
+	config := *settings.GetSettings()
+	config.DataDir = dir
+	return OpenWith(&config)
+}
+
+// OpenWith opens config.DataDir with the settings given, as the server would start with them
+func OpenWith(config *settings.Arguments) (*DB, error) {
+	openMu.Lock()
+	defer openMu.Unlock()
+	dir, err := filepath.Abs(config.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve data directory: %w", err)
+	}
+	if openDirs[dir] {
+		return nil, fmt.Errorf("data directory %s is open already", dir)
+	}
+	if config.Mode == "cluster" {
+		return nil, fmt.Errorf("cluster mode is not available embedded")
+	}
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	srv, err := server.InitServer(config)
+	if err != nil {
+		return nil, err
+	}
+	srv.StartLocal()
+	openDirs[dir] = true
+
+	db := &DB{server: srv, admin: config.AdminUser, dir: dir, sessions: make(map[*Session]struct{})}
+	db.shared, err = db.Session()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Execute runs a command on the DB's shared session, binding params to its $1, $2, ...
+func (db *DB) Execute(command string, params ...interface{}) (*Result, error) {
+	db.sharedMu.Lock()
+	defer db.sharedMu.Unlock()
+	return db.shared.Execute(command, params...)
+}
+
+// Session starts a session, with no database selected
+func (db *DB) Session() (*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, fmt.Errorf("database is closed")
+	}
+	id := fmt.Sprintf("embedded_%d", db.nextID.Add(1))
+	session := &Session{db: db, conn: db.server.NewLocalConnection(id, db.admin)}
+	db.sessions[session] = struct{}{}
+	return session, nil
+}
+
+// Close rolls back the transactions sessions left open, writes every change to disk and
+// stops the engine
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	sessions := db.sessions
+	db.sessions = nil
+	db.mu.Unlock()
+
+	for session := range sessions {
+		db.server.CloseLocalConnection(session.conn)
+	}
+	err := db.server.Stop()
+
+	openMu.Lock()
+	delete(openDirs, db.dir)
+	openMu.Unlock()
+	return err
+}
+
+// Session runs commands with a current database and transaction of its own, like a client's
+// connection. It is not safe for concurrent use; start a session per goroutine.
+type Session struct {
+	db   *DB
+	conn *server.Connection
+}
+
+// Execute runs a command, binding params to its $1, $2, ... (see engine/parameters.go)
+func (s *Session) Execute(command string, params ...interface{}) (*Result, error) {
+	s.db.mu.Lock()
+	closed := s.db.closed
+	_, open := s.db.sessions[s]
+	s.db.mu.Unlock()
+	if closed {
+		return nil, fmt.Errorf("database is closed")
+	}
+	if !open {
+		return nil, fmt.Errorf("session is closed")
+	}
+	if len(params) > 0 {
+		bound, err := engine.BindParameters(command, params)
+		if err != nil {
+			return nil, err
+		}
+		command = bound
+	}
+
+	result, err := s.db.server.Execute(s.conn, command)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(result), nil
+}
+
+// Close rolls back the session's open transaction
+func (s *Session) Close() error {
+	s.db.mu.Lock()
+	_, open := s.db.sessions[s]
+	delete(s.db.sessions, s)
+	s.db.mu.Unlock()
+	if open {
+		s.db.server.CloseLocalConnection(s.conn)
+	}
+	return nil
+}
+
+// Result is the result of a command, holding the engine's values
+type Result struct {
+	ResultCount int
+	Result      interface{}
+}
+
+// newResult wraps what the engine returned for a command
+func newResult(value interface{}) *Result {
+	switch typed := value.(type) {
+	case *engine.CommandResponse:
+		if typed != nil {
+			return &Result{ResultCount: typed.ResultCount, Result: typed.Result}
+		}
+	case engine.CommandResponse:
+		return &Result{ResultCount: typed.ResultCount, Result: typed.Result}
+	case *string:
+		if typed != nil {
+			return &Result{ResultCount: 1, Result: *typed}
+		}
+	case nil:
+		return &Result{}
+	}
+	return &Result{ResultCount: 1, Result: value}
+}
+
+// Decode converts the result into v as the server would send it, through JSON
+func (r *Result) Decode(v interface{}) error {
+	if r.Result == nil {
+		return nil
+	}
+	data, err := json.Marshal(r.Result)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"math"
+	"syndrdb/src/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	Materialized aggregates (CREATE AGGREGATE).
+
+	An aggregate is an ordinary bundle holding one document per distinct value of a field of
+	another bundle, its source. Every group document has the group value under the field's own
+	name, the number of source documents in the group under "count" and, for every summed
+	field, the total of its values under "sum_<field>". Values that are missing or not numbers
+	add nothing to a sum.
+
+	The source bundle lists its aggregates in its file and every ADD DOCUMENT, UPDATE DOCUMENTS
+	and DELETE DOCUMENTS on it changes the affected groups; a group whose count drops to zero
+	is removed. The aggregate bundle itself is read like any other bundle but only written
+	through its source. REFRESH AGGREGATE rebuilds it from the source's documents.
+*/
+
+// AggregateCountField holds the number of source documents in a group
+const AggregateCountField = "count"
+
+// AggregateSumField returns the field holding the total of a summed source field
+func AggregateSumField(field string) string {
+	return "sum_" + field
+}
+
+// AggregateDelta is how a write changes one group of an aggregate
+type AggregateDelta struct {
+	GroupValue interface{}
+	Count      int
+	Sums       map[string]float64
+}
+
+// AddAggregateDelta records a source document entering (sign 1) or leaving (sign -1) its
+// group. deltas is keyed by group document ID.
+func AddAggregateDelta(deltas map[string]*AggregateDelta, def models.AggregateDefinition, doc *models.Document, sign int) {
+	groupValue := doc.Fields[def.GroupBy].Value
+	groupID := AggregateGroupID(groupValue)
+	delta, exists := deltas[groupID]
+	if !exists {
+		delta = &AggregateDelta{GroupValue: groupValue, Sums: make(map[string]float64, len(def.SumFields))}
+		deltas[groupID] = delta
+	}
+
+	delta.Count += sign
+	for _, field := range def.SumFields {
+		if number, ok := numericValue(doc.Fields[field].Value); ok {
+			delta.Sums[field] += float64(sign) * number
+		}
+	}
+}
+
+// ApplyAggregateDeltas changes the group documents of an aggregate bundle in memory and
+// reports the change in document count. Groups left with no source documents are removed.
+func ApplyAggregateDeltas(aggregate *models.Bundle, def models.AggregateDefinition, deltas map[string]*AggregateDelta) int {
+	if aggregate.Documents == nil {
+		aggregate.Documents = make(map[string]models.Document)
+	}
+
+	documents := 0
+	now := time.Now()
+	for groupID, delta := range deltas {
+		doc, exists := aggregate.Documents[groupID]
+		if !exists {
+			if delta.Count <= 0 {
+				continue
+			}
+			doc = models.Document{
+				DocumentID: groupID,
+				Fields: map[string]models.Field{
+					def.GroupBy:         {Name: def.GroupBy, Value: delta.GroupValue},
+					AggregateCountField: {Name: AggregateCountField, Value: int64(0)},
+				},
+				CreatedAt: now,
+			}
+			for _, field := range def.SumFields {
+				doc.Fields[AggregateSumField(field)] = models.Field{Name: AggregateSumField(field)}
+			}
+			documents++
+		}
+
+		count, _ := numericValue(doc.Fields[AggregateCountField].Value)
+		count += float64(delta.Count)
+		if count <= 0 {
+			delete(aggregate.Documents, groupID)
+			documents--
+			continue
+		}
+		doc.Fields[AggregateCountField] = models.Field{Name: AggregateCountField, Value: int64(count)}
+
+		for _, field := range def.SumFields {
+			name := AggregateSumField(field)
+			sum, _ := numericValue(doc.Fields[name].Value)
+			doc.Fields[name] = models.Field{Name: name, Value: sumValue(aggregate, name, sum+delta.Sums[field])}
+		}
+		doc.UpdatedAt = now
+		aggregate.Documents[groupID] = doc
+	}
+	return documents
+}
+
+// ComputeAggregate builds the group documents of an aggregate from every document of its source
+func ComputeAggregate(aggregate *models.Bundle, source *models.Bundle, def models.AggregateDefinition) {
+	deltas := make(map[string]*AggregateDelta)
+	for docID := range source.Documents {
+		doc := source.Documents[docID]
+		AddAggregateDelta(deltas, def, &doc, 1)
+	}
+	aggregate.Documents = make(map[string]models.Document, len(deltas))
+	ApplyAggregateDeltas(aggregate, def, deltas)
+}
+
+// AggregateGroupID is the document ID of the group for a value; values an index treats as
+// equal share a group
+func AggregateGroupID(value interface{}) string {
+	return "group:" + indexKey(value)
+}
+
+// sumValue stores a sum as the type of its field: whole numbers for int fields
+func sumValue(aggregate *models.Bundle, field string, sum float64) interface{} {
+	if aggregate.DocumentStructure.FieldDefinitions[field].Type == "int" {
+		return int64(math.Round(sum))
+	}
+	return sum
+}
+
+// AggregatesToMap prepares a bundle's aggregate definitions for the bundle file
+func AggregatesToMap(defs []models.AggregateDefinition) []interface{} {
+	aggregates := make([]interface{}, 0, len(defs))
+	for _, def := range defs {
+		aggregates = append(aggregates, map[string]interface{}{
+			"Bundle":    def.Bundle,
+			"GroupBy":   def.GroupBy,
+			"SumFields": def.SumFields,
+		})
+	}
+	return aggregates
+}
+
+// MapToAggregates restores aggregate definitions decoded from BSON
+func MapToAggregates(data interface{}) []models.AggregateDefinition {
+	var aggregates []interface{}
+	switch a := data.(type) {
+	case primitive.A:
+		aggregates = a
+	case []interface{}:
+		aggregates = a
+	}
+
+	defs := make([]models.AggregateDefinition, 0, len(aggregates))
+	for _, raw := range aggregates {
+		defData, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		def := models.AggregateDefinition{
+			Bundle:  stringValue(defData, "Bundle", ""),
+			GroupBy: stringValue(defData, "GroupBy", ""),
+		}
+		var fields []interface{}
+		switch f := defData["SumFields"].(type) {
+		case primitive.A:
+			fields = f
+		case []interface{}:
+			fields = f
+		}
+		for _, field := range fields {
+			if name, ok := field.(string); ok {
+				def.SumFields = append(def.SumFields, name)
+			}
+		}
+		defs = append(defs, def)
+	}
+	return defs
+}
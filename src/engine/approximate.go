@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"syndrdb/src/models"
+)
+
+/*
+	Approximate aggregates.
+
+	SELECT TOPK(Country, 10), PERCENTILE(Price, 0.95), APPROX_COUNT_DISTINCT(CustomerID)
+	FROM "Orders" [SAMPLE ...] [WHERE ...] feeds the matching documents one at a time into the
+	streaming sketches of sketches.go, so no result set is built however many documents
+	match. TOPK returns the k most frequent values with their counts, PERCENTILE the value at
+	that share of the sorted values, between 0 and 1, and APPROX_COUNT_DISTINCT the number of
+	distinct values. Documents without the field are skipped, and so are values that are not
+	numbers for PERCENTILE, which returns null when no number was seen. Results come back in
+	the order the functions were written.
+*/
+
+const (
+	FunctionTopK                = "TOPK"
+	FunctionPercentile          = "PERCENTILE"
+	FunctionApproxCountDistinct = "APPROX_COUNT_DISTINCT"
+)
+
+// MaxTopK bounds TOPK's k, and with it the sketch's memory
+const MaxTopK = 10000
+
+// ApproximateFunction is one function of a SELECT of approximate aggregates
+type ApproximateFunction struct {
+	Name       string // One of the Function constants
+	Field      string
+	K          int     // TOPK only
+	Percentile float64 // PERCENTILE only, 0 to 1
+}
+
+// String renders the function as written, to label its result
+func (f ApproximateFunction) String() string {
+	switch f.Name {
+	case FunctionTopK:
+		return fmt.Sprintf("%s(%s, %d)", f.Name, f.Field, f.K)
+	case FunctionPercentile:
+		return fmt.Sprintf("%s(%s, %s)", f.Name, f.Field, strconv.FormatFloat(f.Percentile, 'f', -1, 64))
+	}
+	return fmt.Sprintf("%s(%s)", f.Name, f.Field)
+}
+
+// ApproximateResult is the outcome of one function
+type ApproximateResult struct {
+	Function string
+	Value    interface{} // []TopValue for TOPK, a float64 or nil for PERCENTILE, an int64 for APPROX_COUNT_DISTINCT
+}
+
+// ApproximateAggregator runs the functions of one query over the documents it is given
+type ApproximateAggregator struct {
+	functions []ApproximateFunction
+	sketches  []interface{}
+}
+
+func NewApproximateAggregator(functions []ApproximateFunction) *ApproximateAggregator {
+	aggregator := &ApproximateAggregator{functions: functions, sketches: make([]interface{}, len(functions))}
+	for i, function := range functions {
+		switch function.Name {
+		case FunctionTopK:
+			aggregator.sketches[i] = newTopKSketch(function.K)
+		case FunctionPercentile:
+			aggregator.sketches[i] = &tDigest{}
+		default:
+			aggregator.sketches[i] = &hyperLogLog{}
+		}
+	}
+	return aggregator
+}
+
+// Add feeds one document to every function
+func (a *ApproximateAggregator) Add(doc *models.Document) {
+	for i, function := range a.functions {
+		value := documentFieldValue(doc, function.Field)
+		if value == nil {
+			continue
+		}
+		switch sketch := a.sketches[i].(type) {
+		case *topKSketch:
+			sketch.add(value)
+		case *tDigest:
+			if number, ok := numericValue(value); ok {
+				sketch.add(number)
+			}
+		case *hyperLogLog:
+			sketch.add(value)
+		}
+	}
+}
+
+// Results returns the outcome of every function, in the order they were given
+func (a *ApproximateAggregator) Results() []ApproximateResult {
+	results := make([]ApproximateResult, len(a.functions))
+	for i, function := range a.functions {
+		results[i].Function = function.String()
+		switch sketch := a.sketches[i].(type) {
+		case *topKSketch:
+			results[i].Value = sketch.top()
+		case *tDigest:
+			if value, ok := sketch.quantile(function.Percentile); ok {
+				results[i].Value = value
+			}
+		case *hyperLogLog:
+			results[i].Value = sketch.estimate()
+		}
+	}
+	return results
+}
@@ -1,16 +1,18 @@
 package engine
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"syndrdb/src/buffermgr"
 	"syndrdb/src/helpers"
 	"syndrdb/src/models"
-	"syndrdb/src/settings"
+	"syndrdb/src/protocol"
 	"syscall"
 	"time"
 
@@ -22,6 +24,11 @@ import (
 type BundleStorageEngine struct {
 	fileManager   *buffermgr.FileManager
 	DataDirectory string
+	paths         *helpers.PathResolver
+	debug         bool        // Logs the documents deleted from bundle files, as -debug asks
+	syncer        *FileSyncer // Syncs the files written as their database's durability asks, see durability.go
+	pageWAL       *PageWAL    // Logs the changes to paged bundle files, see page_wal.go; nil refuses them
+	pagedMu       sync.Mutex  // Serializes the writes to paged bundle files, see paged_bundle.go
 	logger        *zap.SugaredLogger
 }
 
@@ -32,10 +39,13 @@ type DocumentFactory interface {
 	NewDocument(docCommand DocumentCommand) *models.Document
 }
 
+// BundleStore reads and writes bundle files. Reads stop when their ctx is canceled, such as by
+// the client disconnecting; writes take none, as one that has started is finished rather than
+// leave a file half written.
 type BundleStore interface {
-	LoadAllBundleDataFiles(dataRootDir string) (map[string]*models.Bundle, error)
-	LoadBundleDataFile(database *models.Database, dataRootDir string, fileName string) (*models.Bundle, error)
-	LoadBundleIntoMemory(database *models.Database, bundleName string) (*[]byte, *models.Bundle, error)
+	LoadAllBundleDataFiles(ctx context.Context, dataRootDir string) (map[string]*models.Bundle, error)
+	LoadBundleDataFile(ctx context.Context, database *models.Database, fileName string) (*models.Bundle, error)
+	LoadBundleIntoMemory(ctx context.Context, database *models.Database, bundleName string) (*[]byte, *models.Bundle, error)
 	CreateBundleFile(database *models.Database, bundle *models.Bundle) error
 	UpdateBundleFile(database *models.Database, bundle *models.Bundle) error
 	UpdateDocumentDataInBundleFile(database *models.Database, bundle *models.Bundle, documentID string, updatedDocument map[string]interface{}, mmapData []byte) error
@@ -48,9 +58,14 @@ type BundleStore interface {
 	RemoveDocumentFromBundleFile(database *models.Database, bundle *models.Bundle, documentID string, mmapData []byte) error
 	BundleFileExists(bundleName string) bool
 	RemoveBundleFile(database *models.Database, bundleName string) error
+
+	// EncodeBundleFiles returns the contents of a bundle's files by file name, for a catalog change
+	EncodeBundleFiles(bundle *models.Bundle) (map[string][]byte, error)
 }
 
-func NewBundleStore(dataDir string, bufferPool *buffermgr.BufferPool, logger *zap.SugaredLogger) (*BundleStorageEngine, error) {
+// NewBundleStore creates the store of the bundle files in a data directory. Writing bundles in
+// the paged layout takes a page log; without one (nil) those writes are refused.
+func NewBundleStore(dataDir string, bufferPool *buffermgr.BufferPool, pageWAL *PageWAL, syncer *FileSyncer, debug bool, logger *zap.SugaredLogger) (*BundleStorageEngine, error) {
 	// Create a buffer pool for file management
 	fileManager, err := buffermgr.NewFileManager(dataDir, bufferPool, logger)
 	if err != nil {
@@ -60,10 +75,19 @@ func NewBundleStore(dataDir string, bufferPool *buffermgr.BufferPool, logger *za
 	// Create a new bundle store
 	store := &BundleStorageEngine{
 		DataDirectory: dataDir,
+		paths:         helpers.NewPathResolver(dataDir),
 		fileManager:   fileManager,
+		debug:         debug,
+		syncer:        syncer,
+		pageWAL:       pageWAL,
 		logger:        logger,
 	}
 
+	// Pages of bundle files are written behind the log of their changes
+	if pageWAL != nil {
+		bufferPool.SetWAL(pageWAL)
+	}
+
 	// Ensure the data directory exists
 	if err := os.MkdirAll(store.DataDirectory, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory %s: %w", store.DataDirectory, err)
@@ -73,7 +97,7 @@ func NewBundleStore(dataDir string, bufferPool *buffermgr.BufferPool, logger *za
 }
 
 // LoadAllBundleDataFiles loads all bundle data files from the given directory
-func (bse *BundleStorageEngine) LoadAllBundleDataFiles(dataDir string) (map[string]*models.Bundle, error) {
+func (bse *BundleStorageEngine) LoadAllBundleDataFiles(ctx context.Context, dataDir string) (map[string]*models.Bundle, error) {
 	bundles := make(map[string]*models.Bundle)
 	// Implementation for loading all bundle data files
 	// This is a placeholder that should be filled with actual loading logic
@@ -81,11 +105,14 @@ func (bse *BundleStorageEngine) LoadAllBundleDataFiles(dataDir string) (map[stri
 }
 
 // TODO This is the old, pre-buffer manager implementation.
-func (b *BundleStorageEngine) LoadBundleDataFile(database *models.Database, dataRootDir string, fileName string) (*models.Bundle, error) {
-	filePath := filepath.Join(dataRootDir, fileName)
+func (b *BundleStorageEngine) LoadBundleDataFile(ctx context.Context, database *models.Database, fileName string) (*models.Bundle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	filePath := b.paths.Path(fileName)
 	// Check if the file exists
 	if !helpers.FileExists(filePath, *b.logger) {
-		return nil, fmt.Errorf("bundle file %s does not exist", fileName)
+		return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle file %s does not exist", fileName)
 	}
 	// Open the file
 	bundleFile, err := os.Open(filePath)
@@ -103,6 +130,9 @@ func (b *BundleStorageEngine) LoadBundleDataFile(database *models.Database, data
 	if err != nil {
 		return nil, fmt.Errorf("error decoding bundle data from file %s: %w", fileName, err)
 	}
+	if _, err := upgradeBundleMap(bundleData.(map[string]interface{}), fileName); err != nil {
+		return nil, err
+	}
 
 	bundle, err := MapToBundle(bundleData.(map[string]interface{}), *b.logger)
 	if err != nil {
@@ -111,6 +141,13 @@ func (b *BundleStorageEngine) LoadBundleDataFile(database *models.Database, data
 
 	bundle.Database = database
 
+	if bundle.Partitioning != nil {
+		err = b.loadPartitionFiles(bundle)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	prettyJSON, err := json.MarshalIndent(bundleData, "", "  ")
 	if err != nil {
 		b.logger.Warnf("Failed to pretty-print bundle data: %v", err)
@@ -126,8 +163,11 @@ func (b *BundleStorageEngine) LoadBundleDataFile(database *models.Database, data
 }
 
 // TODO this is the old, pre-buffer manager implementation.
-func (b *BundleStorageEngine) LoadBundleIntoMemory(database *models.Database, bundleName string) (*[]byte, *models.Bundle, error) {
-	bundleFile, err := helpers.OpenDataFile(database.DataDirectory, fmt.Sprintf("%s.bnd", bundleName))
+func (b *BundleStorageEngine) LoadBundleIntoMemory(ctx context.Context, database *models.Database, bundleName string) (*[]byte, *models.Bundle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	bundleFile, err := helpers.OpenDataFile(b.paths.DataDir(), helpers.BundleFileName(bundleName))
 	if err != nil {
 		return nil, nil, fmt.Errorf("error opening bundle file %s: %w", bundleName, err)
 	}
@@ -164,29 +204,29 @@ func (b *BundleStorageEngine) LoadBundleIntoMemory(database *models.Database, bu
 }
 
 // LoadBundle loads a bundle from disk
-func (bs *BundleStorageEngine) LoadBundle(bundleName string) (*models.Bundle, error) {
+func (bs *BundleStorageEngine) LoadBundle(ctx context.Context, bundleName string) (*models.Bundle, error) {
 	// Get the fileID for this bundle
-	bundleFilename := fmt.Sprintf("%s.bun", bundleName)
+	bundleFilename := helpers.BundleFileName(bundleName)
 	fileID, err := bs.fileManager.OpenFile(bundleFilename)
 	if err != nil {
 		return nil, fmt.Errorf("could not open bundle file: %w", err)
 	}
 
 	// Read the header page (block 0)
-	headerBuffer, err := bs.fileManager.ReadPage(fileID, 0)
+	headerBuffer, err := bs.fileManager.ReadPage(ctx, fileID, 0)
 	if err != nil {
 		return nil, fmt.Errorf("could not read header page: %w", err)
 	}
 	defer bs.fileManager.ReleasePage(headerBuffer)
 
 	// Parse the header
-	bundle, docCount, err := bs.parseHeaderPage(headerBuffer.Data)
+	bundle, docCount, pageCount, err := bs.parseHeaderPage(ctx, fileID, headerBuffer.Data)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse header page: %w", err)
 	}
 
 	// Read the document pages
-	docs, err := bs.readDocuments(fileID, docCount)
+	docs, err := bs.readDocuments(ctx, fileID, pageCount, docCount)
 	if err != nil {
 		return nil, fmt.Errorf("could not read documents: %w", err)
 	}
@@ -196,135 +236,23 @@ func (bs *BundleStorageEngine) LoadBundle(bundleName string) (*models.Bundle, er
 	return bundle, nil
 }
 
-// parseHeaderPage parses the header page of a bundle file
-func (bs *BundleStorageEngine) parseHeaderPage(pageData []byte) (*models.Bundle, uint32, error) {
-	// First 4 bytes: magic number
-	magic := binary.LittleEndian.Uint32(pageData[:4])
-	if magic != 0x42554E44 { // "BUND" in hex
-		return nil, 0, fmt.Errorf("invalid bundle file format (bad magic number)")
-	}
-
-	// Next 4 bytes: version
-	version := binary.LittleEndian.Uint32(pageData[4:8])
-	if version != 1 {
-		return nil, 0, fmt.Errorf("unsupported bundle file version: %d", version)
-	}
-
-	// Next 4 bytes: document count
-	docCount := binary.LittleEndian.Uint32(pageData[8:12])
-
-	// Rest of header contains serialized bundle metadata
-	// For simplicity, let's assume JSON format
-	// TODO In the production, use a more efficient binary format like bson
-	bundleMetadata := pageData[16:2048] // Limit the metadata size
-
-	// Trim null bytes - FOR THE FULL IMPLEMENTATION, handle this metadata properly
-	// metadataLen := 0
-	// for i, b := range bundleMetadata {
-	// 	if b == 0 {
-	// 		metadataLen = i
-	// 		break
-	// 	}
-	// }
-
-	bundle := &models.Bundle{}
-	// TODO deserialize bundle from bundleMetadata[:metadataLen]
-
-	// For this example, just create an empty bundle
-	bundle.BundleID = string(bundleMetadata[:32])
-	bundle.Name = string(bundleMetadata[32:64])
-	bundle.Documents = make(map[string]models.Document)
-
-	return bundle, docCount, nil
-}
-
-// readDocuments reads all documents from a bundle file
-func (bs *BundleStorageEngine) readDocuments(fileID uint32, docCount uint32) (map[string]models.Document, error) {
-	docs := make(map[string]models.Document)
-
-	// Start reading from block 1 (block 0 is the header)
-	currentBlock := uint32(1)
-	docsRead := uint32(0)
-
-	for docsRead < docCount {
-		buffer, err := bs.fileManager.ReadPage(fileID, currentBlock)
-		if err != nil {
-			return nil, fmt.Errorf("could not read document page %d: %w", currentBlock, err)
-		}
-
-		// Process documents from this page
-		pageDocsRead, err := bs.processDocumentPage(buffer.Data, docs)
-		bs.fileManager.ReleasePage(buffer)
-
-		if err != nil {
-			return nil, fmt.Errorf("could not process document page %d: %w", currentBlock, err)
-		}
-
-		docsRead += pageDocsRead
-		currentBlock++
-	}
-
-	return docs, nil
-}
-
-// processDocumentPage extracts documents from a page
-func (bs *BundleStorageEngine) processDocumentPage(pageData []byte, docs map[string]models.Document) (uint32, error) {
-	// First 4 bytes: document count in this page
-	docsInPage := binary.LittleEndian.Uint32(pageData[:4])
-
-	offset := 4
-	for i := uint32(0); i < docsInPage; i++ {
-		// Read document length
-		if offset+4 > len(pageData) {
-			return i, fmt.Errorf("unexpected end of page data")
-		}
-
-		docLen := binary.LittleEndian.Uint32(pageData[offset : offset+4])
-		offset += 4
-
-		// Read document data
-		if offset+int(docLen) > len(pageData) {
-			return i, fmt.Errorf("document exceeds page boundary")
-		}
-
-		docData := pageData[offset : offset+int(docLen)]
-		offset += int(docLen)
-
-		// Parse document
-		doc := models.Document{}
-		// In real code: deserialize document from docData
-
-		// For this example, just extract ID from first few bytes
-		idLen := 16
-		if idLen > len(docData) {
-			idLen = len(docData)
-		}
-		docID := string(docData[:idLen])
-		doc.DocumentID = docID
-
-		// Add to the map
-		docs[docID] = doc
-	}
-
-	return docsInPage, nil
-}
-
 func (b *BundleStorageEngine) BundleFileExists(bundleName string) bool {
 	// Check if the bundle file exists in the data directory
-	args := settings.GetSettings()
-	filePath := filepath.Join(args.DataDir, fmt.Sprintf("%s.bnd", bundleName))
-	return helpers.FileExists(filePath, *b.logger)
+	return helpers.FileExists(b.paths.BundleFile(bundleName), *b.logger)
 }
 
 func (b *BundleStorageEngine) CreateBundleFile(database *models.Database, bundle *models.Bundle) error {
 	// Create a new data file
-	filePath := filepath.Join(database.DataDirectory, fmt.Sprintf("%s.bnd", bundle.Name))
+	filePath := b.paths.BundleFile(bundle.Name)
 
 	// Check if the file already exists
 	if helpers.FileExists(filePath, *b.logger) {
-		return fmt.Errorf("Bundle %s already exists", bundle.Name)
+		return protocol.Errorf(protocol.ErrAlreadyExists, "Bundle %s already exists", bundle.Name)
 	}
 
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("error creating namespace directory for %s: %w", bundle.Name, err)
+	}
 	file, err := os.Create(filePath)
 	if err != nil {
 		return fmt.Errorf("error creating data file %s: %w", bundle.Name, err)
@@ -337,10 +265,12 @@ func (b *BundleStorageEngine) CreateBundleFile(database *models.Database, bundle
 	convertedBundle := BundleToMap(bundle)
 
 	// Encode the bundle to BSON
-	encodedBundle, err := helpers.EncodeBSON(convertedBundle)
-	if err != nil {
+	buffer := helpers.GetBuffer()
+	defer helpers.PutBuffer(buffer)
+	if err := helpers.EncodeBSONTo(buffer, convertedBundle); err != nil {
 		return fmt.Errorf("error encoding bundle data: %w", err)
 	}
+	encodedBundle := buffer.Bytes()
 
 	// Write the encoded bundle to the file
 	fileLen, err := file.Write(encodedBundle)
@@ -352,19 +282,29 @@ func (b *BundleStorageEngine) CreateBundleFile(database *models.Database, bundle
 		return fmt.Errorf("error writing to bundle data file %s: wrote %d bytes, expected %d", bundle.Name, fileLen, len(encodedBundle))
 	}
 
+	if bundle.Partitioning != nil {
+		for i := 0; i < bundle.Partitioning.PartitionCount; i++ {
+			partitionPath := b.paths.PartitionFile(bundle.Name, i)
+			if err := b.writePartitionFile(bundle, i, partitionPath); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
 func (b *BundleStorageEngine) UpdateBundleFile(database *models.Database, bundle *models.Bundle) error {
 	// Create a new data file
-	filePath := filepath.Join(database.DataDirectory, fmt.Sprintf("%s.bnd", bundle.Name))
+	filePath := b.paths.BundleFile(bundle.Name)
 
 	// Check if the file already exists
 	if !helpers.FileExists(filePath, *b.logger) {
-		return fmt.Errorf("bundle %s does not exist", bundle.Name)
+		return protocol.Errorf(protocol.ErrBundleNotFound, "bundle %s does not exist", bundle.Name)
 	}
 
-	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
+	// Truncate, or a shorter encoding leaves the tail of the old one behind
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_TRUNC, 0644)
 	if err != nil {
 		return fmt.Errorf("error opening data file %s: %w", bundle.Name, err)
 	}
@@ -374,10 +314,12 @@ func (b *BundleStorageEngine) UpdateBundleFile(database *models.Database, bundle
 	convertedBundle := BundleToMap(bundle)
 
 	// Encode the bundle to BSON
-	encodedBundle, err := helpers.EncodeBSON(convertedBundle)
-	if err != nil {
+	buffer := helpers.GetBuffer()
+	defer helpers.PutBuffer(buffer)
+	if err := helpers.EncodeBSONTo(buffer, convertedBundle); err != nil {
 		return fmt.Errorf("error encoding bundle data: %w", err)
 	}
+	encodedBundle := buffer.Bytes()
 
 	// Write the encoded bundle to the file
 	fileLen, err := file.Write(encodedBundle)
@@ -389,7 +331,7 @@ func (b *BundleStorageEngine) UpdateBundleFile(database *models.Database, bundle
 		return fmt.Errorf("error writing to bundle data file %s: wrote %d bytes, expected %d", bundle.Name, fileLen, len(encodedBundle))
 	}
 
-	return nil
+	return b.syncer.Written(database, file)
 }
 
 func (b *BundleStorageEngine) UpdateDocumentDataInBundleFile(database *models.Database,
@@ -439,7 +381,7 @@ func (b *BundleStorageEngine) UpdateDocumentDataInBundleFile(database *models.Da
 	}
 
 	if !found {
-		return fmt.Errorf("document with ID %s not found in bundle", documentID)
+		return protocol.Errorf(protocol.ErrDocumentNotFound, "document with ID %s not found in bundle", documentID)
 	}
 
 	// Sync changes to the file
@@ -449,7 +391,7 @@ func (b *BundleStorageEngine) UpdateDocumentDataInBundleFile(database *models.Da
 	}
 
 	// Update the data file
-	filePath := filepath.Join(database.DataDirectory, fmt.Sprintf("%s.bnd", bundle.Name))
+	filePath := b.paths.BundleFile(bundle.Name)
 	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
 	if err != nil {
 		return fmt.Errorf("error opening bundle file for update: %w", err)
@@ -462,7 +404,7 @@ func (b *BundleStorageEngine) UpdateDocumentDataInBundleFile(database *models.Da
 		return fmt.Errorf("error writing updated data to file: %w", err)
 	}
 
-	return nil
+	return b.syncer.Written(database, file)
 }
 
 func (b *BundleStorageEngine) UpdateDocumentInBundleFile(bundle *models.Bundle, document *models.Document) error {
@@ -484,17 +426,11 @@ func (b *BundleStorageEngine) UpdateDocumentInBundleFile(bundle *models.Bundle,
 	}
 
 	// Find the file path for the bundle
-	args := settings.GetSettings()
-	dataDir := args.DataDir
-	if dataDir == "" {
-		return fmt.Errorf("bundle has no associated database directory")
-	}
-
-	filePath := filepath.Join(dataDir, fmt.Sprintf("%s.bnd", bundle.Name))
+	filePath := b.paths.BundleFile(bundle.Name)
 
 	// Check if the file exists
 	if !helpers.FileExists(filePath, *b.logger) {
-		return fmt.Errorf("bundle file %s does not exist", fmt.Sprintf("%s.bnd", bundle.Name))
+		return protocol.Errorf(protocol.ErrBundleNotFound, "bundle file %s does not exist", helpers.BundleFileName(bundle.Name))
 	}
 
 	// Update the document in the bundle in memory
@@ -529,14 +465,11 @@ func (b *BundleStorageEngine) DeleteDocumentFromBundleFile(bundle *models.Bundle
 		return fmt.Errorf("documentID cannot be nil")
 	}
 
-	args := settings.GetSettings()
-	dataDir := args.DataDir
-
 	if bundle.Documents == nil {
 		return fmt.Errorf("bundle %s has no documents. Cannot delete from nothing.", bundle.Name)
 	}
 
-	if args.Debug {
+	if b.debug {
 		b.logger.Infof("Attempting to delete document %s from bundle file", documentID)
 	}
 
@@ -547,11 +480,11 @@ func (b *BundleStorageEngine) DeleteDocumentFromBundleFile(bundle *models.Bundle
 		}
 	}
 
-	filePath := filepath.Join(dataDir, fmt.Sprintf("%s.bnd", bundle.Name))
+	filePath := b.paths.BundleFile(bundle.Name)
 
 	// Check if the file exists
 	if !helpers.FileExists(filePath, *b.logger) {
-		return fmt.Errorf("bundle file %s does not exist", fmt.Sprintf("%s.bnd", bundle.Name))
+		return protocol.Errorf(protocol.ErrBundleNotFound, "bundle file %s does not exist", helpers.BundleFileName(bundle.Name))
 	}
 
 	// Write bundle to file
@@ -582,17 +515,11 @@ func (b *BundleStorageEngine) AddDocumentToBundleFile(bundle *models.Bundle, doc
 	}
 
 	// Find the file path for the bundle
-	args := settings.GetSettings()
-	dataDir := args.DataDir
-	if dataDir == "" {
-		return fmt.Errorf("bundle has no associated database directory")
-	}
-
-	filePath := filepath.Join(dataDir, fmt.Sprintf("%s.bnd", bundle.Name))
+	filePath := b.paths.BundleFile(bundle.Name)
 
 	// Check if the file exists
 	if !helpers.FileExists(filePath, *b.logger) {
-		return fmt.Errorf("bundle file %s does not exist", fmt.Sprintf("%s.bnd", bundle.Name))
+		return protocol.Errorf(protocol.ErrBundleNotFound, "bundle file %s does not exist", helpers.BundleFileName(bundle.Name))
 	}
 
 	// Add the document to the bundle in memory
@@ -601,8 +528,14 @@ func (b *BundleStorageEngine) AddDocumentToBundleFile(bundle *models.Bundle, doc
 	}
 	bundle.Documents[document.DocumentID] = *document
 
-	// Write bundle to file
-	err := b.WriteBundleToFile(bundle, filePath)
+	// A new document only changes the partition that owns it
+	var err error
+	if bundle.Partitioning != nil {
+		partition := PartitionForDocument(bundle.Partitioning, document)
+		err = b.writePartitionFile(bundle, partition, b.paths.PartitionFile(bundle.Name, partition))
+	} else {
+		err = b.WriteBundleToFile(bundle, filePath)
+	}
 	if err != nil {
 		return err
 	}
@@ -663,7 +596,7 @@ func (b *BundleStorageEngine) RemoveDocumentFromBundleFile(database *models.Data
 	}
 
 	if !found {
-		return fmt.Errorf("document with ID %s not found in bundle", documentID)
+		return protocol.Errorf(protocol.ErrDocumentNotFound, "document with ID %s not found in bundle", documentID)
 	}
 
 	// Remove the document by shifting the data after it
@@ -676,7 +609,7 @@ func (b *BundleStorageEngine) RemoveDocumentFromBundleFile(database *models.Data
 		return fmt.Errorf("error unmapping memory: %w", err)
 	}
 
-	filePath := filepath.Join(database.DataDirectory, bundle.BundleID)
+	filePath := b.paths.BundleFile(bundle.Name)
 	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
 	if err != nil {
 		return fmt.Errorf("error opening bundle file for truncation: %w", err)
@@ -705,19 +638,14 @@ func (b *BundleStorageEngine) RemoveDocumentFromBundleFile(database *models.Data
 
 // WriteBundleToFile encodes a bundle and writes it to a file
 func (b *BundleStorageEngine) WriteBundleToFile(bundle *models.Bundle, filePath string) error {
+	if bundle.Partitioning != nil {
+		return b.writePartitionedBundle(bundle, filePath)
+	}
+
 	// 1. Convert the bundle to a map for BSON encoding
 	convertedBundle := BundleToMap(bundle)
 
-	// 2. Make sure Documents are included in the map
-	docMap := make(map[string]interface{})
-	for docID, doc := range bundle.Documents {
-		docMap[docID] = map[string]interface{}{
-			"Fields":    doc.Fields,
-			"CreatedAt": doc.CreatedAt,
-			"UpdatedAt": doc.UpdatedAt,
-		}
-	}
-	convertedBundle["Documents"] = docMap
+	// 2. The map holds the Documents, keyed by ID as MapToBundle reads them
 
 	// docs := make([]interface{}, 0, len(bundle.Documents))
 	// for _, doc := range bundle.Documents {
@@ -733,10 +661,12 @@ func (b *BundleStorageEngine) WriteBundleToFile(bundle *models.Bundle, filePath
 	// convertedBundle["Documents"] = docs
 
 	// 3. Encode the bundle to BSON
-	encodedBundle, err := helpers.EncodeBSON(convertedBundle)
-	if err != nil {
+	buffer := helpers.GetBuffer()
+	defer helpers.PutBuffer(buffer)
+	if err := helpers.EncodeBSONTo(buffer, convertedBundle); err != nil {
 		return fmt.Errorf("error encoding bundle data: %w", err)
 	}
+	encodedBundle := buffer.Bytes()
 
 	// 4. Open the file for writing
 	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_TRUNC, 0644)
@@ -755,6 +685,9 @@ func (b *BundleStorageEngine) WriteBundleToFile(bundle *models.Bundle, filePath
 		return fmt.Errorf("error writing to bundle file %s: wrote %d bytes, expected %d",
 			bundle.Name, fileLen, len(encodedBundle))
 	}
+	if err := b.syncer.Written(bundle.Database, file); err != nil {
+		return err
+	}
 
 	if b.logger != nil {
 		b.logger.Debugw("Successfully wrote bundle to file",
@@ -766,13 +699,154 @@ func (b *BundleStorageEngine) WriteBundleToFile(bundle *models.Bundle, filePath
 	return nil
 }
 
+// writePartitionedBundle writes the bundle file (schema only) and every partition file
+func (b *BundleStorageEngine) writePartitionedBundle(bundle *models.Bundle, filePath string) error {
+	buffer := helpers.GetBuffer()
+	defer helpers.PutBuffer(buffer)
+	if err := helpers.EncodeBSONTo(buffer, BundleToMap(bundle)); err != nil {
+		return fmt.Errorf("error encoding bundle data: %w", err)
+	}
+
+	err := b.writeFile(bundle.Database, filePath, buffer.Bytes())
+	if err != nil {
+		return fmt.Errorf("error writing to bundle data file %s: %w", bundle.Name, err)
+	}
+
+	for i := 0; i < bundle.Partitioning.PartitionCount; i++ {
+		err = b.writePartitionFile(bundle, i, b.paths.PartitionFile(bundle.Name, i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writePartitionFile writes the documents owned by one partition to its own file
+func (b *BundleStorageEngine) writePartitionFile(bundle *models.Bundle, partition int, filePath string) error {
+	buffer := helpers.GetBuffer()
+	defer helpers.PutBuffer(buffer)
+	if err := encodePartitionFile(buffer, bundle, partition); err != nil {
+		return err
+	}
+
+	err := b.writeFile(bundle.Database, filePath, buffer.Bytes())
+	if err != nil {
+		return fmt.Errorf("error writing partition file %s: %w", filePath, err)
+	}
+
+	if b.logger != nil {
+		b.logger.Debugw("Successfully wrote partition to file",
+			"bundle", bundle.Name,
+			"partition", partition)
+	}
+
+	return nil
+}
+
+// writeFile writes a file of database, as os.WriteFile does, and syncs it as its durability asks
+func (b *BundleStorageEngine) writeFile(database *models.Database, filePath string, data []byte) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := b.syncer.Written(database, file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// encodePartitionFile encodes the documents owned by one partition into buffer, as its file
+// holds them
+func encodePartitionFile(buffer *bytes.Buffer, bundle *models.Bundle, partition int) error {
+	documents := make(map[string]models.Document)
+	for docID, doc := range bundle.Documents {
+		if PartitionForDocument(bundle.Partitioning, &doc) == partition {
+			documents[docID] = doc
+		}
+	}
+
+	err := helpers.EncodeBSONTo(buffer, map[string]interface{}{
+		"FormatVersion": BundleFormatVersion,
+		"BundleID":      bundle.BundleID,
+		"Name":          bundle.Name,
+		"Partition":     partition,
+		"Documents":     documentsToMap(documents),
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding partition %d of bundle %s: %w", partition, bundle.Name, err)
+	}
+	return nil
+}
+
+// EncodeBundleFiles encodes a bundle as its files hold it, by file name: the bundle file and,
+// for a partitioned bundle, every partition file. Nothing is written; a catalog change
+// writes them.
+func (b *BundleStorageEngine) EncodeBundleFiles(bundle *models.Bundle) (map[string][]byte, error) {
+	encodedBundle, err := helpers.EncodeBSON(BundleToMap(bundle))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding bundle data: %w", err)
+	}
+	files := map[string][]byte{helpers.BundleFileName(bundle.Name): encodedBundle}
+
+	if bundle.Partitioning != nil {
+		for i := 0; i < bundle.Partitioning.PartitionCount; i++ {
+			// The catalog change keeps the encodings, so they get buffers of their own
+			encodedPartition := new(bytes.Buffer)
+			if err := encodePartitionFile(encodedPartition, bundle, i); err != nil {
+				return nil, err
+			}
+			files[helpers.PartitionFileName(bundle.Name, i)] = encodedPartition.Bytes()
+		}
+	}
+	return files, nil
+}
+
+// loadPartitionFiles reads every partition file of a bundle into bundle.Documents
+func (b *BundleStorageEngine) loadPartitionFiles(bundle *models.Bundle) error {
+	if bundle.Documents == nil {
+		bundle.Documents = make(map[string]models.Document)
+	}
+
+	for i := 0; i < bundle.Partitioning.PartitionCount; i++ {
+		fileName := helpers.PartitionFileName(bundle.Name, i)
+		data, err := os.ReadFile(b.paths.Path(fileName))
+		if err != nil {
+			return fmt.Errorf("error reading partition file %s: %w", fileName, err)
+		}
+
+		partitionData, err := helpers.DecodeBSON(data)
+		if err != nil {
+			return fmt.Errorf("error decoding partition file %s: %w", fileName, err)
+		}
+		if _, err := upgradeBundleMap(partitionData.(map[string]interface{}), fileName); err != nil {
+			return err
+		}
+
+		partition, err := MapToBundle(partitionData.(map[string]interface{}), *b.logger)
+		if err != nil {
+			return fmt.Errorf("error converting partition file %s: %w", fileName, err)
+		}
+
+		for docID, doc := range partition.Documents {
+			bundle.Documents[docID] = doc
+		}
+	}
+
+	return nil
+}
+
 func (b *BundleStorageEngine) RemoveBundleFile(database *models.Database, bundleName string) error {
-	// Create a new data file
-	filePath := filepath.Join(database.DataDirectory, bundleName)
+	filePath := b.paths.BundleFile(bundleName)
 
 	// Check if the file already exists
 	if !helpers.FileExists(filePath, *b.logger) {
-		return fmt.Errorf("Bundle %s does not exist", bundleName)
+		return protocol.Errorf(protocol.ErrBundleNotFound, "Bundle %s does not exist", bundleName)
 	}
 
 	err := os.Remove(filePath)
@@ -809,16 +883,63 @@ func (b *BundleStorageEngine) RemoveBundleFile(database *models.Database, bundle
 // }
 
 func BundleToMap(bundle *models.Bundle) map[string]interface{} {
-	return map[string]interface{}{
+	// Only reference the parent database; embedding it would recurse
+	// through Database.Bundles back into this bundle.
+	databaseName := ""
+	if bundle.Database != nil {
+		databaseName = bundle.Database.Name
+	}
+
+	bundleMap := map[string]interface{}{
+		"FormatVersion":     BundleFormatVersion,
 		"BundleID":          bundle.BundleID,
 		"Name":              bundle.Name,
-		"Database":          bundle.Database,
+		"Database":          databaseName,
 		"DocumentStructure": bundle.DocumentStructure,
 		"FieldDefinitions":  bundle.DocumentStructure.FieldDefinitions,
-		"Documents":         bundle.Documents,
+		"Documents":         documentsToMap(bundle.Documents),
 		"Relationships":     bundle.Relationships,
 		"Constraints":       bundle.Constraints,
 	}
+
+	if bundle.Partitioning != nil {
+		// Documents live in the partition files, not the bundle file
+		bundleMap["Documents"] = map[string]interface{}{}
+		bundleMap["Partitioning"] = PartitionSchemeToMap(bundle.Partitioning)
+	}
+
+	if bundle.FieldStatistics != nil {
+		bundleMap["FieldStatistics"] = FieldStatisticsToMap(bundle.FieldStatistics)
+	}
+
+	if len(bundle.Aggregates) > 0 {
+		bundleMap["Aggregates"] = AggregatesToMap(bundle.Aggregates)
+	}
+	if bundle.AggregateOf != "" {
+		bundleMap["AggregateOf"] = bundle.AggregateOf
+	}
+	if len(bundle.Webhooks) > 0 {
+		bundleMap["Webhooks"] = WebhooksToMap(bundle.Webhooks)
+	}
+	if bundle.Limits != (models.DocumentLimits{}) {
+		bundleMap["Limits"] = DocumentLimitsToMap(bundle.Limits)
+	}
+
+	return bundleMap
+}
+
+// documentsToMap keys documents by ID under the field names MapToBundle reads back;
+// encoding models.Document directly would lowercase them
+func documentsToMap(documents map[string]models.Document) map[string]interface{} {
+	docMap := make(map[string]interface{}, len(documents))
+	for docID, doc := range documents {
+		docMap[docID] = map[string]interface{}{
+			"Fields":    doc.Fields,
+			"CreatedAt": doc.CreatedAt,
+			"UpdatedAt": doc.UpdatedAt,
+		}
+	}
+	return docMap
 }
 
 func calculateDocumentOffset(data []byte, index int) (int, error) {
@@ -918,12 +1039,17 @@ func MapToBundle(data map[string]interface{}, logger zap.SugaredLogger) (*models
 			if fdMap, ok := fieldDefs.(map[string]interface{}); ok {
 				for key, val := range fdMap {
 					if fdData, ok := val.(map[string]interface{}); ok {
+						// The BSON encoder writes the struct's keys in lower case
+						defaultValue, exists := fdData["DefaultValue"]
+						if !exists {
+							defaultValue = fdData["defaultvalue"]
+						}
 						fd := models.FieldDefinition{
-							Name:         stringValue(fdData, "Name", ""),
-							Type:         stringValue(fdData, "Type", ""),
-							IsRequired:   boolValue(fdData, "IsRequired", false),
-							IsUnique:     boolValue(fdData, "IsUnique", false),
-							DefaultValue: fdData["DefaultValue"],
+							Name:         stringValue(fdData, "Name", stringValue(fdData, "name", key)),
+							Type:         stringValue(fdData, "Type", stringValue(fdData, "type", "")),
+							IsRequired:   boolValue(fdData, "IsRequired", boolValue(fdData, "isrequired", false)),
+							IsUnique:     boolValue(fdData, "IsUnique", boolValue(fdData, "isunique", false)),
+							DefaultValue: defaultValue,
 						}
 						bundle.DocumentStructure.FieldDefinitions[key] = fd
 					}
@@ -934,6 +1060,30 @@ func MapToBundle(data map[string]interface{}, logger zap.SugaredLogger) (*models
 		bundle.DocumentStructure.FieldDefinitions = make(map[string]models.FieldDefinition)
 	}
 
+	// Extract partitioning
+	if partitioning, ok := data["Partitioning"].(map[string]interface{}); ok {
+		bundle.Partitioning = MapToPartitionScheme(partitioning)
+	}
+	if limits, ok := data["Limits"].(map[string]interface{}); ok {
+		bundle.Limits = MapToDocumentLimits(limits)
+	}
+
+	// Extract field statistics
+	if fieldStatistics, ok := data["FieldStatistics"].(map[string]interface{}); ok {
+		bundle.FieldStatistics = MapToFieldStatistics(fieldStatistics)
+	}
+
+	// Extract aggregates
+	if aggregates, ok := data["Aggregates"]; ok {
+		bundle.Aggregates = MapToAggregates(aggregates)
+	}
+	bundle.AggregateOf = stringValue(data, "AggregateOf", "")
+
+	// Extract webhooks
+	if webhooks, ok := data["Webhooks"]; ok {
+		bundle.Webhooks = MapToWebhooks(webhooks)
+	}
+
 	logger.Infof("Processing bundle %s , going to load documents, with ID %s", bundle.Name, bundle.BundleID)
 
 	// Extract documents
@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syndrdb/src/helpers"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Crash torture for the catalog log.
+
+	TortureCatalogWAL checks that a catalog change happens whole or not at all, whatever write
+	a crash cuts short. A round commits a run of changes, each of which
+	  - writes a.json and b.json with the change's number (and padding of random length)
+	  - writes c.json with the number, or removes it every third change
+	  - renames r.odd to r.even or back, after the first change has written r.odd
+	with a crash armed at a byte offset the round's seed picks among the bytes the same
+	changes write without one (see helpers/crash_simulation.go). The log is then opened as at
+	startup, crashed as well half of the time and opened again. Afterwards the files must
+	show one change, no earlier than the last acknowledged one and no later than the one the
+	crash interrupted, which has happened once its record is logged.
+*/
+
+// catalogTortureRound is the work of one round, drawn from its seed
+type catalogTortureRound struct {
+	padding []int // Padding of each change's files, by change number - 1
+}
+
+// TortureCatalogWAL runs one crash torture round in dir. It reports whether the crash came
+// before the work ended, and an error when the files recovered are not consistent.
+func TortureCatalogWAL(dir string, seed int64, logger *zap.SugaredLogger) (bool, error) {
+	rng := rand.New(rand.NewSource(seed))
+	round := &catalogTortureRound{}
+	for i, count := 0, 1+rng.Intn(30); i < count; i++ {
+		round.padding = append(round.padding, rng.Intn(4096))
+	}
+
+	// An uninterrupted run counts the bytes the crash can cut at
+	helpers.ArmCrash(-1)
+	_, err := round.run(filepath.Join(dir, "uninterrupted"), logger)
+	total, _ := helpers.DisarmCrash()
+	if err != nil {
+		return false, fmt.Errorf("uninterrupted run failed: %w", err)
+	}
+
+	crashDir := filepath.Join(dir, "crashed")
+	helpers.ArmCrash(rng.Int63n(total + 1))
+	acknowledged, err := round.run(crashDir, logger)
+	_, crashed := helpers.DisarmCrash()
+	if err != nil {
+		return crashed, err
+	}
+
+	if rng.Intn(2) == 0 {
+		helpers.ArmCrash(rng.Int63n(total + 1))
+		OpenCatalogWAL(crashDir, logger)
+		helpers.DisarmCrash()
+	}
+	if _, err := OpenCatalogWAL(crashDir, logger); err != nil {
+		return crashed, fmt.Errorf("catalog log does not open after the crash: %w", err)
+	}
+	return crashed, round.verify(crashDir, acknowledged)
+}
+
+// run commits the changes, stopping at the first failure, and returns how many were
+// acknowledged. A change whose record was logged counts, though it was not applied yet.
+// Failures other than the simulated crash are returned.
+func (r *catalogTortureRound) run(dir string, logger *zap.SugaredLogger) (int, error) {
+	wal, err := OpenCatalogWAL(dir, logger)
+	if err != nil {
+		return 0, err
+	}
+	for change := 1; change <= len(r.padding); change++ {
+		tx := wal.Begin(fmt.Sprintf("torture change %d", change))
+		contents := r.contents(change)
+		tx.WriteFile("a.json", contents)
+		tx.WriteFile("b.json", contents)
+		if change%3 == 0 {
+			tx.RemoveFile("c.json")
+		} else {
+			tx.WriteFile("c.json", contents)
+		}
+		if change == 1 {
+			tx.WriteFile("r.odd", contents)
+		} else {
+			tx.RenameFile(renamedFile(change-1), renamedFile(change))
+		}
+
+		if err := tx.Commit(); err != nil {
+			if errors.Is(err, ErrCatalogChangePending) {
+				return change, nil
+			}
+			if errors.Is(err, helpers.ErrSimulatedCrash) {
+				return change - 1, nil
+			}
+			return change - 1, err
+		}
+	}
+	return len(r.padding), nil
+}
+
+// contents returns what a change writes
+func (r *catalogTortureRound) contents(change int) []byte {
+	return []byte(strconv.Itoa(change) + "\n" + strings.Repeat("x", r.padding[change-1]))
+}
+
+// renamedFile is the name the renamed file has after a change
+func renamedFile(change int) string {
+	if change%2 == 0 {
+		return "r.even"
+	}
+	return "r.odd"
+}
+
+// verify checks that the files show one change, acknowledged or interrupted
+func (r *catalogTortureRound) verify(dir string, acknowledged int) error {
+	read := func(name string) ([]byte, bool, error) {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return data, err == nil, err
+	}
+
+	a, exists, err := read("a.json")
+	if err != nil {
+		return err
+	}
+	change := 0
+	if exists {
+		number, _, _ := strings.Cut(string(a), "\n")
+		if change, err = strconv.Atoi(number); err != nil || change < 1 || change > len(r.padding) || string(a) != string(r.contents(change)) {
+			return fmt.Errorf("a.json holds no change's contents")
+		}
+	}
+	if change < acknowledged || change > acknowledged+1 {
+		return fmt.Errorf("files show change %d, but change %d was the last acknowledged", change, acknowledged)
+	}
+
+	expect := func(name string, want []byte) error {
+		data, exists, err := read(name)
+		switch {
+		case err != nil:
+			return err
+		case want == nil && exists:
+			return fmt.Errorf("%s exists after change %d", name, change)
+		case want != nil && !exists:
+			return fmt.Errorf("%s is missing after change %d", name, change)
+		case want != nil && string(data) != string(want):
+			return fmt.Errorf("%s does not hold change %d", name, change)
+		}
+		return nil
+	}
+
+	var b, c, odd, even []byte
+	if change > 0 {
+		b = r.contents(change)
+		if change%3 != 0 {
+			c = b
+		}
+		if renamedFile(change) == "r.odd" {
+			odd = r.contents(1)
+		} else {
+			even = r.contents(1)
+		}
+	}
+	for _, file := range []struct {
+		name string
+		want []byte
+	}{{"b.json", b}, {"c.json", c}, {"r.odd", odd}, {"r.even", even}} {
+		if err := expect(file.name, file.want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
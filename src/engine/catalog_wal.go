@@ -0,0 +1,249 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syndrdb/src/helpers"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Catalog write-ahead log.
+
+	A catalog change (creating, copying, adopting or dropping a bundle, creating an aggregate)
+	writes more than one file: the bundle file and the database file that lists it, and for
+	CLONE the file of another database. Written one after the other, a crash between
+	them leaves a database listing a bundle that does not exist, or a bundle no database lists.
+
+	Such changes are staged in a CatalogTx as complete file contents, removals and renames.
+	Commit writes them as one record to catalog.wal in the data directory and syncs it; from
+	then on the change has happened. It then applies each operation (a write goes to a
+	temporary file renamed over the old one) and empties the log. If the server stops before
+	the log is emptied, OpenCatalogWAL applies the record again at the next start, before any
+	database is loaded. Every operation can be applied twice with the same result. A record
+	cut short by a crash while it was written was never committed and is discarded.
+
+	Changes are committed one at a time, so the log holds at most one record.
+*/
+
+// Catalog operations
+const (
+	CatalogOpWrite  = "WRITE"
+	CatalogOpRemove = "REMOVE"
+	CatalogOpRename = "RENAME"
+)
+
+// ErrCatalogChangePending is returned by Commit for a change that was logged but could not be
+// applied yet. The change has happened: it is retried before the next change and at startup.
+var ErrCatalogChangePending = errors.New("catalog change is logged but not yet applied")
+
+// CatalogOp is one file operation of a catalog change. File names are relative to the data
+// directory.
+type CatalogOp struct {
+	Op   string
+	File string
+	To   string `json:",omitempty"` // New name for RENAME
+	Data []byte `json:",omitempty"` // New contents for WRITE
+}
+
+// catalogRecord is a committed catalog change as the log stores it
+type catalogRecord struct {
+	ID          uint64
+	Description string
+	Ops         []CatalogOp
+}
+
+// CatalogWAL commits catalog changes atomically
+type CatalogWAL struct {
+	mu      sync.Mutex
+	paths   *helpers.PathResolver
+	logger  *zap.SugaredLogger
+	nextID  uint64
+	pending *catalogRecord // Committed but not fully applied
+}
+
+// CatalogTx collects the file operations of one catalog change
+type CatalogTx struct {
+	wal         *CatalogWAL
+	description string
+	ops         []CatalogOp
+}
+
+// OpenCatalogWAL opens the catalog log of a data directory, finishing a change that was
+// committed but not applied when the server stopped
+func OpenCatalogWAL(dataDir string, logger *zap.SugaredLogger) (*CatalogWAL, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory %s: %w", dataDir, err)
+	}
+	w := &CatalogWAL{paths: helpers.NewPathResolver(dataDir), logger: logger, nextID: 1}
+
+	data, err := os.ReadFile(w.paths.CatalogWALFile())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read catalog log: %w", err)
+	}
+	if len(data) == 0 {
+		return w, nil
+	}
+
+	var record catalogRecord
+	if data[len(data)-1] != '\n' || json.Unmarshal(data, &record) != nil {
+		logger.Warnf("Discarding an incomplete catalog change from %s; it was never committed", helpers.CatalogWALFileName)
+		return w, w.clear()
+	}
+
+	w.nextID = record.ID + 1
+	if err := w.apply(&record); err != nil {
+		return nil, fmt.Errorf("failed to finish catalog change %d (%s): %w", record.ID, record.Description, err)
+	}
+	logger.Infof("Finished catalog change %d (%s) left over from the last run", record.ID, record.Description)
+	return w, w.clear()
+}
+
+// Begin starts collecting a catalog change; nothing is written until Commit
+func (w *CatalogWAL) Begin(description string) *CatalogTx {
+	return &CatalogTx{wal: w, description: description}
+}
+
+// WriteFile replaces a file's contents, creating it if needed
+func (t *CatalogTx) WriteFile(fileName string, data []byte) {
+	t.ops = append(t.ops, CatalogOp{Op: CatalogOpWrite, File: fileName, Data: data})
+}
+
+// RemoveFile removes a file; a file that does not exist is not an error
+func (t *CatalogTx) RemoveFile(fileName string) {
+	t.ops = append(t.ops, CatalogOp{Op: CatalogOpRemove, File: fileName})
+}
+
+// RenameFile gives a file a new name
+func (t *CatalogTx) RenameFile(fileName, to string) {
+	t.ops = append(t.ops, CatalogOp{Op: CatalogOpRename, File: fileName, To: to})
+}
+
+// Commit makes every operation of the change happen, or, when it fails before the change is
+// logged, none of them. A logged change that cannot be applied now fails with
+// ErrCatalogChangePending and is finished later.
+func (t *CatalogTx) Commit() error {
+	w := t.wal
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pending != nil {
+		if err := w.apply(w.pending); err != nil {
+			return fmt.Errorf("catalog change %d (%s) is not finished: %w", w.pending.ID, w.pending.Description, err)
+		}
+		w.pending = nil
+		if err := w.clear(); err != nil {
+			return err
+		}
+	}
+
+	record := &catalogRecord{ID: w.nextID, Description: t.description, Ops: t.ops}
+	w.nextID++
+	if err := w.log(record); err != nil {
+		return err
+	}
+
+	if err := w.apply(record); err != nil {
+		w.pending = record
+		return fmt.Errorf("%w: '%s': %w", ErrCatalogChangePending, t.description, err)
+	}
+	return w.clear()
+}
+
+// log writes a record to the log and syncs it
+func (w *CatalogWAL) log(record *catalogRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog change: %w", err)
+	}
+	data = append(data, '\n')
+
+	file, err := os.OpenFile(w.paths.CatalogWALFile(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open catalog log: %w", err)
+	}
+	defer file.Close()
+	if _, err := helpers.Write(file, data); err != nil {
+		return fmt.Errorf("failed to write catalog log: %w", err)
+	}
+	if err := helpers.Sync(file); err != nil {
+		return fmt.Errorf("failed to sync catalog log: %w", err)
+	}
+	return nil
+}
+
+// clear empties the log once its record has been applied
+func (w *CatalogWAL) clear() error {
+	if err := helpers.TruncatePath(w.paths.CatalogWALFile(), 0); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear catalog log: %w", err)
+	}
+	return nil
+}
+
+// apply carries out the operations of a record
+func (w *CatalogWAL) apply(record *catalogRecord) error {
+	for _, op := range record.Ops {
+		path := w.paths.Path(op.File)
+		switch op.Op {
+		case CatalogOpWrite:
+			if err := writeFileAtomically(path, op.Data); err != nil {
+				return err
+			}
+		case CatalogOpRemove:
+			if err := helpers.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error removing %s: %w", op.File, err)
+			}
+			if dir := filepath.Dir(path); dir != filepath.Clean(w.paths.DataDir()) {
+				os.Remove(dir) // A namespace goes with its last bundle; fails while others are left
+			}
+		case CatalogOpRename:
+			err := helpers.Rename(path, w.paths.Path(op.To))
+			if errors.Is(err, os.ErrNotExist) {
+				// Renamed before the last run stopped
+				if _, statErr := os.Stat(w.paths.Path(op.To)); statErr == nil {
+					err = nil
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("error renaming %s to %s: %w", op.File, op.To, err)
+			}
+		default:
+			return fmt.Errorf("unknown catalog operation '%s' on %s", op.Op, op.File)
+		}
+	}
+	helpers.SyncDirectory(w.paths.DataDir())
+	return nil
+}
+
+// writeFileAtomically replaces a file so that it holds either its old or its new contents
+func writeFileAtomically(path string, data []byte) error {
+	// Files of bundles in a namespace live in the namespace's directory
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %s: %w", filepath.Base(path), err)
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", filepath.Base(tmp), err)
+	}
+	if _, err := helpers.Write(file, data); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing %s: %w", filepath.Base(tmp), err)
+	}
+	if err := helpers.Sync(file); err != nil {
+		file.Close()
+		return fmt.Errorf("error syncing %s: %w", filepath.Base(tmp), err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing %s: %w", filepath.Base(tmp), err)
+	}
+	if err := helpers.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error replacing %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
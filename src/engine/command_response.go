@@ -1,6 +1,11 @@
 package engine
 
+import "syndrdb/src/protocol"
+
 type CommandResponse struct {
 	ResultCount int
 	Result      interface{}
+	Notices     []string           `json:",omitempty"` // Server notices queued for the client, such as maintenance
+	NextKey     string             `json:",omitempty"` // Continuation token for AFTER KEY when LIMIT filled the page, see keyset.go
+	Metadata    *protocol.Metadata `json:"-"`          // Declared fields of the documents returned, see result_metadata.go
 }
@@ -33,98 +33,23 @@ DELETE RELATIONSHIP "RELATIONSHIP_NAME"
 package engine
 
 import (
-	"fmt"
 	"regexp"
 	"strings"
-	"syndrdb/src/helpers"
-	"syndrdb/src/settings"
-
-	"go.uber.org/zap"
+	"syndrdb/src/models"
 )
 
 type DatabaseCommand struct {
-	ID                 string
-	CommandType        string // CREATE, UPDATE, DELETE
-	DatabaseName       string
-	DBMetadataFilePath string
-}
-
-func ParseCreateDatabaseCommand(command string, logger *zap.SugaredLogger) (*DatabaseCommand, error) {
-	args := settings.GetSettings()
-	// Regular expression to extract database name
-	databaseNameRegex := regexp.MustCompile(`CREATE DATABASE\s+(?:"([^"]+)"|([^\s;]+))`)
-	matches := databaseNameRegex.FindStringSubmatch(command)
-	if len(matches) < 2 {
-		logger.Infof("Invalid CREATE DATABASE command syntax: %s", command)
-		logger.Infof("Matches found: %v", matches)
-
-		return nil, fmt.Errorf("invalid CREATE DATABASE command syntax")
-	}
-
-	// The database name could be in group 1 (with quotes) or group 2 (without quotes)
-	var databaseName string
-	if matches[1] != "" {
-		databaseName = matches[1] // Quoted name
-	} else {
-		databaseName = matches[2] // Unquoted name
-	}
+	ID           string
+	CommandType  string // CREATE, UPDATE, DELETE
+	DatabaseName string
 
-	return &DatabaseCommand{
-		ID:                 helpers.GenerateUUID(), // Generate a unique ID for the command
-		DatabaseName:       databaseName,
-		DBMetadataFilePath: args.DataDir, // Placeholder for actual metadata file path
-		CommandType:        "CREATE",
-	}, nil
-}
-
-func ParseUpdateDatabaseCommand(command string) (*DatabaseCommand, error) {
-	// Regular expression to extract database name
-	databaseNameRegex := regexp.MustCompile(`UPDATE DATABASE\s+"([^"]+)"`)
-	matches := databaseNameRegex.FindStringSubmatch(command)
-	if len(matches) < 2 {
-		return nil, fmt.Errorf("invalid UPDATE DATABASE command syntax")
-	}
-	databaseName := matches[1]
-
-	return &DatabaseCommand{
+	// DefaultLimits is set by a DEFAULT LIMITS clause, in CREATE DATABASE or UPDATE DATABASE ... SET
+	DefaultLimits *models.DocumentLimits
 
-		DatabaseName:       databaseName,
-		DBMetadataFilePath: "path/to/metadata/file", // Placeholder for actual metadata file path
-		CommandType:        "UPDATE",
-	}, nil
+	// Durability is set by a DURABILITY clause, in CREATE DATABASE or UPDATE DATABASE ... SET
+	Durability models.Durability
 }
 
-func ParseDeleteDatabaseCommand(command string) (*DatabaseCommand, error) {
-	// Regular expression to extract database name
-	databaseNameRegex := regexp.MustCompile(`DELETE DATABASE\s+"([^"]+)"`)
-	matches := databaseNameRegex.FindStringSubmatch(command)
-	if len(matches) < 2 {
-		return nil, fmt.Errorf("invalid DELETE DATABASE command syntax")
-	}
-	databaseName := matches[1]
-
-	return &DatabaseCommand{
-		DatabaseName: databaseName,
-		CommandType:  "DELETE",
-	}, nil
-}
-
-func ParseSelectDatabaseCommand(command string) (*DatabaseCommand, error) {
-	// Regular expression to extract database name
-	databaseNameRegex := regexp.MustCompile(`SELECT DATABASES\s+"([^"]+)"`)
-	matches := databaseNameRegex.FindStringSubmatch(command)
-	if len(matches) < 2 {
-		return nil, fmt.Errorf("invalid SELECT DATABASES command syntax")
-	}
-	databaseName := matches[1]
-
-	return &DatabaseCommand{
-		DatabaseName: databaseName,
-		CommandType:  "SELECT",
-	}, nil
-}
-
-// parseBool converts string "true"/"false" to bool
 func parseBool(value string) bool {
 	value = strings.ToLower(strings.TrimSpace(value))
 	return value == "true"
@@ -138,15 +63,14 @@ func IsValidDatabaseName(name string) bool {
 }
 func IsValidBundleName(name string) bool {
 	// Regular expression to validate bundle name
-	// Must start with a letter, can contain letters, numbers, underscores, and hyphens
-	validNameRegex := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+	// Must start with a letter, can contain letters, numbers, underscores, and hyphens, and may
+	// be qualified with a namespace named the same way: namespace.bundle
+	validNameRegex := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*(\.[a-zA-Z][a-zA-Z0-9_-]*)?$`)
 	return validNameRegex.MatchString(name)
 }
 func IsValidFieldName(name string) bool {
-	// Regular expression to validate field name
-	// Must start with a letter, can contain letters, numbers, underscores, and hyphens
-	validNameRegex := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
-	return validNameRegex.MatchString(name)
+	// A plain name; see field_names.go for the rules and backquoted names
+	return CheckFieldName(name, false) == nil
 }
 func IsValidRelationshipName(name string) bool {
 	// Regular expression to validate relationship name
@@ -1,32 +1,37 @@
 package engine
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 	"syndrdb/src/helpers"
 	"syndrdb/src/models"
-	"syndrdb/src/settings"
+	"syndrdb/src/protocol"
 	"syscall"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
 )
 
-// DatabaseStore defines the interface for database storage operations
+// DatabaseStore defines the interface for database storage operations. Reads stop when their
+// ctx is canceled; writes take none, as for BundleStore.
 type DatabaseStore interface {
-	LoadAllDatabaseDataFiles(dataRootDir string) (map[string]*models.Database, error)
+	LoadAllDatabaseDataFiles(ctx context.Context, dataRootDir string) (map[string]*models.Database, error)
 
-	LoadDatabaseDataFile(dataRootDir, fileName string) (*models.Database, error)
+	LoadDatabaseDataFile(ctx context.Context, dataRootDir, fileName string) (*models.Database, error)
 
-	LoadDatabaseIntoMemory(database *models.Database, databaseName string) (*[]byte, *models.Database, error)
+	LoadDatabaseIntoMemory(ctx context.Context, database *models.Database, databaseName string) (*[]byte, *models.Database, error)
 
 	CreateDatabaseDataFile(database *models.Database) error
 
 	UpdateDatabaseDataFile(database *models.Database) error
 
+	// EncodeDatabaseFile returns the contents of a database's file, for a catalog change
+	EncodeDatabaseFile(database *models.Database) ([]byte, error)
+
 	// GetByID(id string) (*Database, bool)
 	// GetByName(name string) (*Database, bool)
 	// Add(db *Database) error
@@ -37,6 +42,8 @@ type DatabaseStore interface {
 
 type DatabaseStorageEngine struct {
 	DataDirectory string
+	paths         *helpers.PathResolver
+	debug         bool // Logs each database file loaded, as -debug asks
 	logger        *zap.SugaredLogger
 }
 
@@ -45,10 +52,12 @@ type DatabaseFactory interface {
 	NewDatabase(name, description string) *models.Database
 }
 
-func NewDatabaseStore(dataDir string, logger *zap.SugaredLogger) (*DatabaseStorageEngine, error) {
+func NewDatabaseStore(dataDir string, debug bool, logger *zap.SugaredLogger) (*DatabaseStorageEngine, error) {
 	// Create a new database store
 	store := &DatabaseStorageEngine{
 		DataDirectory: dataDir,
+		paths:         helpers.NewPathResolver(dataDir),
+		debug:         debug,
 		logger:        logger,
 	}
 
@@ -61,7 +70,7 @@ func NewDatabaseStore(dataDir string, logger *zap.SugaredLogger) (*DatabaseStora
 }
 
 // LoadAllDatabaseDataFiles scans the data directory and loads all database metadata files
-func (d *DatabaseStorageEngine) LoadAllDatabaseDataFiles(dataRootDir string) (map[string]*models.Database, error) {
+func (d *DatabaseStorageEngine) LoadAllDatabaseDataFiles(ctx context.Context, dataRootDir string) (map[string]*models.Database, error) {
 	// Create map to hold databases
 	databases := make(map[string]*models.Database)
 
@@ -84,12 +93,15 @@ func (d *DatabaseStorageEngine) LoadAllDatabaseDataFiles(dataRootDir string) (ma
 		}
 
 		// Check file extension if you have a specific extension for database files
-		if !strings.HasSuffix(file.Name(), ".db") {
+		if !strings.HasSuffix(file.Name(), helpers.DatabaseFileExt) {
 			continue
 		}
 
 		// Load the database
-		db, err := d.LoadDatabaseDataFile(dataRootDir, file.Name())
+		db, err := d.LoadDatabaseDataFile(ctx, dataRootDir, file.Name())
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if err != nil {
 			log.Printf("Warning: Failed to load database from %s: %v", file.Name(), err)
 			continue
@@ -109,10 +121,11 @@ func (d *DatabaseStorageEngine) LoadAllDatabaseDataFiles(dataRootDir string) (ma
 }
 
 // LoadDatabaseDataFile loads a single database metadata file
-func (d *DatabaseStorageEngine) LoadDatabaseDataFile(dataRootDir, fileName string) (*models.Database, error) {
-	args := settings.GetSettings()
-
-	fullPath := filepath.Join(dataRootDir, fileName)
+func (d *DatabaseStorageEngine) LoadDatabaseDataFile(ctx context.Context, dataRootDir, fileName string) (*models.Database, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fullPath := helpers.NewPathResolver(dataRootDir).Path(fileName)
 
 	// Open the file
 	dbFile, err := os.Open(fullPath)
@@ -146,7 +159,7 @@ func (d *DatabaseStorageEngine) LoadDatabaseDataFile(dataRootDir, fileName strin
 		return nil, fmt.Errorf("error decoding database data: %w", err)
 	}
 
-	if args.Debug {
+	if d.debug {
 		log.Printf("Loaded database metadata from file %s: %v", fileName, dbMap)
 	}
 
@@ -156,16 +169,18 @@ func (d *DatabaseStorageEngine) LoadDatabaseDataFile(dataRootDir, fileName strin
 		return nil, fmt.Errorf("error converting map to Database: %w", err)
 	}
 
-	// Set the data directory if it's not already set
-	if db.DataDirectory == "" {
-		db.DataDirectory = dataRootDir
-	}
+	// A database's files are wherever its catalog file was found, whatever directory it was
+	// created in
+	db.DataDirectory = dataRootDir
 
 	return db, nil
 }
 
-func (d *DatabaseStorageEngine) LoadDatabaseIntoMemory(database *models.Database, databaseName string) (*[]byte, *models.Database, error) {
-	dbFile, err := helpers.OpenDataFile(database.DataDirectory, databaseName)
+func (d *DatabaseStorageEngine) LoadDatabaseIntoMemory(ctx context.Context, database *models.Database, databaseName string) (*[]byte, *models.Database, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	dbFile, err := helpers.OpenDataFile(d.paths.DataDir(), helpers.DatabaseFileName(databaseName))
 	if err != nil {
 		return nil, nil, fmt.Errorf("error opening database file %s: %w", databaseName, err)
 	}
@@ -203,11 +218,11 @@ func (d *DatabaseStorageEngine) LoadDatabaseIntoMemory(database *models.Database
 
 func (d *DatabaseStorageEngine) CreateDatabaseDataFile(database *models.Database) error {
 	// Create a new data file
-	filePath := filepath.Join(database.DataDirectory, fmt.Sprintf("%s.db", database.Name))
+	filePath := d.paths.DatabaseFile(database.Name)
 
 	// Check if the file already exists
 	if helpers.FileExists(filePath, *d.logger) {
-		return fmt.Errorf("Database %s already exists", database.Name)
+		return protocol.Errorf(protocol.ErrAlreadyExists, "Database %s already exists", database.Name)
 	}
 
 	d.logger.Infof("Creating database file %s", filePath)
@@ -224,10 +239,12 @@ func (d *DatabaseStorageEngine) CreateDatabaseDataFile(database *models.Database
 	convertedDatabase := DBToMap(database)
 
 	// Encode the db to BSON
-	encodedDB, err := helpers.EncodeBSON(convertedDatabase)
-	if err != nil {
+	buffer := helpers.GetBuffer()
+	defer helpers.PutBuffer(buffer)
+	if err := helpers.EncodeBSONTo(buffer, convertedDatabase); err != nil {
 		return fmt.Errorf("error encoding bundle data: %w", err)
 	}
+	encodedDB := buffer.Bytes()
 
 	// Write the encoded db to the file
 	fileLen, err := file.Write(encodedDB)
@@ -244,11 +261,11 @@ func (d *DatabaseStorageEngine) CreateDatabaseDataFile(database *models.Database
 
 func (d *DatabaseStorageEngine) UpdateDatabaseDataFile(database *models.Database) error {
 	// Create a new data file
-	filePath := filepath.Join(database.DataDirectory, fmt.Sprintf("%s.db", database.Name))
+	filePath := d.paths.DatabaseFile(database.Name)
 
 	// Check if the file already exists
 	if !helpers.FileExists(filePath, *d.logger) {
-		return fmt.Errorf("Database %s does not exist", filePath)
+		return protocol.Errorf(protocol.ErrDatabaseNotFound, "Database %s does not exist", filePath)
 	}
 
 	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_TRUNC, 0644)
@@ -261,10 +278,12 @@ func (d *DatabaseStorageEngine) UpdateDatabaseDataFile(database *models.Database
 	convertedDatabase := DBToMap(database)
 
 	// Encode the db to BSON
-	encodedDB, err := helpers.EncodeBSON(convertedDatabase)
-	if err != nil {
+	buffer := helpers.GetBuffer()
+	defer helpers.PutBuffer(buffer)
+	if err := helpers.EncodeBSONTo(buffer, convertedDatabase); err != nil {
 		return fmt.Errorf("error encoding bundle data: %w", err)
 	}
+	encodedDB := buffer.Bytes()
 
 	// Write the encoded db to the file
 	fileLen, err := file.Write(encodedDB)
@@ -279,15 +298,35 @@ func (d *DatabaseStorageEngine) UpdateDatabaseDataFile(database *models.Database
 	return nil
 }
 
+// EncodeDatabaseFile encodes a database as its file holds it, without writing it
+func (d *DatabaseStorageEngine) EncodeDatabaseFile(database *models.Database) ([]byte, error) {
+	encodedDB, err := helpers.EncodeBSON(DBToMap(database))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding database %s: %w", database.Name, err)
+	}
+	return encodedDB, nil
+}
+
 func DBToMap(database *models.Database) map[string]interface{} {
+	// Bundles point back at their database, so drop that reference or encoding never terminates
+	bundles := make(map[string]models.Bundle, len(database.Bundles))
+	for name, bundle := range database.Bundles {
+		bundle.Database = nil
+		bundles[name] = bundle
+	}
+
 	// Convert the database object to a map
 	return map[string]interface{}{
 		"DatabaseID":    database.DatabaseID,
 		"Name":          database.Name,
 		"Description":   database.Description,
 		"BundleFiles":   database.BundleFiles,
-		"Bundles":       database.Bundles,
+		"Bundles":       bundles,
 		"DataDirectory": database.DataDirectory,
+		"Defaults": map[string]interface{}{
+			"Limits": DocumentLimitsToMap(database.Defaults.Limits),
+		},
+		"Durability": string(database.Durability),
 	}
 }
 
@@ -326,13 +365,26 @@ func MapToDB(data interface{}) (*models.Database, error) {
 	if dir, ok := dbMap["DataDirectory"].(string); ok {
 		db.DataDirectory = dir
 	}
+	if defaults, ok := dbMap["Defaults"].(map[string]interface{}); ok {
+		if limits, ok := defaults["Limits"].(map[string]interface{}); ok {
+			db.Defaults.Limits = MapToDocumentLimits(limits)
+		}
+	}
+	if durability, ok := dbMap["Durability"].(string); ok {
+		db.Durability = models.Durability(durability)
+	}
 
-	// Extract bundle files map
-	if bundleFilesInterface, ok := dbMap["BundleFiles"].([]interface{}); ok {
-		for _, pathInterface := range bundleFilesInterface {
-			if pathStr, ok := pathInterface.(string); ok {
-				db.BundleFiles = append(db.BundleFiles, pathStr)
-			}
+	// Extract bundle files map; BSON decodes arrays as primitive.A
+	var bundleFilesInterface []interface{}
+	switch files := dbMap["BundleFiles"].(type) {
+	case primitive.A:
+		bundleFilesInterface = files
+	case []interface{}:
+		bundleFilesInterface = files
+	}
+	for _, pathInterface := range bundleFilesInterface {
+		if pathStr, ok := pathInterface.(string); ok {
+			db.BundleFiles = append(db.BundleFiles, pathStr)
 		}
 	}
 
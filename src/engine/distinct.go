@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"sort"
+	"syndrdb/src/models"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Distinct values.
+
+	SELECT DISTINCT <field> FROM <bundle> [WHERE ...] returns each value of a field once, in
+	ascending order. When a B-tree index leads with the field, the values come from the
+	index: without a WHERE clause no document is read at all, and with one each value is
+	kept as soon as one of its documents matches. Otherwise the matching documents are read
+	and their values collected in a hash set. Documents without the field, or with a null
+	in it, add nothing. Values are told apart as index keys are, so 5 and 5.0 are one value.
+*/
+
+// DistinctValues returns the distinct values of a field among the documents a WHERE
+// condition matches; a nil condition matches every document
+func DistinctValues(bundle *models.Bundle, field string, whereGroup *WhereGroup, whereClause string, logger *zap.SugaredLogger) ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	if index, found := distinctIndex(bundle, field); found {
+		logger.Debugf("DISTINCT %s on bundle '%s' scans index '%s'", field, bundle.Name, index.IndexName)
+		recordIndexUse(bundle, index.IndexName)
+		for _, entry := range postingsFor(bundle, index).leading {
+			if entry.value != nil && (whereGroup == nil || anyMatches(bundle, entry.docIDs, whereGroup, logger)) {
+				values = append(values, entry.value)
+			}
+		}
+	} else {
+		documents, err := FilterDocuments(bundle, whereClause, logger)
+		if err != nil {
+			return nil, err
+		}
+		values = DistinctFieldValues(documents, field)
+	}
+
+	sortValues(values)
+	return values, nil
+}
+
+// DistinctFieldValues collects the distinct values of a field among documents in a hash set
+func DistinctFieldValues(documents []*models.Document, field string) []interface{} {
+	seen := make(map[string]bool)
+	values := make([]interface{}, 0)
+	for _, doc := range documents {
+		value := documentFieldValue(doc, field)
+		if value == nil {
+			continue
+		}
+		if key := indexKey(value); !seen[key] {
+			seen[key] = true
+			values = append(values, value)
+		}
+	}
+	sortValues(values)
+	return values
+}
+
+// distinctIndex finds a B-tree index whose first field is the given one, by name so the
+// choice is stable
+func distinctIndex(bundle *models.Bundle, field string) (models.IndexReference, bool) {
+	names := make([]string, 0, len(bundle.Indexes))
+	for name, index := range bundle.Indexes {
+		if index.IndexType == "btree" && len(index.Fields) > 0 && index.Fields[0].Name == field {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return models.IndexReference{}, false
+	}
+	sort.Strings(names)
+	return bundle.Indexes[names[0]], true
+}
+
+// anyMatches reports whether one of the documents matches the condition, stopping at the first
+func anyMatches(bundle *models.Bundle, docIDs []string, whereGroup *WhereGroup, logger *zap.SugaredLogger) bool {
+	for _, docID := range docIDs {
+		if doc, exists := bundle.Documents[docID]; exists && EvaluateWhereClause(&doc, whereGroup, logger) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortValues(values []interface{}) {
+	sort.SliceStable(values, func(i, j int) bool { return CompareOrderedValues(values[i], values[j]) < 0 })
+}
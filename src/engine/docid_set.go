@@ -0,0 +1,102 @@
+package engine
+
+import "sort"
+
+// DocIDSet is an immutable sorted set of DocumentIDs. Index lookups return one, and the
+// planner combines them with Intersect for AND and Union for OR before any document is read.
+type DocIDSet struct {
+	ids []string
+}
+
+// NewDocIDSet builds a set from DocumentIDs in any order, dropping duplicates
+func NewDocIDSet(ids []string) DocIDSet {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	unique := sorted[:0]
+	for i, id := range sorted {
+		if i == 0 || id != sorted[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return DocIDSet{ids: unique}
+}
+
+// sortedDocIDSet wraps IDs that are already sorted and unique without copying them
+func sortedDocIDSet(ids []string) DocIDSet {
+	return DocIDSet{ids: ids}
+}
+
+// Len returns the number of DocumentIDs in the set
+func (s DocIDSet) Len() int {
+	return len(s.ids)
+}
+
+// IDs returns the DocumentIDs in sorted order. The slice must not be modified.
+func (s DocIDSet) IDs() []string {
+	return s.ids
+}
+
+// Contains reports whether a DocumentID is in the set
+func (s DocIDSet) Contains(id string) bool {
+	i := sort.SearchStrings(s.ids, id)
+	return i < len(s.ids) && s.ids[i] == id
+}
+
+// Intersect returns the DocumentIDs present in both sets. When one set is much smaller
+// its IDs are binary searched in the other instead of merging both.
+func (s DocIDSet) Intersect(other DocIDSet) DocIDSet {
+	small, large := s.ids, other.ids
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+	result := make([]string, 0, len(small))
+
+	if len(small)*16 < len(large) {
+		for _, id := range small {
+			i := sort.SearchStrings(large, id)
+			if i < len(large) && large[i] == id {
+				result = append(result, id)
+			}
+			large = large[i:]
+		}
+		return DocIDSet{ids: result}
+	}
+
+	for i, j := 0, 0; i < len(small) && j < len(large); {
+		switch {
+		case small[i] < large[j]:
+			i++
+		case small[i] > large[j]:
+			j++
+		default:
+			result = append(result, small[i])
+			i++
+			j++
+		}
+	}
+	return DocIDSet{ids: result}
+}
+
+// Union returns the DocumentIDs present in either set
+func (s DocIDSet) Union(other DocIDSet) DocIDSet {
+	a, b := s.ids, other.ids
+	result := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	result = append(result, b[j:]...)
+	return DocIDSet{ids: result}
+}
@@ -20,9 +20,13 @@ func NewDocumentFactory() DocumentFactory {
 
 func (f *DocumentFactoryImpl) NewDocument(docCommand DocumentCommand) *models.Document {
 	now := time.Now()
+	documentID := docCommand.DocumentID
+	if documentID == "" {
+		documentID = helpers.GenerateUUID()
+	}
 
 	newDoc := &models.Document{
-		DocumentID: helpers.GenerateUUID(),
+		DocumentID: documentID,
 		Fields:     f.MakeDocumentFields(docCommand),
 		CreatedAt:  now,
 		UpdatedAt:  now,
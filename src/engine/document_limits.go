@@ -0,0 +1,41 @@
+package engine
+
+import "syndrdb/src/models"
+
+// DocumentLimitsToMap prepares a bundle's document limits for the bundle file
+func DocumentLimitsToMap(limits models.DocumentLimits) map[string]interface{} {
+	return map[string]interface{}{
+		"MaxBytes":  limits.MaxBytes,
+		"MaxFields": limits.MaxFields,
+		"MaxDepth":  limits.MaxDepth,
+	}
+}
+
+// InheritLimits fills in the limits a bundle leaves at zero with its database's defaults
+func InheritLimits(limits, defaults models.DocumentLimits) models.DocumentLimits {
+	if limits.MaxBytes == 0 {
+		limits.MaxBytes = defaults.MaxBytes
+	}
+	if limits.MaxFields == 0 {
+		limits.MaxFields = defaults.MaxFields
+	}
+	if limits.MaxDepth == 0 {
+		limits.MaxDepth = defaults.MaxDepth
+	}
+	return limits
+}
+
+// MapToDocumentLimits restores document limits decoded from BSON
+func MapToDocumentLimits(data map[string]interface{}) models.DocumentLimits {
+	limits := models.DocumentLimits{}
+	if maxBytes, ok := numericValue(data["MaxBytes"]); ok {
+		limits.MaxBytes = int64(maxBytes)
+	}
+	if maxFields, ok := numericValue(data["MaxFields"]); ok {
+		limits.MaxFields = int(maxFields)
+	}
+	if maxDepth, ok := numericValue(data["MaxDepth"]); ok {
+		limits.MaxDepth = int(maxDepth)
+	}
+	return limits
+}
@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Durability.
+
+	Each database says when writes to its bundle files are synced to disk, so a cache-like
+	database can trade durability for speed while another syncs every commit:
+
+	    ALWAYS    each file is synced before the write returns, so a command's changes, and a
+	              transaction's at COMMIT, survive the machine going down once it has answered
+	    INTERVAL  the files written are synced every -syncinterval, so at most that much is lost
+	    OFF       syncing is left to the operating system
+
+	A database that sets none has the server's -durability. Only the machine going down, or
+	the disk being pulled, loses anything: a crash of the server itself leaves its writes with
+	the operating system in every mode.
+*/
+
+// ParseDurability returns the durability a DURABILITY clause or -durability names
+func ParseDurability(name string) (models.Durability, error) {
+	switch durability := models.Durability(strings.ToUpper(strings.TrimSpace(name))); durability {
+	case models.DurabilityAlways, models.DurabilityInterval, models.DurabilityOff:
+		return durability, nil
+	}
+	return "", fmt.Errorf("unknown durability %q: expected ALWAYS, INTERVAL or OFF", name)
+}
+
+// FileSyncer syncs the files written for each database as its durability asks. It is safe
+// for concurrent use.
+type FileSyncer struct {
+	durability models.Durability // For databases that set none
+	interval   time.Duration
+	logger     *zap.SugaredLogger
+
+	mu      sync.Mutex
+	pending map[string]struct{} // Paths written under INTERVAL since they were last synced
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+// NewFileSyncer returns a FileSyncer that syncs the files of databases at INTERVAL every
+// interval, until it is closed
+func NewFileSyncer(durability models.Durability, interval time.Duration, logger *zap.SugaredLogger) *FileSyncer {
+	fs := &FileSyncer{
+		durability: durability,
+		interval:   interval,
+		logger:     logger,
+		pending:    make(map[string]struct{}),
+		stop:       make(chan struct{}),
+	}
+	if interval > 0 {
+		go helpers.Supervise(logger, "file sync", fs.syncEvery)
+	}
+	return fs
+}
+
+// Durability returns the durability writes to a database's files get; a nil database, as
+// for a bundle not yet attached to one, gets the server's
+func (fs *FileSyncer) Durability(database *models.Database) models.Durability {
+	if database != nil && database.Durability != "" {
+		return database.Durability
+	}
+	return fs.durability
+}
+
+// Written is called once a file of database has been written, before it is closed. At
+// ALWAYS it syncs the file; at INTERVAL the file is synced at the next tick.
+func (fs *FileSyncer) Written(database *models.Database, file *os.File) error {
+	switch fs.Durability(database) {
+	case models.DurabilityAlways:
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("error syncing %s: %w", file.Name(), err)
+		}
+	case models.DurabilityInterval:
+		fs.mu.Lock()
+		fs.pending[file.Name()] = struct{}{}
+		fs.mu.Unlock()
+	}
+	return nil
+}
+
+// Pending returns how many files wait for the next interval sync
+func (fs *FileSyncer) Pending() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return len(fs.pending)
+}
+
+// SyncPending syncs the files written at INTERVAL since their last sync. A file removed
+// since is skipped.
+func (fs *FileSyncer) SyncPending() error {
+	fs.mu.Lock()
+	paths := fs.pending
+	fs.pending = make(map[string]struct{})
+	fs.mu.Unlock()
+
+	var lastErr error
+	for path := range paths {
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = file.Sync()
+			file.Close()
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("error syncing %s: %w", path, err)
+			fs.logger.Warnf("Could not sync %s: %v", path, err)
+		}
+	}
+	return lastErr
+}
+
+// Close stops the interval syncs and syncs what is still pending
+func (fs *FileSyncer) Close() error {
+	fs.stopped.Do(func() { close(fs.stop) })
+	return fs.SyncPending()
+}
+
+func (fs *FileSyncer) syncEvery() {
+	ticker := time.NewTicker(fs.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fs.SyncPending()
+		case <-fs.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package engine
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"syndrdb/src/models"
+)
+
+/*
+	Expressions over the fields of a document.
+
+	An index field, and the left side of a WHERE comparison, may be an expression instead of a
+	field: LOWER(<expression>) and UPPER(<expression>), and + - * / between fields and
+	numbers, * and / binding tighter than + and -. Operators are words, so they need spaces
+	around them: "Price" * 1.2. An expression is known by its canonical text (String), which
+	quotes every field and spaces every operator the same way however it was written, so a
+	comparison on LOWER(Email) can use an index on LOWER("Email").
+
+	An expression has no value for a document when a field it reads is missing or null, when
+	LOWER or UPPER gets something other than a string, when arithmetic gets something other
+	than two numbers (+ also joins two strings), or when it divides by zero. Such a document
+	matches no comparison on the expression and is left out of indexes over it.
+
+	Index postings compute expressions from the documents (see buildPostings), so they stay
+	in sync with writes like any other index field. The index files are written from a copy of
+	the bundle holding each expression's values under a field of its own, named by
+	IndexFieldKey (see IndexSource).
+*/
+
+// Expression is a value computed from the fields of a document
+type Expression struct {
+	Function string      // LOWER or UPPER, of Args[0]
+	Operator string      // + - * or /, between Args[0] and Args[1]
+	Field    string      // The field read, when Function and Operator are empty
+	Literal  interface{} // The number, when Field is empty too
+	Args     []*Expression
+}
+
+var expressionFunctions = []string{"LOWER", "UPPER"}
+
+// String writes an expression as canonical SyndrQL. Operations nested in an operation are
+// always parenthesized, so the text does not depend on how it was grouped when written.
+func (e *Expression) String() string {
+	switch {
+	case e.Function != "":
+		return e.Function + "(" + e.Args[0].String() + ")"
+	case e.Operator != "":
+		operands := make([]string, 2)
+		for i, arg := range e.Args {
+			operands[i] = arg.String()
+			if arg.Operator != "" {
+				operands[i] = "(" + operands[i] + ")"
+			}
+		}
+		return operands[0] + " " + e.Operator + " " + operands[1]
+	case e.Field != "":
+		return QuoteString(e.Field)
+	}
+	if float, isFloat := e.Literal.(float64); isFloat {
+		literal := strconv.FormatFloat(float, 'f', -1, 64)
+		if !strings.Contains(literal, ".") {
+			literal += ".0"
+		}
+		return literal
+	}
+	return fmt.Sprint(e.Literal)
+}
+
+// Evaluate computes an expression for a document; false when it has no value there
+func (e *Expression) Evaluate(doc *models.Document) (interface{}, bool) {
+	switch {
+	case e.Function != "":
+		value, ok := e.Args[0].Evaluate(doc)
+		text, isText := value.(string)
+		if !ok || !isText {
+			return nil, false
+		}
+		if e.Function == "LOWER" {
+			return strings.ToLower(text), true
+		}
+		return strings.ToUpper(text), true
+	case e.Operator != "":
+		left, ok := e.Args[0].Evaluate(doc)
+		if !ok {
+			return nil, false
+		}
+		right, ok := e.Args[1].Evaluate(doc)
+		if !ok {
+			return nil, false
+		}
+		return arithmetic(e.Operator, left, right)
+	case e.Field != "":
+		field, exists := doc.Fields[e.Field]
+		if !exists || field.Value == nil {
+			return nil, false
+		}
+		return field.Value, true
+	}
+	return e.Literal, true
+}
+
+// arithmetic applies an operator to two values. Whole numbers stay whole except through /.
+func arithmetic(operator string, left, right interface{}) (interface{}, bool) {
+	if leftText, isText := left.(string); isText && operator == "+" {
+		rightText, isText := right.(string)
+		return leftText + rightText, isText
+	}
+	l, leftIsNumber := numericValue(left)
+	r, rightIsNumber := numericValue(right)
+	if !leftIsNumber || !rightIsNumber {
+		return nil, false
+	}
+	_, leftIsFloat := left.(float64)
+	_, rightIsFloat := right.(float64)
+	whole := !leftIsFloat && !rightIsFloat
+
+	switch operator {
+	case "+":
+		if whole {
+			return int64(l) + int64(r), true
+		}
+		return l + r, true
+	case "-":
+		if whole {
+			return int64(l) - int64(r), true
+		}
+		return l - r, true
+	case "*":
+		if whole {
+			return int64(l) * int64(r), true
+		}
+		return l * r, true
+	case "/":
+		if r == 0 {
+			return nil, false
+		}
+		return l / r, true
+	}
+	return nil, false
+}
+
+// parseExpression parses expression = product { ( "+" | "-" ) product }
+func (p *statementParser) parseExpression() (*Expression, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("+") || p.peek().isKeyword("-") {
+		operator := p.peek().Text
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &Expression{Operator: operator, Args: []*Expression{left, right}}
+	}
+	return left, nil
+}
+
+// parseProduct parses product = factor { ( "*" | "/" ) factor }
+func (p *statementParser) parseProduct() (*Expression, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("*") || p.peek().isKeyword("/") {
+		operator := p.peek().Text
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &Expression{Operator: operator, Args: []*Expression{left, right}}
+	}
+	return left, nil
+}
+
+// parseFactor parses factor = ( "LOWER" | "UPPER" ) "(" expression ")" | "(" expression ")" | name | number
+func (p *statementParser) parseFactor() (*Expression, error) {
+	for _, function := range expressionFunctions {
+		if p.peek().isKeyword(function) && p.peekAt(1).isPunct("(") {
+			p.pos += 2
+			arg, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+			return &Expression{Function: function, Args: []*Expression{arg}}, nil
+		}
+	}
+	if p.acceptPunct("(") {
+		inner, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expectPunct(")")
+	}
+
+	token, err := p.expectNameToken("a field name")
+	if err != nil {
+		return nil, err
+	}
+	if token.Kind == TokenWord {
+		value, _ := literalValue(token)
+		if _, isNumber := numericValue(value); isNumber {
+			return &Expression{Literal: value}, nil
+		}
+	}
+	return &Expression{Field: token.Text}, nil
+}
+
+var compiledExpressions = struct {
+	sync.Mutex
+	byText map[string]*Expression
+}{byText: make(map[string]*Expression)}
+
+// compileExpression parses the canonical text of an expression index field, once
+func compileExpression(text string) (*Expression, error) {
+	compiledExpressions.Lock()
+	defer compiledExpressions.Unlock()
+	if expression, exists := compiledExpressions.byText[text]; exists {
+		return expression, nil
+	}
+	p, err := newStatementParser(text)
+	if err != nil {
+		return nil, err
+	}
+	expression, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectEnd(); err != nil {
+		return nil, err
+	}
+	compiledExpressions.byText[text] = expression
+	return expression, nil
+}
+
+// indexFieldValue returns the value an index field has for a document: its field's, or its
+// expression's computed from the document. False when it has none.
+func indexFieldValue(doc *models.Document, field models.FieldDefinition) (interface{}, bool) {
+	if field.Expression == "" {
+		value, exists := doc.Fields[field.Name]
+		return value.Value, exists
+	}
+	expression, err := compileExpression(field.Expression)
+	if err != nil {
+		return nil, false
+	}
+	return expression.Evaluate(doc)
+}
+
+// IndexedValue is the value a document has in an index field, as its index files hold it
+func IndexedValue(doc *models.Document, field models.FieldDefinition) (interface{}, bool) {
+	return indexFieldValue(doc, field)
+}
+
+// IndexFieldKey names an index field in index files: the field itself, or for an expression a
+// name made from a hash of its text, since the text may hold characters file names cannot
+func IndexFieldKey(field models.FieldDefinition) string {
+	if field.Expression == "" {
+		return field.Name
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(field.Expression))
+	return fmt.Sprintf("expr_%08x", hash.Sum32())
+}
+
+// IndexSource returns what the index services build an index over: the bundle and fields
+// themselves, or, when some fields are expressions, a copy of the bundle whose documents hold
+// each expression's value under its IndexFieldKey, and the fields renamed to match
+func IndexSource(bundle *models.Bundle, fields []models.FieldDefinition) (*models.Bundle, []models.FieldDefinition) {
+	var expressions []models.FieldDefinition
+	keyed := make([]models.FieldDefinition, len(fields))
+	for i, field := range fields {
+		keyed[i] = field
+		if field.Expression != "" {
+			keyed[i].Name = IndexFieldKey(field)
+			expressions = append(expressions, field)
+		}
+	}
+	if len(expressions) == 0 {
+		return bundle, fields
+	}
+
+	source := *bundle
+	source.DocumentStructure.FieldDefinitions = make(map[string]models.FieldDefinition, len(bundle.DocumentStructure.FieldDefinitions)+len(expressions))
+	for name, definition := range bundle.DocumentStructure.FieldDefinitions {
+		source.DocumentStructure.FieldDefinitions[name] = definition
+	}
+	for _, field := range expressions {
+		key := IndexFieldKey(field)
+		source.DocumentStructure.FieldDefinitions[key] = models.FieldDefinition{Name: key, IsUnique: field.IsUnique}
+	}
+
+	source.Documents = make(map[string]models.Document, len(bundle.Documents))
+	for docID, doc := range bundle.Documents {
+		computed := doc
+		computed.Fields = make(map[string]models.Field, len(doc.Fields)+len(expressions))
+		for name, value := range doc.Fields {
+			computed.Fields[name] = value
+		}
+		for _, field := range expressions {
+			if value, ok := indexFieldValue(&doc, field); ok {
+				key := IndexFieldKey(field)
+				computed.Fields[key] = models.Field{Name: key, Value: value}
+			}
+		}
+		source.Documents[docID] = computed
+	}
+	return &source, keyed
+}
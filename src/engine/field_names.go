@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+	Field names.
+
+	Field names end up as map keys, in WHERE clauses and ORDER BY, in index definitions and in
+	the JSON clients get back, so the names a bundle definition or a document write introduces
+	are checked by the parser:
+
+	  - a plain name starts with a letter and holds only letters, digits, '_' and '-'
+	  - a name in backquotes, such as `unit.price` or `first name`, may hold any printable
+	    character; it has to be written in backquotes wherever it is used
+	  - no name is longer than MaxFieldNameLength characters
+	  - DocumentID, CreatedAt and UpdatedAt, in any case, belong to the document itself
+
+	Names already stored are not checked again, so older documents stay readable.
+*/
+
+// MaxFieldNameLength is the longest field name allowed, in characters
+const MaxFieldNameLength = 64
+
+// ReservedFieldNames are the document's own metadata; no field may take their names
+var ReservedFieldNames = []string{"DocumentID", "CreatedAt", "UpdatedAt"}
+
+var plainFieldName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// CheckFieldName reports why a field name is not allowed; escaped is true for a name
+// written in backquotes
+func CheckFieldName(name string, escaped bool) error {
+	if name == "" {
+		return fmt.Errorf("field name cannot be empty")
+	}
+	if length := utf8.RuneCountInString(name); length > MaxFieldNameLength {
+		return fmt.Errorf("field name '%s...' is %d characters long; at most %d are allowed", string([]rune(name)[:16]), length, MaxFieldNameLength)
+	}
+	for _, reserved := range ReservedFieldNames {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("field name '%s' is reserved for the document's %s", name, reserved)
+		}
+	}
+	if escaped {
+		if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			return fmt.Errorf("field name %q contains a control character", name)
+		}
+		return nil
+	}
+	if !plainFieldName.MatchString(name) {
+		return fmt.Errorf("field name '%s' must start with a letter and hold only letters, digits, '_' and '-'; write it in backquotes, as `%s`, to use other characters", name, name)
+	}
+	return nil
+}
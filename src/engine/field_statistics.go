@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"syndrdb/src/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	Field statistics (ANALYZE BUNDLE).
+
+	ANALYZE samples up to SAMPLE documents of a bundle (uniformly, all of them when the bundle
+	is smaller) and records for every field the bundle defines the share of documents where it
+	is missing or null, the average width of its values, the number of distinct values in the
+	sample and, for numeric fields, an equal-height histogram. The statistics are stored in the
+	bundle file and describe the bundle as it was when it was last analyzed.
+
+	The planner uses a field's histogram to estimate how many index entries a < or > predicate
+	keeps; without one it assumes rangeSelectivity.
+*/
+
+const (
+	DefaultAnalyzeSample = 10000 // Documents ANALYZE BUNDLE samples without a SAMPLE clause
+	histogramBuckets     = 100
+)
+
+// AnalyzeBundle gathers statistics for every defined field over a sample of a bundle's documents
+func AnalyzeBundle(bundle *models.Bundle, sampleSize int) map[string]models.FieldStatistics {
+	sample := sampleDocuments(bundle, sampleSize)
+	analyzedAt := time.Now()
+
+	stats := make(map[string]models.FieldStatistics, len(bundle.DocumentStructure.FieldDefinitions))
+	for field := range bundle.DocumentStructure.FieldDefinitions {
+		stats[field] = analyzeField(sample, field, analyzedAt)
+	}
+	return stats
+}
+
+// sampleDocuments picks up to sampleSize documents, each with the same chance (reservoir sampling)
+func sampleDocuments(bundle *models.Bundle, sampleSize int) []*models.Document {
+	sample := make([]*models.Document, 0, int(math.Min(float64(sampleSize), float64(len(bundle.Documents)))))
+	seen := 0
+	for docID := range bundle.Documents {
+		doc := bundle.Documents[docID]
+		seen++
+		if len(sample) < sampleSize {
+			sample = append(sample, &doc)
+		} else if i := rand.Intn(seen); i < sampleSize {
+			sample[i] = &doc
+		}
+	}
+	return sample
+}
+
+func analyzeField(sample []*models.Document, field string, analyzedAt time.Time) models.FieldStatistics {
+	stats := models.FieldStatistics{SampledDocuments: len(sample), AnalyzedAt: analyzedAt}
+	if len(sample) == 0 {
+		return stats
+	}
+
+	nulls, width := 0, 0
+	distinct := make(map[string]bool)
+	numbers := make([]float64, 0, len(sample))
+	for _, doc := range sample {
+		value, exists := doc.Fields[field]
+		if !exists || value.Value == nil {
+			nulls++
+			continue
+		}
+		width += valueWidth(value.Value)
+		distinct[indexKey(value.Value)] = true
+		if number, ok := numericValue(value.Value); ok {
+			numbers = append(numbers, number)
+		}
+	}
+
+	nonNull := len(sample) - nulls
+	stats.NullFraction = float64(nulls) / float64(len(sample))
+	stats.DistinctValues = len(distinct)
+	if nonNull > 0 {
+		stats.AverageWidth = float64(width) / float64(nonNull)
+	}
+	if len(numbers) == nonNull && len(distinct) > 1 {
+		stats.Histogram = equalHeightBounds(numbers, histogramBuckets)
+	}
+	return stats
+}
+
+// equalHeightBounds returns the bounds of at most buckets buckets holding equally many of the values
+func equalHeightBounds(values []float64, buckets int) []float64 {
+	sort.Float64s(values)
+	if buckets > len(values)-1 {
+		buckets = len(values) - 1
+	}
+	bounds := make([]float64, buckets+1)
+	for i := range bounds {
+		bounds[i] = values[i*(len(values)-1)/buckets]
+	}
+	return bounds
+}
+
+// valueWidth is the size in bytes a value takes in a bundle file, near enough
+func valueWidth(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case bool:
+		return 1
+	case int, int32, int64, float64, time.Time, primitive.DateTime:
+		return 8 // Numbers decode as int32 or int64 depending on where they came from
+	default:
+		return len(fmt.Sprint(v))
+	}
+}
+
+// rangeFraction estimates the share of a field's values the < and > predicates on it keep,
+// from the field's histogram when ANALYZE built one
+func rangeFraction(bundle *models.Bundle, field string, predicates []WhereClause) float64 {
+	stats, exists := bundle.FieldStatistics[field]
+	if !exists || len(stats.Histogram) < 2 {
+		return rangeSelectivity
+	}
+
+	low, high := math.Inf(-1), math.Inf(1)
+	for _, predicate := range predicates {
+		if predicate.Operator != "<" && predicate.Operator != ">" {
+			continue
+		}
+		bound, ok := numericValue(predicate.Value)
+		if !ok {
+			text, isText := predicate.Value.(string)
+			number, err := strconv.ParseFloat(text, 64)
+			if !isText || err != nil {
+				return rangeSelectivity
+			}
+			bound = number
+		}
+		if predicate.Operator == ">" {
+			low = math.Max(low, bound)
+		} else {
+			high = math.Min(high, bound)
+		}
+	}
+
+	return math.Max(0, histogramFraction(stats.Histogram, high)-histogramFraction(stats.Histogram, low))
+}
+
+// histogramFraction is the share of values below v, interpolating linearly within a bucket
+func histogramFraction(bounds []float64, v float64) float64 {
+	last := len(bounds) - 1
+	if v <= bounds[0] {
+		return 0
+	}
+	if v >= bounds[last] {
+		return 1
+	}
+	i := sort.SearchFloat64s(bounds, v) // First bound >= v, at least 1
+	within := 0.0
+	if bounds[i] > bounds[i-1] {
+		within = (v - bounds[i-1]) / (bounds[i] - bounds[i-1])
+	}
+	return (float64(i-1) + within) / float64(last)
+}
+
+// FieldStatisticsToMap prepares field statistics for the bundle file
+func FieldStatisticsToMap(stats map[string]models.FieldStatistics) map[string]interface{} {
+	fields := make(map[string]interface{}, len(stats))
+	for name, field := range stats {
+		fields[name] = map[string]interface{}{
+			"SampledDocuments": field.SampledDocuments,
+			"NullFraction":     field.NullFraction,
+			"AverageWidth":     field.AverageWidth,
+			"DistinctValues":   field.DistinctValues,
+			"Histogram":        field.Histogram,
+			"AnalyzedAt":       field.AnalyzedAt,
+		}
+	}
+	return fields
+}
+
+// MapToFieldStatistics restores field statistics decoded from BSON
+func MapToFieldStatistics(data map[string]interface{}) map[string]models.FieldStatistics {
+	stats := make(map[string]models.FieldStatistics, len(data))
+	for name, raw := range data {
+		fieldData, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		field := models.FieldStatistics{}
+		if n, ok := numericValue(fieldData["SampledDocuments"]); ok {
+			field.SampledDocuments = int(n)
+		}
+		if n, ok := numericValue(fieldData["DistinctValues"]); ok {
+			field.DistinctValues = int(n)
+		}
+		field.NullFraction, _ = numericValue(fieldData["NullFraction"])
+		field.AverageWidth, _ = numericValue(fieldData["AverageWidth"])
+
+		var bounds []interface{}
+		switch b := fieldData["Histogram"].(type) {
+		case primitive.A:
+			bounds = b
+		case []interface{}:
+			bounds = b
+		}
+		for _, bound := range bounds {
+			if n, ok := numericValue(bound); ok {
+				field.Histogram = append(field.Histogram, n)
+			}
+		}
+
+		switch analyzedAt := fieldData["AnalyzedAt"].(type) {
+		case primitive.DateTime:
+			field.AnalyzedAt = analyzedAt.Time()
+		case time.Time:
+			field.AnalyzedAt = analyzedAt
+		}
+		stats[name] = field
+	}
+	return stats
+}
@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	On-disk format versions.
+
+	Bundle files and partition files are one BSON document each. Version 1 is that document as
+	written before formats were versioned: it has no FormatVersion field. Version 2 adds the
+	field, and is what BundleToMap and encodePartitionFile write. A file is brought forward
+	through bundleMigrations when it is read, and rewritten in the current format when it is
+	next written or by a data directory upgrade. A file with a newer version than
+	BundleFormatVersion is refused rather than read and written back without what it holds.
+	The paged bundle layout (see paged_bundle.go) has a version of its own in its header page;
+	the server does not keep bundles in it yet.
+
+	Index files carry their own versions: hashindex.FormatVersion and btreeindex.FormatVersion.
+
+	format.json in the data directory records the DataFormatVersion all its files were last
+	brought up to, so a server only looks through them when the directory is older than it
+	(see directors.UpgradeDataDirectory). A directory without the file is new, or was written
+	before formats were versioned.
+*/
+
+const (
+	BundleFormatVersion = 2 // Of bundle and partition files
+	DataFormatVersion   = 3 // Of a data directory whose files are all in the current formats
+)
+
+// bundleMigrations bring a decoded bundle or partition file forward one version each: the
+// first from version 1 to 2, and so on
+var bundleMigrations = []func(data map[string]interface{}){
+	// 2 only adds FormatVersion, which upgradeBundleMap sets
+	func(data map[string]interface{}) {},
+}
+
+// DataFormat is the content of format.json
+type DataFormat struct {
+	Version  int
+	Upgraded time.Time // When the files were last brought up to Version
+}
+
+// BundleFileVersion returns the format version of a decoded bundle or partition file
+func BundleFileVersion(data map[string]interface{}) (int, error) {
+	raw, exists := data["FormatVersion"]
+	if !exists {
+		return 1, nil
+	}
+	switch version := raw.(type) {
+	case int32:
+		return int(version), nil
+	case int64:
+		return int(version), nil
+	case float64:
+		return int(version), nil
+	}
+	return 0, fmt.Errorf("format version %v is not a number", raw)
+}
+
+// upgradeBundleMap brings a decoded bundle or partition file up to BundleFormatVersion in
+// memory, returning the version it had. A file from a newer server is refused.
+func upgradeBundleMap(data map[string]interface{}, fileName string) (int, error) {
+	version, err := BundleFileVersion(data)
+	if err != nil {
+		return 0, fmt.Errorf("bundle file %s: %w", fileName, err)
+	}
+	if version > BundleFormatVersion {
+		return version, protocol.Errorf(protocol.ErrNewerFormat, "bundle file %s has format version %d; this server reads versions 1 to %d",
+			fileName, version, BundleFormatVersion)
+	}
+	if version < 1 {
+		return version, fmt.Errorf("bundle file %s has an invalid format version %d", fileName, version)
+	}
+	for v := version; v < BundleFormatVersion; v++ {
+		bundleMigrations[v-1](data)
+	}
+	data["FormatVersion"] = BundleFormatVersion
+	return version, nil
+}
+
+// UpgradeBundleFile rewrites a bundle or partition file in the current format, under a
+// temporary name renamed into place, and returns the version it had. A file already in the
+// current format is left alone.
+func UpgradeBundleFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %w", filepath.Base(path), err)
+	}
+	decoded, err := helpers.DecodeBSON(data)
+	if err != nil {
+		return 0, fmt.Errorf("error decoding %s: %w", filepath.Base(path), err)
+	}
+	bundleData, ok := decoded.(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("%s does not hold a bundle", filepath.Base(path))
+	}
+
+	version, err := upgradeBundleMap(bundleData, filepath.Base(path))
+	if err != nil || version == BundleFormatVersion {
+		return version, err
+	}
+	encoded, err := helpers.EncodeBSON(bundleData)
+	if err != nil {
+		return version, fmt.Errorf("error encoding %s: %w", filepath.Base(path), err)
+	}
+	return version, writeFileAtomically(path, encoded)
+}
+
+// ReadDataFormat reads format.json; false when the data directory has none
+func ReadDataFormat(paths *helpers.PathResolver) (DataFormat, bool, error) {
+	var format DataFormat
+	data, err := os.ReadFile(paths.DataFormatFile())
+	if os.IsNotExist(err) {
+		return format, false, nil
+	}
+	if err != nil {
+		return format, false, fmt.Errorf("error reading %s: %w", helpers.DataFormatFileName, err)
+	}
+	if err := json.Unmarshal(data, &format); err != nil || format.Version < 1 {
+		return format, false, fmt.Errorf("%s does not hold a format version; restore it or remove it to have the files checked again", helpers.DataFormatFileName)
+	}
+	return format, true, nil
+}
+
+// WriteDataFormat records that every file of the data directory is in the current formats
+func WriteDataFormat(paths *helpers.PathResolver) error {
+	data, err := json.MarshalIndent(DataFormat{Version: DataFormatVersion, Upgraded: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(paths.DataFormatFile(), data); err != nil {
+		return err
+	}
+	helpers.SyncDirectory(paths.DataDir())
+	return nil
+}
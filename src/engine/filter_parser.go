@@ -1,7 +1,6 @@
 package engine
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 	"syndrdb/src/models"
@@ -22,10 +21,11 @@ import (
 */
 // WhereClause represents a single condition in a WHERE clause
 type WhereClause struct {
-	Field    string
-	Operator string
-	Value    interface{} // Can be string, int, float64, bool
-	Logic    string      // "AND" or "OR"
+	Field      string
+	Expression *Expression // Set when Field is the canonical text of an expression, see expressions.go
+	Operator   string
+	Value      interface{} // Can be string, int, float64, bool; []interface{} of them for IN
+	Logic      string      // "AND" or "OR"
 }
 
 // WhereGroup represents a group of clauses joined by the same logical operator
@@ -35,177 +35,6 @@ type WhereGroup struct {
 	Logic     string // Logic connecting this group to others ("AND" or "OR")
 }
 
-// tokenizeWhereClause breaks a WHERE clause into tokens while preserving quoted strings
-func tokenizeWhereClause(whereClause string) []string {
-	var tokens []string
-	var currentToken strings.Builder
-	inQuote := false
-
-	for i := 0; i < len(whereClause); i++ {
-		ch := whereClause[i]
-
-		// Handle quotes
-		if ch == '"' {
-			currentToken.WriteByte(ch)
-			inQuote = !inQuote
-			continue
-		}
-
-		// If we're in quotes, just add the character
-		if inQuote {
-			currentToken.WriteByte(ch)
-			continue
-		}
-
-		// Handle parentheses as separate tokens
-		if ch == '(' || ch == ')' {
-			// Add current token if not empty
-			if currentToken.Len() > 0 {
-				tokens = append(tokens, strings.TrimSpace(currentToken.String()))
-				currentToken.Reset()
-			}
-			// Add parenthesis as its own token
-			tokens = append(tokens, string(ch))
-			continue
-		}
-
-		// Handle spaces outside quotes
-		if ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' {
-			// Only add token if not empty
-			if currentToken.Len() > 0 {
-				tokens = append(tokens, strings.TrimSpace(currentToken.String()))
-				currentToken.Reset()
-			}
-			continue
-		}
-
-		// For all other characters
-		currentToken.WriteByte(ch)
-	}
-
-	// Add the final token if not empty
-	if currentToken.Len() > 0 {
-		tokens = append(tokens, strings.TrimSpace(currentToken.String()))
-	}
-
-	return tokens
-}
-
-// ParseWhereClause parses a WHERE clause into a tree of conditions and groups
-func ParseWhereClause(whereClause string) (*WhereGroup, error) {
-	// Trim any leading WHERE keyword and ensure clean input
-	whereClause = strings.TrimSpace(whereClause)
-	if strings.HasPrefix(strings.ToUpper(whereClause), "WHERE") {
-		whereClause = strings.TrimSpace(whereClause[5:])
-	}
-
-	// Tokenize the where clause
-	tokens := tokenizeWhereClause(whereClause)
-
-	// Parse the tokens into a tree structure
-	rootGroup := &WhereGroup{}
-
-	// Track our position in the token stream
-	pos := 0
-
-	// Parse recursively
-	var err error
-	rootGroup, pos, err = parseWhereGroup(tokens, pos)
-	if err != nil {
-		return nil, err
-	}
-
-	// Check if we consumed all tokens
-	if pos < len(tokens) {
-		return nil, fmt.Errorf("unexpected tokens after parsing: %v", tokens[pos:])
-	}
-
-	return rootGroup, nil
-}
-
-// parseWhereGroup parses a group of conditions (possibly nested)
-func parseWhereGroup(tokens []string, pos int) (*WhereGroup, int, error) {
-	group := &WhereGroup{}
-
-	// Skip opening parenthesis if present
-	if pos < len(tokens) && tokens[pos] == "(" {
-		pos++
-	}
-
-	for pos < len(tokens) {
-		// Handle closing parenthesis
-		if tokens[pos] == ")" {
-			pos++
-			break
-		}
-
-		// If we encounter an opening parenthesis, it's a nested group
-		if tokens[pos] == "(" {
-			// Parse the nested group
-			subGroup, newPos, err := parseWhereGroup(tokens, pos)
-			if err != nil {
-				return nil, pos, err
-			}
-
-			// Update position
-			pos = newPos
-
-			// Set logical connector if there are more tokens
-			if pos < len(tokens) && (strings.ToUpper(tokens[pos]) == "AND" || strings.ToUpper(tokens[pos]) == "OR") {
-				subGroup.Logic = strings.ToUpper(tokens[pos])
-				pos++
-			}
-
-			// Add the subgroup to current group
-			group.SubGroups = append(group.SubGroups, *subGroup)
-			continue
-		}
-
-		// Parse a simple condition (Field Operator Value)
-		if pos+2 < len(tokens) {
-			field := tokens[pos]
-			operator := tokens[pos+1]
-			valueToken := tokens[pos+2]
-
-			// Validate operator
-			if !isValidOperator(operator) {
-				return nil, pos, fmt.Errorf("invalid operator: %s", operator)
-			}
-
-			// Parse value based on type
-			value, err := parseValue(valueToken)
-			if err != nil {
-				return nil, pos, err
-			}
-
-			// Create clause
-			clause := WhereClause{
-				Field:    field,
-				Operator: operator,
-				Value:    value,
-			}
-
-			// Move position
-			pos += 3
-
-			// Check for logical joiner
-			if pos < len(tokens) && (strings.ToUpper(tokens[pos]) == "AND" || strings.ToUpper(tokens[pos]) == "OR") {
-				clause.Logic = strings.ToUpper(tokens[pos])
-				pos++
-			}
-
-			// Add clause to group
-			group.Clauses = append(group.Clauses, clause)
-			continue
-		}
-
-		// If we reach here, there's a syntax error
-		return nil, pos, fmt.Errorf("unexpected syntax at position %d: %v", pos, tokens[pos:])
-	}
-
-	return group, pos, nil
-}
-
 // Helper function to check if operator is valid
 func isValidOperator(op string) bool {
 	return op == "==" || op == "!=" || op == ">" || op == "<"
@@ -256,15 +85,18 @@ func EvaluateWhereClause(document *models.Document, whereGroup *WhereGroup, logg
 
 	// Evaluate all clauses in this group
 	clauseResults := make([]bool, 0, len(whereGroup.Clauses))
+	logic := make([]string, 0, len(whereGroup.Clauses)+len(whereGroup.SubGroups))
 	for _, clause := range whereGroup.Clauses {
 		logger.Infof("DEBUG DEBUG:: Evaluating clause: %+v", clause)
 		clauseResults = append(clauseResults, evaluateClause(document, clause, logger))
+		logic = append(logic, clause.Logic)
 	}
 
 	// Evaluate all subgroups
 	subgroupResults := make([]bool, 0, len(whereGroup.SubGroups))
 	for _, subgroup := range whereGroup.SubGroups {
 		subgroupResults = append(subgroupResults, EvaluateWhereClause(document, &subgroup, logger))
+		logic = append(logic, subgroup.Logic)
 	}
 
 	// Combine all results using appropriate logic
@@ -273,22 +105,33 @@ func EvaluateWhereClause(document *models.Document, whereGroup *WhereGroup, logg
 		return true
 	}
 
-	// Default to AND logic within a group
-	result := true
-	for _, r := range results {
-		result = result && r
-		if !result {
-			break // Short-circuit for AND
+	// Each result's Logic joins it to the next one; AND binds tighter than OR
+	term := true
+	for i, r := range results {
+		term = term && r
+		if logic[i] == "OR" || i == len(results)-1 {
+			if term {
+				return true
+			}
+			term = true
 		}
 	}
 
-	return result
+	return false
 }
 
 // evaluateClause evaluates a single clause against a document
 func evaluateClause(document *models.Document, clause WhereClause, logger *zap.SugaredLogger) bool {
 	// Get field value from document
 
+	if clause.Expression != nil {
+		value, ok := clause.Expression.Evaluate(document)
+		if !ok {
+			return false // No value for this document
+		}
+		return evaluateClause(&models.Document{Fields: map[string]models.Field{clause.Field: {Value: value}}}, WhereClause{Field: clause.Field, Operator: clause.Operator, Value: clause.Value}, logger)
+	}
+
 	field, exists := document.Fields[clause.Field]
 	if !exists && !strings.EqualFold(clause.Field, "documentid") {
 		logger.Infof("Field '%s' does not exist in document, returning false", clause.Field)
@@ -318,6 +161,14 @@ func evaluateClause(document *models.Document, clause WhereClause, logger *zap.S
 		return compareValues(field.Value, clause.Value, logger, func(a, b float64) bool { return a > b })
 	case "<":
 		return compareValues(field.Value, clause.Value, logger, func(a, b float64) bool { return a < b })
+	case "IN":
+		values, _ := clause.Value.([]interface{})
+		for _, value := range values {
+			if compareValues(field.Value, value, logger, func(a, b float64) bool { return a == b }) {
+				return true
+			}
+		}
+		return false
 	default:
 		return false
 	}
@@ -330,8 +181,17 @@ func compareValues(a, b interface{}, logger *zap.SugaredLogger, numericCompariso
 	bStr, bIsString := b.(string)
 	//logger.Infof("DEBUG DEBUG:: Comparing strings: '%s' and '%s'", aStr, bStr)
 	if aIsString && bIsString {
-
-		return aStr == bStr
+		// Numeric strings compare as numbers, as index keys do; other strings by their text.
+		// A numeric string against another compares as a number against a string would.
+		aNum, aErr := strconv.ParseFloat(aStr, 64)
+		bNum, bErr := strconv.ParseFloat(bStr, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			return numericComparison(aNum, bNum)
+		case aErr == nil || bErr == nil:
+			return false
+		}
+		return numericComparison(float64(strings.Compare(aStr, bStr)), 0)
 	}
 
 	// Handle boolean comparison
@@ -348,6 +208,10 @@ func compareValues(a, b interface{}, logger *zap.SugaredLogger, numericCompariso
 	switch v := a.(type) {
 	case int:
 		aVal = float64(v)
+	case int32:
+		aVal = float64(v)
+	case int64:
+		aVal = float64(v)
 	case float64:
 		aVal = v
 	case string:
@@ -362,6 +226,10 @@ func compareValues(a, b interface{}, logger *zap.SugaredLogger, numericCompariso
 	switch v := b.(type) {
 	case int:
 		bVal = float64(v)
+	case int32:
+		bVal = float64(v)
+	case int64:
+		bVal = float64(v)
 	case float64:
 		bVal = v
 	case string:
@@ -378,29 +246,132 @@ func compareValues(a, b interface{}, logger *zap.SugaredLogger, numericCompariso
 
 // FilterDocuments filters documents based on a WHERE clause
 func FilterDocuments(bundle *models.Bundle, whereClause string, logger *zap.SugaredLogger) ([]*models.Document, error) {
-	// Parse the WHERE clause
-	whereGroup, err := ParseWhereClause(whereClause)
+	return FilterDocumentsInPartitions(bundle, whereClause, nil, logger)
+}
+
+// FilterDocumentsInPartitions filters documents based on a WHERE clause, only looking at the
+// given partitions of a partitioned bundle. A nil partition list means every partition.
+// An empty WHERE clause matches every document.
+func FilterDocumentsInPartitions(bundle *models.Bundle, whereClause string, partitionList []int, logger *zap.SugaredLogger) ([]*models.Document, error) {
+	return FilterSampledDocuments(bundle, whereClause, partitionList, nil, logger)
+}
+
+// FilterSampledDocuments is FilterDocumentsInPartitions over a sample of the bundle; a nil
+// sample reads all of it. See sampling.go.
+func FilterSampledDocuments(bundle *models.Bundle, whereClause string, partitionList []int, sample *SampleClause, logger *zap.SugaredLogger) ([]*models.Document, error) {
+	var result []*models.Document
+	err := ScanDocuments(bundle, whereClause, partitionList, sample, logger, func(doc *models.Document) {
+		result = append(result, doc)
+	})
 	if err != nil {
 		return nil, err
 	}
-	//logger.Infof("Parsed WHERE clause: %+v", whereGroup)
-	// Filter documents
-	// if len(bundle.Documents) > 0 {
-	// 	prettyJSON, err := json.MarshalIndent(bundle.Documents, "", "  ")
-	// 	if err != nil {
-	// 		logger.Warnf("Failed to convert documents to JSON: %v", err)
-	// 	} else {
-	// 		logger.Infof("Found %d documents: \n%s", len(bundle.Documents), string(prettyJSON))
-	// 	}
-	// } else {
-	// 	logger.Infof("No documents found matching the filter")
-	// }
-	var result []*models.Document
+	return result, nil
+}
+
+// ScanDocuments hands each document FilterSampledDocuments would return to visit, without
+// collecting them, for callers that only fold them into a summary
+func ScanDocuments(bundle *models.Bundle, whereClause string, partitionList []int, sample *SampleClause, logger *zap.SugaredLogger, visit func(doc *models.Document)) error {
+	whereGroup, matches, err := documentFilter(bundle, whereClause, partitionList, logger)
+	if err != nil {
+		return err
+	}
+
+	// Documents outside the sample are skipped before they are copied or checked
+	inSample := sample.selector(bundle)
+
+	if whereGroup != nil && len(bundle.Indexes) > 0 {
+		plan := choosePlan(bundle, whereGroup)
+		logger.Debugf("Planner chose %s %s (cost %.2f, ~%.0f rows) for bundle '%s'", plan.Access, plan.IndexName, plan.Cost, plan.EstimatedRows, bundle.Name)
+
+		if plan.Access != AccessFullScan {
+			recordQueryShapes(bundle, whereGroup, plan.Cost)
+			docIDs, err := candidateDocIDs(bundle, plan, logger)
+			if err != nil {
+				return err
+			}
+			// Index lookups can over-select, so fetched documents are still checked against the full clause
+			for _, docID := range docIDs.IDs() {
+				if inSample != nil && !inSample(docID) {
+					continue
+				}
+				doc, exists := bundle.Documents[docID]
+				if exists && matches(&doc) {
+					visit(&doc)
+				}
+			}
+			return nil
+		}
+	}
+	if whereGroup != nil {
+		recordQueryShapes(bundle, whereGroup, float64(len(bundle.Documents))*scanCostPerDocument)
+	}
+
+	if inSample != nil {
+		for docID := range bundle.Documents {
+			if !inSample(docID) {
+				continue
+			}
+			if doc := bundle.Documents[docID]; matches(&doc) {
+				visit(&doc)
+			}
+		}
+		return nil
+	}
+
 	for _, doc := range bundle.Documents {
-		if EvaluateWhereClause(&doc, whereGroup, logger) {
-			result = append(result, &doc)
+		if matches(&doc) {
+			visit(&doc)
 		}
 	}
 
-	return result, nil
+	return nil
+}
+
+// documentFilter parses a WHERE clause and returns it with a check of whether a document
+// matches it and lies in the partitions asked for and not ruled out by the clause
+func documentFilter(bundle *models.Bundle, whereClause string, partitionList []int, logger *zap.SugaredLogger) (*WhereGroup, func(doc *models.Document) bool, error) {
+	var whereGroup *WhereGroup
+	if strings.TrimSpace(whereClause) != "" {
+		// Parse the WHERE clause
+		group, err := ParseWhereClause(whereClause)
+		if err != nil {
+			return nil, nil, err
+		}
+		whereGroup = group
+	}
+
+	// Skip documents in partitions the WHERE clause rules out
+	var partitions map[int]bool
+	if bundle.Partitioning != nil {
+		pruned := PrunePartitions(bundle.Partitioning, whereGroup)
+		if partitionList != nil {
+			requested := make(map[int]bool, len(partitionList))
+			for _, partition := range partitionList {
+				requested[partition] = true
+			}
+			kept := pruned[:0]
+			for _, partition := range pruned {
+				if requested[partition] {
+					kept = append(kept, partition)
+				}
+			}
+			pruned = kept
+		}
+		if len(pruned) < bundle.Partitioning.PartitionCount {
+			partitions = make(map[int]bool, len(pruned))
+			for _, partition := range pruned {
+				partitions[partition] = true
+			}
+			logger.Debugf("Partition pruning on bundle '%s' kept partitions %v of %d", bundle.Name, pruned, bundle.Partitioning.PartitionCount)
+		}
+	}
+
+	matches := func(doc *models.Document) bool {
+		if partitions != nil && !partitions[PartitionForDocument(bundle.Partitioning, doc)] {
+			return false
+		}
+		return whereGroup == nil || EvaluateWhereClause(doc, whereGroup, logger)
+	}
+	return whereGroup, matches, nil
 }
@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"syndrdb/src/models"
+)
+
+/*
+	Index advisor.
+
+	Every SELECT, UPDATE and DELETE with a WHERE clause is recorded by the shape of each of
+	its OR-ed terms: the fields it compares with == and the first field it compares with < or
+	>. For each shape the advisor keeps how many queries had it, what they cost as planned
+	(see query_planner.go) and the predicates of the latest one, and for each field how often
+	queries filter on it. Counts cover the time since the server started.
+
+	ADVISE INDEXES FOR BUNDLE costs each shape again, once with the bundle's indexes as they
+	are and once with a B-tree index over its == fields, most often filtered on first, then
+	its range field. The index is built in memory to be costed, not stored. An index is
+	suggested when it would make the shape's queries cheaper; suggestions are ranked by the
+	cost they would have saved over the queries recorded.
+*/
+
+// maxQueryShapes bounds the shapes kept per bundle; queries of later shapes are not recorded
+const maxQueryShapes = 64
+
+// IndexAdvice is an index ADVISE INDEXES suggests
+type IndexAdvice struct {
+	Statement     string // The CREATE INDEX that creates it
+	Bundle        string
+	Fields        []string
+	Queries       uint64  // Queries since startup it would have served
+	ObservedCost  float64 // Their average cost when they ran
+	CurrentCost   float64 // Their cost with the bundle's indexes as they are now
+	EstimatedCost float64 // Their cost with the suggested index
+	Benefit       float64 // (CurrentCost - EstimatedCost) * Queries
+}
+
+// queryShape is what the queries of one shape have in common
+type queryShape struct {
+	equalities []string // Sorted
+	rangeField string   // Empty when the shape has no range predicate
+	queries    uint64
+	totalCost  float64
+	predicates map[string][]WhereClause // Of the latest query, to cost indexes with
+}
+
+// bundleQueries are the shapes and field counts recorded for one bundle
+type bundleQueries struct {
+	shapes map[string]*queryShape
+	fields map[string]uint64 // Queries filtering on each field
+}
+
+var queryShapes = struct {
+	sync.Mutex
+	byBundle map[string]*bundleQueries // By bundle ID
+}{byBundle: make(map[string]*bundleQueries)}
+
+// recordQueryShapes counts the shapes of the terms of a WHERE clause that was answered at cost
+func recordQueryShapes(bundle *models.Bundle, whereGroup *WhereGroup, cost float64) {
+	terms := splitOrTerms(whereGroup)
+
+	queryShapes.Lock()
+	defer queryShapes.Unlock()
+	recorded, exists := queryShapes.byBundle[bundle.BundleID]
+	if !exists {
+		recorded = &bundleQueries{shapes: make(map[string]*queryShape), fields: make(map[string]uint64)}
+		queryShapes.byBundle[bundle.BundleID] = recorded
+	}
+
+	for _, term := range terms {
+		var equalities, ranges []string
+		for field, clauses := range term.predicates {
+			recorded.fields[field]++
+			switch {
+			case hasOperator(clauses, "=="):
+				equalities = append(equalities, field)
+			case hasOperator(clauses, "<"), hasOperator(clauses, ">"):
+				ranges = append(ranges, field)
+			}
+		}
+		if len(equalities) == 0 && len(ranges) == 0 {
+			continue
+		}
+		sort.Strings(equalities)
+		sort.Strings(ranges)
+
+		shape := &queryShape{equalities: equalities}
+		if len(ranges) > 0 {
+			shape.rangeField = ranges[0]
+		}
+		key := strings.Join(shape.equalities, "\x00") + "\x01" + shape.rangeField
+		if existing, exists := recorded.shapes[key]; exists {
+			shape = existing
+		} else if len(recorded.shapes) < maxQueryShapes {
+			recorded.shapes[key] = shape
+		} else {
+			continue
+		}
+		shape.queries++
+		shape.totalCost += cost
+		shape.predicates = term.predicates
+	}
+}
+
+// ForgetQueryShapes drops what was recorded of the queries of a bundle that is being deleted
+func ForgetQueryShapes(bundle *models.Bundle) {
+	queryShapes.Lock()
+	defer queryShapes.Unlock()
+	delete(queryShapes.byBundle, bundle.BundleID)
+}
+
+// AdviseIndexes suggests indexes for the queries recorded against a bundle, most beneficial first
+func AdviseIndexes(bundle *models.Bundle) []IndexAdvice {
+	queryShapes.Lock()
+	var shapes []queryShape
+	fieldCounts := make(map[string]uint64)
+	if recorded, exists := queryShapes.byBundle[bundle.BundleID]; exists {
+		for _, shape := range recorded.shapes {
+			shapes = append(shapes, *shape)
+		}
+		for field, count := range recorded.fields {
+			fieldCounts[field] = count
+		}
+	}
+	queryShapes.Unlock()
+
+	advice := make([]IndexAdvice, 0)
+	scanCost := float64(len(bundle.Documents)) * scanCostPerDocument
+	for _, shape := range shapes {
+		index := suggestedIndex(bundle, shape, fieldCounts)
+		suggested := planIndexWith(bundle, index, shape.predicates, func() *IndexStatistics {
+			return indexStatistics(index, buildPostings(bundle, index))
+		})
+		if suggested.Reason != "" {
+			continue
+		}
+
+		current := scanCost
+		if best := cheapestPlan(planConjunction(bundle, whereTerm{predicates: shape.predicates})); best != nil && best.Cost < current {
+			current = best.Cost
+		}
+		if suggested.Cost >= current {
+			continue
+		}
+
+		fields := make([]string, 0, len(index.Fields))
+		for _, field := range index.Fields {
+			fields = append(fields, field.Name)
+		}
+		advice = append(advice, IndexAdvice{
+			Statement:     createIndexStatement(bundle, index),
+			Bundle:        bundle.Name,
+			Fields:        fields,
+			Queries:       shape.queries,
+			ObservedCost:  roundCost(shape.totalCost / float64(shape.queries)),
+			CurrentCost:   roundCost(current),
+			EstimatedCost: suggested.Cost,
+			Benefit:       roundCost((current - suggested.Cost) * float64(shape.queries)),
+		})
+	}
+
+	sort.Slice(advice, func(i, j int) bool {
+		if advice[i].Benefit != advice[j].Benefit {
+			return advice[i].Benefit > advice[j].Benefit
+		}
+		return advice[i].Statement < advice[j].Statement
+	})
+	return advice
+}
+
+// suggestedIndex is a B-tree index over the == fields of a shape, those queries filter on
+// most often first, so other shapes can use a prefix of it, then its range field
+func suggestedIndex(bundle *models.Bundle, shape queryShape, fieldCounts map[string]uint64) models.IndexReference {
+	names := append([]string(nil), shape.equalities...)
+	sort.SliceStable(names, func(i, j int) bool { return fieldCounts[names[i]] > fieldCounts[names[j]] })
+	if shape.rangeField != "" {
+		names = append(names, shape.rangeField)
+	}
+
+	index := models.IndexReference{
+		IndexName: bundle.Name + "_" + strings.Join(names, "_"),
+		IndexType: "btree",
+	}
+	for _, name := range names {
+		field := models.FieldDefinition{Name: name}
+		if clauses := shape.predicates[name]; len(clauses) > 0 && clauses[0].Expression != nil {
+			field.Expression = name
+		}
+		index.Fields = append(index.Fields, field)
+	}
+	return index
+}
+
+// createIndexStatement writes the CREATE INDEX that creates an index
+func createIndexStatement(bundle *models.Bundle, index models.IndexReference) string {
+	fields := make([]string, 0, len(index.Fields))
+	for _, field := range index.Fields {
+		name := QuoteString(field.Name)
+		if field.Expression != "" {
+			name = field.Expression
+		}
+		fields = append(fields, fmt.Sprintf("{%s, %t}", name, field.IsUnique))
+	}
+	return fmt.Sprintf("CREATE B-INDEX %s ON BUNDLE %s WITH FIELDS (%s);",
+		QuoteString(index.IndexName), QuoteString(bundle.Name), strings.Join(fields, ", "))
+}
+
+func roundCost(cost float64) float64 {
+	return math.Round(cost*100) / 100
+}
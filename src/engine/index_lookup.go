@@ -0,0 +1,301 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	hashindex "syndrdb/src/hash_index"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+
+	"go.uber.org/zap"
+)
+
+/*
+	In-memory DocID postings used to execute index plans.
+
+	Hash index files are maintained on every write (see directors/index_maintenance.go), so
+	an equality or IN lookup through a hash index of one field reads the index file, for
+	the bundles the bundle service holds. Copies of a bundle, such as snapshot views and a
+	transaction's working copies, differ from the file, and an invalid index cannot be read
+	until it is rebuilt; those lookups fall back to postings. B-tree index files are built
+	once when an index is created and are not maintained, so B-tree lookups, and hash indexes
+	of several fields, always use postings. Postings are built from the bundle the first time
+	an index is used, kept in the server's QueryCaches, and dropped whenever a document in the
+	bundle changes.
+	A lookup may return more DocIDs than strictly match; the caller always re-checks
+	the full WHERE clause on the documents it fetches.
+*/
+
+// indexPostings maps keys of one index to the sorted DocIDs holding them
+type indexPostings struct {
+	// byPrefix[i] is keyed by the first i+1 index fields
+	byPrefix []map[string][]string
+	// leading holds the distinct values of the first field, for range lookups
+	leading []leadingValue
+	// ordered holds the same values but nil in ascending order, each with its DocIDs sorted,
+	// for reading pages in order (see keyset.go)
+	ordered []leadingValue
+}
+
+type leadingValue struct {
+	value  interface{}
+	docIDs []string
+}
+
+// InvalidateIndexLookups drops the postings of a bundle after its documents change
+func InvalidateIndexLookups(bundle *models.Bundle) {
+	caches := queryCachesOf(bundle)
+	if caches == nil {
+		return
+	}
+	caches.postingsMu.Lock()
+	defer caches.postingsMu.Unlock()
+	delete(caches.postings, bundle)
+}
+
+// postingsFor returns the postings of an index, building them on first use; they are built
+// for every use on a bundle without caches
+func postingsFor(bundle *models.Bundle, index models.IndexReference) *indexPostings {
+	caches := queryCachesOf(bundle)
+	if caches == nil {
+		return buildPostings(bundle, index)
+	}
+	caches.postingsMu.Lock()
+	defer caches.postingsMu.Unlock()
+
+	indexes, exists := caches.postings[bundle]
+	if !exists {
+		indexes = make(map[string]*indexPostings)
+		caches.postings[bundle] = indexes
+	}
+	if postings, exists := indexes[index.IndexName]; exists {
+		return postings
+	}
+
+	postings := buildPostings(bundle, index)
+	indexes[index.IndexName] = postings
+	return postings
+}
+
+func buildPostings(bundle *models.Bundle, index models.IndexReference) *indexPostings {
+	postings := &indexPostings{byPrefix: make([]map[string][]string, len(index.Fields))}
+	for i := range postings.byPrefix {
+		postings.byPrefix[i] = make(map[string][]string)
+	}
+	leading := make(map[string]*leadingValue)
+
+	for docID, doc := range bundle.Documents {
+		var key strings.Builder
+		for i, field := range index.Fields {
+			value, exists := indexFieldValue(&doc, field)
+			if !exists {
+				break
+			}
+			key.WriteString(indexKey(value))
+			key.WriteByte(0)
+			postings.byPrefix[i][key.String()] = append(postings.byPrefix[i][key.String()], docID)
+
+			if i == 0 {
+				entry, exists := leading[key.String()]
+				if !exists {
+					entry = &leadingValue{value: value}
+					leading[key.String()] = entry
+				}
+				entry.docIDs = append(entry.docIDs, docID)
+			}
+		}
+	}
+
+	for _, prefix := range postings.byPrefix {
+		for _, docIDs := range prefix {
+			sort.Strings(docIDs)
+		}
+	}
+	for _, entry := range leading {
+		postings.leading = append(postings.leading, *entry)
+		if entry.value != nil {
+			ordered := leadingValue{value: entry.value, docIDs: append([]string(nil), entry.docIDs...)}
+			sort.Strings(ordered.docIDs)
+			postings.ordered = append(postings.ordered, ordered)
+		}
+	}
+	sort.Slice(postings.ordered, func(i, j int) bool {
+		return CompareOrderedValues(postings.ordered[i].value, postings.ordered[j].value) < 0
+	})
+	return postings
+}
+
+// indexFiles are the index files of a bundle the bundle service holds
+type indexFiles struct {
+	bundle *models.Bundle // The bundle they were attached to
+	hash   *hashindex.HashService
+}
+
+// AttachIndexFiles lets hash lookups on a bundle read its index files from hash. Only lookups
+// on that very bundle do: a copy of it carries the attachment but reads postings.
+func AttachIndexFiles(bundle *models.Bundle, hash *hashindex.HashService) {
+	bundle.IndexFiles = &indexFiles{bundle: bundle, hash: hash}
+}
+
+// hashIndexFiles returns the hash index files of a bundle, nil for a copy or a bundle without
+func hashIndexFiles(bundle *models.Bundle) *hashindex.HashService {
+	if files, ok := bundle.IndexFiles.(*indexFiles); ok && files.bundle == bundle {
+		return files.hash
+	}
+	return nil
+}
+
+// readsHashFile reports whether lookups through an index read its file: a hash index of one
+// field, on a bundle the files belong to
+func readsHashFile(bundle *models.Bundle, index models.IndexReference) bool {
+	return strings.EqualFold(index.IndexType, "hash") && len(index.Fields) == 1 && hashIndexFiles(bundle) != nil
+}
+
+// hashFileStatistics returns the entries and distinct keys a hash index file keeps up to
+// date, for an index whose lookups read it and whose file can be read
+func hashFileStatistics(bundle *models.Bundle, index models.IndexReference) (*IndexStatistics, bool) {
+	if !readsHashFile(bundle, index) {
+		return nil, false
+	}
+	name := helpers.HashIndexName(bundle.BundleID, IndexFieldKey(index.Fields[0]))
+	entries, keys, err := hashIndexFiles(bundle).HashIndexCounts(name)
+	if err != nil {
+		return nil, false
+	}
+	return &IndexStatistics{
+		Entries:      int(entries),
+		DistinctKeys: []int{int(keys)},
+		Height:       1,
+		Unique:       index.Fields[0].IsUnique,
+	}, true
+}
+
+// lookupHashFile reads the DocIDs of a hash lookup from the index file. False when postings
+// have to answer it: the index has several fields, the bundle is a copy, or the file cannot be
+// read.
+func lookupHashFile(bundle *models.Bundle, index models.IndexReference, plan *QueryPlan) (DocIDSet, bool) {
+	if !readsHashFile(bundle, index) {
+		return DocIDSet{}, false
+	}
+	hash := hashIndexFiles(bundle)
+
+	clauses := plan.predicates[plan.IndexFields[0]]
+	keys := []interface{}{firstClause(clauses, "==").Value}
+	if plan.Probes > 0 {
+		keys, _ = firstClause(clauses, "IN").Value.([]interface{})
+	}
+	field := hashindex.IndexField{FieldName: IndexFieldKey(index.Fields[0]), IsUnique: index.Fields[0].IsUnique}
+	docIDs, err := hash.SearchHashIndexMany(helpers.HashIndexName(bundle.BundleID, field.FieldName), keys, field)
+	if err != nil {
+		return DocIDSet{}, false
+	}
+	return NewDocIDSet(docIDs), true
+}
+
+// lookupIndex returns the DocIDs an index plan selects
+func lookupIndex(bundle *models.Bundle, plan *QueryPlan, logger *zap.SugaredLogger) (DocIDSet, error) {
+	index, exists := bundle.Indexes[plan.IndexName]
+	if !exists {
+		return DocIDSet{}, fmt.Errorf("index '%s' no longer exists on bundle '%s'", plan.IndexName, bundle.Name)
+	}
+	recordIndexUse(bundle, index.IndexName)
+	if plan.Access == AccessHashLookup {
+		if docIDs, ok := lookupHashFile(bundle, index, plan); ok {
+			return docIDs, nil
+		}
+	}
+	postings := postingsFor(bundle, index)
+	predicates := plan.predicates
+
+	equalities, hasRange := indexPrefixMatch(plan.IndexFields, predicates)
+	if plan.Probes > 0 {
+		return lookupInList(postings, plan.IndexFields, equalities, predicates), nil
+	}
+	if equalities > 0 {
+		// An equality prefix narrows enough; a following range is left to the WHERE re-check
+		var key strings.Builder
+		for _, field := range plan.IndexFields[:equalities] {
+			key.WriteString(indexKey(firstClause(predicates[field], "==").Value))
+			key.WriteByte(0)
+		}
+		return sortedDocIDSet(postings.byPrefix[equalities-1][key.String()]), nil
+	}
+	if !hasRange {
+		return DocIDSet{}, fmt.Errorf("index '%s' has no usable predicate", plan.IndexName)
+	}
+
+	// Range on the leading field: keep the distinct values every range predicate accepts
+	var docIDs []string
+	for _, entry := range postings.leading {
+		matches := true
+		for _, clause := range predicates[plan.IndexFields[0]] {
+			if clause.Operator != "<" && clause.Operator != ">" {
+				continue
+			}
+			doc := &models.Document{Fields: map[string]models.Field{clause.Field: {Name: clause.Field, Value: entry.value}}}
+			clause.Expression = nil // The value is the expression's, already computed
+			if !evaluateClause(doc, clause, logger) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			docIDs = append(docIDs, entry.docIDs...)
+		}
+	}
+	return NewDocIDSet(docIDs), nil
+}
+
+// lookupInList reads the DocIDs of each distinct key of the IN list on the field after an
+// equality prefix, once per key, and merges them
+func lookupInList(postings *indexPostings, fields []string, equalities int, predicates map[string][]WhereClause) DocIDSet {
+	var prefix strings.Builder
+	for _, field := range fields[:equalities] {
+		prefix.WriteString(indexKey(firstClause(predicates[field], "==").Value))
+		prefix.WriteByte(0)
+	}
+	var docIDs []string
+	for _, key := range inListKeys(predicates[fields[equalities]]) {
+		docIDs = append(docIDs, postings.byPrefix[equalities][prefix.String()+key+"\x00"]...)
+	}
+	return NewDocIDSet(docIDs)
+}
+
+// candidateDocIDs runs the index lookups of a plan, combining the DocID sets of intersections and unions
+func candidateDocIDs(bundle *models.Bundle, plan *QueryPlan, logger *zap.SugaredLogger) (DocIDSet, error) {
+	switch plan.Access {
+	case AccessIntersect, AccessUnion:
+	default:
+		return lookupIndex(bundle, plan, logger)
+	}
+
+	var result DocIDSet
+	for i, input := range plan.Inputs {
+		docIDs, err := candidateDocIDs(bundle, input, logger)
+		if err != nil {
+			return DocIDSet{}, err
+		}
+		switch {
+		case i == 0:
+			result = docIDs
+		case plan.Access == AccessUnion:
+			result = result.Union(docIDs)
+		default:
+			result = result.Intersect(docIDs)
+			if result.Len() == 0 {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+func firstClause(clauses []WhereClause, operator string) WhereClause {
+	for _, clause := range clauses {
+		if clause.Operator == operator {
+			return clause
+		}
+	}
+	return WhereClause{}
+}
@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"strings"
+	"sync"
+	"syndrdb/src/models"
+	"time"
+)
+
+/*
+	Index usage.
+
+	Every time an index serves a query, narrowing a WHERE, listing the values of a SELECT
+	DISTINCT or reading a page in ORDER BY order, it is counted along with when that last
+	happened, so SHOW INDEX USAGE can point out indexes that are never used and only slow
+	writes down. Uses are kept by bundle ID and index name, so a snapshot or clone of a bundle
+	starts counting from nothing. directors/index_usage.go writes them to the data directory
+	every so often and reads them back at startup.
+*/
+
+// IndexUsage is how often an index has served a query
+type IndexUsage struct {
+	Lookups  uint64
+	LastUsed time.Time // Zero when the index has never been used
+}
+
+var indexUsage = struct {
+	sync.Mutex
+	byKey   map[string]IndexUsage
+	changes uint64 // Bumped by every change, so a saved snapshot can tell it is still current
+}{byKey: make(map[string]IndexUsage)}
+
+func indexUsageKey(bundle *models.Bundle, indexName string) string {
+	return bundle.BundleID + "/" + indexName
+}
+
+// recordIndexUse counts one query an index served
+func recordIndexUse(bundle *models.Bundle, indexName string) {
+	indexUsage.Lock()
+	defer indexUsage.Unlock()
+	key := indexUsageKey(bundle, indexName)
+	usage := indexUsage.byKey[key]
+	usage.Lookups++
+	usage.LastUsed = time.Now()
+	indexUsage.byKey[key] = usage
+	indexUsage.changes++
+}
+
+// IndexUsageOf returns the usage of an index of a bundle
+func IndexUsageOf(bundle *models.Bundle, indexName string) IndexUsage {
+	indexUsage.Lock()
+	defer indexUsage.Unlock()
+	return indexUsage.byKey[indexUsageKey(bundle, indexName)]
+}
+
+// ForgetIndexUsage drops the usage of an index that is being created, so one recreated
+// under an old name does not inherit the old counts
+func ForgetIndexUsage(bundle *models.Bundle, indexName string) {
+	indexUsage.Lock()
+	defer indexUsage.Unlock()
+	if _, exists := indexUsage.byKey[indexUsageKey(bundle, indexName)]; exists {
+		delete(indexUsage.byKey, indexUsageKey(bundle, indexName))
+		indexUsage.changes++
+	}
+}
+
+// ForgetBundleIndexUsage drops the usage of every index of a bundle that is being deleted
+func ForgetBundleIndexUsage(bundle *models.Bundle) {
+	indexUsage.Lock()
+	defer indexUsage.Unlock()
+	prefix := indexUsageKey(bundle, "")
+	for key := range indexUsage.byKey {
+		if strings.HasPrefix(key, prefix) {
+			delete(indexUsage.byKey, key)
+			indexUsage.changes++
+		}
+	}
+}
+
+// IndexUsageSnapshot returns the usage of every index by "<bundle ID>/<index name>", and a
+// version that changes whenever the usage does
+func IndexUsageSnapshot() (map[string]IndexUsage, uint64) {
+	indexUsage.Lock()
+	defer indexUsage.Unlock()
+	snapshot := make(map[string]IndexUsage, len(indexUsage.byKey))
+	for key, usage := range indexUsage.byKey {
+		snapshot[key] = usage
+	}
+	return snapshot, indexUsage.changes
+}
+
+// RestoreIndexUsage adds usage read back from disk to what was counted since startup
+func RestoreIndexUsage(saved map[string]IndexUsage) {
+	indexUsage.Lock()
+	defer indexUsage.Unlock()
+	for key, usage := range saved {
+		current := indexUsage.byKey[key]
+		current.Lookups += usage.Lookups
+		if usage.LastUsed.After(current.LastUsed) {
+			current.LastUsed = usage.LastUsed
+		}
+		indexUsage.byKey[key] = current
+	}
+	indexUsage.changes++
+}
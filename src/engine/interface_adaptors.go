@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
@@ -163,7 +164,7 @@ func CreateBTreeIndex(bundle *models.Bundle, fieldName string, isUnique bool) (s
 	adapter := NewBundleAdapter(bundle)
 
 	// Create index
-	indexName, err := service.CreateIndex(adapter.Bundle, fieldName, isUnique)
+	indexName, err := service.CreateIndex(context.Background(), adapter.Bundle, fieldName, isUnique)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"syndrdb/src/models"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Keyset pagination.
+
+	SELECT DOCUMENTS ... ORDER BY <field> [ASC|DESC] AFTER KEY (<value>, "<DocumentID>") LIMIT n
+	returns the n documents that follow that position in the order; without ORDER BY the
+	documents are in DocumentID order and the key is just ("<DocumentID>"). Ties on the
+	ORDER BY field are broken by DocumentID, so every document has a place of its own in the
+	order and pages neither skip nor repeat documents, even while others are added or removed.
+	Documents without the field come last, in DocumentID order.
+
+	When LIMIT fills a page the response carries NextKey, a continuation token holding the
+	position of its last document; AFTER KEY "<token>" starts the next page there. A token
+	only fits a SELECT with the same ORDER BY.
+
+	Unlike skipping rows, a page does not get slower the further in it is. When a B-tree index
+	leads with the ORDER BY field and the WHERE clause, if any, has no index of its own to use,
+	the page is read by walking the index's values in order from the key, stopping as soon as
+	the page is full.
+*/
+
+// AfterKey is the position AFTER KEY starts a page after
+type AfterKey struct {
+	Value      interface{} // Of the ORDER BY field; nil for a document without it
+	DocumentID string
+}
+
+// continuationToken is what a NextKey token holds, encoded as base64 JSON
+type continuationToken struct {
+	Field      string      `json:"field,omitempty"`
+	Descending bool        `json:"desc,omitempty"`
+	Value      interface{} `json:"value"`
+	DocumentID string      `json:"id"`
+}
+
+// ParseContinuationToken decodes a NextKey token for a SELECT ordered by orderBy, nil
+// without ORDER BY
+func ParseContinuationToken(token string, orderBy *OrderBy) (*AfterKey, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid continuation token")
+	}
+	var decoded continuationToken
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.DocumentID == "" {
+		return nil, fmt.Errorf("invalid continuation token")
+	}
+	field, descending := "", false
+	if orderBy != nil {
+		field, descending = orderBy.Field, orderBy.Descending
+	}
+	if decoded.Field != field || decoded.Descending != descending {
+		return nil, fmt.Errorf("the continuation token is for %s, not %s", describeOrder(decoded.Field, decoded.Descending), describeOrder(field, descending))
+	}
+	return &AfterKey{Value: decoded.Value, DocumentID: decoded.DocumentID}, nil
+}
+
+func describeOrder(field string, descending bool) string {
+	switch {
+	case field == "":
+		return "a SELECT without ORDER BY"
+	case descending:
+		return fmt.Sprintf("ORDER BY %s DESC", field)
+	}
+	return fmt.Sprintf("ORDER BY %s ASC", field)
+}
+
+// Token encodes the key as a continuation token for a SELECT ordered by orderBy
+func (k *AfterKey) Token(orderBy *OrderBy) string {
+	token := continuationToken{DocumentID: k.DocumentID}
+	if orderBy != nil {
+		token.Field, token.Descending, token.Value = orderBy.Field, orderBy.Descending, k.Value
+	}
+	data, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// NextKey returns the continuation token for the page after documents, or "" when LIMIT did
+// not fill the page and no documents follow
+func (m *SelectModifiers) NextKey(documents []*models.Document) string {
+	if m == nil || m.Limit <= 0 || len(documents) < m.Limit {
+		return ""
+	}
+	last := documents[len(documents)-1]
+	key := &AfterKey{DocumentID: last.DocumentID}
+	if m.OrderBy != nil {
+		key.Value = documentFieldValue(last, m.OrderBy.Field)
+	}
+	return key.Token(m.OrderBy)
+}
+
+// comparePositions orders two documents, given by their ORDER BY value and ID, as a SELECT
+// with orderBy returns them: by value, then ID, with documents lacking the value last
+func comparePositions(orderBy *OrderBy, aValue interface{}, aID string, bValue interface{}, bID string) int {
+	if orderBy != nil {
+		switch {
+		case aValue == nil && bValue != nil:
+			return 1
+		case aValue != nil && bValue == nil:
+			return -1
+		case aValue != nil:
+			cmp := CompareOrderedValues(aValue, bValue)
+			if orderBy.Descending {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp
+			}
+		}
+	}
+	return strings.Compare(aID, bID)
+}
+
+// isAfter reports whether a document comes after the key in the order of the SELECT
+func (k *AfterKey) isAfter(document *models.Document, orderBy *OrderBy) bool {
+	var value interface{}
+	if orderBy != nil {
+		value = documentFieldValue(document, orderBy.Field)
+	}
+	return comparePositions(orderBy, value, document.DocumentID, k.Value, k.DocumentID) > 0
+}
+
+// SelectOrderedDocuments returns the documents a SELECT with ORDER BY, AFTER KEY or LIMIT
+// asks for, in order. A page that an index can serve in order is read from the index;
+// anything else is filtered and then sorted.
+func SelectOrderedDocuments(bundle *models.Bundle, whereClause string, partitionList []int, sample *SampleClause, modifiers *SelectModifiers, logger *zap.SugaredLogger) ([]*models.Document, error) {
+	if index, ok := orderingIndex(bundle, sample, modifiers); ok {
+		whereGroup, matches, err := documentFilter(bundle, whereClause, partitionList, logger)
+		if err != nil {
+			return nil, err
+		}
+		if whereGroup == nil || PlanQuery(bundle, whereGroup).Chosen.Access == AccessFullScan {
+			logger.Debugf("Reading a page of bundle '%s' in the order of index '%s'", bundle.Name, index.IndexName)
+			return walkIndexInOrder(bundle, index, matches, modifiers), nil
+		}
+	}
+
+	documents, err := FilterSampledDocuments(bundle, whereClause, partitionList, sample, logger)
+	if err != nil {
+		return nil, err
+	}
+	return ApplySelectModifiers(documents, modifiers), nil
+}
+
+// orderingIndex finds a B-tree index leading with the ORDER BY field of a SELECT that stops
+// after LIMIT documents
+func orderingIndex(bundle *models.Bundle, sample *SampleClause, modifiers *SelectModifiers) (models.IndexReference, bool) {
+	if modifiers == nil || modifiers.OrderBy == nil || modifiers.Limit <= 0 || sample != nil {
+		return models.IndexReference{}, false
+	}
+	names := make([]string, 0, len(bundle.Indexes))
+	for name := range bundle.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		index := bundle.Indexes[name]
+		if strings.EqualFold(index.IndexType, "btree") && len(index.Fields) > 0 && index.Fields[0].Name == modifiers.OrderBy.Field {
+			return index, true
+		}
+	}
+	return models.IndexReference{}, false
+}
+
+// walkIndexInOrder collects the documents matching a filter in the order of an index's
+// leading field, from the AFTER KEY position until LIMIT documents were found. Documents
+// without the field are not in the index; they come last, so they are only looked for when
+// the index runs out first.
+func walkIndexInOrder(bundle *models.Bundle, index models.IndexReference, matches func(*models.Document) bool, modifiers *SelectModifiers) []*models.Document {
+	orderBy, after, limit := modifiers.OrderBy, modifiers.After, modifiers.Limit
+	ordered := postingsFor(bundle, index).ordered
+	recordIndexUse(bundle, index.IndexName)
+
+	var page []*models.Document
+	visit := func(docID string) bool {
+		doc, exists := bundle.Documents[docID]
+		if !exists {
+			return true
+		}
+		if after != nil && !after.isAfter(&doc, orderBy) {
+			return true
+		}
+		if matches(&doc) {
+			page = append(page, &doc)
+		}
+		return len(page) < limit
+	}
+
+	// ordered is ascending; find the first value not before the key in the SELECT's order
+	position := func(i int) int {
+		if orderBy.Descending {
+			return len(ordered) - 1 - i
+		}
+		return i
+	}
+	start := 0
+	if after != nil && after.Value != nil {
+		start = sort.Search(len(ordered), func(i int) bool {
+			return comparePositions(orderBy, ordered[position(i)].value, "", after.Value, "") >= 0
+		})
+	}
+	if after == nil || after.Value != nil {
+		for i := start; i < len(ordered); i++ {
+			for _, docID := range ordered[position(i)].docIDs {
+				if !visit(docID) {
+					return page
+				}
+			}
+		}
+	}
+
+	// The documents without the field, in ID order
+	var missing []*models.Document
+	for docID, doc := range bundle.Documents {
+		if doc.Fields[orderBy.Field].Value != nil {
+			continue
+		}
+		if after != nil && after.Value == nil && docID <= after.DocumentID {
+			continue
+		}
+		if matches(&doc) {
+			missing = append(missing, &doc)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].DocumentID < missing[j].DocumentID })
+	page = append(page, missing...)
+	if len(page) > limit {
+		page = page[:limit]
+	}
+	return page
+}
@@ -0,0 +1,328 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syndrdb/src/helpers"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Page write-ahead log.
+
+	Pages of paged bundle files (see paged_bundle.go) are changed in the buffer pool and written
+	back whenever the pool evicts or flushes them. Each change is logged first, to pages.wal in
+	the directory the log is opened in, as the images of the pages it leaves. Every page carries the LSN of
+	the last record that changed it, in the same place in each page, and a checksum sealing it
+	with that LSN. The pool writes no page before the log is synced up to that LSN (see
+	buffermgr.WAL), so a page on disk never holds a change the log could lose.
+
+	The log starts with the LSN its first record follows:
+
+	    magic "PWAL" | LSN uint64
+
+	then holds one record per change, little endian like the pages:
+
+	    length of the rest | CRC-32 of the rest | LSN uint64 | file name length uint16 | file name |
+	    page size | page count | block | page | block | page | ...
+
+	OpenPageWAL replays the log at startup, before any bundle file is read. A page on disk is
+	kept only when its checksum holds and its LSN is at least the record's, so the changes that
+	reached the disk before the crash are not applied again; one a crash tore, even with its
+	LSN already written, is written back from the record. A file that no longer exists
+	was dropped since and is skipped. A record cut short by the crash was never synced, so no
+	change it holds was acknowledged; it is discarded with what follows it. Once the pages
+	are written and synced, at startup and by Checkpoint, the log is emptied down to the LSN
+	it has reached, so LSNs only grow.
+*/
+
+const (
+	pageWALMagic           = 0x5057414C // "PWAL"
+	pageWALHeaderSize      = 12         // magic, LSN
+	pageWALRecordHeader    = 8          // length, CRC-32
+	pageWALCheckpointBytes = 64 << 20   // The log is checkpointed once it grows past this
+)
+
+// LoggedPage is the image of one page a change leaves
+type LoggedPage struct {
+	Block uint32
+	Data  []byte
+}
+
+// pageWALRecord is a change as the log holds it
+type pageWALRecord struct {
+	lsn      uint64
+	fileName string
+	pages    []LoggedPage
+}
+
+// PageWAL logs the changes to the pages of paged bundle files. It is safe for concurrent use.
+type PageWAL struct {
+	mu      sync.Mutex
+	paths   *helpers.PathResolver
+	file    *os.File
+	size    int64         // Of the log
+	lastLSN uint64        // Of the last record logged
+	flushed atomic.Uint64 // The log is synced up to this LSN
+	logger  *zap.SugaredLogger
+}
+
+// OpenPageWAL opens the page log of a data directory, redoing the changes a crash kept from
+// reaching the bundle files
+func OpenPageWAL(dataDir string, logger *zap.SugaredLogger) (*PageWAL, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory %s: %w", dataDir, err)
+	}
+	w := &PageWAL{paths: helpers.NewPathResolver(dataDir), logger: logger}
+
+	data, err := os.ReadFile(w.paths.PageWALFile())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read page log: %w", err)
+	}
+	lastLSN, records, discarded, err := parsePageWAL(data)
+	if err != nil {
+		return nil, err
+	}
+	if discarded > 0 {
+		logger.Warnf("Discarding %d bytes of an incomplete change at the end of %s; it was never synced", discarded, helpers.PageWALFileName)
+	}
+
+	written, skipped, err := w.replay(records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redo the changes in the page log: %w", err)
+	}
+	if len(records) > 0 {
+		lastLSN = records[len(records)-1].lsn
+		logger.Infof("Redid %d change(s) from %s: %d page(s) written, %d already on disk", len(records), helpers.PageWALFileName, written, skipped)
+	}
+
+	w.lastLSN = lastLSN
+	if err := w.reset(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// parsePageWAL returns the LSN a log starts from and its records, with the bytes of a record
+// cut short at its end
+func parsePageWAL(data []byte) (uint64, []pageWALRecord, int, error) {
+	if len(data) == 0 {
+		return 0, nil, 0, nil
+	}
+	if len(data) < pageWALHeaderSize || binary.LittleEndian.Uint32(data[0:4]) != pageWALMagic {
+		return 0, nil, 0, fmt.Errorf("%s is not a page log", helpers.PageWALFileName)
+	}
+	lastLSN := binary.LittleEndian.Uint64(data[4:12])
+
+	var records []pageWALRecord
+	offset := pageWALHeaderSize
+	for offset < len(data) {
+		record, size, ok := parsePageWALRecord(data[offset:])
+		if !ok || record.lsn <= lastLSN {
+			break
+		}
+		records = append(records, record)
+		lastLSN = record.lsn
+		offset += size
+	}
+	return binary.LittleEndian.Uint64(data[4:12]), records, len(data) - offset, nil
+}
+
+// parsePageWALRecord parses the record at the start of data, reporting one that is cut short
+// or does not match its CRC
+func parsePageWALRecord(data []byte) (pageWALRecord, int, bool) {
+	var record pageWALRecord
+	if len(data) < pageWALRecordHeader {
+		return record, 0, false
+	}
+	length := int(binary.LittleEndian.Uint32(data[0:4]))
+	if length < 18 || pageWALRecordHeader+length > len(data) {
+		return record, 0, false
+	}
+	body := data[pageWALRecordHeader : pageWALRecordHeader+length]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[4:8]) {
+		return record, 0, false
+	}
+
+	record.lsn = binary.LittleEndian.Uint64(body[0:8])
+	nameLength := int(binary.LittleEndian.Uint16(body[8:10]))
+	if 18+nameLength > len(body) {
+		return record, 0, false
+	}
+	record.fileName = string(body[10 : 10+nameLength])
+	pageSize := int(binary.LittleEndian.Uint32(body[10+nameLength : 14+nameLength]))
+	count := int(binary.LittleEndian.Uint32(body[14+nameLength : 18+nameLength]))
+	pages := body[18+nameLength:]
+	if pageSize <= pageLSNOffset+8+pageChecksumSize || len(pages) != count*(4+pageSize) {
+		return record, 0, false
+	}
+	for i := 0; i < count; i++ {
+		page := pages[i*(4+pageSize):]
+		record.pages = append(record.pages, LoggedPage{Block: binary.LittleEndian.Uint32(page[0:4]), Data: page[4 : 4+pageSize]})
+	}
+	return record, pageWALRecordHeader + length, true
+}
+
+// replay writes the pages of records over the older ones on disk, then syncs the files
+func (w *PageWAL) replay(records []pageWALRecord) (int, int, error) {
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	written, skipped := 0, 0
+	for _, record := range records {
+		file, opened := files[record.fileName]
+		if !opened {
+			var err error
+			file, err = os.OpenFile(w.paths.Path(record.fileName), os.O_RDWR, 0)
+			if os.IsNotExist(err) {
+				skipped += len(record.pages)
+				continue
+			}
+			if err != nil {
+				return written, skipped, fmt.Errorf("failed to open %s: %w", record.fileName, err)
+			}
+			files[record.fileName] = file
+		}
+
+		for _, page := range record.pages {
+			offset := int64(page.Block) * int64(len(page.Data))
+			onDisk := make([]byte, len(page.Data))
+			if n, _ := file.ReadAt(onDisk, offset); n == len(onDisk) {
+				if lsn, ok := checkPage(onDisk); ok && lsn >= record.lsn {
+					skipped++
+					continue
+				}
+			}
+			if _, err := helpers.WriteAt(file, page.Data, offset); err != nil {
+				return written, skipped, fmt.Errorf("failed to write block %d of %s: %w", page.Block, record.fileName, err)
+			}
+			written++
+		}
+	}
+
+	for fileName, file := range files {
+		if err := helpers.Sync(file); err != nil {
+			return written, skipped, fmt.Errorf("failed to sync %s: %w", fileName, err)
+		}
+	}
+	return written, skipped, nil
+}
+
+// Log logs a change to the pages of a file, sealing each page with the change's LSN, and
+// returns the LSN. The record is not synced; Flush syncs it.
+func (w *PageWAL) Log(fileName string, pages []LoggedPage) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lsn := w.lastLSN + 1
+	pageSize := 0
+	for _, page := range pages {
+		sealPage(page.Data, lsn)
+		pageSize = len(page.Data)
+	}
+
+	body := make([]byte, 18+len(fileName), 18+len(fileName)+len(pages)*(4+pageSize))
+	binary.LittleEndian.PutUint64(body[0:8], lsn)
+	binary.LittleEndian.PutUint16(body[8:10], uint16(len(fileName)))
+	copy(body[10:], fileName)
+	binary.LittleEndian.PutUint32(body[10+len(fileName):], uint32(pageSize))
+	binary.LittleEndian.PutUint32(body[14+len(fileName):], uint32(len(pages)))
+	for _, page := range pages {
+		body = binary.LittleEndian.AppendUint32(body, page.Block)
+		body = append(body, page.Data...)
+	}
+	record := make([]byte, pageWALRecordHeader, pageWALRecordHeader+len(body))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	record = append(record, body...)
+
+	if _, err := helpers.WriteAt(w.file, record, w.size); err != nil {
+		return 0, fmt.Errorf("failed to write page log: %w", err)
+	}
+	w.size += int64(len(record))
+	w.lastLSN = lsn
+	return lsn, nil
+}
+
+// FlushedLSN returns the LSN the log is synced up to
+func (w *PageWAL) FlushedLSN() uint64 {
+	return w.flushed.Load()
+}
+
+// Flush syncs the log up to at least lsn
+func (w *PageWAL) Flush(lsn uint64) error {
+	if w.flushed.Load() >= lsn {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.flushed.Load() >= lsn {
+		return nil
+	}
+	if err := helpers.Sync(w.file); err != nil {
+		return fmt.Errorf("failed to sync page log: %w", err)
+	}
+	w.flushed.Store(w.lastLSN)
+	return nil
+}
+
+// Size returns how many bytes the log holds
+func (w *PageWAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Checkpoint empties the log once syncPages has written and synced every page it changed.
+// Nothing may be logged meanwhile.
+func (w *PageWAL) Checkpoint(syncPages func() error) error {
+	if err := syncPages(); err != nil {
+		return fmt.Errorf("failed to write the pages the page log changed: %w", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reset()
+}
+
+// reset replaces the log with an empty one that starts from the last LSN
+func (w *PageWAL) reset() error {
+	header := make([]byte, pageWALHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], pageWALMagic)
+	binary.LittleEndian.PutUint64(header[4:12], w.lastLSN)
+	if err := writeFileAtomically(w.paths.PageWALFile(), header); err != nil {
+		return fmt.Errorf("failed to empty page log: %w", err)
+	}
+	helpers.SyncDirectory(w.paths.DataDir())
+
+	file, err := os.OpenFile(w.paths.PageWALFile(), os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open page log: %w", err)
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = file
+	w.size = pageWALHeaderSize
+	w.flushed.Store(w.lastLSN)
+	return nil
+}
+
+// Close closes the log, syncing it
+func (w *PageWAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := helpers.Sync(w.file); err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to sync page log: %w", err)
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,1108 @@
+package engine
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"syndrdb/src/buffermgr"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	Paged bundle layout.
+
+	The layout bundle files take once they are read and written through the buffer pool
+	(LoadBundle, WritePagedBundle); the server still keeps bundles as one BSON document each
+	(see file_formats.go) and makes its store without a page log, so it writes no paged files.
+	syndrbench -micro exercises the layout. Numbers are little endian, uint32s unless said. Every page starts
+	with its magic and the LSN of the last change to it (see page_wal.go), a uint64, and ends
+	with a CRC-32 of the rest of it, so a page a crash tore is told from one written whole.
+	Block 0 is the header page:
+
+	    magic "BUND" | LSN | version | document count | page count | generation | free list | metadata entry
+
+	the metadata being the bundle without its documents, as BundleToMap encodes it, held as
+	its length, then the block of its first overflow page, 0 when it is held in the header page,
+	followed by the bytes themselves in that case. The other blocks are document, overflow or
+	free pages, told apart by their magic. A document page is a slotted page:
+
+	    magic "DPAG" | LSN | slots uint16 | free space start uint16 | free space end uint16 | unused uint16
+	    slot directory: tuple offset uint16 | tuple length uint16, one per slot
+	    free space
+	    tuples, from the checksum back
+
+	A tuple is one document, as one BSON document, behind its header:
+
+	    created | deleted | overflow block | document length | ID length uint16 | ID | document
+
+	Created and deleted are the generations, counted in the header page, of the change that
+	wrote the tuple and the one that deleted it, 0 while it is live; only live tuples are read.
+	A document encoded larger than a quarter of a page is stored in a chain of overflow pages
+	instead, the tuple keeping its overflow block, so a document of any size up to the limit
+	it is written with is split across pages and put back together when it is read:
+
+	    magic "OVFL" | LSN | next overflow block, 0 for the last | bytes used | bytes
+
+	Documents are added, updated and deleted in place (AddPagedDocument, UpdatePagedDocument,
+	DeletePagedDocument) without the file being rewritten. A tuple that shrinks is rewritten
+	where it is; one that grows is moved within its page when the page has room, keeping its
+	slot, and to another page otherwise. A page is compacted, dropping its deleted tuples and
+	closing the holes they and shrunk tuples leave, when a tuple needs more than its free space
+	holds. Overflow chains no longer used go on the free list, chained through the free pages,
+	and are reused before the file grows:
+
+	    magic "FREE" | LSN | next free block, 0 for the last
+
+	A change is made to copies of the pages it writes, which are logged, then put in the buffer
+	pool to be written behind the log; one that fails leaves the file as it was.
+*/
+
+const (
+	pagedBundleMagic         = 0x42554E44 // "BUND"
+	documentPageMagic        = 0x44504147 // "DPAG"
+	overflowPageMagic        = 0x4F56464C // "OVFL"
+	freePageMagic            = 0x46524545 // "FREE"
+	pagedBundleFormatVersion = 5          // Version 2 adds overflow pages, 3 slotted document pages and the free list, 4 page LSNs, 5 page checksums
+	pageLSNOffset            = 4          // Of the LSN every page has after its magic
+	pageChecksumSize         = 4          // The CRC-32 every page ends with
+	pagedHeaderSize          = 32         // magic, LSN, version, document count, page count, generation, free list
+	pagedEntryHeaderSize     = 8          // length, first overflow block
+	documentPageHeaderSize   = 20         // magic, LSN, slots, free space start, free space end, unused
+	slotSize                 = 4          // tuple offset, tuple length
+	tupleHeaderSize          = 18         // created, deleted, overflow block, document length, ID length
+	overflowPageHeaderSize   = 20         // magic, LSN, next block, bytes used
+)
+
+// sealPage stamps a page with the LSN of the change writing it and its checksum
+func sealPage(page []byte, lsn uint64) {
+	binary.LittleEndian.PutUint64(page[pageLSNOffset:pageLSNOffset+8], lsn)
+	binary.LittleEndian.PutUint32(page[len(page)-pageChecksumSize:], crc32.ChecksumIEEE(page[:len(page)-pageChecksumSize]))
+}
+
+// checkPage returns the LSN of the last change to a page, and whether its checksum holds
+func checkPage(page []byte) (uint64, bool) {
+	lsn := binary.LittleEndian.Uint64(page[pageLSNOffset : pageLSNOffset+8])
+	return lsn, binary.LittleEndian.Uint32(page[len(page)-pageChecksumSize:]) == crc32.ChecksumIEEE(page[:len(page)-pageChecksumSize])
+}
+
+// errNoPageLog refuses writes in the paged layout to a store made without a page log
+var errNoPageLog = errors.New("bundle files are not written in the paged layout without a page log (see OpenPageWAL)")
+
+// pagedEntry is what an entry holds, with the block of its overflow chain once placed
+type pagedEntry struct {
+	data     []byte
+	overflow uint32
+}
+
+// WritePagedBundle writes a bundle in the paged layout through the buffer pool, refusing any
+// document encoded larger than maxDocumentBytes (0 allows any size)
+func (bs *BundleStorageEngine) WritePagedBundle(bundle *models.Bundle, maxDocumentBytes int64) error {
+	if bs.pageWAL == nil {
+		return errNoPageLog
+	}
+	pages, err := encodePagedBundle(bundle, bs.fileManager.PageSize(), maxDocumentBytes)
+	if err != nil {
+		return err
+	}
+
+	bs.pagedMu.Lock()
+	defer bs.pagedMu.Unlock()
+
+	fileName := helpers.BundleFileName(bundle.Name)
+	fileID, err := bs.fileManager.OpenFile(fileName)
+	if err != nil {
+		return fmt.Errorf("could not open bundle file: %w", err)
+	}
+	logged := make([]LoggedPage, len(pages))
+	for block, page := range pages {
+		logged[block] = LoggedPage{Block: uint32(block), Data: page}
+	}
+	lsn, err := bs.pageWAL.Log(fileName, logged)
+	if err != nil {
+		return fmt.Errorf("could not write bundle file %s: %w", fileName, err)
+	}
+	for block, page := range pages {
+		buffer, err := bs.fileManager.NewPage(fileID, uint32(block))
+		if err != nil {
+			return fmt.Errorf("could not get page %d of bundle file %s: %w", block, fileName, err)
+		}
+		copy(buffer.Data, page)
+		bs.fileManager.WritePageLSN(buffer, lsn)
+		bs.fileManager.ReleasePage(buffer)
+	}
+	if err := bs.fileManager.FlushFile(fileID); err != nil {
+		return fmt.Errorf("could not write bundle file %s: %w", fileName, err)
+	}
+
+	// Pages of a larger earlier version of the file are left behind otherwise
+	if err := os.Truncate(bs.paths.BundleFile(bundle.Name), int64(len(pages)*bs.fileManager.PageSize())); err != nil {
+		return fmt.Errorf("could not truncate bundle file %s: %w", fileName, err)
+	}
+	return nil
+}
+
+// encodePagedBundle lays a bundle out in pages of pageSize bytes
+func encodePagedBundle(bundle *models.Bundle, pageSize int, maxDocumentBytes int64) ([][]byte, error) {
+	if bundle.Partitioning != nil {
+		return nil, fmt.Errorf("bundle %s is partitioned; its documents live in its partition files", bundle.Name)
+	}
+	if pageSize > math.MaxUint16 {
+		return nil, fmt.Errorf("pages of %d bytes are too large for slot offsets; at most %d", pageSize, math.MaxUint16)
+	}
+
+	withoutDocuments := *bundle
+	withoutDocuments.Documents = nil
+	metadata, err := helpers.EncodeBSON(BundleToMap(&withoutDocuments))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding bundle %s: %w", bundle.Name, err)
+	}
+	metadataEntry := &pagedEntry{data: metadata}
+
+	documentIDs := make([]string, 0, len(bundle.Documents))
+	for documentID := range bundle.Documents {
+		documentIDs = append(documentIDs, documentID)
+	}
+	sort.Strings(documentIDs)
+
+	// Documents are packed into pages in order, those too large for a page going to overflow
+	// chains placed after the page they are packed into
+	const generation = 1
+	pages := [][]byte{make([]byte, pageSize)}
+	var current slottedPage
+	for _, documentID := range documentIDs {
+		data, err := encodePagedDocument(bundle.Documents[documentID])
+		if err != nil {
+			return nil, fmt.Errorf("error encoding document %s: %w", documentID, err)
+		}
+		if err := checkPagedDocument(bundle.Name, documentID, data, maxDocumentBytes); err != nil {
+			return nil, err
+		}
+		overflow := uint32(0)
+		if len(data) > pageSize/4 {
+			overflow = uint32(len(pages))
+			pages = append(pages, overflowPages(data, overflow, pageSize)...)
+		}
+		t := newTuple(generation, documentID, data, overflow)
+		if current == nil || !current.insert(t) {
+			current = newDocumentPage(pageSize)
+			pages = append(pages, current)
+			if !current.insert(t) {
+				return nil, fmt.Errorf("document ID '%s' is too long for a page", documentID)
+			}
+		}
+	}
+	if pagedHeaderSize+pagedEntryHeaderSize+len(metadata) > pageSize-pageChecksumSize {
+		metadataEntry.overflow = uint32(len(pages))
+		pages = append(pages, overflowPages(metadata, metadataEntry.overflow, pageSize)...)
+	}
+
+	header := pages[0]
+	binary.LittleEndian.PutUint32(header[0:4], pagedBundleMagic)
+	binary.LittleEndian.PutUint32(header[12:16], pagedBundleFormatVersion)
+	binary.LittleEndian.PutUint32(header[headerDocCount:], uint32(len(documentIDs)))
+	binary.LittleEndian.PutUint32(header[headerPageCount:], uint32(len(pages)))
+	binary.LittleEndian.PutUint32(header[headerGeneration:], generation)
+	putPagedEntry(header[pagedHeaderSize:], metadataEntry)
+	return pages, nil
+}
+
+// checkPagedDocument refuses a document encoded larger than maxDocumentBytes
+func checkPagedDocument(bundleName string, documentID string, data []byte, maxDocumentBytes int64) error {
+	if maxDocumentBytes > 0 && int64(len(data)) > maxDocumentBytes {
+		return protocol.Errorf(protocol.ErrDocumentLimit, "document '%s' is %d bytes encoded; bundle '%s' is written with documents of at most %d",
+			documentID, len(data), bundleName, maxDocumentBytes)
+	}
+	return nil
+}
+
+// putPagedEntry writes an entry at the start of buf and returns its size
+func putPagedEntry(buf []byte, entry *pagedEntry) int {
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(entry.data)))
+	binary.LittleEndian.PutUint32(buf[4:8], entry.overflow)
+	if entry.overflow != 0 {
+		return pagedEntryHeaderSize
+	}
+	return pagedEntryHeaderSize + copy(buf[pagedEntryHeaderSize:], entry.data)
+}
+
+// overflowPages splits data into a chain of overflow pages starting at block first
+func overflowPages(data []byte, first uint32, pageSize int) [][]byte {
+	blocks := make([]uint32, overflowPageCount(len(data), pageSize))
+	for i := range blocks {
+		blocks[i] = first + uint32(i)
+	}
+	pages := make([][]byte, len(blocks))
+	for i := range pages {
+		pages[i] = make([]byte, pageSize)
+	}
+	fillOverflowPages(pages, blocks, data)
+	return pages
+}
+
+// overflowPageCount returns how many overflow pages of pageSize bytes length bytes take
+func overflowPageCount(length int, pageSize int) int {
+	capacity := overflowCapacity(pageSize)
+	return max(1, (length+capacity-1)/capacity)
+}
+
+// overflowCapacity returns the bytes an overflow page of pageSize bytes holds
+func overflowCapacity(pageSize int) int {
+	return pageSize - overflowPageHeaderSize - pageChecksumSize
+}
+
+// fillOverflowPages writes data across pages, the chain's pages in order, which are at blocks
+func fillOverflowPages(pages [][]byte, blocks []uint32, data []byte) {
+	start := 0
+	for i, page := range pages {
+		clear(page)
+		end := min(start+overflowCapacity(len(page)), len(data))
+		binary.LittleEndian.PutUint32(page[0:4], overflowPageMagic)
+		if i+1 < len(blocks) {
+			binary.LittleEndian.PutUint32(page[12:16], blocks[i+1])
+		}
+		binary.LittleEndian.PutUint32(page[16:20], uint32(end-start))
+		copy(page[overflowPageHeaderSize:], data[start:end])
+		start = end
+	}
+}
+
+// tuple is a document as a document page holds it, header and all
+type tuple []byte
+
+// newTuple returns the tuple of a document created at generation, holding data unless it is
+// stored in the overflow chain at block overflow
+func newTuple(generation uint32, documentID string, data []byte, overflow uint32) tuple {
+	size := tupleHeaderSize + len(documentID)
+	if overflow == 0 {
+		size += len(data)
+	}
+	t := make(tuple, size)
+	binary.LittleEndian.PutUint32(t[0:4], generation)
+	binary.LittleEndian.PutUint32(t[8:12], overflow)
+	binary.LittleEndian.PutUint32(t[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint16(t[16:18], uint16(len(documentID)))
+	copy(t[tupleHeaderSize:], documentID)
+	if overflow == 0 {
+		copy(t[tupleHeaderSize+len(documentID):], data)
+	}
+	return t
+}
+
+func (t tuple) created() uint32  { return binary.LittleEndian.Uint32(t[0:4]) }
+func (t tuple) deleted() uint32  { return binary.LittleEndian.Uint32(t[4:8]) }
+func (t tuple) overflow() uint32 { return binary.LittleEndian.Uint32(t[8:12]) }
+func (t tuple) length() int      { return int(binary.LittleEndian.Uint32(t[12:16])) }
+
+func (t tuple) setDeleted(generation uint32) { binary.LittleEndian.PutUint32(t[4:8], generation) }
+
+// documentID returns the ID of the tuple's document, without decoding the document
+func (t tuple) documentID() string {
+	return string(t[tupleHeaderSize : tupleHeaderSize+int(binary.LittleEndian.Uint16(t[16:18]))])
+}
+
+// inline returns the document held in the tuple, nil if it is in an overflow chain
+func (t tuple) inline() []byte {
+	if t.overflow() != 0 {
+		return nil
+	}
+	start := tupleHeaderSize + int(binary.LittleEndian.Uint16(t[16:18]))
+	return t[start : start+t.length()]
+}
+
+// valid reports whether the tuple's header agrees with its size
+func (t tuple) valid() bool {
+	if len(t) < tupleHeaderSize {
+		return false
+	}
+	size := tupleHeaderSize + int(binary.LittleEndian.Uint16(t[16:18]))
+	if t.overflow() == 0 {
+		size += t.length()
+	}
+	return size == len(t)
+}
+
+// slottedPage is a document page
+type slottedPage []byte
+
+// newDocumentPage returns an empty document page of pageSize bytes
+func newDocumentPage(pageSize int) slottedPage {
+	p := make(slottedPage, pageSize)
+	p.init()
+	return p
+}
+
+// init empties the page
+func (p slottedPage) init() {
+	clear(p)
+	binary.LittleEndian.PutUint32(p[0:4], documentPageMagic)
+	p.setSlots(0)
+	p.setLower(documentPageHeaderSize)
+	p.setUpper(p.end())
+}
+
+// end returns where the page's tuples end, at its checksum
+func (p slottedPage) end() int { return len(p) - pageChecksumSize }
+
+func isDocumentPage(page []byte) bool {
+	return binary.LittleEndian.Uint32(page[0:4]) == documentPageMagic
+}
+
+func (p slottedPage) slots() int { return int(binary.LittleEndian.Uint16(p[12:14])) }
+func (p slottedPage) lower() int { return int(binary.LittleEndian.Uint16(p[14:16])) }
+func (p slottedPage) upper() int { return int(binary.LittleEndian.Uint16(p[16:18])) }
+
+func (p slottedPage) setSlots(n int) { binary.LittleEndian.PutUint16(p[12:14], uint16(n)) }
+func (p slottedPage) setLower(n int) { binary.LittleEndian.PutUint16(p[14:16], uint16(n)) }
+func (p slottedPage) setUpper(n int) { binary.LittleEndian.PutUint16(p[16:18], uint16(n)) }
+
+// slot returns where the tuple of a slot is; an offset of 0 is a slot free for reuse
+func (p slottedPage) slot(i int) (offset int, length int) {
+	at := documentPageHeaderSize + i*slotSize
+	return int(binary.LittleEndian.Uint16(p[at : at+2])), int(binary.LittleEndian.Uint16(p[at+2 : at+4]))
+}
+
+func (p slottedPage) setSlot(i int, offset int, length int) {
+	at := documentPageHeaderSize + i*slotSize
+	binary.LittleEndian.PutUint16(p[at:at+2], uint16(offset))
+	binary.LittleEndian.PutUint16(p[at+2:at+4], uint16(length))
+}
+
+// tuple returns the tuple of a slot, nil for a free slot
+func (p slottedPage) tuple(i int) tuple {
+	offset, length := p.slot(i)
+	if offset == 0 {
+		return nil
+	}
+	return tuple(p[offset : offset+length])
+}
+
+// check reports a page whose header or slot directory points outside it
+func (p slottedPage) check() error {
+	lower, upper := p.lower(), p.upper()
+	if lower != documentPageHeaderSize+p.slots()*slotSize || lower > upper || upper > p.end() {
+		return fmt.Errorf("document page has %d slots and free space from %d to %d", p.slots(), lower, upper)
+	}
+	for i := 0; i < p.slots(); i++ {
+		offset, length := p.slot(i)
+		if offset != 0 && (offset < upper || offset+length > p.end() || !tuple(p[offset:offset+length]).valid()) {
+			return fmt.Errorf("slot %d of the document page holds %d bytes at %d", i, length, offset)
+		}
+	}
+	return nil
+}
+
+// room returns the bytes the page has for new tuples and slots once compacted
+func (p slottedPage) room() int {
+	used := 0
+	for i := 0; i < p.slots(); i++ {
+		if t := p.tuple(i); t != nil && t.deleted() == 0 {
+			used += len(t)
+		}
+	}
+	return p.end() - p.lower() - used
+}
+
+// compact drops the deleted tuples, freeing their slots, and moves the live ones to the end
+// of the page so its free space is in one piece. Slots keep their numbers.
+func (p slottedPage) compact() {
+	live := make(map[int]tuple)
+	for i := 0; i < p.slots(); i++ {
+		if t := p.tuple(i); t != nil && t.deleted() == 0 {
+			live[i] = append(tuple(nil), t...)
+		}
+		p.setSlot(i, 0, 0)
+	}
+	upper := p.end()
+	for i := 0; i < p.slots(); i++ {
+		if t, ok := live[i]; ok {
+			upper -= len(t)
+			copy(p[upper:], t)
+			p.setSlot(i, upper, len(t))
+		}
+	}
+	clear(p[p.lower():upper])
+	p.setUpper(upper)
+
+	// Free slots at the end of the directory go back to the free space
+	slots := p.slots()
+	for slots > 0 {
+		if offset, _ := p.slot(slots - 1); offset != 0 {
+			break
+		}
+		slots--
+	}
+	p.setSlots(slots)
+	p.setLower(documentPageHeaderSize + slots*slotSize)
+}
+
+// fits reports whether insert has room for a tuple, without changing the page
+func (p slottedPage) fits(t tuple) bool {
+	need := len(t)
+	if p.freeSlot() < 0 {
+		need += slotSize
+	}
+	return p.upper()-p.lower() >= need || p.room() >= len(t)+slotSize
+}
+
+// insert places a tuple in the page, in a free slot or a new one, and reports whether it
+// had room
+func (p slottedPage) insert(t tuple) bool {
+	if !p.fits(t) {
+		return false
+	}
+	slot, need := p.freeSlot(), len(t)
+	if slot < 0 {
+		need += slotSize
+	}
+	if p.upper()-p.lower() < need {
+		p.compact()
+		if slot = p.freeSlot(); slot < 0 {
+			need = len(t) + slotSize
+		}
+	}
+	if slot < 0 {
+		slot = p.slots()
+		p.setSlots(slot + 1)
+		p.setLower(p.lower() + slotSize)
+	}
+	p.place(slot, t)
+	return true
+}
+
+// replace puts t in place of the tuple of slot, keeping the slot, and reports whether the
+// page had room. A tuple no larger is rewritten where it is; a larger one is moved.
+func (p slottedPage) replace(slot int, t tuple) bool {
+	offset, length := p.slot(slot)
+	if len(t) <= length {
+		copy(p[offset:], t)
+		p.setSlot(slot, offset, len(t))
+		return true
+	}
+	if p.room()+length < len(t) {
+		return false
+	}
+
+	// The old tuple's space is freed by compacting the page without it
+	p.tuple(slot).setDeleted(t.created())
+	if p.upper()-p.lower() < len(t) {
+		p.compact()
+		if slot >= p.slots() {
+			p.setSlots(slot + 1)
+			p.setLower(documentPageHeaderSize + (slot+1)*slotSize)
+		}
+	}
+	p.place(slot, t)
+	return true
+}
+
+// place copies t into the free space, for slot
+func (p slottedPage) place(slot int, t tuple) {
+	upper := p.upper() - len(t)
+	copy(p[upper:], t)
+	p.setUpper(upper)
+	p.setSlot(slot, upper, len(t))
+}
+
+// freeSlot returns a slot free for reuse, -1 if there is none
+func (p slottedPage) freeSlot() int {
+	for i := 0; i < p.slots(); i++ {
+		if offset, _ := p.slot(i); offset == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// encodePagedDocument encodes a document as a paged entry holds it
+func encodePagedDocument(document models.Document) ([]byte, error) {
+	fields := make(map[string]interface{}, len(document.Fields))
+	for name, field := range document.Fields {
+		fields[name] = field.Value
+	}
+	return helpers.EncodeBSON(map[string]interface{}{
+		"ID":        document.DocumentID,
+		"Fields":    fields,
+		"CreatedAt": document.CreatedAt,
+		"UpdatedAt": document.UpdatedAt,
+	})
+}
+
+// decodePagedDocument decodes a document encodePagedDocument encoded
+func decodePagedDocument(data []byte) (models.Document, error) {
+	decoded, err := helpers.DecodeBSON(data)
+	if err != nil {
+		return models.Document{}, err
+	}
+	documentMap := decoded.(map[string]interface{})
+	documentID, ok := documentMap["ID"].(string)
+	if !ok {
+		return models.Document{}, fmt.Errorf("document has no ID")
+	}
+
+	document := models.Document{DocumentID: documentID, Fields: make(map[string]models.Field)}
+	if created, ok := documentMap["CreatedAt"].(time.Time); ok {
+		document.CreatedAt = created
+	}
+	if updated, ok := documentMap["UpdatedAt"].(time.Time); ok {
+		document.UpdatedAt = updated
+	}
+	if fields, ok := documentMap["Fields"].(map[string]interface{}); ok {
+		for name, value := range fields {
+			document.Fields[name] = models.Field{Name: name, Value: value}
+		}
+	}
+	return document, nil
+}
+
+// parseHeaderPage parses the header page of a bundle file, returning the bundle without its
+// documents, how many it has and how many pages the file has
+func (bs *BundleStorageEngine) parseHeaderPage(ctx context.Context, fileID uint32, pageData []byte) (*models.Bundle, uint32, uint32, error) {
+	if err := checkHeaderPage(pageData); err != nil {
+		return nil, 0, 0, err
+	}
+	docCount := binary.LittleEndian.Uint32(pageData[headerDocCount:])
+	pageCount := binary.LittleEndian.Uint32(pageData[headerPageCount:])
+
+	metadata, _, err := bs.readPagedEntry(ctx, fileID, pageData[pagedHeaderSize:])
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("could not read bundle metadata: %w", err)
+	}
+	decoded, err := helpers.DecodeBSON(metadata)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("could not decode bundle metadata: %w", err)
+	}
+	bundle, err := MapToBundle(decoded.(map[string]interface{}), *bs.logger)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("could not decode bundle metadata: %w", err)
+	}
+	return bundle, docCount, pageCount, nil
+}
+
+// checkHeaderPage reports a header page this server cannot read
+func checkHeaderPage(pageData []byte) error {
+	if binary.LittleEndian.Uint32(pageData[0:4]) != pagedBundleMagic {
+		return fmt.Errorf("invalid bundle file format (bad magic number)")
+	}
+
+	// The version of the paged layout, apart from BundleFormatVersion
+	version := binary.LittleEndian.Uint32(pageData[12:16])
+	if version != pagedBundleFormatVersion {
+		return fmt.Errorf("unsupported paged bundle file version %d; this server reads version %d", version, pagedBundleFormatVersion)
+	}
+	if _, ok := checkPage(pageData); !ok {
+		return fmt.Errorf("the header page fails its checksum")
+	}
+	return nil
+}
+
+// readDocuments reads the live documents of a bundle file's document pages, stopping between
+// pages when ctx is canceled
+func (bs *BundleStorageEngine) readDocuments(ctx context.Context, fileID uint32, pageCount uint32, docCount uint32) (map[string]models.Document, error) {
+	docs := make(map[string]models.Document, docCount)
+
+	// Block 0 is the header; the others are told apart by their magic
+	for block := uint32(1); block < pageCount; block++ {
+		buffer, err := bs.fileManager.ReadPage(ctx, fileID, block)
+		if err != nil {
+			return nil, fmt.Errorf("could not read page %d: %w", block, err)
+		}
+		if _, ok := checkPage(buffer.Data); !ok {
+			err = fmt.Errorf("the page fails its checksum")
+		} else if isDocumentPage(buffer.Data) {
+			err = bs.processDocumentPage(ctx, fileID, buffer.Data, docs)
+		}
+		bs.fileManager.ReleasePage(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("could not process document page %d: %w", block, err)
+		}
+	}
+
+	if uint32(len(docs)) != docCount {
+		return nil, fmt.Errorf("the file has %d live documents; its header counts %d", len(docs), docCount)
+	}
+	return docs, nil
+}
+
+// processDocumentPage extracts the live documents of a page, reading those held in overflow
+// pages
+func (bs *BundleStorageEngine) processDocumentPage(ctx context.Context, fileID uint32, pageData []byte, docs map[string]models.Document) error {
+	page := slottedPage(pageData)
+	if err := page.check(); err != nil {
+		return err
+	}
+
+	for i := 0; i < page.slots(); i++ {
+		t := page.tuple(i)
+		if t == nil || t.deleted() != 0 {
+			continue
+		}
+		data := t.inline()
+		if data == nil {
+			var err error
+			if data, err = bs.readOverflow(ctx, fileID, t.overflow(), t.length()); err != nil {
+				return err
+			}
+		}
+
+		doc, err := decodePagedDocument(data)
+		if err != nil {
+			return fmt.Errorf("could not decode the document of slot %d: %w", i, err)
+		}
+		if doc.DocumentID != t.documentID() {
+			return fmt.Errorf("slot %d holds document %s under ID %s", i, doc.DocumentID, t.documentID())
+		}
+		docs[doc.DocumentID] = doc
+	}
+	return nil
+}
+
+// readPagedEntry returns the bytes of the entry at the start of buf, following its overflow
+// chain if it has one, and the size of the entry in buf
+func (bs *BundleStorageEngine) readPagedEntry(ctx context.Context, fileID uint32, buf []byte) ([]byte, int, error) {
+	if len(buf) < pagedEntryHeaderSize {
+		return nil, 0, fmt.Errorf("unexpected end of page data")
+	}
+	length := int(binary.LittleEndian.Uint32(buf[0:4]))
+	overflow := binary.LittleEndian.Uint32(buf[4:8])
+	if overflow == 0 {
+		if pagedEntryHeaderSize+length > len(buf) {
+			return nil, 0, fmt.Errorf("entry exceeds page boundary")
+		}
+		data := make([]byte, length)
+		copy(data, buf[pagedEntryHeaderSize:])
+		return data, pagedEntryHeaderSize + length, nil
+	}
+
+	data, err := bs.readOverflow(ctx, fileID, overflow, length)
+	return data, pagedEntryHeaderSize, err
+}
+
+// readOverflow reads length bytes from the chain of overflow pages starting at block
+func (bs *BundleStorageEngine) readOverflow(ctx context.Context, fileID uint32, block uint32, length int) ([]byte, error) {
+	data := make([]byte, 0, length)
+	for len(data) < length {
+		if block == 0 {
+			return nil, fmt.Errorf("overflow chain ends after %d of %d bytes", len(data), length)
+		}
+		buffer, err := bs.fileManager.ReadPage(ctx, fileID, block)
+		if err != nil {
+			return nil, fmt.Errorf("could not read overflow page %d: %w", block, err)
+		}
+		page := buffer.Data
+		if binary.LittleEndian.Uint32(page[0:4]) != overflowPageMagic {
+			bs.fileManager.ReleasePage(buffer)
+			return nil, fmt.Errorf("block %d is not an overflow page", block)
+		}
+		next := binary.LittleEndian.Uint32(page[12:16])
+		used := int(binary.LittleEndian.Uint32(page[16:20]))
+		if used == 0 || used > overflowCapacity(len(page)) || len(data)+used > length {
+			bs.fileManager.ReleasePage(buffer)
+			return nil, fmt.Errorf("overflow page %d holds %d bytes, which its entry cannot have left", block, used)
+		}
+		data = append(data, page[overflowPageHeaderSize:overflowPageHeaderSize+used]...)
+		bs.fileManager.ReleasePage(buffer)
+		block = next
+	}
+	return data, nil
+}
+
+// AddPagedDocument adds a document to a paged bundle file in place, refusing one encoded
+// larger than maxDocumentBytes (0 allows any size)
+func (bs *BundleStorageEngine) AddPagedDocument(bundleName string, document models.Document, maxDocumentBytes int64) error {
+	return bs.changePagedBundle(bundleName, func(pf *pagedFile, generation uint32) error {
+		block, _, err := pf.find(document.DocumentID)
+		if err != nil {
+			return err
+		}
+		if block != 0 {
+			return protocol.Errorf(protocol.ErrAlreadyExists, "document '%s' already exists in bundle '%s'", document.DocumentID, bundleName)
+		}
+
+		t, err := pf.newTuple(generation, document, maxDocumentBytes)
+		if err != nil {
+			return err
+		}
+		if err := pf.place(t); err != nil {
+			return err
+		}
+		pf.setHeader(headerDocCount, pf.header(headerDocCount)+1)
+		return nil
+	})
+}
+
+// UpdatePagedDocument replaces a document of a paged bundle file in place, refusing one
+// encoded larger than maxDocumentBytes (0 allows any size). The document keeps its slot
+// unless its page has no room for it grown.
+func (bs *BundleStorageEngine) UpdatePagedDocument(bundleName string, document models.Document, maxDocumentBytes int64) error {
+	return bs.changePagedBundle(bundleName, func(pf *pagedFile, generation uint32) error {
+		block, slot, err := pf.find(document.DocumentID)
+		if err != nil {
+			return err
+		}
+		if block == 0 {
+			return protocol.Errorf(protocol.ErrDocumentNotFound, "document '%s' not found in bundle '%s'", document.DocumentID, bundleName)
+		}
+
+		t, err := pf.newTuple(generation, document, maxDocumentBytes)
+		if err != nil {
+			return err
+		}
+		page, err := pf.page(block)
+		if err != nil {
+			return err
+		}
+		if err := pf.freeOverflow(slottedPage(page).tuple(slot).overflow()); err != nil {
+			return err
+		}
+		if slottedPage(page).replace(slot, t) {
+			return nil
+		}
+
+		// The page has no room for it grown, so it moves
+		slottedPage(page).tuple(slot).setDeleted(generation)
+		return pf.place(t)
+	})
+}
+
+// DeletePagedDocument deletes a document of a paged bundle file in place. Its tuple is kept,
+// marked deleted, until its page is next compacted.
+func (bs *BundleStorageEngine) DeletePagedDocument(bundleName string, documentID string) error {
+	return bs.changePagedBundle(bundleName, func(pf *pagedFile, generation uint32) error {
+		block, slot, err := pf.find(documentID)
+		if err != nil {
+			return err
+		}
+		if block == 0 {
+			return protocol.Errorf(protocol.ErrDocumentNotFound, "document '%s' not found in bundle '%s'", documentID, bundleName)
+		}
+
+		page, err := pf.page(block)
+		if err != nil {
+			return err
+		}
+		t := slottedPage(page).tuple(slot)
+		if err := pf.freeOverflow(t.overflow()); err != nil {
+			return err
+		}
+		t.setDeleted(generation)
+		pf.setHeader(headerDocCount, pf.header(headerDocCount)-1)
+		return nil
+	})
+}
+
+// changePagedBundle runs change on copies of the pages of a paged bundle file, under the
+// next generation. Once it succeeds the pages it changed are logged and take the place of
+// theirs in the buffer pool, to be written behind the log; a change that fails changes
+// nothing.
+func (bs *BundleStorageEngine) changePagedBundle(bundleName string, change func(pf *pagedFile, generation uint32) error) error {
+	if bs.pageWAL == nil {
+		return errNoPageLog
+	}
+	bs.pagedMu.Lock()
+	defer bs.pagedMu.Unlock()
+
+	fileName := helpers.BundleFileName(bundleName)
+	fileID, err := bs.fileManager.OpenFile(fileName)
+	if err != nil {
+		return fmt.Errorf("could not open bundle file: %w", err)
+	}
+	pf := &pagedFile{
+		fm:         bs.fileManager,
+		bundleName: bundleName,
+		fileID:     fileID,
+		pages:      make(map[uint32][]byte),
+		fresh:      make(map[uint32]bool),
+	}
+	header, err := pf.page(0)
+	if err != nil {
+		return err
+	}
+	if err := checkHeaderPage(header); err != nil {
+		return fmt.Errorf("could not parse header page of bundle file %s: %w", fileName, err)
+	}
+
+	generation := pf.header(headerGeneration) + 1
+	pf.setHeader(headerGeneration, generation)
+	if err := change(pf, generation); err != nil {
+		return err
+	}
+	lsn, err := pf.commit(bs.pageWAL)
+	if err != nil {
+		return fmt.Errorf("could not write bundle file %s: %w", fileName, err)
+	}
+
+	// The change is durable once its record is; the pages follow when the pool writes them
+	switch bs.syncer.Durability(nil) {
+	case models.DurabilityAlways:
+		err = bs.pageWAL.Flush(lsn)
+	case models.DurabilityInterval:
+		err = bs.syncer.Written(nil, bs.pageWAL.file)
+	}
+	if err != nil {
+		return err
+	}
+	if bs.pageWAL.Size() > pageWALCheckpointBytes {
+		return bs.checkpointPagesLocked()
+	}
+	return nil
+}
+
+// CheckpointPages writes every page changed behind the page log to its file, syncs the files
+// and empties the log, so a restart has nothing to redo
+func (bs *BundleStorageEngine) CheckpointPages() error {
+	bs.pagedMu.Lock()
+	defer bs.pagedMu.Unlock()
+	return bs.checkpointPagesLocked()
+}
+
+func (bs *BundleStorageEngine) checkpointPagesLocked() error {
+	if bs.pageWAL == nil {
+		return nil
+	}
+	return bs.pageWAL.Checkpoint(bs.fileManager.SyncAll)
+}
+
+// pagedFile is a paged bundle file being changed. The pages a change writes are copies until
+// it commits.
+type pagedFile struct {
+	fm         *buffermgr.FileManager
+	bundleName string
+	fileID     uint32
+	pages      map[uint32][]byte // Copies of the pages changed, by block
+	fresh      map[uint32]bool   // Of those, the pages past the end of the file
+}
+
+// Offsets of the header page's counts
+const (
+	headerDocCount   = 16
+	headerPageCount  = 20
+	headerGeneration = 24
+	headerFreeList   = 28
+)
+
+// header returns one of the header page's counts
+func (pf *pagedFile) header(at int) uint32 {
+	return binary.LittleEndian.Uint32(pf.pages[0][at : at+4])
+}
+
+func (pf *pagedFile) setHeader(at int, n uint32) {
+	binary.LittleEndian.PutUint32(pf.pages[0][at:at+4], n)
+}
+
+// page returns the copy of a page the change writes, copying it from the buffer pool the
+// first time
+func (pf *pagedFile) page(block uint32) ([]byte, error) {
+	if page, ok := pf.pages[block]; ok {
+		return page, nil
+	}
+	buffer, err := pf.fm.ReadPage(context.Background(), pf.fileID, block)
+	if err != nil {
+		return nil, fmt.Errorf("could not read page %d: %w", block, err)
+	}
+	page := append([]byte(nil), buffer.Data...)
+	pf.fm.ReleasePage(buffer)
+	pf.pages[block] = page
+	return page, nil
+}
+
+// view calls read with a page as the change sees it, without copying it
+func (pf *pagedFile) view(block uint32, read func(page []byte) error) error {
+	if page, ok := pf.pages[block]; ok {
+		return read(page)
+	}
+	buffer, err := pf.fm.ReadPage(context.Background(), pf.fileID, block)
+	if err != nil {
+		return fmt.Errorf("could not read page %d: %w", block, err)
+	}
+	defer pf.fm.ReleasePage(buffer)
+	return read(buffer.Data)
+}
+
+// commit logs the pages the change wrote and puts them in the buffer pool, returning the
+// change's LSN
+func (pf *pagedFile) commit(wal *PageWAL) (uint64, error) {
+	blocks := make([]uint32, 0, len(pf.pages))
+	for block := range pf.pages {
+		blocks = append(blocks, block)
+	}
+	slices.Sort(blocks)
+	logged := make([]LoggedPage, len(blocks))
+	for i, block := range blocks {
+		logged[i] = LoggedPage{Block: block, Data: pf.pages[block]}
+	}
+	lsn, err := wal.Log(helpers.BundleFileName(pf.bundleName), logged)
+	if err != nil {
+		return 0, err
+	}
+
+	// From here on the change has happened: should a page not reach the pool, the log redoes
+	// it at the next start
+	for _, block := range blocks {
+		var buffer *buffermgr.DBPageBuffer
+		if pf.fresh[block] {
+			buffer, err = pf.fm.NewPage(pf.fileID, block)
+		} else {
+			buffer, err = pf.fm.ReadPage(context.Background(), pf.fileID, block)
+		}
+		if err != nil {
+			return lsn, fmt.Errorf("could not get page %d: %w", block, err)
+		}
+		copy(buffer.Data, pf.pages[block])
+		pf.fm.WritePageLSN(buffer, lsn)
+		pf.fm.ReleasePage(buffer)
+	}
+	return lsn, nil
+}
+
+// newTuple encodes a document as a tuple created at generation, writing it to an overflow
+// chain when it is too large for a page
+func (pf *pagedFile) newTuple(generation uint32, document models.Document, maxDocumentBytes int64) (tuple, error) {
+	data, err := encodePagedDocument(document)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding document %s: %w", document.DocumentID, err)
+	}
+	if err := checkPagedDocument(pf.bundleName, document.DocumentID, data, maxDocumentBytes); err != nil {
+		return nil, err
+	}
+
+	overflow := uint32(0)
+	if len(data) > pf.fm.PageSize()/4 {
+		if overflow, err = pf.writeOverflow(data); err != nil {
+			return nil, err
+		}
+	}
+	return newTuple(generation, document.DocumentID, data, overflow), nil
+}
+
+// find returns the block and slot of the live tuple of a document, block 0 if the file has
+// none
+func (pf *pagedFile) find(documentID string) (uint32, int, error) {
+	errFound := errors.New("found")
+	for block := uint32(1); block < pf.header(headerPageCount); block++ {
+		slot := -1
+		err := pf.view(block, func(data []byte) error {
+			page := slottedPage(data)
+			if !isDocumentPage(page) {
+				return nil
+			}
+			if err := page.check(); err != nil {
+				return fmt.Errorf("document page %d: %w", block, err)
+			}
+			for i := 0; i < page.slots(); i++ {
+				if t := page.tuple(i); t != nil && t.deleted() == 0 && t.documentID() == documentID {
+					slot = i
+					return errFound
+				}
+			}
+			return nil
+		})
+		if err == errFound {
+			return block, slot, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return 0, 0, nil
+}
+
+// place inserts a tuple into the first document page with room for it, or a new one
+func (pf *pagedFile) place(t tuple) error {
+	for block := uint32(1); block < pf.header(headerPageCount); block++ {
+		fits := false
+		err := pf.view(block, func(page []byte) error {
+			fits = isDocumentPage(page) && slottedPage(page).fits(t)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if fits {
+			page, err := pf.page(block)
+			if err != nil {
+				return err
+			}
+			slottedPage(page).insert(t)
+			return nil
+		}
+	}
+
+	_, page, err := pf.allocate()
+	if err != nil {
+		return err
+	}
+	slottedPage(page).init()
+	if !slottedPage(page).insert(t) {
+		return fmt.Errorf("document ID '%s' is too long for a page", t.documentID())
+	}
+	return nil
+}
+
+// allocate returns a page to fill, the first of the free list or a new one at the end of
+// the file, its contents cleared
+func (pf *pagedFile) allocate() (uint32, []byte, error) {
+	if block := pf.header(headerFreeList); block != 0 {
+		page, err := pf.page(block)
+		if err != nil {
+			return 0, nil, err
+		}
+		if binary.LittleEndian.Uint32(page[0:4]) != freePageMagic {
+			return 0, nil, fmt.Errorf("block %d on the free list is not a free page", block)
+		}
+		pf.setHeader(headerFreeList, binary.LittleEndian.Uint32(page[12:16]))
+		clear(page)
+		return block, page, nil
+	}
+
+	block := pf.header(headerPageCount)
+	pf.setHeader(headerPageCount, block+1)
+	page := make([]byte, pf.fm.PageSize())
+	pf.pages[block] = page
+	pf.fresh[block] = true
+	return block, page, nil
+}
+
+// writeOverflow writes data to a new overflow chain and returns its first block
+func (pf *pagedFile) writeOverflow(data []byte) (uint32, error) {
+	count := overflowPageCount(len(data), pf.fm.PageSize())
+	blocks := make([]uint32, count)
+	pages := make([][]byte, count)
+	for i := range count {
+		block, page, err := pf.allocate()
+		if err != nil {
+			return 0, err
+		}
+		blocks[i], pages[i] = block, page
+	}
+	fillOverflowPages(pages, blocks, data)
+	return blocks[0], nil
+}
+
+// freeOverflow puts the pages of the overflow chain starting at block on the free list
+func (pf *pagedFile) freeOverflow(block uint32) error {
+	for block != 0 {
+		page, err := pf.page(block)
+		if err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(page[0:4]) != overflowPageMagic {
+			return fmt.Errorf("block %d is not an overflow page", block)
+		}
+		next := binary.LittleEndian.Uint32(page[12:16])
+		clear(page)
+		binary.LittleEndian.PutUint32(page[0:4], freePageMagic)
+		binary.LittleEndian.PutUint32(page[12:16], pf.header(headerFreeList))
+		pf.setHeader(headerFreeList, block)
+		block = next
+	}
+	return nil
+}
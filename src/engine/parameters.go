@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"syndrdb/src/protocol"
+)
+
+/*
+	Positional parameters.
+
+	A command may hold $1, $2, ... where a value goes, and have its values sent next to it
+	instead of written into it, so text a user typed never has to be spliced into SyndrQL by
+	hand. Binding writes each value as the literal it stands for: strings are quoted and
+	escaped, so whatever they hold stays one string and cannot end the value early and
+	continue the command. A $n inside a quoted string is text, not a parameter.
+
+	Values are strings, numbers and booleans, as Go values or as decoded from JSON; SyndrQL
+	has no null, list or object literal to bind the others to. Every value must be used and
+	every $n must have a value.
+*/
+
+// BindParameters replaces the $n placeholders of a command with its params, in order
+func BindParameters(command string, params []interface{}) (string, error) {
+	tokens, err := tokenize(command, "(){},;", statementOperators)
+	if err != nil {
+		return "", err
+	}
+
+	var bound strings.Builder
+	used := make([]bool, len(params))
+	last := 0
+	for _, token := range tokens {
+		index, isParameter := parameterIndex(token)
+		if !isParameter {
+			continue
+		}
+		if index < 1 || index > len(params) {
+			return "", protocol.WithCode(protocol.ErrParameter, newSyntaxError(command, token.Offset, token.End, fmt.Sprintf("parameter %s has no value (%d given)", token.Text, len(params))))
+		}
+		literal, err := parameterLiteral(params[index-1])
+		if err != nil {
+			return "", protocol.Errorf(protocol.ErrParameter, "parameter %s: %w", token.Text, err)
+		}
+		bound.WriteString(command[last:token.Offset])
+		bound.WriteString(literal)
+		last = token.End
+		used[index-1] = true
+	}
+	bound.WriteString(command[last:])
+
+	for i, isUsed := range used {
+		if !isUsed {
+			return "", protocol.Errorf(protocol.ErrParameter, "parameter $%d was given but the command does not use it", i+1)
+		}
+	}
+	return bound.String(), nil
+}
+
+// QuoteString writes a value as a SyndrQL string that reads back as exactly that value
+func QuoteString(value string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// parameterIndex returns n for a $n word
+func parameterIndex(token Token) (int, bool) {
+	if token.Kind != TokenWord || len(token.Text) < 2 || token.Text[0] != '$' {
+		return 0, false
+	}
+	index, err := strconv.Atoi(token.Text[1:])
+	if err != nil || strings.ContainsAny(token.Text[1:], "+-") {
+		return 0, false
+	}
+	return index, true
+}
+
+// parameterLiteral writes a parameter value as a SyndrQL literal; floats always get a
+// decimal point, so a whole one is not read back as an integer
+func parameterLiteral(value interface{}) (string, error) {
+	switch typed := value.(type) {
+	case string:
+		return QuoteString(typed), nil
+	case bool:
+		return strconv.FormatBool(typed), nil
+	case int:
+		return strconv.FormatInt(int64(typed), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(typed), 10), nil
+	case int64:
+		return strconv.FormatInt(typed, 10), nil
+	case uint:
+		return strconv.FormatUint(uint64(typed), 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(typed), 10), nil
+	case uint64:
+		return strconv.FormatUint(typed, 10), nil
+	case float32:
+		return floatLiteral(float64(typed))
+	case float64:
+		return floatLiteral(typed)
+	case json.Number:
+		if integer, err := typed.Int64(); err == nil {
+			return strconv.FormatInt(integer, 10), nil
+		}
+		float, err := typed.Float64()
+		if err != nil {
+			return "", fmt.Errorf("invalid number %s", typed)
+		}
+		return floatLiteral(float)
+	case nil:
+		return "", fmt.Errorf("null cannot be bound; SyndrQL has no null literal")
+	}
+	return "", fmt.Errorf("values of type %T cannot be bound; use a string, number or boolean", value)
+}
+
+func floatLiteral(value float64) (string, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", fmt.Errorf("%v cannot be bound", value)
+	}
+	literal := strconv.FormatFloat(value, 'f', -1, 64)
+	if !strings.Contains(literal, ".") {
+		literal += ".0"
+	}
+	return literal, nil
+}
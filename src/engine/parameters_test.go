@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"encoding/json"
+	"syndrdb/src/protocol"
+	"testing"
+)
+
+func TestBindParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		params  []interface{}
+		want    string
+	}{
+		{
+			name:    "string and integer",
+			command: `SELECT DOCUMENTS FROM "U" WHERE "Name" == $1 AND "Age" > $2;`,
+			params:  []interface{}{"Bo", 3},
+			want:    `SELECT DOCUMENTS FROM "U" WHERE "Name" == "Bo" AND "Age" > 3;`,
+		},
+		{
+			name:    "quotes and backslashes stay in the string",
+			command: `SELECT DOCUMENTS FROM "U" WHERE "Name" == $1;`,
+			params:  []interface{}{`a"; DELETE DOCUMENTS FROM "U" WHERE "x" == "\`},
+			want:    `SELECT DOCUMENTS FROM "U" WHERE "Name" == "a\"; DELETE DOCUMENTS FROM \"U\" WHERE \"x\" == \"\\";`,
+		},
+		{
+			name:    "whole float keeps its decimal point",
+			command: `SELECT DOCUMENTS FROM "U" WHERE "Score" > $1;`,
+			params:  []interface{}{2.0},
+			want:    `SELECT DOCUMENTS FROM "U" WHERE "Score" > 2.0;`,
+		},
+		{
+			name:    "reused placeholder",
+			command: `SELECT DOCUMENTS FROM "U" WHERE "A" == $1 OR "B" == $1;`,
+			params:  []interface{}{true},
+			want:    `SELECT DOCUMENTS FROM "U" WHERE "A" == true OR "B" == true;`,
+		},
+		{
+			name:    "JSON numbers",
+			command: `SELECT DOCUMENTS FROM "U" WHERE "Age" > $1 AND "Score" < $2;`,
+			params:  []interface{}{json.Number("7"), json.Number("1.25")},
+			want:    `SELECT DOCUMENTS FROM "U" WHERE "Age" > 7 AND "Score" < 1.25;`,
+		},
+		{
+			name:    "placeholder inside a string is text",
+			command: `SELECT DOCUMENTS FROM "U" WHERE "Name" == "$1";`,
+			want:    `SELECT DOCUMENTS FROM "U" WHERE "Name" == "$1";`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := BindParameters(test.command, test.params)
+			if err != nil {
+				t.Fatalf("BindParameters(%q) failed: %v", test.command, err)
+			}
+			if got != test.want {
+				t.Errorf("BindParameters(%q) = %q, want %q", test.command, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBindParametersErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		params  []interface{}
+	}{
+		{"missing value", `SELECT DOCUMENTS FROM "U" WHERE "Age" > $1;`, nil},
+		{"unused value", `SELECT DOCUMENTS FROM "U" WHERE "Age" > $1;`, []interface{}{1, 2}},
+		{"null", `SELECT DOCUMENTS FROM "U" WHERE "Age" > $1;`, []interface{}{nil}},
+		{"list", `SELECT DOCUMENTS FROM "U" WHERE "Age" > $1;`, []interface{}{[]interface{}{1}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := BindParameters(test.command, test.params)
+			if code := protocol.CodeOf(err); code != protocol.ErrParameter {
+				t.Errorf("BindParameters(%q, %v) error = %v (%s), want %s", test.command, test.params, err, code, protocol.ErrParameter)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"syndrdb/src/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Partitioned bundles split their documents across several data files.
+
+CREATE BUNDLE "Orders"
+WITH FIELDS (...)
+PARTITION BY HASH ("CustomerID") PARTITIONS 4
+
+CREATE BUNDLE "Orders"
+WITH FIELDS (...)
+PARTITION BY RANGE ("Year") BOUNDARIES (2020, 2023)
+
+A RANGE scheme with N boundaries has N+1 partitions: partition i holds values
+below Boundaries[i], and the last partition holds everything else.
+*/
+
+const (
+	PartitionStrategyRange = "RANGE"
+	PartitionStrategyHash  = "HASH"
+
+	// MaxPartitions bounds the number of files a single bundle can be split into
+	MaxPartitions = 256
+)
+
+// newPartitionScheme validates the parts of a PARTITION BY clause. HASH schemes take a
+// partition count; RANGE schemes take ascending boundaries and get one more partition than that.
+func newPartitionScheme(strategy string, field string, partitionCount int, boundaries []interface{}) (*models.PartitionScheme, error) {
+	scheme := &models.PartitionScheme{
+		Strategy: strategy,
+		Field:    field,
+	}
+
+	switch strategy {
+	case PartitionStrategyHash:
+		if partitionCount < 2 || partitionCount > MaxPartitions {
+			return nil, fmt.Errorf("partition count must be between 2 and %d", MaxPartitions)
+		}
+		scheme.PartitionCount = partitionCount
+	case PartitionStrategyRange:
+		if len(boundaries) == 0 || len(boundaries)+1 > MaxPartitions {
+			return nil, fmt.Errorf("RANGE partitioning needs between 1 and %d boundaries", MaxPartitions-1)
+		}
+		if !sort.SliceIsSorted(boundaries, func(i, j int) bool {
+			return CompareOrderedValues(boundaries[i], boundaries[j]) < 0
+		}) {
+			return nil, fmt.Errorf("RANGE boundaries must be in ascending order")
+		}
+		scheme.Boundaries = boundaries
+		scheme.PartitionCount = len(boundaries) + 1
+	default:
+		return nil, fmt.Errorf("unknown partition strategy '%s'", strategy)
+	}
+
+	return scheme, nil
+}
+
+// PartitionForValue returns the partition that owns a partition key value
+func PartitionForValue(scheme *models.PartitionScheme, value interface{}) int {
+	switch scheme.Strategy {
+	case PartitionStrategyHash:
+		h := fnv.New32a()
+		h.Write([]byte(fmt.Sprintf("%v", value)))
+		return int(h.Sum32() % uint32(scheme.PartitionCount))
+	default:
+		for i, boundary := range scheme.Boundaries {
+			if CompareOrderedValues(value, boundary) < 0 {
+				return i
+			}
+		}
+		return len(scheme.Boundaries)
+	}
+}
+
+// PartitionForDocument returns the partition that owns a document.
+// Documents without the partition key land in partition 0.
+func PartitionForDocument(scheme *models.PartitionScheme, doc *models.Document) int {
+	field, exists := doc.Fields[scheme.Field]
+	if !exists || field.Value == nil {
+		return 0
+	}
+	return PartitionForValue(scheme, field.Value)
+}
+
+// PrunePartitions returns the partitions that can hold documents matching the WHERE clause.
+// It only narrows on AND-ed predicates over the partition key; anything it cannot reason
+// about keeps every partition.
+func PrunePartitions(scheme *models.PartitionScheme, whereGroup *WhereGroup) []int {
+	candidates := make(map[int]bool, scheme.PartitionCount)
+	for i := 0; i < scheme.PartitionCount; i++ {
+		candidates[i] = true
+	}
+
+	if whereGroup != nil {
+		prunePartitionGroup(scheme, whereGroup, candidates)
+	}
+
+	partitions := make([]int, 0, len(candidates))
+	for i := range candidates {
+		partitions = append(partitions, i)
+	}
+	sort.Ints(partitions)
+	return partitions
+}
+
+func prunePartitionGroup(scheme *models.PartitionScheme, group *WhereGroup, candidates map[int]bool) {
+	// An OR anywhere at this level means a predicate no longer has to hold on its own
+	for _, clause := range group.Clauses {
+		if clause.Logic == "OR" {
+			return
+		}
+	}
+	for _, sub := range group.SubGroups {
+		if sub.Logic == "OR" {
+			return
+		}
+	}
+
+	for _, clause := range group.Clauses {
+		if clause.Field != scheme.Field || clause.Value == nil {
+			continue
+		}
+		allowed := partitionsForPredicate(scheme, clause.Operator, clause.Value)
+		if allowed == nil {
+			continue
+		}
+		for partition := range candidates {
+			if !allowed[partition] {
+				delete(candidates, partition)
+			}
+		}
+	}
+
+	for i := range group.SubGroups {
+		prunePartitionGroup(scheme, &group.SubGroups[i], candidates)
+	}
+}
+
+// partitionsForPredicate returns the partitions a single predicate can match, or nil for all
+func partitionsForPredicate(scheme *models.PartitionScheme, operator string, value interface{}) map[int]bool {
+	if operator == "==" {
+		return map[int]bool{PartitionForValue(scheme, value): true}
+	}
+	if operator == "IN" {
+		values, _ := value.([]interface{})
+		allowed := make(map[int]bool, len(values))
+		for _, listed := range values {
+			allowed[PartitionForValue(scheme, listed)] = true
+		}
+		return allowed
+	}
+
+	if scheme.Strategy != PartitionStrategyRange {
+		return nil
+	}
+
+	owner := PartitionForValue(scheme, value)
+	allowed := make(map[int]bool)
+	switch operator {
+	case "<":
+		for i := 0; i <= owner; i++ {
+			allowed[i] = true
+		}
+	case ">":
+		for i := owner; i < scheme.PartitionCount; i++ {
+			allowed[i] = true
+		}
+	default:
+		return nil
+	}
+	return allowed
+}
+
+// PartitionSchemeToMap converts a partition scheme for BSON storage
+func PartitionSchemeToMap(scheme *models.PartitionScheme) map[string]interface{} {
+	return map[string]interface{}{
+		"Strategy":       scheme.Strategy,
+		"Field":          scheme.Field,
+		"Boundaries":     scheme.Boundaries,
+		"PartitionCount": scheme.PartitionCount,
+	}
+}
+
+// MapToPartitionScheme restores a partition scheme decoded from BSON
+func MapToPartitionScheme(data map[string]interface{}) *models.PartitionScheme {
+	scheme := &models.PartitionScheme{
+		Strategy: stringValue(data, "Strategy", PartitionStrategyHash),
+		Field:    stringValue(data, "Field", ""),
+	}
+
+	if count, ok := numericValue(data["PartitionCount"]); ok {
+		scheme.PartitionCount = int(count)
+	}
+
+	var boundaries []interface{}
+	switch b := data["Boundaries"].(type) {
+	case primitive.A:
+		boundaries = b
+	case []interface{}:
+		boundaries = b
+	}
+
+	for _, boundary := range boundaries {
+		// BSON decodes ints as int32/int64, so narrow them back to int
+		if n, ok := boundary.(int32); ok {
+			boundary = int(n)
+		} else if n, ok := boundary.(int64); ok {
+			boundary = int(n)
+		}
+		scheme.Boundaries = append(scheme.Boundaries, boundary)
+	}
+
+	return scheme
+}
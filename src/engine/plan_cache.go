@@ -0,0 +1,307 @@
+package engine
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"syndrdb/src/models"
+)
+
+/*
+	Query plan cache.
+
+	Planning a WHERE clause costs every index of the bundle, and gathering the statistics of
+	an index walks all of its keys, so a query sent over and over is planned over and over.
+	Plans are cached by bundle and by the shape of the WHERE condition: its fields, operators
+	and logic without the values compared against or listed after IN, so "Age" > 30 and
+	"Age" > 40 share an entry (see whereShape). The shape is written from the parsed
+	condition; the command is not tokenized again for it. A query whose shape is cached
+	reads through the same indexes, combined the same way, with its own values to look up,
+	and is not costed again. Its plan therefore does not change with the values, even where
+	a histogram would estimate a range differently.
+
+	Each database has its own cache of PlanCacheSize entries in the server's QueryCaches,
+	least recently used dropped first. A bundle's entries are dropped when an index is created on it, when it is analyzed
+	and when it is deleted. An entry is also planned again once the bundle holds more than
+	twice, or less than half, the documents it was planned with. SHOW METRICS reports the
+	hits and misses of each database's cache.
+*/
+
+// PlanCacheStats are the counters SHOW METRICS reports for the plan cache of a database
+type PlanCacheStats struct {
+	Entries  int
+	Hits     uint64
+	Misses   uint64
+	HitRatio float64 // Hits over lookups; 0 before the first
+}
+
+type planCache struct {
+	mu       sync.Mutex
+	database string                   // Name, for SHOW METRICS
+	entries  map[string]*list.Element // By bundle ID and WHERE shape
+	order    *list.List               // Entries, most recently used first
+	hits     uint64
+	misses   uint64
+}
+
+type planCacheEntry struct {
+	key       string
+	bundleID  string
+	plan      *QueryPlan
+	documents int // Documents in the bundle when it was planned
+}
+
+// NormalizeCommand writes a command the way the statement cache keys it: its tokens separated
+// by single spaces, with every value compared against or listed after IN replaced by ?
+func NormalizeCommand(command string) (string, error) {
+	tokens, err := tokenize(command, "(){},;", statementOperators)
+	if err != nil {
+		return "", err
+	}
+	normalized, _ := normalizeTokens(tokens)
+	return normalized, nil
+}
+
+// normalizeTokens is NormalizeCommand over tokenized text; it also returns the positions of
+// the tokens it replaced by ?
+func normalizeTokens(tokens []Token) (string, []int) {
+	parts := make([]string, 0, len(tokens))
+	var values []int
+	inList := false
+	for i, token := range tokens {
+		if token.Kind == TokenPunct {
+			inList = token.Text == "(" && i > 0 && tokens[i-1].isKeyword("IN") || inList && token.Text != ")"
+		}
+		switch {
+		case token.Kind != TokenPunct && (inList || i > 0 && tokens[i-1].Kind == TokenPunct && isValidOperator(tokens[i-1].Text)):
+			parts = append(parts, "?")
+			values = append(values, i)
+		case token.Kind == TokenString:
+			parts = append(parts, QuoteString(token.Text))
+		default:
+			parts = append(parts, token.Text)
+		}
+	}
+	return strings.Join(parts, " "), values
+}
+
+// whereShape writes a WHERE condition the way the plan cache keys it: its fields, operators
+// and logic, with ? for every value
+func whereShape(group *WhereGroup) string {
+	var shape strings.Builder
+	writeWhereShape(&shape, group)
+	return shape.String()
+}
+
+func writeWhereShape(shape *strings.Builder, group *WhereGroup) {
+	shape.WriteByte('(')
+	for _, clause := range group.Clauses {
+		shape.WriteString(QuoteString(clause.Field) + " " + clause.Operator)
+		if list, ok := clause.Value.([]interface{}); ok && clause.Operator == "IN" {
+			shape.WriteString(" (" + strings.Repeat("?,", len(list)) + ")")
+		} else {
+			shape.WriteString(" ?")
+		}
+		shape.WriteString(" " + clause.Logic + " ")
+	}
+	for i := range group.SubGroups {
+		writeWhereShape(shape, &group.SubGroups[i])
+		shape.WriteString(" " + group.SubGroups[i].Logic + " ")
+	}
+	shape.WriteByte(')')
+}
+
+// choosePlan returns the plan PlanQuery would choose for a WHERE condition, reusing the one
+// cached for its shape when there is one
+func choosePlan(bundle *models.Bundle, whereGroup *WhereGroup) *QueryPlan {
+	caches := queryCachesOf(bundle)
+	if caches == nil || caches.planCacheSize <= 0 {
+		return PlanQuery(bundle, whereGroup).Chosen
+	}
+
+	cache := caches.planCacheFor(bundle.Database)
+	key := bundle.BundleID + "\x00" + whereShape(whereGroup)
+	if plan, hit := cache.get(key, bundle, whereGroup); hit {
+		return plan
+	}
+	plan := PlanQuery(bundle, whereGroup).Chosen
+	if _, reusable := rebindPlan(plan, whereGroup); reusable {
+		cache.put(&planCacheEntry{key: key, bundleID: bundle.BundleID, plan: plan, documents: len(bundle.Documents)}, caches.planCacheSize)
+	}
+	return plan
+}
+
+// planCacheFor returns the plan cache of a database, creating it on first use
+func (c *QueryCaches) planCacheFor(database *models.Database) *planCache {
+	id, name := "", ""
+	if database != nil {
+		id, name = database.DatabaseID, database.Name
+	}
+	c.plansMu.Lock()
+	defer c.plansMu.Unlock()
+	cache, exists := c.plans[id]
+	if !exists {
+		cache = &planCache{database: name, entries: make(map[string]*list.Element), order: list.New()}
+		c.plans[id] = cache
+	}
+	return cache
+}
+
+// get returns the cached plan for key bound to the values of whereGroup, dropping the entry
+// if it no longer suits the bundle
+func (c *planCache) get(key string, bundle *models.Bundle, whereGroup *WhereGroup) (*QueryPlan, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exists := c.entries[key]; exists {
+		entry := element.Value.(*planCacheEntry)
+		documents := len(bundle.Documents)
+		if documents <= 2*entry.documents && 2*documents >= entry.documents && planIndexesExist(entry.plan, bundle) {
+			if plan, ok := rebindPlan(entry.plan, whereGroup); ok {
+				c.order.MoveToFront(element)
+				c.hits++
+				return plan, true
+			}
+		}
+		c.remove(element)
+	}
+	c.misses++
+	return nil, false
+}
+
+// put caches a plan, dropping the least recently used entries beyond size
+func (c *planCache) put(entry *planCacheEntry, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exists := c.entries[entry.key]; exists {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > size {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an entry. Callers hold mu.
+func (c *planCache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*planCacheEntry).key)
+	c.order.Remove(element)
+}
+
+// planIndexesExist reports whether every index a plan reads is still defined on the bundle
+func planIndexesExist(plan *QueryPlan, bundle *models.Bundle) bool {
+	if plan.IndexName != "" {
+		if _, exists := bundle.Indexes[plan.IndexName]; !exists {
+			return false
+		}
+	}
+	for _, input := range plan.Inputs {
+		if !planIndexesExist(input, bundle) {
+			return false
+		}
+	}
+	return true
+}
+
+// rebindPlan copies a plan for a WHERE clause of the same shape, to look up its values.
+// It is false for plans it cannot match up with the clause, which read a nested OR group.
+func rebindPlan(plan *QueryPlan, whereGroup *WhereGroup) (*QueryPlan, bool) {
+	if plan.Access == AccessFullScan {
+		bound := *plan
+		return &bound, true
+	}
+	terms := splitOrTerms(whereGroup)
+	if plan.Access != AccessUnion {
+		if len(terms) != 1 {
+			return nil, false
+		}
+		return rebindTerm(plan, terms[0])
+	}
+
+	// A union has one input per OR-ed term, in order
+	if len(terms) != len(plan.Inputs) {
+		return nil, false
+	}
+	bound := *plan
+	bound.Inputs = make([]*QueryPlan, len(plan.Inputs))
+	for i, input := range plan.Inputs {
+		boundInput, ok := rebindTerm(input, terms[i])
+		if !ok {
+			return nil, false
+		}
+		bound.Inputs[i] = boundInput
+	}
+	return &bound, true
+}
+
+// rebindTerm copies the plan of one term, an index lookup or an intersection of them
+func rebindTerm(plan *QueryPlan, term whereTerm) (*QueryPlan, bool) {
+	bound := *plan
+	switch plan.Access {
+	case AccessUnion:
+		return nil, false
+	case AccessIntersect:
+		bound.Inputs = make([]*QueryPlan, len(plan.Inputs))
+		for i, input := range plan.Inputs {
+			if input.Access == AccessUnion || input.Access == AccessIntersect {
+				return nil, false
+			}
+			boundInput := *input
+			boundInput.predicates = term.predicates
+			bound.Inputs[i] = &boundInput
+		}
+	default:
+		bound.predicates = term.predicates
+	}
+	return &bound, true
+}
+
+// InvalidatePlans drops the cached plans of a bundle whose indexes or statistics changed,
+// or that is being deleted
+func InvalidatePlans(bundle *models.Bundle) {
+	caches := queryCachesOf(bundle)
+	if caches == nil || bundle.Database == nil {
+		return
+	}
+	caches.plansMu.Lock()
+	cache, exists := caches.plans[bundle.Database.DatabaseID]
+	caches.plansMu.Unlock()
+	if !exists {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, element := range cache.entries {
+		if element.Value.(*planCacheEntry).bundleID == bundle.BundleID {
+			cache.remove(element)
+		}
+	}
+}
+
+// ForgetDatabasePlans drops the plan cache of a database that is being deleted
+func (c *QueryCaches) ForgetDatabasePlans(database *models.Database) {
+	c.plansMu.Lock()
+	defer c.plansMu.Unlock()
+	delete(c.plans, database.DatabaseID)
+}
+
+// PlanCacheStatistics returns the counters of the plan cache of every database, by name
+func (c *QueryCaches) PlanCacheStatistics() map[string]PlanCacheStats {
+	c.plansMu.Lock()
+	caches := make([]*planCache, 0, len(c.plans))
+	for _, cache := range c.plans {
+		caches = append(caches, cache)
+	}
+	c.plansMu.Unlock()
+
+	stats := make(map[string]PlanCacheStats, len(caches))
+	for _, cache := range caches {
+		cache.mu.Lock()
+		cacheStats := PlanCacheStats{Entries: cache.order.Len(), Hits: cache.hits, Misses: cache.misses}
+		cache.mu.Unlock()
+		if lookups := cacheStats.Hits + cacheStats.Misses; lookups > 0 {
+			cacheStats.HitRatio = float64(cacheStats.Hits) / float64(lookups)
+		}
+		stats[cache.database] = cacheStats
+	}
+	return stats
+}
@@ -0,0 +1,54 @@
+package engine
+
+import "testing"
+
+func TestNormalizeCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{
+			name:    "comparison",
+			command: `SELECT DOCUMENTS FROM "Users" WHERE "Age" > 30;`,
+			want:    `SELECT DOCUMENTS FROM "Users" WHERE "Age" > ? ;`,
+		},
+		{
+			name:    "negative number",
+			command: `SELECT DOCUMENTS FROM "Users" WHERE "Age" > -4;`,
+			want:    `SELECT DOCUMENTS FROM "Users" WHERE "Age" > ? ;`,
+		},
+		{
+			name:    "strings and booleans in groups",
+			command: `SELECT DOCUMENTS FROM "Users" WHERE "Name" == "Bo" AND ("Age" < 3 OR "Active" == true);`,
+			want:    `SELECT DOCUMENTS FROM "Users" WHERE "Name" == ? AND ( "Age" < ? OR "Active" == ? ) ;`,
+		},
+		{
+			name:    "IN list",
+			command: `SELECT DOCUMENTS FROM "Users" WHERE "Age" IN (1, 2, 3);`,
+			want:    `SELECT DOCUMENTS FROM "Users" WHERE "Age" IN ( ? , ? , ? ) ;`,
+		},
+		{
+			name:    "spacing",
+			command: "SELECT   DOCUMENTS FROM \"Users\"\n\tWHERE \"Age\">30;",
+			want:    `SELECT DOCUMENTS FROM "Users" WHERE "Age" > ? ;`,
+		},
+		{
+			name:    "no values",
+			command: `USE "Shop";`,
+			want:    `USE "Shop" ;`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NormalizeCommand(test.command)
+			if err != nil {
+				t.Fatalf("NormalizeCommand(%q) failed: %v", test.command, err)
+			}
+			if got != test.want {
+				t.Errorf("NormalizeCommand(%q) = %q, want %q", test.command, got, test.want)
+			}
+		})
+	}
+}
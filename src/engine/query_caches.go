@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"sync"
+	"syndrdb/src/models"
+)
+
+/*
+	Query caches.
+
+	What a server learns while answering queries, the plans of each database (see
+	plan_cache.go) and the postings of each index (see index_lookup.go), is kept in its
+	QueryCaches. The bundle service creates them and attaches them to every bundle it holds,
+	the way it attaches index files; copies of a bundle, such as snapshot views and a
+	transaction's working copies, carry them along. Two servers in one process therefore
+	never share plans or postings, even over copies of one data directory. Queries on a
+	bundle without caches are planned, and build their postings, afresh.
+*/
+
+// QueryCaches are the plan and postings caches of one server
+type QueryCaches struct {
+	planCacheSize int // Plans kept per database; 0 plans every query
+
+	plansMu sync.Mutex
+	plans   map[string]*planCache // By database ID
+
+	postingsMu sync.Mutex
+	postings   map[*models.Bundle]map[string]*indexPostings
+}
+
+// NewQueryCaches creates the caches of a server keeping up to planCacheSize plans per database
+func NewQueryCaches(planCacheSize int) *QueryCaches {
+	return &QueryCaches{
+		planCacheSize: planCacheSize,
+		plans:         make(map[string]*planCache),
+		postings:      make(map[*models.Bundle]map[string]*indexPostings),
+	}
+}
+
+// AttachQueryCaches lets queries on a bundle, and on its copies, use caches
+func AttachQueryCaches(bundle *models.Bundle, caches *QueryCaches) {
+	bundle.QueryCaches = caches
+}
+
+// queryCachesOf returns the caches attached to a bundle, or nil
+func queryCachesOf(bundle *models.Bundle) *QueryCaches {
+	caches, _ := bundle.QueryCaches.(*QueryCaches)
+	return caches
+}
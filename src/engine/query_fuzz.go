@@ -0,0 +1,356 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"syndrdb/src/models"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Query fuzzing.
+
+	The planner answers a WHERE clause through hash lookups, B-tree seeks and ranges, and the
+	intersections and unions of them, and SELECT DISTINCT through the values of a B-tree index.
+	Each of those must return exactly what evaluating the clause on every document returns.
+	FuzzQueries checks that on made-up data. Each round makes a bundle with random fields,
+	fills it with random documents and defines random hash and B-tree indexes over it. Values
+	repeat often, and are missing, null or of another type often enough to reach the edge
+	cases. Random WHERE clauses of AND, OR, parentheses, ==, !=, <, > and IN then run through
+	  - FilterDocuments, with the plan the planner chooses. Each clause runs again with other
+	    values, so the plan cache hands back the plan it kept for the first.
+	  - every usable index plan EXPLAIN lists for the clause, forced in turn
+	  - DistinctValues of a random field
+	and each result is compared with the naive evaluator's. A round's bundle and queries follow
+	from its seed alone, so a mismatch is replayed with
+	`syndrdb -fuzzqueries 1 -fuzzseed <seed>` using the seed it is reported with.
+*/
+
+const (
+	fuzzQueriesPerRound = 20
+	fuzzMaxDocuments    = 200
+	fuzzReportedDocIDs  = 5 // DocIDs listed per mismatch
+)
+
+// fuzzStrings are the string values documents and queries draw from. "7" and "2.5" compare
+// equal to the numbers 7 and 2.5.
+var fuzzStrings = []string{"a", "b", "c", "ab", "A", "7", "2.5", "x y", ""}
+
+// FuzzReport is the outcome of FuzzQueries
+type FuzzReport struct {
+	Seed       int64
+	Rounds     int
+	Queries    int // WHERE clauses run
+	Plans      int // Index plans forced
+	Mismatches []FuzzMismatch
+}
+
+// FuzzMismatch is one result that differs from the naive evaluator's
+type FuzzMismatch struct {
+	Seed     int64  // Seed of the round, which replays it
+	Check    string // What disagreed: the chosen plan, a forced plan or DISTINCT
+	Where    string
+	Indexes  []string
+	Expected int
+	Got      int
+	Missing  []string `json:",omitempty"` // DocIDs or values the check left out
+	Extra    []string `json:",omitempty"` // DocIDs or values the check returned on top
+}
+
+func (m FuzzMismatch) String() string {
+	return fmt.Sprintf("seed %d: %s WHERE %s with indexes %s: expected %d, got %d (missing %v, extra %v)",
+		m.Seed, m.Check, m.Where, strings.Join(m.Indexes, ", "), m.Expected, m.Got, m.Missing, m.Extra)
+}
+
+// Summary returns a one-line account of the run
+func (r *FuzzReport) Summary() string {
+	return fmt.Sprintf("%d round(s) from seed %d: %d queries, %d forced plans, %d mismatch(es)",
+		r.Rounds, r.Seed, r.Queries, r.Plans, len(r.Mismatches))
+}
+
+// FuzzQueries runs rounds of random bundles and queries, round i from seed+i, caching up to
+// planCacheSize plans as a server would
+func FuzzQueries(seed int64, rounds int, planCacheSize int, logger *zap.SugaredLogger) *FuzzReport {
+	report := &FuzzReport{Seed: seed, Rounds: rounds}
+	database := &models.Database{DatabaseID: "fuzz-" + strconv.FormatInt(seed, 10), Name: "fuzz"}
+	caches := NewQueryCaches(planCacheSize)
+	for round := 0; round < rounds; round++ {
+		fuzzRound(database, caches, seed+int64(round), report, logger)
+	}
+	return report
+}
+
+// fuzzField is one field of a round's bundle
+type fuzzField struct {
+	name string
+	kind string // "int", "float", "string" or "bool"
+}
+
+// fuzzer makes the bundle and queries of one round
+type fuzzer struct {
+	rng    *rand.Rand
+	fields []fuzzField
+}
+
+// fuzzRound builds one bundle and checks its queries
+func fuzzRound(database *models.Database, caches *QueryCaches, seed int64, report *FuzzReport, logger *zap.SugaredLogger) {
+	f := &fuzzer{rng: rand.New(rand.NewSource(seed))}
+	bundle := f.bundle(database, seed)
+	AttachQueryCaches(bundle, caches)
+	defer func() {
+		InvalidateIndexLookups(bundle)
+		InvalidatePlans(bundle)
+		ForgetQueryShapes(bundle)
+		ForgetBundleIndexUsage(bundle)
+	}()
+
+	indexes := make([]string, 0, len(bundle.Indexes))
+	for _, index := range bundle.Indexes {
+		names := make([]string, len(index.Fields))
+		for i, field := range index.Fields {
+			names[i] = field.Name
+		}
+		indexes = append(indexes, fmt.Sprintf("%s %s(%s)", index.IndexName, index.IndexType, strings.Join(names, ", ")))
+	}
+	sort.Strings(indexes)
+
+	mismatch := func(check, where string, expected, got []string) {
+		missing, extra := setDifference(expected, got), setDifference(got, expected)
+		if len(missing) == 0 && len(extra) == 0 {
+			return
+		}
+		report.Mismatches = append(report.Mismatches, FuzzMismatch{
+			Seed: seed, Check: check, Where: where, Indexes: indexes,
+			Expected: len(expected), Got: len(got),
+			Missing: firstFew(missing), Extra: firstFew(extra),
+		})
+	}
+
+	for i := 0; i < fuzzQueriesPerRound; i++ {
+		shape := f.condition(0)
+		for _, where := range []string{f.render(shape), f.render(shape)} {
+			report.Queries++
+			whereGroup, err := ParseWhereClause(where)
+			if err != nil {
+				report.Mismatches = append(report.Mismatches, FuzzMismatch{Seed: seed, Check: "parse: " + err.Error(), Where: where, Indexes: indexes})
+				continue
+			}
+			var expected []*models.Document
+			for docID := range bundle.Documents {
+				if doc := bundle.Documents[docID]; EvaluateWhereClause(&doc, whereGroup, logger) {
+					expected = append(expected, &doc)
+				}
+			}
+			expectedIDs := documentIDs(expected)
+
+			chosen, err := FilterDocuments(bundle, where, logger)
+			if err != nil {
+				report.Mismatches = append(report.Mismatches, FuzzMismatch{Seed: seed, Check: "chosen plan: " + err.Error(), Where: where, Indexes: indexes})
+				continue
+			}
+			mismatch("chosen plan", where, expectedIDs, documentIDs(chosen))
+
+			for _, plan := range PlanQuery(bundle, whereGroup).Candidates {
+				if plan.Reason != "" || plan.Access == AccessFullScan {
+					continue
+				}
+				report.Plans++
+				check := strings.TrimSpace(plan.Access + " " + plan.IndexName)
+				docIDs, err := candidateDocIDs(bundle, plan, logger)
+				if err != nil {
+					report.Mismatches = append(report.Mismatches, FuzzMismatch{Seed: seed, Check: check + ": " + err.Error(), Where: where, Indexes: indexes})
+					continue
+				}
+				var got []string
+				for _, docID := range docIDs.IDs() {
+					if doc, exists := bundle.Documents[docID]; exists && EvaluateWhereClause(&doc, whereGroup, logger) {
+						got = append(got, docID)
+					}
+				}
+				mismatch(check, where, expectedIDs, got)
+			}
+
+			field := f.fields[f.rng.Intn(len(f.fields))].name
+			values, err := DistinctValues(bundle, field, whereGroup, where, logger)
+			if err != nil {
+				report.Mismatches = append(report.Mismatches, FuzzMismatch{Seed: seed, Check: "DISTINCT: " + err.Error(), Where: where, Indexes: indexes})
+				continue
+			}
+			mismatch("DISTINCT "+field, where, valueKeys(DistinctFieldValues(expected, field)), valueKeys(values))
+		}
+	}
+}
+
+// bundle makes a bundle of random fields, documents and indexes
+func (f *fuzzer) bundle(database *models.Database, seed int64) *models.Bundle {
+	kinds := []string{"int", "float", "string", "bool"}
+	for i, count := 0, 2+f.rng.Intn(4); i < count; i++ {
+		f.fields = append(f.fields, fuzzField{name: string(rune('A' + i)), kind: kinds[f.rng.Intn(len(kinds))]})
+	}
+
+	bundle := &models.Bundle{
+		BundleID:  fmt.Sprintf("fuzz-%d", seed),
+		Name:      "Fuzz",
+		Documents: make(map[string]models.Document),
+		Indexes:   make(map[string]models.IndexReference),
+		Database:  database,
+	}
+	created := time.Unix(0, 0)
+	for i, count := 0, f.rng.Intn(fuzzMaxDocuments+1); i < count; i++ {
+		doc := models.Document{DocumentID: fmt.Sprintf("doc-%04d", i), Fields: make(map[string]models.Field), CreatedAt: created, UpdatedAt: created}
+		for _, field := range f.fields {
+			switch roll := f.rng.Intn(20); {
+			case roll < 2: // Missing
+			case roll < 3:
+				doc.Fields[field.name] = models.Field{Name: field.name}
+			case roll < 5:
+				doc.Fields[field.name] = models.Field{Name: field.name, Value: f.value(kinds[f.rng.Intn(len(kinds))])}
+			default:
+				doc.Fields[field.name] = models.Field{Name: field.name, Value: f.value(field.kind)}
+			}
+		}
+		bundle.Documents[doc.DocumentID] = doc
+	}
+
+	for i, count := 0, 1+f.rng.Intn(3); i < count; i++ {
+		index := models.IndexReference{IndexName: fmt.Sprintf("fuzz_%d", i), IndexType: "btree", CreateTime: created}
+		if f.rng.Intn(3) == 0 {
+			index.IndexType = "hash"
+		}
+		for _, position := range f.rng.Perm(len(f.fields))[:1+f.rng.Intn(2)] {
+			index.Fields = append(index.Fields, models.FieldDefinition{Name: f.fields[position].name, Type: f.fields[position].kind})
+		}
+		bundle.Indexes[index.IndexName] = index
+	}
+	return bundle
+}
+
+// value returns a random value of a kind, from small domains so values repeat
+func (f *fuzzer) value(kind string) interface{} {
+	switch kind {
+	case "int":
+		return f.rng.Intn(10)
+	case "float":
+		return float64(f.rng.Intn(10)) / 2
+	case "bool":
+		return f.rng.Intn(2) == 0
+	}
+	return fuzzStrings[f.rng.Intn(len(fuzzStrings))]
+}
+
+// fuzzCondition is the shape of a WHERE clause; rendering it fills in the values
+type fuzzCondition struct {
+	field    fuzzField
+	operator string
+	values   int // Literals of an IN list
+
+	terms []*fuzzCondition // Set for a parenthesized group
+	logic []string         // logic[i] joins terms[i] and terms[i+1]
+}
+
+// condition returns a random condition of one to three terms, nesting groups up to two deep
+func (f *fuzzer) condition(depth int) *fuzzCondition {
+	group := &fuzzCondition{}
+	for i, count := 0, 1+f.rng.Intn(3); i < count; i++ {
+		if i > 0 {
+			group.logic = append(group.logic, []string{"AND", "OR"}[f.rng.Intn(2)])
+		}
+		if depth < 2 && f.rng.Intn(4) == 0 {
+			group.terms = append(group.terms, f.condition(depth+1))
+			continue
+		}
+		term := &fuzzCondition{field: f.fields[f.rng.Intn(len(f.fields))]}
+		term.operator = []string{"==", "==", "!=", "<", ">", "IN"}[f.rng.Intn(6)]
+		if term.operator == "IN" {
+			term.values = 1 + f.rng.Intn(3)
+		}
+		group.terms = append(group.terms, term)
+	}
+	return group
+}
+
+// render writes a condition with fresh values
+func (f *fuzzer) render(condition *fuzzCondition) string {
+	var b strings.Builder
+	for i, term := range condition.terms {
+		if i > 0 {
+			b.WriteString(" " + condition.logic[i-1] + " ")
+		}
+		if term.terms != nil {
+			b.WriteString("(" + f.render(term) + ")")
+			continue
+		}
+		b.WriteString(strconv.Quote(term.field.name) + " " + term.operator + " ")
+		if term.operator != "IN" {
+			b.WriteString(f.literal(term.field.kind))
+			continue
+		}
+		literals := make([]string, term.values)
+		for j := range literals {
+			literals[j] = f.literal(term.field.kind)
+		}
+		b.WriteString("(" + strings.Join(literals, ", ") + ")")
+	}
+	return b.String()
+}
+
+// literal returns a random literal, usually of the field's kind
+func (f *fuzzer) literal(kind string) string {
+	if f.rng.Intn(10) == 0 {
+		kind = []string{"int", "float", "string", "bool"}[f.rng.Intn(4)]
+	}
+	switch value := f.value(kind).(type) {
+	case float64:
+		return strconv.FormatFloat(value, 'f', 1, 64)
+	case string:
+		return strconv.Quote(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// documentIDs returns the sorted DocIDs of documents
+func documentIDs(documents []*models.Document) []string {
+	ids := make([]string, len(documents))
+	for i, doc := range documents {
+		ids[i] = doc.DocumentID
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// valueKeys returns the keys of values, which DISTINCT tells values apart by
+func valueKeys(values []interface{}) []string {
+	keys := make([]string, len(values))
+	for i, value := range values {
+		keys[i] = indexKey(value)
+	}
+	return keys
+}
+
+// setDifference returns the entries of a that are not in b
+func setDifference(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, entry := range b {
+		in[entry] = true
+	}
+	var difference []string
+	for _, entry := range a {
+		if !in[entry] {
+			difference = append(difference, entry)
+		}
+	}
+	return difference
+}
+
+func firstFew(entries []string) []string {
+	if len(entries) > fuzzReportedDocIDs {
+		return entries[:fuzzReportedDocIDs]
+	}
+	return entries
+}
@@ -3,9 +3,9 @@ package engine
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"syndrdb/src/models"
 
-	//"strconv"
 	"strings"
 	//"syndrdb/src/settings"
 )
@@ -26,6 +26,120 @@ A.Relationship.RelationshipField = SomeOtherValue
 */
 // ---------------------------------------- SELECT Query ----------------------------------------
 
+// OrderBy sorts SELECT results on a single field
+type OrderBy struct {
+	Field      string
+	Descending bool
+}
+
+// SelectModifiers are the optional ORDER BY / AFTER KEY / LIMIT clauses trailing a SELECT DOCUMENTS command
+type SelectModifiers struct {
+	OrderBy *OrderBy
+	After   *AfterKey // Start after this position, see keyset.go
+	Limit   int       // 0 means no limit
+}
+
+// String renders the modifiers back into SyndrQL so they can be pushed down to other nodes
+func (m *SelectModifiers) String() string {
+	if m == nil {
+		return ""
+	}
+	var parts []string
+	if m.OrderBy != nil {
+		direction := "ASC"
+		if m.OrderBy.Descending {
+			direction = "DESC"
+		}
+		parts = append(parts, fmt.Sprintf("ORDER BY %s %s", m.OrderBy.Field, direction))
+	}
+	if m.After != nil {
+		parts = append(parts, fmt.Sprintf("AFTER KEY \"%s\"", m.After.Token(m.OrderBy)))
+	}
+	if m.Limit > 0 {
+		parts = append(parts, fmt.Sprintf("LIMIT %d", m.Limit))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ApplySelectModifiers sorts and truncates a result set, dropping documents up to AFTER KEY.
+// Ties on the ORDER BY field, and everything without one, are ordered by ID so LIMIT is
+// deterministic and pages follow on from each other.
+func ApplySelectModifiers(documents []*models.Document, modifiers *SelectModifiers) []*models.Document {
+	if modifiers == nil {
+		return documents
+	}
+
+	if modifiers.After != nil {
+		kept := documents[:0]
+		for _, document := range documents {
+			if modifiers.After.isAfter(document, modifiers.OrderBy) {
+				kept = append(kept, document)
+			}
+		}
+		documents = kept
+	}
+
+	sort.Slice(documents, func(i, j int) bool {
+		if modifiers.OrderBy == nil {
+			return documents[i].DocumentID < documents[j].DocumentID
+		}
+		// Documents missing the field sort last regardless of direction
+		a := documentFieldValue(documents[i], modifiers.OrderBy.Field)
+		b := documentFieldValue(documents[j], modifiers.OrderBy.Field)
+		return comparePositions(modifiers.OrderBy, a, documents[i].DocumentID, b, documents[j].DocumentID) < 0
+	})
+
+	if modifiers.Limit > 0 && len(documents) > modifiers.Limit {
+		documents = documents[:modifiers.Limit]
+	}
+	return documents
+}
+
+// documentFieldValue returns a field's value, treating DocumentID as a field like the WHERE evaluator does
+func documentFieldValue(document *models.Document, fieldName string) interface{} {
+	if strings.EqualFold(fieldName, "documentid") {
+		return document.DocumentID
+	}
+	field, exists := document.Fields[fieldName]
+	if !exists {
+		return nil
+	}
+	return field.Value
+}
+
+// CompareOrderedValues orders numbers numerically and everything else as strings
+func CompareOrderedValues(a, b interface{}) int {
+	aNum, aOk := numericValue(a)
+	bNum, bOk := numericValue(b)
+	if aOk && bOk {
+		switch {
+		case aNum < bNum:
+			return -1
+		case aNum > bNum:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+// numericValue widens any numeric type to float64
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
 func ParseQuery(query string) (*Query, error) {
 	// Split the query into SELECT, FROM, and WHERE parts
 	selectIndex := strings.Index(query, "SELECT ")
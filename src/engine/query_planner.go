@@ -0,0 +1,551 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"syndrdb/src/models"
+)
+
+/*
+	Cost based access path selection.
+
+	For a SELECT the planner lists every way the bundle could be read: a full scan,
+	and each index whose fields are constrained by AND-ed predicates of the WHERE
+	clause. Hash indexes need an equality on every field; B-tree indexes can use an
+	equality prefix of their fields, optionally followed by one range predicate.
+
+	When several indexes cover different predicates, their DocID sets can also be
+	intersected before any document is read; the intersection is costed as one more
+	candidate, assuming the predicates are independent. OR-ed terms are answered by
+	unioning the DocID sets of the cheapest plan of each term, which is only possible
+	when every term can use an index.
+
+	Each candidate is costed from statistics gathered over the indexed fields (entries,
+	distinct keys, estimated height) and, for range predicates, the field histograms built by
+	ANALYZE BUNDLE, and the cheapest one wins. The costs are in
+	abstract units where reading one document sequentially costs 1.
+
+	A hash lookup whose index file can be read (see index_lookup.go) is costed from the
+	entries and distinct keys the file keeps up to date. Every other index plan reads, and is
+	costed from, postings built from the documents, and says so under Reads: its index file
+	is not read.
+*/
+
+const (
+	scanCostPerDocument  = 1.0  // Sequential read and evaluation of one document
+	fetchCostPerDocument = 1.5  // Random read of one document found through an index
+	btreePageCost        = 2.0  // Reading one B-tree page on the way down
+	btreeLeafCostPerKey  = 0.05 // Walking one key along the leaves of a range
+	hashProbeCost        = 1.5  // Hashing the key and reading its bucket
+	hashEntryCost        = 0.02 // Reading one DocID from a bucket
+	mergeCostPerID       = 0.01 // Merging one DocID into an intersection or union
+	residualCostPerDoc   = 0.01 // Evaluating the predicates the index does not cover
+
+	btreeFanout      = 128
+	rangeSelectivity = 1.0 / 3.0 // Fraction of keys assumed to satisfy a single < or > on a field without a histogram
+
+	AccessFullScan   = "FULL SCAN"
+	AccessHashLookup = "HASH LOOKUP"
+	AccessBTreeSeek  = "BTREE SEEK"
+	AccessBTreeRange = "BTREE RANGE"
+	AccessIntersect  = "INDEX INTERSECTION"
+	AccessUnion      = "INDEX UNION"
+
+	ReadsIndexFile = "INDEX FILE" // The lookup reads the index file, see index_lookup.go
+	ReadsPostings  = "POSTINGS"   // The lookup reads postings built from the documents
+)
+
+// IndexStatistics describe the contents of one index
+type IndexStatistics struct {
+	Entries int
+	// DistinctKeys[i] is the number of distinct values of the first i+1 index fields
+	DistinctKeys []int
+	Height       int
+	Unique       bool
+}
+
+// QueryPlan is one way of reading the documents for a WHERE clause
+type QueryPlan struct {
+	Access        string
+	IndexName     string   `json:",omitempty"`
+	IndexType     string   `json:",omitempty"`
+	IndexFields   []string `json:",omitempty"`
+	MatchedFields []string `json:",omitempty"` // Index fields the predicates constrain
+	EstimatedRows float64
+	LookupCost    float64          `json:",omitempty"` // Reading the DocIDs from the index(es)
+	Cost          float64          // Only meaningful when Reason is empty
+	Statistics    *IndexStatistics `json:",omitempty"`
+	Probes        int              `json:",omitempty"` // Distinct keys a hash lookup reads for an IN list
+	Reads         string           `json:",omitempty"` // What an index lookup reads its DocIDs from
+	Inputs        []*QueryPlan     `json:",omitempty"` // Index lookups combined by an intersection or union
+	Reason        string           `json:",omitempty"` // Why an index could not be used
+
+	predicates map[string][]WhereClause // What an index lookup searches for
+}
+
+// QueryPlanResult is the output of EXPLAIN: the chosen plan and every candidate considered
+type QueryPlanResult struct {
+	Bundle     string
+	Documents  int
+	Where      string
+	Chosen     *QueryPlan
+	Candidates []*QueryPlan
+}
+
+// PlanQuery costs every access path for a WHERE clause and picks the cheapest
+func PlanQuery(bundle *models.Bundle, whereGroup *WhereGroup) *QueryPlanResult {
+	documentCount := len(bundle.Documents)
+	scan := &QueryPlan{
+		Access:        AccessFullScan,
+		EstimatedRows: float64(documentCount),
+		Cost:          float64(documentCount) * scanCostPerDocument,
+	}
+
+	result := &QueryPlanResult{
+		Bundle:     bundle.Name,
+		Documents:  documentCount,
+		Candidates: []*QueryPlan{scan},
+	}
+
+	result.Candidates = append(result.Candidates, planGroup(bundle, whereGroup)...)
+
+	// Cheapest usable plan wins; ties keep the earlier candidate, so the scan beats an equal index
+	result.Chosen = scan
+	if best := cheapestPlan(result.Candidates[1:]); best != nil && best.Cost < scan.Cost {
+		result.Chosen = best
+	}
+	return result
+}
+
+// whereTerm is a run of elements of a group joined by AND
+type whereTerm struct {
+	predicates map[string][]WhereClause
+	nested     []*WhereGroup // Subgroups containing OR, planned on their own
+}
+
+// planGroup lists the index based ways of answering a group. A group made of several
+// OR-ed terms can only use indexes when every term can.
+func planGroup(bundle *models.Bundle, group *WhereGroup) []*QueryPlan {
+	if group == nil {
+		return nil
+	}
+	terms := splitOrTerms(group)
+	if len(terms) == 1 {
+		return planConjunction(bundle, terms[0])
+	}
+	if union := planUnion(bundle, terms); union != nil {
+		return []*QueryPlan{union}
+	}
+	return nil
+}
+
+// planConjunction costs every index for the predicates of one term, the best plan of each
+// nested OR group, and the intersection of the most selective of them
+func planConjunction(bundle *models.Bundle, term whereTerm) []*QueryPlan {
+	indexNames := make([]string, 0, len(bundle.Indexes))
+	for name := range bundle.Indexes {
+		indexNames = append(indexNames, name)
+	}
+	sort.Strings(indexNames)
+
+	var candidates, usable []*QueryPlan
+	for _, name := range indexNames {
+		plan := planIndex(bundle, bundle.Indexes[name], term.predicates)
+		candidates = append(candidates, plan)
+		if plan.Reason == "" {
+			usable = append(usable, plan)
+		}
+	}
+	for _, nested := range term.nested {
+		if plan := cheapestPlan(planGroup(bundle, nested)); plan != nil {
+			candidates = append(candidates, plan)
+			usable = append(usable, plan)
+		}
+	}
+	if intersection := planIntersection(len(bundle.Documents), usable, countPredicates(term.predicates)+len(term.nested)); intersection != nil {
+		candidates = append(candidates, intersection)
+	}
+	return candidates
+}
+
+// planUnion answers OR-ed terms by unioning the DocIDs of the cheapest plan of each term
+func planUnion(bundle *models.Bundle, terms []whereTerm) *QueryPlan {
+	plan := &QueryPlan{Access: AccessUnion}
+	covered := make(map[string]bool)
+	scanned := 0.0
+	for _, term := range terms {
+		input := cheapestPlan(planConjunction(bundle, term))
+		if input == nil {
+			return nil
+		}
+		plan.Inputs = append(plan.Inputs, input)
+		plan.LookupCost += input.LookupCost
+		scanned += input.EstimatedRows
+		for _, field := range input.MatchedFields {
+			if !covered[field] {
+				covered[field] = true
+				plan.MatchedFields = append(plan.MatchedFields, field)
+			}
+		}
+	}
+
+	plan.EstimatedRows = math.Min(scanned, float64(len(bundle.Documents)))
+	plan.LookupCost += scanned * mergeCostPerID
+	plan.Cost = plan.LookupCost + fetchCost(plan.EstimatedRows, 0)
+	roundPlan(plan)
+	return plan
+}
+
+// cheapestPlan returns the usable plan with the lowest cost, or nil
+func cheapestPlan(plans []*QueryPlan) *QueryPlan {
+	var best *QueryPlan
+	for _, plan := range plans {
+		if plan.Reason == "" && (best == nil || plan.Cost < best.Cost) {
+			best = plan
+		}
+	}
+	return best
+}
+
+// planIndex costs reading the bundle through one index
+func planIndex(bundle *models.Bundle, index models.IndexReference, predicates map[string][]WhereClause) *QueryPlan {
+	return planIndexWith(bundle, index, predicates, func() *IndexStatistics { return CollectIndexStatistics(bundle, index) })
+}
+
+// planIndexWith costs reading the bundle through an index whose statistics come from
+// statistics, which is only called when the index can serve the predicates
+func planIndexWith(bundle *models.Bundle, index models.IndexReference, predicates map[string][]WhereClause, statistics func() *IndexStatistics) *QueryPlan {
+	plan := &QueryPlan{
+		IndexName:     index.IndexName,
+		IndexType:     strings.ToLower(index.IndexType),
+		EstimatedRows: float64(len(bundle.Documents)),
+	}
+	for _, field := range index.Fields {
+		plan.IndexFields = append(plan.IndexFields, field.Name)
+	}
+	if len(plan.IndexFields) == 0 {
+		plan.Reason = "index has no fields"
+		return plan
+	}
+
+	plan.predicates = predicates
+	equalities, hasRange := indexPrefixMatch(plan.IndexFields, predicates)
+
+	switch plan.IndexType {
+	case "hash":
+		plan.Access = AccessHashLookup
+		if equalities == len(plan.IndexFields)-1 {
+			plan.Probes = len(inListKeys(predicates[plan.IndexFields[equalities]]))
+		}
+		if equalities < len(plan.IndexFields) && plan.Probes == 0 {
+			plan.Reason = "hash index needs an equality or IN list on every field"
+			return plan
+		}
+	case "btree":
+		if equalities == 0 && !hasRange {
+			plan.Access = AccessBTreeSeek
+			plan.Reason = fmt.Sprintf("no predicate on leading field '%s'", plan.IndexFields[0])
+			return plan
+		}
+		plan.Access = AccessBTreeSeek
+		if hasRange || equalities < len(plan.IndexFields) {
+			plan.Access = AccessBTreeRange
+		}
+	default:
+		plan.Reason = fmt.Sprintf("unsupported index type '%s'", index.IndexType)
+		return plan
+	}
+	plan.Reads = ReadsPostings
+	if _, ok := hashFileStatistics(bundle, index); ok {
+		plan.Reads = ReadsIndexFile
+	}
+
+	// An IN list keys the last field of a hash index as an equality would, once per value
+	keyed := equalities
+	if plan.Probes > 0 {
+		keyed++
+	}
+	plan.MatchedFields = plan.IndexFields[:keyed]
+	if hasRange {
+		plan.MatchedFields = plan.IndexFields[:equalities+1]
+	}
+
+	stats := statistics()
+	plan.Statistics = stats
+
+	// Rows: entries per distinct equality prefix, narrowed further by a range on the next field
+	// or multiplied by the keys of an IN list
+	rows := float64(stats.Entries)
+	if keyed > 0 && stats.DistinctKeys[keyed-1] > 0 {
+		rows = float64(stats.Entries) / float64(stats.DistinctKeys[keyed-1])
+	}
+	if hasRange {
+		rows *= rangeFraction(bundle, plan.IndexFields[equalities], predicates[plan.IndexFields[equalities]])
+	}
+	probes := math.Max(1, float64(plan.Probes))
+	rows = math.Min(rows*probes, float64(stats.Entries))
+	if stats.Unique && keyed == len(plan.IndexFields) {
+		rows = math.Min(rows, probes)
+	}
+	plan.EstimatedRows = rows
+
+	switch plan.Access {
+	case AccessHashLookup:
+		plan.LookupCost = probes*hashProbeCost + rows*hashEntryCost
+	default:
+		plan.LookupCost = float64(stats.Height)*btreePageCost + rows*btreeLeafCostPerKey
+	}
+	plan.Cost = plan.LookupCost + fetchCost(rows, countPredicates(predicates)-len(plan.MatchedFields))
+	roundPlan(plan)
+	return plan
+}
+
+// planIntersection greedily combines index lookups, most selective first, for as long as
+// each extra index covers a new field and lowers the total cost. Nil when fewer than two help.
+func planIntersection(documentCount int, usable []*QueryPlan, predicateCount int) *QueryPlan {
+	if len(usable) < 2 || documentCount == 0 {
+		return nil
+	}
+
+	ordered := append([]*QueryPlan(nil), usable...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].EstimatedRows < ordered[j].EstimatedRows })
+
+	plan := &QueryPlan{Access: AccessIntersect}
+	covered := make(map[string]bool)
+	rows := float64(documentCount)
+	scanned := 0.0 // DocIDs read from the inputs
+	cost := math.Inf(1)
+
+	for _, input := range ordered {
+		newField := false
+		for _, field := range input.MatchedFields {
+			newField = newField || !covered[field]
+		}
+		if !newField {
+			continue
+		}
+
+		candidateRows := rows * input.EstimatedRows / float64(documentCount)
+		candidateScanned := scanned + input.EstimatedRows
+		lookupCost := plan.LookupCost + input.LookupCost + candidateScanned*mergeCostPerID
+		matched := len(covered)
+		for _, field := range input.MatchedFields {
+			if !covered[field] {
+				matched++
+			}
+		}
+		candidateCost := lookupCost + fetchCost(candidateRows, predicateCount-matched)
+		if len(plan.Inputs) > 0 && candidateCost >= cost {
+			continue
+		}
+
+		plan.Inputs = append(plan.Inputs, input)
+		plan.LookupCost = plan.LookupCost + input.LookupCost
+		for _, field := range input.MatchedFields {
+			if !covered[field] {
+				covered[field] = true
+				plan.MatchedFields = append(plan.MatchedFields, field)
+			}
+		}
+		rows, scanned, cost = candidateRows, candidateScanned, candidateCost
+	}
+
+	if len(plan.Inputs) < 2 {
+		return nil
+	}
+	plan.LookupCost += scanned * mergeCostPerID
+	plan.EstimatedRows = rows
+	plan.Cost = cost
+	roundPlan(plan)
+	return plan
+}
+
+// fetchCost is the cost of reading the documents an index returned and checking the predicates it did not cover
+func fetchCost(rows float64, residualPredicates int) float64 {
+	if residualPredicates < 0 {
+		residualPredicates = 0
+	}
+	return rows*fetchCostPerDocument + rows*float64(residualPredicates)*residualCostPerDoc
+}
+
+func roundPlan(plan *QueryPlan) {
+	plan.Cost = math.Round(plan.Cost*100) / 100
+	plan.LookupCost = math.Round(plan.LookupCost*100) / 100
+	plan.EstimatedRows = math.Round(plan.EstimatedRows*100) / 100
+}
+
+// indexPrefixMatch counts the leading index fields with an equality predicate and
+// reports whether the field after them has a range predicate
+func indexPrefixMatch(fields []string, predicates map[string][]WhereClause) (int, bool) {
+	equalities := 0
+	for _, field := range fields {
+		if !hasOperator(predicates[field], "==") {
+			break
+		}
+		equalities++
+	}
+	hasRange := false
+	if equalities < len(fields) {
+		next := predicates[fields[equalities]]
+		hasRange = hasOperator(next, "<") || hasOperator(next, ">")
+	}
+	return equalities, hasRange
+}
+
+// CollectIndexStatistics gathers entry and distinct key counts over the fields of an index:
+// those a hash index file keeps, when lookups read it, and otherwise the postings'
+func CollectIndexStatistics(bundle *models.Bundle, index models.IndexReference) *IndexStatistics {
+	if stats, ok := hashFileStatistics(bundle, index); ok {
+		return stats
+	}
+	return indexStatistics(index, postingsFor(bundle, index))
+}
+
+// indexStatistics counts entries and distinct keys in the postings of an index
+func indexStatistics(index models.IndexReference, postings *indexPostings) *IndexStatistics {
+	stats := &IndexStatistics{
+		DistinctKeys: make([]int, len(index.Fields)),
+		Unique:       len(index.Fields) > 0,
+	}
+	for _, field := range index.Fields {
+		stats.Unique = stats.Unique && field.IsUnique
+	}
+
+	for i, prefix := range postings.byPrefix {
+		stats.DistinctKeys[i] = len(prefix)
+	}
+	if len(postings.byPrefix) > 0 {
+		for _, docIDs := range postings.byPrefix[0] {
+			stats.Entries += len(docIDs)
+		}
+	}
+
+	stats.Height = 1
+	if stats.Entries > 0 {
+		stats.Height = int(math.Ceil(math.Log(float64(stats.Entries)+1) / math.Log(btreeFanout)))
+		if stats.Height < 1 {
+			stats.Height = 1
+		}
+	}
+	return stats
+}
+
+// indexKey renders a value the way WHERE equality sees it: numbers of any Go type (BSON
+// decodes int32) and numeric strings compare as numbers, so they share a key
+func indexKey(value interface{}) string {
+	if number, ok := numericValue(value); ok {
+		return fmt.Sprintf("n:%v", number)
+	}
+	if text, ok := value.(string); ok {
+		if number, err := strconv.ParseFloat(text, 64); err == nil {
+			return fmt.Sprintf("n:%v", number)
+		}
+		return "s:" + text
+	}
+	return fmt.Sprintf("%T:%v", value, value)
+}
+
+// ValueKey renders a value so that values WHERE equality treats as equal share a key
+func ValueKey(value interface{}) string {
+	return indexKey(value)
+}
+
+// splitOrTerms splits a group into its OR-ed terms. Clauses come before subgroups, each
+// element's Logic joining it to the next; AND binds tighter than OR.
+func splitOrTerms(group *WhereGroup) []whereTerm {
+	var terms []whereTerm
+	term := whereTerm{predicates: make(map[string][]WhereClause)}
+	closeTerm := func() {
+		terms = append(terms, term)
+		term = whereTerm{predicates: make(map[string][]WhereClause)}
+	}
+
+	for _, clause := range group.Clauses {
+		// A clause without a value matches anything and narrows nothing
+		if clause.Value != nil {
+			term.predicates[clause.Field] = append(term.predicates[clause.Field], clause)
+		}
+		if clause.Logic == "OR" {
+			closeTerm()
+		}
+	}
+	for i := range group.SubGroups {
+		sub := &group.SubGroups[i]
+		if groupHasOr(sub) {
+			term.nested = append(term.nested, sub)
+		} else {
+			collectConjunctivePredicates(sub, term.predicates)
+		}
+		if sub.Logic == "OR" {
+			closeTerm()
+		}
+	}
+	closeTerm()
+	return terms
+}
+
+// collectConjunctivePredicates adds the predicates of an AND-only group and its AND-only subgroups
+func collectConjunctivePredicates(group *WhereGroup, predicates map[string][]WhereClause) {
+	if groupHasOr(group) {
+		return
+	}
+	for _, clause := range group.Clauses {
+		if clause.Value == nil {
+			continue
+		}
+		predicates[clause.Field] = append(predicates[clause.Field], clause)
+	}
+	for i := range group.SubGroups {
+		collectConjunctivePredicates(&group.SubGroups[i], predicates)
+	}
+}
+
+// groupHasOr reports whether any element at this level of a group is joined with OR
+func groupHasOr(group *WhereGroup) bool {
+	for _, clause := range group.Clauses {
+		if clause.Logic == "OR" {
+			return true
+		}
+	}
+	for _, sub := range group.SubGroups {
+		if sub.Logic == "OR" {
+			return true
+		}
+	}
+	return false
+}
+
+// inListKeys returns the distinct index keys of the first IN list among clauses, in the
+// order they were written
+func inListKeys(clauses []WhereClause) []string {
+	values, _ := firstClause(clauses, "IN").Value.([]interface{})
+	keys := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		if key := indexKey(value); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func hasOperator(clauses []WhereClause, operator string) bool {
+	for _, clause := range clauses {
+		if clause.Operator == operator {
+			return true
+		}
+	}
+	return false
+}
+
+func countPredicates(predicates map[string][]WhereClause) int {
+	count := 0
+	for _, clauses := range predicates {
+		count += len(clauses)
+	}
+	return count
+}
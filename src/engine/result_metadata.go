@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"sort"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+)
+
+/*
+	Result metadata.
+
+	Documents come back as JSON maps that say nothing of the bundle's schema, so a driver
+	cannot tell an INT field from a FLOAT one that happens to hold 3, nor a UI which columns
+	to draw when the first rows lack some fields. SELECT DOCUMENTS and SELECT DISTINCT carry
+	the declared fields of their bundle, which the server sends ahead of the rows to clients
+	that ask for it. Fields documents hold without the bundle declaring them are not listed;
+	neither are DocumentID, CreatedAt and UpdatedAt, which every document has.
+*/
+
+// BundleMetadata describes every declared field of a bundle, in name order
+func BundleMetadata(bundle *models.Bundle) *protocol.Metadata {
+	metadata := &protocol.Metadata{
+		Status: protocol.MetadataStatus,
+		Bundle: bundle.Name,
+		Fields: make([]protocol.FieldMetadata, 0, len(bundle.DocumentStructure.FieldDefinitions)),
+	}
+	for _, definition := range bundle.DocumentStructure.FieldDefinitions {
+		metadata.Fields = append(metadata.Fields, fieldMetadata(definition))
+	}
+	sort.Slice(metadata.Fields, func(i, j int) bool { return metadata.Fields[i].Name < metadata.Fields[j].Name })
+	return metadata
+}
+
+// FieldMetadataOf describes one field of a bundle; a field the bundle does not declare has
+// no type
+func FieldMetadataOf(bundle *models.Bundle, field string) *protocol.Metadata {
+	definition, declared := bundle.DocumentStructure.FieldDefinitions[field]
+	if !declared {
+		definition = models.FieldDefinition{Name: field}
+	}
+	return &protocol.Metadata{
+		Status: protocol.MetadataStatus,
+		Bundle: bundle.Name,
+		Fields: []protocol.FieldMetadata{fieldMetadata(definition)},
+	}
+}
+
+func fieldMetadata(definition models.FieldDefinition) protocol.FieldMetadata {
+	return protocol.FieldMetadata{
+		Name:     definition.Name,
+		Type:     definition.Type,
+		Required: definition.IsRequired,
+		Unique:   definition.IsUnique,
+	}
+}
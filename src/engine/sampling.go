@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"syndrdb/src/models"
+)
+
+/*
+	Sampling.
+
+	SELECT DOCUMENTS FROM "X" SAMPLE 1 PERCENT, or SAMPLE 1000 ROWS, reads a pseudo-random
+	sample of a bundle instead of all of it, for a quick look at a huge one. As with SQL's
+	TABLESAMPLE, the sample is taken first and WHERE filters what is in it. Whether a document
+	is in the sample depends only on a hash of its ID and a seed, so documents outside it are
+	never copied or checked against the WHERE clause, and REPEATABLE (seed) returns the same
+	sample as long as the bundle does not change. Without REPEATABLE the seed is random.
+
+	PERCENT keeps each document with that chance, so the sample's size varies around the
+	percentage; ROWS keeps exactly that many documents, or all of them when there are fewer.
+	For a bundle spread over the cluster, every node takes a PERCENT sample of its partitions
+	with the same seed; ROWS is refused there, since no node sees the whole bundle.
+*/
+
+// SampleClause is SAMPLE n PERCENT or SAMPLE n ROWS, with the seed that picks the documents
+type SampleClause struct {
+	Percent float64 // 0 < Percent <= 100; 0 when sampling by ROWS
+	Rows    int     // Documents to keep; 0 when sampling by PERCENT
+	Seed    int64
+}
+
+// String renders the clause back into SyndrQL, with its seed, so other nodes take the same sample
+func (s *SampleClause) String() string {
+	if s == nil {
+		return ""
+	}
+	if s.Rows > 0 {
+		return fmt.Sprintf("SAMPLE %d ROWS REPEATABLE (%d)", s.Rows, s.Seed)
+	}
+	return fmt.Sprintf("SAMPLE %s PERCENT REPEATABLE (%d)", strconv.FormatFloat(s.Percent, 'f', -1, 64), s.Seed)
+}
+
+// selector returns whether a document ID is in the sample; nil when every document is
+func (s *SampleClause) selector(bundle *models.Bundle) func(docID string) bool {
+	switch {
+	case s == nil:
+		return nil
+	case s.Rows > 0:
+		if len(bundle.Documents) <= s.Rows {
+			return nil
+		}
+		chosen := s.lowestHashes(bundle)
+		return func(docID string) bool { return chosen[docID] }
+	case s.Percent >= 100:
+		return nil
+	}
+	threshold := uint64(s.Percent / 100 * math.MaxUint64)
+	return func(docID string) bool { return s.hash(docID) < threshold }
+}
+
+// lowestHashes picks the Rows documents whose IDs hash lowest, a uniform sample of that size
+func (s *SampleClause) lowestHashes(bundle *models.Bundle) map[string]bool {
+	kept := &sampleHeap{}
+	for docID := range bundle.Documents {
+		hash := s.hash(docID)
+		if kept.Len() < s.Rows {
+			heap.Push(kept, sampledID{docID: docID, hash: hash})
+		} else if hash < (*kept)[0].hash {
+			(*kept)[0] = sampledID{docID: docID, hash: hash}
+			heap.Fix(kept, 0)
+		}
+	}
+	chosen := make(map[string]bool, kept.Len())
+	for _, sampled := range *kept {
+		chosen[sampled.docID] = true
+	}
+	return chosen
+}
+
+// hash spreads a document ID and the seed evenly over 64 bits
+func (s *SampleClause) hash(docID string) uint64 {
+	hasher := fnv.New64a()
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], uint64(s.Seed))
+	hasher.Write(seed[:])
+	hasher.Write([]byte(docID))
+	return mix64(hasher.Sum64())
+}
+
+// mix64 spreads the bits of an FNV hash, which leaves short inputs unevenly spread in the
+// high bits
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+type sampledID struct {
+	docID string
+	hash  uint64
+}
+
+// sampleHeap is a max-heap on hash, so the highest of the kept hashes is the one to replace
+type sampleHeap []sampledID
+
+func (h sampleHeap) Len() int            { return len(h) }
+func (h sampleHeap) Less(i, j int) bool  { return h[i].hash > h[j].hash }
+func (h sampleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sampleHeap) Push(x interface{}) { *h = append(*h, x.(sampledID)) }
+func (h *sampleHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,553 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	Schema files.
+
+	EXPORT SCHEMA describes the bundles of a database as a SchemaDocument: their fields,
+	indexes, partitioning and document limits, in name order so a file kept in version control
+	only changes where the schema does. It comes back as the result itself (JSON) or as YAML
+	text. APPLY SCHEMA takes such a description, in either format, and compares it with the
+	database. The differences become a plan of SyndrQL statements, each of which brings one
+	bundle a step closer, and the plan is run in order; with PREVIEW it is only returned.
+	Applying a schema the database already matches plans nothing, so the same file can be
+	applied on every deploy.
+
+	Only the bundles a file names are compared, and bundles are never dropped. A bundle that
+	is missing is created. Fields are added or changed as declared, and with PRUNE the fields
+	a file leaves out are removed. Document limits left out are the database's defaults. An index
+	that is missing or defined differently is created under its name, which replaces the old one;
+	indexes a file leaves out are left alone. Partitioning cannot change once a bundle has
+	documents in its partitions, so a bundle partitioned otherwise than declared refuses the
+	whole plan, as does an aggregate bundle, which changes with its source.
+
+	The plan is checked as a whole before anything is run, but it is not one transaction: a
+	step that fails stops the run after the steps before it. Applying the file again plans
+	only what is still missing.
+*/
+
+// Actions of the steps of a schema plan
+const (
+	SchemaCreateBundle = "CREATE BUNDLE"
+	SchemaAddField     = "ADD FIELD"
+	SchemaChangeField  = "CHANGE FIELD"
+	SchemaRemoveField  = "REMOVE FIELD"
+	SchemaSetLimits    = "SET LIMITS"
+	SchemaCreateIndex  = "CREATE INDEX"
+	SchemaReplaceIndex = "REPLACE INDEX"
+)
+
+// SchemaDocument declares the bundles of a database
+type SchemaDocument struct {
+	Bundles []BundleSchema
+}
+
+// BundleSchema declares one bundle
+type BundleSchema struct {
+	Name         string
+	Fields       []FieldSchema
+	Indexes      []IndexSchema           `json:",omitempty"`
+	Partitioning *models.PartitionScheme `json:",omitempty"` // Not partitioned when nil
+	Limits       *models.DocumentLimits  `json:",omitempty"` // The server's limits when nil
+}
+
+// FieldSchema declares a field, as CREATE BUNDLE's field definitions do
+type FieldSchema struct {
+	Name     string
+	Type     string
+	Required bool
+	Unique   bool
+	Default  interface{} `json:",omitempty"`
+}
+
+// IndexSchema declares an index
+type IndexSchema struct {
+	Name   string
+	Type   string // "btree" or "hash"
+	Fields []IndexFieldSchema
+}
+
+// IndexFieldSchema is one field of an index, or an expression over fields (see expressions.go)
+type IndexFieldSchema struct {
+	Field    string
+	Required bool
+	Unique   bool
+}
+
+// SchemaPlan is what APPLY SCHEMA ran, or with PREVIEW would run
+type SchemaPlan struct {
+	Steps   []SchemaStep
+	Applied int // Steps run, in order
+	Preview bool
+}
+
+// SchemaStep is one statement of a schema plan
+type SchemaStep struct {
+	Bundle    string
+	Action    string    // SchemaCreateBundle, SchemaAddField, ...
+	Statement string    // As SyndrQL, to read or run by hand
+	Command   Statement `json:"-"`
+}
+
+// ExportSchema describes bundles as a schema file would; aggregate bundles are left out
+func ExportSchema(bundles []*models.Bundle) *SchemaDocument {
+	schema := &SchemaDocument{Bundles: make([]BundleSchema, 0, len(bundles))}
+	for _, bundle := range bundles {
+		if bundle.AggregateOf != "" {
+			continue
+		}
+		bundleSchema := BundleSchema{Name: bundle.Name, Fields: make([]FieldSchema, 0, len(bundle.DocumentStructure.FieldDefinitions))}
+		for _, definition := range bundle.DocumentStructure.FieldDefinitions {
+			bundleSchema.Fields = append(bundleSchema.Fields, FieldSchema{
+				Name:     definition.Name,
+				Type:     definition.Type,
+				Required: definition.IsRequired,
+				Unique:   definition.IsUnique,
+				Default:  definition.DefaultValue,
+			})
+		}
+		sort.Slice(bundleSchema.Fields, func(i, j int) bool { return bundleSchema.Fields[i].Name < bundleSchema.Fields[j].Name })
+
+		for _, index := range bundle.Indexes {
+			indexSchema := IndexSchema{Name: index.IndexName, Type: index.IndexType}
+			for _, field := range index.Fields {
+				text := field.Name
+				if field.Expression != "" {
+					text = field.Expression
+				}
+				indexSchema.Fields = append(indexSchema.Fields, IndexFieldSchema{
+					Field:    text,
+					Required: field.IsRequired,
+					Unique:   field.IsUnique,
+				})
+			}
+			bundleSchema.Indexes = append(bundleSchema.Indexes, indexSchema)
+		}
+		sort.Slice(bundleSchema.Indexes, func(i, j int) bool { return bundleSchema.Indexes[i].Name < bundleSchema.Indexes[j].Name })
+
+		if bundle.Partitioning != nil {
+			partitioning := *bundle.Partitioning
+			bundleSchema.Partitioning = &partitioning
+		}
+		if bundle.Limits != (models.DocumentLimits{}) {
+			limits := bundle.Limits
+			bundleSchema.Limits = &limits
+		}
+		schema.Bundles = append(schema.Bundles, bundleSchema)
+	}
+	sort.Slice(schema.Bundles, func(i, j int) bool { return schema.Bundles[i].Name < schema.Bundles[j].Name })
+	return schema
+}
+
+// DecodeSchema reads a schema file, in JSON or YAML. Keys are matched without regard to
+// case and unknown keys are refused, so a misspelt one is not silently ignored.
+func DecodeSchema(text string) (*SchemaDocument, error) {
+	// JSON is YAML too; going through JSON gives both formats the same key matching
+	var generic interface{}
+	if err := yaml.Unmarshal([]byte(text), &generic); err != nil {
+		return nil, fmt.Errorf("schema is neither JSON nor YAML: %w", err)
+	}
+	if generic == nil {
+		return nil, fmt.Errorf("schema is empty")
+	}
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return nil, fmt.Errorf("schema cannot be read: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var schema SchemaDocument
+	if err := decoder.Decode(&schema); err != nil {
+		return nil, fmt.Errorf("schema does not describe bundles: %w", err)
+	}
+	return &schema, nil
+}
+
+// EncodeSchemaYAML writes a schema in YAML, with its keys in the same order as in JSON
+func EncodeSchemaYAML(schema *SchemaDocument) (string, error) {
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return "", err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return "", err
+	}
+	blockStyle(&node)
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// blockStyle clears the flow and quoting styles JSON leaves on a YAML node tree, so the
+// encoder writes block YAML and only quotes strings that need it
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// PlanSchema compares a schema with the bundles it names, found through lookup (nil for a
+// bundle that does not exist), and plans the statements that bring them to it. Bundle names
+// are compared by identifiers; defaults are the database's, which new bundles inherit.
+func PlanSchema(schema *SchemaDocument, lookup func(name string) *models.Bundle, identifiers helpers.Identifiers, defaults models.BundleDefaults, prune bool) (*SchemaPlan, error) {
+	plan := &SchemaPlan{Steps: make([]SchemaStep, 0)}
+	for i, bundleSchema := range schema.Bundles {
+		if bundleSchema.Name == "" {
+			return nil, fmt.Errorf("bundle %d of the schema has no name", i+1)
+		}
+		for _, earlier := range schema.Bundles[:i] {
+			if identifiers.Same(earlier.Name, bundleSchema.Name) {
+				return nil, fmt.Errorf("bundle '%s' is declared twice", bundleSchema.Name)
+			}
+		}
+		steps, err := planBundle(bundleSchema, lookup(bundleSchema.Name), defaults, prune)
+		if err != nil {
+			return nil, fmt.Errorf("bundle '%s': %w", bundleSchema.Name, err)
+		}
+		plan.Steps = append(plan.Steps, steps...)
+	}
+	return plan, nil
+}
+
+// planBundle plans the statements that bring one bundle, nil when it does not exist yet, to
+// its schema
+func planBundle(bundleSchema BundleSchema, bundle *models.Bundle, defaults models.BundleDefaults, prune bool) ([]SchemaStep, error) {
+	fields, err := schemaFieldDefinitions(bundleSchema.Fields)
+	if err != nil {
+		return nil, err
+	}
+	partitioning, err := schemaPartitioning(bundleSchema.Partitioning, fields)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := schemaIndexes(bundleSchema, fields)
+	if err != nil {
+		return nil, err
+	}
+	limits := models.DocumentLimits{}
+	if bundleSchema.Limits != nil {
+		limits = *bundleSchema.Limits
+		if limits.MaxBytes < 0 || limits.MaxFields < 0 || limits.MaxDepth < 0 {
+			return nil, fmt.Errorf("limits cannot be negative")
+		}
+	}
+
+	name := bundleSchema.Name
+	var steps []SchemaStep
+	step := func(action string, command Statement, text string) {
+		steps = append(steps, SchemaStep{Bundle: name, Action: action, Statement: text, Command: command})
+	}
+
+	if bundle == nil {
+		command := &BundleCommand{CommandType: "CREATE", BundleName: name, Fields: fields, Partitioning: partitioning}
+		if limits != (models.DocumentLimits{}) {
+			command.Limits = &limits
+		}
+		step(SchemaCreateBundle, command, createBundleText(command))
+	} else {
+		if bundle.AggregateOf != "" {
+			return nil, fmt.Errorf("it is an aggregate of '%s' and changes with that bundle", bundle.AggregateOf)
+		}
+		if !samePartitioning(bundle.Partitioning, partitioning) {
+			return nil, fmt.Errorf("its partitioning (%s) differs from the declared one (%s); partitioning cannot be changed",
+				partitioningText(bundle.Partitioning), partitioningText(partitioning))
+		}
+
+		existing := bundle.DocumentStructure.FieldDefinitions
+		for _, field := range fields {
+			current, exists := existing[field.Name]
+			switch {
+			case !exists:
+				change := FieldChange{ChangeType: "ADD", NewField: field}
+				step(SchemaAddField, &BundleCommand{CommandType: "UPDATE", BundleName: name, Changes: []FieldChange{change}},
+					fmt.Sprintf("UPDATE BUNDLE %s ADD FIELD %s;", quoteName(name), fieldDefinitionText(field)))
+			case !sameFieldDefinition(current, field):
+				change := FieldChange{ChangeType: "CHANGE", OldFieldName: field.Name, NewField: field}
+				step(SchemaChangeField, &BundleCommand{CommandType: "UPDATE", BundleName: name, Changes: []FieldChange{change}},
+					fmt.Sprintf("UPDATE BUNDLE %s CHANGE FIELD %s TO %s;", quoteName(name), fieldNameText(field.Name), fieldDefinitionText(field)))
+			}
+		}
+		if prune {
+			var undeclared []string
+			for fieldName := range existing {
+				if !declaresField(fields, fieldName) {
+					undeclared = append(undeclared, fieldName)
+				}
+			}
+			sort.Strings(undeclared)
+			for _, fieldName := range undeclared {
+				change := FieldChange{ChangeType: "REMOVE", OldFieldName: fieldName}
+				step(SchemaRemoveField, &BundleCommand{CommandType: "UPDATE", BundleName: name, Changes: []FieldChange{change}},
+					fmt.Sprintf("UPDATE BUNDLE %s REMOVE FIELD %s;", quoteName(name), fieldNameText(fieldName)))
+			}
+		}
+		// A new bundle inherits the limits it leaves out, so one made from this schema would have
+		if limits = InheritLimits(limits, defaults.Limits); bundle.Limits != limits {
+			step(SchemaSetLimits, &BundleCommand{CommandType: "UPDATE", BundleName: name, Limits: &limits},
+				fmt.Sprintf("UPDATE BUNDLE %s SET %s;", quoteName(name), limitsText(limits)))
+		}
+	}
+
+	for _, index := range indexes {
+		action := SchemaCreateIndex
+		if bundle != nil {
+			if current, exists := bundle.Indexes[index.IndexName]; exists {
+				if sameIndex(current, index) {
+					continue
+				}
+				action = SchemaReplaceIndex
+			}
+		}
+		step(action, index, createIndexText(index))
+	}
+	return steps, nil
+}
+
+// schemaFieldDefinitions checks the fields of a bundle schema and turns them into the
+// definitions CREATE BUNDLE would make of them
+func schemaFieldDefinitions(fields []FieldSchema) ([]models.FieldDefinition, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("a bundle needs at least one field")
+	}
+	definitions := make([]models.FieldDefinition, 0, len(fields))
+	for _, field := range fields {
+		// A schema file is not SyndrQL, so any name that could be written in backquotes will do
+		if err := CheckFieldName(field.Name, true); err != nil {
+			return nil, err
+		}
+		if field.Type == "" {
+			return nil, fmt.Errorf("field '%s' has no type", field.Name)
+		}
+		if declaresField(definitions, field.Name) {
+			return nil, fmt.Errorf("field '%s' is declared twice", field.Name)
+		}
+		var defaultValue interface{}
+		if field.Default != nil {
+			defaultValue = literalSource(field.Default)
+		}
+		definitions = append(definitions, models.FieldDefinition{
+			Name:         field.Name,
+			Type:         field.Type,
+			IsRequired:   field.Required,
+			IsUnique:     field.Unique,
+			DefaultValue: DetermineDefaultValue(field.Type, defaultValue),
+		})
+	}
+	return definitions, nil
+}
+
+// schemaPartitioning checks the partitioning of a bundle schema as PARTITION BY would
+func schemaPartitioning(declared *models.PartitionScheme, fields []models.FieldDefinition) (*models.PartitionScheme, error) {
+	if declared == nil {
+		return nil, nil
+	}
+	if !declaresField(fields, declared.Field) {
+		return nil, fmt.Errorf("partition field '%s' is not defined in the bundle", declared.Field)
+	}
+	scheme, err := newPartitionScheme(strings.ToUpper(declared.Strategy), declared.Field, declared.PartitionCount, declared.Boundaries)
+	if err != nil {
+		return nil, err
+	}
+	if scheme.Strategy == PartitionStrategyRange && declared.PartitionCount != 0 && declared.PartitionCount != scheme.PartitionCount {
+		return nil, fmt.Errorf("RANGE partitioning with %d boundaries has %d partitions, not %d",
+			len(declared.Boundaries), scheme.PartitionCount, declared.PartitionCount)
+	}
+	return scheme, nil
+}
+
+// schemaIndexes checks the indexes of a bundle schema and turns them into the CREATE INDEX
+// commands that build them
+func schemaIndexes(bundleSchema BundleSchema, fields []models.FieldDefinition) ([]*CreateIndexCommand, error) {
+	commands := make([]*CreateIndexCommand, 0, len(bundleSchema.Indexes))
+	for _, index := range bundleSchema.Indexes {
+		if index.Name == "" {
+			return nil, fmt.Errorf("an index has no name")
+		}
+		for _, earlier := range commands {
+			if earlier.IndexName == index.Name {
+				return nil, fmt.Errorf("index '%s' is declared twice", index.Name)
+			}
+		}
+		indexType := strings.ToLower(index.Type)
+		if indexType != "btree" && indexType != "hash" {
+			return nil, fmt.Errorf("index '%s' has type '%s'; use \"btree\" or \"hash\"", index.Name, index.Type)
+		}
+		if len(index.Fields) == 0 {
+			return nil, fmt.Errorf("index '%s' has no fields", index.Name)
+		}
+
+		command := &CreateIndexCommand{IndexName: index.Name, BundleName: bundleSchema.Name, IndexType: indexType}
+		for _, indexField := range index.Fields {
+			field := models.FieldDefinition{IsRequired: indexField.Required, IsUnique: indexField.Unique}
+			if declaresField(fields, indexField.Field) {
+				field.Name = indexField.Field
+			} else {
+				// Not a field of the bundle, so it has to be an expression over its fields
+				p, err := newStatementParser(indexField.Field)
+				if err != nil {
+					return nil, fmt.Errorf("index '%s': %w", index.Name, err)
+				}
+				text, expression, err := p.parseFieldOrExpression("a field name or an expression")
+				if err == nil {
+					err = p.expectEnd()
+				}
+				if err != nil {
+					return nil, fmt.Errorf("index '%s': '%s' is neither a field of the bundle nor an expression: %w", index.Name, indexField.Field, err)
+				}
+				if expression == nil {
+					return nil, fmt.Errorf("index '%s': field '%s' is not defined in the bundle", index.Name, indexField.Field)
+				}
+				field.Name, field.Expression = text, text
+			}
+			command.Fields = append(command.Fields, field)
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
+
+func declaresField(fields []models.FieldDefinition, name string) bool {
+	for _, field := range fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFieldDefinition compares a stored definition with a declared one; stored defaults may
+// have come back from BSON as another numeric type
+func sameFieldDefinition(current, declared models.FieldDefinition) bool {
+	return strings.EqualFold(current.Type, declared.Type) &&
+		current.IsRequired == declared.IsRequired &&
+		current.IsUnique == declared.IsUnique &&
+		fmt.Sprint(current.DefaultValue) == fmt.Sprint(declared.DefaultValue)
+}
+
+func sameIndex(current models.IndexReference, declared *CreateIndexCommand) bool {
+	if current.IndexType != declared.IndexType || len(current.Fields) != len(declared.Fields) {
+		return false
+	}
+	for i, field := range current.Fields {
+		other := declared.Fields[i]
+		if IndexFieldKey(field) != IndexFieldKey(other) || field.IsRequired != other.IsRequired || field.IsUnique != other.IsUnique {
+			return false
+		}
+	}
+	return true
+}
+
+func samePartitioning(current, declared *models.PartitionScheme) bool {
+	if current == nil || declared == nil {
+		return current == declared
+	}
+	return strings.EqualFold(current.Strategy, declared.Strategy) && current.Field == declared.Field &&
+		current.PartitionCount == declared.PartitionCount &&
+		fmt.Sprint(current.Boundaries) == fmt.Sprint(declared.Boundaries)
+}
+
+// literalSource is the text a value would be written as in SyndrQL, as DetermineDefaultValue
+// is given it by the parser
+func literalSource(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	return fmt.Sprint(value)
+}
+
+// quoteName quotes a name or string value for SyndrQL
+func quoteName(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// fieldNameText writes a field name, in backquotes when it is not a plain name
+func fieldNameText(name string) string {
+	if CheckFieldName(name, false) == nil {
+		return quoteName(name)
+	}
+	return "`" + strings.NewReplacer(`\`, `\\`, "`", "\\`").Replace(name) + "`"
+}
+
+func literalText(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return quoteName(text)
+	}
+	return fmt.Sprint(value)
+}
+
+func fieldDefinitionText(field models.FieldDefinition) string {
+	text := fmt.Sprintf("{%s, %s, %t, %t", fieldNameText(field.Name), field.Type, field.IsRequired, field.IsUnique)
+	if field.DefaultValue != nil {
+		text += ", " + literalText(field.DefaultValue)
+	}
+	return text + "}"
+}
+
+func limitsText(limits models.DocumentLimits) string {
+	return fmt.Sprintf("LIMITS (BYTES = %d, FIELDS = %d, DEPTH = %d)", limits.MaxBytes, limits.MaxFields, limits.MaxDepth)
+}
+
+func partitioningText(scheme *models.PartitionScheme) string {
+	if scheme == nil {
+		return "not partitioned"
+	}
+	if scheme.Strategy == PartitionStrategyHash {
+		return fmt.Sprintf("PARTITION BY HASH (%s) PARTITIONS %d", quoteName(scheme.Field), scheme.PartitionCount)
+	}
+	boundaries := make([]string, 0, len(scheme.Boundaries))
+	for _, boundary := range scheme.Boundaries {
+		boundaries = append(boundaries, literalText(boundary))
+	}
+	return fmt.Sprintf("PARTITION BY RANGE (%s) BOUNDARIES (%s)", quoteName(scheme.Field), strings.Join(boundaries, ", "))
+}
+
+func createBundleText(command *BundleCommand) string {
+	fields := make([]string, 0, len(command.Fields))
+	for _, field := range command.Fields {
+		fields = append(fields, fieldDefinitionText(field))
+	}
+	text := fmt.Sprintf("CREATE BUNDLE %s WITH FIELDS (%s)", quoteName(command.BundleName), strings.Join(fields, ", "))
+	if command.Partitioning != nil {
+		text += " " + partitioningText(command.Partitioning)
+	}
+	if command.Limits != nil {
+		text += " " + limitsText(*command.Limits)
+	}
+	return text + ";"
+}
+
+func createIndexText(command *CreateIndexCommand) string {
+	kind := "B-INDEX"
+	if command.IndexType == "hash" {
+		kind = "H-INDEX"
+	}
+	fields := make([]string, 0, len(command.Fields))
+	for _, field := range command.Fields {
+		name := fieldNameText(field.Name)
+		if field.Expression != "" {
+			name = field.Expression
+		}
+		fields = append(fields, fmt.Sprintf("{%s, %t, %t}", name, field.IsRequired, field.IsUnique))
+	}
+	return fmt.Sprintf("CREATE %s %s ON BUNDLE %s WITH FIELDS (%s);", kind, quoteName(command.IndexName), quoteName(command.BundleName), strings.Join(fields, ", "))
+}
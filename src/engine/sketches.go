@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+/*
+	Streaming sketches for approximate aggregates, see approximate.go. Each one takes values
+	one at a time in bounded memory, however many documents it is fed.
+
+	  - topKSketch is Space-Saving: it counts at most topKCapacity(k) values, and a new value
+	    takes over the counter of the least counted one, inheriting its count as the most it
+	    may be overstated by. Counts are exact while fewer values than that were seen.
+	  - tDigest is a merging t-digest: values are buffered, then merged into centroids whose
+	    size the k1 scale function keeps small near the tails, so extreme percentiles stay
+	    accurate.
+	  - hyperLogLog keeps 2^hllPrecision registers of one byte, for a standard error of
+	    about 0.8%; small counts use linear counting.
+*/
+
+// TopValue is one of the most frequent values TOPK found
+type TopValue struct {
+	Value interface{}
+	Count int64
+	Error int64 // Count may be overstated by up to this much
+}
+
+type topKCounter struct {
+	key       string
+	value     interface{}
+	count     int64
+	overcount int64
+	index     int
+}
+
+// topKHeap is a min-heap on count, so the least counted value is the one to replace
+type topKHeap []*topKCounter
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *topKHeap) Push(x interface{}) {
+	counter := x.(*topKCounter)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+type topKSketch struct {
+	k        int
+	capacity int
+	counters map[string]*topKCounter
+	heap     topKHeap
+}
+
+// topKCapacity is how many values are counted to find the top k
+func topKCapacity(k int) int {
+	return max(10*k, 100)
+}
+
+func newTopKSketch(k int) *topKSketch {
+	return &topKSketch{k: k, capacity: topKCapacity(k), counters: make(map[string]*topKCounter)}
+}
+
+func (s *topKSketch) add(value interface{}) {
+	key := indexKey(value)
+	if counter, exists := s.counters[key]; exists {
+		counter.count++
+		heap.Fix(&s.heap, counter.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		counter := &topKCounter{key: key, value: value, count: 1}
+		s.counters[key] = counter
+		heap.Push(&s.heap, counter)
+		return
+	}
+	least := s.heap[0]
+	delete(s.counters, least.key)
+	least.key, least.value, least.overcount = key, value, least.count
+	least.count++
+	s.counters[key] = least
+	heap.Fix(&s.heap, 0)
+}
+
+// top returns the k most counted values, most frequent first
+func (s *topKSketch) top() []TopValue {
+	counters := append([]*topKCounter(nil), s.heap...)
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].count != counters[j].count {
+			return counters[i].count > counters[j].count
+		}
+		return CompareOrderedValues(counters[i].value, counters[j].value) < 0
+	})
+	top := make([]TopValue, 0, min(s.k, len(counters)))
+	for _, counter := range counters[:min(s.k, len(counters))] {
+		top = append(top, TopValue{Value: counter.value, Count: counter.count, Error: counter.overcount})
+	}
+	return top
+}
+
+const tDigestCompression = 100
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+type tDigest struct {
+	centroids []centroid // Merged, by mean
+	buffer    []centroid
+	count     float64
+	min, max  float64
+}
+
+func (t *tDigest) add(value float64) {
+	if t.count == 0 || value < t.min {
+		t.min = value
+	}
+	if t.count == 0 || value > t.max {
+		t.max = value
+	}
+	t.count++
+	t.buffer = append(t.buffer, centroid{mean: value, weight: 1})
+	if len(t.buffer) >= 5*tDigestCompression {
+		t.compress()
+	}
+}
+
+// tDigestScale is the k1 scale function; neighbouring centroids merge while the scale they
+// span stays within 1
+func tDigestScale(q float64) float64 {
+	return tDigestCompression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (t *tDigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	t.buffer = t.buffer[:0]
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, len(all))
+	current := all[0]
+	before := 0.0 // Weight of the centroids already merged
+	for _, next := range all[1:] {
+		if tDigestScale((before+current.weight+next.weight)/t.count)-tDigestScale(before/t.count) <= 1 {
+			weight := current.weight + next.weight
+			current.mean += (next.mean - current.mean) * next.weight / weight
+			current.weight = weight
+			continue
+		}
+		before += current.weight
+		merged = append(merged, current)
+		current = next
+	}
+	t.centroids = append(merged, current)
+}
+
+// quantile estimates the value below which the share q of the values fall; ok is false when
+// no value was added
+func (t *tDigest) quantile(q float64) (value float64, ok bool) {
+	t.compress()
+	if t.count == 0 {
+		return 0, false
+	}
+	centroids := t.centroids
+	switch {
+	case q <= 0:
+		return t.min, true
+	case q >= 1:
+		return t.max, true
+	case len(centroids) == 1:
+		return centroids[0].mean, true
+	}
+
+	// Each centroid sits at the middle of its weight; interpolate between neighbours
+	position := q * t.count
+	first := centroids[0]
+	if position < first.weight/2 {
+		return t.min + (first.mean-t.min)*position/(first.weight/2), true
+	}
+	before := 0.0
+	for i := 0; i < len(centroids)-1; i++ {
+		left := before + centroids[i].weight/2
+		right := before + centroids[i].weight + centroids[i+1].weight/2
+		if position <= right {
+			return centroids[i].mean + (centroids[i+1].mean-centroids[i].mean)*(position-left)/(right-left), true
+		}
+		before += centroids[i].weight
+	}
+	last := centroids[len(centroids)-1]
+	left := t.count - last.weight/2
+	return clampFloat(last.mean+(t.max-last.mean)*(position-left)/(last.weight/2), t.min, t.max), true
+}
+
+func clampFloat(value, low, high float64) float64 {
+	return math.Max(low, math.Min(high, value))
+}
+
+const hllPrecision = 14
+
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+func (h *hyperLogLog) add(value interface{}) {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(indexKey(value)))
+	hash := mix64(hasher.Sum64())
+	register := hash >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[register] {
+		h.registers[register] = rank
+	}
+}
+
+// estimate returns the approximate number of distinct values added
+func (h *hyperLogLog) estimate() int64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
@@ -0,0 +1,298 @@
+package engine
+
+import (
+	"container/list"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/*
+	Statement cache.
+
+	A query sent over and over differs from one run to the next only in its values, yet each
+	run would be parsed anew. StatementCache tokenizes a command once and keys it by its tokens
+	normalized: every value compared against or listed after IN replaced by ? (see
+	NormalizeCommand). The first SELECT DOCUMENTS, SELECT DISTINCT, SELECT APPROXIMATE or
+	EXPLAIN of a shape is parsed and its statement kept. A later command of the shape gets a
+	copy of it holding its own values and its own WHERE text, and is not parsed; its plan then
+	comes from the plan cache. Other statements are always parsed.
+
+	A statement is only kept when its WHERE values are the ? of its shape, in the order they
+	are written, so that the copy is what parsing the command would have returned. Each server
+	has one cache of PlanCacheSize statements, least recently used dropped first. SHOW METRICS
+	reports its hits and misses.
+*/
+
+// StatementCache keeps parsed read statements by the normalized text of their commands
+type StatementCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element // By normalized command
+	order   *list.List               // Entries, most recently used first
+	hits    uint64
+	misses  uint64
+}
+
+type statementCacheEntry struct {
+	key       string
+	statement Statement // Never handed out; hits get copies of it
+	whereFrom int       // The tokens of the WHERE condition, to cut its text out of later commands
+	whereTo   int       // 0 without a WHERE clause
+}
+
+// NewStatementCache creates a cache of up to size statements; 0 parses every command
+func NewStatementCache(size int) *StatementCache {
+	return &StatementCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// Parse parses a command as ParseStatement does, reusing the statement cached for its shape
+func (c *StatementCache) Parse(command string) (Statement, error) {
+	if c == nil || c.size <= 0 {
+		return ParseStatement(command)
+	}
+	tokens, err := tokenize(command, "(){},;", statementOperators)
+	if err != nil {
+		return nil, err
+	}
+	key, values := normalizeTokens(tokens)
+	if statement, hit := c.get(key, command, tokens, values); hit {
+		return statement, nil
+	}
+
+	p := &statementParser{input: command, tokens: tokens}
+	statement, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectEnd(); err != nil {
+		return nil, err
+	}
+	if entry := newStatementCacheEntry(key, statement, command, tokens, values); entry != nil {
+		c.put(entry)
+	}
+	return statement, nil
+}
+
+// Stats returns the counters SHOW METRICS reports for the cache
+func (c *StatementCache) Stats() PlanCacheStats {
+	c.mu.Lock()
+	stats := PlanCacheStats{Entries: c.order.Len(), Hits: c.hits, Misses: c.misses}
+	c.mu.Unlock()
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+	return stats
+}
+
+// get returns a copy of the statement cached for key holding the values of the command
+func (c *StatementCache) get(key, command string, tokens []Token, values []int) (Statement, bool) {
+	c.mu.Lock()
+	element, exists := c.entries[key]
+	if !exists {
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	entry := element.Value.(*statementCacheEntry)
+	c.mu.Unlock()
+
+	statement := cloneStatement(entry.statement)
+	where, whereText := statementWhere(statement)
+	bound := 0
+	failed := false
+	walkWhereValues(where, func(value *interface{}) {
+		if failed || bound >= len(values) {
+			failed = true
+			return
+		}
+		token := tokens[values[bound]]
+		bound++
+		if token.Kind != TokenWord && token.Kind != TokenString {
+			failed = true
+			return
+		}
+		literal, err := literalValue(token)
+		if err != nil {
+			failed = true
+			return
+		}
+		*value = literal
+	})
+	// A value that does not convert is left to the parser, to report where it is
+	if failed || bound != len(values) {
+		return nil, false
+	}
+	if entry.whereTo > 0 {
+		*whereText = strings.TrimSpace(command[tokens[entry.whereFrom].Offset:tokens[entry.whereTo-1].End])
+	}
+
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+	return statement, true
+}
+
+// put caches an entry, dropping the least recently used entries beyond the cache's size. Only
+// statements the cache keeps count as misses, not every other command parsed.
+func (c *StatementCache) put(entry *statementCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.misses++
+	if element, exists := c.entries[entry.key]; exists {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an entry. Callers hold mu.
+func (c *StatementCache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*statementCacheEntry).key)
+	c.order.Remove(element)
+}
+
+// newStatementCacheEntry returns the entry caching a freshly parsed statement, or nil for a
+// statement that is not a read or whose values are not the ? of its shape, in order
+func newStatementCacheEntry(key string, statement Statement, command string, tokens []Token, values []int) *statementCacheEntry {
+	where, whereText := statementWhere(statement)
+	if whereText == nil {
+		return nil
+	}
+
+	matched := 0
+	walkWhereValues(where, func(value *interface{}) {
+		if matched < 0 || matched >= len(values) {
+			matched = -1
+			return
+		}
+		literal, err := literalValue(tokens[values[matched]])
+		if err != nil || !reflect.DeepEqual(literal, *value) {
+			matched = -1
+			return
+		}
+		matched++
+	})
+	if matched != len(values) {
+		return nil
+	}
+
+	entry := &statementCacheEntry{key: key, statement: cloneStatement(statement)}
+	if *whereText == "" {
+		return entry
+	}
+	for from, token := range tokens {
+		if !token.isKeyword("WHERE") {
+			continue
+		}
+		for to := from + 2; to <= len(tokens); to++ {
+			if strings.TrimSpace(command[tokens[from+1].Offset:tokens[to-1].End]) == *whereText {
+				entry.whereFrom, entry.whereTo = from+1, to
+				return entry
+			}
+		}
+		break
+	}
+	return nil
+}
+
+// statementWhere returns the WHERE condition of a read statement and its text, or nils for
+// statements the cache does not keep
+func statementWhere(statement Statement) (*WhereGroup, *string) {
+	switch cmd := statement.(type) {
+	case *SelectDocumentsCommand:
+		return cmd.Where, &cmd.WhereClause
+	case *SelectDistinctCommand:
+		return cmd.Where, &cmd.WhereClause
+	case *SelectApproximateCommand:
+		return cmd.Where, &cmd.WhereClause
+	case *ExplainCommand:
+		return cmd.Select.Where, &cmd.Select.WhereClause
+	}
+	return nil, nil
+}
+
+// walkWhereValues visits every value of a WHERE condition in the order it is written: each
+// comparison's, and each of an IN list
+func walkWhereValues(group *WhereGroup, visit func(value *interface{})) {
+	if group == nil {
+		return
+	}
+	for i := range group.Clauses {
+		clause := &group.Clauses[i]
+		if list, ok := clause.Value.([]interface{}); ok && clause.Operator == "IN" {
+			for j := range list {
+				visit(&list[j])
+			}
+			continue
+		}
+		visit(&clause.Value)
+	}
+	for i := range group.SubGroups {
+		walkWhereValues(&group.SubGroups[i], visit)
+	}
+}
+
+// cloneStatement copies a read statement deep enough that binding values to the copy leaves
+// the original alone
+func cloneStatement(statement Statement) Statement {
+	switch cmd := statement.(type) {
+	case *SelectDocumentsCommand:
+		clone := *cmd
+		clone.Where = cloneWhereGroup(cmd.Where)
+		if cmd.Sample != nil {
+			sample := *cmd.Sample
+			clone.Sample = &sample
+		}
+		if cmd.Modifiers != nil {
+			modifiers := *cmd.Modifiers
+			clone.Modifiers = &modifiers
+		}
+		return &clone
+	case *SelectDistinctCommand:
+		clone := *cmd
+		clone.Where = cloneWhereGroup(cmd.Where)
+		return &clone
+	case *SelectApproximateCommand:
+		clone := *cmd
+		clone.Functions = append([]ApproximateFunction(nil), cmd.Functions...)
+		clone.Where = cloneWhereGroup(cmd.Where)
+		if cmd.Sample != nil {
+			sample := *cmd.Sample
+			clone.Sample = &sample
+		}
+		return &clone
+	case *ExplainCommand:
+		return &ExplainCommand{Select: cloneStatement(cmd.Select).(*SelectDocumentsCommand)}
+	}
+	return statement
+}
+
+func cloneWhereGroup(group *WhereGroup) *WhereGroup {
+	if group == nil {
+		return nil
+	}
+	clone := copyWhereGroup(*group)
+	return &clone
+}
+
+func copyWhereGroup(group WhereGroup) WhereGroup {
+	clone := WhereGroup{Logic: group.Logic}
+	if group.Clauses != nil {
+		clone.Clauses = append([]WhereClause(nil), group.Clauses...)
+		for i, clause := range clone.Clauses {
+			if list, ok := clause.Value.([]interface{}); ok {
+				clone.Clauses[i].Value = append([]interface{}(nil), list...)
+			}
+		}
+	}
+	if group.SubGroups != nil {
+		clone.SubGroups = make([]WhereGroup, len(group.SubGroups))
+		for i, subGroup := range group.SubGroups {
+			clone.SubGroups[i] = copyWhereGroup(subGroup)
+		}
+	}
+	return clone
+}
@@ -0,0 +1,2420 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"time"
+)
+
+/*
+	SyndrQL grammar. Keywords are case-insensitive; a name is a bare word or a quoted string.
+
+	request     = [ "REQUEST" name ] statement                               the server strips the ID, see CutRequestID
+	statement   = ( select | explain | create | update | delete | add | merge | erase | snapshot | clone | use | check | show | adopt | analyze | advise | refresh
+	              | transaction | alter | export | apply ) [ ";" ]
+
+	select      = "SELECT" ( "DATABASES" [ "FROM" name ] | documents | distinct | approximate )
+	explain     = "EXPLAIN" "SELECT" documents
+	documents   = "DOCUMENTS" "FROM" bundle [ "AS" "OF" name ] [ sample ] [ "WHERE" condition ]
+	              [ "ORDER" "BY" name [ "ASC" | "DESC" ] ] [ after ] [ "LIMIT" integer ]  AS OF an RFC 3339 time
+	after       = "AFTER" "KEY" ( "(" [ literal "," ] name ")" | name )     (value, DocumentID) with ORDER BY, or a NextKey
+	                                                                         token; see keyset.go
+	sample      = "SAMPLE" word ( "PERCENT" | "ROWS" ) [ "REPEATABLE" "(" integer ")" ]   see sampling.go
+	distinct    = "DISTINCT" name "FROM" bundle [ "WHERE" condition ]
+	approximate = function { "," function } "FROM" bundle [ sample ] [ "WHERE" condition ]     see approximate.go
+	function    = "TOPK" "(" name "," integer ")" | "PERCENTILE" "(" name "," word ")"   PERCENTILE from 0 to 1
+	            | "APPROX_COUNT_DISTINCT" "(" name ")"
+
+	create      = "CREATE" ( "DATABASE" name [ "DEFAULT" limits ] [ durability ]   defaults for the bundles created in it
+	                       | "BUNDLE" bundle "WITH" "FIELDS" "(" fieldDef { "," fieldDef } ")" [ partition ] [ limits ]
+	                       | ( "TEMP" | "TEMPORARY" ) "BUNDLE" bundle "WITH" "FIELDS" "(" fieldDef { "," fieldDef } ")" [ limits ]
+	                       | indexType name "ON" "BUNDLE" bundle "WITH" "FIELDS" "(" indexField { "," indexField } ")"
+	                       | "AGGREGATE" bundle "ON" "BUNDLE" bundle "GROUP" "BY" name "COMPUTE" aggregate { "," aggregate }
+	                       | "WEBHOOK" name "ON" "BUNDLE" bundle "URL" name [ "EVENTS" event { "," event } ] [ "WHERE" condition ]
+	                         [ "SECRET" name ] [ "RETRIES" integer ] [ "BACKOFF" name ] )           BACKOFF is a duration such as "2s"
+	fieldDef    = "{" field "," name "," bool "," bool [ "," literal ] "}"   name, type, required, unique, default
+	partition   = "PARTITION" "BY" ( "HASH" "(" name ")" "PARTITIONS" integer
+	                               | "RANGE" "(" name ")" "BOUNDARIES" "(" literal { "," literal } ")" )
+	limits      = "LIMITS" "(" limit { "," limit } ")"
+	limit       = ( "BYTES" | "FIELDS" | "DEPTH" ) "=" integer                  0 or left out: the server's limit
+	durability  = "DURABILITY" ( "ALWAYS" | "INTERVAL" | "OFF" )             when its files are synced; see durability.go
+	indexType   = "B-INDEX" | "BTREE" "INDEX" | "H-INDEX" | "HASH" "INDEX"
+	indexField  = "{" operand "," bool [ "," bool ] "}"                      field or expression, [required,] unique
+	aggregate   = "COUNT" | "SUM" "(" name ")"                               the count is kept either way
+	event       = "INSERT" | "UPDATE" | "DELETE"
+
+	update      = "UPDATE" ( "DATABASE" name [ "SET" ( "DEFAULT" limits | durability ) ]   DEFAULT replaces all three default limits
+	                       | "BUNDLE" bundle change { [ "," ] change }
+	                       | "DOCUMENTS" "IN" [ "BUNDLE" ] bundle "(" field "=" literal { "," field "=" literal } ")" "WHERE" condition )
+	change      = "CHANGE" "FIELD" name "TO" fieldDef | "ADD" "FIELD" fieldDef | "REMOVE" "FIELD" name
+	            | "SET" limits                                               replaces all three limits
+	delete      = "DELETE" ( "DATABASE" name | "BUNDLE" bundle | "DOCUMENTS" "FROM" [ "BUNDLE" ] bundle "WHERE" condition
+	                       | "WEBHOOK" name "ON" "BUNDLE" bundle
+	                       | "ORPHANED" "FILES" [ name { "," name } ] )                 every orphaned file when none are named
+	add         = "ADD" "DOCUMENT" "TO" [ "BUNDLE" ] bundle "WITH" "(" "{" field "=" literal "}" { "," "{" field "=" literal "}" } ")"
+	              [ "ID" name ]                                              a new ID when none is given; replicated ADDs carry it
+	            | "ADD" "DOCUMENTS" "TO" [ "BUNDLE" ] bundle [ "MAP" "(" field "=" expression { "," field "=" expression } ")" ]
+	              "FROM" "SELECT" documents [ ids ]                          every field is copied without MAP
+	merge       = "MERGE" "INTO" [ "BUNDLE" ] bundle "USING" [ "BUNDLE" ] bundle [ "WHERE" condition ]   see directors/merge.go
+	              "ON" "(" field [ "=" field ] ")" when { when } [ ids ]     the target's key, then the source's
+	ids         = "IDS" name                                                 new documents' IDs derive from it and their source;
+	                                                                         replicated ones carry it
+	when        = "WHEN" "MATCHED" [ "THEN" ] "UPDATE" [ "SET" mappings ]    every field of the source without SET
+	            | "WHEN" "NOT" "MATCHED" [ "THEN" ] "INSERT" [ "MAP" mappings ]
+	mappings    = "(" field "=" expression { "," field "=" expression } ")"
+	erase       = "ERASE" "SUBJECT" [ name ] "WHERE" condition [ "SHRED" ]    see directors/erasure.go
+	snapshot    = "SNAPSHOT" "BUNDLE" bundle "AS" bundle
+	clone       = "CLONE" "BUNDLE" bundle "TO" "DATABASE" name [ "AS" bundle ]
+	use         = "USE" [ "DATABASE" ] name
+	check       = "CHECK" "DATABASE" name [ "REPAIR" ]
+	show        = "SHOW" ( "ORPHANED" "FILES" | "BUNDLE" "STATS" bundle      SHOW CLUSTER STATUS, PROCESSLIST, METRICS and REPLICA STATUS are answered by the server
+	                     | "FIELD" "STATS" bundle [ name ]                   bundle, then optionally one field
+	                     | "WEBHOOKS" [ "ON" "BUNDLE" bundle ] | "INDEX" ( "USAGE" | "STATS" ) [ "ON" "BUNDLE" bundle ] | "NAMESPACES"
+	                     | "DOCUMENT" "HISTORY" name "IN" [ "BUNDLE" ] bundle )
+	adopt       = "ADOPT" "ORPHANED" "FILE" name "INTO" "DATABASE" name
+	analyze     = "ANALYZE" "BUNDLE" bundle [ "SAMPLE" integer ]
+	advise      = "ADVISE" "INDEXES" "FOR" "BUNDLE" bundle                   see index_advisor.go
+	refresh     = "REFRESH" "AGGREGATE" bundle
+	export      = "EXPORT" "SCHEMA" [ "BUNDLE" bundle ] [ "AS" ( "JSON" | "YAML" ) ]   see schema_files.go
+	apply       = "APPLY" "SCHEMA" name [ "PRUNE" ] [ "PREVIEW" ]               the schema file's text, in JSON or YAML
+	transaction = "BEGIN" [ "TRANSACTION" ] [ "ISOLATION" "LEVEL" isolation ] | "COMMIT" | "ROLLBACK"
+	isolation   = "READ" "COMMITTED" | "SNAPSHOT"                            SNAPSHOT when omitted; transactions are answered by the server
+	alter       = "ALTER" ( "USER" name "PASSWORD" name "REPLACE" name        new password, then the current one; answered by the server
+	                      | "SYSTEM" "SET" name "=" literal )                 answered by the server
+
+	condition   = term { ( "AND" | "OR" ) term }
+	term        = "(" condition ")" | operand ( "==" | "!=" | "<" | ">" ) literal
+	            | operand "IN" "(" literal { "," literal } ")"               matches any of the literals
+	operand     = name | expression                                          see expressions.go
+	expression  = product { ( "+" | "-" ) product }                          operators need spaces around them
+	product     = factor { ( "*" | "/" ) factor }
+	factor      = ( "LOWER" | "UPPER" ) "(" expression ")" | "(" expression ")" | name | number
+	literal     = string | word                                              words become numbers or booleans where they parse
+	bundle      = name [ "." name ]                                          a bundle, or a namespace and a bundle in it;
+	                                                                         see helpers/namespaces.go
+	field       = name                                                       a field name a bundle or document write introduces;
+	                                                                         see field_names.go, `backquoted` for unusual ones
+*/
+
+// statementOperators are split out of words even without surrounding spaces
+var statementOperators = []string{"==", "!=", "<", ">", "="}
+
+// Statement is a parsed SyndrQL command, ready for the CommandDirector to execute
+type Statement interface {
+	statementName() string
+}
+
+// SelectDocumentsCommand is SELECT DOCUMENTS FROM <bundle> [AS OF ...] [SAMPLE ...] [WHERE ...] [ORDER BY ...] [AFTER KEY ...] [LIMIT n]
+type SelectDocumentsCommand struct {
+	BundleName  string
+	AsOf        *time.Time       // nil to read the bundle as it is now
+	Sample      *SampleClause    // nil to read every document
+	Where       *WhereGroup      // nil without a WHERE clause
+	WhereClause string           // The WHERE condition as written, for routing to other nodes
+	Modifiers   *SelectModifiers // nil without ORDER BY, AFTER KEY or LIMIT
+}
+
+// SelectDistinctCommand is SELECT DISTINCT <field> FROM <bundle> [WHERE ...], see distinct.go
+type SelectDistinctCommand struct {
+	Field       string
+	BundleName  string
+	Where       *WhereGroup // nil without a WHERE clause
+	WhereClause string
+}
+
+// SelectApproximateCommand is SELECT <function> {, <function>} FROM <bundle> [SAMPLE ...] [WHERE ...],
+// see approximate.go
+type SelectApproximateCommand struct {
+	Functions   []ApproximateFunction
+	BundleName  string
+	Sample      *SampleClause // nil to read every document
+	Where       *WhereGroup   // nil without a WHERE clause
+	WhereClause string
+}
+
+// SelectDatabasesCommand is SELECT DATABASES [FROM <scope>]
+type SelectDatabasesCommand struct{}
+
+// ExplainCommand asks for the plan of a SELECT DOCUMENTS instead of its results
+type ExplainCommand struct {
+	Select *SelectDocumentsCommand
+}
+
+// InsertSelectCommand is ADD DOCUMENTS TO <bundle> [MAP (...)] FROM SELECT DOCUMENTS ..., which
+// adds a new document to the bundle for every document the SELECT returns
+type InsertSelectCommand struct {
+	BundleName string
+	Mapping    []FieldMapping // nil to copy every field
+	Select     *SelectDocumentsCommand
+	IDSeed     string // The new documents' IDs derive from it; random IDs when empty
+}
+
+// FieldMapping sets a field of the new document to an expression over the selected one
+type FieldMapping struct {
+	Field string
+	Value *Expression
+}
+
+// MergeCommand is MERGE INTO <bundle> USING <bundle> [WHERE ...] ON (<field> [= <field>]) WHEN ...,
+// which updates the documents of the target that share a key with a source document and
+// inserts the source documents that match none
+type MergeCommand struct {
+	Target      string
+	Source      string
+	WhereClause string // Filters the source; empty for every document
+	TargetKey   string
+	SourceKey   string // The same as TargetKey when ON names one field
+
+	MatchedUpdate    bool           // WHEN MATCHED UPDATE was given
+	Update           []FieldMapping // nil to copy every field of the source document
+	NotMatchedInsert bool           // WHEN NOT MATCHED INSERT was given
+	Insert           []FieldMapping // nil to copy every field of the source document
+	IDSeed           string         // Inserted documents' IDs derive from it; random IDs when empty
+}
+
+// EraseSubjectCommand is ERASE SUBJECT [<name>] WHERE ... [SHRED], which erases the documents
+// of the subjects the condition finds in the bundles configured for them
+type EraseSubjectCommand struct {
+	Subject     string // Empty for the only subject configured for the database
+	Where       *WhereGroup
+	WhereClause string
+	Shred       bool // Encrypt the personal fields with a key that is thrown away instead of deleting
+}
+
+// UseDatabaseCommand switches the database a connection works in
+type UseDatabaseCommand struct {
+	DatabaseName string
+}
+
+// CheckDatabaseCommand verifies a database's files, repairing what it can when Repair is set
+type CheckDatabaseCommand struct {
+	DatabaseName string
+	Repair       bool
+}
+
+// ShowOrphanedFilesCommand lists data files no database refers to
+type ShowOrphanedFilesCommand struct{}
+
+// ShowDocumentHistoryCommand lists the writes kept of a document, see directors/time_travel.go
+type ShowDocumentHistoryCommand struct {
+	BundleName string
+	DocumentID string
+}
+
+// ShowNamespacesCommand lists the namespaces of the current database and their bundles
+type ShowNamespacesCommand struct{}
+
+// ShowBundleStatsCommand reports the statistics kept for a bundle
+type ShowBundleStatsCommand struct {
+	BundleName string
+}
+
+// ShowFieldStatsCommand reports the field statistics ANALYZE gathered for a bundle
+type ShowFieldStatsCommand struct {
+	BundleName string
+	FieldName  string // Every field when empty
+}
+
+// AnalyzeBundleCommand gathers field statistics over a sample of a bundle's documents
+type AnalyzeBundleCommand struct {
+	BundleName string
+	SampleSize int
+}
+
+// AdviseIndexesCommand suggests indexes for the queries run against a bundle, see index_advisor.go
+type AdviseIndexesCommand struct {
+	BundleName string
+}
+
+// ExportSchemaCommand describes the bundles of the current database as a schema file, see
+// schema_files.go
+type ExportSchemaCommand struct {
+	BundleName string // Every bundle when empty
+	YAML       bool
+}
+
+// ApplySchemaCommand brings the current database to a schema file, see schema_files.go
+type ApplySchemaCommand struct {
+	Schema  string // The file's text
+	Prune   bool   // Remove the fields the file leaves out
+	Preview bool   // Only return the plan
+}
+
+// CreateAggregateCommand declares a bundle of per-group counts and sums kept up to date from
+// another bundle
+type CreateAggregateCommand struct {
+	AggregateName string
+	SourceBundle  string
+	GroupBy       string
+	SumFields     []string
+}
+
+// RefreshAggregateCommand rebuilds an aggregate bundle from its source
+type RefreshAggregateCommand struct {
+	AggregateName string
+}
+
+// CreateWebhookCommand subscribes a URL to the document changes of a bundle
+type CreateWebhookCommand struct {
+	WebhookName string
+	BundleName  string
+	URL         string
+	Events      []string // WebhookInsert, WebhookUpdate, WebhookDelete; every event when empty
+	WhereClause string   // As written; every document when empty
+	Secret      string
+	MaxRetries  int
+	Backoff     time.Duration
+}
+
+// DeleteWebhookCommand removes a webhook from a bundle
+type DeleteWebhookCommand struct {
+	WebhookName string
+	BundleName  string
+}
+
+// ShowWebhooksCommand lists the webhooks of a bundle, or of every bundle of the database
+type ShowWebhooksCommand struct {
+	BundleName string // Every bundle when empty
+}
+
+// ShowIndexUsageCommand lists how often the indexes of a bundle, or of every bundle of the
+// database, served queries; see index_usage.go
+type ShowIndexUsageCommand struct {
+	BundleName string // Every bundle when empty
+}
+
+// ShowIndexStatsCommand describes the keys of the indexes of a bundle, or of every bundle of
+// the database, and how the buckets of hash indexes have grown; see directors/index_stats.go
+type ShowIndexStatsCommand struct {
+	BundleName string // Every bundle when empty
+}
+
+// Transaction isolation levels
+const (
+	IsolationReadCommitted = "READ COMMITTED"
+	IsolationSnapshot      = "SNAPSHOT"
+)
+
+// BeginTransactionCommand starts collecting a connection's document writes for one COMMIT
+type BeginTransactionCommand struct {
+	Isolation string // IsolationReadCommitted or IsolationSnapshot
+}
+
+// CommitCommand writes the open transaction's documents
+type CommitCommand struct{}
+
+// RollbackCommand discards the open transaction
+type RollbackCommand struct{}
+
+// AlterUserCommand is ALTER USER <user> PASSWORD <new> REPLACE <current>
+type AlterUserCommand struct {
+	UserName        string
+	Password        string
+	CurrentPassword string
+}
+
+// AlterSystemCommand is ALTER SYSTEM SET <setting> = <value>
+type AlterSystemCommand struct {
+	Setting string // In lower case
+	Value   interface{}
+}
+
+// DeleteOrphanedFilesCommand removes orphaned files; every one of them when FileNames is empty
+type DeleteOrphanedFilesCommand struct {
+	FileNames []string
+}
+
+// AdoptOrphanedFileCommand lists an orphaned bundle file in a database again
+type AdoptOrphanedFileCommand struct {
+	FileName     string
+	DatabaseName string
+}
+
+func (c *SelectDocumentsCommand) statementName() string     { return "SELECT DOCUMENTS" }
+func (c *SelectDistinctCommand) statementName() string      { return "SELECT DISTINCT" }
+func (c *SelectApproximateCommand) statementName() string   { return "SELECT APPROXIMATE" }
+func (c *SelectDatabasesCommand) statementName() string     { return "SELECT DATABASES" }
+func (c *ExplainCommand) statementName() string             { return "EXPLAIN" }
+func (c *InsertSelectCommand) statementName() string        { return "ADD DOCUMENTS" }
+func (c *MergeCommand) statementName() string               { return "MERGE" }
+func (c *EraseSubjectCommand) statementName() string        { return "ERASE SUBJECT" }
+func (c *UseDatabaseCommand) statementName() string         { return "USE" }
+func (c *CheckDatabaseCommand) statementName() string       { return "CHECK DATABASE" }
+func (c *ShowOrphanedFilesCommand) statementName() string   { return "SHOW ORPHANED FILES" }
+func (c *ShowNamespacesCommand) statementName() string      { return "SHOW NAMESPACES" }
+func (c *ShowDocumentHistoryCommand) statementName() string { return "SHOW DOCUMENT HISTORY" }
+func (c *ShowBundleStatsCommand) statementName() string     { return "SHOW BUNDLE STATS" }
+func (c *ShowFieldStatsCommand) statementName() string      { return "SHOW FIELD STATS" }
+func (c *AnalyzeBundleCommand) statementName() string       { return "ANALYZE BUNDLE" }
+func (c *AdviseIndexesCommand) statementName() string       { return "ADVISE INDEXES" }
+func (c *ExportSchemaCommand) statementName() string        { return "EXPORT SCHEMA" }
+func (c *ApplySchemaCommand) statementName() string         { return "APPLY SCHEMA" }
+func (c *CreateAggregateCommand) statementName() string     { return "CREATE AGGREGATE" }
+func (c *RefreshAggregateCommand) statementName() string    { return "REFRESH AGGREGATE" }
+func (c *CreateWebhookCommand) statementName() string       { return "CREATE WEBHOOK" }
+func (c *DeleteWebhookCommand) statementName() string       { return "DELETE WEBHOOK" }
+func (c *ShowWebhooksCommand) statementName() string        { return "SHOW WEBHOOKS" }
+func (c *ShowIndexUsageCommand) statementName() string      { return "SHOW INDEX USAGE" }
+func (c *ShowIndexStatsCommand) statementName() string      { return "SHOW INDEX STATS" }
+func (c *BeginTransactionCommand) statementName() string    { return "BEGIN" }
+func (c *CommitCommand) statementName() string              { return "COMMIT" }
+func (c *RollbackCommand) statementName() string            { return "ROLLBACK" }
+func (c *AlterUserCommand) statementName() string           { return "ALTER USER" }
+func (c *AlterSystemCommand) statementName() string         { return "ALTER SYSTEM" }
+func (c *DeleteOrphanedFilesCommand) statementName() string { return "DELETE ORPHANED FILES" }
+func (c *AdoptOrphanedFileCommand) statementName() string   { return "ADOPT ORPHANED FILE" }
+func (c *DatabaseCommand) statementName() string            { return c.CommandType + " DATABASE" }
+func (c *BundleCommand) statementName() string              { return c.CommandType + " BUNDLE" }
+func (c *CreateIndexCommand) statementName() string         { return "CREATE INDEX" }
+func (c *DocumentCommand) statementName() string            { return "ADD DOCUMENT" }
+func (c *DocumentUpdateCommand) statementName() string      { return "UPDATE DOCUMENTS" }
+func (c *DocumentDeleteCommand) statementName() string      { return "DELETE DOCUMENTS" }
+func (c *BundleCopyCommand) statementName() string          { return c.CommandType + " BUNDLE" }
+
+// StatementName returns the kind of a statement as written, such as "ADD DOCUMENT"
+func StatementName(statement Statement) string {
+	return statement.statementName()
+}
+
+// StatementBundle returns the bundle a statement reads or changes, or "" when it names none
+func StatementBundle(statement Statement) string {
+	switch cmd := statement.(type) {
+	case *SelectDocumentsCommand:
+		return cmd.BundleName
+	case *SelectDistinctCommand:
+		return cmd.BundleName
+	case *SelectApproximateCommand:
+		return cmd.BundleName
+	case *ExplainCommand:
+		return cmd.Select.BundleName
+	case *ShowBundleStatsCommand:
+		return cmd.BundleName
+	case *ShowFieldStatsCommand:
+		return cmd.BundleName
+	case *ShowDocumentHistoryCommand:
+		return cmd.BundleName
+	case *AnalyzeBundleCommand:
+		return cmd.BundleName
+	case *AdviseIndexesCommand:
+		return cmd.BundleName
+	case *CreateAggregateCommand:
+		return cmd.SourceBundle
+	case *CreateWebhookCommand:
+		return cmd.BundleName
+	case *DeleteWebhookCommand:
+		return cmd.BundleName
+	case *ShowWebhooksCommand:
+		return cmd.BundleName
+	case *ShowIndexUsageCommand:
+		return cmd.BundleName
+	case *ShowIndexStatsCommand:
+		return cmd.BundleName
+	case *ExportSchemaCommand:
+		return cmd.BundleName
+	case *BundleCommand:
+		return cmd.BundleName
+	case *CreateIndexCommand:
+		return cmd.BundleName
+	case *DocumentCommand:
+		return cmd.BundleName
+	case *InsertSelectCommand:
+		return cmd.BundleName
+	case *MergeCommand:
+		return cmd.Target
+	case *DocumentUpdateCommand:
+		return cmd.BundleName
+	case *DocumentDeleteCommand:
+		return cmd.BundleName
+	case *BundleCopyCommand:
+		return cmd.SourceBundle
+	}
+	return ""
+}
+
+// ParseStatement parses one SyndrQL command
+func ParseStatement(command string) (Statement, error) {
+	p, err := newStatementParser(command)
+	if err != nil {
+		return nil, err
+	}
+	statement, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectEnd(); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// ParseWhereClause parses a WHERE condition, with or without the WHERE keyword, into a tree of groups
+func ParseWhereClause(whereClause string) (*WhereGroup, error) {
+	p, err := newStatementParser(whereClause)
+	if err != nil {
+		return nil, err
+	}
+	p.acceptKeyword("WHERE")
+	group, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectEnd(); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// CutRequestID splits the REQUEST "<id>" prefix a client puts on a write it may retry off the
+// command. Commands without the prefix come back unchanged with an empty ID.
+func CutRequestID(command string) (string, string, error) {
+	p, err := newStatementParser(command)
+	if err != nil {
+		return "", command, err
+	}
+	if !p.peek().isKeyword("REQUEST") {
+		return "", command, nil
+	}
+	p.pos++
+	requestID, err := p.expectName("a request ID")
+	if err != nil {
+		return "", command, err
+	}
+	if p.peek().Kind == TokenEnd {
+		p.tried("a command")
+		return "", command, p.expectedError("")
+	}
+	return requestID, strings.TrimSpace(command[p.peek().Offset:]), nil
+}
+
+// statementParser is a recursive descent parser over the tokens of one command
+type statementParser struct {
+	input  string
+	tokens []Token
+	pos    int
+
+	// expected collects what was tried at expectedAt, so an error there can list every alternative
+	expected   []string
+	expectedAt int
+}
+
+func newStatementParser(input string) (*statementParser, error) {
+	tokens, err := tokenize(input, "(){},;", statementOperators)
+	if err != nil {
+		return nil, err
+	}
+	return &statementParser{input: input, tokens: tokens}, nil
+}
+
+func (p *statementParser) peek() Token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return Token{Kind: TokenEnd, Offset: len(p.input), End: len(p.input)}
+}
+
+func (p *statementParser) peekAt(ahead int) Token {
+	if p.pos+ahead < len(p.tokens) {
+		return p.tokens[p.pos+ahead]
+	}
+	return Token{Kind: TokenEnd, Offset: len(p.input), End: len(p.input)}
+}
+
+// errorAt builds a SyntaxError pointing at a token
+func (p *statementParser) errorAt(token Token, format string, args ...interface{}) *SyntaxError {
+	return newSyntaxError(p.input, token.Offset, token.End, fmt.Sprintf(format, args...))
+}
+
+// tried records an alternative that would have been accepted at the current token
+func (p *statementParser) tried(alternative string) {
+	if p.expectedAt != p.pos {
+		p.expected = nil
+		p.expectedAt = p.pos
+	}
+	for _, existing := range p.expected {
+		if existing == alternative {
+			return
+		}
+	}
+	p.expected = append(p.expected, alternative)
+}
+
+// expectedError reports the current token as unexpected, listing everything tried at it and
+// suggesting the keyword it most likely misspells
+func (p *statementParser) expectedError(context string) error {
+	token := p.peek()
+	var expected []string
+	if p.expectedAt == p.pos {
+		expected = p.expected
+	}
+
+	message := "expected " + joinAlternatives(expected)
+	if context != "" {
+		message += " for " + context
+	}
+	err := p.errorAt(token, "%s", message)
+	err.Expected = expected
+
+	if token.Kind == TokenWord {
+		var keywords []string
+		for _, alternative := range expected {
+			if alternative == strings.ToUpper(alternative) && !strings.HasPrefix(alternative, "'") {
+				keywords = append(keywords, alternative)
+			}
+		}
+		err.Suggestion = suggestKeyword(token.Text, keywords)
+	}
+	return err
+}
+
+// joinAlternatives lists alternatives as "A", "A or B" or "A, B or C"
+func joinAlternatives(alternatives []string) string {
+	if len(alternatives) <= 1 {
+		return strings.Join(alternatives, "")
+	}
+	return strings.Join(alternatives[:len(alternatives)-1], ", ") + " or " + alternatives[len(alternatives)-1]
+}
+
+func (p *statementParser) acceptKeyword(word string) bool {
+	if p.peek().isKeyword(word) {
+		p.pos++
+		return true
+	}
+	p.tried(word)
+	return false
+}
+
+func (p *statementParser) expectKeywords(words ...string) error {
+	for _, word := range words {
+		if !p.acceptKeyword(word) {
+			return p.expectedError("")
+		}
+	}
+	return nil
+}
+
+// expectOneOf consumes one of the given keywords and returns it in upper case
+func (p *statementParser) expectOneOf(words ...string) (string, error) {
+	for _, word := range words {
+		if p.acceptKeyword(word) {
+			return word, nil
+		}
+	}
+	return "", p.expectedError("")
+}
+
+func (p *statementParser) acceptPunct(text string) bool {
+	if p.peek().isPunct(text) {
+		p.pos++
+		return true
+	}
+	p.tried("'" + text + "'")
+	return false
+}
+
+func (p *statementParser) expectPunct(text string) error {
+	if !p.acceptPunct(text) {
+		return p.expectedError("")
+	}
+	return nil
+}
+
+// expectName consumes a bare word or quoted string
+func (p *statementParser) expectName(what string) (string, error) {
+	token, err := p.expectNameToken(what)
+	return token.Text, err
+}
+
+// expectNameToken is expectName for callers that need the raw token, such as field defaults
+func (p *statementParser) expectNameToken(what string) (Token, error) {
+	token := p.peek()
+	if token.Kind != TokenWord && token.Kind != TokenString {
+		p.tried(what)
+		return token, p.expectedError("")
+	}
+	p.pos++
+	return token, nil
+}
+
+// expectBundleName consumes a bundle name, which may be qualified with its namespace as
+// namespace.bundle or "namespace"."bundle" (see helpers/namespaces.go)
+func (p *statementParser) expectBundleName(what string) (string, error) {
+	token, err := p.expectNameToken(what)
+	if err != nil {
+		return "", err
+	}
+	if !p.peek().isPunct(".") {
+		return token.Text, nil
+	}
+	p.pos++
+	bundle, err := p.expectNameToken("a bundle name after the namespace")
+	if err != nil {
+		return "", err
+	}
+	return helpers.QualifiedBundleName(token.Text, bundle.Text), nil
+}
+
+// expectFieldName is expectName for a field name a bundle or a document write introduces,
+// checked by CheckFieldName
+func (p *statementParser) expectFieldName(what string) (string, error) {
+	token, err := p.expectNameToken(what)
+	if err != nil {
+		return "", err
+	}
+	escaped := token.Kind == TokenString && strings.HasPrefix(p.input[token.Offset:], "`")
+	if err := CheckFieldName(token.Text, escaped); err != nil {
+		return "", p.errorAt(token, "%s", err)
+	}
+	return token.Text, nil
+}
+
+func (p *statementParser) expectLiteral(what string) (interface{}, error) {
+	token, err := p.expectNameToken(what)
+	if err != nil {
+		return nil, err
+	}
+	return literalValue(token)
+}
+
+func (p *statementParser) expectBool(what string) (bool, error) {
+	token := p.peek()
+	if !token.isKeyword("true") && !token.isKeyword("false") {
+		p.tried("true")
+		p.tried("false")
+		return false, p.expectedError(what)
+	}
+	p.pos++
+	return strings.EqualFold(token.Text, "true"), nil
+}
+
+func (p *statementParser) expectInteger(what string) (int, error) {
+	token := p.peek()
+	value, err := strconv.Atoi(token.Text)
+	if token.Kind != TokenWord || err != nil {
+		p.tried("a whole number")
+		return 0, p.expectedError(what)
+	}
+	p.pos++
+	return value, nil
+}
+
+// expectEnd allows a trailing ';' and nothing after it
+func (p *statementParser) expectEnd() error {
+	p.acceptPunct(";")
+	if p.peek().Kind != TokenEnd {
+		p.tried("the end of the command")
+		return p.expectedError("")
+	}
+	return nil
+}
+
+// acceptOptionalBundleKeyword skips a BUNDLE keyword that is followed by the bundle's name
+func (p *statementParser) acceptOptionalBundleKeyword() {
+	if next := p.peekAt(1); p.peek().isKeyword("BUNDLE") && (next.Kind == TokenWord || next.Kind == TokenString) {
+		p.pos++
+	}
+}
+
+// textSince returns the command text from a token offset up to the last consumed token
+func (p *statementParser) textSince(offset int) string {
+	if p.pos == 0 {
+		return ""
+	}
+	return strings.TrimSpace(p.input[offset:p.tokens[p.pos-1].End])
+}
+
+func (p *statementParser) parseStatement() (Statement, error) {
+	verb, err := p.expectOneOf("SELECT", "EXPLAIN", "CREATE", "UPDATE", "DELETE", "ADD", "MERGE", "ERASE", "SNAPSHOT", "CLONE", "USE", "CHECK", "SHOW", "ADOPT", "ANALYZE", "ADVISE", "REFRESH",
+		"BEGIN", "COMMIT", "ROLLBACK", "ALTER", "EXPORT", "APPLY")
+	if err != nil {
+		return nil, err
+	}
+
+	switch verb {
+	case "SELECT":
+		object, err := p.expectOneOf("DOCUMENTS", "DATABASES", "DISTINCT", FunctionTopK, FunctionPercentile, FunctionApproxCountDistinct)
+		if err != nil {
+			return nil, err
+		}
+		switch object {
+		case "DISTINCT":
+			return p.parseSelectDistinct()
+		case FunctionTopK, FunctionPercentile, FunctionApproxCountDistinct:
+			return p.parseSelectApproximate(object)
+		}
+		if object == "DATABASES" {
+			if p.acceptKeyword("FROM") {
+				if _, err := p.expectName("a database scope such as DEFAULT"); err != nil {
+					return nil, err
+				}
+			}
+			return &SelectDatabasesCommand{}, nil
+		}
+		return p.parseSelectDocuments()
+	case "EXPLAIN":
+		if err := p.expectKeywords("SELECT", "DOCUMENTS"); err != nil {
+			return nil, err
+		}
+		selectCommand, err := p.parseSelectDocuments()
+		if err != nil {
+			return nil, err
+		}
+		return &ExplainCommand{Select: selectCommand}, nil
+	case "CREATE":
+		return p.parseCreate()
+	case "UPDATE":
+		return p.parseUpdate()
+	case "DELETE":
+		return p.parseDelete()
+	case "ADD":
+		return p.parseAddDocument()
+	case "MERGE":
+		return p.parseMerge()
+	case "ERASE":
+		return p.parseEraseSubject()
+	case "SNAPSHOT":
+		return p.parseSnapshot()
+	case "ALTER":
+		if p.acceptKeyword("SYSTEM") {
+			return p.parseAlterSystem()
+		}
+		return p.parseAlterUser()
+	case "USE":
+		p.acceptKeyword("DATABASE")
+		databaseName, err := p.expectName("a database name")
+		if err != nil {
+			return nil, err
+		}
+		return &UseDatabaseCommand{DatabaseName: databaseName}, nil
+	case "CHECK":
+		if err := p.expectKeywords("DATABASE"); err != nil {
+			return nil, err
+		}
+		databaseName, err := p.expectName("a database name")
+		if err != nil {
+			return nil, err
+		}
+		return &CheckDatabaseCommand{DatabaseName: databaseName, Repair: p.acceptKeyword("REPAIR")}, nil
+	case "SHOW":
+		what, err := p.expectOneOf("ORPHANED", "BUNDLE", "FIELD", "WEBHOOKS", "INDEX", "NAMESPACES", "DOCUMENT")
+		if err != nil {
+			return nil, err
+		}
+		if what == "NAMESPACES" {
+			return &ShowNamespacesCommand{}, nil
+		}
+		if what == "DOCUMENT" {
+			if err := p.expectKeywords("HISTORY"); err != nil {
+				return nil, err
+			}
+			command := &ShowDocumentHistoryCommand{}
+			if command.DocumentID, err = p.expectName("a document ID"); err != nil {
+				return nil, err
+			}
+			if err := p.expectKeywords("IN"); err != nil {
+				return nil, err
+			}
+			p.acceptOptionalBundleKeyword()
+			if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+				return nil, err
+			}
+			return command, nil
+		}
+		if what == "WEBHOOKS" {
+			command := &ShowWebhooksCommand{}
+			if p.acceptKeyword("ON") {
+				if err := p.expectKeywords("BUNDLE"); err != nil {
+					return nil, err
+				}
+				if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+					return nil, err
+				}
+			}
+			return command, nil
+		}
+		if what == "INDEX" {
+			report, err := p.expectOneOf("USAGE", "STATS")
+			if err != nil {
+				return nil, err
+			}
+			var bundleName string
+			if p.acceptKeyword("ON") {
+				if err := p.expectKeywords("BUNDLE"); err != nil {
+					return nil, err
+				}
+				if bundleName, err = p.expectBundleName("a bundle name"); err != nil {
+					return nil, err
+				}
+			}
+			if report == "STATS" {
+				return &ShowIndexStatsCommand{BundleName: bundleName}, nil
+			}
+			return &ShowIndexUsageCommand{BundleName: bundleName}, nil
+		}
+		if what == "FIELD" {
+			if err := p.expectKeywords("STATS"); err != nil {
+				return nil, err
+			}
+			command := &ShowFieldStatsCommand{}
+			if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+				return nil, err
+			}
+			if token := p.peek(); token.Kind == TokenWord || token.Kind == TokenString {
+				command.FieldName = token.Text
+				p.pos++
+			} else {
+				p.tried("a field name")
+			}
+			return command, nil
+		}
+		if what == "BUNDLE" {
+			if err := p.expectKeywords("STATS"); err != nil {
+				return nil, err
+			}
+			bundleName, err := p.expectBundleName("a bundle name")
+			if err != nil {
+				return nil, err
+			}
+			return &ShowBundleStatsCommand{BundleName: bundleName}, nil
+		}
+		if err := p.expectKeywords("FILES"); err != nil {
+			return nil, err
+		}
+		return &ShowOrphanedFilesCommand{}, nil
+	case "ADOPT":
+		if err := p.expectKeywords("ORPHANED", "FILE"); err != nil {
+			return nil, err
+		}
+		command := &AdoptOrphanedFileCommand{}
+		var err error
+		if command.FileName, err = p.expectName("a file name"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeywords("INTO", "DATABASE"); err != nil {
+			return nil, err
+		}
+		if command.DatabaseName, err = p.expectName("a database name"); err != nil {
+			return nil, err
+		}
+		return command, nil
+	case "ANALYZE":
+		if err := p.expectKeywords("BUNDLE"); err != nil {
+			return nil, err
+		}
+		command := &AnalyzeBundleCommand{SampleSize: DefaultAnalyzeSample}
+		if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+			return nil, err
+		}
+		if p.acceptKeyword("SAMPLE") {
+			sampleToken := p.peek()
+			if command.SampleSize, err = p.expectInteger("SAMPLE"); err != nil {
+				return nil, err
+			}
+			if command.SampleSize <= 0 {
+				return nil, p.errorAt(sampleToken, "SAMPLE must be a positive integer")
+			}
+		}
+		return command, nil
+	case "ADVISE":
+		if err := p.expectKeywords("INDEXES", "FOR", "BUNDLE"); err != nil {
+			return nil, err
+		}
+		command := &AdviseIndexesCommand{}
+		if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+			return nil, err
+		}
+		return command, nil
+	case "REFRESH":
+		if err := p.expectKeywords("AGGREGATE"); err != nil {
+			return nil, err
+		}
+		aggregateName, err := p.expectBundleName("an aggregate name")
+		if err != nil {
+			return nil, err
+		}
+		return &RefreshAggregateCommand{AggregateName: aggregateName}, nil
+	case "EXPORT":
+		if err := p.expectKeywords("SCHEMA"); err != nil {
+			return nil, err
+		}
+		command := &ExportSchemaCommand{}
+		if p.acceptKeyword("BUNDLE") {
+			if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+				return nil, err
+			}
+		}
+		if p.acceptKeyword("AS") {
+			format, err := p.expectOneOf("JSON", "YAML")
+			if err != nil {
+				return nil, err
+			}
+			command.YAML = format == "YAML"
+		}
+		return command, nil
+	case "APPLY":
+		if err := p.expectKeywords("SCHEMA"); err != nil {
+			return nil, err
+		}
+		command := &ApplySchemaCommand{}
+		if command.Schema, err = p.expectName("the schema, in JSON or YAML"); err != nil {
+			return nil, err
+		}
+		command.Prune = p.acceptKeyword("PRUNE")
+		command.Preview = p.acceptKeyword("PREVIEW")
+		return command, nil
+	case "BEGIN":
+		p.acceptKeyword("TRANSACTION")
+		command := &BeginTransactionCommand{Isolation: IsolationSnapshot}
+		if p.acceptKeyword("ISOLATION") {
+			if err := p.expectKeywords("LEVEL"); err != nil {
+				return nil, err
+			}
+			level, err := p.expectOneOf("READ", "SNAPSHOT")
+			if err != nil {
+				return nil, err
+			}
+			if level == "READ" {
+				if err := p.expectKeywords("COMMITTED"); err != nil {
+					return nil, err
+				}
+				command.Isolation = IsolationReadCommitted
+			}
+		}
+		return command, nil
+	case "COMMIT":
+		return &CommitCommand{}, nil
+	case "ROLLBACK":
+		return &RollbackCommand{}, nil
+	default:
+		return p.parseClone()
+	}
+}
+
+// parseSelectDocuments parses what follows SELECT DOCUMENTS
+func (p *statementParser) parseSelectDocuments() (*SelectDocumentsCommand, error) {
+	if err := p.expectKeywords("FROM"); err != nil {
+		return nil, err
+	}
+	bundleName, err := p.expectBundleName("a bundle name")
+	if err != nil {
+		return nil, err
+	}
+	command := &SelectDocumentsCommand{BundleName: bundleName}
+
+	if p.acceptKeyword("AS") {
+		if err := p.expectKeywords("OF"); err != nil {
+			return nil, err
+		}
+		timeToken, err := p.expectNameToken("a time such as '2024-05-01T00:00:00Z'")
+		if err != nil {
+			return nil, err
+		}
+		asOf, err := time.Parse(time.RFC3339, timeToken.Text)
+		if err != nil {
+			return nil, p.errorAt(timeToken, "AS OF needs an RFC 3339 time such as '2024-05-01T00:00:00Z'")
+		}
+		command.AsOf = &asOf
+	}
+
+	if p.acceptKeyword("SAMPLE") {
+		if command.Sample, err = p.parseSample(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("WHERE") {
+		start := p.peek().Offset
+		if command.Where, err = p.parseCondition(); err != nil {
+			return nil, err
+		}
+		command.WhereClause = p.textSince(start)
+	}
+
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeywords("BY"); err != nil {
+			return nil, err
+		}
+		field, err := p.expectName("a field to order by")
+		if err != nil {
+			return nil, err
+		}
+		orderBy := &OrderBy{Field: field}
+		if p.acceptKeyword("DESC") {
+			orderBy.Descending = true
+		} else {
+			p.acceptKeyword("ASC")
+		}
+		command.Modifiers = &SelectModifiers{OrderBy: orderBy}
+	}
+
+	if p.acceptKeyword("AFTER") {
+		if err := p.expectKeywords("KEY"); err != nil {
+			return nil, err
+		}
+		if command.Modifiers == nil {
+			command.Modifiers = &SelectModifiers{}
+		}
+		if command.Modifiers.After, err = p.parseAfterKey(command.Modifiers.OrderBy); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		limitToken := p.peek()
+		limit, err := p.expectInteger("LIMIT")
+		if err != nil {
+			return nil, err
+		}
+		if limit <= 0 {
+			return nil, p.errorAt(limitToken, "LIMIT must be a positive integer")
+		}
+		if command.Modifiers == nil {
+			command.Modifiers = &SelectModifiers{}
+		}
+		command.Modifiers.Limit = limit
+	}
+
+	return command, nil
+}
+
+// parseAfterKey parses what follows AFTER KEY: the ORDER BY value and DocumentID of the
+// document a page starts after, in parentheses, or a continuation token
+func (p *statementParser) parseAfterKey(orderBy *OrderBy) (*AfterKey, error) {
+	if !p.acceptPunct("(") {
+		token, err := p.expectNameToken("a continuation token")
+		if err != nil {
+			return nil, err
+		}
+		after, err := ParseContinuationToken(token.Text, orderBy)
+		if err != nil {
+			return nil, p.errorAt(token, "%s", err)
+		}
+		return after, nil
+	}
+
+	after := &AfterKey{}
+	if orderBy != nil {
+		value, err := p.expectLiteral("the " + orderBy.Field + " value to start after")
+		if err != nil {
+			return nil, err
+		}
+		after.Value = value
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if after.DocumentID, err = p.expectName("the DocumentID to start after"); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+// parseSelectDistinct parses what follows SELECT DISTINCT
+func (p *statementParser) parseSelectDistinct() (*SelectDistinctCommand, error) {
+	field, err := p.expectName("a field name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("FROM"); err != nil {
+		return nil, err
+	}
+	bundleName, err := p.expectBundleName("a bundle name")
+	if err != nil {
+		return nil, err
+	}
+	command := &SelectDistinctCommand{Field: field, BundleName: bundleName}
+	if p.acceptKeyword("WHERE") {
+		start := p.peek().Offset
+		if command.Where, err = p.parseCondition(); err != nil {
+			return nil, err
+		}
+		command.WhereClause = p.textSince(start)
+	}
+	return command, nil
+}
+
+// parseSelectApproximate parses what follows the name of the first function of a SELECT of
+// approximate aggregates
+func (p *statementParser) parseSelectApproximate(first string) (*SelectApproximateCommand, error) {
+	command := &SelectApproximateCommand{}
+	name := first
+	for {
+		function, err := p.parseApproximateFunction(name)
+		if err != nil {
+			return nil, err
+		}
+		command.Functions = append(command.Functions, function)
+		if !p.acceptPunct(",") {
+			break
+		}
+		if name, err = p.expectOneOf(FunctionTopK, FunctionPercentile, FunctionApproxCountDistinct); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expectKeywords("FROM"); err != nil {
+		return nil, err
+	}
+	bundleName, err := p.expectBundleName("a bundle name")
+	if err != nil {
+		return nil, err
+	}
+	command.BundleName = bundleName
+	if p.acceptKeyword("SAMPLE") {
+		if command.Sample, err = p.parseSample(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("WHERE") {
+		start := p.peek().Offset
+		if command.Where, err = p.parseCondition(); err != nil {
+			return nil, err
+		}
+		command.WhereClause = p.textSince(start)
+	}
+	return command, nil
+}
+
+// parseApproximateFunction parses the arguments of an approximate aggregate in parentheses
+func (p *statementParser) parseApproximateFunction(name string) (ApproximateFunction, error) {
+	function := ApproximateFunction{Name: name}
+	if err := p.expectPunct("("); err != nil {
+		return function, err
+	}
+	field, err := p.expectName("a field name")
+	if err != nil {
+		return function, err
+	}
+	function.Field = field
+
+	switch name {
+	case FunctionTopK:
+		if err := p.expectPunct(","); err != nil {
+			return function, err
+		}
+		kToken := p.peek()
+		if function.K, err = p.expectInteger("TOPK"); err != nil {
+			return function, err
+		}
+		if function.K <= 0 || function.K > MaxTopK {
+			return function, p.errorAt(kToken, "TOPK needs a k between 1 and %d", MaxTopK)
+		}
+	case FunctionPercentile:
+		if err := p.expectPunct(","); err != nil {
+			return function, err
+		}
+		percentileToken, err := p.expectNameToken("a share between 0 and 1, such as 0.95")
+		if err != nil {
+			return function, err
+		}
+		function.Percentile, err = strconv.ParseFloat(percentileToken.Text, 64)
+		if err != nil || function.Percentile < 0 || function.Percentile > 1 {
+			return function, p.errorAt(percentileToken, "PERCENTILE needs a share between 0 and 1, such as 0.95")
+		}
+	}
+
+	if err := p.expectPunct(")"); err != nil {
+		return function, err
+	}
+	return function, nil
+}
+
+// parseSample parses what follows SAMPLE: n PERCENT or n ROWS, then an optional REPEATABLE (seed)
+func (p *statementParser) parseSample() (*SampleClause, error) {
+	sizeToken, err := p.expectNameToken("a sample size")
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseFloat(sizeToken.Text, 64)
+	if err != nil || size <= 0 {
+		return nil, p.errorAt(sizeToken, "SAMPLE needs a positive number")
+	}
+	sample := &SampleClause{}
+	keyword, err := p.expectOneOf("PERCENT", "ROWS")
+	if err != nil {
+		return nil, err
+	}
+	if keyword == "PERCENT" {
+		if size > 100 {
+			return nil, p.errorAt(sizeToken, "SAMPLE PERCENT must be at most 100")
+		}
+		sample.Percent = size
+	} else {
+		if size != math.Trunc(size) {
+			return nil, p.errorAt(sizeToken, "SAMPLE ROWS must be a whole number")
+		}
+		sample.Rows = int(size)
+	}
+
+	if !p.acceptKeyword("REPEATABLE") {
+		sample.Seed = rand.Int63()
+		return sample, nil
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	seed, err := p.expectInteger("REPEATABLE")
+	if err != nil {
+		return nil, err
+	}
+	sample.Seed = int64(seed)
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return sample, nil
+}
+
+// whereElement is one term of a condition, in the order it was written
+type whereElement struct {
+	clause *WhereClause
+	group  *WhereGroup
+}
+
+// parseCondition parses terms joined by AND/OR, stopping at a ')' or anything else that can't continue it
+func (p *statementParser) parseCondition() (*WhereGroup, error) {
+	var elements []whereElement
+	for {
+		start := p.pos
+		if p.acceptPunct("(") {
+			group, err := p.parseCondition()
+			if err == nil {
+				err = p.expectPunct(")")
+			}
+			if err != nil {
+				// ("Price" * 2) + 1 > 10 opens with an expression, not a group
+				p.pos = start
+				clause, expressionErr := p.parseComparison()
+				if expressionErr != nil {
+					return nil, err
+				}
+				elements = append(elements, whereElement{clause: clause})
+			} else {
+				elements = append(elements, whereElement{group: group})
+			}
+		} else {
+			clause, err := p.parseComparison()
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, whereElement{clause: clause})
+		}
+
+		if !p.acceptKeyword("AND") && !p.acceptKeyword("OR") {
+			break
+		}
+		logic := p.tokens[p.pos-1]
+		last := elements[len(elements)-1]
+		if last.clause != nil {
+			last.clause.Logic = strings.ToUpper(logic.Text)
+		} else {
+			last.group.Logic = strings.ToUpper(logic.Text)
+		}
+	}
+	return newWhereGroup(elements), nil
+}
+
+// newWhereGroup arranges terms into a WhereGroup. Evaluation reads a group's Clauses before its
+// SubGroups, so when a level mixes both every clause becomes a one-clause subgroup to keep the
+// written order; a lone parenthesized group is unwrapped.
+func newWhereGroup(elements []whereElement) *WhereGroup {
+	if len(elements) == 1 && elements[0].group != nil {
+		return elements[0].group
+	}
+
+	mixed := false
+	for _, element := range elements {
+		if element.group != nil {
+			mixed = true
+		}
+	}
+
+	group := &WhereGroup{}
+	for _, element := range elements {
+		switch {
+		case element.group != nil:
+			group.SubGroups = append(group.SubGroups, *element.group)
+		case mixed:
+			clause := *element.clause
+			logic := clause.Logic
+			clause.Logic = ""
+			group.SubGroups = append(group.SubGroups, WhereGroup{Clauses: []WhereClause{clause}, Logic: logic})
+		default:
+			group.Clauses = append(group.Clauses, *element.clause)
+		}
+	}
+	return group
+}
+
+// parseComparison parses <field> <operator> <value> or <field> IN (<value>, ...), where the
+// field may be an expression over fields (see expressions.go)
+func (p *statementParser) parseComparison() (*WhereClause, error) {
+	field, expression, err := p.parseFieldOrExpression("a field name or '('")
+	if err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("IN") {
+		values, err := p.parseInList()
+		if err != nil {
+			return nil, err
+		}
+		return &WhereClause{Field: field, Expression: expression, Operator: "IN", Value: values}, nil
+	}
+	operator := p.peek()
+	if operator.Kind != TokenPunct || !isValidOperator(operator.Text) {
+		for _, valid := range []string{"==", "!=", "<", ">"} {
+			p.tried("'" + valid + "'")
+		}
+		return nil, p.expectedError("a comparison")
+	}
+	p.pos++
+	value, err := p.expectLiteral("a value to compare with")
+	if err != nil {
+		return nil, err
+	}
+	return &WhereClause{Field: field, Expression: expression, Operator: operator.Text, Value: value}, nil
+}
+
+// parseFieldOrExpression parses a field name, or an expression over fields known by its
+// canonical text. A lone name stays a field, even one that reads as a number.
+func (p *statementParser) parseFieldOrExpression(what string) (string, *Expression, error) {
+	start := p.pos
+	if token := p.peek(); token.Kind != TokenWord && token.Kind != TokenString && !token.isPunct("(") {
+		p.tried(what)
+		return "", nil, p.expectedError("")
+	}
+	expression, err := p.parseExpression()
+	if err != nil {
+		return "", nil, err
+	}
+	if p.pos == start+1 {
+		return p.tokens[start].Text, nil, nil
+	}
+	return expression.String(), expression, nil
+}
+
+// parseInList parses the parenthesized values after IN
+func (p *statementParser) parseInList() ([]interface{}, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var values []interface{}
+	for {
+		value, err := p.expectLiteral("a value to match")
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (p *statementParser) parseCreate() (Statement, error) {
+	object, err := p.expectOneOf("DATABASE", "BUNDLE", "TEMP", "TEMPORARY", "B-INDEX", "BTREE", "H-INDEX", "HASH", "AGGREGATE", "WEBHOOK", "USER")
+	if err != nil {
+		return nil, err
+	}
+
+	switch object {
+	case "DATABASE":
+		databaseName, err := p.expectName("a database name")
+		if err != nil {
+			return nil, err
+		}
+		command := &DatabaseCommand{
+			ID:           helpers.GenerateUUID(), // Generate a unique ID for the command
+			CommandType:  "CREATE",
+			DatabaseName: databaseName,
+		}
+		if p.acceptKeyword("DEFAULT") {
+			if err := p.expectKeywords("LIMITS"); err != nil {
+				return nil, err
+			}
+			if command.DefaultLimits, err = p.parseLimits(); err != nil {
+				return nil, err
+			}
+		}
+		if p.acceptKeyword("DURABILITY") {
+			if command.Durability, err = p.parseDurability(); err != nil {
+				return nil, err
+			}
+		}
+		return command, nil
+	case "BUNDLE":
+		return p.parseCreateBundle(false)
+	case "TEMP", "TEMPORARY":
+		if err := p.expectKeywords("BUNDLE"); err != nil {
+			return nil, err
+		}
+		return p.parseCreateBundle(true)
+	case "AGGREGATE":
+		return p.parseCreateAggregate()
+	case "WEBHOOK":
+		return p.parseCreateWebhook()
+	case "USER":
+		return nil, p.errorAt(p.tokens[p.pos-1], "USER commands are not supported yet")
+	default:
+		return p.parseCreateIndex(object)
+	}
+}
+
+// parseCreateBundle parses the rest of CREATE [TEMP] BUNDLE
+func (p *statementParser) parseCreateBundle(temporary bool) (Statement, error) {
+	bundleName, err := p.expectBundleName("a bundle name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("WITH", "FIELDS"); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var fields []models.FieldDefinition
+	for {
+		field, err := p.parseFieldDefinition()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+
+	command := &BundleCommand{
+		CommandType: "CREATE",
+		BundleName:  bundleName,
+		Fields:      fields,
+		Temporary:   temporary,
+	}
+	if token := p.peek(); token.isKeyword("PARTITION") && temporary {
+		return nil, p.errorAt(token, "a temporary bundle cannot be partitioned")
+	}
+	if p.acceptKeyword("PARTITION") {
+		if command.Partitioning, err = p.parsePartition(fields); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("LIMITS") {
+		if command.Limits, err = p.parseLimits(); err != nil {
+			return nil, err
+		}
+	}
+	return command, nil
+}
+
+// parseDurability parses the mode after DURABILITY
+func (p *statementParser) parseDurability() (models.Durability, error) {
+	mode, err := p.expectOneOf(string(models.DurabilityAlways), string(models.DurabilityInterval), string(models.DurabilityOff))
+	return models.Durability(mode), err
+}
+
+// parseLimits parses the rest of a LIMITS clause
+func (p *statementParser) parseLimits() (*models.DocumentLimits, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	limits := &models.DocumentLimits{}
+	seen := make(map[string]bool)
+	for {
+		token := p.peek()
+		limit, err := p.expectOneOf("BYTES", "FIELDS", "DEPTH")
+		if err != nil {
+			return nil, err
+		}
+		if seen[limit] {
+			return nil, p.errorAt(token, "limit %s is given twice", limit)
+		}
+		seen[limit] = true
+		if err := p.expectPunct("="); err != nil {
+			return nil, err
+		}
+		valueToken := p.peek()
+		value, err := p.expectInteger("a limit")
+		if err != nil {
+			return nil, err
+		}
+		if value < 0 {
+			return nil, p.errorAt(valueToken, "limit %s cannot be negative", limit)
+		}
+		switch limit {
+		case "BYTES":
+			limits.MaxBytes = int64(value)
+		case "FIELDS":
+			limits.MaxFields = value
+		case "DEPTH":
+			limits.MaxDepth = value
+		}
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// parseFieldDefinition parses {"<FIELDNAME>", <FIELDTYPE>, <REQUIRED>, <UNIQUE>[, <DEFAULT>]}
+func (p *statementParser) parseCreateAggregate() (Statement, error) {
+	command := &CreateAggregateCommand{}
+	var err error
+	if command.AggregateName, err = p.expectBundleName("an aggregate name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("ON", "BUNDLE"); err != nil {
+		return nil, err
+	}
+	if command.SourceBundle, err = p.expectBundleName("a bundle name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("GROUP", "BY"); err != nil {
+		return nil, err
+	}
+	if command.GroupBy, err = p.expectName("a field name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("COMPUTE"); err != nil {
+		return nil, err
+	}
+	for {
+		function, err := p.expectOneOf("COUNT", "SUM")
+		if err != nil {
+			return nil, err
+		}
+		if function == "SUM" {
+			if err := p.expectPunct("("); err != nil {
+				return nil, err
+			}
+			fieldToken, err := p.expectNameToken("a field to sum")
+			if err != nil {
+				return nil, err
+			}
+			for _, existing := range command.SumFields {
+				if existing == fieldToken.Text {
+					return nil, p.errorAt(fieldToken, "field '%s' is summed twice", fieldToken.Text)
+				}
+			}
+			command.SumFields = append(command.SumFields, fieldToken.Text)
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+		}
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	return command, nil
+}
+
+func (p *statementParser) parseAlterUser() (Statement, error) {
+	command := &AlterUserCommand{}
+	var err error
+	if err := p.expectKeywords("USER"); err != nil {
+		return nil, err
+	}
+	if command.UserName, err = p.expectName("a user name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("PASSWORD"); err != nil {
+		return nil, err
+	}
+	if command.Password, err = p.expectName("the new password"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("REPLACE"); err != nil {
+		return nil, err
+	}
+	if command.CurrentPassword, err = p.expectName("the current password"); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+func (p *statementParser) parseAlterSystem() (Statement, error) {
+	if err := p.expectKeywords("SET"); err != nil {
+		return nil, err
+	}
+	setting, err := p.expectName("a setting name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("="); err != nil {
+		return nil, err
+	}
+	value, err := p.expectLiteral("a value")
+	if err != nil {
+		return nil, err
+	}
+	return &AlterSystemCommand{Setting: strings.ToLower(setting), Value: value}, nil
+}
+
+func (p *statementParser) parseCreateWebhook() (Statement, error) {
+	command := &CreateWebhookCommand{MaxRetries: DefaultWebhookRetries, Backoff: DefaultWebhookBackoff}
+	var err error
+	if command.WebhookName, err = p.expectName("a webhook name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("ON", "BUNDLE"); err != nil {
+		return nil, err
+	}
+	if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("URL"); err != nil {
+		return nil, err
+	}
+	if command.URL, err = p.expectName("a URL"); err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("EVENTS") {
+		for {
+			eventToken := p.peek()
+			event, err := p.expectOneOf(WebhookInsert, WebhookUpdate, WebhookDelete)
+			if err != nil {
+				return nil, err
+			}
+			for _, existing := range command.Events {
+				if existing == event {
+					return nil, p.errorAt(eventToken, "event %s is listed twice", event)
+				}
+			}
+			command.Events = append(command.Events, event)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("WHERE") {
+		start := p.peek().Offset
+		if _, err := p.parseCondition(); err != nil {
+			return nil, err
+		}
+		command.WhereClause = p.textSince(start)
+	}
+	if p.acceptKeyword("SECRET") {
+		if command.Secret, err = p.expectName("a signing secret"); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("RETRIES") {
+		retriesToken := p.peek()
+		if command.MaxRetries, err = p.expectInteger("RETRIES"); err != nil {
+			return nil, err
+		}
+		if command.MaxRetries < 0 {
+			return nil, p.errorAt(retriesToken, "RETRIES cannot be negative")
+		}
+	}
+	if p.acceptKeyword("BACKOFF") {
+		backoffToken, err := p.expectNameToken("a duration such as \"2s\"")
+		if err != nil {
+			return nil, err
+		}
+		if command.Backoff, err = time.ParseDuration(backoffToken.Text); err != nil || command.Backoff <= 0 {
+			return nil, p.errorAt(backoffToken, "BACKOFF must be a positive duration such as \"500ms\" or \"2s\"")
+		}
+	}
+	return command, nil
+}
+
+func (p *statementParser) parseFieldDefinition() (models.FieldDefinition, error) {
+	var field models.FieldDefinition
+	var err error
+	if err = p.expectPunct("{"); err != nil {
+		return field, err
+	}
+	if field.Name, err = p.expectFieldName("a field name"); err != nil {
+		return field, err
+	}
+	if err = p.expectPunct(","); err != nil {
+		return field, err
+	}
+	if field.Type, err = p.expectName("a field type"); err != nil {
+		return field, err
+	}
+	if err = p.expectPunct(","); err != nil {
+		return field, err
+	}
+	if field.IsRequired, err = p.expectBool("REQUIRED"); err != nil {
+		return field, err
+	}
+	if err = p.expectPunct(","); err != nil {
+		return field, err
+	}
+	if field.IsUnique, err = p.expectBool("UNIQUE"); err != nil {
+		return field, err
+	}
+
+	var defaultValue interface{}
+	if p.acceptPunct(",") {
+		token, err := p.expectNameToken("a default value")
+		if err != nil {
+			return field, err
+		}
+		defaultValue = token.Text
+	}
+	field.DefaultValue = DetermineDefaultValue(field.Type, defaultValue)
+
+	return field, p.expectPunct("}")
+}
+
+// parsePartition parses the rest of a PARTITION BY clause over one of the bundle's fields
+func (p *statementParser) parsePartition(fields []models.FieldDefinition) (*models.PartitionScheme, error) {
+	start := p.tokens[p.pos-1]
+	if err := p.expectKeywords("BY"); err != nil {
+		return nil, err
+	}
+	strategy, err := p.expectOneOf(PartitionStrategyHash, PartitionStrategyRange)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	fieldToken := p.peek()
+	field, err := p.expectName("the partition field")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, definition := range fields {
+		if definition.Name == field {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, p.errorAt(fieldToken, "partition field '%s' is not defined in the bundle", field)
+	}
+
+	var count int
+	var boundaries []interface{}
+	if strategy == PartitionStrategyHash {
+		if err := p.expectKeywords("PARTITIONS"); err != nil {
+			return nil, err
+		}
+		if count, err = p.expectInteger("PARTITIONS"); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := p.expectKeywords("BOUNDARIES"); err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		for {
+			boundary, err := p.expectLiteral("a boundary value")
+			if err != nil {
+				return nil, err
+			}
+			boundaries = append(boundaries, boundary)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	scheme, err := newPartitionScheme(strategy, field, count, boundaries)
+	if err != nil {
+		return nil, p.errorAt(start, "%v", err)
+	}
+	return scheme, nil
+}
+
+// parseCreateIndex parses the rest of CREATE B-INDEX / H-INDEX (or BTREE INDEX / HASH INDEX)
+func (p *statementParser) parseCreateIndex(indexKind string) (Statement, error) {
+	command := &CreateIndexCommand{IndexType: "btree"}
+	if indexKind == "H-INDEX" || indexKind == "HASH" {
+		command.IndexType = "hash"
+	}
+	if indexKind == "BTREE" || indexKind == "HASH" {
+		if err := p.expectKeywords("INDEX"); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if command.IndexName, err = p.expectName("an index name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("ON", "BUNDLE"); err != nil {
+		return nil, err
+	}
+	if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("WITH", "FIELDS"); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	for {
+		field, err := p.parseIndexField()
+		if err != nil {
+			return nil, err
+		}
+		command.Fields = append(command.Fields, field)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	return command, p.expectPunct(")")
+}
+
+// parseIndexField parses {"<FIELDNAME>", <UNIQUE>} or {"<FIELDNAME>", <REQUIRED>, <UNIQUE>},
+// where the field may be an expression over fields (see expressions.go)
+func (p *statementParser) parseIndexField() (models.FieldDefinition, error) {
+	var field models.FieldDefinition
+	var err error
+	if err = p.expectPunct("{"); err != nil {
+		return field, err
+	}
+	var expression *Expression
+	if field.Name, expression, err = p.parseFieldOrExpression("a field name"); err != nil {
+		return field, err
+	}
+	if expression != nil {
+		field.Expression = field.Name
+	}
+	if err = p.expectPunct(","); err != nil {
+		return field, err
+	}
+	if field.IsUnique, err = p.expectBool("UNIQUE"); err != nil {
+		return field, err
+	}
+	if p.acceptPunct(",") {
+		field.IsRequired = field.IsUnique
+		if field.IsUnique, err = p.expectBool("UNIQUE"); err != nil {
+			return field, err
+		}
+	}
+	return field, p.expectPunct("}")
+}
+
+func (p *statementParser) parseUpdate() (Statement, error) {
+	object, err := p.expectOneOf("DOCUMENTS", "BUNDLE", "DATABASE", "USER")
+	if err != nil {
+		return nil, err
+	}
+
+	switch object {
+	case "DATABASE":
+		databaseName, err := p.expectName("a database name")
+		if err != nil {
+			return nil, err
+		}
+		command := &DatabaseCommand{
+			CommandType:  "UPDATE",
+			DatabaseName: databaseName,
+		}
+		if p.acceptKeyword("SET") {
+			setting, err := p.expectOneOf("DEFAULT", "DURABILITY")
+			if err != nil {
+				return nil, err
+			}
+			if setting == "DURABILITY" {
+				if command.Durability, err = p.parseDurability(); err != nil {
+					return nil, err
+				}
+				return command, nil
+			}
+			if err := p.expectKeywords("LIMITS"); err != nil {
+				return nil, err
+			}
+			if command.DefaultLimits, err = p.parseLimits(); err != nil {
+				return nil, err
+			}
+		}
+		return command, nil
+	case "BUNDLE":
+		return p.parseUpdateBundle()
+	case "USER":
+		return nil, p.errorAt(p.tokens[p.pos-1], "USER commands are not supported yet")
+	}
+
+	if err := p.expectKeywords("IN"); err != nil {
+		return nil, err
+	}
+	p.acceptOptionalBundleKeyword()
+	command := &DocumentUpdateCommand{}
+	if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	for {
+		key, err := p.expectFieldName("a field name")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("="); err != nil {
+			return nil, err
+		}
+		value, err := p.expectLiteral("a value")
+		if err != nil {
+			return nil, err
+		}
+		command.Fields = append(command.Fields, KeyValue{Key: key, Value: value})
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+
+	if command.WhereClause, err = p.parseRequiredWhere(); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// parseRequiredWhere parses the WHERE clause UPDATE and DELETE DOCUMENTS must have, returning it as written
+func (p *statementParser) parseRequiredWhere() (string, error) {
+	if err := p.expectKeywords("WHERE"); err != nil {
+		return "", err
+	}
+	start := p.peek().Offset
+	if _, err := p.parseCondition(); err != nil {
+		return "", err
+	}
+	return p.textSince(start), nil
+}
+
+func (p *statementParser) parseUpdateBundle() (Statement, error) {
+	bundleName, err := p.expectBundleName("a bundle name")
+	if err != nil {
+		return nil, err
+	}
+	command := &BundleCommand{CommandType: "UPDATE", BundleName: bundleName}
+
+	for {
+		change, err := p.expectOneOf("CHANGE", "ADD", "REMOVE", "SET")
+		if err != nil {
+			return nil, err
+		}
+		if change == "SET" {
+			if err := p.expectKeywords("LIMITS"); err != nil {
+				return nil, err
+			}
+			if command.Limits, err = p.parseLimits(); err != nil {
+				return nil, err
+			}
+			p.acceptPunct(",")
+			if next := p.peek(); next.Kind == TokenEnd || next.isPunct(";") {
+				return command, nil
+			}
+			continue
+		}
+		if err := p.expectKeywords("FIELD"); err != nil {
+			return nil, err
+		}
+
+		fieldChange := FieldChange{ChangeType: change}
+		if change != "ADD" {
+			if fieldChange.OldFieldName, err = p.expectName("a field name"); err != nil {
+				return nil, err
+			}
+		}
+		if change == "CHANGE" {
+			if err := p.expectKeywords("TO"); err != nil {
+				return nil, err
+			}
+		}
+		if change != "REMOVE" {
+			if fieldChange.NewField, err = p.parseFieldDefinition(); err != nil {
+				return nil, err
+			}
+		}
+		command.Changes = append(command.Changes, fieldChange)
+
+		p.acceptPunct(",")
+		if next := p.peek(); next.Kind == TokenEnd || next.isPunct(";") {
+			return command, nil
+		}
+	}
+}
+
+func (p *statementParser) parseDelete() (Statement, error) {
+	object, err := p.expectOneOf("DOCUMENTS", "BUNDLE", "DATABASE", "ORPHANED", "WEBHOOK", "USER")
+	if err != nil {
+		return nil, err
+	}
+
+	switch object {
+	case "DATABASE":
+		databaseName, err := p.expectName("a database name")
+		if err != nil {
+			return nil, err
+		}
+		return &DatabaseCommand{CommandType: "DELETE", DatabaseName: databaseName}, nil
+	case "ORPHANED":
+		if err := p.expectKeywords("FILES"); err != nil {
+			return nil, err
+		}
+		command := &DeleteOrphanedFilesCommand{}
+		if p.peek().Kind != TokenWord && p.peek().Kind != TokenString {
+			return command, nil
+		}
+		for {
+			fileName, err := p.expectName("a file name")
+			if err != nil {
+				return nil, err
+			}
+			command.FileNames = append(command.FileNames, fileName)
+			if !p.acceptPunct(",") {
+				return command, nil
+			}
+		}
+	case "BUNDLE":
+		bundleName, err := p.expectBundleName("a bundle name")
+		if err != nil {
+			return nil, err
+		}
+		return &BundleCommand{CommandType: "DELETE", BundleName: bundleName}, nil
+	case "WEBHOOK":
+		command := &DeleteWebhookCommand{}
+		if command.WebhookName, err = p.expectName("a webhook name"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeywords("ON", "BUNDLE"); err != nil {
+			return nil, err
+		}
+		if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+			return nil, err
+		}
+		return command, nil
+	case "USER":
+		return nil, p.errorAt(p.tokens[p.pos-1], "USER commands are not supported yet")
+	}
+
+	if err := p.expectKeywords("FROM"); err != nil {
+		return nil, err
+	}
+	p.acceptOptionalBundleKeyword()
+	command := &DocumentDeleteCommand{}
+	if command.BundleName, err = p.expectBundleName("a bundle name"); err != nil {
+		return nil, err
+	}
+	if command.WhereClause, err = p.parseRequiredWhere(); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+func (p *statementParser) parseAddDocument() (Statement, error) {
+	object, err := p.expectOneOf("DOCUMENT", "DOCUMENTS")
+	if err != nil {
+		return nil, err
+	}
+	if object == "DOCUMENTS" {
+		return p.parseInsertSelect()
+	}
+	if err := p.expectKeywords("TO"); err != nil {
+		return nil, err
+	}
+	p.acceptOptionalBundleKeyword()
+	bundleName, err := p.expectBundleName("a bundle name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("WITH"); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+
+	command := &DocumentCommand{CommandType: "ADD", BundleName: bundleName}
+	for {
+		if err := p.expectPunct("{"); err != nil {
+			return nil, err
+		}
+		key, err := p.expectFieldName("a field name")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("="); err != nil {
+			return nil, err
+		}
+		// Quoted values stay strings; bare ones become booleans or numbers where they parse
+		value, err := p.expectLiteral("a value")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("}"); err != nil {
+			return nil, err
+		}
+		command.Fields = append(command.Fields, KeyValue{Key: key, Value: value})
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("ID") {
+		if command.DocumentID, err = p.expectName("a document ID"); err != nil {
+			return nil, err
+		}
+	}
+	return command, nil
+}
+
+// parseInsertSelect parses the rest of ADD DOCUMENTS TO <bundle> [MAP (...)] FROM SELECT DOCUMENTS ...
+func (p *statementParser) parseInsertSelect() (Statement, error) {
+	if err := p.expectKeywords("TO"); err != nil {
+		return nil, err
+	}
+	p.acceptOptionalBundleKeyword()
+	bundleName, err := p.expectBundleName("a bundle name")
+	if err != nil {
+		return nil, err
+	}
+	command := &InsertSelectCommand{BundleName: bundleName}
+	if p.acceptKeyword("MAP") {
+		if command.Mapping, err = p.parseFieldMappings(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expectKeywords("FROM", "SELECT", "DOCUMENTS"); err != nil {
+		return nil, err
+	}
+	if command.Select, err = p.parseSelectDocuments(); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("IDS") {
+		if command.IDSeed, err = p.expectName("an ID seed"); err != nil {
+			return nil, err
+		}
+	}
+	return command, nil
+}
+
+// parseMerge parses the rest of MERGE INTO <bundle> USING <bundle> ...
+func (p *statementParser) parseMerge() (Statement, error) {
+	if err := p.expectKeywords("INTO"); err != nil {
+		return nil, err
+	}
+	p.acceptOptionalBundleKeyword()
+	command := &MergeCommand{}
+	var err error
+	if command.Target, err = p.expectBundleName("the bundle to merge into"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("USING"); err != nil {
+		return nil, err
+	}
+	p.acceptOptionalBundleKeyword()
+	if command.Source, err = p.expectBundleName("the bundle to merge from"); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("WHERE") {
+		start := p.peek().Offset
+		if _, err := p.parseCondition(); err != nil {
+			return nil, err
+		}
+		command.WhereClause = p.textSince(start)
+	}
+
+	if err := p.expectKeywords("ON"); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	if command.TargetKey, err = p.expectFieldName("the key field"); err != nil {
+		return nil, err
+	}
+	command.SourceKey = command.TargetKey
+	if p.acceptPunct("=") {
+		if command.SourceKey, err = p.expectFieldName("the source's key field"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peek()
+		if !p.acceptKeyword("WHEN") {
+			if !command.MatchedUpdate && !command.NotMatchedInsert {
+				p.tried("WHEN")
+				return nil, p.expectedError("")
+			}
+			if p.acceptKeyword("IDS") {
+				if command.IDSeed, err = p.expectName("an ID seed"); err != nil {
+					return nil, err
+				}
+			}
+			return command, nil
+		}
+		if p.acceptKeyword("NOT") {
+			if err := p.expectKeywords("MATCHED"); err != nil {
+				return nil, err
+			}
+			p.acceptKeyword("THEN")
+			if err := p.expectKeywords("INSERT"); err != nil {
+				return nil, err
+			}
+			if command.NotMatchedInsert {
+				return nil, p.errorAt(token, "WHEN NOT MATCHED is given twice")
+			}
+			command.NotMatchedInsert = true
+			if p.acceptKeyword("MAP") {
+				if command.Insert, err = p.parseFieldMappings(); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if err := p.expectKeywords("MATCHED"); err != nil {
+			return nil, err
+		}
+		p.acceptKeyword("THEN")
+		if err := p.expectKeywords("UPDATE"); err != nil {
+			return nil, err
+		}
+		if command.MatchedUpdate {
+			return nil, p.errorAt(token, "WHEN MATCHED is given twice")
+		}
+		command.MatchedUpdate = true
+		if p.acceptKeyword("SET") {
+			if command.Update, err = p.parseFieldMappings(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parseEraseSubject parses the rest of ERASE SUBJECT [<name>] WHERE ... [SHRED]
+func (p *statementParser) parseEraseSubject() (Statement, error) {
+	if err := p.expectKeywords("SUBJECT"); err != nil {
+		return nil, err
+	}
+	command := &EraseSubjectCommand{}
+	var err error
+	if !p.acceptKeyword("WHERE") {
+		if command.Subject, err = p.expectName("a subject name"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeywords("WHERE"); err != nil {
+			return nil, err
+		}
+	}
+	start := p.peek().Offset
+	if command.Where, err = p.parseCondition(); err != nil {
+		return nil, err
+	}
+	command.WhereClause = p.textSince(start)
+	command.Shred = p.acceptKeyword("SHRED")
+	return command, nil
+}
+
+// parseFieldMappings parses "(" field "=" expression { "," field "=" expression } ")"
+func (p *statementParser) parseFieldMappings() ([]FieldMapping, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var mappings []FieldMapping
+	mapped := make(map[string]bool)
+	for {
+		token := p.peek()
+		field, err := p.expectFieldName("a field name")
+		if err != nil {
+			return nil, err
+		}
+		if mapped[field] {
+			return nil, p.errorAt(token, "field '%s' is mapped twice", field)
+		}
+		mapped[field] = true
+		if err := p.expectPunct("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, FieldMapping{Field: field, Value: value})
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	return mappings, p.expectPunct(")")
+}
+
+func (p *statementParser) parseSnapshot() (Statement, error) {
+	if err := p.expectKeywords("BUNDLE"); err != nil {
+		return nil, err
+	}
+	command := &BundleCopyCommand{CommandType: "SNAPSHOT"}
+	var err error
+	if command.SourceBundle, err = p.expectBundleName("the bundle to snapshot"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("AS"); err != nil {
+		return nil, err
+	}
+	if command.TargetBundle, err = p.expectBundleName("a name for the snapshot"); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+func (p *statementParser) parseClone() (Statement, error) {
+	if err := p.expectKeywords("BUNDLE"); err != nil {
+		return nil, err
+	}
+	command := &BundleCopyCommand{CommandType: "CLONE"}
+	var err error
+	if command.SourceBundle, err = p.expectBundleName("the bundle to clone"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeywords("TO", "DATABASE"); err != nil {
+		return nil, err
+	}
+	if command.TargetDatabase, err = p.expectName("a database name"); err != nil {
+		return nil, err
+	}
+
+	// The clone keeps the source's name unless given another
+	command.TargetBundle = command.SourceBundle
+	if p.acceptKeyword("AS") {
+		if command.TargetBundle, err = p.expectBundleName("a name for the clone"); err != nil {
+			return nil, err
+		}
+	}
+	return command, nil
+}
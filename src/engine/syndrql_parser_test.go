@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseStatement(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    Statement
+	}{
+		{
+			name:    "select without where",
+			command: `SELECT DOCUMENTS FROM "Users";`,
+			want:    &SelectDocumentsCommand{BundleName: "Users"},
+		},
+		{
+			name:    "select with one comparison",
+			command: `SELECT DOCUMENTS FROM "Users" WHERE "Age" > 30;`,
+			want: &SelectDocumentsCommand{
+				BundleName:  "Users",
+				Where:       &WhereGroup{Clauses: []WhereClause{{Field: "Age", Operator: ">", Value: 30}}},
+				WhereClause: `"Age" > 30`,
+			},
+		},
+		{
+			name:    "select with nested groups",
+			command: `SELECT DOCUMENTS FROM "Users" WHERE "Name" == "Bo" AND ("Age" < 3 OR "Active" == true);`,
+			want: &SelectDocumentsCommand{
+				BundleName: "Users",
+				Where: &WhereGroup{SubGroups: []WhereGroup{
+					{Clauses: []WhereClause{{Field: "Name", Operator: "==", Value: "Bo"}}, Logic: "AND"},
+					{Clauses: []WhereClause{
+						{Field: "Age", Operator: "<", Value: 3, Logic: "OR"},
+						{Field: "Active", Operator: "==", Value: true},
+					}},
+				}},
+				WhereClause: `"Name" == "Bo" AND ("Age" < 3 OR "Active" == true)`,
+			},
+		},
+		{
+			name:    "select with an IN list",
+			command: `SELECT DOCUMENTS FROM "Users" WHERE "Age" IN (1, 2, 3);`,
+			want: &SelectDocumentsCommand{
+				BundleName:  "Users",
+				Where:       &WhereGroup{Clauses: []WhereClause{{Field: "Age", Operator: "IN", Value: []interface{}{1, 2, 3}}}},
+				WhereClause: `"Age" IN (1, 2, 3)`,
+			},
+		},
+		{
+			name:    "select distinct",
+			command: `SELECT DISTINCT "City" FROM "Users" WHERE "Age" > 1.5;`,
+			want: &SelectDistinctCommand{
+				Field:       "City",
+				BundleName:  "Users",
+				Where:       &WhereGroup{Clauses: []WhereClause{{Field: "Age", Operator: ">", Value: 1.5}}},
+				WhereClause: `"Age" > 1.5`,
+			},
+		},
+		{
+			name:    "explain",
+			command: `EXPLAIN SELECT DOCUMENTS FROM "Users" WHERE "Age" > -4;`,
+			want: &ExplainCommand{Select: &SelectDocumentsCommand{
+				BundleName:  "Users",
+				Where:       &WhereGroup{Clauses: []WhereClause{{Field: "Age", Operator: ">", Value: -4}}},
+				WhereClause: `"Age" > -4`,
+			}},
+		},
+		{
+			name:    "use",
+			command: `USE "Shop";`,
+			want:    &UseDatabaseCommand{DatabaseName: "Shop"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseStatement(test.command)
+			if err != nil {
+				t.Fatalf("ParseStatement(%q) failed: %v", test.command, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseStatement(%q) = %#v, want %#v", test.command, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseStatementSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		offset  int
+		near    string
+	}{
+		{"empty condition", `SELECT DOCUMENTS FROM "Users" WHERE;`, 35, ";"},
+		{"unknown operator", `SELECT DOCUMENTS FROM "Users" WHERE "Age" >> 3;`, 43, ">"},
+		{"unknown command", `FROBNICATE "x";`, 0, "FROBNICATE"},
+		{"text after the end", `SELECT DOCUMENTS FROM "Users" WHERE "Age" > 30; extra`, 48, "extra"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseStatement(test.command)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("ParseStatement(%q) error = %v, want a syntax error", test.command, err)
+			}
+			if syntaxErr.Offset != test.offset || syntaxErr.Near != test.near {
+				t.Errorf("ParseStatement(%q) error at %d near %q, want %d near %q", test.command, syntaxErr.Offset, syntaxErr.Near, test.offset, test.near)
+			}
+		})
+	}
+}
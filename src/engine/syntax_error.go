@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"syndrdb/src/protocol"
+	"unicode/utf8"
+)
+
+// snippetWidth is how many characters of a long command line are shown around an error
+const snippetWidth = 72
+
+// SyntaxError reports where a command stopped making sense
+type SyntaxError struct {
+	Message    string
+	Offset     int      // Character (not byte) offset of the offending token
+	Near       string   // The offending token as written; empty at the end of the command
+	Expected   []string // What the parser would have accepted instead, when known
+	Suggestion string   // A keyword the offending token looks like a typo of
+	Snippet    string   // The line holding the error with the token underlined by carets
+}
+
+func (e *SyntaxError) Error() string {
+	var message string
+	if e.Near == "" {
+		message = fmt.Sprintf("syntax error at end of command (character %d): %s", e.Offset, e.Message)
+	} else {
+		message = fmt.Sprintf("syntax error at character %d near '%s': %s", e.Offset, e.Near, e.Message)
+	}
+	// A lone expected keyword already names the fix
+	if e.Suggestion != "" && !(len(e.Expected) == 1 && e.Expected[0] == e.Suggestion) {
+		message += fmt.Sprintf(" (did you mean %s?)", e.Suggestion)
+	}
+	if e.Snippet != "" {
+		message += "\n" + e.Snippet
+	}
+	return message
+}
+
+func (e *SyntaxError) ErrorCode() protocol.ErrorCode { return protocol.ErrParse }
+
+// newSyntaxError builds a SyntaxError for the input bytes [start, end)
+func newSyntaxError(input string, start int, end int, message string) *SyntaxError {
+	return &SyntaxError{
+		Message: message,
+		Offset:  utf8.RuneCountInString(input[:start]),
+		Near:    input[start:end],
+		Snippet: errorSnippet(input, start, end),
+	}
+}
+
+// errorSnippet renders the line around [start, end) with carets under that range, trimming
+// long lines to a window around the error
+func errorSnippet(input string, start int, end int) string {
+	lineStart := strings.LastIndexByte(input[:start], '\n') + 1
+	lineEnd := len(input)
+	if i := strings.IndexByte(input[start:], '\n'); i >= 0 {
+		lineEnd = start + i
+	}
+	if end > lineEnd {
+		end = lineEnd
+	}
+
+	line := []rune(input[lineStart:lineEnd])
+	column := utf8.RuneCountInString(input[lineStart:start])
+	width := utf8.RuneCountInString(input[start:end])
+	if width == 0 {
+		width = 1
+	}
+
+	prefix, suffix := "", ""
+	if len(line) > snippetWidth {
+		from := column - snippetWidth/2
+		if from < 0 {
+			from = 0
+		}
+		to := from + snippetWidth
+		if to > len(line) {
+			to = len(line)
+			from = to - snippetWidth
+		}
+		if from > 0 {
+			prefix = "..."
+		}
+		if to < len(line) {
+			suffix = "..."
+		}
+		line = line[from:to]
+		column = column - from + len(prefix)
+		if column+width > len(prefix)+len(line) {
+			width = len(prefix) + len(line) - column + 1
+		}
+	}
+
+	return "  " + prefix + string(line) + suffix + "\n  " + strings.Repeat(" ", column) + strings.Repeat("^", width)
+}
+
+// suggestKeyword returns the keyword closest to a misspelled word, or "" when none is close
+func suggestKeyword(word string, keywords []string) string {
+	word = strings.ToUpper(word)
+	best, bestDistance := "", 0
+	for _, keyword := range keywords {
+		distance := editDistance(word, strings.ToUpper(keyword))
+		// Allow one typo in short words and two in longer ones
+		limit := 1
+		if utf8.RuneCountInString(keyword) > 4 {
+			limit = 2
+		}
+		if distance == 0 || distance > limit {
+			continue
+		}
+		if best == "" || distance < bestDistance {
+			best, bestDistance = keyword, distance
+		}
+	}
+	return best
+}
+
+// editDistance is the Damerau-Levenshtein distance (with adjacent swaps) between two strings
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous2 := make([]int, len(rb)+1)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				current[j] = min(current[j], previous2[j-2]+1)
+			}
+		}
+		previous2, previous, current = previous, current, previous2
+	}
+	return previous[len(rb)]
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+	The SyndrQL tokenizer.
+
+	Strings may be quoted with " or ', or with the typographic quotes word processors swap
+	in for them (“ ” „ ‘ ’). Inside a string \\ and an escaped quote character are unescaped;
+	any other backslash is kept as written so paths like "C:\data" survive. Backquotes quote
+	field names that are not plain names (see field_names.go).
+
+	A quote only opens a string at the start of a token, so words such as O'Brien stay whole.
+	A "." right after a closing quote is punctuation, so "billing"."invoices" is two strings
+	around it; elsewhere a "." is part of a word, as in 3.5 or billing.invoices.
+	Offsets are byte offsets into the input, measured in whole runes.
+*/
+
+type TokenKind int
+
+const (
+	TokenWord   TokenKind = iota // Keywords, names, numbers and booleans
+	TokenString                  // Quoted text, with the quotes removed and escapes resolved
+	TokenPunct                   // A punctuation rune or operator the caller asked to split on
+	TokenEnd                     // Past the last token
+)
+
+// Token is one lexical unit of a command
+type Token struct {
+	Kind   TokenKind
+	Text   string
+	Offset int // Byte offset of the first rune, including an opening quote
+	End    int // Byte offset just past the token, including a closing quote
+}
+
+// closingQuotes lists the runes that may close a string opened by each quote rune
+var closingQuotes = map[rune]string{
+	'"':  `"`,
+	'\'': `'`,
+	'“':  `”"`,
+	'„':  `”“"`,
+	'”':  `”`,
+	'‘':  `’'`,
+	'’':  `’`,
+	'`':  "`",
+}
+
+// tokenize splits a command into words, strings, the given punctuation runes and operators.
+// Operators end a word even without surrounding spaces; longer ones must come before their prefixes.
+func tokenize(input string, punctuation string, operators []string) ([]Token, error) {
+	var tokens []Token
+	wordStart := -1
+
+	flushWord := func(end int) {
+		if wordStart >= 0 {
+			tokens = append(tokens, Token{Kind: TokenWord, Text: input[wordStart:end], Offset: wordStart, End: end})
+			wordStart = -1
+		}
+	}
+	operatorAt := func(pos int) string {
+		for _, operator := range operators {
+			if strings.HasPrefix(input[pos:], operator) {
+				return operator
+			}
+		}
+		return ""
+	}
+
+	for pos := 0; pos < len(input); {
+		r, size := utf8.DecodeRuneInString(input[pos:])
+
+		if operator := operatorAt(pos); operator != "" {
+			flushWord(pos)
+			tokens = append(tokens, Token{Kind: TokenPunct, Text: operator, Offset: pos, End: pos + len(operator)})
+			pos += len(operator)
+			continue
+		}
+
+		switch {
+		case r == utf8.RuneError && size == 1:
+			return nil, newSyntaxError(input, pos, pos+size, "invalid UTF-8")
+		case unicode.IsSpace(r):
+			flushWord(pos)
+			pos += size
+		case strings.ContainsRune(punctuation, r), r == '.' && wordStart < 0 && followsString(tokens, pos):
+			flushWord(pos)
+			tokens = append(tokens, Token{Kind: TokenPunct, Text: string(r), Offset: pos, End: pos + size})
+			pos += size
+		case wordStart < 0 && closingQuotes[r] != "":
+			token, err := readString(input, pos, r, size)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token)
+			pos = token.End
+		default:
+			if wordStart < 0 {
+				wordStart = pos
+			}
+			pos += size
+		}
+	}
+	flushWord(len(input))
+
+	return tokens, nil
+}
+
+// followsString reports whether the last token is a string that ends right at pos
+func followsString(tokens []Token, pos int) bool {
+	return len(tokens) > 0 && tokens[len(tokens)-1].Kind == TokenString && tokens[len(tokens)-1].End == pos
+}
+
+// readString reads a quoted string whose opening quote is at start
+func readString(input string, start int, open rune, openSize int) (Token, error) {
+	closers := closingQuotes[open]
+	var text strings.Builder
+
+	for pos := start + openSize; pos < len(input); {
+		r, size := utf8.DecodeRuneInString(input[pos:])
+		if r == '\\' && pos+size < len(input) {
+			next, nextSize := utf8.DecodeRuneInString(input[pos+size:])
+			if next == '\\' || next == open || strings.ContainsRune(closers, next) {
+				text.WriteRune(next)
+				pos += size + nextSize
+				continue
+			}
+		}
+		if strings.ContainsRune(closers, r) {
+			return Token{Kind: TokenString, Text: text.String(), Offset: start, End: pos + size}, nil
+		}
+		text.WriteRune(r)
+		pos += size
+	}
+
+	return Token{}, newSyntaxError(input, start, start+openSize, "unterminated string")
+}
+
+// isPunct reports whether a token is the given punctuation or operator
+func (t Token) isPunct(text string) bool {
+	return t.Kind == TokenPunct && t.Text == text
+}
+
+// isKeyword reports whether a token is the given bare word, ignoring case
+func (t Token) isKeyword(word string) bool {
+	return t.Kind == TokenWord && strings.EqualFold(t.Text, word)
+}
+
+// literalValue converts a value token: strings stay strings, words become numbers or booleans where they parse
+func literalValue(token Token) (interface{}, error) {
+	if token.Kind == TokenString {
+		return token.Text, nil
+	}
+	return parseValue(token.Text)
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"syndrdb/src/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Webhook events, named after the operations they notify
+const (
+	WebhookInsert = "INSERT"
+	WebhookUpdate = "UPDATE"
+	WebhookDelete = "DELETE"
+
+	DefaultWebhookRetries = 5
+	DefaultWebhookBackoff = time.Second
+)
+
+// WebhooksToMap prepares a bundle's webhook definitions for the bundle file
+func WebhooksToMap(defs []models.WebhookDefinition) []interface{} {
+	webhooks := make([]interface{}, 0, len(defs))
+	for _, def := range defs {
+		webhooks = append(webhooks, map[string]interface{}{
+			"Name":        def.Name,
+			"URL":         def.URL,
+			"Events":      def.Events,
+			"WhereClause": def.WhereClause,
+			"Secret":      def.Secret,
+			"MaxRetries":  def.MaxRetries,
+			"Backoff":     def.Backoff.String(),
+		})
+	}
+	return webhooks
+}
+
+// MapToWebhooks restores webhook definitions decoded from BSON
+func MapToWebhooks(data interface{}) []models.WebhookDefinition {
+	var webhooks []interface{}
+	switch w := data.(type) {
+	case primitive.A:
+		webhooks = w
+	case []interface{}:
+		webhooks = w
+	}
+
+	defs := make([]models.WebhookDefinition, 0, len(webhooks))
+	for _, raw := range webhooks {
+		defData, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		def := models.WebhookDefinition{
+			Name:        stringValue(defData, "Name", ""),
+			URL:         stringValue(defData, "URL", ""),
+			WhereClause: stringValue(defData, "WhereClause", ""),
+			Secret:      stringValue(defData, "Secret", ""),
+			MaxRetries:  DefaultWebhookRetries,
+			Backoff:     DefaultWebhookBackoff,
+		}
+		if retries, ok := numericValue(defData["MaxRetries"]); ok {
+			def.MaxRetries = int(retries)
+		}
+		if backoff, err := time.ParseDuration(stringValue(defData, "Backoff", "")); err == nil {
+			def.Backoff = backoff
+		}
+		var events []interface{}
+		switch e := defData["Events"].(type) {
+		case primitive.A:
+			events = e
+		case []interface{}:
+			events = e
+		}
+		for _, event := range events {
+			if name, ok := event.(string); ok {
+				def.Events = append(def.Events, name)
+			}
+		}
+		defs = append(defs, def)
+	}
+	return defs
+}
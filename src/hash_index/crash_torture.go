@@ -0,0 +1,251 @@
+package hashindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Crash torture for hash indexes.
+
+	TortureHashIndex checks that the log and the page checksums bring a hash index back to a
+	consistent state after a crash, whatever write the crash cuts short. A round builds an
+	index over random documents, then inserts random keys into it or deletes the entries of
+	documents of the build, one commit at a time, sometimes closing and reopening it. A crash is armed at a byte offset the round's seed
+	picks among the bytes the same work writes without one (see helpers/crash_simulation.go).
+	Recovery then runs as it does at startup. Half of the time it is crashed as well and run
+	again. Afterwards the index must hold:
+	  - when its build was cut short: nothing, as an index that fails to open (invalid or
+	    unreadable), or all of the build's entries, when the crash came after its last commit
+	  - otherwise: the build's entries but those of acknowledged deletes, and every acknowledged
+	    insert. The change the crash interrupted, durable once its commit record is logged,
+	    may or may not be there. Nothing else may be, and every entry must be found by its key.
+*/
+
+// hashTortureRound is the work of one round, drawn from its seed
+type hashTortureRound struct {
+	fillFactor uint32
+	checkpoint int64 // Log size that triggers a checkpoint
+	hashSeed   uint32
+	build      []string // Keys of the build's documents, by position
+	inserts    []string // Keys inserted after the build
+	deletes    []int    // For each change after the build, the build entry it deletes instead of inserting, or -1
+	reopen     []bool   // Whether the index is closed and reopened before each change
+}
+
+// hashTortureOutcome is how far a run got before the crash
+type hashTortureOutcome struct {
+	built        bool // The build returned success
+	acknowledged int  // Changes after the build that returned success
+	inFlight     bool // A change was interrupted
+}
+
+var hashTortureField = IndexField{FieldName: "Key"}
+
+// TortureHashIndex runs one crash torture round in dir. It reports whether the crash came before
+// the work ended, and an error when the index recovered is not consistent.
+func TortureHashIndex(dir string, seed int64, logger *zap.SugaredLogger) (bool, error) {
+	rng := rand.New(rand.NewSource(seed))
+	round := &hashTortureRound{
+		fillFactor: uint32(MinFillFactor + rng.Intn(MaxFillFactor-MinFillFactor+1)),
+		checkpoint: []int64{32 << 10, 256 << 10, 16 << 20}[rng.Intn(3)],
+		hashSeed:   rng.Uint32(),
+	}
+	for i, count := 0, rng.Intn(3*hashBuildBatch); i < count; i++ {
+		round.build = append(round.build, tortureKey(rng, "b", i))
+	}
+	deletable := rng.Perm(len(round.build))
+	for i, count := 0, rng.Intn(200); i < count; i++ {
+		round.inserts = append(round.inserts, tortureKey(rng, "i", i))
+		round.deletes = append(round.deletes, -1)
+		if len(deletable) > 0 && rng.Intn(4) == 0 {
+			round.deletes[i], deletable = deletable[0], deletable[1:]
+		}
+		round.reopen = append(round.reopen, rng.Intn(20) == 0)
+	}
+
+	savedSeed, savedCheckpoint := newIndexSeed, hashWALCheckpointSize
+	newIndexSeed = func() uint32 { return round.hashSeed }
+	hashWALCheckpointSize = round.checkpoint
+	defer func() { newIndexSeed, hashWALCheckpointSize = savedSeed, savedCheckpoint }()
+
+	// An uninterrupted run counts the bytes the crash can cut at
+	helpers.ArmCrash(-1)
+	_, err := round.run(filepath.Join(dir, "uninterrupted"), logger)
+	total, _ := helpers.DisarmCrash()
+	if err != nil {
+		return false, fmt.Errorf("uninterrupted run failed: %w", err)
+	}
+
+	crashDir := filepath.Join(dir, "crashed")
+	helpers.ArmCrash(rng.Int63n(total + 1))
+	outcome, err := round.run(crashDir, logger)
+	_, crashed := helpers.DisarmCrash()
+	if err != nil {
+		return crashed, err
+	}
+
+	if rng.Intn(2) == 0 {
+		helpers.ArmCrash(rng.Int63n(total + 1))
+		RecoverHashIndexes(crashDir, logger)
+		helpers.DisarmCrash()
+	}
+	RecoverHashIndexes(crashDir, logger)
+	return crashed, round.verify(crashDir, outcome, logger)
+}
+
+// tortureKey returns a key of random length, so pages fill unevenly and chain overflow pages
+func tortureKey(rng *rand.Rand, prefix string, i int) string {
+	return fmt.Sprintf("%s%05d-%s", prefix, i, strings.Repeat("x", rng.Intn(300)))
+}
+
+// tortureDocID is the DocID of the i'th key of a kind
+func tortureDocID(prefix string, i int) string {
+	return fmt.Sprintf("doc-%s%05d", prefix, i)
+}
+
+// run builds the index and changes it, stopping at the first failure. Failures other than
+// the simulated crash are returned.
+func (r *hashTortureRound) run(dir string, logger *zap.SugaredLogger) (hashTortureOutcome, error) {
+	var outcome hashTortureOutcome
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return outcome, err
+	}
+	stopped := func(err error) (hashTortureOutcome, error) {
+		if errors.Is(err, helpers.ErrSimulatedCrash) {
+			return outcome, nil
+		}
+		return outcome, err
+	}
+
+	bundle := &models.Bundle{
+		BundleID:          "torture",
+		DocumentStructure: models.DocumentStructure{FieldDefinitions: map[string]models.FieldDefinition{hashTortureField.FieldName: {Name: hashTortureField.FieldName, Type: "STRING"}}},
+		Documents:         make(map[string]models.Document, len(r.build)),
+	}
+	for i, key := range r.build {
+		docID := tortureDocID("b", i)
+		bundle.Documents[docID] = models.Document{DocumentID: docID, Fields: map[string]models.Field{hashTortureField.FieldName: {Name: hashTortureField.FieldName, Value: key}}}
+	}
+	service := NewHashService(dir, 0, r.fillFactor, logger)
+	indexName, err := service.CreateHashIndex(context.Background(), bundle, hashTortureField)
+	if err != nil {
+		return stopped(err)
+	}
+	outcome.built = true
+
+	path := service.paths.HashIndexFile(indexName)
+	index, err := openHashIndex(path, 100, logger)
+	if err != nil {
+		return stopped(err)
+	}
+	for i, value := range r.inserts {
+		if r.reopen[i] {
+			if err := index.Close(); err != nil {
+				return stopped(err)
+			}
+			if index, err = openHashIndex(path, 100, logger); err != nil {
+				return stopped(err)
+			}
+		}
+		docID := tortureDocID("i", i)
+		if j := r.deletes[i]; j >= 0 {
+			value, docID = r.build[j], tortureDocID("b", j)
+		}
+		key, _, err := encodeFieldValue(value, hashTortureField)
+		if err != nil {
+			index.Close()
+			return outcome, err
+		}
+		if r.deletes[i] >= 0 {
+			err = index.Delete(key, docID)
+		} else {
+			err = index.Insert(key, docID, uint64(len(r.build)+i+1))
+		}
+		if err != nil {
+			outcome.inFlight = true
+			index.Close()
+			return stopped(err)
+		}
+		outcome.acknowledged++
+	}
+	return stopped(index.Close())
+}
+
+// verify checks the recovered index against what the crashed run got done
+func (r *hashTortureRound) verify(dir string, outcome hashTortureOutcome, logger *zap.SugaredLogger) error {
+	path := helpers.NewPathResolver(dir).HashIndexFile(helpers.HashIndexName("torture", hashTortureField.FieldName))
+	index, err := openHashIndex(path, 100, logger)
+	if err != nil {
+		if outcome.built {
+			return fmt.Errorf("index built before the crash does not open: %w", err)
+		}
+		return nil
+	}
+	defer index.Close()
+
+	// Entries that must be there, and the one that may be
+	required := make(map[string]string)
+	optional := make(map[string]string)
+	for i, key := range r.build {
+		required[tortureDocID("b", i)] = key
+	}
+	if outcome.built {
+		for i, key := range r.inserts[:outcome.acknowledged] {
+			if j := r.deletes[i]; j >= 0 {
+				delete(required, tortureDocID("b", j))
+			} else {
+				required[tortureDocID("i", i)] = key
+			}
+		}
+		if i := outcome.acknowledged; outcome.inFlight {
+			if j := r.deletes[i]; j >= 0 {
+				delete(required, tortureDocID("b", j))
+				optional[tortureDocID("b", j)] = r.build[j]
+			} else {
+				optional[tortureDocID("i", i)] = r.inserts[i]
+			}
+		}
+	}
+
+	entries, err := index.ScanAll()
+	if err != nil {
+		return fmt.Errorf("recovered index cannot be scanned: %w", err)
+	}
+	if index.metadata.NumTuples != uint64(len(entries)) || index.metadata.Keys != uint64(len(entries)) {
+		return fmt.Errorf("recovered index counts %d entries and %d keys but holds %d", index.metadata.NumTuples, index.metadata.Keys, len(entries))
+	}
+	found := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		key, isRequired := required[entry.DocID]
+		if !isRequired {
+			key = optional[entry.DocID]
+		}
+		if expected, _, _ := encodeFieldValue(key, hashTortureField); key == "" || string(entry.Key) != string(expected) {
+			return fmt.Errorf("recovered index holds an entry for %s it should not", entry.DocID)
+		}
+		if found[entry.DocID] {
+			return fmt.Errorf("recovered index holds %s twice", entry.DocID)
+		}
+		found[entry.DocID] = true
+	}
+	for docID, key := range required {
+		if !found[docID] {
+			return fmt.Errorf("recovered index lost %s (%d of %d required entries found)", docID, len(found), len(required))
+		}
+		encoded, _, _ := encodeFieldValue(key, hashTortureField)
+		if entry, err := index.Find(encoded); err != nil || entry == nil {
+			return fmt.Errorf("recovered index does not find the key of %s: %v", docID, err)
+		}
+	}
+	return nil
+}
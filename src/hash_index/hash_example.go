@@ -8,7 +8,7 @@ package hashindex
 
 // func CreateHashIndex(bundle *engine.Bundle, logger *zap.SugaredLogger) {
 // 	// Create a hash indexing service
-// 	//hashService := NewHashService("/path/to/data", 100*1024*1024, logger)
+// 	//hashService := NewHashService("/path/to/data", 100*1024*1024, DefaultFillFactor, logger)
 
 // 	// Create a hash index on a field
 // 	// indexName, err := hashService.CreateHashIndex(bundle, IndexField{
@@ -17,7 +17,7 @@ var hashKey func(key []byte) uint32
 // 	return h.Sum32()
 // }
 
-// computeBucket determines which bucket a hash value belongs to
+// computeBucket determines which bucket a hash value belongs to, returning its page
 func (hi *HashIndex) computeBucket(hashValue uint32) uint32 {
 	bucket := hashValue & hi.metadata.HighMask
 
@@ -27,7 +27,7 @@ func (hi *HashIndex) computeBucket(hashValue uint32) uint32 {
 		bucket = hashValue & hi.metadata.LowMask
 	}
 
-	return bucket + 1 // Convert to 1-based page numbers
+	return hi.bucketPage(bucket)
 }
 
 // -----------------------  new implementation of the jenkins hash function -----------------------
@@ -4,9 +4,17 @@ import (
 	"bytes"
 	"crypto/rand"
 	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"syndrdb/src/protocol"
 	"time"
 )
 
+// newIndexSeed seeds the hash function of a new index. Crash torture rounds replace it, so
+// that a round builds the same pages every time it runs.
+var newIndexSeed = generateSeed
+
 func generateSeed() uint32 {
 	var seedBytes [4]byte
 	_, err := rand.Read(seedBytes[:])
@@ -20,11 +28,24 @@ func generateSeed() uint32 {
 		uint32(seedBytes[3])<<24
 }
 
-// Insert adds a key to the hash index
+// Insert adds a key to the hash index and commits it, see hash_wal.go
 func (hi *HashIndex) Insert(key []byte, docID string, tid uint64) error {
 	hi.Lock()
 	defer hi.Unlock()
 
+	if err := hi.insert(key, docID, tid); err != nil {
+		return err
+	}
+	return hi.commit()
+}
+
+// insert adds a key to the current commit. A failure once pages have changed leaves the
+// commit half made, so the index takes no more changes.
+func (hi *HashIndex) insert(key []byte, docID string, tid uint64) error {
+	if hi.broken != nil {
+		return hi.broken
+	}
+
 	// Compute hash value
 	//hashValue := hashKey(key)
 
@@ -39,26 +60,13 @@ func (hi *HashIndex) Insert(key []byte, docID string, tid uint64) error {
 		return fmt.Errorf("failed to read bucket page: %w", err)
 	}
 
-	// Check if key already exists (for uniqueness)
-	if hi.metadata.IsUnique {
-		existingPage := bucketPage
-		for {
-			for _, item := range existingPage.Items {
-				if bytes.Equal(item.Key, key) {
-					return fmt.Errorf("duplicate key detected in unique index")
-				}
-			}
-
-			// Check overflow pages
-			if existingPage.NextPage == 0 {
-				break
-			}
-
-			existingPage, err = hi.readPage(existingPage.NextPage)
-			if err != nil {
-				return fmt.Errorf("failed to read overflow page: %w", err)
-			}
-		}
+	// Check if the key already exists, for uniqueness and the count of distinct keys
+	seen, err := hi.chainHasKey(bucketPage, key)
+	if err != nil {
+		return err
+	}
+	if seen && hi.metadata.IsUnique {
+		return protocol.Errorf(protocol.ErrUniqueViolation, "duplicate key detected in unique index")
 	}
 
 	// Create new index item
@@ -68,234 +76,264 @@ func (hi *HashIndex) Insert(key []byte, docID string, tid uint64) error {
 		DocID:     docID,
 		TID:       tid,
 	}
+	itemSize := hashItemSize(item)
+	if itemSize > HashPageSize-hashPageHeaderSize {
+		return fmt.Errorf("key of %d bytes does not fit in a hash index page", len(key))
+	}
 
-	// Calculate item size (approximate)
-	itemSize := 12 + len(key) + len(docID) // header + key + docID
-
-	// Check if item fits in the current bucket page
-	if int(bucketPage.FreeSpace) < itemSize {
-		// Need to use or create an overflow page
-		if bucketPage.NextPage == 0 {
-			// Create a new overflow page
-			overflowPageNum := hi.allocateNewPage()
-			overflowPage := &HashIndexPage{
-				PageType:  HashOverflowPage,
-				PageNum:   overflowPageNum,
-				NextPage:  0,
-				ItemCount: 0,
-				FreeSpace: HashPageSize - 32, // Approximate header size
-				Items:     make([]HashIndexItem, 0),
-			}
-
-			// Link it to the bucket
-			bucketPage.NextPage = overflowPageNum
-
-			// Write the updated bucket page
-			if err := hi.writePage(bucketNum, bucketPage); err != nil {
-				return fmt.Errorf("failed to update bucket page: %w", err)
-			}
-
-			// Add item to the overflow page
-			overflowPage.Items = append(overflowPage.Items, item)
-			overflowPage.ItemCount++
-			overflowPage.FreeSpace -= uint16(itemSize)
-
-			// Write the overflow page
-			if err := hi.writePage(overflowPageNum, overflowPage); err != nil {
-				return fmt.Errorf("failed to write overflow page: %w", err)
-			}
-
-			hi.metadata.OverflowPages++
-		} else {
-			// Use existing overflow chain
-			// Find the last page with enough space
-			currentPageNum := bucketPage.NextPage
-			for {
-				currentPage, err := hi.readPage(currentPageNum)
-				if err != nil {
-					return fmt.Errorf("failed to read overflow page: %w", err)
-				}
-
-				// If this page has enough space or is the last page
-				if int(currentPage.FreeSpace) >= itemSize || currentPage.NextPage == 0 {
-					if int(currentPage.FreeSpace) >= itemSize {
-						// Add item to this page
-						currentPage.Items = append(currentPage.Items, item)
-						currentPage.ItemCount++
-						currentPage.FreeSpace -= uint16(itemSize)
-
-						// Write the updated page
-						if err := hi.writePage(currentPageNum, currentPage); err != nil {
-							return fmt.Errorf("failed to update overflow page: %w", err)
-						}
-					} else {
-						// Need another overflow page
-						overflowPageNum := hi.allocateNewPage()
-						overflowPage := &HashIndexPage{
-							PageType:  HashOverflowPage,
-							PageNum:   overflowPageNum,
-							NextPage:  0,
-							ItemCount: 1,
-							FreeSpace: HashPageSize - 32 - uint16(itemSize),
-							Items:     []HashIndexItem{item},
-						}
-
-						// Link it to the chain
-						currentPage.NextPage = overflowPageNum
-
-						// Write the updated pages
-						if err := hi.writePage(currentPageNum, currentPage); err != nil {
-							return fmt.Errorf("failed to update overflow page: %w", err)
-						}
-
-						if err := hi.writePage(overflowPageNum, overflowPage); err != nil {
-							return fmt.Errorf("failed to write new overflow page: %w", err)
-						}
-
-						hi.metadata.OverflowPages++
-					}
-					break
-				}
-
-				currentPageNum = currentPage.NextPage
-			}
-		}
-	} else {
-		// Add item to the bucket page
-		bucketPage.Items = append(bucketPage.Items, item)
-		bucketPage.ItemCount++
-		bucketPage.FreeSpace -= uint16(itemSize)
-
-		// Write the updated page
-		if err := hi.writePage(bucketNum, bucketPage); err != nil {
-			return fmt.Errorf("failed to update bucket page: %w", err)
-		}
+	if err := hi.appendItem(bucketNum, item); err != nil {
+		hi.broken = err
+		return err
 	}
 
 	// Update metadata
 	hi.metadata.NumTuples++
+	if !seen {
+		hi.metadata.Keys++
+	}
+	hi.metadata.ItemBytes += uint64(itemSize)
 	hi.dirty = true
 
-	// Check if we need to split a bucket
-	fillPercentage := (float64(hi.metadata.NumTuples) / float64(hi.metadata.MaxBucket+1)) /
-		(float64(HashPageSize) * float64(hi.metadata.FillFactor) / 100.0)
-
-	if fillPercentage > 1.0 {
-		return hi.splitBucket()
+	// Split the next bucket once the entries fill more of the buckets' pages than FillFactor
+	if hi.load() > float64(hi.metadata.FillFactor) {
+		if err := hi.splitBucket(); err != nil {
+			hi.broken = err
+			return err
+		}
 	}
 
 	return nil
 }
 
-// allocateNewPage finds the next available page number
-func (hi *HashIndex) allocateNewPage() uint32 {
-	// Simple implementation: just return the next page number
-	// In a real implementation, you'd track free/used pages
-	return uint32(hi.metadata.MaxBucket + hi.metadata.OverflowPages + 2) // +2 because page 0 is meta, and bucket pages start at 1
+// Delete removes the entry of a document under a key and commits it, see hash_wal.go
+func (hi *HashIndex) Delete(key []byte, docID string) error {
+	hi.Lock()
+	defer hi.Unlock()
+
+	if err := hi.delete(key, docID); err != nil {
+		return err
+	}
+	return hi.commit()
 }
 
-// splitBucket implements the linear hashing bucket split algorithm
-func (hi *HashIndex) splitBucket() error {
-	// Determine which bucket to split (round-robin)
-	splitBucket := uint32(0)
-	if hi.metadata.LowMask > 0 {
-		// After first round of splits
-		splitBucket = hi.metadata.MaxBucket + 1 - hi.metadata.HighMask
+// delete removes the entry of a document under a key from the current commit; there is none to
+// remove when the document did not hold the key. Buckets are never merged back: a page emptied
+// stays in its chain and takes the next entries of its bucket.
+func (hi *HashIndex) delete(key []byte, docID string) error {
+	if hi.broken != nil {
+		return hi.broken
 	}
 
-	hi.logger.Infof("Splitting bucket %d", splitBucket)
+	bucketNum := hi.computeBucket(jenkinsHash(key, hi.metadata.Seed))
+	pageNum := bucketNum
+	for pageNum != 0 {
+		page, err := hi.readPage(pageNum)
+		if err != nil {
+			return fmt.Errorf("failed to read bucket page: %w", err)
+		}
+		for i, item := range page.Items {
+			if item.DocID != docID || !bytes.Equal(item.Key, key) {
+				continue
+			}
+			page.Items = append(page.Items[:i:i], page.Items[i+1:]...)
+			page.ItemCount--
+			page.FreeSpace += uint16(hashItemSize(item))
+			if err := hi.writePage(pageNum, page); err != nil {
+				hi.broken = err
+				return fmt.Errorf("failed to update page: %w", err)
+			}
 
-	// Create a new bucket
-	newBucketNum := hi.metadata.MaxBucket + 1
-	newBucketPage := &HashIndexPage{
-		PageType:  HashBucketPage,
-		PageNum:   newBucketNum + 1, // Convert to 1-based page numbers
-		ItemCount: 0,
-		FreeSpace: HashPageSize - 32,
-		Items:     make([]HashIndexItem, 0),
+			hi.metadata.NumTuples--
+			hi.metadata.ItemBytes -= uint64(hashItemSize(item))
+			bucketPage, err := hi.readPage(bucketNum)
+			if err != nil {
+				hi.broken = err
+				return fmt.Errorf("failed to read bucket page: %w", err)
+			}
+			if remaining, err := hi.chainHasKey(bucketPage, key); err != nil {
+				hi.broken = err
+				return err
+			} else if !remaining {
+				hi.metadata.Keys--
+			}
+			hi.dirty = true
+			return nil
+		}
+		pageNum = page.NextPage
 	}
+	return nil
+}
 
-	// Read the bucket being split
-	splitBucketPage, err := hi.readPage(splitBucket + 1) // Convert to 1-based
-	if err != nil {
-		return fmt.Errorf("failed to read split bucket: %w", err)
+// chainHasKey reports whether a bucket's chain, starting at its page, holds an entry under key
+func (hi *HashIndex) chainHasKey(page *HashIndexPage, key []byte) (bool, error) {
+	for {
+		for _, item := range page.Items {
+			if bytes.Equal(item.Key, key) {
+				return true, nil
+			}
+		}
+		if page.NextPage == 0 {
+			return false, nil
+		}
+		var err error
+		if page, err = hi.readPage(page.NextPage); err != nil {
+			return false, fmt.Errorf("failed to read overflow page: %w", err)
+		}
 	}
+}
 
-	// Collect all items from the bucket and its overflow chain
-	var allItems []HashIndexItem
-	currentPage := splitBucketPage
-	for {
-		allItems = append(allItems, currentPage.Items...)
+// hashItemSize is the space an item takes in a page, as serializeHashPage writes it
+func hashItemSize(item HashIndexItem) int {
+	return 20 + len(item.Key) + len(item.DocID) // hash, key length, DocID length, TID
+}
 
-		if currentPage.NextPage == 0 {
-			break
-		}
+// load is the percentage of the bucket pages' space the entries take, on average
+func (hi *HashIndex) load() float64 {
+	capacity := float64(hi.metadata.MaxBucket+1) * float64(HashPageSize-hashPageHeaderSize)
+	return float64(hi.metadata.ItemBytes) * 100 / capacity
+}
 
-		currentPage, err = hi.readPage(currentPage.NextPage)
-		if err != nil {
+// appendItem adds an item to the first page of a bucket's chain with room for it, adding an
+// overflow page to the end of the chain when none has
+func (hi *HashIndex) appendItem(bucketPageNum uint32, item HashIndexItem) error {
+	itemSize := hashItemSize(item)
+	pageNum := bucketPageNum
+	page, err := hi.readPage(pageNum)
+	if err != nil {
+		return fmt.Errorf("failed to read bucket page: %w", err)
+	}
+	for int(page.FreeSpace) < itemSize && page.NextPage != 0 {
+		pageNum = page.NextPage
+		if page, err = hi.readPage(pageNum); err != nil {
 			return fmt.Errorf("failed to read overflow page: %w", err)
 		}
 	}
 
-	// Reset the split bucket
-	splitBucketPage.Items = make([]HashIndexItem, 0)
-	splitBucketPage.ItemCount = 0
-	splitBucketPage.FreeSpace = HashPageSize - 32
-	splitBucketPage.NextPage = 0
+	if int(page.FreeSpace) >= itemSize {
+		page.Items = append(page.Items, item)
+		page.ItemCount++
+		page.FreeSpace -= uint16(itemSize)
+		if err := hi.writePage(pageNum, page); err != nil {
+			return fmt.Errorf("failed to update page: %w", err)
+		}
+		return nil
+	}
 
-	// Write the empty bucket
-	if err := hi.writePage(splitBucket+1, splitBucketPage); err != nil {
-		return fmt.Errorf("failed to write reset bucket: %w", err)
+	// Need another overflow page
+	overflowPageNum := hi.allocateNewPage()
+	overflowPage := &HashIndexPage{
+		PageType:  HashOverflowPage,
+		PageNum:   overflowPageNum,
+		NextPage:  0,
+		ItemCount: 1,
+		FreeSpace: uint16(HashPageSize - hashPageHeaderSize - itemSize),
+		Items:     []HashIndexItem{item},
+	}
+	if err := hi.writePage(overflowPageNum, overflowPage); err != nil {
+		return fmt.Errorf("failed to write overflow page: %w", err)
 	}
 
-	// Delete all overflow pages (in a full implementation, we will recycle these)
-	// For this example, we'll just "forget" them
+	// Link it to the chain
+	page.NextPage = overflowPageNum
+	if err := hi.writePage(pageNum, page); err != nil {
+		return fmt.Errorf("failed to update page: %w", err)
+	}
 
-	// Write the new bucket
-	if err := hi.writePage(newBucketNum+1, newBucketPage); err != nil {
-		return fmt.Errorf("failed to write new bucket: %w", err)
+	hi.metadata.OverflowPages++
+	return nil
+}
+
+// allocateNewPage returns a page for an overflow page: one a split emptied, or a new one past
+// every page allocated so far
+func (hi *HashIndex) allocateNewPage() uint32 {
+	if n := len(hi.freePages); n > 0 {
+		pageNum := hi.freePages[n-1]
+		hi.freePages = hi.freePages[:n-1]
+		return pageNum
 	}
+	hi.metadata.LastPage++
+	return hi.metadata.LastPage
+}
 
-	// Update metadata for the split
-	oldMaxBucket := hi.metadata.MaxBucket
-	hi.metadata.MaxBucket = newBucketNum
+// bucketPage returns the page of a bucket. The first InitialBucketCount buckets follow the
+// meta page; the buckets each doubling adds take a run of pages reserved when the doubling
+// began, starting at its split point, so overflow pages never stand in the way of a bucket.
+func (hi *HashIndex) bucketPage(bucket uint32) uint32 {
+	if bucket < InitialBucketCount {
+		return bucket + 1
+	}
+	doubling := bits.Len32(bucket) - bits.Len32(InitialBucketCount)
+	first := uint32(InitialBucketCount) << doubling
+	return hi.metadata.SplitPoints[doubling] + bucket - first
+}
 
-	// Update masks based on PostgreSQL's linear hashing algorithm
-	if (oldMaxBucket + 1) >= (hi.metadata.HighMask + 1) {
-		// We've completed a round of splits, double the high mask
-		hi.metadata.HighMask = 2*hi.metadata.HighMask + 1
-		hi.metadata.LowMask = 0
-	} else {
-		// Still in the middle of a round
-		hi.metadata.LowMask = hi.metadata.LowMask + 1
+// splitBucket implements the linear hashing bucket split algorithm: the buckets are split in
+// turn, and each split moves the entries of one bucket whose next hash bit is set to a new
+// bucket at the end, so the table grows by one bucket at a time
+func (hi *HashIndex) splitBucket() error {
+	newBucket := hi.metadata.MaxBucket + 1
+	oldBucket := newBucket & hi.metadata.LowMask
+	if newBucket > hi.metadata.HighMask {
+		// A round of splits is done; the next one doubles the buckets again
+		hi.metadata.LowMask = hi.metadata.HighMask
+		hi.metadata.HighMask = newBucket | hi.metadata.LowMask
+	}
+	if doubling := bits.Len32(newBucket) - bits.Len32(InitialBucketCount); doubling == len(hi.metadata.SplitPoints) {
+		// The first bucket of a doubling reserves pages for all of them
+		hi.metadata.SplitPoints = append(hi.metadata.SplitPoints, hi.metadata.LastPage+1)
+		hi.metadata.LastPage += newBucket
 	}
 
-	// Redistribute items between the split and new buckets
-	for _, item := range allItems {
-		bucketNum := hi.computeBucket(item.HashValue)
-		targetPage, err := hi.readPage(bucketNum)
+	hi.logger.Debugf("Splitting bucket %d into bucket %d", oldBucket, newBucket)
+
+	// Collect all items from the bucket and its overflow chain, freeing the overflow pages
+	oldPageNum := hi.bucketPage(oldBucket)
+	oldPage, err := hi.readPage(oldPageNum)
+	if err != nil {
+		return fmt.Errorf("failed to read split bucket: %w", err)
+	}
+	allItems := oldPage.Items
+	for nextPage := oldPage.NextPage; nextPage != 0; {
+		overflowPage, err := hi.readPage(nextPage)
 		if err != nil {
-			return fmt.Errorf("failed to read target bucket: %w", err)
+			return fmt.Errorf("failed to read overflow page: %w", err)
 		}
+		allItems = append(allItems, overflowPage.Items...)
+		hi.freePages = append(hi.freePages, nextPage)
+		hi.metadata.OverflowPages--
+		nextPage = overflowPage.NextPage
+	}
 
-		// Insert the item (simplified - doesn't handle overflow during redistribution)
-		targetPage.Items = append(targetPage.Items, item)
-		targetPage.ItemCount++
+	// Empty the split bucket and create the new one
+	hi.metadata.MaxBucket = newBucket
+	for _, pageNum := range []uint32{oldPageNum, hi.bucketPage(newBucket)} {
+		emptyPage := &HashIndexPage{
+			PageType:  HashBucketPage,
+			ItemCount: 0,
+			FreeSpace: HashPageSize - hashPageHeaderSize,
+			Items:     make([]HashIndexItem, 0),
+		}
+		if err := hi.writePage(pageNum, emptyPage); err != nil {
+			return fmt.Errorf("failed to write bucket: %w", err)
+		}
+	}
 
-		// Write the updated page
-		if err := hi.writePage(bucketNum, targetPage); err != nil {
-			return fmt.Errorf("failed to update bucket during redistribution: %w", err)
+	// Redistribute items between the split and new buckets
+	for _, item := range allItems {
+		if err := hi.appendItem(hi.computeBucket(item.HashValue), item); err != nil {
+			return fmt.Errorf("failed to redistribute bucket: %w", err)
 		}
 	}
 
+	hi.metadata.Splits++
 	hi.dirty = true
 	return nil
 }
 
 // Find searches for a key in the hash index
 func (hi *HashIndex) Find(key []byte) (*IndexTuple, error) {
-	hi.RLock()
-	defer hi.RUnlock()
+	hi.Lock() // Reads fill the page cache
+	defer hi.Unlock()
 
 	// Compute hash value
 	//hashValue := hashKey(key)
@@ -338,16 +376,112 @@ func (hi *HashIndex) Find(key []byte) (*IndexTuple, error) {
 	return nil, nil
 }
 
-// ScanAll scans the entire hash index
-func (hi *HashIndex) ScanAll() ([]*IndexTuple, error) {
+// FindMany looks up several keys at once and returns every entry holding one of them.
+// Keys are grouped by bucket and the buckets read in page order, so a bucket and its
+// overflow pages are read once however many of the keys hash to it; a key given twice is
+// looked up once.
+func (hi *HashIndex) FindMany(keys [][]byte) ([]*IndexTuple, error) {
+	hi.Lock() // Reads fill the page cache
+	defer hi.Unlock()
+
+	wantedByBucket := make(map[uint32]map[string]bool)
+	var buckets []uint32
+	for _, key := range keys {
+		bucketNum := hi.computeBucket(jenkinsHash(key, hi.metadata.Seed))
+		wanted, exists := wantedByBucket[bucketNum]
+		if !exists {
+			wanted = make(map[string]bool)
+			wantedByBucket[bucketNum] = wanted
+			buckets = append(buckets, bucketNum)
+		}
+		wanted[string(key)] = true
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+
+	var tuples []*IndexTuple
+	for _, bucketNum := range buckets {
+		wanted := wantedByBucket[bucketNum]
+		currentPage, err := hi.readPage(bucketNum)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bucket page: %w", err)
+		}
+		for {
+			for _, item := range currentPage.Items {
+				if wanted[string(item.Key)] {
+					tuples = append(tuples, &IndexTuple{
+						Key:   item.Key,
+						DocID: item.DocID,
+						TID:   item.TID,
+					})
+				}
+			}
+			if currentPage.NextPage == 0 {
+				break
+			}
+			currentPage, err = hi.readPage(currentPage.NextPage)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read overflow page: %w", err)
+			}
+		}
+	}
+	return tuples, nil
+}
+
+// Counts returns how many entries and distinct keys the index holds, from its metadata
+func (hi *HashIndex) Counts() (entries, keys uint64) {
 	hi.RLock()
 	defer hi.RUnlock()
+	return hi.metadata.NumTuples, hi.metadata.Keys
+}
+
+// Stats walks the buckets of the index and their overflow chains
+func (hi *HashIndex) Stats() (HashIndexStats, error) {
+	hi.Lock() // Reads fill the page cache
+	defer hi.Unlock()
+
+	stats := HashIndexStats{
+		Entries:       hi.metadata.NumTuples,
+		Keys:          hi.metadata.Keys,
+		Buckets:       hi.metadata.MaxBucket + 1,
+		FillFactor:    hi.metadata.FillFactor,
+		Load:          math.Round(hi.load()*100) / 100,
+		Splits:        hi.metadata.Splits,
+		OverflowPages: hi.metadata.OverflowPages,
+	}
+	for bucket := uint32(0); bucket <= hi.metadata.MaxBucket; bucket++ {
+		page, err := hi.readPage(hi.bucketPage(bucket))
+		if err != nil {
+			return stats, fmt.Errorf("failed to read bucket page: %w", err)
+		}
+		chain := 0
+		for page.NextPage != 0 {
+			if page, err = hi.readPage(page.NextPage); err != nil {
+				return stats, fmt.Errorf("failed to read overflow page: %w", err)
+			}
+			chain++
+		}
+		for len(stats.ChainLengths) <= chain {
+			stats.ChainLengths = append(stats.ChainLengths, 0)
+		}
+		stats.ChainLengths[chain]++
+		if chain > stats.LongestChain {
+			stats.LongestChain = chain
+		}
+	}
+	stats.AverageChain = math.Round(float64(stats.OverflowPages)/float64(stats.Buckets)*100) / 100
+	return stats, nil
+}
+
+// ScanAll scans the entire hash index
+func (hi *HashIndex) ScanAll() ([]*IndexTuple, error) {
+	hi.Lock() // Reads fill the page cache
+	defer hi.Unlock()
 
 	var results []*IndexTuple
 
 	// Scan all buckets
-	for bucketNum := uint32(1); bucketNum <= hi.metadata.MaxBucket+1; bucketNum++ {
-		bucketPage, err := hi.readPage(bucketNum)
+	for bucket := uint32(0); bucket <= hi.metadata.MaxBucket; bucket++ {
+		bucketPage, err := hi.readPage(hi.bucketPage(bucket))
 		if err != nil {
 			return nil, fmt.Errorf("failed to read bucket page: %w", err)
 		}
@@ -6,15 +6,22 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// encodeFieldValue encodes a field value into a byte slice optimized for hash indexing
+// encodeFieldValue encodes a field value into a byte slice optimized for hash indexing. Values
+// WHERE equality compares as numbers (numbers of any Go type, and strings holding one) are
+// encoded as the same float64, so a document stored with an int32 is found by a lookup for 5.
 func encodeFieldValue(value interface{}, indexField IndexField) ([]byte, string, error) {
 	var buffer bytes.Buffer
 	var keyString string
 
+	if number, ok := keyNumber(value); ok {
+		value = number
+	}
+
 	switch v := value.(type) {
 	case string:
 		keyString = v
@@ -29,29 +36,19 @@ func encodeFieldValue(value interface{}, indexField IndexField) ([]byte, string,
 		// Write string directly (no length prefix needed for hash indexes)
 		buffer.Write([]byte(v))
 
-	case int:
-		keyString = fmt.Sprintf("%d", v)
-		buffer.WriteByte(2) // Type tag for integer
-
-		// Use fixed 8 bytes for all integers for consistent hashing
-		binary.Write(&buffer, binary.LittleEndian, int64(v))
-
-	case int64:
-		keyString = fmt.Sprintf("%d", v)
-		buffer.WriteByte(2) // Type tag for integer
-		binary.Write(&buffer, binary.LittleEndian, v)
-
 	case float64:
 		keyString = fmt.Sprintf("%g", v)
-		buffer.WriteByte(3) // Type tag for float
+		buffer.WriteByte(3) // Type tag for numbers
 
-		// Ensure NaN and Infinity are handled consistently
+		// Ensure NaN and Infinity are handled consistently, and -0 shares the key of 0
 		if math.IsNaN(v) {
 			binary.Write(&buffer, binary.LittleEndian, math.Float64bits(math.NaN()))
 		} else if math.IsInf(v, 1) {
 			binary.Write(&buffer, binary.LittleEndian, math.Float64bits(math.Inf(1)))
 		} else if math.IsInf(v, -1) {
 			binary.Write(&buffer, binary.LittleEndian, math.Float64bits(math.Inf(-1)))
+		} else if v == 0 {
+			binary.Write(&buffer, binary.LittleEndian, float64(0))
 		} else {
 			binary.Write(&buffer, binary.LittleEndian, v)
 		}
@@ -101,6 +98,24 @@ func encodeFieldValue(value interface{}, indexField IndexField) ([]byte, string,
 	return buffer.Bytes(), keyString, nil
 }
 
+// keyNumber returns the number a value is compared as by WHERE equality, if it is one
+func keyNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
 // objectToString converts a map to a deterministic string representation
 func objectToString(obj map[string]interface{}) string {
 	// Sort keys for deterministic output
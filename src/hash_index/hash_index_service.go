@@ -1,38 +1,182 @@
 package hashindex
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
-	"strings"
+	"sort"
+	"syndrdb/src/helpers"
 	"syndrdb/src/models"
+	"syndrdb/src/protocol"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-// NewHashService creates a new hash indexing service
-func NewHashService(dataDir string, maxMemorySize int64, logger *zap.SugaredLogger) *HashService {
+// NewHashService creates a new hash indexing service. Its indexes split a bucket once their
+// entries fill fillFactor percent of the buckets' pages; 0 takes DefaultFillFactor.
+func NewHashService(dataDir string, maxMemorySize int64, fillFactor uint32, logger *zap.SugaredLogger) *HashService {
+	if fillFactor == 0 {
+		fillFactor = DefaultFillFactor
+	}
 	return &HashService{
 		dataDir:       dataDir,
+		paths:         helpers.NewPathResolver(dataDir),
 		maxMemorySize: maxMemorySize,
+		fillFactor:    fillFactor,
 		logger:        logger,
+		open:          make(map[string]*HashIndex),
+	}
+}
+
+// index returns the open handle of an index, opening it on first use. Handles stay open so
+// that each write commits to the index's log without syncing the index file; Close closes them.
+func (hs *HashService) index(indexName string) (*HashIndex, error) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if index, exists := hs.open[indexName]; exists {
+		return index, nil
+	}
+	index, err := openHashIndex(hs.paths.HashIndexFile(indexName), 100, hs.logger) // Cache up to 100 pages
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hash index: %w", err)
+	}
+	hs.open[indexName] = index
+	return index, nil
+}
+
+// forget closes the open handle of an index, if it has one
+func (hs *HashService) forget(indexName string) {
+	hs.mu.Lock()
+	index, exists := hs.open[indexName]
+	delete(hs.open, indexName)
+	hs.mu.Unlock()
+
+	if exists {
+		if err := index.Close(); err != nil {
+			hs.logger.Warnf("Failed to close hash index %s: %v", indexName, err)
+		}
+	}
+}
+
+// Close closes the indexes the service holds open, checkpointing each so its log can go
+func (hs *HashService) Close() error {
+	hs.mu.Lock()
+	open := hs.open
+	hs.open = make(map[string]*HashIndex)
+	hs.mu.Unlock()
+
+	var firstErr error
+	for name, index := range open {
+		if err := index.Close(); err != nil {
+			hs.logger.Warnf("Failed to close hash index %s: %v", name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// writeFailed stops an index taking changes after a failed write, closes it and marks its file
+// invalid, once what it logged is recovered, so that it is rebuilt before it is read again
+func (hs *HashService) writeFailed(indexName string, index *HashIndex, err error) error {
+	index.Lock()
+	if index.broken == nil {
+		index.broken = err
+	}
+	index.Unlock()
+	hs.forget(indexName)
+
+	path := hs.paths.HashIndexFile(indexName)
+	if _, recoverErr := recoverHashIndex(path, hs.logger); recoverErr != nil {
+		hs.logger.Errorf("Failed to recover hash index %s after a failed write: %v", indexName, recoverErr)
+	}
+	file, openErr := os.OpenFile(path, os.O_RDWR, 0644)
+	if openErr == nil {
+		openErr = markHashIndexInvalid(file, hashWriteUnfinished)
+		file.Close()
 	}
+	if openErr != nil {
+		hs.logger.Errorf("Failed to mark hash index %s invalid after a failed write: %v", indexName, openErr)
+	}
+	return err
 }
 
-// CreateHashIndex creates a new hash index for the specified field
-func (hs *HashService) CreateHashIndex(bundle *models.Bundle, indexField IndexField) (string, error) {
+// MarkHashIndexChanging marks an index invalid, durably, before a write to its bundle. The
+// write's UpdateHashIndex clears the mark; a server that stops in between rebuilds the index
+// at startup.
+func (hs *HashService) MarkHashIndexChanging(indexName string) error {
+	index, err := hs.index(indexName)
+	if err != nil {
+		return err
+	}
+
+	index.Lock()
+	index.metadata.Invalid = hashWriteUnfinished
+	index.dirty = true
+	err = index.commit()
+	index.Unlock()
+	if err != nil {
+		return hs.writeFailed(indexName, index, fmt.Errorf("failed to mark hash index: %w", err))
+	}
+	return nil
+}
+
+// UpdateHashIndex applies a write to an index in one commit: the entries of removed go, those
+// of added come in and the mark of MarkHashIndexChanging is cleared. Values that cannot be
+// encoded are left out, as they are when the index is built. An index that fails to take the
+// write is left invalid.
+func (hs *HashService) UpdateHashIndex(indexName string, indexField IndexField, removed, added []IndexEntry) error {
+	index, err := hs.index(indexName)
+	if err != nil {
+		return err
+	}
+
+	index.Lock()
+	err = func() error {
+		for _, entry := range removed {
+			if key, _, err := encodeFieldValue(entry.Value, indexField); err == nil {
+				if err := index.delete(key, entry.DocID); err != nil {
+					return err
+				}
+			}
+		}
+		for _, entry := range added {
+			if key, _, err := encodeFieldValue(entry.Value, indexField); err == nil {
+				if err := index.insert(key, entry.DocID, 0); err != nil {
+					return err
+				}
+			}
+		}
+		index.metadata.Invalid = ""
+		index.dirty = true
+		return index.commit()
+	}()
+	index.Unlock()
+	if err != nil {
+		return hs.writeFailed(indexName, index, fmt.Errorf("failed to update hash index: %w", err))
+	}
+	return nil
+}
+
+// CreateHashIndex creates a new hash index for the specified field. A canceled ctx stops the
+// build between batches and removes the files written so far.
+func (hs *HashService) CreateHashIndex(ctx context.Context, bundle *models.Bundle, indexField IndexField) (string, error) {
 	// Generate a unique index name
-	indexName := fmt.Sprintf("%s_%s_hidx", bundle.BundleID, indexField.FieldName)
-	indexName = cleanFileName(indexName)
+	indexName := helpers.HashIndexName(bundle.BundleID, indexField.FieldName)
 
 	hs.logger.Infof("Creating hash index %s on field %s", indexName, indexField.FieldName)
+	hs.forget(indexName)
 
-	// Create the index file
-	indexPath := filepath.Join(hs.dataDir, indexName+".hidx")
-	index, err := createEmptyHashIndex(indexPath, indexField, DefaultFillFactor, hs.logger)
+	// Create the index file, marked invalid until every entry is in. A log left behind by an
+	// index of the same name must not be replayed over it.
+	indexPath := hs.paths.HashIndexFile(indexName)
+	helpers.Remove(indexPath + hashWALExt)
+	index, err := createEmptyHashIndex(indexPath, indexField, hs.fillFactor, hs.logger)
 	if err != nil {
 		return "", fmt.Errorf("failed to create hash index file: %w", err)
 	}
@@ -41,38 +185,49 @@ func (hs *HashService) CreateHashIndex(bundle *models.Bundle, indexField IndexFi
 	tuples, err := hs.scanBundleForHashIndex(bundle, indexField)
 	if err != nil {
 		index.Close()
-		os.Remove(indexPath)
+		removeHashIndexFiles(indexPath)
 		return "", fmt.Errorf("failed to scan bundle: %w", err)
 	}
 
-	// Insert all tuples into the hash index
-	for _, tuple := range tuples {
-		if err := index.Insert(tuple.Key, tuple.DocID, tuple.TID); err != nil {
+	// Insert all tuples into the hash index, a batch per commit
+	for i, tuple := range tuples {
+		err := index.insert(tuple.Key, tuple.DocID, tuple.TID)
+		if err == nil && (i+1)%hashBuildBatch == 0 {
+			err = index.commit()
+		}
+		if err != nil {
 			index.Close()
+			removeHashIndexFiles(indexPath)
 			return "", fmt.Errorf("failed to insert tuple: %w", err)
 		}
+		if (i+1)%hashBuildBatch == 0 && ctx.Err() != nil {
+			index.Close()
+			removeHashIndexFiles(indexPath)
+			return "", ctx.Err()
+		}
 	}
 
 	// Close and finalize the index
+	index.metadata.Invalid = ""
+	index.dirty = true
+	buckets, splits, overflowPages := index.metadata.MaxBucket+1, index.metadata.Splits, index.metadata.OverflowPages
 	if err := index.Close(); err != nil {
+		removeHashIndexFiles(indexPath)
 		return "", fmt.Errorf("failed to close index: %w", err)
 	}
 
-	hs.logger.Infof("Successfully created hash index %s with %d entries",
-		indexName, len(tuples))
+	hs.logger.Infof("Successfully created hash index %s with %d entries in %d buckets (%d splits, %d overflow pages)",
+		indexName, len(tuples), buckets, splits, overflowPages)
 
 	return indexName, nil
 }
 
 // SearchHashIndex searches the hash index for a document with the given key
 func (hs *HashService) SearchHashIndex(indexName string, key interface{}, indexField IndexField) (string, error) {
-	// Open the index file
-	indexPath := filepath.Join(hs.dataDir, indexName+".hidx")
-	index, err := openHashIndex(indexPath, 100, hs.logger) // Cache up to 100 pages
+	index, err := hs.index(indexName)
 	if err != nil {
-		return "", fmt.Errorf("failed to open hash index: %w", err)
+		return "", err
 	}
-	defer index.Close()
 
 	// Encode key in the same format used for indexing
 	encodedKey, _, err := encodeFieldValue(key, indexField)
@@ -93,19 +248,69 @@ func (hs *HashService) SearchHashIndex(indexName string, key interface{}, indexF
 	return result.DocID, nil
 }
 
+// SearchHashIndexMany searches the hash index for the documents holding any of keys, reading
+// each bucket once (see HashIndex.FindMany). The DocIDs are unique but in no particular order.
+func (hs *HashService) SearchHashIndexMany(indexName string, keys []interface{}, indexField IndexField) ([]string, error) {
+	index, err := hs.index(indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedKeys := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		encodedKey, _, err := encodeFieldValue(key, indexField)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode key: %w", err)
+		}
+		encodedKeys = append(encodedKeys, encodedKey)
+	}
+
+	tuples, err := index.FindMany(encodedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("hash index search failed: %w", err)
+	}
+
+	docIDs := make([]string, 0, len(tuples))
+	seen := make(map[string]bool, len(tuples))
+	for _, tuple := range tuples {
+		if !seen[tuple.DocID] {
+			seen[tuple.DocID] = true
+			docIDs = append(docIDs, tuple.DocID)
+		}
+	}
+	return docIDs, nil
+}
+
+// HashIndexStats reads how full a hash index is and how its buckets have grown
+func (hs *HashService) HashIndexStats(indexName string) (HashIndexStats, error) {
+	index, err := hs.index(indexName)
+	if err != nil {
+		return HashIndexStats{}, err
+	}
+	return index.Stats()
+}
+
+// HashIndexCounts returns how many entries and distinct keys a hash index holds, without
+// reading its buckets
+func (hs *HashService) HashIndexCounts(indexName string) (entries, keys uint64, err error) {
+	index, err := hs.index(indexName)
+	if err != nil {
+		return 0, 0, err
+	}
+	entries, keys = index.Counts()
+	return entries, keys, nil
+}
+
 // ListHashIndexes lists all hash indexes for a bundle
 func (hs *HashService) ListHashIndexes(bundleID string) ([]string, error) {
-	pattern := filepath.Join(hs.dataDir, bundleID+"_*_hidx.hidx")
-	matches, err := filepath.Glob(pattern)
+	matches, err := hs.paths.HashIndexFiles(bundleID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list hash indexes: %w", err)
 	}
 
 	indexNames := make([]string, 0, len(matches))
 	for _, path := range matches {
-		name := filepath.Base(path)
-		name = name[:len(name)-5] // Remove ".hidx" extension
-		indexNames = append(indexNames, name)
+		indexNames = append(indexNames, helpers.IndexNameFromFile(path))
 	}
 
 	return indexNames, nil
@@ -113,90 +318,162 @@ func (hs *HashService) ListHashIndexes(bundleID string) ([]string, error) {
 
 // DropHashIndex removes a hash index
 func (hs *HashService) DropHashIndex(indexName string) error {
-	indexPath := filepath.Join(hs.dataDir, indexName+".hidx")
-	return os.Remove(indexPath)
+	hs.forget(indexName)
+	indexPath := hs.paths.HashIndexFile(indexName)
+	return removeHashIndexFiles(indexPath)
 }
 
-// openHashIndex opens an existing hash index
-func openHashIndex(path string, cacheSize int, logger *zap.SugaredLogger) (*HashIndex, error) {
-	// Open the file
-	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+// removeHashIndexFiles removes an index file and its log
+func removeHashIndexFiles(path string) error {
+	helpers.Remove(path + hashWALExt)
+	return helpers.Remove(path)
+}
+
+// VerifyHashIndexFile checks that a hash index file starts with a meta page whose metadata
+// decodes and that the index is not invalid (see ErrIndexInvalid), returning the indexed field
+func VerifyHashIndexFile(path string) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open hash index file: %w", err)
+		return "", fmt.Errorf("failed to open hash index file: %w", err)
 	}
+	defer file.Close()
 
-	// Create the index object
-	index := &HashIndex{
-		filePath:     path,
-		file:         file,
-		pageCache:    make(map[uint32]*HashIndexPage),
-		cacheSize:    0,
-		maxCacheSize: cacheSize,
-		logger:       logger,
+	metadata, err := readHashMetadata(file)
+	if err != nil {
+		return "", err
+	}
+	if metadata.IndexField == "" {
+		return "", fmt.Errorf("metadata does not name the indexed field")
 	}
+	if metadata.Invalid != "" {
+		return "", invalidIndexError(metadata.Invalid)
+	}
+	return metadata.IndexField, nil
+}
 
-	// Read the meta page
-	metaPage, err := index.readPage(0)
-	if err != nil {
-		file.Close()
+// readHashMetadata reads the metadata from the meta page, as metaPageImage lays it out
+func readHashMetadata(file *os.File) (*HashIndexMetadata, error) {
+	page := make([]byte, HashPageSize)
+	if _, err := file.ReadAt(page, 0); err != nil {
 		return nil, fmt.Errorf("failed to read meta page: %w", err)
 	}
-
-	// The meta page should have an entry with our metadata
-	if len(metaPage.Items) < 1 || !bytes.Equal(metaPage.Items[0].Key, []byte("metadata")) {
-		file.Close()
+	if binary.LittleEndian.Uint32(page[0:4]) != uint32(HashMetaPage) {
 		return nil, fmt.Errorf("invalid meta page format")
 	}
+	if _, ok := checkHashPage(page); !ok {
+		return nil, fmt.Errorf("meta page fails its checksum")
+	}
+	if version := binary.LittleEndian.Uint16(page[14:16]); version > FormatVersion {
+		return nil, protocol.Errorf(protocol.ErrNewerFormat, "hash index has format version %d; this server reads versions 1 to %d", version, FormatVersion)
+	}
 
-	// Read metadata marker
-	offset := int64(16) // Skip page header
+	// Header, then the write time, the METADATA marker and the metadata, each length-prefixed
+	offset := 16
+	var sections [3][]byte
+	for i := range sections {
+		if offset+4 > len(page) {
+			return nil, fmt.Errorf("meta page is truncated")
+		}
+		length := int(binary.LittleEndian.Uint32(page[offset : offset+4]))
+		offset += 4
+		if length > len(page)-offset {
+			return nil, fmt.Errorf("meta page is truncated")
+		}
+		sections[i] = page[offset : offset+length]
+		offset += length
+	}
+	if string(sections[1]) != "METADATA" {
+		return nil, fmt.Errorf("invalid metadata marker")
+	}
+
+	metadata, err := deserializeHashMetadata(sections[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize metadata: %w", err)
+	}
+	return metadata, nil
+}
 
-	// Read timestamp length and skip it
-	var timeLen uint32
-	timeData := make([]byte, 4)
-	file.ReadAt(timeData, offset)
-	timeLen = binary.LittleEndian.Uint32(timeData)
-	offset += 4 + int64(timeLen)
+// HashIndexFileVersion returns the format version of a hash index file. Files from before
+// the version was recorded in the meta page are told apart by their metadata.
+func HashIndexFileVersion(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open hash index file: %w", err)
+	}
+	defer file.Close()
 
-	// Read marker
-	markerLenData := make([]byte, 4)
-	file.ReadAt(markerLenData, offset)
-	markerLen := binary.LittleEndian.Uint32(markerLenData)
-	offset += 4
+	header := make([]byte, 16)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return 0, fmt.Errorf("failed to read meta page: %w", err)
+	}
+	if version := binary.LittleEndian.Uint16(header[14:16]); version != 0 {
+		if version > FormatVersion {
+			return int(version), protocol.Errorf(protocol.ErrNewerFormat, "hash index has format version %d; this server reads versions 1 to %d", version, FormatVersion)
+		}
+		return int(version), nil
+	}
 
-	markerData := make([]byte, markerLen)
-	file.ReadAt(markerData, offset)
-	if string(markerData) != "METADATA" {
-		file.Close()
-		return nil, fmt.Errorf("invalid metadata marker")
+	metadata, err := readHashMetadata(file)
+	switch {
+	case errors.Is(err, ErrIndexInvalid):
+		return 1, nil
+	case err != nil:
+		return 0, err
+	case metadata.LSN == 0:
+		return 2, nil
+	}
+	return 3, nil
+}
+
+// UpgradeHashIndexFile brings a hash index file to FormatVersion and returns the version it
+// had. Keys written before version 4 cannot be told apart again, so versions 2 and 3 are marked
+// invalid and rebuilt with their bundle; version 1 already reads as invalid.
+func UpgradeHashIndexFile(path string) (int, error) {
+	version, err := HashIndexFileVersion(path)
+	if err != nil || version == 1 || version >= FormatVersion {
+		return version, err
 	}
-	offset += int64(markerLen)
 
-	// Read metadata length
-	metaLenData := make([]byte, 4)
-	file.ReadAt(metaLenData, offset)
-	metaLen := binary.LittleEndian.Uint32(metaLenData)
-	offset += 4
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return version, fmt.Errorf("failed to open hash index file: %w", err)
+	}
+	defer file.Close()
+	return version, markHashIndexInvalid(file, fmt.Sprintf("its keys were written in format version %d", version))
+}
 
-	// Read metadata
-	metaData := make([]byte, metaLen)
-	file.ReadAt(metaData, offset)
+// openHashIndex opens an existing hash index, recovering it first if a crash left it a log
+func openHashIndex(path string, cacheSize int, logger *zap.SugaredLogger) (*HashIndex, error) {
+	if _, err := recoverHashIndex(path, logger); err != nil {
+		return nil, fmt.Errorf("failed to recover hash index: %w", err)
+	}
 
-	// metadata, err := deserializeHashMetadata(metaData)
-	// if err != nil {
-	// 	file.Close()
-	// 	return nil, fmt.Errorf("failed to deserialize metadata: %w", err)
-	// }
+	// Open the file
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hash index file: %w", err)
+	}
 
-	metadata, err := deserializeHashMetadata(metaPage.Items[0].Value)
+	metadata, err := readHashMetadata(file)
 	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to deserialize metadata: %w", err)
+		return nil, err
+	}
+	if metadata.Invalid != "" {
+		file.Close()
+		return nil, invalidIndexError(metadata.Invalid)
 	}
 
-	index.metadata = *metadata
-
-	return index, nil
+	return &HashIndex{
+		filePath:     path,
+		file:         file,
+		metadata:     *metadata,
+		pageCache:    make(map[uint32]*HashIndexPage),
+		cacheSize:    0,
+		maxCacheSize: cacheSize,
+		logger:       logger,
+		pending:      make(map[uint32]*HashIndexPage),
+	}, nil
 }
 
 // scanBundleForHashIndex scans a bundle and extracts values for hash indexing
@@ -210,8 +487,15 @@ func (hs *HashService) scanBundleForHashIndex(bundle *models.Bundle, indexField
 		return nil, fmt.Errorf("field %s not defined in bundle structure", indexField.FieldName)
 	}
 
-	// Scan each document in the bundle
-	for docID, doc := range bundle.Documents {
+	// Scan each document in the bundle, in DocID order so that indexing the same documents
+	// again writes the same pages
+	docIDs := make([]string, 0, len(bundle.Documents))
+	for docID := range bundle.Documents {
+		docIDs = append(docIDs, docID)
+	}
+	sort.Strings(docIDs)
+	for _, docID := range docIDs {
+		doc := bundle.Documents[docID]
 		// Get the field from the document
 		field, exists := doc.Fields[indexField.FieldName]
 		if !exists {
@@ -262,34 +546,24 @@ func createEmptyHashIndex(filePath string, indexField IndexField, fillFactor uin
 		maxCacheSize: 100, // Cache up to 100 pages
 		logger:       logger,
 		dirty:        true,
+		pending:      make(map[uint32]*HashIndexPage),
 	}
 
 	// Initialize metadata
 	index.metadata = HashIndexMetadata{
 		MaxBucket:     InitialBucketCount - 1, // 0-based
-		HighMask:      0x3,                    // 11 in binary (for 4 buckets)
-		LowMask:       0,                      // Starts at 0
+		HighMask:      0x7,                    // 111 in binary: the buckets once the next round of splits is done
+		LowMask:       0x3,                    // 11 in binary: the 4 buckets before it
+		LastPage:      InitialBucketCount,     // The meta page, then the buckets
 		FillFactor:    fillFactor,
 		NumTuples:     0,
 		BitmapPages:   0,
 		OverflowPages: 0,
 		IndexField:    indexField.FieldName,
 		IsUnique:      indexField.IsUnique,
-		Seed:          generateSeed(), //Use cryptographic random seed
+		Seed:          newIndexSeed(), //Use cryptographic random seed
 		Created:       time.Now(),
-	}
-
-	// Create meta page
-	metaPage := &HashIndexPage{
-		PageType:  HashMetaPage,
-		PageNum:   0,
-		ItemCount: 0,
-	}
-
-	// Write metadata to the meta page
-	if err := index.writeMetaPage(metaPage); err != nil {
-		file.Close()
-		return nil, err
+		Invalid:       hashBuildUnfinished, // Until CreateHashIndex has inserted every entry
 	}
 
 	// Create initial bucket pages
@@ -298,7 +572,7 @@ func createEmptyHashIndex(filePath string, indexField IndexField, fillFactor uin
 			PageType:  HashBucketPage,
 			PageNum:   i + 1, // Page numbers start at 1 (0 is meta)
 			ItemCount: 0,
-			FreeSpace: HashPageSize - 32, // Approximate header size
+			FreeSpace: HashPageSize - hashPageHeaderSize,
 			Items:     make([]HashIndexItem, 0),
 		}
 
@@ -308,21 +582,20 @@ func createEmptyHashIndex(filePath string, indexField IndexField, fillFactor uin
 		}
 	}
 
+	// The meta page and the buckets make the first commit
+	if err := index.commit(); err != nil {
+		index.Close()
+		return nil, err
+	}
+
 	logger.Infof("Created empty hash index with %d initial buckets", InitialBucketCount)
 
 	return index, nil
 }
 
-// cleanFileName sanitizes a string for use as a filename
-func cleanFileName(name string) string {
-	// Replace characters that might be problematic in filenames
-	return strings.ReplaceAll(name, "-", "_")
-}
-
 /*
 Improvements to be made later:
 
-WAL logging - For crash recovery
 Better cache eviction - Full LRU implementation
 Concurrency control - Fine-grained locking
 Bitmap pages - For space management
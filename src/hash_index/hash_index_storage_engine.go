@@ -7,21 +7,28 @@ import (
 	"time"
 )
 
-// readPage reads a page from disk, using cache if available
+// readPage reads a page, as the current commit left it or from disk, using cache if available
 func (hi *HashIndex) readPage(pageNum uint32) (*HashIndexPage, error) {
+	if page, found := hi.pending[pageNum]; found {
+		return page, nil
+	}
+
 	// Check if page is in cache
 	if page, found := hi.pageCache[pageNum]; found {
 		return page, nil
 	}
 
 	// Calculate file offset
-	offset := int64(pageNum-1) * int64(HashPageSize)
+	offset := int64(pageNum) * int64(HashPageSize)
 
 	// Read the page data
 	pageData := make([]byte, HashPageSize)
 	if _, err := hi.file.ReadAt(pageData, offset); err != nil {
 		return nil, fmt.Errorf("failed to read page data: %w", err)
 	}
+	if _, ok := checkHashPage(pageData); !ok {
+		return nil, fmt.Errorf("page %d fails its checksum", pageNum)
+	}
 
 	// Parse the page
 	page, err := parseHashPage(pageData)
@@ -35,59 +42,34 @@ func (hi *HashIndex) readPage(pageNum uint32) (*HashIndexPage, error) {
 	return page, nil
 }
 
-// writePage writes a page to disk
+// writePage changes a page; it reaches the disk when the current commit ends (see commit)
 func (hi *HashIndex) writePage(pageNum uint32, page *HashIndexPage) error {
-	// Serialize the page
 	page.PageNum = pageNum
 	page.LastUpdated = time.Now()
 
-	pageData, err := serializeHashPage(page)
-	if err != nil {
-		return fmt.Errorf("failed to serialize page: %w", err)
-	}
-
-	// Calculate file offset
-	offset := int64(pageNum-1) * int64(HashPageSize)
-
-	// Write the page data
-	if _, err := hi.file.WriteAt(pageData, offset); err != nil {
-		return fmt.Errorf("failed to write page data: %w", err)
-	}
-
-	// Update cache
+	hi.pending[pageNum] = page
 	hi.addToCache(pageNum, page)
 
 	return nil
 }
 
-// writeMetaPage writes the metadata to page 0
-func (hi *HashIndex) writeMetaPage(page *HashIndexPage) error {
+// metaPageImage lays out the meta page holding the metadata
+func metaPageImage(metadata *HashIndexMetadata) ([]byte, error) {
 	// Serialize metadata
-	metadataBytes, err := serializeHashMetadata(&hi.metadata)
+	metadataBytes, err := serializeHashMetadata(metadata)
 	if err != nil {
-		return fmt.Errorf("failed to serialize metadata: %w", err)
-	}
-
-	// Create a meta page item to store metadata
-	metaItem := HashIndexItem{
-		HashValue: 0,
-		Key:       []byte("metadata"),
-		DocID:     "",
-		TID:       0,
+		return nil, fmt.Errorf("failed to serialize metadata: %w", err)
 	}
 
-	page.Items = []HashIndexItem{metaItem}
-	page.ItemCount = 1
-
 	// Serialize the page with a special marker for metadata
 	buffer := new(bytes.Buffer)
 
 	// Write standard page header
 	binary.Write(buffer, binary.LittleEndian, uint32(HashMetaPage))
-	binary.Write(buffer, binary.LittleEndian, uint32(0)) // Page 0
-	binary.Write(buffer, binary.LittleEndian, uint32(0)) // No next page
-	binary.Write(buffer, binary.LittleEndian, uint16(1)) // One item (metadata)
-	binary.Write(buffer, binary.LittleEndian, uint16(0)) // Free space not used for meta
+	binary.Write(buffer, binary.LittleEndian, uint32(0))             // Page 0
+	binary.Write(buffer, binary.LittleEndian, uint32(0))             // No next page
+	binary.Write(buffer, binary.LittleEndian, uint16(1))             // One item (metadata)
+	binary.Write(buffer, binary.LittleEndian, uint16(FormatVersion)) // Free space is unused in the meta page; it holds the format version
 
 	// Write current time
 	timeBytes, _ := time.Now().MarshalBinary()
@@ -103,45 +85,45 @@ func (hi *HashIndex) writeMetaPage(page *HashIndexPage) error {
 	binary.Write(buffer, binary.LittleEndian, uint32(len(metadataBytes)))
 	buffer.Write(metadataBytes)
 
-	// Pad to page size
-	if buffer.Len() < HashPageSize {
-		padding := make([]byte, HashPageSize-buffer.Len())
-		buffer.Write(padding)
-	}
-
-	// Write the meta page
-	if _, err := hi.file.WriteAt(buffer.Bytes(), 0); err != nil {
-		return fmt.Errorf("failed to write meta page: %w", err)
+	// Pad to page size, leaving the trailer free
+	if buffer.Len() > HashPageSize-hashPageTrailerSize {
+		return nil, fmt.Errorf("metadata exceeds the meta page: %d bytes", len(metadataBytes))
 	}
+	buffer.Write(make([]byte, HashPageSize-buffer.Len()))
 
-	hi.dirty = false
-	return nil
+	return buffer.Bytes(), nil
 }
 
-// Close flushes any pending changes and closes the index file
+// Close commits any pending changes, syncs the index file so its log can go, and closes it.
+// After a failed commit the log is kept for recovery instead.
 func (hi *HashIndex) Close() error {
 	hi.Lock()
 	defer hi.Unlock()
 
-	// Update metadata if dirty
-	if hi.dirty {
-		metaPage := &HashIndexPage{
-			PageType:  HashMetaPage,
-			PageNum:   0,
-			ItemCount: 0,
+	var err error
+	if hi.broken == nil {
+		if err = hi.commit(); err != nil {
+			hi.logger.Errorf("Failed to commit hash index during close: %v", err)
 		}
-
-		if err := hi.writeMetaPage(metaPage); err != nil {
-			hi.logger.Errorf("Failed to write meta page during close: %v", err)
+	}
+	if hi.wal != nil {
+		if hi.broken == nil {
+			if err = hi.checkpoint(); err == nil {
+				err = hi.wal.remove()
+			}
+		} else {
+			hi.wal.file.Close()
 		}
 	}
 
 	// Close the file
 	if hi.file != nil {
-		return hi.file.Close()
+		if closeErr := hi.file.Close(); err == nil {
+			err = closeErr
+		}
 	}
 
-	return nil
+	return err
 }
 
 // addToCache adds a page to the cache, evicting if necessary
@@ -297,13 +279,11 @@ func serializeHashPage(page *HashIndexPage) ([]byte, error) {
 		binary.Write(buffer, binary.LittleEndian, item.TID)
 	}
 
-	// Pad to page size
-	if buffer.Len() < HashPageSize {
-		padding := make([]byte, HashPageSize-buffer.Len())
-		buffer.Write(padding)
-	} else if buffer.Len() > HashPageSize {
-		return nil, fmt.Errorf("serialized page exceeds page size: %d > %d", buffer.Len(), HashPageSize)
+	// Pad to page size, leaving the trailer free
+	if buffer.Len() > HashPageSize-hashPageTrailerSize {
+		return nil, fmt.Errorf("serialized page exceeds page size: %d > %d", buffer.Len(), HashPageSize-hashPageTrailerSize)
 	}
+	buffer.Write(make([]byte, HashPageSize-buffer.Len()))
 
 	return buffer.Bytes(), nil
 }
@@ -341,6 +321,22 @@ func serializeHashMetadata(metadata *HashIndexMetadata) ([]byte, error) {
 	binary.Write(buffer, binary.LittleEndian, uint32(len(timeBytes)))
 	buffer.Write(timeBytes)
 
+	// Hashing and growth, after what earlier versions wrote
+	binary.Write(buffer, binary.LittleEndian, metadata.Seed)
+	binary.Write(buffer, binary.LittleEndian, metadata.Splits)
+	binary.Write(buffer, binary.LittleEndian, metadata.ItemBytes)
+	binary.Write(buffer, binary.LittleEndian, metadata.LastPage)
+	binary.Write(buffer, binary.LittleEndian, uint32(len(metadata.SplitPoints)))
+	binary.Write(buffer, binary.LittleEndian, metadata.SplitPoints)
+
+	// Crash safety, after what earlier versions wrote
+	binary.Write(buffer, binary.LittleEndian, metadata.LSN)
+	binary.Write(buffer, binary.LittleEndian, uint32(len(metadata.Invalid)))
+	buffer.WriteString(metadata.Invalid)
+
+	// Maintenance on writes, after what earlier versions wrote
+	binary.Write(buffer, binary.LittleEndian, metadata.Keys)
+
 	return buffer.Bytes(), nil
 }
 
@@ -379,5 +375,42 @@ func deserializeHashMetadata(data []byte) (*HashIndexMetadata, error) {
 
 	metadata.Created.UnmarshalBinary(timeBytes)
 
+	// Files from format version 1 end here, and laid their pages out differently
+	if reader.Len() == 0 {
+		return nil, invalidIndexError("it was written in format version 1, before bucket splits")
+	}
+	binary.Read(reader, binary.LittleEndian, &metadata.Seed)
+	binary.Read(reader, binary.LittleEndian, &metadata.Splits)
+	binary.Read(reader, binary.LittleEndian, &metadata.ItemBytes)
+	binary.Read(reader, binary.LittleEndian, &metadata.LastPage)
+	var splitPoints uint32
+	if err := binary.Read(reader, binary.LittleEndian, &splitPoints); err != nil {
+		return nil, fmt.Errorf("metadata is truncated: %w", err)
+	}
+	if int(splitPoints) > reader.Len()/4 {
+		return nil, fmt.Errorf("metadata is truncated")
+	}
+	metadata.SplitPoints = make([]uint32, splitPoints)
+	binary.Read(reader, binary.LittleEndian, metadata.SplitPoints)
+
+	// Files from before indexes had a log end here
+	if reader.Len() == 0 {
+		return &metadata, nil
+	}
+	binary.Read(reader, binary.LittleEndian, &metadata.LSN)
+	var invalidLen uint32
+	if err := binary.Read(reader, binary.LittleEndian, &invalidLen); err != nil {
+		return nil, fmt.Errorf("metadata is truncated: %w", err)
+	}
+	if int(invalidLen) > reader.Len() {
+		return nil, fmt.Errorf("metadata is truncated")
+	}
+	invalid := make([]byte, invalidLen)
+	reader.Read(invalid)
+	metadata.Invalid = string(invalid)
+
+	// Files from before indexes counted their distinct keys end here
+	binary.Read(reader, binary.LittleEndian, &metadata.Keys)
+
 	return &metadata, nil
 }
@@ -3,6 +3,7 @@ package hashindex
 import (
 	"os"
 	"sync"
+	"syndrdb/src/helpers"
 	"time"
 
 	"go.uber.org/zap"
@@ -10,10 +11,18 @@ import (
 
 // Constants for hash index
 const (
+	// FormatVersion is the layout of the index files written: 1 had no bucket split points,
+	// 2 no page LSNs and checksums, 3 keyed numbers by their Go type and counted no distinct
+	// keys. See HashIndexFileVersion.
+	FormatVersion = 4
+
 	HashPageSize      = 8192 // 8KB pages like PostgreSQL
+	MinFillFactor     = 10   // Minimum fill factor percentage
 	MaxFillFactor     = 90   // Maximum fill factor percentage
 	DefaultFillFactor = 75   // Default fill factor
 
+	hashPageHeaderSize = 64 // Page header, timestamp and trailer, rounded up
+
 	// Page types
 	HashMetaPage     = 0
 	HashBucketPage   = 1
@@ -36,6 +45,13 @@ type HashIndexMetadata struct {
 	IsUnique      bool      // Whether the index enforces uniqueness
 	Created       time.Time // When the index was created
 	Seed          uint32    // Seed for hash function (for linear hashing)
+	Splits        uint64    // Buckets split since the index was created
+	ItemBytes     uint64    // Page space the entries take, weighed against FillFactor
+	LastPage      uint32    // Highest page number allocated
+	SplitPoints   []uint32  // First page of the buckets each doubling added, see bucketPage
+	LSN           uint64    // Of the last commit, see hash_wal.go
+	Invalid       string    // Why the index has to be rebuilt; empty when it is sound
+	Keys          uint64    // Distinct keys among the entries
 }
 
 // HashIndexPage represents a page in the hash index file
@@ -68,14 +84,43 @@ type HashIndex struct {
 	cacheSize    int
 	maxCacheSize int
 	logger       *zap.SugaredLogger
-	dirty        bool // Whether metadata has been modified
+	dirty        bool                      // Whether metadata has been modified
+	freePages    []uint32                  // Overflow pages emptied by splits, reused before new ones; lost on close
+	pending      map[uint32]*HashIndexPage // Pages changed since the last commit
+	wal          *hashWAL                  // Opened by the first commit
+	broken       error                     // Why a commit failed; the index takes no more changes
 }
 
 // HashService manages hash index operations at the service level
 type HashService struct {
 	dataDir       string
+	paths         *helpers.PathResolver
 	maxMemorySize int64
+	fillFactor    uint32 // Of the indexes it creates
 	logger        *zap.SugaredLogger
+
+	mu   sync.Mutex
+	open map[string]*HashIndex // Indexes kept open between lookups and writes, by name
+}
+
+// IndexEntry is the value a document holds in an indexed field
+type IndexEntry struct {
+	DocID string
+	Value interface{}
+}
+
+// HashIndexStats describe how full a hash index is and how its buckets have grown
+type HashIndexStats struct {
+	Entries       uint64
+	Keys          uint64 // Distinct keys among the entries
+	Buckets       uint32
+	FillFactor    uint32   // Percent of the buckets' pages the entries may fill before a bucket is split
+	Load          float64  // Percent of the buckets' pages the entries fill
+	Splits        uint64   // Buckets split since the index was created
+	OverflowPages uint32   // Pages chained behind buckets whose own page is full
+	LongestChain  int      // Most overflow pages behind one bucket
+	AverageChain  float64  // Overflow pages per bucket
+	ChainLengths  []uint32 // Buckets by the number of overflow pages behind them: [0] have none, [1] one...
 }
 
 // IndexTuple represents a single entry in the index result set
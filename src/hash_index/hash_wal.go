@@ -0,0 +1,387 @@
+package hashindex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syndrdb/src/helpers"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Hash index write-ahead log.
+
+	A hash index file is changed a commit at a time: one Insert or Delete with the bucket splits
+	it causes, a batch of inserts while CreateHashIndex builds the index, or the entries a write
+	to the bundle removes and adds (see UpdateHashIndex). Pages changed by a commit are held back
+	until it ends. Then the full image of each, and of the meta page, is
+	appended to the index's log (the index file's name with ".wal" added) under the commit's log
+	sequence number (LSN), followed by a commit record, and the log is synced. Only then are the
+	pages written over the index file. Every page ends with a trailer holding the LSN of the
+	commit that last wrote it and a checksum of the page.
+
+	A crash may tear the pages a commit was writing, but their images are in the log: it is only
+	cleared once the index file has been synced (see checkpoint). Recovery, when the index is
+	next opened and for every index at startup (RecoverHashIndexes), writes back the committed
+	images newer than the pages on disk, drops a torn or uncommitted tail of the log and then
+	reads back every page. An index with a page that still fails its checksum is marked invalid,
+	as is one whose build never finished. A write to the bundle marks the index before it
+	changes any document and clears the mark with its entries, so an index whose bundle write a
+	crash cut short is left invalid too. An invalid index cannot be opened. CHECK DATABASE
+	reports it, and it is rebuilt from its bundle's documents at startup or by a repair.
+*/
+
+const (
+	hashWALExt          = ".wal"
+	hashBuildBatch      = 1024 // Inserts per commit while an index is built
+	hashPageTrailerSize = 12   // LSN and checksum at the end of every page
+
+	walPageRecord   = 1 // The image of a page
+	walCommitRecord = 2 // The end of a commit whose page images precede it
+
+	walRecordHeaderSize = 21 // Checksum, length, LSN, kind and page number
+
+	hashBuildUnfinished = "its build did not finish"
+	hashWriteUnfinished = "a write to its bundle did not finish"
+)
+
+// hashWALCheckpointSize is the log size after which a commit syncs the index file and clears
+// the log. Crash torture rounds lower it, to crash around checkpoints too.
+var hashWALCheckpointSize int64 = 16 << 20
+
+// ErrIndexInvalid is returned for a hash index whose build did not finish or that a crash left
+// damaged; it has to be rebuilt from its bundle
+var ErrIndexInvalid = errors.New("hash index is invalid")
+
+// invalidIndexError explains why an index is invalid
+func invalidIndexError(reason string) error {
+	return fmt.Errorf("%w: %s; it has to be rebuilt", ErrIndexInvalid, reason)
+}
+
+// sealHashPage stamps a serialized page with the LSN of the commit writing it and a checksum
+func sealHashPage(data []byte, lsn uint64) {
+	binary.LittleEndian.PutUint64(data[HashPageSize-hashPageTrailerSize:], lsn)
+	binary.LittleEndian.PutUint32(data[HashPageSize-4:], crc32.ChecksumIEEE(data[:HashPageSize-4]))
+}
+
+// checkHashPage returns the LSN a page was last written by, and whether its checksum holds.
+// Pages written before indexes had a log carry neither, and pass.
+func checkHashPage(data []byte) (uint64, bool) {
+	lsn := binary.LittleEndian.Uint64(data[HashPageSize-hashPageTrailerSize:])
+	checksum := binary.LittleEndian.Uint32(data[HashPageSize-4:])
+	if lsn == 0 && checksum == 0 {
+		return 0, true
+	}
+	return lsn, checksum == crc32.ChecksumIEEE(data[:HashPageSize-4])
+}
+
+// hashWAL is the log of one hash index file, opened by its first commit
+type hashWAL struct {
+	path string
+	file *os.File
+	size int64
+}
+
+// openHashWAL starts an empty log; recovery has consumed whatever an earlier one held
+func openHashWAL(path string) (*hashWAL, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index log: %w", err)
+	}
+	return &hashWAL{path: path, file: file}, nil
+}
+
+// appendWALRecord adds a record to a buffer of records for the log
+func appendWALRecord(buffer *bytes.Buffer, lsn uint64, kind byte, pageNum uint32, image []byte) {
+	var header [walRecordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(image)))
+	binary.LittleEndian.PutUint64(header[8:16], lsn)
+	header[16] = kind
+	binary.LittleEndian.PutUint32(header[17:21], pageNum)
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[4:])
+	checksum.Write(image)
+	binary.LittleEndian.PutUint32(header[0:4], checksum.Sum32())
+
+	buffer.Write(header[:])
+	buffer.Write(image)
+}
+
+// append writes records to the log and syncs it
+func (w *hashWAL) append(records []byte) error {
+	if _, err := helpers.Write(w.file, records); err != nil {
+		return fmt.Errorf("failed to write index log: %w", err)
+	}
+	if err := helpers.Sync(w.file); err != nil {
+		return fmt.Errorf("failed to sync index log: %w", err)
+	}
+	w.size += int64(len(records))
+	return nil
+}
+
+// clear empties the log
+func (w *hashWAL) clear() error {
+	if err := helpers.Truncate(w.file, 0); err != nil {
+		return fmt.Errorf("failed to clear index log: %w", err)
+	}
+	w.size = 0
+	return helpers.Sync(w.file)
+}
+
+// remove closes and deletes the log, which must have been cleared
+func (w *hashWAL) remove() error {
+	w.file.Close()
+	if err := helpers.Remove(w.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove index log: %w", err)
+	}
+	helpers.SyncDirectory(filepath.Dir(w.path))
+	return nil
+}
+
+// commit makes the pages changed since the last commit, and the metadata, durable: their
+// images are logged and the log synced before they are written over the index file. After a
+// failure the index takes no more changes; what was logged is recovered at the next open.
+func (hi *HashIndex) commit() error {
+	if hi.broken != nil {
+		return hi.broken
+	}
+	if len(hi.pending) == 0 && !hi.dirty {
+		return nil
+	}
+	if err := hi.logAndWrite(); err != nil {
+		hi.broken = err
+		return err
+	}
+	hi.pending = make(map[uint32]*HashIndexPage)
+	hi.dirty = false
+
+	if hi.wal.size >= hashWALCheckpointSize {
+		if err := hi.checkpoint(); err != nil {
+			hi.broken = err
+			return err
+		}
+	}
+	return nil
+}
+
+// logAndWrite logs the pending pages and the meta page under the next LSN, then writes them
+func (hi *HashIndex) logAndWrite() error {
+	lsn := hi.metadata.LSN + 1
+	hi.metadata.LSN = lsn
+
+	pageNums := make([]uint32, 0, len(hi.pending)+1)
+	for pageNum := range hi.pending {
+		pageNums = append(pageNums, pageNum)
+	}
+	sort.Slice(pageNums, func(i, j int) bool { return pageNums[i] < pageNums[j] })
+
+	images := make([][]byte, 0, len(pageNums)+1)
+	for _, pageNum := range pageNums {
+		image, err := serializeHashPage(hi.pending[pageNum])
+		if err != nil {
+			return fmt.Errorf("failed to serialize page %d: %w", pageNum, err)
+		}
+		images = append(images, image)
+	}
+	meta, err := metaPageImage(&hi.metadata)
+	if err != nil {
+		return err
+	}
+	pageNums = append(pageNums, 0)
+	images = append(images, meta)
+
+	records := new(bytes.Buffer)
+	for i, image := range images {
+		sealHashPage(image, lsn)
+		appendWALRecord(records, lsn, walPageRecord, pageNums[i], image)
+	}
+	appendWALRecord(records, lsn, walCommitRecord, 0, nil)
+
+	if hi.wal == nil {
+		if hi.wal, err = openHashWAL(hi.filePath + hashWALExt); err != nil {
+			return err
+		}
+	}
+	if err := hi.wal.append(records.Bytes()); err != nil {
+		return err
+	}
+
+	for i, pageNum := range pageNums {
+		if _, err := helpers.WriteAt(hi.file, images[i], int64(pageNum)*HashPageSize); err != nil {
+			return fmt.Errorf("failed to write page %d: %w", pageNum, err)
+		}
+	}
+	return nil
+}
+
+// checkpoint syncs the index file, after which its log is no longer needed to recover it
+func (hi *HashIndex) checkpoint() error {
+	if err := helpers.Sync(hi.file); err != nil {
+		return fmt.Errorf("failed to sync index file: %w", err)
+	}
+	return hi.wal.clear()
+}
+
+// walImage is a committed page image read back from a log
+type walImage struct {
+	lsn   uint64
+	image []byte
+}
+
+// readHashWAL returns the latest committed image of each page in a log, and how many bytes at
+// its end were dropped: a record torn by a crash, or a commit that never logged its end
+func readHashWAL(data []byte) (map[uint32]walImage, int) {
+	committed := make(map[uint32]walImage)
+	var uncommitted []uint32
+	var images []walImage
+	offset, end := 0, 0
+
+	for offset+walRecordHeaderSize <= len(data) {
+		header := data[offset : offset+walRecordHeaderSize]
+		length := int(binary.LittleEndian.Uint32(header[4:8]))
+		if length > len(data)-offset-walRecordHeaderSize {
+			break
+		}
+		record := data[offset+walRecordHeaderSize : offset+walRecordHeaderSize+length]
+		checksum := crc32.NewIEEE()
+		checksum.Write(header[4:])
+		checksum.Write(record)
+		if checksum.Sum32() != binary.LittleEndian.Uint32(header[0:4]) {
+			break
+		}
+		offset += walRecordHeaderSize + length
+
+		lsn := binary.LittleEndian.Uint64(header[8:16])
+		pageNum := binary.LittleEndian.Uint32(header[17:21])
+		switch header[16] {
+		case walPageRecord:
+			if length != HashPageSize {
+				return committed, len(data) - end
+			}
+			uncommitted = append(uncommitted, pageNum)
+			images = append(images, walImage{lsn: lsn, image: record})
+		case walCommitRecord:
+			for i, pageNum := range uncommitted {
+				committed[pageNum] = images[i]
+			}
+			uncommitted, images = nil, nil
+			end = offset
+		default:
+			return committed, len(data) - end
+		}
+	}
+	return committed, len(data) - end
+}
+
+// recoverHashIndex brings an index file up to date with its log after a crash, marks it
+// invalid if a page still fails its checksum, and removes the log. It reports whether there
+// was a log to recover from.
+func recoverHashIndex(path string, logger *zap.SugaredLogger) (bool, error) {
+	walPath := path + hashWALExt
+	data, err := os.ReadFile(walPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("failed to read index log: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return true, fmt.Errorf("failed to open hash index file: %w", err)
+	}
+	defer file.Close()
+
+	committed, dropped := readHashWAL(data)
+	redone := 0
+	page := make([]byte, HashPageSize)
+	for pageNum, logged := range committed {
+		offset := int64(pageNum) * HashPageSize
+		if _, err := file.ReadAt(page, offset); err == nil {
+			if lsn, ok := checkHashPage(page); ok && lsn >= logged.lsn {
+				continue
+			}
+		}
+		if _, err := helpers.WriteAt(file, logged.image, offset); err != nil {
+			return true, fmt.Errorf("failed to redo page %d: %w", pageNum, err)
+		}
+		redone++
+	}
+	if err := helpers.Sync(file); err != nil {
+		return true, fmt.Errorf("failed to sync hash index file: %w", err)
+	}
+
+	reason := ""
+	for pageNum := uint32(0); ; pageNum++ {
+		n, err := file.ReadAt(page, int64(pageNum)*HashPageSize)
+		if err == io.EOF && n == 0 {
+			break
+		}
+		if _, ok := checkHashPage(page); err != nil || !ok {
+			reason = fmt.Sprintf("page %d is damaged after a crash", pageNum)
+			break
+		}
+	}
+	if reason != "" {
+		if err := markHashIndexInvalid(file, reason); err != nil {
+			return true, err
+		}
+		logger.Errorf("Hash index %s is invalid after crash recovery: %s", filepath.Base(path), reason)
+	}
+
+	if err := helpers.Remove(walPath); err != nil {
+		return true, fmt.Errorf("failed to remove index log: %w", err)
+	}
+	helpers.SyncDirectory(filepath.Dir(path))
+	logger.Infof("Recovered hash index %s from its log: %d page(s) redone, %d byte(s) of unfinished commits dropped",
+		filepath.Base(path), redone, dropped)
+	return true, nil
+}
+
+// markHashIndexInvalid records in an index's metadata why it has to be rebuilt
+func markHashIndexInvalid(file *os.File, reason string) error {
+	metadata, err := readHashMetadata(file)
+	if err != nil {
+		return fmt.Errorf("cannot mark the index invalid: %w", err)
+	}
+	metadata.Invalid = reason
+	image, err := metaPageImage(metadata)
+	if err != nil {
+		return err
+	}
+	sealHashPage(image, metadata.LSN)
+	if _, err := helpers.WriteAt(file, image, 0); err != nil {
+		return fmt.Errorf("failed to write meta page: %w", err)
+	}
+	return helpers.Sync(file)
+}
+
+// RecoverHashIndexes recovers every hash index in a data directory that a crash left with a
+// log, before any is opened. Indexes it cannot recover are marked invalid, or left unreadable
+// when their meta page is lost; CHECK DATABASE finds both.
+func RecoverHashIndexes(dataDir string, logger *zap.SugaredLogger) int {
+	logs, _ := filepath.Glob(filepath.Join(dataDir, "*"+helpers.HashIndexFileExt+hashWALExt))
+	recovered := 0
+	for _, walPath := range logs {
+		path := walPath[:len(walPath)-len(hashWALExt)]
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// The index was dropped after the log was written
+			os.Remove(walPath)
+			continue
+		}
+		if _, err := recoverHashIndex(path, logger); err != nil {
+			logger.Errorf("Failed to recover hash index %s: %v", filepath.Base(path), err)
+			continue
+		}
+		recovered++
+	}
+	return recovered
+}
@@ -0,0 +1,52 @@
+package helpers
+
+import (
+	"bytes"
+	"log"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+	Scratch buffers.
+
+	Encoding a bundle or a response used to allocate a new buffer every time, and grow it
+	from nothing to the size of the result. Code that only needs the encoding until it has
+	written it takes a buffer from this pool instead and gives it back afterwards, so the next
+	encoding starts with room to spare. Buffers grown past maxPooledBufferSize are let go
+	rather than kept, so one huge bundle does not pin its memory for good.
+*/
+
+// maxPooledBufferSize is the largest buffer put back in the pool
+const maxPooledBufferSize = 16 * 1024 * 1024
+
+var scratchBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// GetBuffer returns an empty buffer from the pool; hand it back with PutBuffer
+func GetBuffer() *bytes.Buffer {
+	buffer := scratchBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+// PutBuffer returns a buffer to the pool. Nothing may use it or its bytes afterwards.
+func PutBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+	scratchBuffers.Put(buffer)
+}
+
+// EncodeBSONTo appends the BSON encoding of a map to buffer, as EncodeBSON would return it
+func EncodeBSONTo(buffer *bytes.Buffer, jsonData map[string]interface{}) error {
+	encoded, err := bson.MarshalAppend(buffer.AvailableBuffer(), jsonData)
+	if err != nil {
+		log.Println("Error encoding BSON:", err)
+		return err
+	}
+	buffer.Write(encoded)
+	return nil
+}
@@ -0,0 +1,111 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	Container limits.
+
+	In a container the machine's CPUs and memory are not all the server's to use: the cgroup
+	it runs in can cap the CPU time it gets and kill it once it uses more memory than allowed.
+	CPUQuota reads the CPU cap, from cgroup v2's cpu.max or cgroup v1's cpu.cfs_quota_us and
+	cpu.cfs_period_us; MemoryLimit reads the memory cap, from cgroup v2's memory.max or cgroup
+	v1's memory.limit_in_bytes. Both read the cgroup of this process.
+*/
+
+// unlimitedMemory is the smallest cgroup v1 memory limit taken to mean no limit; v1 reports
+// an unlimited cgroup as a number close to the largest int64
+const unlimitedMemory = 1 << 60
+
+// cgroupRoot is where the cgroup file system is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// CPUQuota returns how many CPUs' worth of time the process's cgroup may use; ok is false
+// when it is not limited or no limit could be read
+func CPUQuota() (cpus float64, ok bool) {
+	// cgroup v2: "<quota> <period>", or "max <period>" when unlimited
+	if data, err := os.ReadFile(cgroupFile("", "cpu.max")); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			return quotaCPUs(fields[0], fields[1])
+		}
+		return 0, false
+	}
+
+	// cgroup v1: the quota is -1 when unlimited
+	quota, err := os.ReadFile(cgroupFile("cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	period, err := os.ReadFile(cgroupFile("cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+	return quotaCPUs(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+// MemoryLimit returns how many bytes of memory the process's cgroup may use; ok is false when
+// it is not limited or no limit could be read
+func MemoryLimit() (bytes int64, ok bool) {
+	data, err := os.ReadFile(cgroupFile("", "memory.max"))
+	if err != nil {
+		if data, err = os.ReadFile(cgroupFile("memory", "memory.limit_in_bytes")); err != nil {
+			return 0, false
+		}
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, false
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 || limit >= unlimitedMemory {
+		return 0, false
+	}
+	return limit, true
+}
+
+func quotaCPUs(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+// cgroupFile returns the path of a control file of this process's cgroup, for the v1
+// controller given or, with no controller, for v2. A cgroup that is not visible from inside
+// the container, as with a private cgroup namespace, is read at the root of the mount.
+func cgroupFile(controller, name string) string {
+	base := filepath.Join(cgroupRoot, controller)
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return filepath.Join(base, name)
+	}
+	// Lines are "<id>:<controllers>:<path>"; v2 has the single line "0::<path>"
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		matches := controller == "" && parts[0] == "0" && parts[1] == ""
+		for _, c := range strings.Split(parts[1], ",") {
+			matches = matches || (controller != "" && c == controller)
+		}
+		if !matches {
+			continue
+		}
+		path := filepath.Join(base, parts[2], name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(base, name)
+}
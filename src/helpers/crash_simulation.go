@@ -0,0 +1,144 @@
+package helpers
+
+import (
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Simulated crashes.
+
+	The files crash recovery depends on, hash index files with their logs (see
+	hash_index/hash_wal.go), the catalog log (see engine/catalog_wal.go) and the page log
+	(see engine/page_wal.go), are changed
+	through Write, WriteAt, Sync, Truncate, TruncatePath, Rename and Remove. These pass
+	straight through to the os calls they are named after unless a crash is armed, which
+	only the -crashtorture mode does.
+
+	ArmCrash lets a number of bytes reach the files. The write that crosses that number is cut
+	short at it and fails with ErrSimulatedCrash. So does every write, sync, truncation,
+	rename and removal after it, as if the machine had stopped there. Writes are assumed to
+	reach the disk in the order they are made; a real crash can also lose writes that were
+	never synced, which this does not simulate.
+*/
+
+// ErrSimulatedCrash is returned by file changes made at or after an armed crash
+var ErrSimulatedCrash = errors.New("simulated crash")
+
+// crashSimulation is an armed crash
+type crashSimulation struct {
+	mu        sync.Mutex
+	remaining int64 // Bytes still allowed to reach the files
+	written   int64
+	crashed   bool
+}
+
+var armedCrash atomic.Pointer[crashSimulation]
+
+// ArmCrash lets after bytes reach the files from now on, then crashes. A negative after
+// never crashes and only counts the bytes written.
+func ArmCrash(after int64) {
+	if after < 0 {
+		after = math.MaxInt64
+	}
+	armedCrash.Store(&crashSimulation{remaining: after, crashed: after == 0})
+}
+
+// DisarmCrash lets every change through again. It returns the bytes written while the crash
+// was armed and whether it happened.
+func DisarmCrash() (int64, bool) {
+	simulation := armedCrash.Swap(nil)
+	if simulation == nil {
+		return 0, false
+	}
+	simulation.mu.Lock()
+	defer simulation.mu.Unlock()
+	return simulation.written, simulation.crashed
+}
+
+// allow returns how many of n bytes may be written, and ErrSimulatedCrash when that is not all
+// of them or the crash has happened already
+func allow(n int) (int, error) {
+	simulation := armedCrash.Load()
+	if simulation == nil {
+		return n, nil
+	}
+	simulation.mu.Lock()
+	defer simulation.mu.Unlock()
+	if simulation.crashed {
+		return 0, ErrSimulatedCrash
+	}
+	allowed := int(min(int64(n), simulation.remaining))
+	simulation.remaining -= int64(allowed)
+	simulation.written += int64(allowed)
+	if simulation.remaining == 0 {
+		simulation.crashed = true
+	}
+	if allowed < n {
+		return allowed, ErrSimulatedCrash
+	}
+	return allowed, nil
+}
+
+// Write is file.Write, cut short by an armed crash
+func Write(file *os.File, data []byte) (int, error) {
+	allowed, crash := allow(len(data))
+	n, err := file.Write(data[:allowed])
+	if err == nil {
+		err = crash
+	}
+	return n, err
+}
+
+// WriteAt is file.WriteAt, cut short by an armed crash
+func WriteAt(file *os.File, data []byte, offset int64) (int, error) {
+	allowed, crash := allow(len(data))
+	n, err := file.WriteAt(data[:allowed], offset)
+	if err == nil {
+		err = crash
+	}
+	return n, err
+}
+
+// Sync is file.Sync, failing after an armed crash
+func Sync(file *os.File) error {
+	if _, err := allow(0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Truncate is file.Truncate, failing after an armed crash
+func Truncate(file *os.File, size int64) error {
+	if _, err := allow(0); err != nil {
+		return err
+	}
+	return file.Truncate(size)
+}
+
+// TruncatePath is os.Truncate, failing after an armed crash
+func TruncatePath(path string, size int64) error {
+	if _, err := allow(0); err != nil {
+		return err
+	}
+	return os.Truncate(path, size)
+}
+
+// Rename is os.Rename, failing after an armed crash
+func Rename(oldPath, newPath string) error {
+	if _, err := allow(0); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// Remove is os.Remove, failing after an armed crash
+func Remove(path string) error {
+	if _, err := allow(0); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -26,6 +26,14 @@ func DeleteDataFile(filePath string) error {
 	return os.Remove(filePath)
 }
 
+// SyncDirectory makes renames and removals in a directory durable, where the platform allows
+func SyncDirectory(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
 // fileExists checks if a file exists and is not a directory
 func FileExists(filename string, logger zap.SugaredLogger) bool {
 	args := settings.GetSettings()
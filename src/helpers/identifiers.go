@@ -0,0 +1,47 @@
+package helpers
+
+import "strings"
+
+/*
+	Identifier case.
+
+	Database and bundle names keep the case they were created with, in catalogs, file names and
+	results, but by default are compared without regard to case: "Users" and "users" name the
+	same bundle, and a second bundle cannot be created under either. -identifiercase=sensitive
+	compares them exactly instead, so both can exist; their files differ only in case, so that
+	is only safe on a file system that tells them apart. Every lookup of a database or bundle by
+	name goes through the server's Identifiers, so the policy holds across catalogs. The
+	services each carry them, so servers in one process may compare names differently.
+*/
+
+const (
+	IdentifierCaseInsensitive = "insensitive"
+	IdentifierCaseSensitive   = "sensitive"
+)
+
+// Identifiers compare database and bundle names the way a server's -identifiercase says. The
+// zero value compares them without regard to case.
+type Identifiers struct {
+	CaseSensitive bool
+}
+
+// NewIdentifiers returns the comparison an -identifiercase value names
+func NewIdentifiers(identifierCase string) Identifiers {
+	return Identifiers{CaseSensitive: identifierCase == IdentifierCaseSensitive}
+}
+
+// Same reports whether two database or bundle names name the same thing
+func (i Identifiers) Same(a, b string) bool {
+	if i.CaseSensitive {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
+
+// Key returns the key a name is kept under in maps that must follow the policy
+func (i Identifiers) Key(name string) string {
+	if i.CaseSensitive {
+		return name
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,104 @@
+package helpers
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Namespaces.
+
+	A namespace groups the bundles of a database, such as billing.invoices and auth.users. A
+	bundle in a namespace is named "<namespace>.<bundle>" everywhere inside the server, so
+	catalogs, caches and commands handle it like any other bundle; SyndrQL also accepts the
+	quoted form "billing"."invoices". Its files live in a directory named after the namespace,
+	billing/invoices.bnd and billing/invoices.p<n>.bnd, and database catalogs list them by that
+	path. Namespaces are not created or dropped on their own: one exists while it holds a
+	bundle, and its directory goes with its last bundle. Index files are named by bundle ID, so
+	they stay in the data directory itself.
+*/
+
+const NamespaceSeparator = "."
+
+// SplitBundleName splits a bundle name into its namespace, empty outside one, and its name
+// within the namespace
+func SplitBundleName(name string) (namespace, bundle string) {
+	if i := strings.Index(name, NamespaceSeparator); i >= 0 {
+		return name[:i], name[i+len(NamespaceSeparator):]
+	}
+	return "", name
+}
+
+// QualifiedBundleName names a bundle in a namespace; an empty namespace leaves the name as is
+func QualifiedBundleName(namespace, bundle string) string {
+	if namespace == "" {
+		return bundle
+	}
+	return namespace + NamespaceSeparator + bundle
+}
+
+// bundleFilePath turns a bundle name into the path of its files without the extension,
+// relative to the data directory and with / between namespace and bundle
+func bundleFilePath(bundleName string) string {
+	namespace, bundle := SplitBundleName(bundleName)
+	if namespace == "" {
+		return bundle
+	}
+	return path.Join(namespace, bundle)
+}
+
+// bundleNameFromPath is the reverse of bundleFilePath
+func bundleNameFromPath(filePath string) string {
+	return strings.ReplaceAll(filepath.ToSlash(filePath), "/", NamespaceSeparator)
+}
+
+// DataDirEntry is a file in the data directory or one of its namespace directories. Path is
+// relative to the data directory, with / after the namespace.
+type DataDirEntry struct {
+	Path string
+	fs.DirEntry
+}
+
+// ReadDataDir lists the files in the data directory and in the directories one level down,
+// where the files of bundles in namespaces live
+func (r *PathResolver) ReadDataDir() ([]DataDirEntry, error) {
+	entries, err := os.ReadDir(r.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]DataDirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, DataDirEntry{Path: entry.Name(), DirEntry: entry})
+			continue
+		}
+		nested, err := os.ReadDir(r.Path(entry.Name()))
+		if err != nil {
+			continue
+		}
+		for _, file := range nested {
+			if !file.IsDir() {
+				files = append(files, DataDirEntry{Path: path.Join(entry.Name(), file.Name()), DirEntry: file})
+			}
+		}
+	}
+	return files, nil
+}
+
+// Namespaces lists the namespace directories in the data directory
+func (r *PathResolver) Namespaces() ([]string, error) {
+	entries, err := os.ReadDir(r.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			namespaces = append(namespaces, entry.Name())
+		}
+	}
+	return namespaces, nil
+}
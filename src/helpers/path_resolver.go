@@ -0,0 +1,165 @@
+package helpers
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/*
+	Data file naming.
+
+	Every file SyndrDB keeps for databases, bundles and indexes lives in the data directory,
+	under a name built here and nowhere else:
+	  <database>.db                               database catalog
+	  <bundle>.bnd                                bundle
+	  <bundle>.p<n>.bnd                           one partition of a partitioned bundle
+	  <namespace>/<bundle>.bnd, .p<n>.bnd         the same for a bundle in a namespace (namespaces.go)
+	  <bundle ID>_<field>{_<field>}_idx.idx       btree index
+	  <bundle ID>_<field>_hidx.hidx               hash index
+	  <bundle ID>_<field>_hidx.hidx.wal           hash index changes being made (hash_index/hash_wal.go)
+	  format.json                                 format version of the files (engine/file_formats.go)
+	  catalog.wal                                 catalog changes being committed (engine/catalog_wal.go)
+	  users.dat                                   local users, encrypted (auth/user_store.go)
+	  erasures.log                                reports of ERASE SUBJECT (directors/erasure.go)
+	Index names have "-" replaced by "_" so bundle IDs are safe in file names. Storage code asks
+	a PathResolver for a path instead of joining directories or appending extensions itself, so
+	a file is always looked for under the name it was written with.
+*/
+
+const (
+	DatabaseFileExt     = ".db"
+	BundleFileExt       = ".bnd"
+	LegacyBundleFileExt = ".bun" // Written by older versions under some paths; never read
+	BTreeIndexFileExt   = ".idx"
+	HashIndexFileExt    = ".hidx"
+	CatalogWALFileName  = "catalog.wal"
+	PageWALFileName     = "pages.wal"
+	DataFormatFileName  = "format.json"
+	UserStoreFileName   = "users.dat"
+	ErasureLogFileName  = "erasures.log"
+)
+
+var partitionFileNamePattern = regexp.MustCompile(`^(.+)\.p(\d+)\` + BundleFileExt + `$`)
+
+// PathResolver builds the paths of the data files in one data directory
+type PathResolver struct {
+	dataDir string
+}
+
+// NewPathResolver creates a resolver for the given data directory
+func NewPathResolver(dataDir string) *PathResolver {
+	return &PathResolver{dataDir: dataDir}
+}
+
+// DataDir returns the directory the resolver builds paths in
+func (r *PathResolver) DataDir() string {
+	return r.dataDir
+}
+
+// Path returns the path of a data file given its file name
+func (r *PathResolver) Path(fileName string) string {
+	return filepath.Join(r.dataDir, fileName)
+}
+
+// DatabaseFile returns the path of a database's catalog file
+func (r *PathResolver) DatabaseFile(databaseName string) string {
+	return r.Path(DatabaseFileName(databaseName))
+}
+
+// BundleFile returns the path of a bundle's file
+func (r *PathResolver) BundleFile(bundleName string) string {
+	return r.Path(BundleFileName(bundleName))
+}
+
+// PartitionFile returns the path of one partition file of a bundle
+func (r *PathResolver) PartitionFile(bundleName string, partition int) string {
+	return r.Path(PartitionFileName(bundleName, partition))
+}
+
+// BTreeIndexFile returns the path of a btree index file
+func (r *PathResolver) BTreeIndexFile(indexName string) string {
+	return r.Path(indexName + BTreeIndexFileExt)
+}
+
+// HashIndexFile returns the path of a hash index file
+func (r *PathResolver) HashIndexFile(indexName string) string {
+	return r.Path(indexName + HashIndexFileExt)
+}
+
+// CatalogWALFile returns the path of the catalog write-ahead log
+func (r *PathResolver) CatalogWALFile() string {
+	return r.Path(CatalogWALFileName)
+}
+
+// PageWALFile returns the path of the page write-ahead log
+func (r *PathResolver) PageWALFile() string {
+	return r.Path(PageWALFileName)
+}
+
+// DataFormatFile returns the path of the file recording the data directory's format version
+func (r *PathResolver) DataFormatFile() string {
+	return r.Path(DataFormatFileName)
+}
+
+// BTreeIndexFiles returns the paths of the btree index files of a bundle
+func (r *PathResolver) BTreeIndexFiles(bundleID string) ([]string, error) {
+	return filepath.Glob(r.Path(IndexNamePrefix(bundleID) + "*_idx" + BTreeIndexFileExt))
+}
+
+// HashIndexFiles returns the paths of the hash index files of a bundle
+func (r *PathResolver) HashIndexFiles(bundleID string) ([]string, error) {
+	return filepath.Glob(r.Path(IndexNamePrefix(bundleID) + "*_hidx" + HashIndexFileExt))
+}
+
+// DatabaseFileName returns the file name of a database's catalog file
+func DatabaseFileName(databaseName string) string {
+	return databaseName + DatabaseFileExt
+}
+
+// BundleFileName returns the file name of a bundle's file
+func BundleFileName(bundleName string) string {
+	return bundleFilePath(bundleName) + BundleFileExt
+}
+
+// BundleNameFromFile returns the bundle a bundle file name belongs to
+func BundleNameFromFile(fileName string) string {
+	return bundleNameFromPath(strings.TrimSuffix(strings.TrimSuffix(fileName, BundleFileExt), LegacyBundleFileExt))
+}
+
+// PartitionFileName returns the file name of one partition of a bundle
+func PartitionFileName(bundleName string, partition int) string {
+	return fmt.Sprintf("%s.p%d%s", bundleFilePath(bundleName), partition, BundleFileExt)
+}
+
+// ParsePartitionFileName splits a partition file name into its bundle and partition number
+func ParsePartitionFileName(fileName string) (string, int, bool) {
+	match := partitionFileNamePattern.FindStringSubmatch(fileName)
+	if match == nil {
+		return "", 0, false
+	}
+	var partition int
+	fmt.Sscanf(match[2], "%d", &partition)
+	return bundleNameFromPath(match[1]), partition, true
+}
+
+// IndexNamePrefix is how the names of all index files of a bundle start
+func IndexNamePrefix(bundleID string) string {
+	return strings.ReplaceAll(bundleID, "-", "_") + "_"
+}
+
+// BTreeIndexName returns the name of a btree index over the given fields
+func BTreeIndexName(bundleID string, fieldNames []string) string {
+	return strings.ReplaceAll(fmt.Sprintf("%s_%s_idx", bundleID, strings.Join(fieldNames, "_")), "-", "_")
+}
+
+// HashIndexName returns the name of a hash index over the given field
+func HashIndexName(bundleID string, fieldName string) string {
+	return strings.ReplaceAll(fmt.Sprintf("%s_%s_hidx", bundleID, fieldName), "-", "_")
+}
+
+// IndexNameFromFile strips the extension from an index file name
+func IndexNameFromFile(fileName string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(filepath.Base(fileName), BTreeIndexFileExt), HashIndexFileExt)
+}
@@ -0,0 +1,61 @@
+package helpers
+
+import (
+	"runtime/debug"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Panic recovery for goroutines.
+
+	A panic in any goroutine takes the whole server down, so every goroutine the server starts
+	either defers RecoverPanic, for one-off work, or runs under Supervise, for loops that must
+	keep going. Both log the panic with its stack. Command execution recovers on its own, see
+	server/recovery.go.
+*/
+
+const (
+	supervisorFirstRestart = time.Second
+	supervisorMaxRestart   = time.Minute
+)
+
+// RecoverPanic logs a panic with its stack instead of letting it crash the server. It has to
+// be deferred directly: defer helpers.RecoverPanic(logger, "what was running")
+func RecoverPanic(logger *zap.SugaredLogger, task string) {
+	if recovered := recover(); recovered != nil {
+		logger.Errorw("Recovered from a panic", "task", task, "panic", recovered, "stack", string(debug.Stack()))
+	}
+}
+
+// Supervise runs a background loop until it returns, starting it again after a panic. The
+// pause before a restart doubles with each panic in a row, up to a minute, so a loop that
+// panics on every run does not flood the log.
+func Supervise(logger *zap.SugaredLogger, task string, loop func()) {
+	delay := supervisorFirstRestart
+	for {
+		started := time.Now()
+		if !runRecovered(logger, task, loop) {
+			return
+		}
+		if time.Since(started) > supervisorMaxRestart {
+			delay = supervisorFirstRestart // It ran fine for a while before this panic
+		}
+		logger.Warnw("Restarting background task after a panic", "task", task, "in", delay)
+		time.Sleep(delay)
+		delay = min(2*delay, supervisorMaxRestart)
+	}
+}
+
+// runRecovered runs a loop and reports whether it panicked
+func runRecovered(logger *zap.SugaredLogger, task string, loop func()) (panicked bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger.Errorw("Recovered from a panic", "task", task, "panic", recovered, "stack", string(debug.Stack()))
+			panicked = true
+		}
+	}()
+	loop()
+	return false
+}
@@ -12,6 +12,12 @@ func GenerateUUID() string {
 	return uuid.New().String()
 }
 
+// DerivedUUID returns the UUID made from a seed and a name, the same on every node that works
+// it out
+func DerivedUUID(seed, name string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(seed+"\x00"+name)).String()
+}
+
 // Helper function to properly remove quotes from strings
 func StripQuotes(s string) string {
 	s = strings.TrimSpace(s)
@@ -1,17 +1,32 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"syndrdb/src/auth"
+	"syndrdb/src/cdc"
+	"syndrdb/src/directors"
+	"syndrdb/src/engine"
+	hashindex "syndrdb/src/hash_index"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
 	"syndrdb/src/server"
 	"syndrdb/src/settings"
+	"syndrdb/src/workers"
 	"syscall"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 // printUsage prints helpful usage information
@@ -38,13 +53,84 @@ func main() {
 	flag.StringVar(&args.DataDir, "datadir", "./datafiles", "Directory to store data files")
 	flag.StringVar(&args.LogDir, "logdir", "./log_files", "Directory to store log files (default: stdout)")
 	flag.StringVar(&args.TempDir, "tempdir", "./temp", "Temporary directory for intermediate files/indexes/sorts")
+	flag.StringVar(&args.InitDir, "initdir", "", "Directory of *.syndrql scripts run as -adminuser when the server starts with an empty -datadir")
 	flag.Int64Var(&args.MaxJournalFileSize, "maxjournalfilesize", 1000000, "Maximum size of journal files in bytes (default: 1MB)")
 	flag.StringVar(&args.Host, "host", "127.0.0.1", "Host name or IP address to listen on")
 	flag.IntVar(&args.Port, "port", 1776, "Port for the HTTP server")
+	flag.StringVar(&args.Socket, "socket", "", "Path of a Unix domain socket to listen on as well, such as /var/run/syndrdb.sock (empty disables)")
+	flag.BoolVar(&args.ReusePort, "reuseport", false, "Accept connections on one SO_REUSEPORT listener per CPU, for high connection rates")
+	flag.StringVar(&args.AdminHost, "adminhost", "127.0.0.1", "Host name or IP address the admin port listens on; keep it loopback or internal")
+	flag.IntVar(&args.AdminPort, "adminport", 0, "Port of a separate listener that alone accepts ALTER SYSTEM, SECRETS ROTATE, DIAGNOSTICS DUMP and DIAGNOSTICS BUFFERPOOL (0 accepts them on -port)")
+	flag.IntVar(&args.MongoPort, "mongoport", 0, "Port of a MongoDB wire protocol listener serving find, insert, update and delete, for trying Mongo drivers and tools (0 disables; not with -auth)")
+	flag.IntVar(&args.GRPCPort, "grpcport", 0, "Port of the gRPC API, with the services defined in src/rpc/syndrdb.proto (0 disables)")
+	flag.StringVar(&args.TLSCertFile, "tlscert", "", "PEM certificate file, or env:NAME holding the PEM; enables TLS for client connections (requires -tlskey)")
+	flag.StringVar(&args.TLSKeyFile, "tlskey", "", "PEM private key file for -tlscert, or env:NAME holding the PEM")
+	flag.Int64Var(&args.MaxCommandSize, "maxcommandsize", 16*1024*1024, "Maximum size of a single command in bytes; larger commands are rejected")
+	flag.Int64Var(&args.MaxDocumentBytes, "maxdocumentbytes", 16*1024*1024, "Largest document in bytes, for bundles without their own LIMITS (0 disables)")
+	flag.IntVar(&args.MaxDocumentFields, "maxdocumentfields", 1024, "Most fields in a document, nested ones included, for bundles without their own LIMITS (0 disables)")
+	flag.IntVar(&args.MaxDocumentDepth, "maxdocumentdepth", 32, "Deepest nesting of objects and arrays in a document, for bundles without their own LIMITS (0 disables)")
+	flag.StringVar(&args.IdentifierCase, "identifiercase", helpers.IdentifierCaseInsensitive, "How database and bundle names are compared (insensitive, sensitive); names keep their case either way")
+	flag.DurationVar(&args.VersionRetention, "versionretention", 0, "How long every document version is kept in memory for AS OF queries and SHOW DOCUMENT HISTORY (0 disables)")
+	flag.DurationVar(&args.RequestIDTTL, "requestidttl", 10*time.Minute, "How long the result of a write sent with REQUEST \"<id>\" is kept for retries (0 disables)")
+	flag.DurationVar(&args.SessionGracePeriod, "sessiongrace", 5*time.Minute, "How long a disconnected client can resume its session with its session token (0 disables)")
+	flag.StringVar(&args.DiagnosticsAddr, "diagnosticsaddr", "", "Address of the operator-only HTTP endpoint with pprof and runtime stats, such as 127.0.0.1:6060 (empty disables)")
+	flag.StringVar(&args.DiagnosticsDir, "diagnosticsdir", "./diagnostics", "Directory DIAGNOSTICS DUMP writes support bundles to, and DIAGNOSTICS BUFFERPOOL TO FILE its snapshots")
+	flag.Float64Var(&args.AccessLogSampleRate, "accesslogsample", 0.01, "Share of fast, successful commands written to the access log, 0 to 1 (failed and slow ones are always written)")
+	flag.DurationVar(&args.SlowRequestThreshold, "slowrequest", time.Second, "Commands at least this slow are always written to the access log (0 disables)")
+	flag.StringVar(&args.CDCSink, "cdcsink", "", "Publish document changes to kafka://host:port[,host:port] or nats://[user:password@]host:port")
+	flag.StringVar(&args.CDCTopic, "cdctopic", cdc.DefaultTopic, "Topic or subject document changes are published to; {database} and {bundle} are filled in")
+	flag.StringVar(&args.CDCFormat, "cdcformat", cdc.FormatJSON, "Encoding of published document changes (json, avro)")
+	flag.DurationVar(&args.DeadlockCheckInterval, "deadlockcheck", time.Second, "How often transactions waiting for document locks are checked for deadlocks (0 disables)")
+	flag.DurationVar(&args.IndexUsageInterval, "indexusageinterval", time.Minute, "How often the counts behind SHOW INDEX USAGE are saved to the data directory (0 saves them only at shutdown)")
+	flag.IntVar(&args.PlanCacheSize, "plancachesize", 256, "Query plans cached per database, and read statements per server, reused by queries whose WHERE clauses differ only in their values (0 disables)")
+	flag.DurationVar(&args.AutoAnalyzeInterval, "autoanalyzeinterval", time.Minute, "How often bundles are checked for automatic ANALYZE, give or take a fifth at random (0 disables)")
+	flag.IntVar(&args.AutoAnalyzeThreshold, "autoanalyzethreshold", 500, "Documents that must change in a bundle, besides -autoanalyzescale of them, before it is analyzed automatically")
+	flag.Float64Var(&args.AutoAnalyzeScale, "autoanalyzescale", 0.1, "Share of a bundle's documents that must change, besides -autoanalyzethreshold, before it is analyzed automatically")
+	flag.StringVar(&args.Durability, "durability", "interval", "When writes to bundle files are synced to disk, for databases that set no DURABILITY (always, interval, off)")
+	flag.DurationVar(&args.SyncInterval, "syncinterval", time.Second, "How often bundle files written at INTERVAL durability are synced to disk")
+	flag.Float64Var(&args.MaxDirtyRatio, "maxdirtyratio", 0.9, "Share of the buffer pool that may be dirty before writes are throttled (0 disables)")
+	flag.DurationVar(&args.MaxWriteLatency, "maxwritelatency", 500*time.Millisecond, "Average page write time above which writes are throttled (0 disables)")
+	flag.IntVar(&args.MaxBundleWrites, "maxbundlewrites", 64, "Writes that may run at once against one bundle before more are throttled (0 disables)")
+	flag.Int64Var(&args.BufferPoolMemory, "bufferpoolmemory", 0, "Bytes of pages the buffer pool caches (0 takes a quarter of the container's memory limit, up to 1GB, or 8MB without one)")
+	flag.Int64Var(&args.SortMemory, "sortmemory", 0, "Bytes each index build sorts keys in before spilling to disk (0 takes a sixteenth of the container's memory limit, up to 100MB, or 100MB without one)")
+	flag.IntVar(&args.HashFillFactor, "hashfillfactor", 75, "Percent of a hash index's bucket pages its entries may fill before a bucket is split, from 10 to 90; lower splits sooner and keeps overflow chains short")
+	flag.IntVar(&args.GoMaxProcs, "gomaxprocs", 0, "CPUs the server may use at once (0 follows the container's CPU limit, or uses every CPU without one)")
+	flag.StringVar(&args.QueryWorkers, "queryworkers", workers.DefaultQueryWorkers, "SELECT statements that run at once, as a count or a multiple of the CPUs such as 2x; more wait for a free worker")
+	flag.StringVar(&args.IndexBuildWorkers, "indexworkers", workers.DefaultIndexBuildWorkers, "Goroutines encoding index keys, shared by every index build, as a count or a multiple of the CPUs")
+	flag.StringVar(&args.WriterWorkers, "writerworkers", workers.DefaultWriterWorkers, "Goroutines writing dirty buffers back to disk, as a count or a multiple of the CPUs")
+	flag.StringVar(&args.CDCWorkers, "cdcworkers", workers.DefaultCDCWorkers, "Change data capture delivery loops, as a count or a multiple of the CPUs; above 1, changes stay in order per document only")
+	flag.StringVar(&args.ResourceGroupsFile, "resourcegroups", "", "JSON file of resource groups with the CPU share, concurrency and memory of the users and connections in each (empty puts every connection in one unlimited group)")
+	flag.StringVar(&args.ErasureSubjectsFile, "erasuresubjects", "", "JSON file of the subjects ERASE SUBJECT finds and erases, with their bundles and personal fields (empty configures none)")
+	flag.StringVar(&args.MaskingPoliciesFile, "maskingpolicies", "", "JSON file of roles and the rules masking fields (last4, redact, hash) in the results their users read (empty masks nothing)")
+	flag.BoolVar(&args.Fsck, "fsck", false, "Check every database's bundle and index files, report and exit (status 1 if problems remain)")
+	flag.BoolVar(&args.FsckRepair, "repair", false, "With -fsck, rebuild missing or unreadable indexes and drop references to missing bundle files")
+	flag.IntVar(&args.FuzzQueries, "fuzzqueries", 0, "Run this many rounds of random bundles and queries, comparing the planner's results with a full scan, report and exit (status 1 on a mismatch)")
+	flag.Int64Var(&args.FuzzSeed, "fuzzseed", 0, "Seed of the first -fuzzqueries round, to replay a reported mismatch (0 picks one from the clock)")
+	flag.IntVar(&args.CrashTorture, "crashtorture", 0, "Run this many rounds of hash index and catalog writes cut short by a simulated crash, check that recovery restores a consistent state, report and exit (status 1 on a failure)")
+	flag.Int64Var(&args.CrashSeed, "crashseed", 0, "Seed of the first -crashtorture round, to replay a reported failure (0 picks one from the clock)")
+	flag.BoolVar(&args.ReadOnly, "readonly", false, "Start in read-only mode, refusing every command that writes (ALTER SYSTEM SET read_only = false lifts it)")
 	flag.BoolVar(&args.Verbose, "verbose", true, "Enable verbose logging")
 	flag.StringVar(&args.ConfigFile, "config", "", "Path to config file")
 	flag.StringVar(&args.Mode, "mode", "standalone", "Operation mode (standalone, cluster)")
+	flag.StringVar(&args.NodeID, "nodeid", "", "ID of this node in the cluster topology (cluster mode)")
+	flag.StringVar(&args.ClusterConfigFile, "clusterconfig", "", "Path to the cluster topology file (cluster mode)")
+	flag.Int64Var(&args.MaxHintBytes, "maxhintbytes", 64*1024*1024, "Maximum bytes of buffered writes kept per unreachable replica (cluster mode)")
 	flag.BoolVar(&args.AuthEnabled, "auth", false, "Enable authentication")
+	flag.StringVar(&args.UserStoreKey, "userstorekey", "", "Key the local user store file is encrypted with, or env:NAME or file:PATH holding it")
+	flag.StringVar(&args.AdminUser, "adminuser", "admin", "Local user added at the first start with -auth; the only user allowed SECRETS ROTATE")
+	flag.StringVar(&args.AdminPassword, "adminpassword", "", "First password of -adminuser, or env:NAME or file:PATH holding it")
+	flag.IntVar(&args.PasswordMinLength, "passwordminlength", 12, "Shortest password a local user may set")
+	flag.IntVar(&args.PasswordMinClasses, "passwordminclasses", 3, "Kinds of characters a password must mix: lower case, upper case, digits, others (1-4)")
+	flag.IntVar(&args.MaxFailedLogins, "maxfailedlogins", 5, "Wrong passwords in a row before a local user is locked out (0 disables)")
+	flag.DurationVar(&args.LockoutDuration, "lockoutduration", 15*time.Minute, "How long a locked-out local user stays locked")
+	flag.DurationVar(&args.PasswordMaxAge, "passwordmaxage", 0, "How long a local user's password lasts before it must be changed (0 disables)")
+	flag.StringVar(&args.AuthProviders, "authproviders", auth.ProviderLocal, "Comma-separated authentication providers, asked in order (local, ldap, oidc, peer)")
+	flag.StringVar(&args.LDAPURL, "ldapurl", "", "LDAP directory the ldap provider binds to, as ldap://host[:port] or ldaps://host[:port]")
+	flag.StringVar(&args.LDAPUserDN, "ldapuserdn", "", "DN the ldap provider binds as; {username} is replaced by the user name")
+	flag.StringVar(&args.OIDCIssuer, "oidcissuer", "", "Issuer whose JWT bearer tokens the oidc provider accepts as passwords")
+	flag.StringVar(&args.OIDCAudience, "oidcaudience", "", "Audience tokens must be issued for (oidc provider)")
+	flag.StringVar(&args.OIDCJWKSURL, "oidcjwksurl", "", "URL of the issuer's signing keys; discovered from -oidcissuer when empty")
+	flag.StringVar(&args.OIDCUsernameClaim, "oidcusernameclaim", auth.DefaultUsernameClaim, "Token claim holding the user name (oidc provider)")
 	flag.StringVar(&args.Version, "version", "0.0.1alpha", "Shows version")
 	flag.BoolVar(&args.PrintToScreen, "print", true, "Print Log Messages to screen")
 	flag.BoolVar(&args.Debug, "debug", true, "Enable debug mode")
@@ -53,6 +139,25 @@ func main() {
 	// Parse the command line
 	flag.Parse()
 
+	// Secrets not given as flags come from their environment variables
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, variable := range settings.SecretEnvironment {
+		if _, set := os.LookupEnv(variable); set && !given[name] {
+			flag.Set(name, "env:"+variable)
+		}
+	}
+
+	// On the first start the root password stands in for -adminpassword (see server/bootstrap.go)
+	firstStart, err := server.IsFirstStart(args.DataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if rootPassword := os.Getenv(server.RootPasswordEnvironment); firstStart && rootPassword != "" && args.AdminPassword == "" {
+		args.AdminPassword = rootPassword
+	}
+
 	timestamp := time.Now().Format("2006-01-02_15-04-05")
 	logFilename := fmt.Sprintf("%s_%s_ServerLog.txt", timestamp, args.Host)
 
@@ -70,6 +175,16 @@ func main() {
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	setGoMaxProcs(args.GoMaxProcs)
+	setMemoryLimits(args)
+
+	if args.FuzzQueries > 0 {
+		os.Exit(runQueryFuzzer(args.FuzzQueries, args.FuzzSeed, args.PlanCacheSize))
+	}
+	if args.CrashTorture > 0 {
+		os.Exit(runCrashTorture(args.CrashTorture, args.CrashSeed, args.TempDir))
+	}
+
 	// Print the arguments if in verbose mode
 	if args.Verbose {
 		log.Println("SyndrDB starting with options:")
@@ -77,9 +192,23 @@ func main() {
 		log.Printf("  Log File: %s\n", args.LogDir)
 		log.Printf("  Host: %s\n", args.Host)
 		log.Printf("  Port: %d\n", args.Port)
+		if args.AdminPort != 0 {
+			log.Printf("  Admin Port: %s:%d\n", args.AdminHost, args.AdminPort)
+		}
+		if args.MongoPort != 0 {
+			log.Printf("  MongoDB Port: %d\n", args.MongoPort)
+		}
+		if args.GRPCPort != 0 {
+			log.Printf("  gRPC Port: %d\n", args.GRPCPort)
+		}
 		log.Printf("  Verbose: %v\n", args.Verbose)
 		log.Printf("  Config File: %s\n", args.ConfigFile)
 		log.Printf("  Mode: %s\n", args.Mode)
+		log.Printf("  TLS: %v\n", args.TLSCertFile != "")
+		if args.Mode == "cluster" {
+			log.Printf("  Node ID: %s\n", args.NodeID)
+			log.Printf("  Cluster Config: %s\n", args.ClusterConfigFile)
+		}
 
 	}
 
@@ -133,10 +262,30 @@ func main() {
 	}
 	//srv := server.NewServer(args.Host, args.Port, db, args.AuthEnabled)
 
-	// Add users if authentication is enabled
+	if args.Fsck {
+		os.Exit(runConsistencyCheck(srv.Services(), args.FsckRepair))
+	}
+
+	// Add the admin user at the first start with authentication. Without -adminpassword it
+	// and an example user get default passwords, which must be changed at the first login.
 	if args.AuthEnabled {
-		srv.AddUser("admin", "admin123")   // Example user
-		srv.AddUser("syndrdb", "password") // Example user
+		if args.AdminPassword != "" {
+			adminPassword, _ := settings.ResolveSecret(args.AdminPassword) // Checked by validateArguments
+			srv.AddUser(args.AdminUser, adminPassword, false)
+		} else {
+			srv.AddUser(args.AdminUser, "admin123", true)
+			srv.AddUser("syndrdb", "password", true)
+		}
+	} else if firstStart && args.AdminPassword != "" {
+		// Ready for when -auth is turned on
+		adminPassword, _ := settings.ResolveSecret(args.AdminPassword)
+		srv.AddUser(args.AdminUser, adminPassword, false)
+	}
+
+	if firstStart && args.InitDir != "" {
+		if err := srv.RunInitScripts(args.InitDir, args.AdminUser); err != nil {
+			log.Fatalf("First start bootstrap failed: %v", err)
+		}
 	}
 
 	// Start the server
@@ -158,6 +307,141 @@ func main() {
 	fmt.Println("Server shutdown complete")
 }
 
+// setGoMaxProcs limits the CPUs Go uses to -gomaxprocs or, without it, to the container's CPU
+// limit, which Go does not follow on its own. A GOMAXPROCS environment variable wins over both.
+func setGoMaxProcs(requested int) {
+	if os.Getenv("GOMAXPROCS") != "" {
+		return
+	}
+	if requested > 0 {
+		runtime.GOMAXPROCS(requested)
+		log.Printf("GOMAXPROCS set to %d", requested)
+		return
+	}
+	if quota, ok := helpers.CPUQuota(); ok {
+		cpus := max(1, int(math.Ceil(quota)))
+		if cpus < runtime.GOMAXPROCS(0) {
+			runtime.GOMAXPROCS(cpus)
+			log.Printf("GOMAXPROCS set to %d for the container's CPU limit of %.2f CPUs", cpus, quota)
+		}
+	}
+}
+
+// Shares of a container's memory limit taken by default, see setMemoryLimits
+const (
+	bufferPoolShare     = 4  // A quarter for the buffer pool
+	sortShare           = 16 // A sixteenth for each index build's sort
+	maxDerivedPoolBytes = 1024 * 1024 * 1024
+	goMemoryLimitShare  = 0.9 // Go collects garbage harder as the heap nears this share
+)
+
+// setMemoryLimits sizes the buffer pool and index sorts for the container's memory limit,
+// unless -bufferpoolmemory and -sortmemory were given, and has Go keep its heap below the
+// limit, unless a GOMEMLIMIT environment variable says otherwise. Without a limit the fixed
+// defaults apply.
+func setMemoryLimits(args *settings.Arguments) {
+	limit, limited := helpers.MemoryLimit()
+	if !limited {
+		if args.BufferPoolMemory == 0 {
+			args.BufferPoolMemory = settings.DefaultBufferPoolMemory
+		}
+		if args.SortMemory == 0 {
+			args.SortMemory = settings.DefaultSortMemory
+		}
+		return
+	}
+
+	if args.BufferPoolMemory == 0 {
+		args.BufferPoolMemory = min(limit/bufferPoolShare, maxDerivedPoolBytes)
+	}
+	if args.SortMemory == 0 {
+		args.SortMemory = min(limit/sortShare, settings.DefaultSortMemory)
+	}
+	if os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(int64(float64(limit) * goMemoryLimitShare))
+	}
+	log.Printf("Container memory limit of %d MB: buffer pool %d MB, index sorts %d MB each",
+		limit>>20, args.BufferPoolMemory>>20, args.SortMemory>>20)
+}
+
+// runConsistencyCheck checks every database for -fsck and returns the exit status
+func runConsistencyCheck(serviceManager *directors.ServiceManager, repair bool) int {
+	status := 0
+	for _, db := range serviceManager.DatabaseService.ListDatabases() {
+		report := serviceManager.BundleService.CheckDatabase(context.Background(), serviceManager.DatabaseService, db, repair)
+		for _, problem := range report.Problems {
+			if problem.Action != "" {
+				log.Printf("fsck: %s: %s: %s (%s)", db.Name, problem.Object, problem.Problem, problem.Action)
+			} else {
+				log.Printf("fsck: %s: %s: %s", db.Name, problem.Object, problem.Problem)
+			}
+		}
+		log.Printf("fsck: %s", report.Summary())
+		if report.Unresolved > 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// runQueryFuzzer runs the rounds of -fuzzqueries and returns the exit status
+func runQueryFuzzer(rounds int, seed int64, planCacheSize int) int {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	report := engine.FuzzQueries(seed, rounds, planCacheSize, zap.NewNop().Sugar())
+	for _, mismatch := range report.Mismatches {
+		log.Printf("fuzz: %s", mismatch)
+	}
+	log.Printf("fuzz: %s", report.Summary())
+	if len(report.Mismatches) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runCrashTorture runs the rounds of -crashtorture in tempDir and returns the exit status.
+// Rounds alternate between hash indexes and the catalog log by their seed; the files of a
+// failed round are kept.
+func runCrashTorture(rounds int, seed int64, tempDir string) int {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		log.Printf("torture: failed to create temporary directory: %v", err)
+		return 1
+	}
+	logger := zap.NewNop().Sugar()
+	crashes, failures := 0, 0
+	for round := 0; round < rounds; round++ {
+		roundSeed := seed + int64(round)
+		dir, err := os.MkdirTemp(tempDir, "torture-")
+		if err != nil {
+			log.Printf("torture: failed to create round directory: %v", err)
+			return 1
+		}
+		name, torture := "hash index", hashindex.TortureHashIndex
+		if roundSeed%2 != 0 {
+			name, torture = "catalog log", engine.TortureCatalogWAL
+		}
+		crashed, err := torture(dir, roundSeed, logger)
+		if crashed {
+			crashes++
+		}
+		if err != nil {
+			failures++
+			log.Printf("torture: seed %d: %s: %v (files kept in %s)", roundSeed, name, err, dir)
+			continue
+		}
+		os.RemoveAll(dir)
+	}
+	log.Printf("torture: %d round(s) from seed %d: %d crashed before their work ended, %d failed to recover", rounds, seed, crashes, failures)
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
 // validateArguments validates the arguments and returns an error if invalid
 func validateArguments(args *settings.Arguments) error {
 	// Check if data directory exists and is accessible
@@ -200,6 +484,27 @@ func validateArguments(args *settings.Arguments) error {
 	if args.Port < 1 || args.Port > 65535 {
 		return fmt.Errorf("invalid port number: %d (must be between 1 and 65535)", args.Port)
 	}
+	if args.AdminPort < 0 || args.AdminPort > 65535 {
+		return fmt.Errorf("invalid admin port number: %d (must be between 1 and 65535, or 0 to disable)", args.AdminPort)
+	}
+	if args.AdminPort == args.Port {
+		return fmt.Errorf("-adminport must differ from -port")
+	}
+	if args.MongoPort < 0 || args.MongoPort > 65535 {
+		return fmt.Errorf("invalid MongoDB port number: %d (must be between 1 and 65535, or 0 to disable)", args.MongoPort)
+	}
+	if args.MongoPort != 0 && (args.MongoPort == args.Port || args.MongoPort == args.AdminPort) {
+		return fmt.Errorf("-mongoport must differ from -port and -adminport")
+	}
+	if args.MongoPort != 0 && args.AuthEnabled {
+		return fmt.Errorf("-mongoport cannot be used with -auth: MongoDB clients are not authenticated")
+	}
+	if args.GRPCPort < 0 || args.GRPCPort > 65535 {
+		return fmt.Errorf("invalid gRPC port number: %d (must be between 1 and 65535, or 0 to disable)", args.GRPCPort)
+	}
+	if args.GRPCPort != 0 && (args.GRPCPort == args.Port || args.GRPCPort == args.AdminPort || args.GRPCPort == args.MongoPort) {
+		return fmt.Errorf("-grpcport must differ from -port, -adminport and -mongoport")
+	}
 
 	// If config file is specified, check if it exists and is readable
 	if args.ConfigFile != "" {
@@ -214,6 +519,146 @@ func validateArguments(args *settings.Arguments) error {
 	if _, valid := validModes[args.Mode]; !valid {
 		return fmt.Errorf("invalid mode: %s (must be 'standalone' or 'cluster')", args.Mode)
 	}
+	if args.Mode == "cluster" && args.ClusterConfigFile == "" {
+		return fmt.Errorf("cluster mode requires -clusterconfig")
+	}
+	if (args.TLSCertFile == "") != (args.TLSKeyFile == "") {
+		return fmt.Errorf("-tlscert and -tlskey must be given together")
+	}
+	if args.MaxCommandSize <= 0 || args.MaxCommandSize > protocol.MaxFrameSize {
+		return fmt.Errorf("-maxcommandsize must be between 1 and %d bytes", int64(protocol.MaxFrameSize))
+	}
+	if args.MaxDocumentBytes < 0 || args.MaxDocumentFields < 0 || args.MaxDocumentDepth < 0 {
+		return fmt.Errorf("-maxdocumentbytes, -maxdocumentfields and -maxdocumentdepth cannot be negative")
+	}
+	if args.IdentifierCase != helpers.IdentifierCaseInsensitive && args.IdentifierCase != helpers.IdentifierCaseSensitive {
+		return fmt.Errorf("invalid -identifiercase: %s (must be '%s' or '%s')", args.IdentifierCase,
+			helpers.IdentifierCaseInsensitive, helpers.IdentifierCaseSensitive)
+	}
+	if args.VersionRetention < 0 {
+		return fmt.Errorf("-versionretention cannot be negative")
+	}
+	if args.RequestIDTTL < 0 {
+		return fmt.Errorf("-requestidttl cannot be negative")
+	}
+	if args.SessionGracePeriod < 0 {
+		return fmt.Errorf("-sessiongrace cannot be negative")
+	}
+	if args.AccessLogSampleRate < 0 || args.AccessLogSampleRate > 1 {
+		return fmt.Errorf("-accesslogsample must be between 0 and 1")
+	}
+	if args.SlowRequestThreshold < 0 {
+		return fmt.Errorf("-slowrequest cannot be negative")
+	}
+	if args.DeadlockCheckInterval < 0 {
+		return fmt.Errorf("-deadlockcheck cannot be negative")
+	}
+	if args.IndexUsageInterval < 0 {
+		return fmt.Errorf("-indexusageinterval cannot be negative")
+	}
+	if args.AutoAnalyzeInterval < 0 || args.AutoAnalyzeThreshold < 0 || args.AutoAnalyzeScale < 0 {
+		return fmt.Errorf("-autoanalyzeinterval, -autoanalyzethreshold and -autoanalyzescale cannot be negative")
+	}
+	if _, err := engine.ParseDurability(args.Durability); err != nil {
+		return fmt.Errorf("invalid -durability: %w", err)
+	}
+	if args.SyncInterval <= 0 {
+		return fmt.Errorf("-syncinterval must be positive")
+	}
+	if args.PlanCacheSize < 0 {
+		return fmt.Errorf("-plancachesize cannot be negative")
+	}
+	if args.HashFillFactor < 10 || args.HashFillFactor > 90 {
+		return fmt.Errorf("-hashfillfactor must be between 10 and 90")
+	}
+	if args.CDCSink != "" {
+		if err := (cdc.Config{Sink: args.CDCSink, Topic: args.CDCTopic, Format: args.CDCFormat}).Validate(); err != nil {
+			return err
+		}
+	}
+	for _, secret := range []struct{ flag, reference string }{{"userstorekey", args.UserStoreKey}, {"adminpassword", args.AdminPassword}} {
+		if _, err := settings.ResolveSecret(secret.reference); err != nil {
+			return fmt.Errorf("-%s: %w", secret.flag, err)
+		}
+	}
+	if args.AdminUser == "" {
+		return fmt.Errorf("-adminuser cannot be empty")
+	}
+	if args.PasswordMinLength < 1 {
+		return fmt.Errorf("-passwordminlength must be at least 1")
+	}
+	if args.PasswordMinClasses < 1 || args.PasswordMinClasses > 4 {
+		return fmt.Errorf("-passwordminclasses must be between 1 and 4")
+	}
+	if args.MaxFailedLogins < 0 {
+		return fmt.Errorf("-maxfailedlogins cannot be negative")
+	}
+	if args.MaxFailedLogins > 0 && args.LockoutDuration <= 0 {
+		return fmt.Errorf("-lockoutduration must be positive when -maxfailedlogins is set")
+	}
+	if args.PasswordMaxAge < 0 {
+		return fmt.Errorf("-passwordmaxage cannot be negative")
+	}
+	if args.AdminPassword != "" {
+		adminPassword, _ := settings.ResolveSecret(args.AdminPassword)
+		policy := auth.PasswordPolicy{MinLength: args.PasswordMinLength, MinClasses: args.PasswordMinClasses}
+		if err := policy.Check(args.AdminUser, adminPassword); err != nil {
+			return fmt.Errorf("-adminpassword: %w", err)
+		}
+	}
+	if err := (auth.ProviderConfig{
+		Providers:         args.AuthProviders,
+		LDAPURL:           args.LDAPURL,
+		LDAPUserDN:        args.LDAPUserDN,
+		OIDCIssuer:        args.OIDCIssuer,
+		OIDCAudience:      args.OIDCAudience,
+		OIDCJWKSURL:       args.OIDCJWKSURL,
+		OIDCUsernameClaim: args.OIDCUsernameClaim,
+	}).Validate(); err != nil {
+		return err
+	}
+	if slices.Contains(auth.ProviderConfig{Providers: args.AuthProviders}.Names(), auth.ProviderPeer) && args.Socket == "" {
+		return fmt.Errorf("the peer provider requires -socket")
+	}
+	if args.MaxDirtyRatio < 0 || args.MaxDirtyRatio > 1 {
+		return fmt.Errorf("-maxdirtyratio must be between 0 and 1")
+	}
+	if args.MaxWriteLatency < 0 {
+		return fmt.Errorf("-maxwritelatency cannot be negative")
+	}
+	if args.MaxBundleWrites < 0 {
+		return fmt.Errorf("-maxbundlewrites cannot be negative")
+	}
+	if args.BufferPoolMemory < 0 || args.SortMemory < 0 {
+		return fmt.Errorf("-bufferpoolmemory and -sortmemory cannot be negative")
+	}
+	if args.GoMaxProcs < 0 {
+		return fmt.Errorf("-gomaxprocs cannot be negative")
+	}
+	for _, pool := range []struct{ flag, size string }{
+		{"queryworkers", args.QueryWorkers},
+		{"indexworkers", args.IndexBuildWorkers},
+		{"writerworkers", args.WriterWorkers},
+		{"cdcworkers", args.CDCWorkers},
+	} {
+		if _, err := workers.ParseSize(pool.size); err != nil {
+			return fmt.Errorf("-%s: %w", pool.flag, err)
+		}
+	}
+	if args.InitDir != "" {
+		if info, err := os.Stat(args.InitDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("-initdir %s is not a readable directory", args.InitDir)
+		}
+	}
+	if args.FuzzQueries < 0 {
+		return fmt.Errorf("-fuzzqueries must not be negative")
+	}
+	if args.CrashTorture < 0 {
+		return fmt.Errorf("-crashtorture must not be negative")
+	}
+	if args.FsckRepair && !args.Fsck {
+		return fmt.Errorf("-repair requires -fsck")
+	}
 
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	//btreeindex "syndrdb/src/btree_index"
 	//hashindex "syndrdb/src/hash_index"
 
+	"context"
 	"time"
 )
 
@@ -24,6 +25,29 @@ type Database struct {
 	Bundles map[string]Bundle
 
 	DataDirectory string
+
+	// Defaults are copied into each bundle created in the database, for the settings its
+	// CREATE BUNDLE leaves out.
+	Defaults BundleDefaults
+
+	// Durability is when writes to the database's bundle files are synced to disk; empty
+	// leaves it to the server's -durability.
+	Durability Durability
+}
+
+// Durability is when writes to a database's files are synced to disk
+type Durability string
+
+const (
+	DurabilityAlways   Durability = "ALWAYS"   // Each file written is synced before the write returns
+	DurabilityInterval Durability = "INTERVAL" // Files written are synced every -syncinterval
+	DurabilityOff      Durability = "OFF"      // Syncing is left to the operating system
+)
+
+// BundleDefaults are the settings a database gives the bundles created in it
+type BundleDefaults struct {
+	// Limits fills in the limits a new bundle leaves at zero; zero here leaves them to the server's.
+	Limits DocumentLimits
 }
 
 type Bundle struct {
@@ -46,6 +70,104 @@ type Bundle struct {
 	Constraints   map[string]Constraint
 
 	Database *Database // Reference to the parent database
+
+	// Partitioning is nil for ordinary bundles. When set, documents are
+	// split across one data file per partition.
+	Partitioning *PartitionScheme
+
+	// FieldStatistics are gathered by ANALYZE BUNDLE, by field name. nil until
+	// the bundle is analyzed.
+	FieldStatistics map[string]FieldStatistics
+
+	// Aggregates are the aggregate bundles kept up to date from this bundle's documents.
+	Aggregates []AggregateDefinition
+
+	// AggregateOf names the source bundle when this bundle is an aggregate, and is
+	// empty otherwise. Aggregate bundles are only written through their source.
+	AggregateOf string
+
+	// Webhooks are the URLs notified of this bundle's document changes.
+	Webhooks []WebhookDefinition
+
+	// Limits bound the size and shape of the bundle's documents; a zero limit falls back
+	// to the server's.
+	Limits DocumentLimits
+
+	// Temporary bundles belong to one connection and are never written to disk.
+	Temporary bool `json:"-"`
+
+	// IndexFiles lets lookups read the bundle's index files; set by the bundle service on
+	// the bundles it holds (see engine.AttachIndexFiles). Copies of a bundle read postings.
+	IndexFiles interface{} `json:"-"`
+
+	// QueryCaches holds the plans and postings of the server that holds the bundle; set by
+	// the bundle service (see engine.AttachQueryCaches). Copies of a bundle share them.
+	QueryCaches interface{} `json:"-"`
+}
+
+// DocumentLimits bound a document before it is written
+type DocumentLimits struct {
+	// MaxBytes is the largest encoded document.
+	MaxBytes int64
+	// MaxFields counts the fields of nested objects too.
+	MaxFields int
+	// MaxDepth is how deeply objects and arrays may nest; a flat document is 1 deep.
+	MaxDepth int
+}
+
+// WebhookDefinition subscribes a URL to the document changes of a bundle
+type WebhookDefinition struct {
+	Name string
+	URL  string
+	// Events are the operations notified (INSERT, UPDATE, DELETE); every one when empty.
+	Events []string
+	// WhereClause limits notifications to matching documents, as written; empty for all.
+	WhereClause string
+	// Secret signs each delivery with HMAC-SHA256 when set.
+	Secret string
+	// MaxRetries is how many times a failed delivery is tried again, Backoff the first wait
+	// before doing so; each later wait is twice as long.
+	MaxRetries int
+	Backoff    time.Duration
+}
+
+// AggregateDefinition declares an aggregate bundle of per-group counts and sums
+type AggregateDefinition struct {
+	// Bundle is the aggregate bundle holding one document per group.
+	Bundle string
+	// GroupBy is the source field whose values form the groups.
+	GroupBy string
+	// SumFields are the numeric source fields totalled per group, besides the count.
+	SumFields []string
+}
+
+// FieldStatistics summarize the values of one field over a sample of documents
+type FieldStatistics struct {
+	SampledDocuments int
+	// NullFraction is the share of sampled documents where the field is missing or null.
+	NullFraction float64
+	// AverageWidth is the average size in bytes of the non-null values.
+	AverageWidth float64
+	// DistinctValues is the number of distinct non-null values in the sample.
+	DistinctValues int
+	// Histogram holds the bounds of equal-height buckets over the sampled values:
+	// about as many values fall between each pair of adjacent bounds. Only fields
+	// whose values are all numbers with at least two distinct values have one.
+	Histogram  []float64
+	AnalyzedAt time.Time
+}
+
+// PartitionScheme describes how a bundle's documents are split across partitions
+type PartitionScheme struct {
+	// Strategy is "RANGE" or "HASH".
+	Strategy string
+	// Field is the partition key.
+	Field string
+	// Boundaries are the exclusive upper bounds of each RANGE partition, in
+	// ascending order. There is always one more partition than boundaries.
+	Boundaries []interface{}
+	// PartitionCount is the number of partitions.
+	PartitionCount int
 }
 
 type DocumentStructure struct {
@@ -65,6 +187,7 @@ type FieldDefinition struct {
 	IsRequired   bool // Indicates if the field can be null
 	IsUnique     bool
 	DefaultValue interface{} // Optional default value for the field
+	Expression   string      // For an index field computed from others, its canonical text, which Name repeats
 }
 
 type Field struct {
@@ -105,7 +228,7 @@ type Relationship struct {
 
 // IndexService defines the interface for any index implementation
 type IndexService interface {
-	CreateIndex(bundle *Bundle, fieldName string, isUnique bool) (string, error)
+	CreateIndex(ctx context.Context, bundle *Bundle, fieldName string, isUnique bool) (string, error)
 	SearchIndex(indexName string, key interface{}) ([]string, error)
 	ListIndexes(bundleID string) ([]string, error)
 	DropIndex(indexName string) error
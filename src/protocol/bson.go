@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+)
+
+/*
+	BSON responses.
+
+	With format=bson every response is a BSON document, for clients from the MongoDB
+	ecosystem that already decode BSON. Results are encoded straight from the values the
+	command returned, the way documents are written to bundle files, so dates stay BSON
+	datetimes, binary fields stay binary and 64-bit integers stay integers instead of passing
+	through JSON. Keys are named as in the JSON responses. A result that is not a document,
+	such as a list or a plain text message, is sent as {"Result": <value>}.
+*/
+
+// bsonRegistry encodes structs with the field names encoding/json would use
+var bsonRegistry = func() *bsoncodec.Registry {
+	registry := bson.NewRegistry()
+	structCodec, err := bsoncodec.NewStructCodec(jsonFieldNames)
+	if err != nil {
+		panic(err)
+	}
+	registry.RegisterKindEncoder(reflect.Struct, structCodec)
+	return registry
+}()
+
+// jsonFieldNames names a struct field after its json tag, or its Go name without one
+var jsonFieldNames bsoncodec.StructTagParserFunc = func(field reflect.StructField) (bsoncodec.StructTags, error) {
+	name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" && options == "" {
+		return bsoncodec.StructTags{Skip: true}, nil
+	}
+	tags := bsoncodec.StructTags{Name: name, OmitEmpty: strings.Contains(","+options+",", ",omitempty,")}
+	if name == "" {
+		tags.Name = field.Name
+		tags.Inline = field.Anonymous && field.Type.Kind() == reflect.Struct
+	}
+	return tags, nil
+}
+
+// MarshalBSON encodes a response as a BSON document
+func MarshalBSON(value interface{}) ([]byte, error) {
+	if !isBSONDocument(value) {
+		value = bson.D{{Key: "Result", Value: value}}
+	}
+	var buf bytes.Buffer
+	writer, err := bsonrw.NewBSONValueWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := bson.NewEncoder(writer)
+	if err != nil {
+		return nil, err
+	}
+	if err := encoder.SetRegistry(bsonRegistry); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(value); err != nil {
+		return nil, fmt.Errorf("encoding BSON: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// isBSONDocument reports whether a value encodes as a document: a map, a bson.D or a struct
+// without an encoder of its own, as time.Time has
+func isBSONDocument(value interface{}) bool {
+	if _, ok := value.(bson.D); ok {
+		return true
+	}
+	kind := reflect.TypeOf(value)
+	for kind != nil && kind.Kind() == reflect.Pointer {
+		kind = kind.Elem()
+	}
+	if kind == nil {
+		return false
+	}
+	if kind.Kind() == reflect.Map {
+		return true
+	}
+	encoder, err := bsonRegistry.LookupEncoder(kind)
+	_, isStruct := encoder.(*bsoncodec.StructCodec)
+	return err == nil && isStruct
+}
+
+// JSONToBSON converts a JSON object to a BSON document with the same keys in the same
+// order; any other JSON value, or text that is not JSON, is sent as {"Result": <value>}
+func JSONToBSON(data []byte) ([]byte, error) {
+	if !json.Valid(data) {
+		return MarshalBSON(string(data))
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var document bson.D
+		if err := bson.UnmarshalExtJSON(data, false, &document); err != nil {
+			return nil, fmt.Errorf("converting JSON to BSON: %w", err)
+		}
+		return MarshalBSON(document)
+	}
+	var value bson.D
+	if err := bson.UnmarshalExtJSON([]byte(`{"Result":`+string(data)+`}`), false, &value); err != nil {
+		return nil, fmt.Errorf("converting JSON to BSON: %w", err)
+	}
+	return MarshalBSON(value)
+}
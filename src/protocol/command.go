@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Command is a command sent with positional parameters. It travels as JSON in place of the
+// command text, as a line or a frame; the server binds Params to the $1, $2, ... in
+// Command before running it, so the values never have to be written into the SyndrQL.
+type Command struct {
+	Command string        `json:"command"`
+	Params  []interface{} `json:"params"`
+}
+
+// IsCommand reports whether a message is a Command rather than plain SyndrQL, which
+// never starts with "{"
+func IsCommand(message string) bool {
+	return strings.HasPrefix(message, "{")
+}
+
+// ParseCommand decodes a Command, keeping numbers as json.Number so integers too large
+// for a float64 arrive intact
+func ParseCommand(message string) (*Command, error) {
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	var command Command
+	if err := decoder.Decode(&command); err != nil {
+		return nil, Errorf(ErrParameter, "invalid command message: %w", err)
+	}
+	if strings.TrimSpace(command.Command) == "" {
+		return nil, Errorf(ErrParameter, "command message has no command")
+	}
+	return &command, nil
+}
+
+// MarshalCommand encodes a command and its parameters as one message
+func MarshalCommand(command string, params []interface{}) ([]byte, error) {
+	message, err := json.Marshal(Command{Command: command, Params: params})
+	if err != nil {
+		return nil, fmt.Errorf("cannot send parameters: %w", err)
+	}
+	return message, nil
+}
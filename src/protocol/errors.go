@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrorCode names the kind of failure an error response reports, so clients can branch on it
+// rather than on the message, which is meant for people and may change. Every error response
+// carries one as "code". The thousands group the codes:
+//
+//	1xxx  something named does not exist
+//	2xxx  the data refuses a write
+//	3xxx  the command itself is wrong
+//	4xxx  the client may not do this
+//	5xxx  the server cannot do this now; the retryable ones may succeed later, see Retryable
+//	9xxx  anything else
+type ErrorCode string
+
+const (
+	ErrDatabaseNotFound ErrorCode = "SDB-1000"
+	ErrBundleNotFound   ErrorCode = "SDB-1001"
+	ErrDocumentNotFound ErrorCode = "SDB-1002"
+
+	ErrAlreadyExists      ErrorCode = "SDB-2001" // A database or bundle of that name exists
+	ErrDocumentLimit      ErrorCode = "SDB-2002" // Over one of the bundle's LIMITS
+	ErrUniqueViolation    ErrorCode = "SDB-2003"
+	ErrBundleHasAggregate ErrorCode = "SDB-2004" // Aggregates depend on the bundle; delete them first
+
+	ErrParse            ErrorCode = "SDB-3001"
+	ErrCommandTooLarge  ErrorCode = "SDB-3002"
+	ErrConnectionString ErrorCode = "SDB-3003"
+	ErrParameter        ErrorCode = "SDB-3004" // The params sent with a command do not match its $n placeholders
+
+	ErrAuthentication   ErrorCode = "SDB-4001"
+	ErrPermissionDenied ErrorCode = "SDB-4002"
+	ErrPasswordExpired  ErrorCode = "SDB-4003"
+	ErrAdminPortOnly    ErrorCode = "SDB-4004"
+	ErrResourceLimit    ErrorCode = "SDB-4005" // Over a limit of the connection's resource group
+
+	ErrThrottled       ErrorCode = "SDB-5001" // Carries retry_after_ms
+	ErrMaintenance     ErrorCode = "SDB-5002" // Carries retry_after_ms
+	ErrReadOnly        ErrorCode = "SDB-5003" // ALTER SYSTEM SET read_only is on
+	ErrReadOnlyReplica ErrorCode = "SDB-5004" // A hot standby; send writes to the primary it names
+	ErrDeadlock        ErrorCode = "SDB-5005" // The transaction was rolled back; run it again
+	ErrBundleSuspect   ErrorCode = "SDB-5006" // Writes wait for CHECK DATABASE
+
+	ErrLeaderUnavailable ErrorCode = "SDB-5007" // No cluster leader is elected, or it could not be reached
+	ErrCommitUncertain   ErrorCode = "SDB-5008" // The cluster did not confirm the command in time; it may still be applied
+	ErrBufferPoolFull    ErrorCode = "SDB-5009" // Every buffer is in use
+	ErrNodeUnavailable   ErrorCode = "SDB-5010" // A node holding partitions a query needed did not answer
+	ErrNewerFormat       ErrorCode = "SDB-5011" // A data file was written by a newer server
+
+	ErrCommandFailed ErrorCode = "SDB-9000" // Not classified further
+	ErrInternal      ErrorCode = "SDB-9001" // The command panicked, or its result could not be encoded
+	ErrIdleTimeout   ErrorCode = "SDB-9002" // No command came within the connection's read timeout; it is closed
+)
+
+// retryAfter is how long to wait before sending a command again after a retryable error,
+// unless the error says otherwise
+var retryAfter = map[ErrorCode]time.Duration{
+	ErrThrottled:         50 * time.Millisecond,
+	ErrMaintenance:       30 * time.Second,
+	ErrLeaderUnavailable: 500 * time.Millisecond, // About one election
+	ErrCommitUncertain:   200 * time.Millisecond,
+	ErrBufferPoolFull:    50 * time.Millisecond,
+	ErrNodeUnavailable:   200 * time.Millisecond,
+}
+
+// Retryable reports whether the same command may succeed when sent again after a while,
+// without changing anything first. Error responses say so with "retryable": true and carry
+// retry_after_ms. A write may have been applied before ErrCommitUncertain, so writes are
+// only safe to retry with the same REQUEST ID.
+func Retryable(code ErrorCode) bool {
+	_, retryable := retryAfter[code]
+	return retryable
+}
+
+// RetryAfter is how long to wait before retrying after err: what the outermost error in its
+// chain that knows asks for, or the usual wait for its code. It is 0 when err is not retryable.
+func RetryAfter(err error) time.Duration {
+	if !Retryable(CodeOf(err)) {
+		return 0
+	}
+	var hinted interface{ RetryHint() time.Duration }
+	if errors.As(err, &hinted) {
+		return hinted.RetryHint()
+	}
+	return retryAfter[CodeOf(err)]
+}
+
+// CodedError is an error that knows its code
+type CodedError interface {
+	error
+	ErrorCode() ErrorCode
+}
+
+// codedError gives an error without a code of its own one
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *codedError) Error() string        { return e.err.Error() }
+func (e *codedError) Unwrap() error        { return e.err }
+func (e *codedError) ErrorCode() ErrorCode { return e.code }
+
+// Errorf formats an error as fmt.Errorf does, with a code
+func Errorf(code ErrorCode, format string, args ...interface{}) error {
+	return &codedError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// WithCode gives err a code, which wins over any code of the errors it wraps
+func WithCode(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// CodeOf returns the code of the outermost error in err's chain that has one, and
+// ErrCommandFailed when none does
+func CodeOf(err error) ErrorCode {
+	var coded CodedError
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	return ErrCommandFailed
+}
@@ -0,0 +1,82 @@
+// Package protocol holds the wire format shared by the server and its clients.
+//
+// Version 1 is newline delimited text: one command per line, one JSON response per line.
+// Version 2 is negotiated with protocol=2 in the connection string. The connection string
+// and its response still travel as lines; after that every command and response is a
+// frame: a 4-byte big-endian payload length followed by the payload, so payloads may
+// contain newlines.
+//
+// In either version, a client that sets notices=true in its connection string may also be
+// sent notices (see notice.go) between responses, without having asked for anything, and
+// one that sets metadata=true is sent the fields of a SELECT's documents ahead of its
+// response (see metadata.go). Every error response carries a code (see errors.go). A
+// command may be sent with positional parameters as a JSON Command (see command.go).
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	VersionLine   = 1
+	VersionFramed = 2
+
+	// DefaultMaxFrameSize bounds a single frame unless the reader asks for another limit
+	DefaultMaxFrameSize = 64 * 1024 * 1024
+	// MaxFrameSize is the largest payload a 4-byte length can describe
+	MaxFrameSize = 1<<32 - 1
+
+	frameHeaderSize = 4
+)
+
+// ErrFrameTooLarge is returned when a frame header announces more than the reader accepts
+type ErrFrameTooLarge struct {
+	Size  uint32
+	Limit int
+}
+
+func (e *ErrFrameTooLarge) Error() string {
+	return fmt.Sprintf("frame of %d bytes exceeds the %d byte limit", e.Size, e.Limit)
+}
+
+// WriteFrame writes one length-prefixed payload
+func WriteFrame(w io.Writer, payload []byte) error {
+	if uint64(len(payload)) > MaxFrameSize {
+		return fmt.Errorf("payload of %d bytes is too large for a frame", len(payload))
+	}
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadFrame reads one length-prefixed payload, refusing frames larger than maxSize
+// (DefaultMaxFrameSize when maxSize is 0 or less)
+func ReadFrame(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if uint64(size) > uint64(maxSize) {
+		return nil, &ErrFrameTooLarge{Size: size, Limit: maxSize}
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,26 @@
+package protocol
+
+// MetadataStatus marks result metadata, as "success" and "error" mark responses
+const MetadataStatus = "metadata"
+
+// Metadata describes the fields of the documents a result holds, as their bundle declares
+// them. A client that set metadata=true in its connection string is sent it as a line or
+// frame of its own just before the response to a SELECT DOCUMENTS or SELECT DISTINCT;
+// Status comes first, so its payload starts with MetadataPrefix.
+type Metadata struct {
+	Status string          `json:"status"`
+	Bundle string          `json:"bundle"`
+	Fields []FieldMetadata `json:"fields"`
+}
+
+// FieldMetadata is one declared field of a bundle
+type FieldMetadata struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"` // As declared in CREATE BUNDLE, such as STRING or INT
+	Required bool   `json:"required"`
+	Unique   bool   `json:"unique"`
+	Masked   string `json:"masked,omitempty"` // The mask the connection sees the field's values through, see server/masking.go
+}
+
+// MetadataPrefix starts the payload of all result metadata
+const MetadataPrefix = `{"status":"` + MetadataStatus + `"`
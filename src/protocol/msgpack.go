@@ -0,0 +1,367 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+/*
+	Response formats.
+
+	A client picks how responses are encoded with format= in its connection string:
+
+	  - json: compact JSON, the default
+	  - pretty: indented JSON, for people reading responses; with protocol 1 a response then
+	    spans several lines. Notices and metadata stay compact, so they still start with
+	    NoticePrefix and MetadataPrefix.
+	  - msgpack: MessagePack (https://msgpack.org), smaller than JSON and quicker for drivers
+	    to decode; it is binary, so it needs protocol=2
+	  - bson: BSON documents, see bson.go; binary too
+
+	A MessagePack payload holds exactly what the JSON one would, converted value by value:
+	objects become maps with string keys in the same order, whole numbers integers, other
+	numbers 64-bit floats, and results that are plain text strings. Notices and result
+	metadata are converted too. The connection string and its response are JSON lines in
+	every format.
+*/
+
+// Response formats a connection string may ask for
+const (
+	FormatJSON       = "json"
+	FormatPrettyJSON = "pretty"
+	FormatMsgpack    = "msgpack"
+	FormatBSON       = "bson"
+)
+
+// JSONToMsgpack converts a JSON document to the MessagePack encoding of the same value
+func JSONToMsgpack(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	encoded, err := appendMsgpackValue(nil, decoder)
+	if err != nil {
+		return nil, fmt.Errorf("converting JSON to MessagePack: %w", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("converting JSON to MessagePack: data after the JSON value")
+	}
+	return encoded, nil
+}
+
+// MsgpackString encodes a string as MessagePack, for results that are plain text
+func MsgpackString(s string) []byte {
+	return appendMsgpackString(nil, s)
+}
+
+// appendMsgpackValue reads the next JSON value from decoder and appends its encoding. Maps
+// and arrays are encoded into a buffer of their own first, since their headers hold the
+// number of entries.
+func appendMsgpackValue(buf []byte, decoder *json.Decoder) ([]byte, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch value := token.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if value {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case string:
+		return appendMsgpackString(buf, value), nil
+	case json.Number:
+		if integer, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			return appendMsgpackInt(buf, integer), nil
+		}
+		if integer, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return binary.BigEndian.AppendUint64(append(buf, 0xcf), integer), nil
+		}
+		float, err := value.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(float)), nil
+	case json.Delim:
+		var entries []byte
+		count := 0
+		for decoder.More() {
+			if value == '{' {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				entries = appendMsgpackString(entries, key.(string))
+			}
+			if entries, err = appendMsgpackValue(entries, decoder); err != nil {
+				return nil, err
+			}
+			count++
+		}
+		if _, err := decoder.Token(); err != nil { // The closing delimiter
+			return nil, err
+		}
+		if value == '{' {
+			buf = appendMsgpackHeader(buf, count, 0x80, 0xde, 0xdf)
+		} else {
+			buf = appendMsgpackHeader(buf, count, 0x90, 0xdc, 0xdd)
+		}
+		return append(buf, entries...), nil
+	}
+	return nil, fmt.Errorf("unexpected JSON token %v", token)
+}
+
+func appendMsgpackInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(buf, byte(n))
+	case n < 0 && n >= -32:
+		return append(buf, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), uint64(n))
+	case n >= math.MinInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n <= 31:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+// appendMsgpackHeader writes the header of a map or array of count entries: the fix form
+// for up to 15 entries, then the 16 and 32-bit forms
+func appendMsgpackHeader(buf []byte, count int, fix, code16, code32 byte) []byte {
+	switch {
+	case count <= 15:
+		return append(buf, fix|byte(count))
+	case count <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, code16), uint16(count))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, code32), uint32(count))
+}
+
+// MsgpackToJSON converts a MessagePack value to JSON, for clients that handle responses as
+// JSON. Map keys that are not strings are written as strings; binary data is base64, as
+// encoding/json writes []byte.
+func MsgpackToJSON(data []byte) ([]byte, error) {
+	reader := &msgpackReader{data: data}
+	var out bytes.Buffer
+	if err := reader.writeJSON(&out); err != nil {
+		return nil, fmt.Errorf("converting MessagePack to JSON: %w", err)
+	}
+	if reader.pos != len(data) {
+		return nil, fmt.Errorf("converting MessagePack to JSON: data after the value")
+	}
+	return out.Bytes(), nil
+}
+
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	chunk := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return chunk, nil
+}
+
+// length reads a big-endian length of size bytes
+func (r *msgpackReader) length(size int) (int, error) {
+	chunk, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(chunk[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(chunk)), nil
+	}
+	return int(binary.BigEndian.Uint32(chunk)), nil
+}
+
+func (r *msgpackReader) writeJSON(out *bytes.Buffer) error {
+	head, err := r.next(1)
+	if err != nil {
+		return err
+	}
+	code := head[0]
+	switch {
+	case code <= 0x7f:
+		out.WriteString(strconv.Itoa(int(code)))
+		return nil
+	case code >= 0xe0:
+		out.WriteString(strconv.Itoa(int(int8(code))))
+		return nil
+	case code&0xe0 == 0xa0:
+		return r.writeString(out, int(code&0x1f))
+	case code&0xf0 == 0x90:
+		return r.writeArray(out, int(code&0x0f))
+	case code&0xf0 == 0x80:
+		return r.writeMap(out, int(code&0x0f))
+	}
+
+	switch code {
+	case 0xc0:
+		out.WriteString("null")
+	case 0xc2:
+		out.WriteString("false")
+	case 0xc3:
+		out.WriteString("true")
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		chunk, err := r.next(1 << (code - 0xcc))
+		if err != nil {
+			return err
+		}
+		var n uint64
+		for _, b := range chunk {
+			n = n<<8 | uint64(b)
+		}
+		out.WriteString(strconv.FormatUint(n, 10))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		chunk, err := r.next(1 << (code - 0xd0))
+		if err != nil {
+			return err
+		}
+		var n uint64
+		for _, b := range chunk {
+			n = n<<8 | uint64(b)
+		}
+		shift := 64 - 8*len(chunk)
+		out.WriteString(strconv.FormatInt(int64(n<<shift)>>shift, 10))
+	case 0xca:
+		chunk, err := r.next(4)
+		if err != nil {
+			return err
+		}
+		writeJSONFloat(out, float64(math.Float32frombits(binary.BigEndian.Uint32(chunk))))
+	case 0xcb:
+		chunk, err := r.next(8)
+		if err != nil {
+			return err
+		}
+		writeJSONFloat(out, math.Float64frombits(binary.BigEndian.Uint64(chunk)))
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.length(1 << (code - 0xd9))
+		if err != nil {
+			return err
+		}
+		return r.writeString(out, n)
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.length(1 << (code - 0xc4))
+		if err != nil {
+			return err
+		}
+		chunk, err := r.next(n)
+		if err != nil {
+			return err
+		}
+		encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString(chunk))
+		out.Write(encoded)
+	case 0xdc, 0xdd:
+		n, err := r.length(2 << (code - 0xdc))
+		if err != nil {
+			return err
+		}
+		return r.writeArray(out, n)
+	case 0xde, 0xdf:
+		n, err := r.length(2 << (code - 0xde))
+		if err != nil {
+			return err
+		}
+		return r.writeMap(out, n)
+	default:
+		return fmt.Errorf("unsupported MessagePack type 0x%02x", code)
+	}
+	return nil
+}
+
+func (r *msgpackReader) writeString(out *bytes.Buffer, n int) error {
+	chunk, err := r.next(n)
+	if err != nil {
+		return err
+	}
+	encoded, _ := json.Marshal(string(chunk))
+	out.Write(encoded)
+	return nil
+}
+
+func (r *msgpackReader) writeArray(out *bytes.Buffer, n int) error {
+	out.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if err := r.writeJSON(out); err != nil {
+			return err
+		}
+	}
+	out.WriteByte(']')
+	return nil
+}
+
+func (r *msgpackReader) writeMap(out *bytes.Buffer, n int) error {
+	out.WriteByte('{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		var key bytes.Buffer
+		if err := r.writeJSON(&key); err != nil {
+			return err
+		}
+		if key.Len() > 0 && key.Bytes()[0] == '"' {
+			out.Write(key.Bytes())
+		} else {
+			encoded, _ := json.Marshal(key.String())
+			out.Write(encoded)
+		}
+		out.WriteByte(':')
+		if err := r.writeJSON(out); err != nil {
+			return err
+		}
+	}
+	out.WriteByte('}')
+	return nil
+}
+
+// writeJSONFloat writes a float as encoding/json would; JSON has no NaN or infinities
+func writeJSONFloat(out *bytes.Buffer, f float64) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		out.WriteString("null")
+		return
+	}
+	encoded, _ := json.Marshal(f)
+	out.Write(encoded)
+}
@@ -0,0 +1,33 @@
+package protocol
+
+import "time"
+
+// NoticeStatus marks a notice, as "success" and "error" mark responses
+const NoticeStatus = "notice"
+
+// Events a notice reports
+const (
+	NoticeMaintenance = "maintenance" // The server entered or left maintenance mode
+	NoticeShutdown    = "shutdown"    // The server is stopping; the connection closes next
+	NoticeRoleChange  = "role_change" // The node became the raft leader or a follower, or follows a new leader
+	NoticeSlowCommand = "slow_query"  // A command of this session took at least the server's -slowrequest
+)
+
+// Notice is a message the server sends without being asked, between responses, to a client
+// that set notices=true in its connection string. It travels as a line or frame like a
+// response; Status comes first, so a notice's payload starts with NoticePrefix.
+type Notice struct {
+	Status  string                 `json:"status"`
+	Event   string                 `json:"event"`
+	Message string                 `json:"message"`
+	Time    time.Time              `json:"time"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// NoticePrefix starts the payload of every notice
+const NoticePrefix = `{"status":"` + NoticeStatus + `"`
+
+// NewNotice returns a notice of an event that happens now
+func NewNotice(event, message string, details map[string]interface{}) Notice {
+	return Notice{Status: NoticeStatus, Event: event, Message: message, Time: time.Now().UTC(), Details: details}
+}
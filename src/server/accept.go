@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+	Accepting connections.
+
+	One listener with one accept goroutine takes every new connection, which is plenty until
+	clients connect and disconnect by the thousands per second, as behind a load balancer
+	that checks health with fresh connections. With -reuseport the server opens one listener
+	per CPU Go may use on the same address, each with the SO_REUSEPORT socket option and its
+	own accept goroutine, and the kernel spreads new connections over them. Connections
+	behave the same whichever listener took them.
+
+	SHOW METRICS reports, under Accept, how many listeners take connections, how many
+	connections were accepted since the server started, how many accepts failed, and the
+	rate of new connections per second over the last minute.
+*/
+
+// acceptRateWindow is how many seconds the accept rate is averaged over
+const acceptRateWindow = 60
+
+// acceptStats counts accepted connections, in total and per second of the last minute
+type acceptStats struct {
+	listeners atomic.Int32
+	accepted  atomic.Uint64
+	failed    atomic.Uint64
+	buckets   [acceptRateWindow]acceptBucket
+}
+
+// acceptBucket counts the connections accepted in one second
+type acceptBucket struct {
+	second atomic.Int64
+	count  atomic.Uint64
+}
+
+// record counts an accepted connection. A bucket reused for a new second is reset without a
+// lock, so an accept racing the reset may go uncounted in the rate, never in the total.
+func (a *acceptStats) record(now time.Time) {
+	a.accepted.Add(1)
+	second := now.Unix()
+	bucket := &a.buckets[second%acceptRateWindow]
+	if old := bucket.second.Load(); old != second && bucket.second.CompareAndSwap(old, second) {
+		bucket.count.Store(0)
+	}
+	bucket.count.Add(1)
+}
+
+// AcceptStats is the Accept section of SHOW METRICS
+type AcceptStats struct {
+	Listeners     int
+	ReusePort     bool
+	Accepted      uint64  // Connections since the server started
+	Failed        uint64  // Accepts that returned an error
+	RatePerSecond float64 // New connections per second over the last minute
+}
+
+func (a *acceptStats) stats(reusePort bool, now time.Time) AcceptStats {
+	var recent uint64
+	current := now.Unix()
+	for i := range a.buckets {
+		if second := a.buckets[i].second.Load(); second > current-acceptRateWindow && second <= current {
+			recent += a.buckets[i].count.Load()
+		}
+	}
+	return AcceptStats{
+		Listeners:     int(a.listeners.Load()),
+		ReusePort:     reusePort,
+		Accepted:      a.accepted.Load(),
+		Failed:        a.failed.Load(),
+		RatePerSecond: float64(recent) / acceptRateWindow,
+	}
+}
+
+// listen opens the listeners clients connect to: one, or with -reuseport one per CPU
+func (s *Server) listen(address string) ([]net.Listener, error) {
+	if !s.config.ReusePort {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+
+	config := net.ListenConfig{Control: func(network, address string, conn syscall.RawConn) error {
+		var optErr error
+		if err := conn.Control(func(fd uintptr) {
+			optErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); err != nil {
+			return err
+		}
+		return optErr
+	}}
+	listeners := make([]net.Listener, 0, runtime.GOMAXPROCS(0))
+	for range runtime.GOMAXPROCS(0) {
+		listener, err := config.Listen(context.Background(), "tcp", address)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("SO_REUSEPORT listener: %w", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// closeListeners closes the listeners clients connect to, returning the first error
+func (s *Server) closeListeners() error {
+	var first error
+	for _, listener := range s.listeners {
+		if err := listener.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"math/rand"
+	"strings"
+	"syndrdb/src/engine"
+	"syndrdb/src/protocol"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Access log.
+
+	Every command a client runs is timed and, if picked, logged as one line with its method,
+	bundle, duration, rows, response bytes and outcome. Failed commands and those slower than
+	the slow threshold are always logged; the rest are logged at the sample rate (0.01 logs one
+	in a hundred), so the log stays small on a busy server but still shows what it is doing.
+	Each line carries the rate it was sampled at, so counts can be scaled back up.
+*/
+
+// accessLog decides which commands are logged and logs them
+type accessLog struct {
+	sampleRate    float64       // Share of fast, successful commands logged, 0 to 1
+	slowThreshold time.Duration // Commands at least this slow are always logged; 0 never counts as slow
+	logger        *zap.SugaredLogger
+
+	// Told of every slow command, after its response went out
+	onSlow func(conn *Connection, method, bundle string, elapsed, threshold time.Duration)
+}
+
+func newAccessLog(sampleRate float64, slowThreshold time.Duration, logger *zap.SugaredLogger) *accessLog {
+	return &accessLog{sampleRate: sampleRate, slowThreshold: slowThreshold, logger: logger}
+}
+
+// run runs a command and sends its response, logging it if it is picked
+func (l *accessLog) run(conn *Connection, writer *messageWriter, command string, execute func() (interface{}, error), respond func(interface{}, error)) {
+	started := time.Now()
+	result, err := execute()
+	elapsed := time.Since(started)
+
+	written := writer.written
+	respond(result, err)
+	bytes := writer.written - written
+
+	slow := l.slowThreshold > 0 && elapsed >= l.slowThreshold
+	if err == nil && !slow && (l.sampleRate <= 0 || rand.Float64() >= l.sampleRate) {
+		return
+	}
+
+	method, bundle := describeCommand(command)
+	fields := []interface{}{
+		"connID", conn.ID,
+		"user", conn.User,
+		"database", conn.DatabaseName,
+		"method", method,
+		"bundle", bundle,
+		"durationMs", float64(elapsed.Microseconds()) / 1000,
+		"rows", resultRows(result),
+		"bytes", bytes,
+	}
+	switch {
+	case err != nil:
+		l.logger.Warnw("Request", append(fields, "outcome", "error", "code", protocol.CodeOf(err), "error", err, "sampleRate", 1)...)
+	case slow:
+		l.logger.Warnw("Request", append(fields, "outcome", "slow", "sampleRate", 1)...)
+	default:
+		l.logger.Infow("Request", append(fields, "outcome", "ok", "sampleRate", l.sampleRate)...)
+	}
+	if slow && l.onSlow != nil {
+		l.onSlow(conn, method, bundle, elapsed, l.slowThreshold)
+	}
+}
+
+// describeCommand returns the kind of statement a command is and the bundle it works on,
+// either empty when the command does not say
+func describeCommand(command string) (string, string) {
+	if _, rest, err := engine.CutRequestID(command); err == nil {
+		command = rest
+	}
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		// Server commands such as SHOW METRICS are not statements; their keywords name them
+		var keywords []string
+		for _, field := range strings.Fields(strings.TrimSuffix(command, ";")) {
+			if strings.ContainsAny(field, "\"'(=") || len(keywords) == 3 {
+				break
+			}
+			keywords = append(keywords, strings.ToUpper(field))
+		}
+		return strings.Join(keywords, " "), ""
+	}
+
+	return engine.StatementName(statement), engine.StatementBundle(statement)
+}
+
+// resultRows returns how many rows or documents a result holds
+func resultRows(result interface{}) int {
+	switch typed := result.(type) {
+	case *engine.CommandResponse:
+		if typed != nil {
+			return typed.ResultCount
+		}
+	case engine.CommandResponse:
+		return typed.ResultCount
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+/*
+	Admin port.
+
+	The commands that change or expose the whole server can be kept off the port clients use:
+	with -adminport, the server also listens on -adminhost:-adminport, by default on the
+	loopback interface, and refuses ALTER SYSTEM, SECRETS ROTATE, DIAGNOSTICS DUMP and
+	DIAGNOSTICS BUFFERPOOL on any other connection. Bind it to loopback or an internal interface and expose only -port, so a
+	client that gets hold of the data port, even with the admin's credentials, cannot switch
+	the server into read-only or maintenance mode, rotate its secrets or dump its internals.
+
+	The admin port speaks the same protocol as -port, with the same authentication and TLS,
+	and answers every other command too. Without -adminport nothing changes. Connections from
+	the server's own process (see local.go) count as connected to the admin port.
+*/
+
+// adminCommands are the commands accepted only on the admin port, when there is one
+var adminCommands = [][]string{
+	{"ALTER", "SYSTEM"},
+	{"SECRETS", "ROTATE"},
+	{"DIAGNOSTICS", "DUMP"},
+	{"DIAGNOSTICS", "BUFFERPOOL"},
+}
+
+// isAdminCommand reports whether a command is kept to the admin port
+func isAdminCommand(command string) bool {
+	return adminCommandName(command) != ""
+}
+
+// adminCommandName returns the name of an admin command, empty for any other command
+func adminCommandName(command string) string {
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(command), ";"))
+	for _, words := range adminCommands {
+		if len(fields) < len(words) {
+			continue
+		}
+		matches := true
+		for i, word := range words {
+			matches = matches && strings.EqualFold(fields[i], word)
+		}
+		if matches {
+			return strings.Join(words, " ")
+		}
+	}
+	return ""
+}
+
+// startAdminListener starts accepting connections on the admin port
+func (s *Server) startAdminListener() error {
+	address := net.JoinHostPort(s.config.AdminHost, fmt.Sprint(s.config.AdminPort))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error starting admin listener on %s: %w", address, err)
+	}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.adminListener = listener
+	s.logger.Infof("Admin commands are only accepted on %s", address)
+
+	go s.acceptConnections(listener, true)
+	return nil
+}
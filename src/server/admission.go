@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"syndrdb/src/buffermgr"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
+	"syndrdb/src/settings"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Write admission control.
+
+	Writes are admitted only while the storage layer keeps up. A write is refused, rather than
+	queued, when
+	  - more than MaxDirtyRatio of the buffer pool holds pages not yet written to disk,
+	  - the moving average of a page write exceeds MaxWriteLatency, or
+	  - MaxBundleWrites writes are already running against the same bundle.
+	The client gets a ThrottledError carrying how long to wait before retrying. Reads are never
+	throttled. A refused write has not been applied, so retrying it with the same request ID is safe.
+*/
+
+const (
+	minRetryAfter = 50 * time.Millisecond
+	maxRetryAfter = 5 * time.Second
+)
+
+// ThrottledError refuses a write while the server is saturated
+type ThrottledError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("write throttled: %s; retry after %dms", e.Reason, e.RetryAfter.Milliseconds())
+}
+
+func (e *ThrottledError) ErrorCode() protocol.ErrorCode { return protocol.ErrThrottled }
+func (e *ThrottledError) RetryHint() time.Duration      { return e.RetryAfter }
+
+type admissionControl struct {
+	maxDirtyRatio   float64
+	maxWriteLatency time.Duration
+	maxBundleWrites int
+
+	bufferPool  *buffermgr.BufferPool
+	identifiers helpers.Identifiers
+	logger      *zap.SugaredLogger
+	flushing    atomic.Bool // A background flush started by the dirty-ratio check is running
+
+	mu       sync.Mutex
+	inFlight map[string]int // Running writes per database and bundle
+}
+
+func newAdmissionControl(config *settings.Arguments, bufferPool *buffermgr.BufferPool, identifiers helpers.Identifiers, logger *zap.SugaredLogger) *admissionControl {
+	return &admissionControl{
+		maxDirtyRatio:   config.MaxDirtyRatio,
+		maxWriteLatency: config.MaxWriteLatency,
+		maxBundleWrites: config.MaxBundleWrites,
+		bufferPool:      bufferPool,
+		identifiers:     identifiers,
+		logger:          logger,
+		inFlight:        make(map[string]int),
+	}
+}
+
+// admit decides whether a write may run now. On success the returned release must be called
+// once the write is done.
+func (a *admissionControl) admit(database, command string) (func(), error) {
+	if a.maxDirtyRatio > 0 || a.maxWriteLatency > 0 {
+		stats := a.bufferPool.GetStats()
+		if a.maxDirtyRatio > 0 && stats.DirtyRatio > a.maxDirtyRatio {
+			a.flushInBackground()
+			// Roughly the time needed to write back the pages over the limit
+			excess := stats.DirtyBuffers - int(a.maxDirtyRatio*float64(stats.TotalBuffers))
+			return nil, &ThrottledError{
+				Reason:     fmt.Sprintf("%.0f%% of the buffer pool is waiting to be written to disk", stats.DirtyRatio*100),
+				RetryAfter: clampRetryAfter(time.Duration(excess) * stats.WriteLatency),
+			}
+		}
+		if a.maxWriteLatency > 0 && stats.WriteLatency > a.maxWriteLatency {
+			return nil, &ThrottledError{
+				Reason:     fmt.Sprintf("disk writes are taking %dms on average", stats.WriteLatency.Milliseconds()),
+				RetryAfter: clampRetryAfter(2 * stats.WriteLatency),
+			}
+		}
+	}
+
+	bundleName := writtenBundle(command)
+	if a.maxBundleWrites <= 0 || bundleName == "" {
+		return func() {}, nil
+	}
+
+	key := a.identifiers.Key(database) + "\x00" + a.identifiers.Key(bundleName)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inFlight[key] >= a.maxBundleWrites {
+		return nil, &ThrottledError{
+			Reason:     fmt.Sprintf("too many writes in progress on bundle '%s'", bundleName),
+			RetryAfter: minRetryAfter,
+		}
+	}
+	a.inFlight[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if a.inFlight[key]--; a.inFlight[key] <= 0 {
+				delete(a.inFlight, key)
+			}
+		})
+	}, nil
+}
+
+// flushInBackground starts writing dirty pages back unless a flush is already running
+func (a *admissionControl) flushInBackground() {
+	if !a.flushing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer a.flushing.Store(false)
+		defer helpers.RecoverPanic(a.logger, "background flush of dirty buffers")
+		if err := a.bufferPool.FlushAllDirty(); err != nil {
+			a.logger.Warnf("Background flush of dirty buffers failed: %v", err)
+		}
+	}()
+}
+
+// writtenBundle returns the bundle a document write targets, or "" for other commands
+func writtenBundle(command string) string {
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return ""
+	}
+	switch cmd := statement.(type) {
+	case *engine.DocumentCommand:
+		return cmd.BundleName
+	case *engine.DocumentUpdateCommand:
+		return cmd.BundleName
+	case *engine.DocumentDeleteCommand:
+		return cmd.BundleName
+	}
+	return ""
+}
+
+func clampRetryAfter(wait time.Duration) time.Duration {
+	if wait < minRetryAfter {
+		return minRetryAfter
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
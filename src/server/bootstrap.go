@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/*
+	First-start bootstrap.
+
+	A container started on an empty data directory can provision itself. On that first start
+	only, SYNDRDB_ROOT_PASSWORD stands in for -adminpassword (see main.go), and every
+	*.syndrql file in -initdir runs, in name order, before clients can connect. A script holds
+	statements separated by ';', and lines starting with -- are comments. Statements run as
+	-adminuser, one script at a time, each script starting with no database selected. The
+	first statement that fails stops the bootstrap and the server; since the data directory
+	is no longer empty by then, start again from an empty one once the script is fixed.
+
+	Later starts find the data directory in use and skip all of this, so the scripts need
+	not check whether their databases and bundles exist already.
+*/
+
+// RootPasswordEnvironment holds the admin's password for a first start
+const RootPasswordEnvironment = "SYNDRDB_ROOT_PASSWORD"
+
+// InitScriptExtension marks the files in -initdir that run on a first start
+const InitScriptExtension = ".syndrql"
+
+// IsFirstStart reports whether a data directory is missing or empty. A lost+found directory,
+// which a freshly formatted volume comes with, does not count.
+func IsFirstStart(dataDir string) (bool, error) {
+	entries, err := os.ReadDir(dataDir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read data directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "lost+found" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RunInitScripts runs the init scripts in a directory, stopping at the first statement that fails
+func (s *Server) RunInitScripts(dir, adminUser string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read init script directory: %w", err)
+	}
+	var scripts []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), InitScriptExtension) {
+			scripts = append(scripts, entry.Name())
+		}
+	}
+	sort.Strings(scripts)
+
+	for _, name := range scripts {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("could not read init script %s: %w", name, err)
+		}
+		conn := s.NewLocalConnection("init:"+name, adminUser)
+		statements := splitStatements(string(data))
+		for i, statement := range statements {
+			if _, err := s.Execute(conn, statement); err != nil {
+				s.CloseLocalConnection(conn)
+				return fmt.Errorf("init script %s, statement %d: %w", name, i+1, err)
+			}
+		}
+		s.CloseLocalConnection(conn)
+		s.logger.Infof("Ran init script %s (%d statements)", name, len(statements))
+	}
+	return nil
+}
+
+// splitStatements cuts a script into its statements at each ';' outside quotes and
+// backquotes, leaving out comment lines, and collapses each statement's whitespace as a
+// framed command's is
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	cut := func() {
+		if statement := collapseWhitespace(current.String()); statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	var quote rune
+	escaped := false
+	lineStart := true // Only whitespace so far on this line
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if quote == 0 && lineStart && r == '-' && i+1 < len(runes) && runes[i+1] == '-' {
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			current.WriteRune('\n')
+			continue
+		}
+		lineStart = r == '\n' || (lineStart && unicode.IsSpace(r))
+
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && strings.ContainsRune("\"'`“‘", r):
+			quote = closingQuote(r)
+		case quote == 0 && r == ';':
+			cut()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	cut()
+	return statements
+}
+
+// closingQuote returns the quote that ends a string opened with the one given; the curly
+// quotes word processors substitute come in pairs
+func closingQuote(opening rune) rune {
+	switch opening {
+	case '“':
+		return '”'
+	case '‘':
+		return '’'
+	}
+	return opening
+}
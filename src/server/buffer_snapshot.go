@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syndrdb/src/buffermgr"
+	"syndrdb/src/engine"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	Buffer pool snapshots.
+
+	DIAGNOSTICS BUFFERPOOL [HEATMAP [<n>]] [TO FILE] reports what the buffer pool holds, buffer
+	by buffer: the file and block of its page, whether it is dirty, how many hold it pinned and
+	how often it was asked for since it was read. It is for telling why the pool misses: a scan
+	churning through every buffer, pages pinned and never released, one file crowding out the
+	others.
+
+	HEATMAP adds the n pages asked for most (20 by default) and, for each file, its cached
+	blocks split into at most heatmapCells ranges with the uses of the pages of each, so the hot
+	and cold parts of a file show. TO FILE writes the snapshot as JSON to -diagnosticsdir and
+	returns its path instead. Like DIAGNOSTICS DUMP it is kept to the admin port, and with auth
+	on only the admin user may take one.
+*/
+
+const (
+	defaultHottestPages = 20
+	heatmapCells        = 32
+)
+
+// bufferPoolSnapshot is what DIAGNOSTICS BUFFERPOOL reports
+type bufferPoolSnapshot struct {
+	TakenAt time.Time
+	Stats   buffermgr.BufferStats
+	Buffers []buffermgr.BufferSnapshot // The buffers holding a page, by buffer
+	Hottest []buffermgr.BufferSnapshot `json:",omitempty"` // Most used first
+	Heatmap []fileHeat                 `json:",omitempty"`
+}
+
+// fileHeat is one file's row of the heatmap
+type fileHeat struct {
+	FileID        uint32
+	File          string
+	Pages         int // Cached
+	DirtyPages    int
+	Uses          int
+	BlocksPerCell uint32
+	Cells         []int // Uses of the cached pages of each range of BlocksPerCell blocks, from block 0
+}
+
+// bufferPoolDumpOptions are the clauses of a DIAGNOSTICS BUFFERPOOL
+type bufferPoolDumpOptions struct {
+	hottest int // Pages in the heatmap's hottest list; 0 without HEATMAP
+	toFile  bool
+}
+
+// isBufferPoolDump reports whether a command is a DIAGNOSTICS BUFFERPOOL
+func isBufferPoolDump(command string) bool {
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(command), ";"))
+	return len(fields) >= 2 && strings.EqualFold(fields[0], "DIAGNOSTICS") && strings.EqualFold(fields[1], "BUFFERPOOL")
+}
+
+// parseBufferPoolDump parses the clauses after DIAGNOSTICS BUFFERPOOL
+func parseBufferPoolDump(command string) (bufferPoolDumpOptions, error) {
+	var options bufferPoolDumpOptions
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(command), ";"))[2:]
+	for len(fields) > 0 {
+		switch {
+		case strings.EqualFold(fields[0], "HEATMAP") && options.hottest == 0:
+			options.hottest = defaultHottestPages
+			fields = fields[1:]
+			if len(fields) > 0 {
+				if n, err := strconv.Atoi(fields[0]); err == nil {
+					if n <= 0 {
+						return options, protocol.Errorf(protocol.ErrParse, "HEATMAP takes a positive number of pages, not %d", n)
+					}
+					options.hottest = n
+					fields = fields[1:]
+				}
+			}
+		case len(fields) >= 2 && strings.EqualFold(fields[0], "TO") && strings.EqualFold(fields[1], "FILE") && !options.toFile:
+			options.toFile = true
+			fields = fields[2:]
+		default:
+			return options, protocol.Errorf(protocol.ErrParse, "unexpected '%s': expected DIAGNOSTICS BUFFERPOOL [HEATMAP [<n>]] [TO FILE]", fields[0])
+		}
+	}
+	return options, nil
+}
+
+// dumpBufferPool answers DIAGNOSTICS BUFFERPOOL
+func (s *Server) dumpBufferPool(conn *Connection, command string) (interface{}, error) {
+	options, err := parseBufferPoolDump(command)
+	if err != nil {
+		return nil, err
+	}
+	if s.AuthEnabled && conn.User != s.adminUser {
+		return nil, protocol.Errorf(protocol.ErrPermissionDenied, "only the admin user '%s' may snapshot the buffer pool", s.adminUser)
+	}
+
+	snapshot := &bufferPoolSnapshot{
+		TakenAt: time.Now(),
+		Stats:   s.bufferPool.GetStats(),
+		Buffers: s.bufferPool.Snapshot(),
+	}
+	if options.hottest > 0 {
+		snapshot.Hottest = hottestPages(snapshot.Buffers, options.hottest)
+		snapshot.Heatmap = bufferHeatmap(snapshot.Buffers)
+	}
+	if !options.toFile {
+		return &engine.CommandResponse{ResultCount: len(snapshot.Buffers), Result: snapshot}, nil
+	}
+
+	if err := os.MkdirAll(s.config.DiagnosticsDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create diagnostics directory: %w", err)
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.config.DiagnosticsDir, fmt.Sprintf("syndrdb-bufferpool-%s.json", snapshot.TakenAt.Format("2006-01-02_15-04-05.000")))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write buffer pool snapshot: %w", err)
+	}
+
+	s.logger.Infow("Buffer pool snapshot written", "connID", conn.ID, "user", conn.User, "path", path, "buffers", len(snapshot.Buffers))
+	return &engine.CommandResponse{
+		ResultCount: 1,
+		Result:      map[string]interface{}{"Path": path, "Buffers": len(snapshot.Buffers)},
+	}, nil
+}
+
+// hottestPages returns the n buffers whose pages were asked for most, most first
+func hottestPages(buffers []buffermgr.BufferSnapshot, n int) []buffermgr.BufferSnapshot {
+	hottest := slices.Clone(buffers)
+	slices.SortStableFunc(hottest, func(a, b buffermgr.BufferSnapshot) int {
+		return b.UsageCount - a.UsageCount
+	})
+	return hottest[:min(n, len(hottest))]
+}
+
+// bufferHeatmap sums the uses of the cached pages of each file over ranges of its blocks
+func bufferHeatmap(buffers []buffermgr.BufferSnapshot) []fileHeat {
+	byFile := make(map[uint32][]buffermgr.BufferSnapshot)
+	for _, buffer := range buffers {
+		byFile[buffer.FileID] = append(byFile[buffer.FileID], buffer)
+	}
+
+	heatmap := make([]fileHeat, 0, len(byFile))
+	for fileID, pages := range byFile {
+		blocks := uint32(0)
+		for _, page := range pages {
+			blocks = max(blocks, page.Block+1)
+		}
+		heat := fileHeat{
+			FileID:        fileID,
+			File:          pages[0].File,
+			Pages:         len(pages),
+			BlocksPerCell: (blocks + heatmapCells - 1) / heatmapCells,
+		}
+		heat.Cells = make([]int, (blocks+heat.BlocksPerCell-1)/heat.BlocksPerCell)
+		for _, page := range pages {
+			heat.Cells[page.Block/heat.BlocksPerCell] += page.UsageCount
+			heat.Uses += page.UsageCount
+			if page.Dirty {
+				heat.DirtyPages++
+			}
+		}
+		heatmap = append(heatmap, heat)
+	}
+
+	// The busiest files first
+	slices.SortFunc(heatmap, func(a, b fileHeat) int {
+		if a.Uses != b.Uses {
+			return b.Uses - a.Uses
+		}
+		return int(a.FileID) - int(b.FileID)
+	})
+	return heatmap
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strings"
+	"sync"
+	"syndrdb/src/directors"
+	"syndrdb/src/engine"
+	"syndrdb/src/protocol"
+	"syndrdb/src/settings"
+	"time"
+)
+
+/*
+	Diagnostics.
+
+	With -diagnosticsaddr the server answers on a second, HTTP port meant for operators only:
+
+	  /debug/pprof/    the Go profiler (net/http/pprof)
+	  /debug/runtime   goroutines, heap, GC pauses, connections and the buffer pool's internals
+
+	Bind it to a loopback or management address. With auth on it also needs HTTP basic auth as
+	the admin user.
+
+	DIAGNOSTICS DUMP writes a support bundle to -diagnosticsdir: a zip with the configuration
+	(secrets left out), the runtime stats and metrics, every goroutine's stack, a heap profile,
+	the most recent log entries and the end of the log file. With auth on, only the admin user
+	may write one.
+*/
+
+const (
+	recentLogEntries = 1000    // Log entries kept in memory for support bundles
+	logFileTailBytes = 1 << 20 // How much of the end of the log file a support bundle holds
+	maxGCPauses      = 16      // Most recent GC pauses reported
+)
+
+// logRing keeps the most recent log entries, one encoded entry per Write
+type logRing struct {
+	mu      sync.Mutex
+	entries [][]byte
+	next    int
+	full    bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{entries: make([][]byte, size)}
+}
+
+func (r *logRing) Write(entry []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = append([]byte(nil), entry...)
+	r.next = (r.next + 1) % len(r.entries)
+	r.full = r.full || r.next == 0
+	return len(entry), nil
+}
+
+func (r *logRing) Sync() error { return nil }
+
+// contents returns the entries kept, oldest first
+func (r *logRing) contents() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var buffer bytes.Buffer
+	if r.full {
+		for _, entry := range r.entries[r.next:] {
+			buffer.Write(entry)
+		}
+	}
+	for _, entry := range r.entries[:r.next] {
+		buffer.Write(entry)
+	}
+	return buffer.Bytes()
+}
+
+// startDiagnostics serves the profiler and runtime stats on the operator address
+func (s *Server) startDiagnostics() error {
+	listener, err := net.Listen("tcp", s.config.DiagnosticsAddr)
+	if err != nil {
+		return fmt.Errorf("error starting diagnostics endpoint on %s: %w", s.config.DiagnosticsAddr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(s.runtimeStats())
+	})
+
+	s.diagnostics = &http.Server{Handler: s.operatorOnly(mux), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.diagnostics.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorw("Diagnostics endpoint stopped", "error", err)
+		}
+	}()
+	s.logger.Infow("Diagnostics endpoint listening", "address", listener.Addr().String())
+	return nil
+}
+
+// operatorOnly lets only the admin user through when auth is on
+func (s *Server) operatorOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.AuthEnabled {
+			username, password, given := r.BasicAuth()
+			identity, expired, ok := "", false, false
+			if given && username == s.adminUser {
+				identity, expired, ok = s.authenticate(username, password, "")
+			}
+			if !ok || expired || identity != s.adminUser {
+				w.Header().Set("WWW-Authenticate", `Basic realm="SyndrDB diagnostics"`)
+				http.Error(w, "only the admin user may use the diagnostics endpoint", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runtimeStats reports the Go runtime's state and the buffer pool's internals
+func (s *Server) runtimeStats() map[string]interface{} {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	var pauses []time.Duration
+	for i := 0; i < maxGCPauses && i < int(memory.NumGC); i++ {
+		// PauseNs is a circular buffer; the most recent pause is at (NumGC+255)%256
+		pauses = append(pauses, time.Duration(memory.PauseNs[(int(memory.NumGC)-1-i+256)%256]))
+	}
+	var lastGC time.Time
+	if memory.LastGC > 0 {
+		lastGC = time.Unix(0, int64(memory.LastGC))
+	}
+
+	s.mu.Lock()
+	connections := len(s.ActiveConnections)
+	s.mu.Unlock()
+
+	return map[string]interface{}{
+		"Uptime":      time.Since(s.startedAt).Round(time.Second).String(),
+		"GoVersion":   runtime.Version(),
+		"CPUs":        runtime.NumCPU(),
+		"Goroutines":  runtime.NumGoroutine(),
+		"Connections": connections,
+		"Memory": map[string]interface{}{
+			"Sys":        memory.Sys,
+			"TotalAlloc": memory.TotalAlloc,
+			"StackInUse": memory.StackInuse,
+		},
+		"Heap": map[string]interface{}{
+			"Alloc":    memory.HeapAlloc,
+			"Sys":      memory.HeapSys,
+			"Idle":     memory.HeapIdle,
+			"InUse":    memory.HeapInuse,
+			"Released": memory.HeapReleased,
+			"Objects":  memory.HeapObjects,
+		},
+		"GC": map[string]interface{}{
+			"Count":        memory.NumGC,
+			"Forced":       memory.NumForcedGC,
+			"PauseTotal":   time.Duration(memory.PauseTotalNs),
+			"RecentPauses": pauses, // Most recent first
+			"LastGC":       lastGC,
+			"NextGCAt":     memory.NextGC, // Heap size that triggers the next collection
+			"CPUFraction":  memory.GCCPUFraction,
+		},
+		"BufferPool": s.bufferPool.GetInternals(),
+	}
+}
+
+// dumpDiagnostics writes a support bundle and returns its path
+func (s *Server) dumpDiagnostics(conn *Connection, serviceManager *directors.ServiceManager) (interface{}, error) {
+	if s.AuthEnabled && conn.User != s.adminUser {
+		return nil, protocol.Errorf(protocol.ErrPermissionDenied, "only the admin user '%s' may dump diagnostics", s.adminUser)
+	}
+	if err := os.MkdirAll(s.config.DiagnosticsDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create diagnostics directory: %w", err)
+	}
+	path := filepath.Join(s.config.DiagnosticsDir, fmt.Sprintf("syndrdb-diagnostics-%s.zip", time.Now().Format("2006-01-02_15-04-05.000")))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create support bundle: %w", err)
+	}
+
+	bundle := zip.NewWriter(file)
+	err = s.writeSupportBundle(bundle, serviceManager)
+	if closeErr := bundle.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write support bundle: %w", err)
+	}
+
+	s.logger.Infow("Support bundle written", "connID", conn.ID, "user", conn.User, "path", path)
+	return &engine.CommandResponse{
+		ResultCount: 1,
+		Result:      map[string]interface{}{"Path": path},
+	}, nil
+}
+
+func (s *Server) writeSupportBundle(bundle *zip.Writer, serviceManager *directors.ServiceManager) error {
+	stats := map[string]interface{}{
+		"Runtime": s.runtimeStats(),
+		"Metrics": s.metrics(serviceManager),
+	}
+	if s.topology != nil {
+		stats["Cluster"] = s.clusterStatus()
+	}
+	if s.isStandby() {
+		stats["Replica"] = s.replicaStatus()
+	}
+	for name, value := range map[string]interface{}{"config.json": supportConfig(s.config), "stats.json": stats} {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeZipFile(bundle, name, data); err != nil {
+			return err
+		}
+	}
+
+	for _, profile := range []struct {
+		file, name string
+		debug      int
+	}{{"goroutines.txt", "goroutine", 2}, {"heap.pprof", "heap", 0}} {
+		var buffer bytes.Buffer
+		if err := runtimepprof.Lookup(profile.name).WriteTo(&buffer, profile.debug); err != nil {
+			return err
+		}
+		if err := writeZipFile(bundle, profile.file, buffer.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if s.recentLogs != nil {
+		if err := writeZipFile(bundle, "recent.log", s.recentLogs.contents()); err != nil {
+			return err
+		}
+	}
+	if tail, err := readFileTail(s.config.LogDir, logFileTailBytes); err == nil {
+		if err := writeZipFile(bundle, "server.log", tail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supportConfig is the configuration with the secrets left out; secret references stay, as
+// they only say where a secret is kept
+func supportConfig(config *settings.Arguments) settings.Arguments {
+	copied := *config
+	for _, secret := range []*string{&copied.UserStoreKey, &copied.AdminPassword} {
+		if *secret != "" && !strings.HasPrefix(*secret, "env:") && !strings.HasPrefix(*secret, "file:") {
+			*secret = "xxxxx"
+		}
+	}
+	return copied
+}
+
+func writeZipFile(bundle *zip.Writer, name string, data []byte) error {
+	writer, err := bundle.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+// readFileTail returns up to the last limit bytes of a file
+func readFileTail(path string, limit int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > limit {
+		if _, err := file.Seek(-limit, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	return io.ReadAll(file)
+}
@@ -0,0 +1,566 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"syndrdb/src/directors"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+	"syndrdb/src/rpc"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+/*
+	gRPC API.
+
+	With -grpcport the server also serves the services of rpc/syndrdb.proto, a typed
+	alternative to the TCP protocol for clients in any language gRPC generates code for:
+	DatabaseService, BundleService, DocumentService and QueryService. Each call builds SyndrQL
+	from its request (see translate.go) and runs it on a connection of its own, through the
+	same rules as a client's commands: read-only, maintenance and admission, the query worker
+	pool and panic recovery. A call's connection lasts as long as the call, so transactions
+	do not span calls, and it is not listed by SHOW PROCESSLIST. QueryService.Execute runs any
+	SyndrQL a single command can.
+
+	With -auth, every call carries the user name and password as HTTP basic credentials in its
+	"authorization" metadata, checked by the -authproviders as the connection string's are.
+	The listener uses the server's certificate when one is configured; without one, the
+	credentials cross the network in the clear.
+
+	Failures come back as the gRPC status code that fits their error code (protocol/errors.go):
+	NOT_FOUND for a database, bundle or document that does not exist, UNAUTHENTICATED for bad
+	credentials, RESOURCE_EXHAUSTED for a throttled write, UNAVAILABLE during maintenance,
+	FAILED_PRECONDITION for a write refused by a read-only server or standby, ABORTED for a
+	deadlock, and INVALID_ARGUMENT for everything else a command rejects.
+*/
+
+// startGRPCServer starts serving the gRPC API on its port
+func (s *Server) startGRPCServer() error {
+	address := net.JoinHostPort(s.config.Host, fmt.Sprint(s.config.GRPCPort))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error starting gRPC listener on %s: %w", address, err)
+	}
+
+	var options []grpc.ServerOption
+	if s.tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+	}
+	s.grpcServer = grpc.NewServer(options...)
+	api := &grpcAPI{server: s}
+	rpc.RegisterDatabaseServiceServer(s.grpcServer, api)
+	rpc.RegisterBundleServiceServer(s.grpcServer, api)
+	rpc.RegisterDocumentServiceServer(s.grpcServer, api)
+	rpc.RegisterQueryServiceServer(s.grpcServer, api)
+	s.logger.Infow("Serving the gRPC API", "address", address, "tls", s.tlsConfig != nil)
+
+	go func() {
+		if err := s.grpcServer.Serve(listener); err != nil && s.Running {
+			s.logger.Errorw("gRPC server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// grpcAPI implements the four services on the server
+type grpcAPI struct {
+	rpc.UnimplementedDatabaseServiceServer
+	rpc.UnimplementedBundleServiceServer
+	rpc.UnimplementedDocumentServiceServer
+	rpc.UnimplementedQueryServiceServer
+	server *Server
+}
+
+// connect authenticates a call and returns the connection its commands run on, in database
+// unless that is empty. done rolls back what the connection left open.
+func (g *grpcAPI) connect(ctx context.Context, database string) (conn *Connection, done func(), err error) {
+	s := g.server
+	conn = &Connection{
+		ID:          "grpc_" + generateConnectionID(),
+		Authorized:  true,
+		Logger:      s.logger,
+		LastActive:  time.Now(),
+		ConnectedAt: time.Now(),
+		ctx:         ctx, // Canceled with the call
+	}
+	if s.AuthEnabled {
+		username, password, given := grpcBasicAuth(ctx)
+		if !given {
+			return nil, nil, status.Error(codes.Unauthenticated, "send the user name and password as basic credentials in the authorization metadata")
+		}
+		identity, expired, ok := s.authenticate(username, password, "")
+		if !ok {
+			return nil, nil, status.Error(codes.Unauthenticated, "Authentication failed")
+		}
+		if expired {
+			return nil, nil, status.Errorf(codes.PermissionDenied, "the password of user '%s' has expired; change it with ALTER USER over the TCP protocol", identity)
+		}
+		conn.User = identity
+	}
+	if err := s.maintenanceConnectError(conn.User); err != nil {
+		return nil, nil, grpcError(err)
+	}
+	done = func() { s.CloseLocalConnection(conn) }
+
+	if database != "" {
+		if err := g.checkDatabase(database); err != nil {
+			return nil, nil, err
+		}
+		if _, err := s.runTranslated(conn, "USE DATABASE "+syndrqlString(database)); err != nil {
+			return nil, nil, grpcError(err)
+		}
+	}
+	return conn, done, nil
+}
+
+// checkDatabase fails with NOT_FOUND for a database that does not exist
+func (g *grpcAPI) checkDatabase(name string) error {
+	if database, err := g.server.databaseService.GetDatabaseByName(name); err != nil || database == nil {
+		return status.Errorf(codes.NotFound, "database '%s' does not exist", name)
+	}
+	return nil
+}
+
+// run runs a translated command, failing with the command's error as a status
+func (g *grpcAPI) run(conn *Connection, command string) (interface{}, error) {
+	response, err := g.server.runTranslated(conn, command)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return response.Result, nil
+}
+
+func (g *grpcAPI) ListDatabases(ctx context.Context, request *rpc.ListDatabasesRequest) (*rpc.ListDatabasesResponse, error) {
+	_, done, err := g.connect(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	done()
+	var names []string
+	for _, database := range g.server.services.DatabaseService.ListDatabases() {
+		names = append(names, database.Name)
+	}
+	sort.Strings(names)
+	return &rpc.ListDatabasesResponse{Names: names}, nil
+}
+
+func (g *grpcAPI) CreateDatabase(ctx context.Context, request *rpc.CreateDatabaseRequest) (*rpc.CreateDatabaseResponse, error) {
+	conn, done, err := g.connect(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	result, err := g.run(conn, "CREATE DATABASE "+syndrqlString(request.GetName()))
+	if err != nil {
+		return nil, err
+	}
+	return &rpc.CreateDatabaseResponse{Message: fmt.Sprint(result)}, nil
+}
+
+func (g *grpcAPI) DeleteDatabase(ctx context.Context, request *rpc.DeleteDatabaseRequest) (*rpc.DeleteDatabaseResponse, error) {
+	conn, done, err := g.connect(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if err := g.checkDatabase(request.GetName()); err != nil {
+		return nil, err
+	}
+	if _, err := g.run(conn, "DELETE DATABASE "+syndrqlString(request.GetName())); err != nil {
+		return nil, err
+	}
+	return &rpc.DeleteDatabaseResponse{}, nil
+}
+
+func (g *grpcAPI) ListBundles(ctx context.Context, request *rpc.ListBundlesRequest) (*rpc.ListBundlesResponse, error) {
+	conn, done, err := g.connect(ctx, request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if conn.Database == nil {
+		return nil, status.Error(codes.InvalidArgument, "name the database to list the bundles of")
+	}
+	return &rpc.ListBundlesResponse{Names: bundleNames(conn.Database)}, nil
+}
+
+func (g *grpcAPI) GetBundle(ctx context.Context, request *rpc.GetBundleRequest) (*rpc.Bundle, error) {
+	conn, done, err := g.connect(ctx, request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return g.bundle(conn, request.GetName())
+}
+
+// bundle describes a bundle of the connection's database from its declared fields
+func (g *grpcAPI) bundle(conn *Connection, name string) (*rpc.Bundle, error) {
+	// Answered from the kept statistics, and loads the bundle when it is not yet
+	result, err := g.run(conn, "SHOW BUNDLE STATS "+syndrqlString(name))
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := g.server.services.BundleService.GetBundleByName(conn.Database, name)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "bundle '%s' does not exist: %v", name, err)
+	}
+
+	described := &rpc.Bundle{Name: bundle.Name}
+	if stats, ok := result.(directors.BundleStats); ok {
+		described.DocumentCount = int64(stats.DocumentCount)
+	}
+	names := make([]string, 0, len(bundle.DocumentStructure.FieldDefinitions))
+	for name := range bundle.DocumentStructure.FieldDefinitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		definition := bundle.DocumentStructure.FieldDefinitions[name]
+		described.Fields = append(described.Fields, &rpc.Field{
+			Name:     definition.Name,
+			Type:     definition.Type,
+			Required: definition.IsRequired,
+			Unique:   definition.IsUnique,
+		})
+	}
+	return described, nil
+}
+
+func (g *grpcAPI) CreateBundle(ctx context.Context, request *rpc.CreateBundleRequest) (*rpc.Bundle, error) {
+	if len(request.GetFields()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "a bundle needs at least one field")
+	}
+	definitions := make([]string, 0, len(request.GetFields()))
+	for _, field := range request.GetFields() {
+		name, err := syndrqlField(field.GetName())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if strings.TrimSpace(field.GetType()) == "" || strings.ContainsAny(field.GetType(), " \t{},") {
+			return nil, status.Errorf(codes.InvalidArgument, "field '%s' has no valid type", field.GetName())
+		}
+		definitions = append(definitions, fmt.Sprintf("{%s, %s, %t, %t}", name, field.GetType(), field.GetRequired(), field.GetUnique()))
+	}
+
+	conn, done, err := g.connect(ctx, request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	command := fmt.Sprintf("CREATE BUNDLE %s WITH FIELDS (%s)", syndrqlString(request.GetName()), strings.Join(definitions, ", "))
+	if _, err := g.run(conn, command); err != nil {
+		return nil, err
+	}
+	return g.bundle(conn, request.GetName())
+}
+
+func (g *grpcAPI) DeleteBundle(ctx context.Context, request *rpc.DeleteBundleRequest) (*rpc.DeleteBundleResponse, error) {
+	conn, done, err := g.connect(ctx, request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if _, err := g.run(conn, "DELETE BUNDLE "+syndrqlString(request.GetName())); err != nil {
+		return nil, err
+	}
+	return &rpc.DeleteBundleResponse{}, nil
+}
+
+func (g *grpcAPI) AddDocument(ctx context.Context, request *rpc.AddDocumentRequest) (*rpc.AddDocumentResponse, error) {
+	assignments, err := grpcAssignments(request.GetFields(), "{%s = %s}")
+	if err != nil {
+		return nil, err
+	}
+	if len(assignments) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "a document needs at least one field that is not null")
+	}
+	conn, done, err := g.connect(ctx, request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	result, err := g.run(conn, fmt.Sprintf("ADD DOCUMENT TO BUNDLE %s WITH (%s)", syndrqlString(request.GetBundle()), strings.Join(assignments, ", ")))
+	if err != nil {
+		return nil, err
+	}
+	return &rpc.AddDocumentResponse{Message: fmt.Sprint(result)}, nil
+}
+
+func (g *grpcAPI) GetDocument(ctx context.Context, request *rpc.GetDocumentRequest) (*rpc.Document, error) {
+	conn, done, err := g.connect(ctx, request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	query := fmt.Sprintf("SELECT DOCUMENTS FROM %s WHERE DocumentID == %s LIMIT 1", syndrqlString(request.GetBundle()), syndrqlString(request.GetId()))
+	response, err := g.server.runTranslated(conn, query)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	documents := resultDocuments(response)
+	if len(documents) == 0 {
+		return nil, status.Errorf(codes.NotFound, "bundle '%s' has no document '%s'", request.GetBundle(), request.GetId())
+	}
+	return grpcDocument(documents[0]), nil
+}
+
+func (g *grpcAPI) UpdateDocuments(ctx context.Context, request *rpc.UpdateDocumentsRequest) (*rpc.UpdateDocumentsResponse, error) {
+	assignments, err := grpcAssignments(request.GetFields(), "%s = %s")
+	if err != nil {
+		return nil, err
+	}
+	if len(assignments) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "set at least one field that is not null")
+	}
+	if strings.TrimSpace(request.GetWhere()) == "" {
+		return nil, status.Error(codes.InvalidArgument, `a condition is required; DocumentID != "" matches every document`)
+	}
+	conn, done, err := g.connect(ctx, request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	command := fmt.Sprintf("UPDATE DOCUMENTS IN BUNDLE %s (%s) WHERE %s", syndrqlString(request.GetBundle()), strings.Join(assignments, ", "), request.GetWhere())
+	if _, err := g.run(conn, command); err != nil {
+		return nil, err
+	}
+	return &rpc.UpdateDocumentsResponse{}, nil
+}
+
+func (g *grpcAPI) DeleteDocuments(ctx context.Context, request *rpc.DeleteDocumentsRequest) (*rpc.DeleteDocumentsResponse, error) {
+	if strings.TrimSpace(request.GetWhere()) == "" {
+		return nil, status.Error(codes.InvalidArgument, `a condition is required; DocumentID != "" matches every document`)
+	}
+	conn, done, err := g.connect(ctx, request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if _, err := g.run(conn, fmt.Sprintf("DELETE DOCUMENTS FROM %s WHERE %s", syndrqlString(request.GetBundle()), request.GetWhere())); err != nil {
+		return nil, err
+	}
+	return &rpc.DeleteDocumentsResponse{}, nil
+}
+
+func (g *grpcAPI) Select(request *rpc.SelectRequest, stream grpc.ServerStreamingServer[rpc.Document]) error {
+	query := "SELECT DOCUMENTS FROM " + syndrqlString(request.GetBundle())
+	if strings.TrimSpace(request.GetWhere()) != "" {
+		query += " WHERE " + request.GetWhere()
+	}
+	if request.GetOrderBy() != "" {
+		field, err := syndrqlField(request.GetOrderBy())
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		query += " ORDER BY " + field
+		if request.GetDescending() {
+			query += " DESC"
+		}
+	}
+	if request.GetLimit() < 0 {
+		return status.Error(codes.InvalidArgument, "limit cannot be negative")
+	}
+	if request.GetLimit() > 0 {
+		query += fmt.Sprintf(" LIMIT %d", request.GetLimit())
+	}
+
+	conn, done, err := g.connect(stream.Context(), request.GetDatabase())
+	if err != nil {
+		return err
+	}
+	defer done()
+	response, err := g.server.runTranslated(conn, query)
+	if err != nil {
+		return grpcError(err)
+	}
+	for _, document := range resultDocuments(response) {
+		if err := stream.Send(grpcDocument(document)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *grpcAPI) Execute(ctx context.Context, request *rpc.ExecuteRequest) (*rpc.ExecuteResponse, error) {
+	conn, done, err := g.connect(ctx, request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	response, err := g.server.runTranslated(conn, request.GetCommand())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	result, err := json.Marshal(response.Result)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "encoding the result: %v", err)
+	}
+	return &rpc.ExecuteResponse{ResultCount: int64(response.ResultCount), Result: result}, nil
+}
+
+// grpcBasicAuth reads the basic credentials of a call's authorization metadata
+func grpcBasicAuth(ctx context.Context) (username, password string, ok bool) {
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range incoming.Get("authorization") {
+		scheme, encoded, found := strings.Cut(value, " ")
+		if !found || !strings.EqualFold(scheme, "Basic") {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			continue
+		}
+		if username, password, ok = strings.Cut(string(decoded), ":"); ok {
+			return username, password, true
+		}
+	}
+	return "", "", false
+}
+
+// grpcError gives a command's failure the status code that fits it
+func grpcError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.InvalidArgument
+	switch protocol.CodeOf(err) {
+	case protocol.ErrDatabaseNotFound, protocol.ErrBundleNotFound, protocol.ErrDocumentNotFound:
+		code = codes.NotFound
+	case protocol.ErrAlreadyExists:
+		code = codes.AlreadyExists
+	case protocol.ErrAuthentication:
+		code = codes.Unauthenticated
+	case protocol.ErrPermissionDenied, protocol.ErrPasswordExpired, protocol.ErrAdminPortOnly:
+		code = codes.PermissionDenied
+	case protocol.ErrThrottled, protocol.ErrBufferPoolFull:
+		code = codes.ResourceExhausted
+	case protocol.ErrMaintenance, protocol.ErrLeaderUnavailable, protocol.ErrNodeUnavailable, protocol.ErrCommitUncertain:
+		code = codes.Unavailable
+	case protocol.ErrReadOnly, protocol.ErrReadOnlyReplica, protocol.ErrBundleSuspect, protocol.ErrBundleHasAggregate:
+		code = codes.FailedPrecondition
+	case protocol.ErrDeadlock:
+		code = codes.Aborted
+	case protocol.ErrInternal:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
+
+// grpcAssignments writes the fields of a request as SyndrQL, each in format with its name
+// and literal, leaving out null values
+func grpcAssignments(fields map[string]*rpc.Value, format string) ([]string, error) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assignments := make([]string, 0, len(names))
+	for _, name := range names {
+		literal, err := grpcLiteral(fields[name])
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "field '%s': %v", name, err)
+		}
+		if literal == "" {
+			continue
+		}
+		field, err := syndrqlField(name)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		assignments = append(assignments, fmt.Sprintf(format, field, literal))
+	}
+	return assignments, nil
+}
+
+// grpcLiteral writes a Value as a SyndrQL literal, or "" for null. Floats keep a decimal
+// point so they are not read back as integers.
+func grpcLiteral(value *rpc.Value) (string, error) {
+	switch kind := value.GetKind().(type) {
+	case nil:
+		return "", nil
+	case *rpc.Value_StringValue:
+		return syndrqlString(kind.StringValue), nil
+	case *rpc.Value_IntValue:
+		return strconv.FormatInt(kind.IntValue, 10), nil
+	case *rpc.Value_FloatValue:
+		if math.IsNaN(kind.FloatValue) || math.IsInf(kind.FloatValue, 0) {
+			return "", fmt.Errorf("NaN and infinite numbers are not supported")
+		}
+		literal := strconv.FormatFloat(kind.FloatValue, 'f', -1, 64)
+		if !strings.Contains(literal, ".") {
+			literal += ".0"
+		}
+		return literal, nil
+	case *rpc.Value_BoolValue:
+		return strconv.FormatBool(kind.BoolValue), nil
+	case *rpc.Value_TimeValue:
+		if err := kind.TimeValue.CheckValid(); err != nil {
+			return "", err
+		}
+		return syndrqlString(kind.TimeValue.AsTime().UTC().Format(time.RFC3339Nano)), nil
+	case *rpc.Value_JsonValue:
+		return "", fmt.Errorf("json_value is only used in results")
+	}
+	return "", fmt.Errorf("unsupported value kind %T", value.GetKind())
+}
+
+// grpcDocument converts a stored document for a gRPC client
+func grpcDocument(document *models.Document) *rpc.Document {
+	converted := &rpc.Document{
+		Id:     document.DocumentID,
+		Fields: make(map[string]*rpc.Value, len(document.Fields)),
+	}
+	if !document.CreatedAt.IsZero() {
+		converted.CreatedAt = timestamppb.New(document.CreatedAt)
+	}
+	if !document.UpdatedAt.IsZero() {
+		converted.UpdatedAt = timestamppb.New(document.UpdatedAt)
+	}
+	for name, field := range document.Fields {
+		converted.Fields[name] = grpcValue(field.Value)
+	}
+	return converted
+}
+
+// grpcValue converts a stored value; what has no kind of its own goes as JSON
+func grpcValue(value interface{}) *rpc.Value {
+	switch typed := value.(type) {
+	case nil:
+		return &rpc.Value{}
+	case string:
+		return &rpc.Value{Kind: &rpc.Value_StringValue{StringValue: typed}}
+	case int:
+		return &rpc.Value{Kind: &rpc.Value_IntValue{IntValue: int64(typed)}}
+	case int32:
+		return &rpc.Value{Kind: &rpc.Value_IntValue{IntValue: int64(typed)}}
+	case int64:
+		return &rpc.Value{Kind: &rpc.Value_IntValue{IntValue: typed}}
+	case float32:
+		return &rpc.Value{Kind: &rpc.Value_FloatValue{FloatValue: float64(typed)}}
+	case float64:
+		return &rpc.Value{Kind: &rpc.Value_FloatValue{FloatValue: typed}}
+	case bool:
+		return &rpc.Value{Kind: &rpc.Value_BoolValue{BoolValue: typed}}
+	case time.Time:
+		return &rpc.Value{Kind: &rpc.Value_TimeValue{TimeValue: timestamppb.New(typed)}}
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return &rpc.Value{Kind: &rpc.Value_JsonValue{JsonValue: string(encoded)}}
+}
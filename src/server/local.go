@@ -0,0 +1,53 @@
+package server
+
+import (
+	"time"
+)
+
+/*
+	Local connections.
+
+	Commands can run inside the server's own process, from the first-start bootstrap (see
+	bootstrap.go) and from programs embedding the engine (see embedded/embedded.go). They run
+	on local connections, which have no network connection behind them: they are authorized
+	already, may run the commands kept to the admin port (see admin_port.go), are not listed
+	by SHOW PROCESSLIST and get no notices. Otherwise their commands take the path a client's
+	do, through admission, read-only and maintenance rules, the query worker pool and panic
+	recovery.
+*/
+
+// NewLocalConnection returns an authorized connection for running commands in-process
+func (s *Server) NewLocalConnection(id, user string) *Connection {
+	return &Connection{
+		ID:          id,
+		User:        user,
+		Authorized:  true,
+		AdminPort:   true,
+		Logger:      s.logger,
+		LastActive:  time.Now(),
+		ConnectedAt: time.Now(),
+	}
+}
+
+// Execute runs a command on a local connection, turning a panic into an error
+func (s *Server) Execute(conn *Connection, command string) (interface{}, error) {
+	conn.LastActive = time.Now()
+	return s.safeProcessCommand(conn, command)
+}
+
+// CloseLocalConnection rolls back the transaction a local connection left open
+func (s *Server) CloseLocalConnection(conn *Connection) {
+	if conn.Transaction != nil {
+		s.services.BundleService.EndTransaction(conn.Transaction)
+		s.logger.Infof("Rolled back transaction %d of closed connection %s", conn.Transaction.ID, conn.ID)
+		conn.Transaction = nil
+	}
+}
+
+// StartLocal starts what the server runs in the background besides serving clients, for a
+// server whose commands all come from its own process
+func (s *Server) StartLocal() {
+	if s.changes != nil {
+		s.changes.Start()
+	}
+}
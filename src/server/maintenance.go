@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"syndrdb/src/engine"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	Maintenance mode.
+
+	ALTER SYSTEM SET maintenance = TRUE, or = '<duration>' to say how long it should take, puts
+	the server in maintenance mode until ALTER SYSTEM SET maintenance = FALSE:
+
+	  - new connections are turned away with a retry-after hint, except the admin's and the
+	    cluster user's
+	  - every open session is sent a notice, at once if it asked for notices (see notices.go),
+	    otherwise with the result of its next command
+	  - writes from open sessions are refused with the same retry-after hint; reads carry on
+	  - the admin's own commands skip write admission, and dirty buffers are flushed at once,
+	    so maintenance work such as CHECK DATABASE REPAIR, bundle copies and file cleanup has
+	    the disk to itself
+
+	Leaving maintenance sends every session a notice that the server is back to normal. The
+	retry-after hint is the time left of the announced duration, or maintenanceRetryAfter when
+	none was given or it has run over. Like read-only mode, it is per node and ends with a
+	restart.
+*/
+
+const (
+	maintenanceRetryAfter    = 30 * time.Second
+	minMaintenanceRetryAfter = time.Second
+)
+
+// MaintenanceError refuses a connection or a write while the server is in maintenance
+type MaintenanceError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *MaintenanceError) Error() string {
+	return fmt.Sprintf("server in maintenance: %s; retry after %s", e.Reason, e.RetryAfter.Round(time.Second))
+}
+
+func (e *MaintenanceError) ErrorCode() protocol.ErrorCode { return protocol.ErrMaintenance }
+func (e *MaintenanceError) RetryHint() time.Duration      { return e.RetryAfter }
+
+// maintenanceWindow is the state of maintenance mode; Since is zero outside maintenance
+type maintenanceWindow struct {
+	mu    sync.Mutex
+	since time.Time
+	until time.Time // Announced end; zero when no duration was given
+}
+
+// inMaintenance reports whether the server is in maintenance mode
+func (s *Server) inMaintenance() bool {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	return !s.maintenance.since.IsZero()
+}
+
+// maintenanceRetry is how long clients should wait before trying again
+func (s *Server) maintenanceRetry() time.Duration {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	if s.maintenance.until.IsZero() {
+		return maintenanceRetryAfter
+	}
+	left := time.Until(s.maintenance.until)
+	if left <= 0 {
+		return maintenanceRetryAfter
+	}
+	return max(left, minMaintenanceRetryAfter)
+}
+
+// exemptFromMaintenance reports whether a user keeps working during maintenance
+func (s *Server) exemptFromMaintenance(user string) bool {
+	return user == s.adminUser || (s.topology != nil && user == s.topology.Username)
+}
+
+// setMaintenance enters maintenance mode, or leaves it when on is false. A zero duration
+// announces no end.
+func (s *Server) setMaintenance(conn *Connection, on bool, duration time.Duration) (interface{}, error) {
+	s.maintenance.mu.Lock()
+	was := !s.maintenance.since.IsZero()
+	if on {
+		if !was {
+			s.maintenance.since = time.Now()
+		}
+		s.maintenance.until = time.Time{}
+		if duration > 0 {
+			s.maintenance.until = time.Now().Add(duration)
+		}
+	} else {
+		s.maintenance.since, s.maintenance.until = time.Time{}, time.Time{}
+	}
+	s.maintenance.mu.Unlock()
+
+	var message string
+	switch {
+	case on && duration > 0:
+		message = fmt.Sprintf("The server is in maintenance for about %s: writes are refused and new connections turned away until it ends.", duration)
+	case on:
+		message = "The server is in maintenance: writes are refused and new connections turned away until it ends."
+	case was:
+		message = "Maintenance is over; the server is back to normal operation."
+	default:
+		message = "The server is not in maintenance."
+	}
+
+	if on || was {
+		notified := s.broadcastNotice(message, conn)
+		s.logger.Warnw("Maintenance mode changed", "maintenance", on, "duration", duration,
+			"connID", conn.ID, "user", conn.User, "sessionsNotified", notified)
+	}
+	if on && !was {
+		// Write back what clients left in memory before maintenance work starts on the files
+		go func() {
+			if err := s.bufferPool.FlushAllDirty(); err != nil {
+				s.logger.Errorw("Failed to flush dirty buffers for maintenance", "error", err)
+			}
+		}()
+	}
+
+	return &engine.CommandResponse{ResultCount: 1, Result: message}, nil
+}
+
+// maintenanceConnectError turns a new connection away during maintenance; nil when it may stay
+func (s *Server) maintenanceConnectError(user string) error {
+	if !s.inMaintenance() || s.exemptFromMaintenance(user) {
+		return nil
+	}
+	return &MaintenanceError{Reason: "new connections are not accepted", RetryAfter: s.maintenanceRetry()}
+}
+
+// maintenanceWriteError refuses a write from a session during maintenance; nil for reads
+func (s *Server) maintenanceWriteError(conn *Connection, command string) error {
+	if s.exemptFromMaintenance(conn.User) {
+		return nil
+	}
+	if writes, _ := commandWrites(conn, command); !writes {
+		return nil
+	}
+	return &MaintenanceError{Reason: "writes are refused", RetryAfter: s.maintenanceRetry()}
+}
+
+// broadcastNotice sends a notice to every open session but the sender's, pushed to those
+// that asked for notices and queued for the others, and returns how many sessions it was for
+func (s *Server) broadcastNotice(notice string, sender *Connection) int {
+	pushed := pendingNotice{notice: protocol.NewNotice(protocol.NoticeMaintenance, notice, nil)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := 0
+	for _, conn := range s.ActiveConnections {
+		if conn == sender || !conn.Authorized {
+			continue
+		}
+		if conn.pushed == nil {
+			conn.notices = append(conn.notices, notice)
+		} else {
+			s.pushLocked(conn, pushed)
+		}
+		queued++
+	}
+	return queued
+}
+
+// withNotices hands a connection's queued notices to the client with a command's result.
+// Only CommandResponse results carry them; others leave them queued for the next one.
+func (s *Server) withNotices(conn *Connection, result interface{}) interface{} {
+	response, ok := result.(*engine.CommandResponse)
+	if !ok || response == nil {
+		return result
+	}
+	s.mu.Lock()
+	notices := conn.notices
+	conn.notices = nil
+	s.mu.Unlock()
+	if len(notices) == 0 {
+		return result
+	}
+	// A copy, since a result kept for request ID retries is shared
+	withNotices := *response
+	withNotices.Notices = notices
+	return &withNotices
+}
+
+// maintenanceStatus reports maintenance mode for SHOW METRICS; nil outside maintenance
+func (s *Server) maintenanceStatus() map[string]interface{} {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	if s.maintenance.since.IsZero() {
+		return nil
+	}
+	status := map[string]interface{}{"Since": s.maintenance.since.Format(time.RFC3339)}
+	if !s.maintenance.until.IsZero() {
+		status["ExpectedEnd"] = s.maintenance.until.Format(time.RFC3339)
+	}
+	return status
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"syndrdb/src/directors"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+)
+
+/*
+	Data masking.
+
+	Masking rules let developers query production-shaped data without seeing raw PII. They
+	are read at startup from the JSON file -maskingpolicies names:
+
+	{
+	  "Salt": "a-long-random-string",
+	  "Roles": [
+	    { "Name": "developers", "Users": ["dev", "analyst"] },
+	    { "Name": "support", "Users": ["helpdesk"], "Unmasked": true }
+	  ],
+	  "Rules": [
+	    { "Bundle": "Customers", "Field": "CardNumber", "Mask": "last4" },
+	    { "Database": "shop", "Bundle": "Customers", "Field": "Email", "Mask": "hash", "Roles": ["developers"] }
+	  ]
+	}
+
+	A rule masks one field of a bundle, in the database it names or in every database, for
+	the users of the roles it lists, or for every user when it lists none. The admin user,
+	the cluster user and the users of an Unmasked role always see the values. Masks are
+	  - last4: the text of the value with all but its last four characters replaced by *;
+	    values of four characters or fewer are replaced whole
+	  - redact: the value is replaced by "[REDACTED]"
+	  - hash: the hex SHA-256 of Salt and the text of the value, so equal values still
+	    match. Short or guessable values can be found by hashing candidates; redact them.
+
+	Masks are applied to results as they leave the server, whichever protocol carries them:
+	the documents of SELECT DOCUMENTS and SHOW DOCUMENT HISTORY, the values of SELECT DISTINCT
+	and the histograms of SHOW FIELD STATS. Statements that would hand a masked value over
+	some other way are refused: ORDER BY a masked field (the AFTER KEY token carries its
+	value), TOPK and PERCENTILE of one, and ADD DOCUMENTS, MERGE, SNAPSHOT or CLONE BUNDLE,
+	CREATE AGGREGATE and CREATE WEBHOOK reading a bundle with masked fields. WHERE still
+	compares the real values, and writes are not masked.
+*/
+
+// Masks a rule may apply
+const (
+	MaskLast4  = "last4"
+	MaskRedact = "redact"
+	MaskHash   = "hash"
+)
+
+// redactedValue replaces the values of redacted fields
+const redactedValue = "[REDACTED]"
+
+// maskingPoliciesFile is the file -maskingpolicies names
+type maskingPoliciesFile struct {
+	Salt  string
+	Roles []maskingRole
+	Rules []maskingRule
+}
+
+type maskingRole struct {
+	Name     string
+	Users    []string
+	Unmasked bool // Its users see every value
+}
+
+type maskingRule struct {
+	Database string // Empty for every database
+	Bundle   string
+	Field    string
+	Mask     string   // One of the Mask constants
+	Roles    []string // Empty for every user
+}
+
+// maskingPolicies are the server's masking rules, see loadMaskingPolicies
+type maskingPolicies struct {
+	salt        string
+	roles       map[string]*maskingRole // By name
+	unmasked    map[string]bool         // Users of an Unmasked role
+	rules       []maskingRule
+	identifiers helpers.Identifiers // How role, database and bundle names are compared
+}
+
+// loadMaskingPolicies reads the masking rules from path; an empty path masks nothing
+func loadMaskingPolicies(path string, identifiers helpers.Identifiers) (*maskingPolicies, error) {
+	policies := &maskingPolicies{
+		roles:       make(map[string]*maskingRole),
+		unmasked:    make(map[string]bool),
+		identifiers: identifiers,
+	}
+	if path == "" {
+		return policies, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read masking policies: %w", err)
+	}
+	var file maskingPoliciesFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse masking policies: %w", err)
+	}
+
+	policies.salt = file.Salt
+	for i := range file.Roles {
+		role := &file.Roles[i]
+		if !engine.IsValidDatabaseName(role.Name) {
+			return nil, fmt.Errorf("invalid masking role name '%s'", role.Name)
+		}
+		key := policies.identifiers.Key(role.Name)
+		if policies.roles[key] != nil {
+			return nil, fmt.Errorf("masking role '%s' is listed twice", role.Name)
+		}
+		policies.roles[key] = role
+		if role.Unmasked {
+			for _, user := range role.Users {
+				policies.unmasked[user] = true
+			}
+		}
+	}
+	for _, rule := range file.Rules {
+		if rule.Bundle == "" || rule.Field == "" {
+			return nil, fmt.Errorf("every masking rule needs a Bundle and a Field")
+		}
+		switch rule.Mask {
+		case MaskLast4, MaskRedact, MaskHash:
+		default:
+			return nil, fmt.Errorf("masking rule for field '%s' of bundle '%s': Mask must be %s, %s or %s",
+				rule.Field, rule.Bundle, MaskLast4, MaskRedact, MaskHash)
+		}
+		for _, name := range rule.Roles {
+			if policies.roles[policies.identifiers.Key(name)] == nil {
+				return nil, fmt.Errorf("masking rule for field '%s' of bundle '%s' names role '%s', which is not listed in Roles",
+					rule.Field, rule.Bundle, name)
+			}
+		}
+		policies.rules = append(policies.rules, rule)
+	}
+	return policies, nil
+}
+
+// appliesTo reports whether a rule masks its field for a user
+func (p *maskingPolicies) appliesTo(rule maskingRule, user string) bool {
+	if len(rule.Roles) == 0 {
+		return true
+	}
+	for _, name := range rule.Roles {
+		for _, member := range p.roles[p.identifiers.Key(name)].Users {
+			if member == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resultMask is what one command of a user must not see
+type resultMask struct {
+	policies *maskingPolicies
+	rules    []maskingRule // The rules masking fields for the user in the connection's database
+	user     string
+}
+
+// resultMask returns the masks a connection's results get, or nil when none do
+func (s *Server) resultMask(conn *Connection) *resultMask {
+	if len(s.maskingPolicies.rules) == 0 || conn.User == s.adminUser || s.maskingPolicies.unmasked[conn.User] ||
+		(s.topology != nil && conn.User == s.topology.Username) {
+		return nil
+	}
+	mask := &resultMask{policies: s.maskingPolicies, user: conn.User}
+	for _, rule := range s.maskingPolicies.rules {
+		if rule.Database != "" && !s.maskingPolicies.identifiers.Same(rule.Database, conn.DatabaseName) {
+			continue
+		}
+		if s.maskingPolicies.appliesTo(rule, conn.User) {
+			mask.rules = append(mask.rules, rule)
+		}
+	}
+	if len(mask.rules) == 0 {
+		return nil
+	}
+	return mask
+}
+
+// fields returns the masked fields of a bundle and their masks
+func (m *resultMask) fields(bundle string) map[string]string {
+	var fields map[string]string
+	for _, rule := range m.rules {
+		if m.policies.identifiers.Same(rule.Bundle, bundle) {
+			if fields == nil {
+				fields = make(map[string]string)
+			}
+			fields[rule.Field] = rule.Mask
+		}
+	}
+	return fields
+}
+
+// check refuses a statement that would hand masked values over other than in its result
+func (m *resultMask) check(statement engine.Statement) error {
+	revealed := func(bundle, field, how string) error {
+		return protocol.Errorf(protocol.ErrPermissionDenied, "%s would reveal field '%s' of bundle '%s', which is masked for user '%s'",
+			how, field, bundle, m.user)
+	}
+	switch cmd := statement.(type) {
+	case *engine.SelectDocumentsCommand:
+		if cmd.Modifiers != nil && cmd.Modifiers.OrderBy != nil {
+			if _, masked := m.fields(cmd.BundleName)[cmd.Modifiers.OrderBy.Field]; masked {
+				return revealed(cmd.BundleName, cmd.Modifiers.OrderBy.Field, "ORDER BY")
+			}
+		}
+	case *engine.SelectApproximateCommand:
+		for _, function := range cmd.Functions {
+			if function.Name != engine.FunctionTopK && function.Name != engine.FunctionPercentile {
+				continue
+			}
+			if _, masked := m.fields(cmd.BundleName)[function.Field]; masked {
+				return revealed(cmd.BundleName, function.Field, function.Name)
+			}
+		}
+	case *engine.InsertSelectCommand:
+		return m.checkCopy(cmd.Select.BundleName, statement)
+	case *engine.MergeCommand:
+		return m.checkCopy(cmd.Source, statement)
+	case *engine.BundleCopyCommand, *engine.CreateAggregateCommand, *engine.CreateWebhookCommand:
+		return m.checkCopy(engine.StatementBundle(statement), statement)
+	}
+	return nil
+}
+
+// checkCopy refuses a statement that copies the values of a bundle with masked fields
+// somewhere they would not be masked
+func (m *resultMask) checkCopy(bundle string, statement engine.Statement) error {
+	if len(m.fields(bundle)) == 0 {
+		return nil
+	}
+	return protocol.Errorf(protocol.ErrPermissionDenied, "%s cannot read bundle '%s', which has fields masked for user '%s'",
+		engine.StatementName(statement), bundle, m.user)
+}
+
+// apply masks the result of a statement
+func (m *resultMask) apply(statement engine.Statement, result interface{}) interface{} {
+	response, ok := result.(*engine.CommandResponse)
+	if !ok || response == nil {
+		return result
+	}
+	fields := m.fields(engine.StatementBundle(statement))
+	if len(fields) == 0 {
+		return result
+	}
+
+	masked := *response
+	switch cmd := statement.(type) {
+	case *engine.SelectDocumentsCommand:
+		switch documents := response.Result.(type) {
+		case []*models.Document:
+			list := make([]*models.Document, len(documents))
+			for i, doc := range documents {
+				list[i] = m.document(doc, fields)
+			}
+			masked.Result = list
+		case map[string]*models.Document:
+			byID := make(map[string]*models.Document, len(documents))
+			for docID, doc := range documents {
+				byID[docID] = m.document(doc, fields)
+			}
+			masked.Result = byID
+		}
+	case *engine.SelectDistinctCommand:
+		mask, isMasked := fields[cmd.Field]
+		values, isList := response.Result.([]interface{})
+		if !isMasked || !isList {
+			return result
+		}
+		list := make([]interface{}, len(values))
+		for i, value := range values {
+			list[i] = m.value(mask, value)
+		}
+		masked.Result = list
+	case *engine.ShowDocumentHistoryCommand:
+		versions, isList := response.Result.([]directors.DocumentVersion)
+		if !isList {
+			return result
+		}
+		list := make([]directors.DocumentVersion, len(versions))
+		for i, version := range versions {
+			version.Document = m.document(version.Document, fields)
+			list[i] = version
+		}
+		masked.Result = list
+	case *engine.ShowFieldStatsCommand:
+		stats, isList := response.Result.([]directors.FieldStats)
+		if !isList {
+			return result
+		}
+		list := make([]directors.FieldStats, len(stats))
+		for i, stat := range stats {
+			if _, isMasked := fields[stat.Field]; isMasked {
+				stat.Histogram = nil
+			}
+			list[i] = stat
+		}
+		masked.Result = list
+	default:
+		return result
+	}
+
+	if response.Metadata != nil {
+		metadata := *response.Metadata
+		metadata.Fields = make([]protocol.FieldMetadata, len(response.Metadata.Fields))
+		for i, field := range response.Metadata.Fields {
+			field.Masked = fields[field.Name]
+			metadata.Fields[i] = field
+		}
+		masked.Metadata = &metadata
+	}
+	return &masked
+}
+
+// document returns a copy of a document with its masked fields masked
+func (m *resultMask) document(doc *models.Document, fields map[string]string) *models.Document {
+	if doc == nil {
+		return nil
+	}
+	copied := *doc
+	copied.Fields = make(map[string]models.Field, len(doc.Fields))
+	for name, field := range doc.Fields {
+		if mask, isMasked := fields[name]; isMasked {
+			field.Value = m.value(mask, field.Value)
+		}
+		copied.Fields[name] = field
+	}
+	return &copied
+}
+
+// value masks one value; nil stays nil
+func (m *resultMask) value(mask string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	text, isText := value.(string)
+	if !isText {
+		text = fmt.Sprint(value)
+	}
+	switch mask {
+	case MaskLast4:
+		runes := []rune(text)
+		keep := 4
+		if len(runes) <= keep {
+			keep = 0
+		}
+		return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+	case MaskHash:
+		sum := sha256.Sum256([]byte(m.policies.salt + text))
+		return hex.EncodeToString(sum[:])
+	}
+	return redactedValue
+}
@@ -0,0 +1,476 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+	MongoDB wire protocol.
+
+	With -mongoport the server also speaks enough of the MongoDB wire protocol for Mongo
+	drivers and tools such as mongosh and Compass to connect and try SyndrDB out. A Mongo
+	database is a SyndrDB database and a collection is a bundle. The shim answers the
+	handshake (hello, isMaster, buildInfo, ping), listDatabases and listCollections, and
+	translates find, count, aggregate, insert, update and delete to SyndrQL, which then runs as any
+	client's command would, through read-only, maintenance and admission rules. Every other
+	command is answered with CommandNotFound.
+
+	It is a subset, see mongo_query.go:
+
+	  - filters compare fields with $eq, $ne, $gt, $gte, $lt, $lte, $in and $nin, and combine
+	    conditions with $and and $or
+	  - find takes a sort on one field, skip, limit and a projection; every result comes in
+	    the first batch, so there are no cursors to get more from
+	  - aggregate takes $match, $sort, $skip, $limit and $project in that order, optionally
+	    ending in $count or a $group counting every document, as countDocuments sends
+	  - update takes $set only; upsert inserts the filter's equalities with the $set fields
+	  - documents hold strings, numbers, booleans, ObjectIds and dates, not nested documents
+	    or arrays; ObjectIds and dates are stored as strings
+
+	_id is a field like any other, kept unique by the shim. A collection that insert names
+	is created with it, as is the database. Documents written in SyndrQL without an _id get
+	their DocumentID as _id.
+
+	Mongo clients are not authenticated, so -mongoport cannot be combined with -auth. The
+	listener has no TLS either; keep it on a trusted network.
+*/
+
+// MongoDB wire protocol opcodes
+const (
+	mongoOpReply = 1
+	mongoOpQuery = 2004
+	mongoOpMsg   = 2013
+)
+
+const (
+	mongoMaxMessageSize = 48000000 // Advertised in hello, as mongod does
+	mongoMaxBSONSize    = 16 * 1024 * 1024
+	mongoMaxWireVersion = 17 // MongoDB 6.0
+	mongoChecksumFlag   = 1 << 0
+	mongoMoreToComeFlag = 1 << 1
+)
+
+// mongoConnectionIDs numbers the connections, for hello's connectionId
+var mongoConnectionIDs atomic.Int32
+
+// mongoRequest is a message read from a Mongo client
+type mongoRequest struct {
+	requestID int32
+	opCode    int32
+	database  string
+	command   bson.D
+	noReply   bool // moreToCome was set: the client does not wait for a reply
+}
+
+// mongoError is a command failure, sent with ok: 0
+type mongoError struct {
+	code     int32
+	codeName string
+	message  string
+}
+
+func (e *mongoError) Error() string {
+	return e.message
+}
+
+func mongoErrorf(code int32, codeName, format string, args ...interface{}) *mongoError {
+	return &mongoError{code: code, codeName: codeName, message: fmt.Sprintf(format, args...)}
+}
+
+// startMongoListener starts accepting connections on the MongoDB port
+func (s *Server) startMongoListener() error {
+	address := net.JoinHostPort(s.config.Host, fmt.Sprint(s.config.MongoPort))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error starting MongoDB listener on %s: %w", address, err)
+	}
+	s.mongoListener = listener
+	s.logger.Infof("Accepting MongoDB wire protocol connections on %s", address)
+
+	go func() {
+		for s.Running {
+			conn, err := listener.Accept()
+			if err != nil {
+				if s.Running {
+					s.logger.Errorw("Error accepting MongoDB connection", "error", err)
+				}
+				continue
+			}
+			wg.Add(1)
+			go func(c net.Conn) {
+				defer wg.Done()
+				s.handleMongoConnection(c)
+			}(conn)
+		}
+	}()
+	return nil
+}
+
+// handleMongoConnection answers one Mongo client's requests until it disconnects
+func (s *Server) handleMongoConnection(conn net.Conn) {
+	connID := "mongo_" + generateConnectionID()
+	connection := &Connection{
+		ID:          connID,
+		Conn:        conn,
+		Authorized:  true,
+		LastActive:  time.Now(),
+		Logger:      s.logger,
+		ConnectedAt: time.Now(),
+	}
+	mongoID := mongoConnectionIDs.Add(1)
+
+	s.mu.Lock()
+	s.ActiveConnections[connID] = connection
+	s.mu.Unlock()
+	defer func() {
+		conn.Close()
+		s.CloseLocalConnection(connection)
+		s.mu.Lock()
+		delete(s.ActiveConnections, connID)
+		s.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	var replyID int32
+	for {
+		request, err := readMongoRequest(reader)
+		if err != nil {
+			var badRequest *mongoError
+			if errors.As(err, &badRequest) {
+				s.logger.Warnw("Closing MongoDB connection after a malformed message", "connID", connID, "error", err)
+			} else if err != io.EOF {
+				s.logger.Debugw("MongoDB connection ended", "connID", connID, "error", err)
+			}
+			return
+		}
+		s.mu.Lock()
+		connection.LastActive = time.Now()
+		s.mu.Unlock()
+
+		reply := s.runMongoCommand(connection, mongoID, request)
+		if request.noReply {
+			continue
+		}
+		replyID++
+		if err := writeMongoReply(writer, replyID, request, reply); err != nil {
+			s.logger.Debugw("Failed to reply to a MongoDB client", "connID", connID, "error", err)
+			return
+		}
+	}
+}
+
+// runMongoCommand runs one command, turning its failure or a panic into an error reply
+func (s *Server) runMongoCommand(conn *Connection, mongoID int32, request *mongoRequest) (reply bson.D) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.logger.Errorw("Recovered from a panic in a MongoDB command", "connID", conn.ID, "panic", recovered)
+			reply = mongoErrorReply(mongoErrorf(1, "InternalError", "internal error: %v", recovered))
+		}
+	}()
+	if len(request.command) == 0 {
+		return mongoErrorReply(mongoErrorf(59, "CommandNotFound", "no command given"))
+	}
+	name := request.command[0].Key
+	conn.Logger.Debugw("Received MongoDB command", "connID", conn.ID, "command", name, "database", request.database)
+
+	var result bson.D
+	var err error
+	switch strings.ToLower(name) {
+	case "hello", "ismaster":
+		result = s.mongoHello(conn, mongoID, request.command, name == "hello")
+	case "ping", "endsessions":
+		result = bson.D{}
+	case "buildinfo":
+		result = bson.D{
+			{Key: "version", Value: "6.0.0"},
+			{Key: "versionArray", Value: bson.A{int32(6), int32(0), int32(0), int32(0)}},
+			{Key: "gitVersion", Value: "syndrdb"},
+			{Key: "modules", Value: bson.A{}},
+			{Key: "bits", Value: int32(64)},
+			{Key: "debug", Value: false},
+			{Key: "maxBsonObjectSize", Value: int32(mongoMaxBSONSize)},
+		}
+	case "listdatabases":
+		result = s.mongoListDatabases()
+	case "listcollections":
+		result, err = s.mongoListCollections(conn, request.database)
+	case "find":
+		result, err = s.mongoFind(conn, request.database, request.command)
+	case "count":
+		result, err = s.mongoCount(conn, request.database, request.command)
+	case "aggregate":
+		result, err = s.mongoAggregate(conn, request.database, request.command)
+	case "insert":
+		result, err = s.mongoInsert(conn, request.database, request.command)
+	case "update":
+		result, err = s.mongoUpdate(conn, request.database, request.command)
+	case "delete":
+		result, err = s.mongoDelete(conn, request.database, request.command)
+	case "getmore":
+		err = mongoErrorf(43, "CursorNotFound", "cursor not found; every result is sent in the first batch")
+	case "killcursors":
+		result = bson.D{{Key: "cursorsKilled", Value: bson.A{}}, {Key: "cursorsNotFound", Value: bson.A{}}, {Key: "cursorsAlive", Value: bson.A{}}, {Key: "cursorsUnknown", Value: bson.A{}}}
+	default:
+		err = mongoErrorf(59, "CommandNotFound", "no such command: '%s'", name)
+	}
+	if err != nil {
+		return mongoErrorReply(err)
+	}
+	return append(result, bson.E{Key: "ok", Value: 1.0})
+}
+
+// mongoHello describes the server as a standalone mongod, and takes the application name
+// the driver sends with its first hello
+func (s *Server) mongoHello(conn *Connection, mongoID int32, command bson.D, hello bool) bson.D {
+	if client, ok := mongoField(command, "client").(bson.D); ok {
+		if application, ok := mongoField(client, "application").(bson.D); ok {
+			if name, ok := mongoField(application, "name").(string); ok {
+				s.mu.Lock()
+				conn.AppName = name
+				s.mu.Unlock()
+			}
+		}
+	}
+	primary := "ismaster"
+	if hello {
+		primary = "isWritablePrimary"
+	}
+	return bson.D{
+		{Key: "helloOk", Value: true},
+		{Key: primary, Value: true},
+		{Key: "maxBsonObjectSize", Value: int32(mongoMaxBSONSize)},
+		{Key: "maxMessageSizeBytes", Value: int32(mongoMaxMessageSize)},
+		{Key: "maxWriteBatchSize", Value: int32(100000)},
+		{Key: "localTime", Value: time.Now()},
+		{Key: "logicalSessionTimeoutMinutes", Value: int32(30)},
+		{Key: "connectionId", Value: mongoID},
+		{Key: "minWireVersion", Value: int32(0)},
+		{Key: "maxWireVersion", Value: int32(mongoMaxWireVersion)},
+		{Key: "readOnly", Value: s.readOnly.Load()},
+	}
+}
+
+// mongoListDatabases lists every database, without sizes
+func (s *Server) mongoListDatabases() bson.D {
+	databases := bson.A{}
+	for _, database := range s.services.DatabaseService.ListDatabases() {
+		databases = append(databases, bson.D{
+			{Key: "name", Value: database.Name},
+			{Key: "sizeOnDisk", Value: int64(0)},
+			{Key: "empty", Value: len(database.Bundles) == 0 && len(database.BundleFiles) == 0},
+		})
+	}
+	return bson.D{{Key: "databases", Value: databases}, {Key: "totalSize", Value: int64(0)}}
+}
+
+func mongoErrorReply(err error) bson.D {
+	var failure *mongoError
+	if !errors.As(err, &failure) {
+		failure = mongoErrorf(1, "InternalError", "%s", err.Error())
+	}
+	return bson.D{
+		{Key: "ok", Value: 0.0},
+		{Key: "errmsg", Value: failure.message},
+		{Key: "code", Value: failure.code},
+		{Key: "codeName", Value: failure.codeName},
+	}
+}
+
+// mongoField returns the value of a key in a command or document, nil when it is missing
+func mongoField(document bson.D, key string) interface{} {
+	for _, element := range document {
+		if element.Key == key {
+			return element.Value
+		}
+	}
+	return nil
+}
+
+// readMongoRequest reads an OP_MSG, or an OP_QUERY on a database's $cmd collection, which
+// drivers send their first hello as
+func readMongoRequest(reader *bufio.Reader) (*mongoRequest, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := int32(binary.LittleEndian.Uint32(header[0:4]))
+	if length < 16 || length > mongoMaxMessageSize {
+		return nil, mongoErrorf(2, "BadValue", "message length %d is out of range", length)
+	}
+	body := make([]byte, length-16)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	request := &mongoRequest{
+		requestID: int32(binary.LittleEndian.Uint32(header[4:8])),
+		opCode:    int32(binary.LittleEndian.Uint32(header[12:16])),
+	}
+
+	var err error
+	switch request.opCode {
+	case mongoOpMsg:
+		err = parseMongoMsg(request, body)
+	case mongoOpQuery:
+		err = parseMongoQuery(request, body)
+	default:
+		err = mongoErrorf(2, "BadValue", "unsupported opcode %d", request.opCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// parseMongoMsg decodes an OP_MSG: its body section, with the document sequences (such as
+// an insert's documents) added to it as arrays
+func parseMongoMsg(request *mongoRequest, body []byte) error {
+	if len(body) < 4 {
+		return mongoErrorf(2, "BadValue", "OP_MSG is too short")
+	}
+	flags := binary.LittleEndian.Uint32(body[0:4])
+	request.noReply = flags&mongoMoreToComeFlag != 0
+	sections := body[4:]
+	if flags&mongoChecksumFlag != 0 {
+		if len(sections) < 4 {
+			return mongoErrorf(2, "BadValue", "OP_MSG is too short for its checksum")
+		}
+		sections = sections[:len(sections)-4]
+	}
+
+	var sequences []bson.E
+	for len(sections) > 0 {
+		kind := sections[0]
+		sections = sections[1:]
+		switch kind {
+		case 0:
+			document, rest, err := nextMongoDocument(sections)
+			if err != nil {
+				return err
+			}
+			if err := bson.Unmarshal(document, &request.command); err != nil {
+				return mongoErrorf(2, "BadValue", "malformed command: %v", err)
+			}
+			sections = rest
+		case 1:
+			if len(sections) < 4 {
+				return mongoErrorf(2, "BadValue", "truncated document sequence")
+			}
+			size := int(binary.LittleEndian.Uint32(sections[0:4]))
+			if size < 5 || size > len(sections) {
+				return mongoErrorf(2, "BadValue", "document sequence size %d is out of range", size)
+			}
+			sequence := sections[4:size]
+			sections = sections[size:]
+			end := strings.IndexByte(string(sequence), 0)
+			if end < 0 {
+				return mongoErrorf(2, "BadValue", "document sequence has no identifier")
+			}
+			identifier := string(sequence[:end])
+			documents := bson.A{}
+			for rest := sequence[end+1:]; len(rest) > 0; {
+				var document []byte
+				var err error
+				if document, rest, err = nextMongoDocument(rest); err != nil {
+					return err
+				}
+				var decoded bson.D
+				if err := bson.Unmarshal(document, &decoded); err != nil {
+					return mongoErrorf(2, "BadValue", "malformed document in '%s': %v", identifier, err)
+				}
+				documents = append(documents, decoded)
+			}
+			sequences = append(sequences, bson.E{Key: identifier, Value: documents})
+		default:
+			return mongoErrorf(2, "BadValue", "unsupported OP_MSG section kind %d", kind)
+		}
+	}
+	request.command = append(request.command, sequences...)
+	request.database, _ = mongoField(request.command, "$db").(string)
+	return nil
+}
+
+// parseMongoQuery decodes an OP_QUERY; only commands, on <database>.$cmd, are answered
+func parseMongoQuery(request *mongoRequest, body []byte) error {
+	if len(body) < 4 {
+		return mongoErrorf(2, "BadValue", "OP_QUERY is too short")
+	}
+	rest := body[4:] // Flags
+	end := strings.IndexByte(string(rest), 0)
+	if end < 0 || len(rest) < end+9 {
+		return mongoErrorf(2, "BadValue", "OP_QUERY has no collection name")
+	}
+	collection := string(rest[:end])
+	rest = rest[end+9:] // The name, numberToSkip and numberToReturn
+	database, isCommand := strings.CutSuffix(collection, ".$cmd")
+	if !isCommand {
+		return mongoErrorf(2, "BadValue", "OP_QUERY is only supported for commands, not on '%s'", collection)
+	}
+	document, _, err := nextMongoDocument(rest)
+	if err != nil {
+		return err
+	}
+	if err := bson.Unmarshal(document, &request.command); err != nil {
+		return mongoErrorf(2, "BadValue", "malformed command: %v", err)
+	}
+	// Commands may come wrapped with read preferences as {$query: {...}}
+	if wrapped, ok := mongoField(request.command, "$query").(bson.D); ok {
+		request.command = wrapped
+	}
+	request.database = database
+	return nil
+}
+
+// nextMongoDocument splits the BSON document at the start of data from what follows it
+func nextMongoDocument(data []byte) ([]byte, []byte, error) {
+	if len(data) < 5 {
+		return nil, nil, mongoErrorf(2, "BadValue", "truncated BSON document")
+	}
+	size := int(binary.LittleEndian.Uint32(data[0:4]))
+	if size < 5 || size > len(data) {
+		return nil, nil, mongoErrorf(2, "BadValue", "BSON document size %d is out of range", size)
+	}
+	return data[:size], data[size:], nil
+}
+
+// writeMongoReply answers a request in kind: OP_MSG with OP_MSG, OP_QUERY with OP_REPLY
+func writeMongoReply(writer *bufio.Writer, replyID int32, request *mongoRequest, reply bson.D) error {
+	document, err := bson.Marshal(reply)
+	if err != nil {
+		document, _ = bson.Marshal(mongoErrorReply(fmt.Errorf("encoding the reply: %w", err)))
+	}
+
+	var body []byte
+	opCode := int32(mongoOpMsg)
+	if request.opCode == mongoOpQuery {
+		opCode = mongoOpReply
+		body = make([]byte, 20) // Flags, cursor ID and starting position, all 0, then the count
+		binary.LittleEndian.PutUint32(body[16:20], 1)
+	} else {
+		body = make([]byte, 5) // Flags 0, then a body section
+	}
+	body = append(body, document...)
+
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(16+len(body)))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(replyID))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(request.requestID))
+	binary.LittleEndian.PutUint32(header[12:16], uint32(opCode))
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := writer.Write(body); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
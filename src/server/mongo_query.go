@@ -0,0 +1,776 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"syndrdb/src/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mongoUse makes a Mongo database the connection's current one, creating it when create is
+// set; it reports false for a database that does not exist
+func (s *Server) mongoUse(conn *Connection, database string, create bool) (bool, error) {
+	if database == "" {
+		database = "test"
+	}
+	if conn.Database != nil && s.identifiers.Same(conn.DatabaseName, database) {
+		return true, nil
+	}
+	if _, err := s.databaseService.GetDatabaseByName(database); err != nil {
+		if !create {
+			return false, nil
+		}
+		if _, err := s.runTranslated(conn, "CREATE DATABASE "+syndrqlString(database)); err != nil {
+			return false, err
+		}
+	}
+	if _, err := s.runTranslated(conn, "USE DATABASE "+syndrqlString(database)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mongoCollection opens the database of a command and reports whether its collection, the
+// command's first value, exists; with create both are created when missing
+func (s *Server) mongoCollection(conn *Connection, database string, command bson.D, create bool) (string, bool, error) {
+	collection, _ := command[0].Value.(string)
+	if collection == "" {
+		return "", false, mongoErrorf(73, "InvalidNamespace", "%s needs a collection name", command[0].Key)
+	}
+	exists, err := s.mongoUse(conn, database, create)
+	if err != nil || !exists {
+		return collection, false, err
+	}
+	if _, err := s.services.BundleService.GetBundleByName(conn.Database, collection); err == nil {
+		return collection, true, nil
+	}
+	if !create {
+		return collection, false, nil
+	}
+	createBundle := fmt.Sprintf("CREATE BUNDLE %s WITH FIELDS ({`_id`, STRING, true, true})", syndrqlString(collection))
+	if _, err := s.runTranslated(conn, createBundle); err != nil {
+		return collection, false, err
+	}
+	return collection, true, nil
+}
+
+// mongoListCollections lists the bundles of a database
+func (s *Server) mongoListCollections(conn *Connection, database string) (bson.D, error) {
+	collections := bson.A{}
+	exists, err := s.mongoUse(conn, database, false)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		for _, name := range bundleNames(conn.Database) {
+			collections = append(collections, bson.D{
+				{Key: "name", Value: name},
+				{Key: "type", Value: "collection"},
+				{Key: "options", Value: bson.D{}},
+				{Key: "info", Value: bson.D{{Key: "readOnly", Value: false}}},
+			})
+		}
+	}
+	return mongoCursor(database+".$cmd.listCollections", collections), nil
+}
+
+// mongoCursor is the reply to a command returning documents, all in the first batch
+func mongoCursor(namespace string, batch bson.A) bson.D {
+	return bson.D{{Key: "cursor", Value: bson.D{
+		{Key: "firstBatch", Value: batch},
+		{Key: "id", Value: int64(0)},
+		{Key: "ns", Value: namespace},
+	}}}
+}
+
+// mongoFind answers find with SELECT DOCUMENTS
+func (s *Server) mongoFind(conn *Connection, database string, command bson.D) (bson.D, error) {
+	collection, batch, err := s.mongoFindDocuments(conn, database, command)
+	if err != nil {
+		return nil, err
+	}
+	return mongoCursor(database+"."+collection, batch), nil
+}
+
+// mongoFindDocuments returns the documents a find command asks for, converted for the client
+func (s *Server) mongoFindDocuments(conn *Connection, database string, command bson.D) (string, bson.A, error) {
+	collection, exists, err := s.mongoCollection(conn, database, command, false)
+	if err != nil || !exists {
+		return collection, bson.A{}, err
+	}
+
+	filter, _ := mongoField(command, "filter").(bson.D)
+	skip, limit := mongoInt(mongoField(command, "skip")), mongoInt(mongoField(command, "limit"))
+	if limit < 0 {
+		limit = -limit // A negative limit asks for a single batch, which every find is
+	}
+	query, err := mongoSelect(collection, filter, limit, skip)
+	if err != nil {
+		return "", nil, err
+	}
+	if sortBy, ok := mongoField(command, "sort").(bson.D); ok && len(sortBy) > 0 {
+		if len(sortBy) > 1 {
+			return "", nil, mongoErrorf(2, "BadValue", "sort is supported on one field only")
+		}
+		field, err := syndrqlField(sortBy[0].Key)
+		if err != nil {
+			return "", nil, err
+		}
+		direction := "ASC"
+		if mongoInt(sortBy[0].Value) < 0 {
+			direction = "DESC"
+		}
+		query = strings.Replace(query, " LIMIT ", fmt.Sprintf(" ORDER BY %s %s LIMIT ", field, direction), 1)
+		if limit == 0 {
+			query += fmt.Sprintf(" ORDER BY %s %s", field, direction)
+		}
+	}
+
+	response, err := s.runTranslated(conn, query)
+	if err != nil {
+		return "", nil, err
+	}
+	documents := resultDocuments(response)
+	documents = documents[min(skip, len(documents)):]
+
+	projection, _ := mongoField(command, "projection").(bson.D)
+	batch := make(bson.A, 0, len(documents))
+	for _, document := range documents {
+		batch = append(batch, mongoDocument(document, projection))
+	}
+	return collection, batch, nil
+}
+
+// mongoCount answers count with the number of documents a SELECT DOCUMENTS returns
+func (s *Server) mongoCount(conn *Connection, database string, command bson.D) (bson.D, error) {
+	collection, exists, err := s.mongoCollection(conn, database, command, false)
+	if err != nil || !exists {
+		return bson.D{{Key: "n", Value: int32(0)}}, err
+	}
+	filter, _ := mongoField(command, "query").(bson.D)
+	skip, limit := mongoInt(mongoField(command, "skip")), mongoInt(mongoField(command, "limit"))
+	query, err := mongoSelect(collection, filter, max(limit, -limit), skip)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.runTranslated(conn, query)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Key: "n", Value: int32(max(len(resultDocuments(response))-skip, 0))}}, nil
+}
+
+// mongoAggregateStages are the stages aggregate takes, each at most once and in this order
+var mongoAggregateStages = map[string]int{"$match": 1, "$sort": 2, "$skip": 3, "$limit": 4, "$project": 5, "$count": 6, "$group": 6}
+
+// mongoAggregate answers the pipelines a find could: they are run as one, then counted when
+// they end in $count or in a $group with a constant _id and a {$sum: 1} field
+func (s *Server) mongoAggregate(conn *Connection, database string, command bson.D) (bson.D, error) {
+	pipeline, ok := mongoField(command, "pipeline").(bson.A)
+	if !ok {
+		return nil, mongoErrorf(9, "FailedToParse", "aggregate needs a pipeline")
+	}
+	find := bson.D{{Key: "find", Value: command[0].Value}}
+	var count bson.D // The counting document, with the count still to be added
+	var countField string
+	last := 0
+	for _, item := range pipeline {
+		stage, _ := item.(bson.D)
+		if len(stage) != 1 {
+			return nil, mongoErrorf(40323, "Location40323", "a pipeline stage must be a document with one field")
+		}
+		name, value := stage[0].Key, stage[0].Value
+		rank, supported := mongoAggregateStages[name]
+		if !supported {
+			return nil, mongoErrorf(2, "BadValue", "pipeline stage %s is not supported", name)
+		}
+		if rank <= last {
+			return nil, mongoErrorf(2, "BadValue", "pipeline stage %s is not supported where it is; stages go $match, $sort, $skip, $limit, $project, then $count or $group", name)
+		}
+		last = rank
+
+		switch name {
+		case "$match":
+			find = append(find, bson.E{Key: "filter", Value: value})
+		case "$project":
+			find = append(find, bson.E{Key: "projection", Value: value})
+		case "$sort", "$skip", "$limit":
+			find = append(find, bson.E{Key: name[1:], Value: value})
+		case "$count":
+			countField, _ = value.(string)
+			if countField == "" || strings.HasPrefix(countField, "$") {
+				return nil, mongoErrorf(40156, "Location40156", "$count needs a field name")
+			}
+			count = bson.D{}
+		case "$group":
+			group, _ := value.(bson.D)
+			if len(group) != 2 || group[0].Key != "_id" {
+				return nil, mongoErrorf(2, "BadValue", "$group is supported with _id and one {$sum: 1} field only")
+			}
+			if id, isString := group[0].Value.(string); isString && strings.HasPrefix(id, "$") {
+				return nil, mongoErrorf(2, "BadValue", "$group is supported with a constant _id only")
+			}
+			sum, _ := group[1].Value.(bson.D)
+			if len(sum) != 1 || sum[0].Key != "$sum" || mongoInt(sum[0].Value) != 1 {
+				return nil, mongoErrorf(2, "BadValue", "$group is supported with _id and one {$sum: 1} field only")
+			}
+			countField = group[1].Key
+			count = bson.D{{Key: "_id", Value: group[0].Value}}
+		}
+	}
+
+	collection, batch, err := s.mongoFindDocuments(conn, database, find)
+	if err != nil {
+		return nil, err
+	}
+	if countField != "" {
+		if len(batch) > 0 {
+			batch = bson.A{append(count, bson.E{Key: countField, Value: int32(len(batch))})}
+		} else {
+			batch = bson.A{} // No documents, no group to count them in
+		}
+	}
+	return mongoCursor(database+"."+collection, batch), nil
+}
+
+// mongoInsert adds each document with ADD DOCUMENT, giving those without an _id an ObjectId
+func (s *Server) mongoInsert(conn *Connection, database string, command bson.D) (bson.D, error) {
+	documents, _ := mongoField(command, "documents").(bson.A)
+	if len(documents) == 0 {
+		return nil, mongoErrorf(2, "BadValue", "insert needs at least one document")
+	}
+	s.mongoWrites.Lock()
+	defer s.mongoWrites.Unlock()
+	collection, _, err := s.mongoCollection(conn, database, command, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := mongoField(command, "ordered") != false
+	inserted := 0
+	var writeErrors bson.A
+	for index, value := range documents {
+		document, ok := value.(bson.D)
+		if !ok {
+			return nil, mongoErrorf(2, "BadValue", "documents must be documents")
+		}
+		if err := s.mongoInsertOne(conn, collection, database, document); err != nil {
+			writeErrors = append(writeErrors, mongoWriteError(index, err))
+			if ordered {
+				break
+			}
+			continue
+		}
+		inserted++
+	}
+	return mongoWriteReply(bson.D{{Key: "n", Value: int32(inserted)}}, writeErrors), nil
+}
+
+// mongoInsertOne adds a document, refusing an _id another document has; s.mongoWrites must be held
+func (s *Server) mongoInsertOne(conn *Connection, collection, database string, document bson.D) error {
+	id := mongoField(document, "_id")
+	if id == nil {
+		id = primitive.NewObjectID()
+		document = append(bson.D{{Key: "_id", Value: id}}, document...)
+	}
+	idLiteral, err := syndrqlLiteral(id)
+	if err != nil {
+		return err
+	}
+	taken, err := s.runTranslated(conn, fmt.Sprintf("SELECT DOCUMENTS FROM %s WHERE `_id` == %s LIMIT 1", syndrqlString(collection), idLiteral))
+	if err != nil {
+		return err
+	}
+	if len(resultDocuments(taken)) > 0 {
+		return mongoErrorf(11000, "DuplicateKey", "E11000 duplicate key error collection: %s.%s index: _id_ dup key: { _id: %s }", database, collection, idLiteral)
+	}
+
+	fields := make([]string, 0, len(document))
+	for _, element := range document {
+		if element.Value == nil {
+			continue // Documents have no null values; the field is left out
+		}
+		field, err := syndrqlField(element.Key)
+		if err != nil {
+			return err
+		}
+		literal, err := syndrqlLiteral(element.Value)
+		if err != nil {
+			return fmt.Errorf("field '%s': %w", element.Key, err)
+		}
+		fields = append(fields, fmt.Sprintf("{%s = %s}", field, literal))
+	}
+	_, err = s.runTranslated(conn, fmt.Sprintf("ADD DOCUMENT TO BUNDLE %s WITH (%s)", syndrqlString(collection), strings.Join(fields, ", ")))
+	return err
+}
+
+// mongoUpdate applies each update's $set with UPDATE DOCUMENTS, to the first matching
+// document or with multi to all of them
+func (s *Server) mongoUpdate(conn *Connection, database string, command bson.D) (bson.D, error) {
+	updates, _ := mongoField(command, "updates").(bson.A)
+	s.mongoWrites.Lock()
+	defer s.mongoWrites.Unlock()
+
+	ordered := mongoField(command, "ordered") != false
+	matched, modified := 0, 0
+	var upserted, writeErrors bson.A
+	for index, value := range updates {
+		update, _ := value.(bson.D)
+		n, id, err := s.mongoUpdateOne(conn, database, command, update)
+		if err != nil {
+			writeErrors = append(writeErrors, mongoWriteError(index, err))
+			if ordered {
+				break
+			}
+			continue
+		}
+		if id != nil {
+			upserted = append(upserted, bson.D{{Key: "index", Value: int32(index)}, {Key: "_id", Value: id}})
+			continue
+		}
+		matched += n
+		modified += n
+	}
+	reply := bson.D{{Key: "n", Value: int32(matched + len(upserted))}, {Key: "nModified", Value: int32(modified)}}
+	if len(upserted) > 0 {
+		reply = append(reply, bson.E{Key: "upserted", Value: upserted})
+	}
+	return mongoWriteReply(reply, writeErrors), nil
+}
+
+// mongoUpdateOne runs one update statement, returning how many documents it changed, or the
+// _id of the document it upserted; s.mongoWrites must be held
+func (s *Server) mongoUpdateOne(conn *Connection, database string, command, update bson.D) (int, interface{}, error) {
+	filter, _ := mongoField(update, "q").(bson.D)
+	change, ok := mongoField(update, "u").(bson.D)
+	if !ok {
+		return 0, nil, mongoErrorf(2, "BadValue", "update pipelines are not supported; use $set")
+	}
+	var set bson.D
+	for _, operator := range change {
+		if operator.Key != "$set" {
+			if !strings.HasPrefix(operator.Key, "$") {
+				return 0, nil, mongoErrorf(2, "BadValue", "replacement documents are not supported; use $set")
+			}
+			return 0, nil, mongoErrorf(2, "BadValue", "update operator %s is not supported; use $set", operator.Key)
+		}
+		fields, _ := operator.Value.(bson.D)
+		set = append(set, fields...)
+	}
+	assignments := make([]string, 0, len(set))
+	for _, element := range set {
+		if element.Key == "_id" {
+			return 0, nil, mongoErrorf(66, "ImmutableField", "performing an update on the path '_id' would modify the immutable field '_id'")
+		}
+		field, err := syndrqlField(element.Key)
+		if err != nil {
+			return 0, nil, err
+		}
+		literal, err := syndrqlLiteral(element.Value)
+		if err != nil {
+			return 0, nil, fmt.Errorf("field '%s': %w", element.Key, err)
+		}
+		assignments = append(assignments, fmt.Sprintf("%s = %s", field, literal))
+	}
+	if len(assignments) == 0 {
+		return 0, nil, mongoErrorf(9, "FailedToParse", "update needs $set with at least one field")
+	}
+
+	upsert := mongoField(update, "upsert") == true
+	collection, exists, err := s.mongoCollection(conn, database, command, upsert)
+	if err != nil {
+		return 0, nil, err
+	}
+	var documents []*models.Document
+	if exists {
+		if documents, err = s.mongoMatches(conn, collection, filter, mongoField(update, "multi") != true); err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(documents) == 0 {
+		if !upsert {
+			return 0, nil, nil
+		}
+		// The new document holds the filter's equalities, then the $set fields
+		var document bson.D
+		for _, element := range filter {
+			if strings.HasPrefix(element.Key, "$") {
+				continue
+			}
+			if operators, ok := element.Value.(bson.D); ok {
+				if equal := mongoField(operators, "$eq"); equal != nil {
+					document = append(document, bson.E{Key: element.Key, Value: equal})
+				}
+				continue
+			}
+			document = append(document, element)
+		}
+		document = append(document, set...)
+		if mongoField(document, "_id") == nil {
+			document = append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, document...)
+		}
+		if err := s.mongoInsertOne(conn, collection, database, document); err != nil {
+			return 0, nil, err
+		}
+		return 0, mongoField(document, "_id"), nil
+	}
+
+	where, err := mongoTargets(filter, documents, mongoField(update, "multi") == true)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = s.runTranslated(conn, fmt.Sprintf("UPDATE DOCUMENTS IN BUNDLE %s (%s) WHERE %s", syndrqlString(collection), strings.Join(assignments, ", "), where))
+	if err != nil {
+		return 0, nil, err
+	}
+	return len(documents), nil, nil
+}
+
+// mongoDelete runs each delete statement with DELETE DOCUMENTS, on one matching document
+// when its limit is 1
+func (s *Server) mongoDelete(conn *Connection, database string, command bson.D) (bson.D, error) {
+	deletes, _ := mongoField(command, "deletes").(bson.A)
+	s.mongoWrites.Lock()
+	defer s.mongoWrites.Unlock()
+	collection, exists, err := s.mongoCollection(conn, database, command, false)
+	if err != nil || !exists {
+		return bson.D{{Key: "n", Value: int32(0)}}, err
+	}
+
+	ordered := mongoField(command, "ordered") != false
+	deleted := 0
+	var writeErrors bson.A
+	for index, value := range deletes {
+		statement, _ := value.(bson.D)
+		filter, _ := mongoField(statement, "q").(bson.D)
+		multi := mongoInt(mongoField(statement, "limit")) == 0
+		documents, err := s.mongoMatches(conn, collection, filter, !multi)
+		if err == nil && len(documents) > 0 {
+			var where string
+			if where, err = mongoTargets(filter, documents, multi); err == nil {
+				_, err = s.runTranslated(conn, fmt.Sprintf("DELETE DOCUMENTS FROM %s WHERE %s", syndrqlString(collection), where))
+			}
+		}
+		if err != nil {
+			writeErrors = append(writeErrors, mongoWriteError(index, err))
+			if ordered {
+				break
+			}
+			continue
+		}
+		deleted += len(documents)
+	}
+	return mongoWriteReply(bson.D{{Key: "n", Value: int32(deleted)}}, writeErrors), nil
+}
+
+// mongoMatches returns the documents a filter matches, only the first with one set
+func (s *Server) mongoMatches(conn *Connection, collection string, filter bson.D, one bool) ([]*models.Document, error) {
+	limit := 0
+	if one {
+		limit = 1
+	}
+	query, err := mongoSelect(collection, filter, limit, 0)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.runTranslated(conn, query)
+	if err != nil {
+		return nil, err
+	}
+	return resultDocuments(response), nil
+}
+
+// mongoTargets is the WHERE condition of an update or delete: the filter itself for many
+// documents, the DocumentID of the one matched otherwise
+func mongoTargets(filter bson.D, documents []*models.Document, multi bool) (string, error) {
+	if !multi {
+		return "DocumentID == " + syndrqlString(documents[0].DocumentID), nil
+	}
+	condition, err := mongoCondition(filter)
+	if condition == "" {
+		condition = `DocumentID != ""` // Every document; UPDATE and DELETE need a WHERE
+	}
+	return condition, err
+}
+
+func mongoWriteError(index int, err error) bson.D {
+	reply := mongoErrorReply(err)
+	return bson.D{
+		{Key: "index", Value: int32(index)},
+		{Key: "code", Value: mongoField(reply, "code")},
+		{Key: "errmsg", Value: mongoField(reply, "errmsg")},
+	}
+}
+
+func mongoWriteReply(reply bson.D, writeErrors bson.A) bson.D {
+	if len(writeErrors) > 0 {
+		reply = append(reply, bson.E{Key: "writeErrors", Value: writeErrors})
+	}
+	return reply
+}
+
+// mongoSelect builds the SELECT DOCUMENTS a filter asks for, reading skip documents more
+// than limit so the first can be dropped
+func mongoSelect(collection string, filter bson.D, limit, skip int) (string, error) {
+	condition, err := mongoCondition(filter)
+	if err != nil {
+		return "", err
+	}
+	query := "SELECT DOCUMENTS FROM " + syndrqlString(collection)
+	if condition != "" {
+		query += " WHERE " + condition
+	}
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit+skip)
+	}
+	return query, nil
+}
+
+// mongoDocument converts a document for a Mongo client: _id first, then the fields in name
+// order, as a projection includes or excludes them. A document without an _id field has its
+// DocumentID as _id.
+func mongoDocument(document *models.Document, projection bson.D) bson.D {
+	include, exclude := make(map[string]bool), make(map[string]bool)
+	for _, element := range projection {
+		if mongoTruthy(element.Value) {
+			include[element.Key] = true
+		} else {
+			exclude[element.Key] = true
+		}
+	}
+	delete(include, "_id")
+	shown := func(name string) bool {
+		if exclude[name] {
+			return false
+		}
+		return len(include) == 0 || include[name] || name == "_id"
+	}
+
+	converted := bson.D{}
+	if shown("_id") {
+		var id interface{} = document.DocumentID
+		if field, exists := document.Fields["_id"]; exists && field.Value != nil {
+			id = field.Value
+		}
+		converted = append(converted, bson.E{Key: "_id", Value: id})
+	}
+	names := make([]string, 0, len(document.Fields))
+	for name := range document.Fields {
+		if name != "_id" && shown(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		converted = append(converted, bson.E{Key: name, Value: document.Fields[name].Value})
+	}
+	return converted
+}
+
+// mongoCondition translates a filter into a SyndrQL condition, "" for one matching every document
+func mongoCondition(filter bson.D) (string, error) {
+	var terms []string
+	for _, element := range filter {
+		var term string
+		var err error
+		switch element.Key {
+		case "$and", "$or":
+			term, err = mongoConditionList(element.Key, element.Value)
+		default:
+			if strings.HasPrefix(element.Key, "$") {
+				return "", mongoErrorf(2, "BadValue", "query operator %s is not supported", element.Key)
+			}
+			term, err = mongoFieldCondition(element.Key, element.Value)
+		}
+		if err != nil {
+			return "", err
+		}
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return joinConditions(terms, "AND"), nil
+}
+
+// mongoConditionList translates $and or $or
+func mongoConditionList(operator string, value interface{}) (string, error) {
+	filters, _ := value.(bson.A)
+	if len(filters) == 0 {
+		return "", mongoErrorf(2, "BadValue", "%s needs a non-empty array", operator)
+	}
+	terms := make([]string, 0, len(filters))
+	for _, item := range filters {
+		filter, ok := item.(bson.D)
+		if !ok {
+			return "", mongoErrorf(2, "BadValue", "%s entries must be documents", operator)
+		}
+		term, err := mongoCondition(filter)
+		if err != nil {
+			return "", err
+		}
+		if term == "" {
+			if operator == "$or" {
+				return "", nil // One alternative matches everything
+			}
+			continue
+		}
+		terms = append(terms, term)
+	}
+	if operator == "$or" {
+		return joinConditions(terms, "OR"), nil
+	}
+	return joinConditions(terms, "AND"), nil
+}
+
+// mongoFieldCondition translates the condition on one field: a value it must equal, or
+// comparison operators
+func mongoFieldCondition(name string, value interface{}) (string, error) {
+	field, err := syndrqlField(name)
+	if err != nil {
+		return "", err
+	}
+	operators, ok := value.(bson.D)
+	if !ok || len(operators) == 0 || !strings.HasPrefix(operators[0].Key, "$") {
+		return mongoComparison(name, field, "==", value)
+	}
+
+	var terms []string
+	for _, operator := range operators {
+		var term string
+		switch operator.Key {
+		case "$eq":
+			term, err = mongoComparison(name, field, "==", operator.Value)
+		case "$ne":
+			term, err = mongoComparison(name, field, "!=", operator.Value)
+		case "$gt":
+			term, err = mongoComparison(name, field, ">", operator.Value)
+		case "$lt":
+			term, err = mongoComparison(name, field, "<", operator.Value)
+		case "$gte", "$lte":
+			// SyndrQL compares with == and the strict operators only
+			var strict, equal string
+			if strict, err = mongoComparison(name, field, operator.Key[:3], operator.Value); err == nil {
+				strict = strings.Replace(strict, " $gt ", " > ", 1)
+				strict = strings.Replace(strict, " $lt ", " < ", 1)
+				if equal, err = mongoComparison(name, field, "==", operator.Value); err == nil {
+					term = joinConditions([]string{strict, equal}, "OR")
+				}
+			}
+		case "$in", "$nin":
+			values, isArray := operator.Value.(bson.A)
+			if !isArray {
+				return "", mongoErrorf(2, "BadValue", "%s needs an array", operator.Key)
+			}
+			comparison, join := "==", "OR"
+			if operator.Key == "$nin" {
+				comparison, join = "!=", "AND"
+			}
+			alternatives := make([]string, 0, len(values))
+			for _, item := range values {
+				alternative, err := mongoComparison(name, field, comparison, item)
+				if err != nil {
+					return "", err
+				}
+				alternatives = append(alternatives, alternative)
+			}
+			term = joinConditions(alternatives, join)
+			if term == "" && operator.Key == "$in" {
+				term = `DocumentID == ""` // Matches nothing
+			}
+		default:
+			return "", mongoErrorf(2, "BadValue", "query operator %s is not supported", operator.Key)
+		}
+		if err != nil {
+			return "", err
+		}
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return joinConditions(terms, "AND"), nil
+}
+
+// mongoComparison compares a field with a value. A document without an _id field has its
+// DocumentID as _id, so _id equality matches either.
+func mongoComparison(name, field, operator string, value interface{}) (string, error) {
+	switch operator {
+	case "$gt":
+		operator = ">"
+	case "$lt":
+		operator = "<"
+	}
+	literal, err := syndrqlLiteral(value)
+	if err != nil {
+		return "", fmt.Errorf("filter on '%s': %w", name, err)
+	}
+	term := fmt.Sprintf("%s %s %s", field, operator, literal)
+	if name == "_id" && operator == "==" {
+		term = joinConditions([]string{term, "DocumentID == " + literal}, "OR")
+	}
+	return term, nil
+}
+
+func joinConditions(terms []string, operator string) string {
+	switch len(terms) {
+	case 0:
+		return ""
+	case 1:
+		return terms[0]
+	}
+	return "(" + strings.Join(terms, ") "+operator+" (") + ")"
+}
+
+// syndrqlLiteral writes a BSON value as a SyndrQL literal. ObjectIds and dates become strings.
+func syndrqlLiteral(value interface{}) (string, error) {
+	switch typed := value.(type) {
+	case string:
+		return syndrqlString(typed), nil
+	case int32:
+		return strconv.FormatInt(int64(typed), 10), nil
+	case int64:
+		return strconv.FormatInt(typed, 10), nil
+	case float64:
+		if math.IsNaN(typed) || math.IsInf(typed, 0) {
+			return "", mongoErrorf(2, "BadValue", "NaN and infinite numbers are not supported")
+		}
+		return strconv.FormatFloat(typed, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(typed), nil
+	case primitive.ObjectID:
+		return syndrqlString(typed.Hex()), nil
+	case primitive.DateTime:
+		return syndrqlString(typed.Time().UTC().Format(time.RFC3339Nano)), nil
+	case nil, primitive.Null:
+		return "", mongoErrorf(2, "BadValue", "null values are not supported")
+	case bson.D, bson.A:
+		return "", mongoErrorf(2, "BadValue", "nested documents and arrays are not supported")
+	}
+	return "", mongoErrorf(2, "BadValue", "values of BSON type %T are not supported", value)
+}
+
+// mongoInt reads a number Mongo sent as any numeric BSON type
+func mongoInt(value interface{}) int {
+	switch typed := value.(type) {
+	case int32:
+		return int(typed)
+	case int64:
+		return int(typed)
+	case float64:
+		return int(typed)
+	}
+	return 0
+}
+
+// mongoTruthy reads a projection value: a number other than 0, or true
+func mongoTruthy(value interface{}) bool {
+	if flag, ok := value.(bool); ok {
+		return flag
+	}
+	return mongoInt(value) != 0
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	Pushed notices.
+
+	A client that sets notices=true in its connection string is sent notices (see
+	protocol/notice.go) as things happen, between responses, instead of with the result of
+	its next command:
+
+	  - maintenance: the server entered or left maintenance mode (see maintenance.go)
+	  - shutdown: the server is stopping; it gives the notices up to shutdownNoticeGrace to go
+	    out before it closes the connections
+	  - role_change: in cluster mode, this node became the raft leader or a follower, or
+	    follows a new leader
+	  - slow_query: a command of this session took at least -slowrequest; sent after its
+	    response
+
+	Each such connection queues up to pushedNoticeQueue notices for a goroutine of its own to
+	write, so a client that does not read them holds up nobody else; more are dropped. Other
+	clients get maintenance notices with their next result, as before, and no others.
+
+	PING answers PONG, so clients can send heartbeats to keep idle connections open and find
+	broken ones.
+*/
+
+const (
+	pushedNoticeQueue   = 32
+	shutdownNoticeGrace = time.Second
+)
+
+// pendingNotice is a notice waiting to be written; sent, when set, is called once it was
+// written, or dropped with its connection
+type pendingNotice struct {
+	notice protocol.Notice
+	sent   func()
+}
+
+// isPing reports whether a command is PING
+func isPing(command string) bool {
+	return strings.EqualFold(strings.TrimSuffix(strings.TrimSpace(command), ";"), "PING")
+}
+
+// enablePushedNotices has notices for a connection written to it until done closes
+func (s *Server) enablePushedNotices(conn *Connection, writer *messageWriter, done <-chan struct{}) {
+	s.mu.Lock()
+	if conn.pushed != nil {
+		s.mu.Unlock()
+		return
+	}
+	queue := make(chan pendingNotice, pushedNoticeQueue)
+	conn.pushed = queue
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case pending := <-queue:
+				if err := writer.writeNotice(pending.notice); err != nil {
+					s.logger.Debugw("Failed to send a notice", "connID", conn.ID, "event", pending.notice.Event, "error", err)
+				}
+				if pending.sent != nil {
+					pending.sent()
+				}
+			case <-done:
+				for {
+					select {
+					case pending := <-queue:
+						if pending.sent != nil {
+							pending.sent()
+						}
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// pushLocked queues a notice for a connection that asked for them, and reports whether it
+// was queued. Caller holds s.mu.
+func (s *Server) pushLocked(conn *Connection, pending pendingNotice) bool {
+	if conn.pushed == nil {
+		return false
+	}
+	select {
+	case conn.pushed <- pending:
+		return true
+	default:
+		s.logger.Warnw("Dropped a notice for a client that does not read them", "connID", conn.ID, "event", pending.notice.Event)
+		return false
+	}
+}
+
+// pushToAll queues a notice for every connection that asked for them and returns how many
+// it was queued for; sent is called for each once it was written
+func (s *Server) pushToAll(notice protocol.Notice, sent func()) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := 0
+	for _, conn := range s.ActiveConnections {
+		if conn.Authorized && s.pushLocked(conn, pendingNotice{notice: notice, sent: sent}) {
+			queued++
+		}
+	}
+	return queued
+}
+
+// notifyShutdown tells the clients that asked for notices that the server is stopping, and
+// waits until the notices were written or shutdownNoticeGrace passed
+func (s *Server) notifyShutdown() {
+	notice := protocol.NewNotice(protocol.NoticeShutdown, "The server is shutting down; this connection closes next.", nil)
+	var sent sync.WaitGroup
+	s.mu.Lock()
+	for _, conn := range s.ActiveConnections {
+		sent.Add(1)
+		if !conn.Authorized || !s.pushLocked(conn, pendingNotice{notice: notice, sent: sent.Done}) {
+			sent.Done()
+		}
+	}
+	s.mu.Unlock()
+
+	written := make(chan struct{})
+	go func() {
+		sent.Wait()
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(shutdownNoticeGrace):
+	}
+}
+
+// notifyRoleChange tells the clients that asked for notices that this node's raft role or
+// leader changed
+func (s *Server) notifyRoleChange(node, role, leader string) {
+	message := fmt.Sprintf("Node '%s' is now the %s; the leader is '%s'.", node, strings.ToLower(role), leader)
+	s.pushToAll(protocol.NewNotice(protocol.NoticeRoleChange, message, map[string]interface{}{
+		"node":   node,
+		"role":   role,
+		"leader": leader,
+	}), nil)
+}
+
+// notifySlowCommand tells a client that asked for notices that its command was slow
+func (s *Server) notifySlowCommand(conn *Connection, method, bundle string, elapsed, threshold time.Duration) {
+	message := fmt.Sprintf("%s took %s, over the server's slow request threshold of %s.", method, elapsed.Round(time.Millisecond), threshold)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushLocked(conn, pendingNotice{notice: protocol.NewNotice(protocol.NoticeSlowCommand, message, map[string]interface{}{
+		"method":      method,
+		"bundle":      bundle,
+		"durationMs":  float64(elapsed.Microseconds()) / 1000,
+		"thresholdMs": threshold.Milliseconds(),
+	})})
+}
+
+// writeNotice sends a notice between responses. Notices do not count towards the bytes of
+// the responses.
+func (w *messageWriter) writeNotice(notice protocol.Notice) error {
+	payload, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	return w.writeCompact(payload, false)
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
+	"unicode"
+)
+
+// responseChunkSize is how much of a JSON response is written before the connection is flushed
+const responseChunkSize = 64 * 1024
+
+// messageWriter writes responses in the protocol the connection negotiated
+type messageWriter struct {
+	mu      sync.Mutex // Notices are written from another goroutine, see notices.go
+	writer  *bufio.Writer
+	framed  bool   // Set once the connection string asked for protocol v2
+	format  string // Set once the connection string picked a format, see protocol/msgpack.go
+	written int64  // Bytes of the responses sent so far
+}
+
+// writeMessage sends one response as a line, or as a frame after v2 was negotiated. The
+// message is JSON, or a plain text result.
+func (w *messageWriter) writeMessage(message string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writePayload(w.encode([]byte(message), true), true)
+}
+
+// writeCompact sends a notice or result metadata. Unlike responses they are never indented,
+// so that their payloads start with protocol.NoticePrefix or protocol.MetadataPrefix.
+func (w *messageWriter) writeCompact(payload []byte, counted bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writePayload(w.encode(payload, false), counted)
+}
+
+// writePayload writes an encoded payload as a line or frame; w.mu must be held
+func (w *messageWriter) writePayload(payload []byte, counted bool) error {
+	var err error
+	if w.framed {
+		err = protocol.WriteFrame(w.writer, payload)
+	} else {
+		if _, err = w.writer.Write(payload); err == nil {
+			err = w.writer.WriteByte('\n')
+		}
+	}
+	if counted {
+		w.written += int64(len(payload))
+	}
+	if err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+// encode turns a JSON or plain text payload into the connection's format; pretty JSON is
+// only indented when indent is set
+func (w *messageWriter) encode(payload []byte, indent bool) []byte {
+	switch {
+	case w.format == protocol.FormatMsgpack:
+		if !json.Valid(payload) {
+			return protocol.MsgpackString(string(payload))
+		}
+		if encoded, err := protocol.JSONToMsgpack(payload); err == nil {
+			return encoded
+		}
+	case w.format == protocol.FormatBSON:
+		if encoded, err := protocol.JSONToBSON(payload); err == nil {
+			return encoded
+		}
+	case w.format == protocol.FormatPrettyJSON && indent:
+		var indented bytes.Buffer
+		if json.Indent(&indented, payload, "", "  ") == nil {
+			return indented.Bytes()
+		}
+	}
+	return payload
+}
+
+// writeJSON sends value encoded as JSON, as writeMessage would send its json.Marshal. A line
+// is encoded straight onto the connection and flushed every responseChunkSize bytes, with no
+// copy of the whole response in between. A frame needs its length up front, so it is encoded
+// into a pooled scratch buffer and written from there.
+func (w *messageWriter) writeJSON(value interface{}) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.framed && w.format == protocol.FormatBSON {
+		// Straight from the result, without JSON in between
+		payload, err := protocol.MarshalBSON(value)
+		if err != nil {
+			return 0, err
+		}
+		w.written += int64(len(payload))
+		if err := protocol.WriteFrame(w.writer, payload); err != nil {
+			return 0, err
+		}
+		return len(payload), w.writer.Flush()
+	}
+	if w.framed {
+		frame := helpers.GetBuffer()
+		defer helpers.PutBuffer(frame)
+		encoder := json.NewEncoder(frame)
+		if w.format == protocol.FormatPrettyJSON {
+			encoder.SetIndent("", "  ")
+		}
+		if err := encoder.Encode(value); err != nil {
+			return 0, err
+		}
+		payload := bytes.TrimSuffix(frame.Bytes(), []byte("\n"))
+		if w.format == protocol.FormatMsgpack {
+			encoded, err := protocol.JSONToMsgpack(payload)
+			if err != nil {
+				return 0, err
+			}
+			payload = encoded
+		}
+		w.written += int64(len(payload))
+		if err := protocol.WriteFrame(w.writer, payload); err != nil {
+			return len(payload), err
+		}
+		return len(payload), w.writer.Flush()
+	}
+
+	chunked := &chunkedWriter{writer: w.writer}
+	encoder := json.NewEncoder(chunked)
+	if w.format == protocol.FormatPrettyJSON {
+		encoder.SetIndent("", "  ")
+	}
+	err := encoder.Encode(value) // Ends the line with its newline
+	size := max(chunked.written-1, 0)
+	w.written += int64(size)
+	if err != nil {
+		return size, err
+	}
+	return size, w.writer.Flush()
+}
+
+// WriteFramedJSON writes value as one response frame in format, as a connection that
+// negotiated protocol v2 does. syndrbench -micro measures the framed write through it.
+func WriteFramedJSON(writer *bufio.Writer, format string, value interface{}) (int, error) {
+	w := &messageWriter{writer: writer, framed: true, format: format}
+	return w.writeJSON(value)
+}
+
+// chunkedWriter passes writes on to a bufio.Writer, flushing after every responseChunkSize bytes
+type chunkedWriter struct {
+	writer    *bufio.Writer
+	written   int
+	unflushed int
+}
+
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n, err := c.writer.Write(p[:min(len(p), responseChunkSize-c.unflushed)])
+		total += n
+		c.written += n
+		c.unflushed += n
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		if c.unflushed >= responseChunkSize {
+			if err := c.writer.Flush(); err != nil {
+				return total, err
+			}
+			c.unflushed = 0
+		}
+	}
+	return total, nil
+}
+
+// defaultMaxCommandSize applies when the server was built without a limit
+const defaultMaxCommandSize = 16 * 1024 * 1024
+
+// commandTooLargeError reports a command that was skipped for exceeding the size limit.
+// The connection stays usable.
+type commandTooLargeError struct {
+	size  int64 // 0 when the line was abandoned before its end
+	limit int
+}
+
+func (e *commandTooLargeError) Error() string {
+	if e.size > 0 {
+		return fmt.Sprintf("command of %d bytes exceeds the %d byte limit", e.size, e.limit)
+	}
+	return fmt.Sprintf("command exceeds the %d byte limit", e.limit)
+}
+
+func (e *commandTooLargeError) ErrorCode() protocol.ErrorCode { return protocol.ErrCommandTooLarge }
+
+// readCommands reads commands from a client until the connection fails or doneCh closes.
+// Commands are lines until a connection string switches the connection to frames; after
+// each connection string read as a line it waits for the protocol it asked for on modeCh.
+// A command over the size limit is skipped and reported on errCh as a *commandTooLargeError.
+// When the connection fails it calls disconnected, stopping the command running meanwhile.
+func (s *Server) readCommands(connection *Connection, dataCh chan<- string, errCh chan<- error, modeCh <-chan int, doneCh <-chan struct{}, disconnected context.CancelFunc) {
+	defer close(dataCh)
+	defer close(errCh)
+	defer helpers.RecoverPanic(s.logger, "reading from connection "+connection.ID)
+
+	limit := s.MaxCommandSize
+	if limit <= 0 {
+		limit = defaultMaxCommandSize
+	}
+
+	report := func(err error) bool {
+		select {
+		case errCh <- err:
+			return true
+		case <-doneCh:
+			return false
+		}
+	}
+
+	framed := false
+	var buffer bytes.Buffer
+	for {
+		var command string
+		if framed {
+			payload, err := readFrame(connection.Reader, limit)
+			if err != nil {
+				var tooLarge *commandTooLargeError
+				if errors.As(err, &tooLarge) {
+					if report(err) {
+						continue
+					}
+					return
+				}
+				disconnected()
+				report(err)
+				return
+			}
+			command = collapseWhitespace(string(payload))
+			if command == "" {
+				continue
+			}
+		} else {
+			err := readLine(connection.Reader, &buffer, limit)
+			if err != nil {
+				var tooLarge *commandTooLargeError
+				if errors.As(err, &tooLarge) {
+					if report(err) {
+						continue
+					}
+					return
+				}
+				disconnected()
+				report(err)
+				return
+			}
+			command = strings.TrimSpace(buffer.String())
+			if command == "" {
+				continue
+			}
+		}
+
+		select {
+		case dataCh <- command:
+		case <-doneCh:
+			return
+		}
+
+		if !framed && strings.HasPrefix(command, "syndrdb://") {
+			select {
+			case version := <-modeCh:
+				framed = version == protocol.VersionFramed
+			case <-doneCh:
+				return
+			}
+		}
+	}
+}
+
+// readLine reads one line into buffer a chunk at a time. Once the line passes limit the
+// rest of it is read and thrown away, so memory stays bounded by limit.
+func readLine(reader *bufio.Reader, buffer *bytes.Buffer, limit int) error {
+	buffer.Reset()
+	if buffer.Cap() > limit {
+		// Don't keep the memory of a previous huge command around
+		*buffer = bytes.Buffer{}
+	}
+
+	oversized := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !oversized {
+			if buffer.Len()+len(chunk) > limit+1 { // +1 for the newline itself
+				oversized = true
+				buffer.Reset()
+			} else {
+				buffer.Write(chunk)
+			}
+		}
+
+		switch err {
+		case nil:
+			if oversized {
+				return &commandTooLargeError{limit: limit}
+			}
+			return nil
+		case bufio.ErrBufferFull:
+			continue
+		default:
+			return err
+		}
+	}
+}
+
+// readFrame reads one frame, skipping the payload of a frame over limit so the next one
+// can still be read
+func readFrame(reader *bufio.Reader, limit int) ([]byte, error) {
+	payload, err := protocol.ReadFrame(reader, limit)
+	var tooLarge *protocol.ErrFrameTooLarge
+	if errors.As(err, &tooLarge) {
+		if _, err := io.CopyN(io.Discard, reader, int64(tooLarge.Size)); err != nil {
+			return nil, err
+		}
+		return nil, &commandTooLargeError{size: int64(tooLarge.Size), limit: limit}
+	}
+	return payload, err
+}
+
+// unpackCommand returns the SyndrQL a message sends, as written for logs and with the
+// parameters sent with it bound for running; plain SyndrQL is both
+func unpackCommand(message string) (string, string, error) {
+	if !protocol.IsCommand(message) {
+		return message, message, nil
+	}
+	command, err := protocol.ParseCommand(message)
+	if err != nil {
+		return message, "", err
+	}
+	bound, err := engine.BindParameters(command.Command, command.Params)
+	return command.Command, bound, err
+}
+
+// collapseWhitespace turns runs of whitespace outside quoted strings into single spaces, so a
+// command spread over several lines parses like its one line form while string values keep
+// their newlines
+func collapseWhitespace(command string) string {
+	var builder strings.Builder
+	builder.Grow(len(command))
+
+	var quote rune
+	escaped := false
+	pendingSpace := false
+	for _, r := range command {
+		if quote == 0 && unicode.IsSpace(r) {
+			pendingSpace = builder.Len() > 0
+			continue
+		}
+		if pendingSpace {
+			builder.WriteByte(' ')
+			pendingSpace = false
+		}
+		builder.WriteRune(r)
+
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		}
+	}
+	return builder.String()
+}
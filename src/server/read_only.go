@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"syndrdb/src/cluster"
+	"syndrdb/src/engine"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	Read-only mode.
+
+	A server started with -readonly, or switched with ALTER SYSTEM SET read_only = true, answers
+	reads as usual but refuses every command that writes, including the COMMIT of a transaction
+	with queued writes, for maintenance windows or to check a restored data directory without
+	changing it. Changes shipped from a primary are still applied, so a standby in read-only
+	mode keeps up. The switch is per node and lasts until the next restart, where -readonly
+	decides again. With auth on, only the admin user may flip it. ALTER SYSTEM also switches
+	maintenance mode, see maintenance.go.
+*/
+
+// isAlterSystem reports whether a command is ALTER SYSTEM, answered by the server itself
+func isAlterSystem(command string) bool {
+	fields := strings.Fields(command)
+	return len(fields) >= 2 && strings.EqualFold(fields[0], "ALTER") && strings.EqualFold(fields[1], "SYSTEM")
+}
+
+// alterSystem changes a server setting while it runs
+func (s *Server) alterSystem(conn *Connection, command string) (interface{}, error) {
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return nil, err
+	}
+	alter, ok := statement.(*engine.AlterSystemCommand)
+	if !ok {
+		return nil, fmt.Errorf("expected ALTER SYSTEM SET <setting> = <value>")
+	}
+	if s.AuthEnabled && conn.User != s.adminUser {
+		return nil, protocol.Errorf(protocol.ErrPermissionDenied, "only the admin user '%s' may alter system settings", s.adminUser)
+	}
+
+	switch alter.Setting {
+	case "read_only":
+		readOnly, ok := alter.Value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("read_only must be TRUE or FALSE")
+		}
+		s.readOnly.Store(readOnly)
+		s.logger.Warnw("Read-only mode changed", "readOnly", readOnly, "connID", conn.ID, "user", conn.User)
+		state := "off; writes are allowed"
+		if readOnly {
+			state = "on; writes are refused"
+		}
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result:      fmt.Sprintf("Read-only mode is %s.", state),
+		}, nil
+	case "maintenance":
+		switch value := alter.Value.(type) {
+		case bool:
+			return s.setMaintenance(conn, value, 0)
+		case string:
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("maintenance must be TRUE, FALSE or how long it should take, such as '15m'")
+			}
+			return s.setMaintenance(conn, true, duration)
+		}
+		return nil, fmt.Errorf("maintenance must be TRUE, FALSE or how long it should take, such as '15m'")
+	}
+	return nil, fmt.Errorf("unknown system setting '%s'; the settings are: read_only, maintenance", alter.Setting)
+}
+
+// readOnlyModeError refuses a command that writes, in read-only mode; nil for reads
+func (s *Server) readOnlyModeError(conn *Connection, command string) error {
+	writes, commit := commandWrites(conn, command)
+	switch {
+	case !writes:
+		return nil
+	case commit:
+		return protocol.Errorf(protocol.ErrReadOnly, "read-only mode: the server refuses writes, so transaction %d cannot commit; ROLLBACK it, or ALTER SYSTEM SET read_only = false first",
+			conn.Transaction.ID)
+	}
+	return protocol.Errorf(protocol.ErrReadOnly, "read-only mode: the server refuses writes until ALTER SYSTEM SET read_only = false")
+}
+
+// writesPaused reports whether the server refuses writes from clients at the moment, for the
+// background work that writes on its own, such as automatic ANALYZE
+func (s *Server) writesPaused() bool {
+	return s.readOnly.Load() || s.isStandby() || s.inMaintenance()
+}
+
+// commandWrites reports whether a command writes, and whether it does so as the COMMIT of a
+// transaction with queued writes. A command that does not parse fails on its own, so it
+// does not count.
+func commandWrites(conn *Connection, command string) (writes bool, commit bool) {
+	if cluster.IsTransactionCommand(command) {
+		// A transaction replicated from the primary
+		return true, false
+	}
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return false, false
+	}
+	if _, isCommit := statement.(*engine.CommitCommand); isCommit {
+		queued := conn.Transaction != nil && conn.Transaction.Len() > 0
+		return queued, queued
+	}
+	return writesData(statement), false
+}
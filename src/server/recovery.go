@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
+)
+
+/*
+	Panic recovery for commands.
+
+	A command that panics fails with an error instead of taking the server down. The panic is
+	logged with its stack; the connection's transaction, if it had one, is rolled back; the
+	bundle the command names is marked suspect (directors/suspect_bundles.go), since the
+	command may have stopped half way through changing it; and dirty buffers are flushed if the
+	buffer pool is not stuck in the middle of an operation, so the writes of other commands are
+	on disk in case worse follows. The connection stays open. Goroutines outside command
+	execution recover through helpers.RecoverPanic and helpers.Supervise.
+*/
+
+// safeProcessCommand runs a command, turning a panic into an error
+func (s *Server) safeProcessCommand(conn *Connection, command string) (result interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result, err = nil, s.recoverCommand(conn, command, recovered, debug.Stack())
+		}
+	}()
+	return s.processCommand(conn, command)
+}
+
+// recoverCommand cleans up after a command that panicked and returns the error for the client
+func (s *Server) recoverCommand(conn *Connection, command string, recovered interface{}, stack []byte) error {
+	method, bundle := describeCommand(command)
+	s.logger.Errorw("Recovered from a panic in a command",
+		"connID", conn.ID, "user", conn.User, "database", conn.DatabaseName,
+		"method", method, "bundle", bundle, "panic", recovered, "stack", string(stack))
+
+	rolledBack := conn.Transaction != nil
+	s.cleanUpAfterPanic(conn, bundle, fmt.Sprintf("%s panicked: %v", method, recovered))
+
+	message := fmt.Sprintf("internal error running %s: %v", method, recovered)
+	if bundle != "" {
+		message += fmt.Sprintf("; bundle '%s' is suspect and refuses writes until CHECK DATABASE passes", bundle)
+	}
+	if rolledBack {
+		message += "; the transaction was rolled back"
+	}
+	return protocol.WithCode(protocol.ErrInternal, errors.New(message))
+}
+
+// cleanUpAfterPanic rolls back the connection's transaction, marks the bundle suspect and
+// flushes what is safe to flush. The server may be in a bad state, so a panic here is logged
+// rather than raised.
+func (s *Server) cleanUpAfterPanic(conn *Connection, bundle, reason string) {
+	defer helpers.RecoverPanic(s.logger, "cleaning up after a panic")
+
+	bundleService := s.services.BundleService
+	if conn.Transaction != nil {
+		transaction := conn.Transaction
+		conn.Transaction = nil
+		bundleService.EndTransaction(transaction)
+		s.logger.Warnw("Rolled back the transaction of a command that panicked", "connID", conn.ID, "transaction", transaction.ID)
+	}
+	if bundle != "" {
+		bundleService.MarkSuspect(bundle, reason)
+	}
+	if flushed, err := s.bufferPool.TryFlushAllDirty(); err != nil {
+		s.logger.Errorw("Failed to flush dirty buffers after a panic", "error", err)
+	} else if !flushed {
+		s.logger.Warnw("Buffer pool busy after a panic; dirty buffers left for the next flush")
+	}
+}
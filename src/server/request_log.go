@@ -0,0 +1,112 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxRememberedRequests caps how many request IDs are kept, whatever their age
+const maxRememberedRequests = 100000
+
+// requestLog remembers the outcome of writes sent with a request ID, so a client that timed
+// out and retries gets the original result back instead of applying the write twice.
+// IDs are scoped to the user who sent them. Failed writes are forgotten so they can be retried.
+// The log lives in this node's memory only: a retry sent to another node, or to this one after
+// a restart, is applied again.
+type requestLog struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*requestEntry
+	order   *list.List // Entry keys, oldest first
+}
+
+type requestEntry struct {
+	command   string // Database and command the ID was first used with
+	startedAt time.Time
+	element   *list.Element
+
+	done   chan struct{} // Closed once result and err are set
+	result interface{}
+	err    error
+}
+
+func newRequestLog(ttl time.Duration) *requestLog {
+	return &requestLog{
+		ttl:     ttl,
+		entries: make(map[string]*requestEntry),
+		order:   list.New(),
+	}
+}
+
+// do runs a write once per user and request ID. A retry waits for the first attempt if it is
+// still running and returns its result; replayed reports whether that happened.
+func (l *requestLog) do(user, requestID, database, command string, run func() (interface{}, error)) (result interface{}, replayed bool, err error) {
+	if l == nil || l.ttl <= 0 {
+		result, err = run()
+		return result, false, err
+	}
+
+	key := user + "\x00" + requestID
+	fingerprint := database + "\x00" + command
+
+	l.mu.Lock()
+	l.expire(time.Now())
+	if entry, exists := l.entries[key]; exists {
+		l.mu.Unlock()
+		if entry.command != fingerprint {
+			return nil, false, fmt.Errorf("request ID '%s' was already used for a different command", requestID)
+		}
+		<-entry.done
+		if entry.err == nil {
+			return entry.result, true, nil
+		}
+		// The first attempt failed and was forgotten; this one runs on its own
+		return l.do(user, requestID, database, command, run)
+	}
+
+	entry := &requestEntry{command: fingerprint, startedAt: time.Now(), done: make(chan struct{})}
+	entry.element = l.order.PushBack(key)
+	l.entries[key] = entry
+	l.mu.Unlock()
+
+	// A failed or panicking attempt is forgotten before its waiters wake, so they run on their own
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			entry.err = fmt.Errorf("request ID '%s' panicked: %v", requestID, recovered)
+		}
+		if entry.err != nil {
+			l.forget(key, entry)
+		}
+		close(entry.done)
+		if recovered != nil {
+			panic(recovered)
+		}
+	}()
+	entry.result, entry.err = run()
+	return entry.result, false, entry.err
+}
+
+// forget drops an entry, unless a later attempt under its key has replaced it
+func (l *requestLog) forget(key string, entry *requestEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.entries[key] == entry {
+		l.order.Remove(entry.element)
+		delete(l.entries, key)
+	}
+}
+
+// expire drops entries older than the TTL and the oldest ones beyond the cap. Callers hold mu.
+func (l *requestLog) expire(now time.Time) {
+	for front := l.order.Front(); front != nil; front = l.order.Front() {
+		key := front.Value.(string)
+		if l.order.Len() <= maxRememberedRequests && now.Sub(l.entries[key].startedAt) < l.ttl {
+			return
+		}
+		l.order.Remove(front)
+		delete(l.entries, key)
+	}
+}
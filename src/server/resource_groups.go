@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
+	"syndrdb/src/workers"
+)
+
+/*
+	Resource groups.
+
+	Named groups share the server out between workloads, so a heavy ETL job cannot starve
+	interactive queries. They are read at startup from the JSON file -resourcegroups names:
+
+	{
+	  "Default": "interactive",
+	  "Groups": [
+	    { "Name": "interactive", "CPUShare": 4 },
+	    { "Name": "etl", "CPUShare": 1, "Concurrency": 2, "Memory": 268435456, "Users": ["loader"] }
+	  ]
+	}
+
+	Every connection belongs to one group: the one its connection string names with group=,
+	else the group listing its user, else Default. A user listed in a group may only name that
+	group, except the admin user. Each group has
+	  - CPUShare: while SELECTs of several groups wait for the query pool, free workers go to
+	    the groups in proportion to their shares (see workers/pool.go)
+	  - Concurrency: commands of the group's connections running at once; more wait their turn.
+	    Commands inside a transaction, SHOW commands, PING and ALTER commands do not count, so a
+	    transaction holding locks never waits behind the group, nor does looking at the server
+	  - Memory: the largest SELECT result, in bytes of JSON, one command of the group may
+	    return; a larger one fails with SDB-4005 instead of being sent, so the group's results
+	    take at most Concurrency times Memory at once
+	A limit left out or 0 is off. Without the file, or without a Default, connections fall in
+	the group "default", which has no limits unless the file lists it. SHOW RESOURCE GROUPS
+	reports each group's settings, connections, and running, waiting and refused commands.
+*/
+
+// DefaultResourceGroup is the group of connections not assigned to another
+const DefaultResourceGroup = "default"
+
+// resourceGroupsFile is the file -resourcegroups names
+type resourceGroupsFile struct {
+	Default string
+	Groups  []resourceGroupSettings
+}
+
+type resourceGroupSettings struct {
+	Name        string
+	CPUShare    int      // Relative share of the query pool; 0 counts as 1
+	Concurrency int      // Commands running at once; 0 is no limit
+	Memory      int64    // Largest SELECT result in bytes; 0 is no limit
+	Users       []string // Users whose connections fall in the group
+}
+
+// resourceGroups are the server's groups, see loadResourceGroups
+type resourceGroups struct {
+	groups      []*resourceGroup // In the order of the file
+	byName      map[string]*resourceGroup
+	byUser      map[string]*resourceGroup
+	fallback    *resourceGroup
+	identifiers helpers.Identifiers // How group names are compared
+}
+
+type resourceGroup struct {
+	resourceGroupSettings
+
+	mu        sync.Mutex
+	freed     *sync.Cond
+	running   int
+	waiting   int
+	completed uint64
+	refused   uint64 // SELECTs whose result was over Memory
+}
+
+// loadResourceGroups reads the groups from path; an empty path gives the default group alone
+func loadResourceGroups(path string, identifiers helpers.Identifiers) (*resourceGroups, error) {
+	var file resourceGroupsFile
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read resource groups: %w", err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&file); err != nil {
+			return nil, fmt.Errorf("failed to parse resource groups: %w", err)
+		}
+	}
+
+	groups := &resourceGroups{
+		byName:      make(map[string]*resourceGroup),
+		byUser:      make(map[string]*resourceGroup),
+		identifiers: identifiers,
+	}
+	for _, settings := range file.Groups {
+		if !engine.IsValidDatabaseName(settings.Name) {
+			return nil, fmt.Errorf("invalid resource group name '%s'", settings.Name)
+		}
+		key := groups.identifiers.Key(settings.Name)
+		if groups.byName[key] != nil {
+			return nil, fmt.Errorf("resource group '%s' is listed twice", settings.Name)
+		}
+		if settings.CPUShare < 0 || settings.Concurrency < 0 || settings.Memory < 0 {
+			return nil, fmt.Errorf("resource group '%s': CPUShare, Concurrency and Memory cannot be negative", settings.Name)
+		}
+		settings.CPUShare = max(1, settings.CPUShare)
+		group := newResourceGroup(settings)
+		for _, user := range settings.Users {
+			if other := groups.byUser[user]; other != nil {
+				return nil, fmt.Errorf("user '%s' is listed in resource groups '%s' and '%s'", user, other.Name, settings.Name)
+			}
+			groups.byUser[user] = group
+		}
+		groups.groups = append(groups.groups, group)
+		groups.byName[key] = group
+	}
+
+	fallback := file.Default
+	if fallback == "" {
+		fallback = DefaultResourceGroup
+	}
+	groups.fallback = groups.byName[groups.identifiers.Key(fallback)]
+	if groups.fallback == nil {
+		if file.Default != "" {
+			return nil, fmt.Errorf("default resource group '%s' is not listed in Groups", file.Default)
+		}
+		groups.fallback = newResourceGroup(resourceGroupSettings{Name: DefaultResourceGroup, CPUShare: 1})
+		groups.groups = append(groups.groups, groups.fallback)
+		groups.byName[groups.identifiers.Key(DefaultResourceGroup)] = groups.fallback
+	}
+	return groups, nil
+}
+
+func newResourceGroup(settings resourceGroupSettings) *resourceGroup {
+	group := &resourceGroup{resourceGroupSettings: settings}
+	group.freed = sync.NewCond(&group.mu)
+	return group
+}
+
+// assign picks the group of a connection: the requested one, else the user's, else the default
+func (g *resourceGroups) assign(user, requested string, admin bool) (*resourceGroup, error) {
+	assigned := g.byUser[user]
+	if requested == "" {
+		if assigned != nil {
+			return assigned, nil
+		}
+		return g.fallback, nil
+	}
+	group := g.byName[g.identifiers.Key(requested)]
+	if group == nil {
+		return nil, protocol.Errorf(protocol.ErrConnectionString, "Invalid connection string: there is no resource group '%s'", requested)
+	}
+	if assigned != nil && group != assigned && !admin {
+		return nil, protocol.Errorf(protocol.ErrPermissionDenied, "user '%s' belongs to resource group '%s' and cannot use '%s'", user, assigned.Name, group.Name)
+	}
+	return group, nil
+}
+
+// enter waits until the group may run another command. Call the returned release once the
+// command is done.
+func (g *resourceGroup) enter() (release func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.Concurrency > 0 && g.running >= g.Concurrency {
+		g.waiting++
+		for g.running >= g.Concurrency {
+			g.freed.Wait()
+		}
+		g.waiting--
+	}
+	g.running++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.running--
+			g.completed++
+			g.freed.Signal()
+		})
+	}
+}
+
+// checkResult refuses a SELECT result over the group's Memory
+func (g *resourceGroup) checkResult(result interface{}) error {
+	if g.Memory <= 0 || result == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil || int64(len(encoded)) <= g.Memory {
+		// A result that does not encode fails when it is sent
+		return nil
+	}
+	g.mu.Lock()
+	g.refused++
+	g.mu.Unlock()
+	return protocol.Errorf(protocol.ErrResourceLimit, "the result of %d bytes is larger than the %d bytes of memory of resource group '%s'; narrow the query or page through it with LIMIT",
+		len(encoded), g.Memory, g.Name)
+}
+
+// groupOf returns a connection's resource group
+func (s *Server) groupOf(conn *Connection) *resourceGroup {
+	if conn.resourceGroup != nil {
+		return conn.resourceGroup
+	}
+	return s.resourceGroups.fallback
+}
+
+// countsTowardsGroup reports whether a command takes one of its group's Concurrency
+func (s *Server) countsTowardsGroup(conn *Connection, command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || conn.Transaction != nil || isTransactionControl(command) || isPing(command) {
+		return false
+	}
+	if strings.EqualFold(fields[0], "SHOW") || strings.EqualFold(fields[0], "ALTER") {
+		return false
+	}
+	// Another node's routed query already counted on the node it came from
+	return s.topology == nil || conn.User != s.topology.Username
+}
+
+// resourceGroupStatus answers SHOW RESOURCE GROUPS
+func (s *Server) resourceGroupStatus() *engine.CommandResponse {
+	connections := make(map[*resourceGroup]int)
+	s.mu.Lock()
+	for _, conn := range s.ActiveConnections {
+		connections[s.groupOf(conn)]++
+	}
+	s.mu.Unlock()
+
+	rows := make([]map[string]interface{}, 0, len(s.resourceGroups.groups))
+	for _, group := range s.resourceGroups.groups {
+		group.mu.Lock()
+		rows = append(rows, map[string]interface{}{
+			"Name":        group.Name,
+			"Default":     group == s.resourceGroups.fallback,
+			"CPUShare":    group.CPUShare,
+			"Concurrency": group.Concurrency,
+			"Memory":      group.Memory,
+			"Users":       group.Users,
+			"Connections": connections[group],
+			"Running":     group.running,
+			"Waiting":     group.waiting,
+			"Completed":   group.completed,
+			"Refused":     group.refused,
+		})
+		group.mu.Unlock()
+	}
+	return &engine.CommandResponse{
+		ResultCount: len(rows),
+		Result:      rows,
+	}
+}
+
+// acquireQueryWorker takes a worker of the query pool at the share of the connection's group
+func (s *Server) acquireQueryWorker(conn *Connection) (release func()) {
+	group := s.groupOf(conn)
+	return workers.Query.AcquireShare(group.Name, group.CPUShare)
+}
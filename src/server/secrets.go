@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"syndrdb/src/auth"
+	"syndrdb/src/engine"
+	"syndrdb/src/protocol"
+	"syndrdb/src/settings"
+)
+
+/*
+	Secret rotation.
+
+	SECRETS ROTATE re-encrypts the user store with a new data-encryption key without a
+	restart. The new key is read again from where -userstorekey refers to, so rotating a key
+	kept in a file is: write the new key to the file, then run SECRETS ROTATE. A key given in
+	an environment variable or on the command line cannot change while the server runs. With
+	auth on, only the admin user may rotate.
+*/
+
+// rotateSecrets re-encrypts the user store with the key -userstorekey refers to now
+func (s *Server) rotateSecrets(conn *Connection) (interface{}, error) {
+	if s.AuthEnabled && conn.User != s.adminUser {
+		return nil, protocol.Errorf(protocol.ErrPermissionDenied, "only the admin user '%s' may rotate secrets", s.adminUser)
+	}
+	key, err := settings.ResolveSecret(s.userStoreKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the new user store key: %w", err)
+	}
+	if err := s.users.Rekey(key); err != nil {
+		if errors.Is(err, auth.ErrKeyUnchanged) {
+			return nil, fmt.Errorf("the user store key has not changed; put the new key where -userstorekey refers to (a file: reference) first")
+		}
+		return nil, fmt.Errorf("failed to re-encrypt the user store: %w", err)
+	}
+
+	s.logger.Infow("User store re-encrypted with a new key", "connID", conn.ID, "user", conn.User)
+	return &engine.CommandResponse{
+		ResultCount: 1,
+		Result:      "User store re-encrypted with the new key.",
+	}, nil
+}
+
+// loadCertificate loads a TLS certificate and key given as secret references
+func loadCertificate(certReference, keyReference string) (tls.Certificate, error) {
+	certPEM, err := settings.LoadSecretFile(certReference)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := settings.LoadSecretFile(keyReference)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -2,27 +2,39 @@ package server
 
 import (
 	"bufio"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"strconv"
+	"net/http"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"syndrdb/src/auth"
 	"syndrdb/src/buffermgr"
+	"syndrdb/src/cdc"
+	"syndrdb/src/cluster"
 	"syndrdb/src/data"
 	"syndrdb/src/directors"
 	"syndrdb/src/engine"
+	hashindex "syndrdb/src/hash_index"
 
 	"syndrdb/src/helpers"
 	"syndrdb/src/models"
+	"syndrdb/src/protocol"
 	"syndrdb/src/settings"
+	"syndrdb/src/workers"
 	"time"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
 )
 
 // Server represents the main TCP server for SyndrDB
@@ -31,14 +43,48 @@ type Server struct {
 	Port              int
 	Databases         map[string]*models.Database
 	Listener          net.Listener
+	listeners         []net.Listener // Listener and, with -reuseport, the others; see accept.go
+	accepts           acceptStats
+	adminListener     net.Listener // Set with -adminport, see admin_port.go
+	socketListener    net.Listener // Set with -socket, see socket.go
+	mongoListener     net.Listener // Set with -mongoport, see mongo.go
+	grpcServer        *grpc.Server // Set with -grpcport, see grpc.go
 	AuthEnabled       bool
-	Users             map[string]string // username -> hashed password
+	MaxCommandSize    int                 // Commands longer than this are rejected without being buffered
+	users             *auth.UserStore     // Local users, see users.go
+	passwordPolicy    auth.PasswordPolicy // For local users
+	userStoreKey      string              // Secret reference to the user store key, re-read by SECRETS ROTATE
+	adminUser         string              // The only user allowed SECRETS ROTATE when auth is on
+	readOnly          atomic.Bool         // Refuses every write; see read_only.go
+	maintenance       maintenanceWindow   // See maintenance.go
+	authProviders     []auth.Provider     // Asked in order; see auth/provider.go
 	ActiveConnections map[string]*Connection
 	mu                sync.Mutex
 	Running           bool
 	databaseService   *directors.DatabaseService
+	services          *directors.ServiceManager // Passed down to the directors; connections get copies of it
 	logger            *zap.SugaredLogger
 	bufferPool        *buffermgr.BufferPool
+	syncer            *engine.FileSyncer // Syncs bundle files as their database's durability asks
+	raft              *cluster.RaftNode  // Metadata consensus, only set in cluster mode
+	raftTransport     *cluster.TCPRaftTransport
+	replicator        *cluster.Replicator // Ships writes to replicas, only set in cluster mode
+	changes           *cdc.Publisher      // Publishes document writes, only set with -cdcsink
+	topology          *cluster.Topology   // Only set in cluster mode
+	standby           standbyStatus       // Changes applied from a primary, see standby.go
+	tlsConfig         *tls.Config         // Set when a certificate is configured
+	requests          *requestLog         // Outcomes of recent writes sent with a request ID
+	sessions          *sessionStore       // nil when session resume is disabled
+	admission         *admissionControl   // Refuses writes while the buffer pool or disk is saturated
+	accessLog         *accessLog          // Logs a sample of the commands run, and every failed or slow one
+	config            *settings.Arguments // For support bundles
+	startedAt         time.Time           // For the uptime in diagnostics
+	recentLogs        *logRing            // Latest log entries, for support bundles
+	diagnostics       *http.Server        // Operator endpoint, only set with -diagnosticsaddr; see diagnostics.go
+	resourceGroups    *resourceGroups     // Share the server out between workloads, see resource_groups.go
+	maskingPolicies   *maskingPolicies    // Fields some users see masked, see masking.go
+	identifiers       helpers.Identifiers // How database and bundle names are compared, see helpers/identifiers.go
+	mongoWrites       sync.Mutex          // Held by the Mongo shim's writes, see mongo_query.go
 }
 
 // Connection represents an active client connection
@@ -53,16 +99,33 @@ type Connection struct {
 	Authorized   bool
 	LastActive   time.Time
 	Logger       *zap.SugaredLogger
-}
 
-// ConnectionString represents parsed MongoDB connection string
-type ConnectionString struct {
-	Host     string
-	Port     int
-	Database string
-	Username string
-	Password string
-	Options  map[string]string
+	// From the connection string
+	AppName     string
+	ReadTimeout time.Duration
+	ConnectedAt time.Time
+	Encrypted   bool   // Accepted on the TLS listener
+	AdminPort   bool   // Accepted on the admin listener, or local; see admin_port.go
+	PeerUser    string // OS user of a client on the Unix socket, see socket.go
+	Metadata    bool   // Send result metadata ahead of SELECT results
+
+	resourceGroup *resourceGroup // Picked once authenticated, see resource_groups.go; guarded by Server.mu
+
+	// Lets a reconnecting client resume this connection's state, see session.go
+	SessionToken      string
+	sessionGeneration int
+
+	Transaction *directors.Transaction // Open since BEGIN, see transactions.go
+	tempBundles *directors.TempBundles // Made by CREATE TEMP BUNDLE, see directors/temp_bundles.go
+
+	PasswordExpired bool // Only ALTER USER for this user is allowed, see users.go
+
+	// The running command's context: canceled once the client goes away, which stops the
+	// command's long reads and index builds. Nil for connections that cannot tell.
+	ctx context.Context
+
+	notices []string           // Sent with the next CommandResponse, see maintenance.go; guarded by Server.mu
+	pushed  chan pendingNotice // Set when the client asked for notices, see notices.go; guarded by Server.mu
 }
 
 // // NewServer creates a new SyndrDB server instance
@@ -104,36 +167,173 @@ func InitServer(config *settings.Arguments) (*Server, error) {
 		return nil, fmt.Errorf("failed to initialize logger: %w", err)
 	}
 
+	// Keep the latest entries for support bundles as well
+	recentLogs := newLogRing(recentLogEntries)
+	logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), recentLogs, zapcore.InfoLevel))
+	}))
+
 	// Create a sugared logger for easier API
 	sugar := logger.Sugar()
 
 	// Replace standard log with zap
 	zap.ReplaceGlobals(logger)
 
+	// Finish any catalog change a crash interrupted before the catalog is read
+	catalog, err := engine.OpenCatalogWAL(config.DataDir, sugar)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog log: %w", err)
+	}
+
+	// Redo the hash index changes a crash cut short, from the indexes' logs
+	if recovered := hashindex.RecoverHashIndexes(config.DataDir, sugar); recovered > 0 {
+		sugar.Infof("Recovered %d hash index(es) from their logs", recovered)
+	}
+
+	// Bring files written by earlier versions to the current formats before any is read
+	if err := directors.UpgradeDataDirectory(config.DataDir, sugar); err != nil {
+		return nil, fmt.Errorf("failed to upgrade data directory: %w", err)
+	}
+
 	// Create database storage
-	databaseStore, err := engine.NewDatabaseStore(config.DataDir, logger.Sugar())
+	databaseStore, err := engine.NewDatabaseStore(config.DataDir, config.Debug, logger.Sugar())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create database store: %w", err)
 	}
 	databaseFactory := engine.NewDatabaseFactory()
 
 	// Create service
-	databaseService := directors.NewDatabaseService(databaseStore, databaseFactory, config, sugar)
+	databaseService := directors.NewDatabaseService(databaseStore, databaseFactory, catalog, config, sugar)
+
+	// Bundle files are synced as each database's durability asks, pages as the server's
+	durability, err := engine.ParseDurability(config.Durability)
+	if err != nil {
+		return nil, err
+	}
+	syncer := engine.NewFileSyncer(durability, config.SyncInterval, sugar)
+	syncPolicy := map[models.Durability]buffermgr.SyncPolicy{
+		models.DurabilityAlways:   buffermgr.SyncAlways,
+		models.DurabilityInterval: buffermgr.SyncInterval,
+		models.DurabilityOff:      buffermgr.SyncNever,
+	}[durability]
+
+	// Create the file registry the buffer pool reads and writes pages through
+	fileRegistry, err := buffermgr.NewFileRegistry(config.DataDir, syncPolicy, sugar)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file registry: %w", err)
+	}
+
+	if err := configureWorkers(config); err != nil {
+		return nil, err
+	}
+	sugar.Infof("Worker pools sized for GOMAXPROCS %d: query %d, index_build %d, background_writer %d, cdc_dispatcher %d",
+		runtime.GOMAXPROCS(0), workers.Query.Size(), workers.IndexBuild.Size(), workers.BackgroundWriter.Size(), workers.CDCDispatcher.Size())
 
 	// Create buffer pool
-	bufferPool := buffermgr.NewBufferPool(config.BundleBufferSize, buffermgr.DefaultPageSize, sugar)
+	bufferCount := config.BundleBufferSize
+	if bufferCount <= 0 && config.BufferPoolMemory > 0 {
+		bufferCount = max(1, int(config.BufferPoolMemory/buffermgr.DefaultPageSize))
+	}
+	bufferPool := buffermgr.NewBufferPool(bufferCount, buffermgr.DefaultPageSize, fileRegistry, sugar)
 
-	// Create bundle service
-	bundleStore, err := engine.NewBundleStore(config.DataDir, bufferPool, logger.Sugar())
+	// Create bundle service. Bundles are not kept in the paged layout, so there is no page log.
+	bundleStore, err := engine.NewBundleStore(config.DataDir, bufferPool, nil, syncer, config.Debug, logger.Sugar())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create bundle store: %w", err)
 	}
 	bundleFactory := engine.NewBundleFactory()
 	documentFactory := engine.NewDocumentFactory()
 	bundleService := directors.NewBundleService(bundleStore, bundleFactory, documentFactory, sugar, config)
+	erasureSubjects, err := directors.LoadErasureSubjects(config.ErasureSubjectsFile, bundleService.Identifiers())
+	if err != nil {
+		return nil, err
+	}
+	bundleService.SetErasureSubjects(erasureSubjects)
+
+	// The directors get the server's services from it. The first server started also answers
+	// directors.GetServiceManager, until nothing calls it.
+	services := directors.NewServiceManager(databaseService, bundleService, sugar)
+	services.Statements = engine.NewStatementCache(config.PlanCacheSize)
+	directors.SetServiceManager(services)
+
+	// Rebuild the indexes left invalid by a crash; -fsck reports them instead
+	if !config.Fsck {
+		if rebuilt := bundleService.RebuildInvalidIndexes(databaseService); rebuilt > 0 {
+			sugar.Infof("Rebuilt %d invalid index(es)", rebuilt)
+		}
+	}
 
-	// Initialize the singleton
-	directors.InitServiceManager(databaseService, bundleService, sugar)
+	var changes *cdc.Publisher
+	if config.CDCSink != "" {
+		changes, err = cdc.NewPublisher(cdc.Config{Sink: config.CDCSink, Topic: config.CDCTopic, Format: config.CDCFormat, Workers: workers.CDCDispatcher.Size()}, sugar)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CDC publisher: %w", err)
+		}
+		bundleService.SetChangePublisher(changes)
+		sugar.Infof("Publishing document changes to %s as %s", changes.Stats().Sink, config.CDCFormat)
+	}
+
+	// In cluster mode, SELECTs on partitioned bundles are routed to the nodes owning each partition
+	// and DDL is replicated through the raft log
+	var raftNode *cluster.RaftNode
+	var raftTransport *cluster.TCPRaftTransport
+	var replicator *cluster.Replicator
+	var appliedSequences *cluster.AppliedSequences
+	var topology *cluster.Topology
+	if config.Mode == "cluster" {
+		topology, err = cluster.LoadTopology(config.ClusterConfigFile, config.NodeID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cluster topology: %w", err)
+		}
+		nodeClient := cluster.NewTCPNodeClient(topology.Username, topology.Password, cluster.DefaultNodeTimeout)
+		services.QueryRouter = cluster.NewQueryRouter(topology, nodeClient, sugar)
+		sugar.Infof("Cluster mode: node '%s' with %d node(s) in topology", topology.LocalNodeID, len(topology.Nodes))
+
+		if topology.ConsensusEnabled() {
+			raftTransport = cluster.NewTCPRaftTransport(topology, sugar)
+			raftNode, err = cluster.NewRaftNode(topology.LocalNodeID, topology.PeerIDs(), raftTransport,
+				cluster.NewRaftStorage(config.DataDir), applyMetadataEntry(services, sugar), sugar)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create raft node: %w", err)
+			}
+		}
+
+		if len(topology.Replicas) > 0 {
+			replicator, err = cluster.NewReplicator(topology, nodeClient, config.DataDir, config.MaxHintBytes, bundleService.Identifiers(), sugar)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create replicator: %w", err)
+			}
+		}
+		if appliedSequences, err = cluster.OpenAppliedSequences(config.DataDir); err != nil {
+			return nil, err
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		certificate, err := loadCertificate(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	}
+
+	groups, err := loadResourceGroups(config.ResourceGroupsFile, bundleService.Identifiers())
+	if err != nil {
+		return nil, err
+	}
+	masking, err := loadMaskingPolicies(config.MaskingPoliciesFile, bundleService.Identifiers())
+	if err != nil {
+		return nil, err
+	}
+
+	passwordPolicy := auth.PasswordPolicy{
+		MinLength:       config.PasswordMinLength,
+		MinClasses:      config.PasswordMinClasses,
+		MaxFailedLogins: config.MaxFailedLogins,
+		LockoutDuration: config.LockoutDuration,
+		MaxAge:          config.PasswordMaxAge,
+	}
 
 	// Create a new server
 	server := &Server{
@@ -141,15 +341,68 @@ func InitServer(config *settings.Arguments) (*Server, error) {
 		Port:              config.Port,
 		Databases:         make(map[string]*models.Database),
 		AuthEnabled:       config.AuthEnabled,
-		Users:             make(map[string]string),
+		MaxCommandSize:    int(config.MaxCommandSize),
+		passwordPolicy:    passwordPolicy,
+		userStoreKey:      config.UserStoreKey,
+		adminUser:         config.AdminUser,
 		ActiveConnections: make(map[string]*Connection),
 		databaseService:   databaseService,
+		services:          services,
 		logger:            sugar,
 		bufferPool:        bufferPool,
+		syncer:            syncer,
+		raft:              raftNode,
+		raftTransport:     raftTransport,
+		replicator:        replicator,
+		changes:           changes,
+		topology:          topology,
+		tlsConfig:         tlsConfig,
+		requests:          newRequestLog(config.RequestIDTTL),
+		sessions:          newSessionStore(config.SessionGracePeriod),
+		admission:         newAdmissionControl(config, bufferPool, bundleService.Identifiers(), sugar),
+		accessLog:         newAccessLog(config.AccessLogSampleRate, config.SlowRequestThreshold, sugar),
+		config:            config,
+		startedAt:         time.Now(),
+		recentLogs:        recentLogs,
+		resourceGroups:    groups,
+		maskingPolicies:   masking,
+		identifiers:       bundleService.Identifiers(),
+	}
+	server.accessLog.onSlow = server.notifySlowCommand
+	server.standby.applied = appliedSequences
+	if raftNode != nil {
+		raftNode.OnRoleChange(server.notifyRoleChange)
+	}
+	if config.ReadOnly {
+		server.readOnly.Store(true)
+		sugar.Infow("Starting in read-only mode; writes are refused")
+	}
+	userStoreKey, err := settings.ResolveSecret(config.UserStoreKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the user store key: %w", err)
+	}
+	if !config.Fsck {
+		bundleService.StartAutoAnalyze(server.writesPaused)
+	}
+	server.users, err = auth.NewUserStore(helpers.NewPathResolver(config.DataDir).Path(helpers.UserStoreFileName), userStoreKey)
+	if err != nil {
+		return nil, err
+	}
+	server.authProviders, err = auth.NewProviders(auth.ProviderConfig{
+		Providers:         config.AuthProviders,
+		LDAPURL:           config.LDAPURL,
+		LDAPUserDN:        config.LDAPUserDN,
+		OIDCIssuer:        config.OIDCIssuer,
+		OIDCAudience:      config.OIDCAudience,
+		OIDCJWKSURL:       config.OIDCJWKSURL,
+		OIDCUsernameClaim: config.OIDCUsernameClaim,
+	}, localUsers{server: server})
+	if err != nil {
+		return nil, err
 	}
 
 	// Load all databases
-	databases, err := databaseStore.LoadAllDatabaseDataFiles(config.DataDir)
+	databases, err := databaseStore.LoadAllDatabaseDataFiles(context.Background(), config.DataDir)
 	if err != nil {
 		log.Printf("Warning: Error loading databases: %v", err)
 		// Continue with empty database map - this allows creating new databases
@@ -185,24 +438,86 @@ func InitServer(config *settings.Arguments) (*Server, error) {
 // Start begins listening for incoming connections
 func (s *Server) Start() error {
 	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
-	listener, err := net.Listen("tcp", addr)
+	listeners, err := s.listen(addr)
 	if err != nil {
 		return fmt.Errorf("error starting server on %s: %w", addr, err)
 	}
+	if s.tlsConfig != nil {
+		for i := range listeners {
+			listeners[i] = tls.NewListener(listeners[i], s.tlsConfig)
+		}
+	}
 
-	s.Listener = listener
+	s.Listener = listeners[0]
+	s.listeners = listeners
+	s.accepts.listeners.Store(int32(len(listeners)))
 	s.Running = true
 
 	log.Printf("SyndrDB server listening on %s", addr)
+	if len(listeners) > 1 {
+		log.Printf("Accepting connections on %d SO_REUSEPORT listeners", len(listeners))
+	}
+
+	if s.raft != nil {
+		if err := s.raftTransport.Listen(s.raft); err != nil {
+			s.closeListeners()
+			return err
+		}
+		s.raft.Start()
+	}
+	if s.replicator != nil {
+		s.replicator.Start()
+	}
+	if s.changes != nil {
+		s.changes.Start()
+	}
+	if s.config.DiagnosticsAddr != "" {
+		if err := s.startDiagnostics(); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
+	if s.config.AdminPort != 0 {
+		if err := s.startAdminListener(); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
+	if s.config.Socket != "" {
+		if err := s.startSocketListener(); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
+	if s.config.MongoPort != 0 {
+		if err := s.startMongoListener(); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
+	if s.config.GRPCPort != 0 {
+		if err := s.startGRPCServer(); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
 
-	go s.acceptConnections()
+	for _, listener := range listeners {
+		go s.acceptConnections(listener, false)
+	}
 
 	return nil
 }
 
+// Services returns the services the server's commands run on
+func (s *Server) Services() *directors.ServiceManager {
+	return s.services
+}
+
 // Stop gracefully shuts down the server
 func (s *Server) Stop() error {
 	s.Running = false
+	s.notifyShutdown()
 
 	// Close all active connections
 	s.mu.Lock()
@@ -212,9 +527,47 @@ func (s *Server) Stop() error {
 	}
 	s.mu.Unlock()
 
-	// Close the listener
+	if s.raft != nil {
+		s.raft.Stop()
+		s.raftTransport.Close()
+	}
+	if s.replicator != nil {
+		s.replicator.Stop()
+	}
+	if s.changes != nil {
+		s.changes.Stop()
+	}
+	if s.diagnostics != nil {
+		s.diagnostics.Close()
+	}
+	if s.adminListener != nil {
+		s.adminListener.Close()
+	}
+	if s.socketListener != nil {
+		s.socketListener.Close()
+	}
+	if s.mongoListener != nil {
+		s.mongoListener.Close()
+	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if bundleService := s.services.BundleService; bundleService != nil {
+		if err := bundleService.SaveIndexUsage(); err != nil {
+			s.logger.Warnf("Could not save index usage: %v", err)
+		}
+		if err := bundleService.CloseIndexes(); err != nil {
+			s.logger.Warnf("Could not close hash indexes: %v", err)
+		}
+	}
+	// Files written at INTERVAL durability since the last tick
+	if err := s.syncer.Close(); err != nil {
+		s.logger.Warnf("Could not sync bundle files: %v", err)
+	}
+
+	// Close the listeners
 	if s.Listener != nil {
-		return s.Listener.Close()
+		return s.closeListeners()
 	}
 
 	wg.Wait()
@@ -236,39 +589,25 @@ func (s *Server) Stop() error {
 	return nil
 }
 
-// AddUser adds a user with the given password
-func (s *Server) AddUser(username, password string) {
-	hashedPassword := hashPassword(password)
-	s.Users[username] = hashedPassword
-}
-
-// Authentication function
-func (s *Server) authenticate(username, password string) bool {
-	hashedPassword, exists := s.Users[username]
-	if !exists {
-		return false
-	}
-
-	return hashedPassword == hashPassword(password)
-}
-
 var wg sync.WaitGroup
 
-// acceptConnections handles incoming connection requests
-func (s *Server) acceptConnections() {
+// acceptConnections handles incoming connection requests on a listener, the admin one or not
+func (s *Server) acceptConnections(listener net.Listener, admin bool) {
 	s.logger.Info("Server started accepting connections",
-		zap.String("host", s.Host),
-		zap.Int("port", s.Port))
+		zap.String("address", listener.Addr().String()),
+		zap.Bool("admin", admin))
 
 	for s.Running {
-		conn, err := s.Listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if s.Running { // Only log if we're still supposed to be running
+				s.accepts.failed.Add(1)
 				s.logger.Errorw("Error accepting connection", "error", err)
 			}
 			continue
 		}
 		wg.Add(1)
+		s.accepts.record(time.Now())
 
 		s.logger.Info("New connection received",
 			zap.String("remoteAddr", conn.RemoteAddr().String()))
@@ -277,36 +616,47 @@ func (s *Server) acceptConnections() {
 		//go s.handleConnection(conn)
 		go func(c net.Conn) {
 			defer wg.Done()
-			s.handleConnection(c)
+			// Commands recover by themselves; this catches the rest, closing just this connection
+			defer helpers.RecoverPanic(s.logger, "connection from "+c.RemoteAddr().String())
+			s.handleConnection(c, admin)
 		}(conn)
 	}
 }
 
 // handleConnection processes a single client connection
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(conn net.Conn, admin bool) {
 	connID := generateConnectionID()
 	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+	writer := &messageWriter{writer: bufio.NewWriter(conn)}
 
 	// Create a connection-specific logger with connection ID context
 	// Create a connection-specific logger with connection ID context
 	connLogger := s.logger
 
-	if settings.GetSettings().UserDebug {
+	if s.config.UserDebug {
 		connLogger = connLogger.With(
 			zap.String("connID", connID),
 			zap.String("remoteAddr", conn.RemoteAddr().String()))
 	}
 
+	_, encrypted := conn.(*tls.Conn)
 	connection := &Connection{
-		ID:         connID,
-		Conn:       conn,
-		Reader:     reader,
-		Writer:     writer,
-		Authorized: !s.AuthEnabled, // If auth is disabled, connection is automatically authorized
-		LastActive: time.Now(),
-		Logger:     connLogger,
+		ID:          connID,
+		Conn:        conn,
+		Reader:      reader,
+		Writer:      writer.writer,
+		Authorized:  !s.AuthEnabled, // If auth is disabled, connection is automatically authorized
+		LastActive:  time.Now(),
+		Logger:      connLogger,
+		ConnectedAt: time.Now(),
+		Encrypted:   encrypted,
+		AdminPort:   admin,
+		PeerUser:    peerUser(conn),
+		tempBundles: directors.NewTempBundles(s.identifiers),
 	}
+	ctx, disconnected := context.WithCancel(context.Background())
+	connection.ctx = ctx
+	defer disconnected()
 
 	// Register the connection
 	s.mu.Lock()
@@ -317,6 +667,14 @@ func (s *Server) handleConnection(conn net.Conn) {
 	defer func() {
 
 		conn.Close()
+		if connection.Transaction != nil {
+			s.services.BundleService.EndTransaction(connection.Transaction)
+			connLogger.Infof("Rolled back transaction %d of closed connection %s", connection.Transaction.ID, connID)
+		}
+		if dropped := connection.tempBundles.Drop(); dropped > 0 {
+			connLogger.Infof("Dropped %d temporary bundle(s) of closed connection %s", dropped, connID)
+		}
+		s.endSession(connection)
 		s.mu.Lock()
 		delete(s.ActiveConnections, connID)
 		s.mu.Unlock()
@@ -330,80 +688,16 @@ func (s *Server) handleConnection(conn net.Conn) {
 	errCh := make(chan error)
 	// Done channel to signal termination
 	doneCh := make(chan struct{})
+	stop := sync.OnceFunc(func() { close(doneCh) })
+	defer stop()
+	// Protocol version picked by each connection string, for the reader
+	modeCh := make(chan int, 1)
 
 	// Start a goroutine for reading
-	go func() {
-
-		defer close(dataCh)
-		defer close(errCh)
-
-		buffer := make([]byte, 1024)
-		var partialData string // For storing incomplete data between reads
-
-		for {
-			select {
-			case <-doneCh:
-				return
-			default:
-				// Set a short deadline to avoid blocking
-				conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-
-				// Try to read available data
-				n, err := conn.Read(buffer)
-
-				// Reset deadline
-				conn.SetReadDeadline(time.Time{})
-
-				if err != nil {
-					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-						// No data available, just continue
-						continue
-					}
-
-					// Handle real errors (EOF, connection closed, etc.)
-					errCh <- err
-					return
-				}
-
-				if n > 0 {
-					data := string(buffer[:n])
-					connLogger.Infof("Read %d bytes", n)
-					connLogger.Sync()
-					// Append to any previous partial data
-					data = partialData + data
-
-					// Look for complete lines
-					if strings.Contains(data, "\n") {
-						lines := strings.Split(data, "\n")
-
-						// The last element might be incomplete
-						partialData = lines[len(lines)-1]
-
-						// Process complete lines
-						for i := 0; i < len(lines)-1; i++ {
-							if line := strings.TrimSpace(lines[i]); line != "" {
-								connLogger.Infof("Received line: %s", line)
-								connLogger.Sync()
-								dataCh <- line
-							}
-						}
-					} else {
-						// No newline, store entire chunk as partial
-						partialData = data
-						connLogger.Infof("Received data: %s", data)
-						connLogger.Sync()
-					}
-				} else {
-					connLogger.Info("No Data Seen")
-					connLogger.Sync()
-				}
-			}
-		}
-	}()
+	go s.readCommands(connection, dataCh, errCh, modeCh, doneCh, disconnected)
 
 	// Send welcome message
-	writer.WriteString(fmt.Sprintf("%s\n", data.Welcome))
-	writer.Flush()
+	writer.writeMessage(data.Welcome)
 
 	// Main processing loop
 	for {
@@ -415,7 +709,10 @@ func (s *Server) handleConnection(conn net.Conn) {
 				goto cleanup
 			}
 			// Process the line
-			connLogger.Infof("Received: %s", line)
+			connLogger.Debugf("Received: %s", redactPasswords(line))
+			s.mu.Lock()
+			connection.LastActive = time.Now()
+			s.mu.Unlock()
 
 			// Your existing logic for handling commands
 			//When the client connects, it should send the connection string
@@ -426,15 +723,22 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 				connStr, err := parseConnectionString(s, line)
 				if err != nil {
-					connLogger.Errorw("Error parsing connection string", "error", err, "input", line)
+					connLogger.Errorw("Error parsing connection string", "error", err, "input", redactPasswords(line))
 					connLogger.Sync()
-					sendError(writer, fmt.Sprintf("Invalid connection string: %v", err))
+					sendError(writer, protocol.ErrConnectionString, fmt.Sprintf("Invalid connection string: %v", err))
 					// Give TCP stack time to send the data
 					time.Sleep(100 * time.Millisecond)
 
-					close(doneCh)
+					stop()
 					return
 				}
+				if connStr.TLS && !connection.Encrypted {
+					sendError(writer, protocol.ErrConnectionString, "Invalid connection string: tls=true was requested but this connection is not encrypted")
+					return
+				}
+				if !writer.framed {
+					modeCh <- connStr.Protocol
+				}
 
 				connLogger.Infof("Client %s: Connected:", connection.ID)
 				connLogger.Infof("Database: %s", connStr.Database)
@@ -445,55 +749,107 @@ func (s *Server) handleConnection(conn net.Conn) {
 				// Read client input
 
 				line = strings.TrimSpace(line)
-				connection.LastActive = time.Now()
+				// Guarded by s.mu since SHOW PROCESSLIST reads them from other connections
+				s.mu.Lock()
+				connection.AppName = connStr.AppName
+				connection.ReadTimeout = connStr.ReadTimeout
 				connection.DatabaseName = connStr.Database
-				connection.Database = s.Databases[connStr.Database]
-
 				connection.User = connStr.Username
+				s.mu.Unlock()
+				connection.Metadata = connStr.Metadata
+				connection.Database = findDatabaseByName(s.Databases, connStr.Database, s.identifiers)
 
 				if !connection.Authorized {
 
 					if !strings.EqualFold(connStr.Database, "default") {
 						db, err := s.databaseService.GetDatabaseByName(connStr.Database)
 						if err != nil {
-							sendError(writer, fmt.Sprintf("Database %s does not exist", connStr.Database))
+							sendError(writer, protocol.ErrDatabaseNotFound, fmt.Sprintf("Database %s does not exist", connStr.Database))
 							return
 						}
 						if db == nil {
-							sendError(writer, fmt.Sprintf("Database %s does not exist", connStr.Database))
+							sendError(writer, protocol.ErrDatabaseNotFound, fmt.Sprintf("Database %s does not exist", connStr.Database))
 							return
 						}
 					}
 
 					// TODO: IF the db is legit, check to see if the user is allowed to access it
-					if s.AuthEnabled && !s.authenticate(connStr.Username, connStr.Password) {
-						sendError(writer, "Authentication failed")
-						return
+					if s.AuthEnabled {
+						identity, expired, ok := s.authenticate(connStr.Username, connStr.Password, connection.PeerUser)
+						if !ok {
+							sendError(writer, protocol.ErrAuthentication, "Authentication failed")
+							return
+						}
+						s.mu.Lock()
+						connection.User = identity
+						s.mu.Unlock()
+						connection.PasswordExpired = expired
 					}
 
 					connection.Authorized = true
-					connection.DatabaseName = connStr.Database
-					connection.User = connStr.Username
 					connection.Logger = connLogger.Desugar().Sugar()
 
 					connLogger.Infow("Client authenticated",
 						"user", connection.User,
 						"database", connection.DatabaseName)
+				}
+
+				group, err := s.resourceGroups.assign(connection.User, connStr.ResourceGroup, connection.User == s.adminUser)
+				if err != nil {
+					sendCommandError(writer, err)
+					return
+				}
+				s.mu.Lock()
+				connection.resourceGroup = group
+				s.mu.Unlock()
 
-					sendSuccess(writer, "Authentication successful")
-					continue
+				if err := s.maintenanceConnectError(connection.User); err != nil {
+					connLogger.Infow("Turned a connection away during maintenance", "user", connection.User)
+					sendCommandError(writer, err)
+					return
 				}
+
+				token, resumed := s.startSession(connection, connStr.Session)
+				if resumed {
+					connLogger.Infow("Client resumed its session", "database", connection.DatabaseName)
+				}
+
+				// Acknowledged as a line; everything after uses the negotiated protocol and format
+				sendAuthenticated(writer, token, resumed)
+				writer.framed = writer.framed || connStr.Protocol == protocol.VersionFramed
+				writer.format = connStr.Format
+				if connStr.Notices {
+					s.enablePushedNotices(connection, writer, doneCh)
+				}
+				continue
 			}
 
 			// Process command for authenticated clients
 			//log.Printf("Processing command from %s: %s", connection.ID, line)
-			result, err := s.processCommand(connection, line)
-			if err != nil {
-				sendError(writer, err.Error())
-			} else {
-				sendResult(writer, result, connLogger)
-			}
+			command, bound, err := unpackCommand(line)
+			s.accessLog.run(connection, writer, command, func() (interface{}, error) {
+				if err != nil {
+					return nil, err
+				}
+				return s.safeProcessCommand(connection, bound)
+			}, func(result interface{}, err error) {
+				if err != nil {
+					sendCommandError(writer, err)
+				} else {
+					if connection.Metadata {
+						sendMetadata(writer, result, connLogger)
+					}
+					sendResult(writer, s.withNotices(connection, result), connLogger)
+				}
+			})
 		case err, ok := <-errCh:
+			var tooLarge *commandTooLargeError
+			if errors.As(err, &tooLarge) {
+				// The reader skipped the command and keeps reading
+				connLogger.Warnw("Rejected oversized command", "error", err)
+				sendCommandError(writer, err)
+				continue
+			}
 			if !ok {
 				// Channel closed
 				connLogger.Errorw("Error reading from client", "error", err)
@@ -503,15 +859,23 @@ func (s *Server) handleConnection(conn net.Conn) {
 			//connLogger.Errorw("Error reading from client", "error", err)
 			return
 
-		case <-time.After(30 * time.Second):
+		case <-time.After(idleCheckInterval(connection.ReadTimeout)):
 			// Idle timeout - send ping or check connection health
-			connLogger.Info("Connection idle for 30 seconds")
+			s.mu.Lock()
+			idle := time.Since(connection.LastActive)
+			s.mu.Unlock()
+			if connection.ReadTimeout > 0 && idle >= connection.ReadTimeout {
+				connLogger.Infof("Closing connection %s after %s without a command", connection.ID, connection.ReadTimeout)
+				sendError(writer, protocol.ErrIdleTimeout, fmt.Sprintf("Connection closed: no command received within %s", connection.ReadTimeout))
+				goto cleanup
+			}
+			connLogger.Infof("Connection idle for %s", idle.Round(time.Second))
 		}
 	}
 
 cleanup:
 	// Cleanup
-	close(doneCh)
+	stop()
 
 }
 
@@ -521,8 +885,41 @@ func (s *Server) processCommand(conn *Connection, command string) (interface{},
 	if len(parts) == 0 {
 		return nil, fmt.Errorf("empty command")
 	}
-	// Use the new function to process and print the client data
-	return s.ProcessClientData(conn, command)
+
+	// Writes sent with a request ID run once; a retry gets the first attempt's result
+	requestID, command, err := engine.CutRequestID(command)
+	if err != nil {
+		return nil, err
+	}
+	if conn.PasswordExpired && !isAlterUser(command) {
+		return nil, protocol.Errorf(protocol.ErrPasswordExpired, "the password of user '%s' has expired; change it with ALTER USER \"%s\" PASSWORD \"<new>\" REPLACE \"<current>\"", conn.User, conn.User)
+	}
+	if !cluster.IsReplicatedCommand(command, false) && !isCommit(command) {
+		// Use the new function to process and print the client data
+		return s.ProcessClientData(conn, command)
+	}
+
+	// Writes wait for admission; a throttled one is refused before it touches any data.
+	// During maintenance the admin's writes are the only ones left and go straight through.
+	write := func() (interface{}, error) {
+		if s.inMaintenance() && s.exemptFromMaintenance(conn.User) {
+			return s.ProcessClientData(conn, command)
+		}
+		release, err := s.admission.admit(conn.DatabaseName, command)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return s.ProcessClientData(conn, command)
+	}
+	if requestID == "" {
+		return write()
+	}
+	result, replayed, err := s.requests.do(conn.User, requestID, conn.DatabaseName, command, write)
+	if replayed {
+		s.logger.Infow("Replayed result of a retried request", "connID", conn.ID, "requestID", requestID)
+	}
+	return result, err
 
 }
 
@@ -532,7 +929,7 @@ func (s *Server) ProcessClientData(conn *Connection, data string) (interface{},
 	logger := s.logger.With("connID", conn.ID)
 
 	// Log the received data
-	logger.Infow("Received from client", "data", data)
+	logger.Debugw("Received from client", "data", redactPasswords(data))
 
 	// If not JSON, treat as plain text command
 	//fmt.Printf("\n--- Client Data (Plain Text) ---\n%s\n------------------------------\n", data)
@@ -553,7 +950,14 @@ func (s *Server) ProcessClientData(conn *Connection, data string) (interface{},
 
 // handleTextCommand processes commands received in plain text format
 func (s *Server) handleTextCommand(conn *Connection, command string, args []string) (interface{}, error) {
-	serviceManager := directors.GetServiceManager()
+	withConn := *s.services
+	withConn.Ctx = conn.ctx
+	if conn.Transaction == nil {
+		// Outside a transaction the connection's temporary bundles are visible
+		withConn.TempBundles = conn.tempBundles
+		withConn.User = conn.User
+	}
+	serviceManager := &withConn
 
 	//s.logger.Infof("Debugging the command received: %s", command)
 	//s.logger.Sync()
@@ -562,7 +966,99 @@ func (s *Server) handleTextCommand(conn *Connection, command string, args []stri
 	s.logger.Debugf("Buffer stats before command: hits=%d, misses=%d, ratio=%.2f, used=%d/%d",
 		stats.Hits, stats.Misses, stats.HitRatio, stats.UsedBuffers, stats.TotalBuffers)
 
-	result, err := directors.CommandDirector(conn.Database, *serviceManager, command, s.logger)
+	var result interface{}
+	var err error
+	var readOnlyErr error
+	// A replicated change is checked as the command it carries. Standbys and read-only mode
+	// let it write, and applyReplicatedChange only takes it from the cluster user.
+	checked := replicatedCommand(command)
+	if s.isStandby() && !isReplicatedChange(command) {
+		readOnlyErr = s.readOnlyError(command)
+	}
+	if readOnlyErr == nil && s.readOnly.Load() && !isReplicatedChange(command) {
+		readOnlyErr = s.readOnlyModeError(conn, command)
+	}
+	if readOnlyErr == nil && s.inMaintenance() {
+		readOnlyErr = s.maintenanceWriteError(conn, checked)
+	}
+	mask := s.resultMask(conn)
+	var statement engine.Statement
+	var maskErr error
+	if mask != nil {
+		if statement, _ = engine.ParseStatement(checked); statement != nil {
+			maskErr = mask.check(statement)
+		}
+	}
+	if s.countsTowardsGroup(conn, command) {
+		release := s.groupOf(conn).enter()
+		defer release()
+	}
+	selects := s.takesQueryWorker(conn, command)
+	if selects {
+		release := s.acquireQueryWorker(conn)
+		defer release()
+	}
+	switch {
+	case s.adminListener != nil && !conn.AdminPort && isAdminCommand(command):
+		err = protocol.Errorf(protocol.ErrAdminPortOnly, "%s is only accepted on the admin port", adminCommandName(command))
+	case s.topology != nil && strings.EqualFold(strings.Join(strings.Fields(command), " "), "SHOW CLUSTER STATUS"):
+		result = s.clusterStatus()
+	case isPing(command):
+		result = &engine.CommandResponse{ResultCount: 1, Result: "PONG"}
+	case strings.EqualFold(strings.Join(strings.Fields(command), " "), "SHOW PROCESSLIST"):
+		result = s.processList()
+	case strings.EqualFold(strings.TrimSuffix(strings.Join(strings.Fields(command), " "), ";"), "SHOW WORKERS"):
+		result = s.workerStatus()
+	case strings.EqualFold(strings.TrimSuffix(strings.Join(strings.Fields(command), " "), ";"), "SHOW RESOURCE GROUPS"):
+		result = s.resourceGroupStatus()
+	case strings.EqualFold(strings.Join(strings.Fields(command), " "), "SHOW METRICS"):
+		result = s.metrics(serviceManager)
+	case strings.EqualFold(strings.Join(strings.Fields(command), " "), "SHOW REPLICA STATUS"):
+		result = s.replicaStatus()
+	case strings.EqualFold(strings.TrimSuffix(strings.Join(strings.Fields(command), " "), ";"), "SECRETS ROTATE"):
+		result, err = s.rotateSecrets(conn)
+	case strings.EqualFold(strings.TrimSuffix(strings.Join(strings.Fields(command), " "), ";"), "DIAGNOSTICS DUMP"):
+		result, err = s.dumpDiagnostics(conn, serviceManager)
+	case isBufferPoolDump(command):
+		result, err = s.dumpBufferPool(conn, command)
+	case isAlterSystem(command):
+		result, err = s.alterSystem(conn, command)
+	case readOnlyErr != nil:
+		err = readOnlyErr
+	case maskErr != nil:
+		err = maskErr
+	case isReplicatedChange(command):
+		result, err = s.applyReplicatedChange(conn, serviceManager, command)
+	case conn.Transaction != nil || isTransactionControl(command):
+		result, err = s.transactionCommand(conn, serviceManager, command)
+	case isAlterUser(command):
+		result, err = s.alterUser(conn, command)
+	case len(strings.Fields(command)) > 0 && strings.EqualFold(strings.Fields(command)[0], "USE"):
+		result, err = s.useDatabase(conn, command)
+	case s.raft != nil && cluster.IsMetadataCommand(command) && !targetsTempBundle(conn, command):
+		// DDL goes through the replicated log and is applied on every node
+		result, err = s.raft.Submit(conn.DatabaseName, command)
+	case s.replicator != nil && tempBundleSource(conn, command) != "":
+		err = fmt.Errorf("ADD DOCUMENTS cannot copy temporary bundle '%s' into a bundle of the database while changes are replicated; the other nodes cannot read it",
+			tempBundleSource(conn, command))
+	default:
+		replicated := s.replicator != nil && cluster.IsReplicatedCommand(command, s.raft != nil) && !targetsTempBundle(conn, command)
+		if replicated {
+			command = withDocumentIDs(command)
+		}
+		result, err = directors.CommandDirector(conn.Database, *serviceManager, command, s.logger)
+		if err == nil && replicated {
+			s.replicator.Replicate(conn.DatabaseName, command)
+		}
+	}
+	if statement != nil && err == nil {
+		result = mask.apply(statement, result)
+	}
+	if selects && err == nil {
+		if err = s.groupOf(conn).checkResult(result); err != nil {
+			result = nil
+		}
+	}
 
 	stats = s.bufferPool.GetStats()
 	s.logger.Debugf("Buffer stats after command: hits=%d, misses=%d, ratio=%.2f, used=%d/%d",
@@ -572,152 +1068,323 @@ func (s *Server) handleTextCommand(conn *Connection, command string, args []stri
 
 }
 
-func parseConnectionString(server *Server, connStr string) (ConnectionString, error) {
-	result := ConnectionString{
-		Options: make(map[string]string),
+// targetsTempBundle reports whether a command names one of the connection's temporary bundles,
+// which stay on this node
+func targetsTempBundle(conn *Connection, command string) bool {
+	if conn.tempBundles.Len() == 0 {
+		return false
 	}
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return false
+	}
+	name := engine.StatementBundle(statement)
+	return name != "" && conn.tempBundles.Get(conn.Database, name) != nil
+}
 
-	// Strip syndr:// prefix if present
-
-	// if strings.HasPrefix(connStr, prefix) {
-	// 	connStr = connStr[len(prefix):]
-	// }
-
-	connStr = strings.TrimPrefix(connStr, "syndrdb://")
-	// Extract options
-	optionsParts := strings.Split(connStr, ":")
-	// The Connection String is like this: host:port:database:username:password
-	result.Host = optionsParts[0]
-	// Convert port string to integer
-	portNum, err := strconv.Atoi(optionsParts[1])
+// tempBundleSource returns the temporary bundle of the connection an ADD DOCUMENTS copies from
+// into a bundle of the database, or ""
+func tempBundleSource(conn *Connection, command string) string {
+	if conn.tempBundles.Len() == 0 {
+		return ""
+	}
+	statement, err := engine.ParseStatement(command)
 	if err != nil {
-		return result, fmt.Errorf("invalid port number: %v", err)
-	}
-	result.Port = portNum
-	result.Database = optionsParts[2]
-
-	if result.Database == "" {
-		return result, fmt.Errorf("database name cannot be empty")
-	}
-
-	// Check to make sure the database exists
-	if !DatabaseExists(server.Databases, result.Database) {
-		return result, fmt.Errorf("invalid database name: %s", result.Database)
-	}
-
-	result.Username = optionsParts[3]
-	result.Password = optionsParts[4]
-	// TODO Check to make sure the user exists
-	// TODO Check to make sure the user has access to the database
-
-	// connStr = optionsParts[0]
-	// if len(optionsParts) > 1 {
-	// 	optionsStr := optionsParts[1]
-	// 	optionsList := strings.Split(optionsStr, "&")
-	// 	for _, option := range optionsList {
-	// 		keyValue := strings.SplitN(option, "=", 2)
-	// 		if len(keyValue) == 2 {
-	// 			result.Options[keyValue[0]] = keyValue[1]
-	// 		}
-	// 	}
-	// }
-
-	// // Extract database name
-	// dbParts := strings.Split(connStr, "/")
-	// if len(dbParts) > 1 {
-	// 	result.Database = dbParts[1]
-	// }
-	// connStr = dbParts[0]
-
-	// // Extract authentication details and host/port
-	// authParts := strings.Split(connStr, "@")
-	// hostPort := connStr
-
-	// if len(authParts) > 1 {
-	// 	credentialsPart := authParts[0]
-	// 	hostPort = authParts[1]
-
-	// 	credentialsParts := strings.SplitN(credentialsPart, ":", 2)
-	// 	if len(credentialsParts) == 2 {
-	// 		result.Username = credentialsParts[0]
-	// 		result.Password = credentialsParts[1]
-	// 	}
-	// }
-
-	// // Extract host and port
-	// hostPortParts := strings.SplitN(hostPort, ":", 2)
-	// result.Host = hostPortParts[0]
-
-	// if len(hostPortParts) > 1 {
-	// 	_, err := fmt.Sscanf(hostPortParts[1], "%d", &result.Port)
-	// 	if err != nil {
-	// 		return result, fmt.Errorf("invalid port: %v", err)
-	// 	}
-	// }
-
-	return result, nil
+		return ""
+	}
+	insert, ok := statement.(*engine.InsertSelectCommand)
+	if !ok || conn.tempBundles.Get(conn.Database, insert.BundleName) != nil || conn.tempBundles.Get(conn.Database, insert.Select.BundleName) == nil {
+		return ""
+	}
+	return insert.Select.BundleName
 }
 
-func DatabaseExists(databases map[string]*models.Database, dbName string) bool {
+func DatabaseExists(databases map[string]*models.Database, dbName string, identifiers helpers.Identifiers) bool {
 	for _, db := range databases {
-		if strings.EqualFold(db.Name, dbName) {
+		if identifiers.Same(db.Name, dbName) {
 			return true
 		}
 	}
 	return false
 }
 
+// useDatabase switches the database a connection works in
+func (s *Server) useDatabase(conn *Connection, command string) (interface{}, error) {
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return nil, err
+	}
+	use, ok := statement.(*engine.UseDatabaseCommand)
+	if !ok {
+		return nil, fmt.Errorf("expected USE DATABASE \"<name>\"")
+	}
+
+	database, err := s.databaseService.GetDatabaseByName(use.DatabaseName)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.ErrDatabaseNotFound, "database '%s' does not exist", use.DatabaseName)
+	}
+
+	s.mu.Lock()
+	conn.DatabaseName = database.Name
+	s.mu.Unlock()
+	conn.Database = database
+
+	return &engine.CommandResponse{
+		ResultCount: 1,
+		Result:      fmt.Sprintf("Using database '%s'.", database.Name),
+	}, nil
+}
+
+// processList describes every open connection, oldest first
+func (s *Server) processList() *engine.CommandResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	processes := make([]map[string]interface{}, 0, len(s.ActiveConnections))
+	for _, conn := range s.ActiveConnections {
+		client := conn.Conn.RemoteAddr().String()
+		if _, local := conn.Conn.(*net.UnixConn); local {
+			client = "unix:" + conn.PeerUser
+		}
+		processes = append(processes, map[string]interface{}{
+			"ID":            conn.ID,
+			"User":          conn.User,
+			"Database":      conn.DatabaseName,
+			"AppName":       conn.AppName,
+			"ResourceGroup": s.groupOf(conn).Name,
+			"TempBundles":   conn.tempBundles.Len(),
+			"Client":        client,
+			"TLS":           conn.Encrypted,
+			"AdminPort":     conn.AdminPort,
+			"ConnectedAt":   conn.ConnectedAt.Format(time.RFC3339),
+			"IdleSeconds":   int(time.Since(conn.LastActive).Seconds()),
+		})
+	}
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i]["ConnectedAt"].(string) < processes[j]["ConnectedAt"].(string) ||
+			(processes[i]["ConnectedAt"] == processes[j]["ConnectedAt"] && processes[i]["ID"].(string) < processes[j]["ID"].(string))
+	})
+
+	return &engine.CommandResponse{
+		ResultCount: len(processes),
+		Result:      processes,
+	}
+}
+
+// metrics reports the buffer pool's counters, the statistics of every loaded bundle and the
+// bundles marked suspect after a panic
+func (s *Server) metrics(serviceManager *directors.ServiceManager) map[string]interface{} {
+	metrics := map[string]interface{}{
+		"BufferPool": s.bufferPool.GetStats(),
+		"Bundles":    serviceManager.BundleService.AllBundleStats(),
+		"Locks":      serviceManager.BundleService.LockStats(),
+		"Suspect":    serviceManager.BundleService.SuspectBundles(),
+		"ReadOnly":   s.readOnly.Load(),
+		"Accept":     s.accepts.stats(s.config.ReusePort, time.Now()),
+		"PlanCache":  serviceManager.BundleService.QueryCaches().PlanCacheStatistics(),
+	}
+	if serviceManager.Statements != nil {
+		metrics["StatementCache"] = serviceManager.Statements.Stats()
+	}
+	if maintenance := s.maintenanceStatus(); maintenance != nil {
+		metrics["Maintenance"] = maintenance
+	}
+	if s.changes != nil {
+		metrics["CDC"] = s.changes.Stats()
+	}
+	return metrics
+}
+
+// idleCheckInterval is how long the connection loop waits for a command before checking
+// whether the connection's read timeout has passed
+func idleCheckInterval(readTimeout time.Duration) time.Duration {
+	if readTimeout > 0 && readTimeout < 30*time.Second {
+		return readTimeout
+	}
+	return 30 * time.Second
+}
+
+// clusterStatus reports the cluster members, which node takes writes, consensus state and
+// per-replica handoff metrics. Clients use it to discover the topology.
+func (s *Server) clusterStatus() map[string]interface{} {
+	status := map[string]interface{}{"NodeID": s.topology.LocalNodeID}
+	primary := ""
+	if s.raft != nil {
+		status = s.raft.Status()
+		primary, _ = status["Leader"].(string)
+	} else if len(s.topology.Replicas) > 0 {
+		// Without consensus the node shipping writes to replicas is the primary
+		primary = s.topology.LocalNodeID
+	} else if s.isStandby() {
+		primary = s.topology.ReplicaOf
+	}
+	status["Primary"] = primary
+
+	members := make([]map[string]interface{}, 0, len(s.topology.Nodes))
+	for _, node := range s.topology.Nodes {
+		members = append(members, map[string]interface{}{
+			"ID":      node.ID,
+			"Address": node.Address,
+		})
+	}
+	status["Nodes"] = members
+
+	if s.replicator != nil {
+		status["Replicas"] = s.replicator.Stats()
+	}
+	return status
+}
+
+// applyMetadataEntry applies a committed DDL command from the raft log to this node's catalog
+func applyMetadataEntry(services *directors.ServiceManager, logger *zap.SugaredLogger) cluster.ApplyFunc {
+	return func(entry cluster.LogEntry) (interface{}, error) {
+		var database *models.Database
+		if entry.Database != "" {
+			db, err := services.DatabaseService.GetDatabaseByName(entry.Database)
+			if err != nil {
+				return nil, fmt.Errorf("database '%s' not found: %w", entry.Database, err)
+			}
+			database = db
+		}
+		return directors.CommandDirector(database, *services, entry.Command, logger)
+	}
+}
+
+// findDatabaseByName looks up a loaded database by name (the map is keyed by database ID)
+func findDatabaseByName(databases map[string]*models.Database, dbName string, identifiers helpers.Identifiers) *models.Database {
+	for _, db := range databases {
+		if identifiers.Same(db.Name, dbName) {
+			return db
+		}
+	}
+	return nil
+}
+
 // Helper functions
-func sendError(writer *bufio.Writer, message string) {
-	response := map[string]interface{}{
+
+// errorResponse is the body of every error response: its code (see protocol/errors.go) and
+// message
+func errorResponse(code protocol.ErrorCode, message string) map[string]interface{} {
+	return map[string]interface{}{
 		"status":  "error",
+		"code":    code,
 		"message": message,
 	}
+}
+
+func sendError(writer *messageWriter, code protocol.ErrorCode, message string) {
+	jsonResponse, _ := json.Marshal(errorResponse(code, message))
+	writer.writeMessage(string(jsonResponse))
+}
+
+// sendCommandError reports a failed command with the code of its error; retryable errors say when to
+// retry, syntax errors also carry where the command went wrong and what was expected there, so clients
+// can point at the mistake, deadlocks name the transactions involved, and writes refused by a hot
+// standby name its primary
+func sendCommandError(writer *messageWriter, err error) {
+	code := protocol.CodeOf(err)
+	response := errorResponse(code, err.Error())
+	if protocol.Retryable(code) {
+		response["retryable"] = true
+		response["retry_after_ms"] = protocol.RetryAfter(err).Milliseconds()
+	}
+
+	var maintenanceErr *MaintenanceError
+	var readOnlyErr *ReadOnlyReplicaError
+	var deadlockErr *directors.DeadlockError
+	var syntaxErr *engine.SyntaxError
+	switch {
+	case errors.As(err, &maintenanceErr):
+		response["maintenance"] = true
+	case errors.As(err, &readOnlyErr):
+		response["read_only"] = map[string]interface{}{
+			"primary": readOnlyErr.Primary,
+			"address": readOnlyErr.PrimaryAddress,
+		}
+	case errors.As(err, &deadlockErr):
+		response["deadlock"] = map[string]interface{}{
+			"transaction": deadlockErr.Victim,
+			"cycle":       deadlockErr.Cycle,
+			"bundle":      deadlockErr.Bundle,
+			"document":    deadlockErr.DocumentID,
+		}
+	case errors.As(err, &syntaxErr):
+		response["syntax"] = map[string]interface{}{
+			"position":   syntaxErr.Offset,
+			"near":       syntaxErr.Near,
+			"expected":   syntaxErr.Expected,
+			"suggestion": syntaxErr.Suggestion,
+			"snippet":    syntaxErr.Snippet,
+		}
+	}
 	jsonResponse, _ := json.Marshal(response)
-	writer.WriteString(string(jsonResponse) + "\n")
-	writer.Flush()
+	writer.writeMessage(string(jsonResponse))
 }
 
-func sendSuccess(writer *bufio.Writer, message string) {
+// sendAuthenticated acknowledges a connection string, handing out the session token when sessions are enabled
+func sendAuthenticated(writer *messageWriter, sessionToken string, resumed bool) {
 	response := map[string]interface{}{
 		"status":  "success",
-		"message": message,
+		"message": "Authentication successful",
+	}
+	if sessionToken != "" {
+		response["session"] = sessionToken
+		response["resumed"] = resumed
 	}
 	jsonResponse, _ := json.Marshal(response)
-	writer.WriteString(string(jsonResponse) + "\n")
-	writer.Flush()
+	writer.writeMessage(string(jsonResponse))
 }
 
-func sendResult(writer *bufio.Writer, result interface{}, logger *zap.SugaredLogger) {
-	var data []byte
+func sendSuccess(writer *messageWriter, message string) {
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": message,
+	}
+	jsonResponse, _ := json.Marshal(response)
+	writer.writeMessage(string(jsonResponse))
+}
 
+func sendResult(writer *messageWriter, result interface{}, logger *zap.SugaredLogger) {
 	switch typedResult := result.(type) {
 	case *string:
 		if typedResult != nil {
 			// For string pointers, just write the string directly
-			writer.WriteString(*typedResult + "\n")
-			writer.Flush()
+			writer.writeMessage(*typedResult)
 			return
 		}
 	case string:
 		// For direct strings
-		writer.WriteString(typedResult + "\n")
-		writer.Flush()
+		writer.writeMessage(typedResult)
 		return
 	default:
-		// For other types, marshal to JSON
-
-		data, _ = json.Marshal(result)
-		logger.Infof("Sending result: %s", data)
-		logger.Sync()
-		writer.WriteString(string(data) + "\n")
-		writer.Flush()
+		// For other types, encode JSON straight onto the connection
+		size, err := writer.writeJSON(result)
+		if err != nil {
+			logger.Debugf("Failed to send result: %v", err)
+			if size == 0 {
+				// Nothing reached the client, so it still waits for a response
+				sendError(writer, protocol.ErrInternal, fmt.Sprintf("failed to encode result: %v", err))
+			}
+			return
+		}
+		logger.Debugf("Sent result of %d bytes", size)
 	}
 }
 
-func hashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
-	return hex.EncodeToString(hash[:])
+// sendMetadata sends the declared fields of the documents in a SELECT's result ahead of it,
+// see engine/result_metadata.go; other results have none
+func sendMetadata(writer *messageWriter, result interface{}, logger *zap.SugaredLogger) {
+	response, ok := result.(*engine.CommandResponse)
+	if !ok || response == nil || response.Metadata == nil {
+		return
+	}
+	payload, err := json.Marshal(response.Metadata)
+	if err == nil {
+		err = writer.writeCompact(payload, true)
+	}
+	if err != nil {
+		logger.Debugf("Failed to send result metadata: %v", err)
+	}
 }
 
 func generateConnectionID() string {
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+/*
+	Sessions.
+
+	Every authenticated connection is given a session token in the connection string's
+	success response. A client that loses its connection can reconnect with ?session=<token>
+	within the grace period and continue where it left off: the database it last selected
+	with USE, its application name and its read timeout are restored. The same user must
+	reconnect, and still authenticates as usual; the token only carries state.
+
+	A token stays valid while a connection holds it. If the old connection is still open when
+	the client reconnects (it may not have noticed the network drop yet), the new connection
+	takes the session over.
+*/
+
+// sessionState is what a resumed connection gets back
+type sessionState struct {
+	DatabaseName string
+	AppName      string
+	ReadTimeout  time.Duration
+}
+
+type session struct {
+	user           string
+	state          sessionState // As of the last disconnect
+	owner          *Connection  // The connection holding the session; nil once it disconnects
+	generation     int          // Bumped on every resume so a stale owner's disconnect is ignored
+	disconnectedAt time.Time
+}
+
+// sessionStore holds the sessions of connected clients and, for the grace period, of disconnected ones
+type sessionStore struct {
+	mu       sync.Mutex
+	grace    time.Duration
+	sessions map[string]*session
+}
+
+func newSessionStore(grace time.Duration) *sessionStore {
+	if grace <= 0 {
+		return nil
+	}
+	return &sessionStore{grace: grace, sessions: make(map[string]*session)}
+}
+
+// create starts a session owned by a connection and returns its token
+func (st *sessionStore) create(conn *Connection) (string, int) {
+	token := newSessionToken()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.expire(time.Now())
+	st.sessions[token] = &session{user: conn.User, owner: conn}
+	return token, 0
+}
+
+// resume hands a session to a new connection. It fails when the token is unknown, expired or
+// belongs to another user. The state comes from the previous owner if it is still connected.
+func (st *sessionStore) resume(token string, conn *Connection, snapshot func(*Connection) sessionState) (sessionState, int, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.expire(time.Now())
+
+	existing, ok := st.sessions[token]
+	if !ok || existing.user != conn.User {
+		return sessionState{}, 0, false
+	}
+	if existing.owner != nil {
+		existing.state = snapshot(existing.owner)
+	}
+	existing.owner = conn
+	existing.generation++
+	return existing.state, existing.generation, true
+}
+
+// detach records a connection's final state and starts the grace period
+func (st *sessionStore) detach(token string, generation int, state sessionState) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	existing, ok := st.sessions[token]
+	if !ok || existing.generation != generation {
+		return
+	}
+	existing.state = state
+	existing.owner = nil
+	existing.disconnectedAt = time.Now()
+}
+
+// expire drops sessions disconnected for longer than the grace period. Callers hold mu.
+func (st *sessionStore) expire(now time.Time) {
+	for token, existing := range st.sessions {
+		if existing.owner == nil && now.Sub(existing.disconnectedAt) > st.grace {
+			delete(st.sessions, token)
+		}
+	}
+}
+
+func newSessionToken() string {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// sessionSnapshot reads a connection's session state
+func (s *Server) sessionSnapshot(conn *Connection) sessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sessionState{
+		DatabaseName: conn.DatabaseName,
+		AppName:      conn.AppName,
+		ReadTimeout:  conn.ReadTimeout,
+	}
+}
+
+// startSession gives an authenticated connection a session, resuming the one named by token
+// when possible. It returns the token to hand back (empty when sessions are disabled) and
+// whether an earlier session was resumed.
+func (s *Server) startSession(conn *Connection, token string) (string, bool) {
+	if s.sessions == nil {
+		return "", false
+	}
+	if conn.SessionToken != "" {
+		// The connection string was sent again on a connection that already has a session
+		return conn.SessionToken, false
+	}
+
+	if token != "" {
+		state, generation, ok := s.sessions.resume(token, conn, s.sessionSnapshot)
+		if ok {
+			// The selected database may have been dropped in the meantime
+			database, err := s.databaseService.GetDatabaseByName(state.DatabaseName)
+
+			s.mu.Lock()
+			// Options given again in the new connection string win over the saved ones
+			if conn.AppName == "" {
+				conn.AppName = state.AppName
+			}
+			if conn.ReadTimeout == 0 {
+				conn.ReadTimeout = state.ReadTimeout
+			}
+			if err == nil {
+				conn.DatabaseName = database.Name
+			}
+			conn.SessionToken = token
+			conn.sessionGeneration = generation
+			s.mu.Unlock()
+			if err == nil {
+				conn.Database = database
+			}
+			return token, true
+		}
+	}
+
+	conn.SessionToken, conn.sessionGeneration = s.sessions.create(conn)
+	return conn.SessionToken, false
+}
+
+// endSession starts the grace period of a closing connection's session
+func (s *Server) endSession(conn *Connection) {
+	if s.sessions == nil || conn.SessionToken == "" {
+		return
+	}
+	s.sessions.detach(conn.SessionToken, conn.sessionGeneration, s.sessionSnapshot(conn))
+}
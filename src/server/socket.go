@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+	Unix domain socket.
+
+	With -socket the server also listens on a Unix domain socket, for clients on the same
+	host such as the CLI or a sidecar, which skip TCP and TLS. The socket takes the same
+	connection strings and commands as -port; the host in the connection string is ignored.
+	Its file is made readable and writable by the server's user and group only, and is
+	removed when the server stops. A file left at the path by a server that crashed is
+	replaced, but the server refuses to start while another one answers on the socket.
+
+	The kernel tells the server which OS user runs the client at the other end of the
+	socket. With the peer authentication provider (-authproviders=peer,local), a client whose
+	connection string names its own OS user name is let in without a password. Connections
+	over TCP never pass the peer provider.
+*/
+
+// socketMode is the permission of the socket file; connecting needs write permission
+const socketMode = 0660
+
+// startSocketListener starts accepting connections on the Unix domain socket
+func (s *Server) startSocketListener() error {
+	path := s.config.Socket
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("-socket %s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("another server is listening on socket %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("could not remove stale socket %s: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("error listening on socket %s: %w", path, err)
+	}
+	if err := os.Chmod(path, socketMode); err != nil {
+		listener.Close()
+		return fmt.Errorf("could not set permissions of socket %s: %w", path, err)
+	}
+	s.socketListener = listener
+	s.logger.Infof("Listening on Unix socket %s", path)
+
+	go s.acceptConnections(listener, false)
+	return nil
+}
+
+// peerUser returns the OS user running the client at the other end of a Unix socket
+// connection, or "" for any other connection or when the kernel does not say
+func peerUser(conn net.Conn) string {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var credentials *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		credentials, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return ""
+	}
+	account, err := user.LookupId(strconv.FormatUint(uint64(credentials.Uid), 10))
+	if err != nil {
+		return ""
+	}
+	return account.Username
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"syndrdb/src/cluster"
+	"syndrdb/src/directors"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/protocol"
+	"time"
+)
+
+/*
+	Hot standby.
+
+	A node whose topology names a ReplicaOf is a hot standby of that node. It applies the
+	changes the primary ships (REPLICATED commands, see cluster/replication.go) and answers
+	reads from clients in the meantime, but refuses every other write with a
+	ReadOnlyReplicaError naming the primary. A REPLICATED command is only taken from the
+	cluster user, on a node of a cluster, from another node of it (the primary, on a standby);
+	otherwise any client could write past the standby, read-only mode and masking with one.
+
+	A primary may send a change again when the reply to it was lost. The standby records the
+	sequence of the last change it applied from each node (cluster.AppliedSequences) and skips
+	one it has seen. A replicated ADD DOCUMENT names its document's ID, and a replicated ADD
+	DOCUMENTS ... FROM SELECT or MERGE the seed its new documents' IDs derive from, so the
+	standby stores them under the IDs the primary gave them, and a change that slips past is
+	refused as a duplicate instead of adding the documents twice.
+
+	SHOW REPLICA STATUS reports how far behind the primary a standby is, from the header of
+	the last change it applied: the changes and bytes that were still waiting behind it on
+	the primary, and, while any were, the seconds since the primary made that change. On a
+	primary it lists the same lag for every replica it ships to.
+*/
+
+// ReadOnlyReplicaError refuses a write sent to a hot standby
+type ReadOnlyReplicaError struct {
+	Primary        string
+	PrimaryAddress string
+}
+
+func (e *ReadOnlyReplicaError) Error() string {
+	return fmt.Sprintf("read-only replica: this node is a hot standby of '%s'; send writes to %s", e.Primary, e.PrimaryAddress)
+}
+
+func (e *ReadOnlyReplicaError) ErrorCode() protocol.ErrorCode { return protocol.ErrReadOnlyReplica }
+
+// standbyStatus tracks the changes applied from a primary
+type standbyStatus struct {
+	mu             sync.Mutex
+	applyMu        sync.Mutex                // Held from checking a change's sequence to recording it
+	applied        *cluster.AppliedSequences // Only set in cluster mode
+	appliedChanges uint64
+	appliedBytes   int64
+	failedChanges  uint64
+	skippedChanges uint64 // Sent again after they were applied
+	last           *cluster.ReplicatedChange
+	lastAppliedAt  time.Time
+	lastError      string
+}
+
+// isStandby reports whether this node is a read-only hot standby
+func (s *Server) isStandby() bool {
+	return s.topology != nil && s.topology.ReplicaOf != ""
+}
+
+// readOnlyError refuses a command that writes, on a hot standby; nil for reads
+func (s *Server) readOnlyError(command string) error {
+	statement, err := engine.ParseStatement(command)
+	if err != nil || !writesData(statement) {
+		// A command that does not parse fails on its own
+		return nil
+	}
+	primary, _ := s.topology.Node(s.topology.ReplicaOf)
+	return &ReadOnlyReplicaError{Primary: primary.ID, PrimaryAddress: primary.Address}
+}
+
+// writesData reports whether a statement changes documents, bundles or catalog files
+func writesData(statement engine.Statement) bool {
+	switch cmd := statement.(type) {
+	case *engine.SelectDocumentsCommand, *engine.SelectDistinctCommand, *engine.SelectApproximateCommand,
+		*engine.SelectDatabasesCommand, *engine.ExplainCommand,
+		*engine.UseDatabaseCommand, *engine.ShowOrphanedFilesCommand, *engine.ShowNamespacesCommand,
+		*engine.ShowDocumentHistoryCommand, *engine.ShowBundleStatsCommand, *engine.ShowFieldStatsCommand, *engine.ShowWebhooksCommand,
+		*engine.ShowIndexUsageCommand, *engine.ShowIndexStatsCommand, *engine.AdviseIndexesCommand, *engine.ExportSchemaCommand,
+		*engine.BeginTransactionCommand, *engine.CommitCommand, *engine.RollbackCommand,
+		*engine.AlterUserCommand, *engine.AlterSystemCommand:
+		return false
+	case *engine.CheckDatabaseCommand:
+		return cmd.Repair
+	case *engine.ApplySchemaCommand:
+		return !cmd.Preview
+	}
+	return true
+}
+
+// isReplicatedChange reports whether a command is a change shipped from a primary
+func isReplicatedChange(command string) bool {
+	fields := strings.Fields(command)
+	return len(fields) > 0 && strings.EqualFold(fields[0], cluster.ReplicatedCommandPrefix)
+}
+
+// replicatedCommand returns the command a replicated change carries, or command itself when it
+// is not one
+func replicatedCommand(command string) string {
+	if !isReplicatedChange(command) {
+		return command
+	}
+	change, err := cluster.ParseReplicatedCommand(command)
+	if err != nil {
+		return command
+	}
+	return change.Command
+}
+
+// acceptsChangesFrom reports whether a node may ship changes to this one: another node of the
+// cluster, and the primary on a hot standby
+func (s *Server) acceptsChangesFrom(origin string) bool {
+	if s.topology == nil || origin == s.topology.LocalNodeID {
+		return false
+	}
+	if _, known := s.topology.Node(origin); !known {
+		return false
+	}
+	return !s.isStandby() || origin == s.topology.ReplicaOf
+}
+
+// withDocumentIDs pins the IDs of the documents a command that is about to be replicated adds,
+// see pinDocumentIDs
+func withDocumentIDs(command string) string {
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return command
+	}
+	return pinDocumentIDs(statement, command)
+}
+
+// pinDocumentIDs picks the ID an ADD DOCUMENT gives its document, or the seed the IDs of the
+// documents an ADD DOCUMENTS ... FROM SELECT or MERGE adds derive from, and adds it to the
+// command, so the replicas store the documents under the same IDs. Other commands are
+// returned as they are.
+func pinDocumentIDs(statement engine.Statement, command string) string {
+	var clause string
+	switch cmd := statement.(type) {
+	case *engine.DocumentCommand:
+		if cmd.DocumentID != "" {
+			return command
+		}
+		cmd.DocumentID = helpers.GenerateUUID()
+		clause = "ID " + engine.QuoteString(cmd.DocumentID)
+	case *engine.InsertSelectCommand:
+		if cmd.IDSeed != "" {
+			return command
+		}
+		cmd.IDSeed = helpers.GenerateUUID()
+		clause = "IDS " + engine.QuoteString(cmd.IDSeed)
+	case *engine.MergeCommand:
+		if cmd.IDSeed != "" {
+			return command
+		}
+		cmd.IDSeed = helpers.GenerateUUID()
+		clause = "IDS " + engine.QuoteString(cmd.IDSeed)
+	default:
+		return command
+	}
+	return strings.TrimSuffix(strings.TrimSpace(command), ";") + " " + clause
+}
+
+// applyReplicatedChange applies a change a primary shipped to this node, unless it was applied already
+func (s *Server) applyReplicatedChange(conn *Connection, serviceManager *directors.ServiceManager, command string) (interface{}, error) {
+	if s.topology == nil || conn.User != s.topology.Username {
+		return nil, protocol.Errorf(protocol.ErrPermissionDenied, "only the cluster user of a node in a cluster can send replicated changes")
+	}
+	change, err := cluster.ParseReplicatedCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	if !s.acceptsChangesFrom(change.Origin) {
+		return nil, protocol.Errorf(protocol.ErrPermissionDenied, "this node does not receive changes from '%s'", change.Origin)
+	}
+
+	s.standby.applyMu.Lock()
+	defer s.standby.applyMu.Unlock()
+	applied := s.standby.applied
+	if applied != nil && applied.Applied(change.Origin, change.Sequence) {
+		s.standby.mu.Lock()
+		s.standby.skippedChanges++
+		s.standby.mu.Unlock()
+		return &engine.CommandResponse{
+			ResultCount: 0,
+			Result:      fmt.Sprintf("Change %d from '%s' was applied already.", change.Sequence, change.Origin),
+		}, nil
+	}
+
+	var result interface{}
+	if cluster.IsTransactionCommand(change.Command) {
+		result, err = s.applyReplicatedTransaction(conn, serviceManager, change.Command)
+	} else {
+		result, err = directors.CommandDirector(conn.Database, *serviceManager, change.Command, s.logger)
+	}
+	if err == nil && applied != nil {
+		if recordErr := applied.Record(change.Origin, change.Sequence); recordErr != nil {
+			// The change is applied; if it is sent again, it is applied again
+			s.logger.Errorf("Failed to record replicated change %d from '%s': %v", change.Sequence, change.Origin, recordErr)
+		}
+	}
+
+	s.standby.mu.Lock()
+	defer s.standby.mu.Unlock()
+	if err != nil {
+		s.standby.failedChanges++
+		s.standby.lastError = err.Error()
+		return nil, err
+	}
+	s.standby.appliedChanges++
+	s.standby.appliedBytes += int64(len(change.Command))
+	s.standby.last = change
+	s.standby.lastAppliedAt = time.Now()
+	return result, nil
+}
+
+// applyReplicatedTransaction commits the statements of a transaction committed on the primary
+// in one transaction, so the replica never shows part of it
+func (s *Server) applyReplicatedTransaction(conn *Connection, serviceManager *directors.ServiceManager, command string) (interface{}, error) {
+	replicated, err := cluster.ParseTransactionCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Database == nil {
+		return nil, fmt.Errorf("no database selected for the replicated transaction")
+	}
+
+	tx := serviceManager.BundleService.BeginTransaction(conn.Database, replicated.Isolation)
+	for _, statementText := range replicated.Commands {
+		statement, err := engine.ParseStatement(statementText)
+		if err == nil {
+			err = serviceManager.BundleService.AddToTransaction(tx, statement, statementText)
+		}
+		if err != nil {
+			serviceManager.BundleService.EndTransaction(tx)
+			return nil, fmt.Errorf("replicated transaction: %w", err)
+		}
+	}
+	written, err := serviceManager.BundleService.CommitTransaction(s.databaseService, tx)
+	if err != nil {
+		return nil, err
+	}
+	return &engine.CommandResponse{
+		ResultCount: written,
+		Result:      fmt.Sprintf("Replicated transaction committed: %d statement(s), %d document(s) written.", tx.Len(), written),
+	}, nil
+}
+
+// replicaStatus answers SHOW REPLICA STATUS
+func (s *Server) replicaStatus() map[string]interface{} {
+	status := map[string]interface{}{"Role": "standalone"}
+	if s.topology != nil {
+		status["NodeID"] = s.topology.LocalNodeID
+	}
+	if s.replicator != nil {
+		status["Role"] = "primary"
+		status["Replicas"] = s.replicator.Stats()
+	}
+
+	s.standby.mu.Lock()
+	defer s.standby.mu.Unlock()
+	if !s.isStandby() && s.standby.appliedChanges == 0 && s.standby.failedChanges == 0 && s.standby.skippedChanges == 0 {
+		return status
+	}
+
+	if s.isStandby() {
+		status["Role"] = "replica"
+		status["Primary"] = s.topology.ReplicaOf
+	}
+	status["AppliedChanges"] = s.standby.appliedChanges
+	status["AppliedBytes"] = s.standby.appliedBytes
+	status["FailedChanges"] = s.standby.failedChanges
+	status["SkippedChanges"] = s.standby.skippedChanges
+	status["LastError"] = s.standby.lastError
+
+	lagSeconds := 0.0
+	if last := s.standby.last; last != nil {
+		status["LastSequence"] = last.Sequence
+		status["LastChangeAt"] = last.Time.Format(time.RFC3339Nano)
+		status["LastAppliedAt"] = s.standby.lastAppliedAt.Format(time.RFC3339Nano)
+		status["LagChanges"] = last.PendingChanges
+		status["LagBytes"] = last.PendingBytes
+		if last.PendingChanges > 0 {
+			lagSeconds = time.Since(last.Time).Seconds()
+		}
+	} else {
+		status["LagChanges"] = 0
+		status["LagBytes"] = int64(0)
+	}
+	status["LagSeconds"] = lagSeconds
+	return status
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syndrdb/src/cluster"
+	"syndrdb/src/directors"
+	"syndrdb/src/engine"
+)
+
+/*
+	Transaction control.
+
+	BEGIN, COMMIT and ROLLBACK work on the connection's own transaction (see
+	directors/transactions.go). While one is open, document writes are queued instead of run,
+	SELECT DOCUMENTS reads what the transaction's isolation level lets it see, other reads
+	run as usual, and anything else is refused so that a transaction never spans a USE or a
+	change to the bundles it writes. Once a transaction commits, its statements are sent to
+	replicas as one change, which each replica commits in a transaction of its own. A transaction that loses a deadlock is rolled back.
+*/
+
+// isTransactionControl reports whether a command is BEGIN, COMMIT or ROLLBACK
+func isTransactionControl(command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(strings.TrimSuffix(fields[0], ";")) {
+	case "BEGIN", "COMMIT", "ROLLBACK":
+		return true
+	}
+	return false
+}
+
+// isCommit reports whether a command is COMMIT, which writes like any document write
+func isCommit(command string) bool {
+	return strings.EqualFold(strings.TrimSuffix(strings.TrimSpace(command), ";"), "COMMIT")
+}
+
+// transactionCommand runs transaction control and, while a transaction is open, every other
+// command of the connection
+func (s *Server) transactionCommand(conn *Connection, serviceManager *directors.ServiceManager, command string) (interface{}, error) {
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cmd := statement.(type) {
+	case *engine.BeginTransactionCommand:
+		if conn.Transaction != nil {
+			return nil, fmt.Errorf("transaction %d is already open; COMMIT or ROLLBACK it first", conn.Transaction.ID)
+		}
+		if conn.Database == nil {
+			return nil, fmt.Errorf("no database selected; USE a database before BEGIN")
+		}
+		conn.Transaction = serviceManager.BundleService.BeginTransaction(conn.Database, cmd.Isolation)
+		return &engine.CommandResponse{
+			ResultCount: 1,
+			Result: fmt.Sprintf("Transaction %d started in database '%s' with isolation level %s.",
+				conn.Transaction.ID, conn.DatabaseName, cmd.Isolation),
+		}, nil
+
+	case *engine.CommitCommand:
+		tx := conn.Transaction
+		if tx == nil {
+			return nil, fmt.Errorf("no transaction is open")
+		}
+		conn.Transaction = nil
+		written, err := serviceManager.BundleService.CommitTransaction(s.databaseService, tx)
+		if err != nil {
+			return nil, err
+		}
+		if s.replicator != nil && tx.Len() > 0 {
+			s.replicator.Replicate(conn.DatabaseName, cluster.FormatTransactionCommand(cluster.ReplicatedTransaction{
+				Isolation: tx.Isolation,
+				Commands:  tx.Commands(),
+			}))
+		}
+		return &engine.CommandResponse{
+			ResultCount: written,
+			Result:      fmt.Sprintf("Transaction %d committed: %d statement(s), %d document(s) written.", tx.ID, tx.Len(), written),
+		}, nil
+
+	case *engine.RollbackCommand:
+		tx := conn.Transaction
+		if tx == nil {
+			return nil, fmt.Errorf("no transaction is open")
+		}
+		conn.Transaction = nil
+		serviceManager.BundleService.EndTransaction(tx)
+		return &engine.CommandResponse{
+			ResultCount: 0,
+			Result:      fmt.Sprintf("Transaction %d rolled back; %d statement(s) discarded.", tx.ID, tx.Len()),
+		}, nil
+
+	case *engine.SelectDocumentsCommand:
+		return directors.TransactionSelect(conn.Transaction, *serviceManager, cmd, s.logger)
+
+	case *engine.SelectDistinctCommand:
+		return directors.TransactionSelectDistinct(conn.Transaction, *serviceManager, cmd, s.logger)
+
+	case *engine.SelectApproximateCommand:
+		return directors.TransactionSelectApproximate(conn.Transaction, *serviceManager, cmd, s.logger)
+
+	case *engine.SelectDatabasesCommand, *engine.ExplainCommand,
+		*engine.ShowBundleStatsCommand, *engine.ShowFieldStatsCommand, *engine.ShowOrphanedFilesCommand,
+		*engine.ShowWebhooksCommand, *engine.ShowIndexUsageCommand, *engine.ShowIndexStatsCommand, *engine.AdviseIndexesCommand,
+		*engine.ExportSchemaCommand:
+		return directors.CommandDirector(conn.Database, *serviceManager, command, s.logger)
+	}
+
+	if s.replicator != nil {
+		command = pinDocumentIDs(statement, command)
+	}
+	if err := serviceManager.BundleService.AddToTransaction(conn.Transaction, statement, command); err != nil {
+		var deadlockErr *directors.DeadlockError
+		if errors.As(err, &deadlockErr) {
+			// The victim of a deadlock is rolled back so the others can go on
+			serviceManager.BundleService.EndTransaction(conn.Transaction)
+			conn.Transaction = nil
+		}
+		return nil, err
+	}
+	return &engine.CommandResponse{
+		ResultCount: 0,
+		Result:      fmt.Sprintf("Queued in transaction %d (%d statement(s)).", conn.Transaction.ID, conn.Transaction.Len()),
+	}, nil
+}
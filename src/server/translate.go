@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+)
+
+/*
+	Translated commands.
+
+	The MongoDB shim (mongo.go) and the gRPC API (grpc.go) take requests in shapes of their
+	own and build SyndrQL from them, which then runs on the caller's connection as any command
+	a client sends would. These are the pieces both use.
+*/
+
+// runTranslated runs a command built from a request on the connection it came in on
+func (s *Server) runTranslated(conn *Connection, command string) (*engine.CommandResponse, error) {
+	conn.Logger.Debugw("Running translated command", "connID", conn.ID, "command", command)
+	result, err := s.safeProcessCommand(conn, command)
+	if err != nil {
+		return nil, err
+	}
+	switch typed := result.(type) {
+	case *engine.CommandResponse:
+		if typed != nil {
+			return typed, nil
+		}
+	case **engine.CommandResponse:
+		if typed != nil && *typed != nil {
+			return *typed, nil
+		}
+	}
+	return &engine.CommandResponse{ResultCount: 1, Result: result}, nil
+}
+
+// syndrqlString quotes a name or value as a SyndrQL string
+func syndrqlString(value string) string {
+	return engine.QuoteString(value)
+}
+
+// syndrqlField writes a field name, in backquotes when it is not a plain one
+func syndrqlField(name string) (string, error) {
+	if engine.CheckFieldName(name, false) == nil {
+		return syndrqlString(name), nil
+	}
+	if strings.Contains(name, "`") {
+		return "", fmt.Errorf("field name %q cannot hold a backquote", name)
+	}
+	return "`" + name + "`", nil
+}
+
+// bundleNames lists the bundles of a database, loaded or not, by name
+func bundleNames(database *models.Database) []string {
+	names := make(map[string]bool)
+	for name := range database.Bundles {
+		names[name] = true
+	}
+	for _, file := range database.BundleFiles {
+		names[helpers.BundleNameFromFile(file)] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// resultDocuments returns the documents a SELECT DOCUMENTS returned, in their order or by
+// DocumentID when the SELECT had none
+func resultDocuments(response *engine.CommandResponse) []*models.Document {
+	switch documents := response.Result.(type) {
+	case []*models.Document:
+		return documents
+	case map[string]*models.Document:
+		sorted := make([]*models.Document, 0, len(documents))
+		for _, document := range documents {
+			sorted = append(sorted, document)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].DocumentID < sorted[j].DocumentID })
+		return sorted
+	}
+	return nil
+}
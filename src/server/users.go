@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"syndrdb/src/auth"
+	"syndrdb/src/engine"
+	"syndrdb/src/protocol"
+)
+
+/*
+	Local users.
+
+	The server's own users live in an encrypted user store in the data directory, with
+	Argon2id password hashes, and log in through the local authentication provider under the
+	server's password policy (auth/password_policy.go). A user whose password has expired
+	still logs in, but every command other than changing that password is refused until
+	ALTER USER has replaced it:
+
+		ALTER USER "<name>" PASSWORD "<new>" REPLACE "<current>"
+
+	The current password is always required, and a wrong one counts towards the lockout like
+	a failed login. Users are local to each node.
+*/
+
+// AddUser adds a local user unless one with the name exists. The password is not checked
+// against the policy; mustChangePassword makes the user replace it at the first login.
+func (s *Server) AddUser(username, password string, mustChangePassword bool) {
+	if _, err := s.users.GetUser(username); err == nil {
+		return
+	}
+	if _, err := s.users.AddUser(auth.NewUser{UserID: username, Username: username, Password: password, MustChangePassword: mustChangePassword}); err != nil {
+		s.logger.Errorw("Failed to add user", "user", username, "error", err)
+	}
+}
+
+// authenticate asks each provider in turn, returning the name the first to accept the
+// credentials knows the client by and whether the client still has to change its password
+func (s *Server) authenticate(username, password, peerUser string) (string, bool, bool) {
+	for _, provider := range s.authProviders {
+		var identity string
+		var err error
+		if peer, ok := provider.(auth.PeerProvider); ok {
+			identity, err = peer.AuthenticatePeer(username, peerUser)
+		} else {
+			identity, err = provider.Authenticate(username, password)
+		}
+		if err == nil {
+			return identity, false, true
+		}
+		if errors.Is(err, auth.ErrPasswordExpired) {
+			return identity, true, true
+		}
+		if !errors.Is(err, auth.ErrInvalidCredentials) {
+			s.logger.Warnw("Authentication provider failed", "provider", provider.Name(), "user", username, "error", err)
+		}
+	}
+	return "", false, false
+}
+
+// localUsers is the provider for the server's own users
+type localUsers struct {
+	server *Server
+}
+
+func (l localUsers) Name() string { return auth.ProviderLocal }
+
+func (l localUsers) Authenticate(username, password string) (string, error) {
+	if err := l.server.users.Authenticate(username, password, l.server.passwordPolicy); err != nil {
+		if errors.Is(err, auth.ErrPasswordExpired) {
+			return username, err
+		}
+		return "", err
+	}
+	return username, nil
+}
+
+// isAlterUser reports whether a command is ALTER USER, answered by the server itself
+func isAlterUser(command string) bool {
+	fields := strings.Fields(command)
+	return len(fields) >= 2 && strings.EqualFold(fields[0], "ALTER") && strings.EqualFold(fields[1], "USER")
+}
+
+// alterUser changes a local user's password
+func (s *Server) alterUser(conn *Connection, command string) (interface{}, error) {
+	statement, err := engine.ParseStatement(command)
+	if err != nil {
+		return nil, err
+	}
+	alter, ok := statement.(*engine.AlterUserCommand)
+	if !ok {
+		return nil, fmt.Errorf("expected ALTER USER \"<name>\" PASSWORD \"<new>\" REPLACE \"<current>\"")
+	}
+	if conn.PasswordExpired && alter.UserName != conn.User {
+		return nil, protocol.Errorf(protocol.ErrPasswordExpired, "the password of user '%s' has expired; change it before anything else", conn.User)
+	}
+
+	if err := s.users.ChangePassword(alter.UserName, alter.CurrentPassword, alter.Password, s.passwordPolicy); err != nil {
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			return nil, fmt.Errorf("the current password of user '%s' is wrong, or there is no such local user", alter.UserName)
+		}
+		return nil, err
+	}
+	if alter.UserName == conn.User {
+		conn.PasswordExpired = false
+	}
+	s.logger.Infow("Password changed", "connID", conn.ID, "user", alter.UserName)
+	return &engine.CommandResponse{
+		ResultCount: 1,
+		Result:      fmt.Sprintf("Password of user '%s' changed.", alter.UserName),
+	}, nil
+}
+
+// redactPasswords hides the passwords in connection strings and ALTER USER commands before
+// they are logged
+func redactPasswords(command string) string {
+	if strings.HasPrefix(command, "syndrdb://") {
+		if strings.Contains(command, "@") {
+			if parsed, err := url.Parse(command); err == nil {
+				return parsed.Redacted()
+			}
+		}
+		// The older form ends with the password, after the fourth ':' of the address
+		rest := strings.TrimPrefix(command, "syndrdb://")
+		if parts := strings.SplitN(rest, ":", 5); len(parts) == 5 {
+			return "syndrdb://" + strings.Join(parts[:4], ":") + ":xxxxx"
+		}
+		return "syndrdb://xxxxx"
+	}
+	fields := strings.Fields(command)
+	for i := 0; i+2 < len(fields); i++ {
+		if strings.EqualFold(fields[i], "ALTER") && strings.EqualFold(fields[i+1], "USER") {
+			return strings.Join(fields[:i+3], " ") + " PASSWORD xxxxx REPLACE xxxxx"
+		}
+	}
+	return command
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"runtime"
+	"strings"
+
+	"syndrdb/src/engine"
+	"syndrdb/src/settings"
+	"syndrdb/src/workers"
+)
+
+/*
+	Worker pools (see workers/pool.go).
+
+	A SELECT from a client runs on a worker of the query pool; once every worker is busy,
+	further SELECTs wait for one instead of all competing for the CPUs. Other commands do not
+	wait, so writes, transactions and SHOW WORKERS itself are answered while queries queue.
+	SELECTs the cluster user sends for another node's routed query skip the pool too: two
+	nodes busy with routed queries would otherwise wait on each other for good.
+*/
+
+// configureWorkers sizes the worker pools for the CPUs Go may use
+func configureWorkers(config *settings.Arguments) error {
+	return workers.Configure(workers.Sizes{
+		Query:            config.QueryWorkers,
+		IndexBuild:       config.IndexBuildWorkers,
+		BackgroundWriter: config.WriterWorkers,
+		CDCDispatcher:    config.CDCWorkers,
+	})
+}
+
+// takesQueryWorker reports whether a command waits for a worker of the query pool
+func (s *Server) takesQueryWorker(conn *Connection, command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "SELECT") {
+		return false
+	}
+	return s.topology == nil || conn.User != s.topology.Username
+}
+
+// workerStatus answers SHOW WORKERS
+func (s *Server) workerStatus() *engine.CommandResponse {
+	pools := workers.All()
+	stats := make([]workers.PoolStats, 0, len(pools))
+	for _, pool := range pools {
+		stats = append(stats, pool.Stats())
+	}
+	return &engine.CommandResponse{
+		ResultCount: len(stats),
+		Result: map[string]interface{}{
+			"CPUs":       runtime.NumCPU(),
+			"GOMAXPROCS": runtime.GOMAXPROCS(0),
+			"Pools":      stats,
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package settings
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+	Secrets.
+
+	Settings that hold secrets (the user store key, the TLS certificate and key, the admin
+	password) take a reference instead of the secret itself, so the secret never shows up in
+	ps or shell history:
+
+	  env:NAME    the value of the environment variable NAME
+	  file:PATH   the contents of the file PATH, without a trailing newline
+
+	Anything else is the secret itself, except for the TLS settings, where it is a file path
+	as before. Each secret is taken from, in order:
+
+	  1. its command line flag
+	  2. its environment variable (SecretEnvironment), holding the secret itself
+	  3. its default
+*/
+
+// SecretEnvironment maps the flags that hold secrets to the environment variables they fall
+// back to
+var SecretEnvironment = map[string]string{
+	"userstorekey":  "SYNDRDB_USER_STORE_KEY",
+	"tlscert":       "SYNDRDB_TLS_CERT",
+	"tlskey":        "SYNDRDB_TLS_KEY",
+	"adminpassword": "SYNDRDB_ADMIN_PASSWORD",
+}
+
+// ResolveSecret returns the secret a setting refers to
+func ResolveSecret(reference string) (string, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		name := strings.TrimPrefix(reference, "env:")
+		value, set := os.LookupEnv(name)
+		if !set {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(reference, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(reference, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("could not read secret: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return reference, nil
+}
+
+// LoadSecretFile returns the contents of a file-valued secret such as a PEM key: the
+// environment variable for env:, otherwise the file, with or without file:
+func LoadSecretFile(reference string) ([]byte, error) {
+	if strings.HasPrefix(reference, "env:") {
+		value, err := ResolveSecret(reference)
+		return []byte(value), err
+	}
+	return os.ReadFile(strings.TrimPrefix(reference, "file:"))
+}
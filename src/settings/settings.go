@@ -1,16 +1,29 @@
 package settings
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 type Arguments struct {
 	DataDir    string
 	LogDir     string
 	TempDir    string // Temporary directory for intermediate files/indexes/sorts
 	ConfigFile string
+	InitDir    string // *.syndrql scripts run on the first start, with an empty DataDir (see server/bootstrap.go)
 
 	CreateDefaultDB bool // Create default database if it doesn't exist
 	PrintToScreen   bool // Print to screen
 
+	Fsck       bool // Check the data files at startup, report and exit instead of serving
+	FsckRepair bool // With Fsck, repair what can be repaired
+
+	FuzzQueries int   // Rounds of the query fuzzer to run, report and exit instead of serving (see engine/query_fuzz.go)
+	FuzzSeed    int64 // Seed of the first round; 0 picks one from the clock
+
+	CrashTorture int   // Rounds of simulated crashes and recovery to run, report and exit instead of serving (see helpers/crash_simulation.go)
+	CrashSeed    int64 // Seed of the first round; 0 picks one from the clock
+
 	Debug     bool // Debug mode
 	UserDebug bool // User debug mode
 
@@ -18,25 +31,135 @@ type Arguments struct {
 	// standalone, cluster
 	Mode string
 
+	// Cluster mode only: this node's ID and the topology file listing peers and partition owners
+	NodeID            string
+	ClusterConfigFile string
+	MaxHintBytes      int64 // On-disk backlog kept per unreachable replica before it needs a full resync
+
 	// the host name or IP address to listen on
 	Host string
 
+	// Certificate and key for TLS; when set, every client connection is encrypted. Secret
+	// references, see secrets.go
+	TLSCertFile string
+	TLSKeyFile  string
+
 	// Add to Journal struct
 	MaxJournalFileSize int64
 
 	BundleBufferSize int // Size of the buffer for bundle reads
 
+	// Memory budgets in bytes; 0 derives them from the container's memory limit at startup
+	BufferPoolMemory int64 // Pages cached by the buffer pool, unless BundleBufferSize sets a page count
+	SortMemory       int64 // Memory each index build sorts its keys in before spilling to disk
+
+	HashFillFactor int // Percent of a hash index's bucket pages filled before it splits a bucket (see hash_index)
+
+	MaxCommandSize int64 // Largest command a client may send, in bytes
+
+	// Document limits for bundles that do not set their own; 0 disables each (see directors/document_limits.go)
+	MaxDocumentBytes  int64
+	MaxDocumentFields int
+	MaxDocumentDepth  int
+
+	// How database and bundle names are compared: insensitive (the default) or sensitive. Names
+	// keep the case they were created with either way (see helpers/identifiers.go)
+	IdentifierCase string
+
+	ReadOnly bool // Refuse every command that writes; ALTER SYSTEM SET read_only changes it while running
+
+	VersionRetention time.Duration // How long document versions are kept for AS OF queries and document history; 0 disables
+
+	RequestIDTTL       time.Duration // How long the outcome of a write sent with a request ID is remembered; 0 disables
+	SessionGracePeriod time.Duration // How long a disconnected client's session can be resumed; 0 disables
+
+	// Operator diagnostics (see server/diagnostics.go)
+	DiagnosticsAddr string // Address of the pprof and runtime stats endpoint; empty disables
+	DiagnosticsDir  string // Where DIAGNOSTICS DUMP writes support bundles and DIAGNOSTICS BUFFERPOOL TO FILE its snapshots
+
+	// Access log (see server/access_log.go)
+	AccessLogSampleRate  float64       // Share of fast, successful commands logged, 0 to 1
+	SlowRequestThreshold time.Duration // Commands at least this slow are always logged; 0 disables
+
+	DeadlockCheckInterval time.Duration // How often transactions waiting for document locks are checked for deadlocks; 0 disables
+	IndexUsageInterval    time.Duration // How often index usage counts are written to the data directory; 0 only at shutdown
+	PlanCacheSize         int           // Query plans cached per database and statements per server (see engine/plan_cache.go, engine/statement_cache.go); 0 disables
+
+	// Automatic ANALYZE of bundles whose documents changed enough (see directors/auto_analyze.go)
+	AutoAnalyzeInterval  time.Duration // How often bundles are looked at, give or take a fifth; 0 disables
+	AutoAnalyzeThreshold int           // Changed documents a bundle needs, besides AutoAnalyzeScale of its documents
+	AutoAnalyzeScale     float64       // Share of a bundle's documents that must change
+
+	// Change data capture: document writes are published to CDCSink (kafka:// or nats://) when set
+	CDCSink   string
+	CDCTopic  string // Topic or subject; {database} and {bundle} are filled in
+	CDCFormat string // json or avro
+
+	// When writes to bundle files are synced to disk (see engine/durability.go)
+	Durability   string        // ALWAYS, INTERVAL or OFF, for databases that set none
+	SyncInterval time.Duration // How often files written at INTERVAL are synced
+
+	// Write admission control; writes are refused with a retry-after hint past these limits. 0 disables each.
+	MaxDirtyRatio   float64       // Share of the buffer pool that may hold unflushed pages
+	MaxWriteLatency time.Duration // Average time to write a page to disk
+	MaxBundleWrites int           // Writes running at once against a single bundle
+
+	// Worker pools, each a count or a multiple of GOMAXPROCS such as "2x" (see workers/pool.go)
+	GoMaxProcs        int    // CPUs Go may use; 0 follows the container's CPU limit, or all CPUs without one
+	QueryWorkers      string // SELECT statements running at once
+	IndexBuildWorkers string // Goroutines encoding index keys, shared by every index build
+	WriterWorkers     string // Goroutines writing dirty pages back to disk
+	CDCWorkers        string // Change data capture delivery lanes
+
+	ResourceGroupsFile  string // JSON file of the resource groups workloads are shared out between; empty gives one unlimited group (see server/resource_groups.go)
+	MaskingPoliciesFile string // JSON file of the rules masking fields for some users; empty masks nothing (see server/masking.go)
+	ErasureSubjectsFile string // JSON file of the subjects ERASE SUBJECT erases; empty configures none (see directors/erasure.go)
+
 	// the port number to listen on
-	Port int
+	Port      int
+	ReusePort bool   // One SO_REUSEPORT listener and accept goroutine per CPU on Port, see server/accept.go
+	Socket    string // Unix domain socket listened on as well; empty disables (see server/socket.go)
+
+	// A second listener for administrative commands, which are then refused on Port; 0 disables
+	AdminHost string
+	AdminPort int
+
+	MongoPort int // MongoDB wire protocol listener on Host, for trying Mongo tools; 0 disables (see server/mongo.go)
+	GRPCPort  int // gRPC API listener on Host; 0 disables (see server/grpc.go)
 
 	// Strongly verbose logging
 	Verbose bool
 
 	AuthEnabled bool // Enable authentication
 
+	// Local users (see server/users.go)
+	UserStoreKey       string        // Encrypts the user store file; a secret reference, see secrets.go
+	AdminUser          string        // Added at the first start with auth, and the only user allowed SECRETS ROTATE
+	AdminPassword      string        // The admin's first password; a secret reference
+	PasswordMinLength  int           // Shortest password a user may set
+	PasswordMinClasses int           // Kinds of characters a password must mix: lower, upper, digit, other
+	MaxFailedLogins    int           // Wrong passwords in a row before an account locks; 0 never locks
+	LockoutDuration    time.Duration // How long a locked account stays locked
+	PasswordMaxAge     time.Duration // How long a password lasts before it must be changed; 0 forever
+
+	// Where credentials are checked, in order: local, ldap, oidc, peer (see auth/provider.go)
+	AuthProviders     string
+	LDAPURL           string // ldap:// or ldaps:// directory bound to as the user
+	LDAPUserDN        string // DN template; {username} is replaced by the user name
+	OIDCIssuer        string // Issuer of the JWT bearer tokens accepted as passwords
+	OIDCAudience      string // Audience the tokens must be issued for
+	OIDCJWKSURL       string // Signing keys; discovered from the issuer when empty
+	OIDCUsernameClaim string // Claim naming the user
+
 	Version string // Show version information
 }
 
+// Memory budgets without a container memory limit
+const (
+	DefaultBufferPoolMemory = 8 * 1024 * 1024
+	DefaultSortMemory       = 100 * 1024 * 1024
+)
+
 var (
 	instance *Arguments
 	once     sync.Once
@@ -48,16 +171,51 @@ func GetSettings() *Arguments {
 	once.Do(func() {
 		instance = &Arguments{
 			// Default values
-			DataDir:         "./data",
-			LogDir:          "",
-			ConfigFile:      "",
-			Mode:            "standalone",
-			Host:            "0.0.0.0",
-			Port:            27017,
-			Verbose:         false,
-			AuthEnabled:     false,
-			CreateDefaultDB: true,
-			Version:         "0.1.0",
+			DataDir:               "./data",
+			LogDir:                "",
+			ConfigFile:            "",
+			Mode:                  "standalone",
+			Host:                  "0.0.0.0",
+			Port:                  27017,
+			AdminHost:             "127.0.0.1",
+			Verbose:               false,
+			AuthEnabled:           false,
+			AuthProviders:         "local",
+			AdminUser:             "admin",
+			PasswordMinLength:     12,
+			PasswordMinClasses:    3,
+			MaxFailedLogins:       5,
+			LockoutDuration:       15 * time.Minute,
+			OIDCUsernameClaim:     "sub",
+			CreateDefaultDB:       true,
+			MaxCommandSize:        16 * 1024 * 1024,
+			MaxDocumentBytes:      16 * 1024 * 1024,
+			MaxDocumentFields:     1024,
+			MaxDocumentDepth:      32,
+			IdentifierCase:        "insensitive",
+			RequestIDTTL:          10 * time.Minute,
+			SessionGracePeriod:    5 * time.Minute,
+			AccessLogSampleRate:   0.01,
+			DiagnosticsDir:        "./diagnostics",
+			SlowRequestThreshold:  time.Second,
+			DeadlockCheckInterval: time.Second,
+			IndexUsageInterval:    time.Minute,
+			PlanCacheSize:         256,
+			AutoAnalyzeInterval:   time.Minute,
+			AutoAnalyzeThreshold:  500,
+			AutoAnalyzeScale:      0.1,
+			CDCTopic:              "syndrdb.{database}.{bundle}",
+			CDCFormat:             "json",
+			Durability:            "interval",
+			SyncInterval:          time.Second,
+			BufferPoolMemory:      DefaultBufferPoolMemory,
+			SortMemory:            DefaultSortMemory,
+			HashFillFactor:        75,
+			QueryWorkers:          "2x",
+			IndexBuildWorkers:     "1x",
+			WriterWorkers:         "1x",
+			CDCWorkers:            "1",
+			Version:               "0.1.0",
 		}
 	})
 	return instance
@@ -81,12 +239,117 @@ func UpdateSettings(args Arguments) {
 	if args.Mode != "" {
 		instance.Mode = args.Mode
 	}
+	if args.NodeID != "" {
+		instance.NodeID = args.NodeID
+	}
+	if args.ClusterConfigFile != "" {
+		instance.ClusterConfigFile = args.ClusterConfigFile
+	}
+	if args.MaxHintBytes != 0 {
+		instance.MaxHintBytes = args.MaxHintBytes
+	}
 	if args.Host != "" {
 		instance.Host = args.Host
 	}
+	if args.TLSCertFile != "" {
+		instance.TLSCertFile = args.TLSCertFile
+	}
+	if args.TLSKeyFile != "" {
+		instance.TLSKeyFile = args.TLSKeyFile
+	}
 	if args.Port != 0 {
 		instance.Port = args.Port
 	}
+	if args.Socket != "" {
+		instance.Socket = args.Socket
+	}
+	if args.ReusePort {
+		instance.ReusePort = args.ReusePort
+	}
+	if args.AdminHost != "" {
+		instance.AdminHost = args.AdminHost
+	}
+	if args.AdminPort != 0 {
+		instance.AdminPort = args.AdminPort
+	}
+	if args.MongoPort != 0 {
+		instance.MongoPort = args.MongoPort
+	}
+	if args.GRPCPort != 0 {
+		instance.GRPCPort = args.GRPCPort
+	}
+	if args.CDCSink != "" {
+		instance.CDCSink = args.CDCSink
+	}
+	if args.CDCTopic != "" {
+		instance.CDCTopic = args.CDCTopic
+	}
+	if args.CDCFormat != "" {
+		instance.CDCFormat = args.CDCFormat
+	}
+	if args.Durability != "" {
+		instance.Durability = args.Durability
+	}
+	if args.SyncInterval > 0 {
+		instance.SyncInterval = args.SyncInterval
+	}
+	if args.DiagnosticsAddr != "" {
+		instance.DiagnosticsAddr = args.DiagnosticsAddr
+	}
+	if args.DiagnosticsDir != "" {
+		instance.DiagnosticsDir = args.DiagnosticsDir
+	}
+	if args.UserStoreKey != "" {
+		instance.UserStoreKey = args.UserStoreKey
+	}
+	if args.AdminUser != "" {
+		instance.AdminUser = args.AdminUser
+	}
+	if args.AdminPassword != "" {
+		instance.AdminPassword = args.AdminPassword
+	}
+	if args.PasswordMinLength != 0 {
+		instance.PasswordMinLength = args.PasswordMinLength
+	}
+	if args.PasswordMinClasses != 0 {
+		instance.PasswordMinClasses = args.PasswordMinClasses
+	}
+	if args.MaxFailedLogins != 0 {
+		instance.MaxFailedLogins = args.MaxFailedLogins
+	}
+	if args.LockoutDuration != 0 {
+		instance.LockoutDuration = args.LockoutDuration
+	}
+	if args.PasswordMaxAge != 0 {
+		instance.PasswordMaxAge = args.PasswordMaxAge
+	}
+	if args.AuthProviders != "" {
+		instance.AuthProviders = args.AuthProviders
+	}
+	if args.LDAPURL != "" {
+		instance.LDAPURL = args.LDAPURL
+	}
+	if args.LDAPUserDN != "" {
+		instance.LDAPUserDN = args.LDAPUserDN
+	}
+	if args.OIDCIssuer != "" {
+		instance.OIDCIssuer = args.OIDCIssuer
+	}
+	if args.OIDCAudience != "" {
+		instance.OIDCAudience = args.OIDCAudience
+	}
+	if args.OIDCJWKSURL != "" {
+		instance.OIDCJWKSURL = args.OIDCJWKSURL
+	}
+	if args.OIDCUsernameClaim != "" {
+		instance.OIDCUsernameClaim = args.OIDCUsernameClaim
+	}
+	if args.MaxCommandSize != 0 {
+		instance.MaxCommandSize = args.MaxCommandSize
+	}
+	if args.IdentifierCase != "" {
+		instance.IdentifierCase = args.IdentifierCase
+	}
 
 	if args.CreateDefaultDB {
 		instance.CreateDefaultDB = args.CreateDefaultDB
@@ -94,6 +357,56 @@ func UpdateSettings(args Arguments) {
 	// Boolean flags need special handling since false is a valid value
 	instance.Verbose = args.Verbose
 	instance.AuthEnabled = args.AuthEnabled
+	instance.ReadOnly = args.ReadOnly
+	// Zero turns request IDs, sessions, access log sampling, deadlock checks, the plan cache, automatic ANALYZE, admission, document limits and version retention off, so these are copied as well
+	instance.RequestIDTTL = args.RequestIDTTL
+	instance.VersionRetention = args.VersionRetention
+	instance.SessionGracePeriod = args.SessionGracePeriod
+	instance.AccessLogSampleRate = args.AccessLogSampleRate
+	instance.SlowRequestThreshold = args.SlowRequestThreshold
+	instance.DeadlockCheckInterval = args.DeadlockCheckInterval
+	instance.IndexUsageInterval = args.IndexUsageInterval
+	instance.PlanCacheSize = args.PlanCacheSize
+	instance.AutoAnalyzeInterval = args.AutoAnalyzeInterval
+	instance.AutoAnalyzeThreshold = args.AutoAnalyzeThreshold
+	instance.AutoAnalyzeScale = args.AutoAnalyzeScale
+	instance.MaxDocumentBytes = args.MaxDocumentBytes
+	instance.MaxDocumentFields = args.MaxDocumentFields
+	instance.MaxDocumentDepth = args.MaxDocumentDepth
+	instance.MaxDirtyRatio = args.MaxDirtyRatio
+	instance.MaxWriteLatency = args.MaxWriteLatency
+	instance.MaxBundleWrites = args.MaxBundleWrites
+	instance.GoMaxProcs = args.GoMaxProcs
+	if args.BufferPoolMemory > 0 {
+		instance.BufferPoolMemory = args.BufferPoolMemory
+	}
+	if args.SortMemory > 0 {
+		instance.SortMemory = args.SortMemory
+	}
+	if args.HashFillFactor > 0 {
+		instance.HashFillFactor = args.HashFillFactor
+	}
+	if args.QueryWorkers != "" {
+		instance.QueryWorkers = args.QueryWorkers
+	}
+	if args.IndexBuildWorkers != "" {
+		instance.IndexBuildWorkers = args.IndexBuildWorkers
+	}
+	if args.WriterWorkers != "" {
+		instance.WriterWorkers = args.WriterWorkers
+	}
+	if args.CDCWorkers != "" {
+		instance.CDCWorkers = args.CDCWorkers
+	}
+	if args.ResourceGroupsFile != "" {
+		instance.ResourceGroupsFile = args.ResourceGroupsFile
+	}
+	if args.MaskingPoliciesFile != "" {
+		instance.MaskingPoliciesFile = args.MaskingPoliciesFile
+	}
+	if args.ErasureSubjectsFile != "" {
+		instance.ErasureSubjectsFile = args.ErasureSubjectsFile
+	}
 
 	if args.Version != "" {
 		instance.Version = args.Version
@@ -0,0 +1,114 @@
+// Package syndrtest runs SyndrQL commands through the engine's directors on in-memory
+// stores, for tests of the engine and of programs built on it.
+package syndrtest
+
+import (
+	"fmt"
+	"os"
+	"syndrdb/src/directors"
+	"syndrdb/src/engine"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+	"syndrdb/src/settings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Test harness.
+
+	A Harness builds a DatabaseService and BundleService of its own on the in-memory stores
+	(see stores.go) and runs commands with directors.CommandDirector, the way the server runs
+	a client's commands, but without a listener, a connection or the ServiceManager
+	singleton, so a test can make as many as it needs:
+
+	    h, err := syndrtest.New(t.TempDir())
+	    ...
+	    h.MustExecute(t, `CREATE DATABASE "shop";`)
+	    h.MustExecute(t, `USE "shop";`)
+	    h.MustExecute(t, `ADD DOCUMENT TO BUNDLE "Orders" WITH ({"Total" = $1});`, 100)
+
+	The directory given holds what still goes to disk: the catalog log and the placeholder
+	files of catalog changes, and index files. Transactions, authentication and the rest of
+	what the server does around the directors need the server, or src/embedded in process.
+*/
+
+// Harness runs commands on services of its own. It is not safe for concurrent use.
+type Harness struct {
+	Settings      *settings.Arguments
+	DatabaseStore *MemoryDatabaseStore
+	BundleStore   *MemoryBundleStore
+	Services      directors.ServiceManager
+	Database      *models.Database // The one USE selected, nil before
+	logger        *zap.SugaredLogger
+}
+
+// New returns a Harness with the default settings, keeping its files in dir
+func New(dir string) (*Harness, error) {
+	config := *settings.GetSettings()
+	config.DataDir = dir
+	// Nothing runs in the background unless asked for
+	config.DeadlockCheckInterval = 0
+	config.IndexUsageInterval = 0
+	return NewWith(&config, zap.NewNop().Sugar())
+}
+
+// NewWith returns a Harness with the settings given, keeping its files in config.DataDir
+func NewWith(config *settings.Arguments, logger *zap.SugaredLogger) (*Harness, error) {
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	catalog, err := engine.OpenCatalogWAL(config.DataDir, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog log: %w", err)
+	}
+
+	h := &Harness{
+		Settings:      config,
+		DatabaseStore: NewMemoryDatabaseStore(),
+		BundleStore:   NewMemoryBundleStore(config.DataDir),
+		logger:        logger,
+	}
+	h.Services = directors.ServiceManager{
+		DatabaseService: directors.NewDatabaseService(h.DatabaseStore, engine.NewDatabaseFactory(), catalog, config, logger),
+		BundleService:   directors.NewBundleService(h.BundleStore, engine.NewBundleFactory(), engine.NewDocumentFactory(), logger, config),
+		Statements:      engine.NewStatementCache(config.PlanCacheSize),
+		User:            config.AdminUser,
+	}
+	return h, nil
+}
+
+// Execute runs a command, binding params to its $1, $2, ... (see engine/parameters.go). USE
+// selects the database later commands run in.
+func (h *Harness) Execute(command string, params ...interface{}) (interface{}, error) {
+	if len(params) > 0 {
+		bound, err := engine.BindParameters(command, params)
+		if err != nil {
+			return nil, err
+		}
+		command = bound
+	}
+
+	if statement, err := engine.ParseStatement(command); err == nil {
+		if use, ok := statement.(*engine.UseDatabaseCommand); ok {
+			database, err := h.Services.DatabaseService.GetDatabaseByName(use.DatabaseName)
+			if err != nil {
+				return nil, protocol.Errorf(protocol.ErrDatabaseNotFound, "database '%s' does not exist", use.DatabaseName)
+			}
+			h.Database = database
+			return &engine.CommandResponse{ResultCount: 1, Result: fmt.Sprintf("Using database '%s'.", database.Name)}, nil
+		}
+	}
+	return directors.CommandDirector(h.Database, h.Services, command, h.logger)
+}
+
+// MustExecute runs a command as Execute does, failing the test when it fails
+func (h *Harness) MustExecute(tb testing.TB, command string, params ...interface{}) interface{} {
+	tb.Helper()
+	result, err := h.Execute(command, params...)
+	if err != nil {
+		tb.Fatalf("%s: %v", command, err)
+	}
+	return result
+}
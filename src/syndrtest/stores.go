@@ -0,0 +1,229 @@
+package syndrtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syndrdb/src/engine"
+	"syndrdb/src/helpers"
+	"syndrdb/src/models"
+	"syndrdb/src/protocol"
+)
+
+/*
+	In-memory stores.
+
+	MemoryDatabaseStore and MemoryBundleStore implement engine.DatabaseStore and
+	engine.BundleStore with maps, so DatabaseService and BundleService can run without the
+	file formats, the buffer pool or a data directory full of bundle files.
+
+	Catalog changes (creating and deleting bundles, see engine/catalog_wal.go) still write
+	the files the stores encode for them, and a bundle exists while its file does, as it
+	does on disk. The stores encode placeholders that name the database or bundle; the
+	database or bundle itself is kept in memory when it is encoded.
+*/
+
+// MemoryDatabaseStore keeps databases in memory. It is safe for concurrent use.
+type MemoryDatabaseStore struct {
+	mu        sync.Mutex
+	databases map[string]*models.Database // By DatabaseID
+}
+
+// NewMemoryDatabaseStore returns an empty MemoryDatabaseStore
+func NewMemoryDatabaseStore() *MemoryDatabaseStore {
+	return &MemoryDatabaseStore{databases: make(map[string]*models.Database)}
+}
+
+func (m *MemoryDatabaseStore) save(database *models.Database) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.databases[database.DatabaseID] = database
+}
+
+// LoadAllDatabaseDataFiles returns every database stored, by ID
+func (m *MemoryDatabaseStore) LoadAllDatabaseDataFiles(ctx context.Context, dataRootDir string) (map[string]*models.Database, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	databases := make(map[string]*models.Database, len(m.databases))
+	for id, database := range m.databases {
+		databases[id] = database
+	}
+	return databases, nil
+}
+
+// LoadDatabaseDataFile returns the database stored under a database file name
+func (m *MemoryDatabaseStore) LoadDatabaseDataFile(ctx context.Context, dataRootDir, fileName string) (*models.Database, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, database := range m.databases {
+		if helpers.DatabaseFileName(database.Name) == fileName {
+			return database, nil
+		}
+	}
+	return nil, protocol.Errorf(protocol.ErrDatabaseNotFound, "database file %s does not exist", fileName)
+}
+
+// LoadDatabaseIntoMemory returns the database stored under a name, with no file contents
+func (m *MemoryDatabaseStore) LoadDatabaseIntoMemory(ctx context.Context, database *models.Database, databaseName string) (*[]byte, *models.Database, error) {
+	database, err := m.LoadDatabaseDataFile(ctx, "", helpers.DatabaseFileName(databaseName))
+	return nil, database, err
+}
+
+func (m *MemoryDatabaseStore) CreateDatabaseDataFile(database *models.Database) error {
+	m.save(database)
+	return nil
+}
+
+func (m *MemoryDatabaseStore) UpdateDatabaseDataFile(database *models.Database) error {
+	m.save(database)
+	return nil
+}
+
+// EncodeDatabaseFile stores the database and returns a placeholder for its file
+func (m *MemoryDatabaseStore) EncodeDatabaseFile(database *models.Database) ([]byte, error) {
+	m.save(database)
+	return []byte(fmt.Sprintf("syndrtest database %s\n", database.Name)), nil
+}
+
+// MemoryBundleStore keeps bundles and their documents in memory. It is safe for concurrent
+// use; the documents are the bundles' own, which BundleService changes in place.
+type MemoryBundleStore struct {
+	paths   *helpers.PathResolver
+	mu      sync.Mutex
+	bundles map[string]*models.Bundle // By name
+}
+
+// NewMemoryBundleStore returns an empty MemoryBundleStore. Bundles exist while their files
+// in dataDir do, which catalog changes write and remove.
+func NewMemoryBundleStore(dataDir string) *MemoryBundleStore {
+	return &MemoryBundleStore{paths: helpers.NewPathResolver(dataDir), bundles: make(map[string]*models.Bundle)}
+}
+
+func (m *MemoryBundleStore) save(bundle *models.Bundle) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bundles[bundle.Name] = bundle
+}
+
+// LoadAllBundleDataFiles returns every bundle that exists, by name
+func (m *MemoryBundleStore) LoadAllBundleDataFiles(ctx context.Context, dataRootDir string) (map[string]*models.Bundle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bundles := make(map[string]*models.Bundle, len(m.bundles))
+	for name, bundle := range m.bundles {
+		if m.fileExists(name) {
+			bundles[name] = bundle
+		}
+	}
+	return bundles, nil
+}
+
+// LoadBundleDataFile returns the bundle stored under a bundle file name
+func (m *MemoryBundleStore) LoadBundleDataFile(ctx context.Context, database *models.Database, fileName string) (*models.Bundle, error) {
+	name := helpers.BundleNameFromFile(fileName)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bundle, exists := m.bundles[name]
+	if !exists || !m.fileExists(name) {
+		return nil, protocol.Errorf(protocol.ErrBundleNotFound, "bundle file %s does not exist", fileName)
+	}
+	bundle.Database = database
+	return bundle, nil
+}
+
+// LoadBundleIntoMemory returns the bundle stored under a name, with no file contents
+func (m *MemoryBundleStore) LoadBundleIntoMemory(ctx context.Context, database *models.Database, bundleName string) (*[]byte, *models.Bundle, error) {
+	bundle, err := m.LoadBundleDataFile(ctx, database, helpers.BundleFileName(bundleName))
+	return nil, bundle, err
+}
+
+// CreateBundleFile stores a new bundle and writes its placeholder file
+func (m *MemoryBundleStore) CreateBundleFile(database *models.Database, bundle *models.Bundle) error {
+	if m.BundleFileExists(bundle.Name) {
+		return protocol.Errorf(protocol.ErrAlreadyExists, "Bundle %s already exists", bundle.Name)
+	}
+	files, err := m.EncodeBundleFiles(bundle)
+	if err != nil {
+		return err
+	}
+	for fileName, data := range files {
+		path := m.paths.Path(fileName)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBundleStore) UpdateBundleFile(database *models.Database, bundle *models.Bundle) error {
+	m.save(bundle)
+	return nil
+}
+
+// UpdateDocumentDataInBundleFile does nothing; documents live in their bundles
+func (m *MemoryBundleStore) UpdateDocumentDataInBundleFile(database *models.Database, bundle *models.Bundle, documentID string, updatedDocument map[string]interface{}, mmapData []byte) error {
+	return nil
+}
+
+// UpdateDocumentInBundleFile does nothing; documents live in their bundles
+func (m *MemoryBundleStore) UpdateDocumentInBundleFile(bundle *models.Bundle, document *models.Document) error {
+	return nil
+}
+
+// DeleteDocumentFromBundleFile removes a document from its bundle
+func (m *MemoryBundleStore) DeleteDocumentFromBundleFile(bundle *models.Bundle, documentID string) error {
+	if bundle == nil {
+		return fmt.Errorf("bundle cannot be nil")
+	}
+	delete(bundle.Documents, documentID)
+	return nil
+}
+
+// AddDocumentToBundleFile does nothing; documents live in their bundles
+func (m *MemoryBundleStore) AddDocumentToBundleFile(bundle *models.Bundle, document *models.Document) error {
+	return nil
+}
+
+// RemoveDocumentFromBundleFile removes a document from its bundle
+func (m *MemoryBundleStore) RemoveDocumentFromBundleFile(database *models.Database, bundle *models.Bundle, documentID string, mmapData []byte) error {
+	return m.DeleteDocumentFromBundleFile(bundle, documentID)
+}
+
+func (m *MemoryBundleStore) BundleFileExists(bundleName string) bool {
+	return m.fileExists(bundleName)
+}
+
+// RemoveBundleFile forgets a bundle and removes its placeholder file
+func (m *MemoryBundleStore) RemoveBundleFile(database *models.Database, bundleName string) error {
+	m.mu.Lock()
+	delete(m.bundles, bundleName)
+	m.mu.Unlock()
+	if err := os.Remove(m.paths.BundleFile(bundleName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// EncodeBundleFiles stores the bundle and returns a placeholder for its file
+func (m *MemoryBundleStore) EncodeBundleFiles(bundle *models.Bundle) (map[string][]byte, error) {
+	m.save(bundle)
+	return map[string][]byte{
+		helpers.BundleFileName(bundle.Name): []byte(fmt.Sprintf("syndrtest bundle %s\n", bundle.Name)),
+	}, nil
+}
+
+// fileExists reports whether a bundle's placeholder file is there
+func (m *MemoryBundleStore) fileExists(bundleName string) bool {
+	_, err := os.Stat(m.paths.BundleFile(bundleName))
+	return err == nil
+}
+
+var (
+	_ engine.DatabaseStore = (*MemoryDatabaseStore)(nil)
+	_ engine.BundleStore   = (*MemoryBundleStore)(nil)
+)
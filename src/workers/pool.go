@@ -0,0 +1,280 @@
+package workers
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Worker pools.
+
+	The work the server spreads over goroutines is bounded by a few shared pools, each sized by
+	a setting that is either a count ("8") or a multiple of the CPUs Go may use ("2x", "0.5x"),
+	so the server sizes itself to a CPU-limited container as well as to a whole machine:
+
+	  - query: SELECT statements running at once; more wait for a free worker
+	  - index_build: goroutines encoding the keys of the indexes being built, shared by every build
+	  - background_writer: goroutines writing dirty pages of the buffer pool back to disk
+	  - cdc_dispatcher: delivery lanes of change data capture, each with its own connection to
+	    the sink
+
+	Tasks may name the class they belong to and its share (AcquireShare). While tasks wait, a
+	freed worker goes to the class that has been given the fewest workers for its share, so a
+	class with share 4 is given about four workers for every one of a class with share 1 while
+	both have work waiting; tasks of one class start in the order they came. A class that
+	comes back after running nothing starts level with the others rather than owed for the
+	time it was idle. The query pool is shared this way
+	between resource groups, see server/resource_groups.go.
+
+	SHOW WORKERS reports each pool's size, how many of its workers are busy and how many tasks
+	wait, the tasks it ran and the share of its capacity it has used since the server started.
+*/
+
+const (
+	PoolQuery            = "query"
+	PoolIndexBuild       = "index_build"
+	PoolBackgroundWriter = "background_writer"
+	PoolCDCDispatcher    = "cdc_dispatcher"
+)
+
+// Default sizes, see ParseSize
+const (
+	DefaultQueryWorkers      = "2x"
+	DefaultIndexBuildWorkers = "1x"
+	DefaultWriterWorkers     = "1x"
+	DefaultCDCWorkers        = "1"
+)
+
+// The server's pools, sized from the defaults until Configure is called
+var (
+	Query            = NewPool(PoolQuery, mustSize(DefaultQueryWorkers))
+	IndexBuild       = NewPool(PoolIndexBuild, mustSize(DefaultIndexBuildWorkers))
+	BackgroundWriter = NewPool(PoolBackgroundWriter, mustSize(DefaultWriterWorkers))
+	CDCDispatcher    = NewPool(PoolCDCDispatcher, mustSize(DefaultCDCWorkers))
+)
+
+// ParseSize turns a pool size setting into a number of workers: a positive count, or a
+// positive multiple of GOMAXPROCS written with an x, which rounds to at least one worker
+func ParseSize(spec string) (int, error) {
+	spec = strings.TrimSpace(spec)
+	if multiple, ok := strings.CutSuffix(strings.ToLower(spec), "x"); ok {
+		factor, err := strconv.ParseFloat(multiple, 64)
+		if err != nil || factor <= 0 || math.IsInf(factor, 0) {
+			return 0, fmt.Errorf("invalid worker count '%s' (must be a positive number, or a positive multiple of the CPUs such as 2x)", spec)
+		}
+		return max(1, int(math.Round(factor*float64(runtime.GOMAXPROCS(0))))), nil
+	}
+	count, err := strconv.Atoi(spec)
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("invalid worker count '%s' (must be a positive number, or a positive multiple of the CPUs such as 2x)", spec)
+	}
+	return count, nil
+}
+
+func mustSize(spec string) int {
+	size, err := ParseSize(spec)
+	if err != nil {
+		panic(err)
+	}
+	return size
+}
+
+// Sizes are the settings of the server's pools, as ParseSize reads them
+type Sizes struct {
+	Query            string
+	IndexBuild       string
+	BackgroundWriter string
+	CDCDispatcher    string
+}
+
+// Configure resizes the server's pools; a setting left empty keeps its pool's size
+func Configure(sizes Sizes) error {
+	for _, setting := range []struct {
+		pool *Pool
+		spec string
+	}{
+		{Query, sizes.Query},
+		{IndexBuild, sizes.IndexBuild},
+		{BackgroundWriter, sizes.BackgroundWriter},
+		{CDCDispatcher, sizes.CDCDispatcher},
+	} {
+		if setting.spec == "" {
+			continue
+		}
+		size, err := ParseSize(setting.spec)
+		if err != nil {
+			return fmt.Errorf("%s workers: %w", setting.pool.name, err)
+		}
+		setting.pool.Resize(size)
+	}
+	return nil
+}
+
+// All returns the server's pools in the order SHOW WORKERS lists them
+func All() []*Pool {
+	return []*Pool{Query, IndexBuild, BackgroundWriter, CDCDispatcher}
+}
+
+// Pool hands out a bounded number of workers; Acquire waits while all of them are busy
+type Pool struct {
+	name    string
+	created time.Time
+
+	mu        sync.Mutex
+	freed     *sync.Cond
+	size      int
+	busy      int
+	waiting   int
+	completed uint64
+	busyTime  time.Duration // Spent by tasks that finished
+	startSum  time.Duration // Start times of the running tasks since created, added up
+
+	classes map[string]*shareClass // Classes with tasks running or waiting
+	tickets uint64                 // Handed to waiting tasks in the order they came
+	pass    float64                // Pass of the class last given a worker
+}
+
+// shareClass is the running and waiting tasks of one class, see AcquireShare
+type shareClass struct {
+	share   int
+	busy    int
+	waiting []uint64 // Tickets of the waiting tasks, oldest first
+	pass    float64  // Workers given to the class, each counting 1/share
+}
+
+func NewPool(name string, size int) *Pool {
+	pool := &Pool{name: name, size: max(1, size), created: time.Now(), classes: make(map[string]*shareClass)}
+	pool.freed = sync.NewCond(&pool.mu)
+	return pool
+}
+
+// Name returns the pool's name
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Size returns how many workers the pool has
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// Resize changes how many workers the pool has. Tasks already running keep theirs.
+func (p *Pool) Resize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size = max(1, size)
+	p.freed.Broadcast()
+}
+
+// Acquire waits for a free worker and takes it. Call the returned release once the task is
+// done; calling it again does nothing.
+func (p *Pool) Acquire() (release func()) {
+	return p.AcquireShare("", 1)
+}
+
+// AcquireShare is Acquire for a task of the named class, which is given free workers in
+// proportion to share while other classes' tasks wait too
+func (p *Pool) AcquireShare(class string, share int) (release func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tasks := p.classes[class]
+	if tasks == nil {
+		tasks = &shareClass{pass: p.pass}
+		p.classes[class] = tasks
+	}
+	tasks.share = max(1, share)
+	if p.busy >= p.size || p.waiting > 0 {
+		p.tickets++
+		ticket := p.tickets
+		tasks.waiting = append(tasks.waiting, ticket)
+		p.waiting++
+		for p.busy >= p.size || p.nextTicket() != ticket {
+			p.freed.Wait()
+		}
+		tasks.waiting = tasks.waiting[1:]
+		p.waiting--
+		// Another worker may be free for the next task in line
+		p.freed.Broadcast()
+	}
+	p.busy++
+	tasks.busy++
+	tasks.pass += 1 / float64(tasks.share)
+	p.pass = tasks.pass
+	started := time.Since(p.created)
+	p.startSum += started
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.busy--
+			p.completed++
+			p.startSum -= started
+			p.busyTime += time.Since(p.created) - started
+			if tasks.busy--; tasks.busy == 0 && len(tasks.waiting) == 0 {
+				delete(p.classes, class)
+			}
+			p.freed.Broadcast()
+		})
+	}
+}
+
+// nextTicket returns the ticket of the task the next free worker goes to: the oldest of the
+// waiting class with the lowest pass
+func (p *Pool) nextTicket() uint64 {
+	var next *shareClass
+	for _, tasks := range p.classes {
+		if len(tasks.waiting) == 0 {
+			continue
+		}
+		if next == nil {
+			next = tasks
+			continue
+		}
+		if tasks.pass < next.pass || (tasks.pass == next.pass && tasks.waiting[0] < next.waiting[0]) {
+			next = tasks
+		}
+	}
+	if next == nil {
+		return 0
+	}
+	return next.waiting[0]
+}
+
+// PoolStats is a pool's row of SHOW WORKERS
+type PoolStats struct {
+	Pool        string
+	Workers     int
+	Busy        int     // Workers running a task now
+	Waiting     int     // Tasks waiting for a worker
+	Completed   uint64  // Tasks finished since the server started
+	Utilization float64 // Share of the workers' time spent on tasks since the server started, 0 to 1
+}
+
+// Stats returns the pool's current figures
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := time.Since(p.created)
+	busy := p.busyTime + time.Duration(p.busy)*elapsed - p.startSum
+	utilization := 0.0
+	if elapsed > 0 {
+		utilization = min(1, busy.Seconds()/(elapsed.Seconds()*float64(p.size)))
+	}
+	return PoolStats{
+		Pool:        p.name,
+		Workers:     p.size,
+		Busy:        p.busy,
+		Waiting:     p.waiting,
+		Completed:   p.completed,
+		Utilization: math.Round(utilization*10000) / 10000,
+	}
+}